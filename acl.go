@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+)
+
+// contentAccessGrant shares a content with a user other than its owner, for
+// contents with util.ContentAccessShared access
+type contentAccessGrant struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Content   uint `gorm:"uniqueIndex:idx_content_access_grant"`
+	UserID    uint `gorm:"uniqueIndex:idx_content_access_grant;index"`
+}
+
+func validContentAccess(access string) bool {
+	switch access {
+	case util.ContentAccessOwner, util.ContentAccessShared, util.ContentAccessPublic:
+		return true
+	default:
+		return false
+	}
+}
+
+// contentIsPublic reports whether anyone may see a content, which contents
+// added before access control existed and have no access set may
+func contentIsPublic(cont Content) bool {
+	return cont.Access == "" || cont.Access == util.ContentAccessPublic
+}
+
+// canAccessContent reports whether u may see cont, its deals and its data. u
+// is nil for requests made without a token, which may only see public
+// contents. Admins may see every content.
+//
+// Shuttles serve contents through their gateways only with a grant from us,
+// see util.GatewayGrant, and the retrieval provider serves public contents
+// only, see retrievalAllowed. Blocks served over bitswap aren't access
+// controlled, and deals are public on chain.
+func canAccessContent(db *gorm.DB, u *User, cont Content) (bool, error) {
+	if contentIsPublic(cont) {
+		return true, nil
+	}
+
+	if u == nil {
+		return false, nil
+	}
+
+	if cont.UserID == u.ID || u.Perm >= util.PermLevelAdmin {
+		return true, nil
+	}
+
+	if cont.Access != util.ContentAccessShared {
+		return false, nil
+	}
+
+	var n int64
+	if err := db.Model(contentAccessGrant{}).Where("content = ? and user_id = ?", cont.ID, u.ID).Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// accessibleContents scopes a query on contents to the ones u may see, see
+// canAccessContent
+func accessibleContents(db *gorm.DB, u *User) *gorm.DB {
+	public := []string{"", util.ContentAccessPublic}
+
+	if u == nil {
+		return db.Where("(coalesce(contents.access, '') in ?)", public)
+	}
+
+	if u.Perm >= util.PermLevelAdmin {
+		return db
+	}
+
+	return db.Where("(contents.user_id = ? or coalesce(contents.access, '') in ? or (contents.access = ? and contents.id in (?)))",
+		u.ID, public, util.ContentAccessShared,
+		db.Session(&gorm.Session{NewDB: true}).Model(contentAccessGrant{}).Select("content").Where("user_id = ?", u.ID),
+	)
+}
+
+// contentsForCid scopes a query on contents to the ones whose root is c,
+// matching either cid version
+func contentsForCid(db *gorm.DB, c cid.Cid) *gorm.DB {
+	v0 := cid.NewCidV0(c.Hash())
+	v1 := cid.NewCidV1(c.Prefix().Codec, c.Hash())
+	return db.Where("(contents.cid = ? or contents.cid = ?)", v0.Bytes(), v1.Bytes())
+}
+
+// contentsHoldingCid scopes a query to the active contents whose dag holds c,
+// as its root or any other block
+func contentsHoldingCid(db *gorm.DB, c cid.Cid) *gorm.DB {
+	v0 := cid.NewCidV0(c.Hash())
+	v1 := cid.NewCidV1(c.Prefix().Codec, c.Hash())
+
+	objects := db.Session(&gorm.Session{NewDB: true}).Model(Object{}).Select("id").Where("cid = ? or cid = ?", v0.Bytes(), v1.Bytes())
+	refs := db.Session(&gorm.Session{NewDB: true}).Model(ObjRef{}).Select("content").Where("object in (?)", objects)
+
+	return db.Model(Content{}).Where("contents.active and (contents.cid = ? or contents.cid = ? or contents.id in (?))", v0.Bytes(), v1.Bytes(), refs)
+}
+
+// retrievalAllowed reports whether the retrieval provider may serve the dag
+// under root, which it may when a public content holds it. Retrievals come
+// without a user, see node.RetrievalAllowFunc.
+func (cm *ContentManager) retrievalAllowed(ctx context.Context, root cid.Cid) (bool, error) {
+	var n int64
+	if err := contentsHoldingCid(cm.DB.WithContext(ctx), root).Where("coalesce(contents.access, '') in ?", []string{"", util.ContentAccessPublic}).Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// setContentAccess sets the access of a content, and of the parts it was
+// split into, and replaces the users it's shared with by users
+func setContentAccess(db *gorm.DB, cont Content, access string, users []uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		if err := tx.Model(Content{}).Where("id = ? or (dag_split and (aggregated_in = ? or split_from = ?))", cont.ID, cont.ID, cont.ID).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(Content{}).Where("id in ?", ids).UpdateColumn("access", access).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("content in ?", ids).Delete(&contentAccessGrant{}).Error; err != nil {
+			return err
+		}
+
+		if access != util.ContentAccessShared {
+			return nil
+		}
+
+		var grants []contentAccessGrant
+		for _, id := range ids {
+			for _, u := range users {
+				grants = append(grants, contentAccessGrant{Content: id, UserID: u})
+			}
+		}
+
+		if len(grants) == 0 {
+			return nil
+		}
+		return tx.Create(&grants).Error
+	})
+}
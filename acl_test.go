@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestContentAccess(t *testing.T) {
+	db := newTestDB(t, &Content{}, &contentAccessGrant{}, &Object{}, &ObjRef{})
+
+	owner := &User{Model: gorm.Model{ID: 1}}
+	friend := &User{Model: gorm.Model{ID: 2}}
+	other := &User{Model: gorm.Model{ID: 3}}
+	admin := &User{Model: gorm.Model{ID: 4}, Perm: util.PermLevelAdmin}
+
+	objs := makeTestObjects(t, 4)
+	for i, access := range []string{util.ContentAccessOwner, util.ContentAccessShared, util.ContentAccessPublic, ""} {
+		require.NoError(t, db.Create(&Content{
+			Cid:    objs[i].Cid,
+			UserID: owner.ID,
+			Active: true,
+			Access: access,
+		}).Error)
+	}
+
+	var shared Content
+	require.NoError(t, db.First(&shared, "id = ?", 2).Error)
+	require.NoError(t, setContentAccess(db, shared, util.ContentAccessShared, []uint{friend.ID}))
+
+	// contents from before access control have none, not even an empty one
+	require.NoError(t, db.Exec("update contents set access = null where id = 4").Error)
+
+	visible := func(u *User) []uint {
+		var ids []uint
+		require.NoError(t, accessibleContents(db.Model(Content{}), u).Order("id").Pluck("id", &ids).Error)
+		return ids
+	}
+
+	require.Equal(t, []uint{1, 2, 3, 4}, visible(owner))
+	require.Equal(t, []uint{1, 2, 3, 4}, visible(admin))
+	require.Equal(t, []uint{2, 3, 4}, visible(friend))
+	require.Equal(t, []uint{3, 4}, visible(other))
+	require.Equal(t, []uint{3, 4}, visible(nil))
+
+	var contents []Content
+	require.NoError(t, db.Order("id").Find(&contents).Error)
+	for _, u := range []*User{owner, friend, other, admin, nil} {
+		for _, cont := range contents {
+			ok, err := canAccessContent(db, u, cont)
+			require.NoError(t, err)
+			require.Equal(t, containsID(visible(u), cont.ID), ok, "user %v content %d", u, cont.ID)
+		}
+	}
+
+	// a content's data is held by the objects it references
+	require.NoError(t, db.Create(objs[0]).Error)
+	require.NoError(t, db.Create(&ObjRef{Content: 3, Object: objs[0].ID}).Error)
+
+	held := func(u *User) []uint {
+		var ids []uint
+		require.NoError(t, accessibleContents(contentsHoldingCid(db, objs[0].Cid.CID), u).Order("id").Pluck("id", &ids).Error)
+		return ids
+	}
+	require.Equal(t, []uint{1, 3}, held(owner))
+	require.Equal(t, []uint{3}, held(nil))
+
+	// retrievals are served for data held by public contents only
+	cm := &ContentManager{DB: db}
+	for i, want := range []bool{true, false, true, true} {
+		ok, err := cm.retrievalAllowed(context.Background(), objs[i].Cid.CID)
+		require.NoError(t, err)
+		require.Equal(t, want, ok, "object %d", i)
+	}
+
+	// sharing with nobody else leaves the content to its owner
+	require.NoError(t, setContentAccess(db, shared, util.ContentAccessOwner, nil))
+	require.Equal(t, []uint{3, 4}, visible(friend))
+
+	var grants int64
+	require.NoError(t, db.Model(contentAccessGrant{}).Count(&grants).Error)
+	require.Zero(t, grants)
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
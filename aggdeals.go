@@ -0,0 +1,80 @@
+package main
+
+import (
+	"gorm.io/gorm"
+)
+
+// aggregateDealProgress sums up how far the deals for an aggregate have come.
+// Each deal moves the whole aggregate to its miner in a single transfer, so
+// the members of an aggregate have no deals or transfers of their own and
+// this is what their progress is reported as.
+//
+// Members are not held inactive until a deal for their aggregate seals.
+// Active is what says a content is pinned: the pinning service API reports
+// inactive contents as still queued or pinning, pins left inactive are
+// pinned again on startup, and inactive contents aren't served. Whether a
+// member is stored in a sealed deal is reported as the sealed field of its
+// status instead.
+type aggregateDealProgress struct {
+	Aggregate uint  `json:"aggregate"`
+	Members   int64 `json:"members"`
+	Size      int64 `json:"size"`
+
+	Deals        int `json:"deals"`
+	Transferring int `json:"transferring"`
+	Transferred  int `json:"transferred"`
+	Sealed       int `json:"sealed"`
+
+	// bytes sent by the furthest along of the transfers still running
+	BytesSent uint64 `json:"bytesSent"`
+}
+
+// dealsContent returns the content whose deals store cont, that is its
+// aggregate if it has been aggregated and cont itself otherwise
+func dealsContent(db *gorm.DB, cont Content) (Content, error) {
+	if cont.AggregatedIn == 0 {
+		return cont, nil
+	}
+
+	var aggr Content
+	if err := db.First(&aggr, "id = ?", cont.AggregatedIn).Error; err != nil {
+		return Content{}, err
+	}
+	return aggr, nil
+}
+
+func summarizeAggregateDeals(aggr Content, members int64, deals []dealStatus) *aggregateDealProgress {
+	p := &aggregateDealProgress{
+		Aggregate: aggr.ID,
+		Members:   members,
+		Size:      aggr.Size,
+	}
+
+	for _, ds := range deals {
+		if ds.Deal.Failed {
+			continue
+		}
+		p.Deals++
+
+		switch {
+		case dealIsSealed(ds):
+			p.Sealed++
+		case !ds.Deal.TransferFinished.IsZero():
+			p.Transferred++
+		case ds.TransferStatus != nil || !ds.Deal.TransferStarted.IsZero():
+			p.Transferring++
+			if ts := ds.TransferStatus; ts != nil && ts.Sent > p.BytesSent {
+				p.BytesSent = ts.Sent
+			}
+		}
+	}
+
+	return p
+}
+
+func dealIsSealed(ds dealStatus) bool {
+	if !ds.Deal.SealedAt.IsZero() {
+		return true
+	}
+	return ds.OnChainState != nil && ds.OnChainState.SectorStartEpoch > 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/filclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDealsContent(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &Content{})
+
+	aggr := Content{Aggregate: true, Active: true}
+	assert.NoError(db.Create(&aggr).Error)
+	member := Content{Active: true, AggregatedIn: aggr.ID}
+	assert.NoError(db.Create(&member).Error)
+	single := Content{Active: true}
+	assert.NoError(db.Create(&single).Error)
+
+	dc, err := dealsContent(db, member)
+	assert.NoError(err)
+	assert.Equal(aggr.ID, dc.ID)
+
+	dc, err = dealsContent(db, single)
+	assert.NoError(err)
+	assert.Equal(single.ID, dc.ID)
+}
+
+func TestSummarizeAggregateDeals(t *testing.T) {
+	now := time.Now()
+	deals := []dealStatus{
+		{Deal: contentDeal{Failed: true, TransferStarted: now}},
+		{Deal: contentDeal{}},
+		{Deal: contentDeal{TransferStarted: now}, TransferStatus: &filclient.ChannelState{Sent: 100}},
+		{Deal: contentDeal{TransferStarted: now}, TransferStatus: &filclient.ChannelState{Sent: 300}},
+		{Deal: contentDeal{TransferStarted: now, TransferFinished: now}},
+		{Deal: contentDeal{TransferStarted: now, TransferFinished: now, SealedAt: now}},
+		{Deal: contentDeal{TransferStarted: now, TransferFinished: now, DealID: 5}, OnChainState: &onChainDealState{SectorStartEpoch: 10}},
+	}
+
+	p := summarizeAggregateDeals(Content{ID: 3, Size: 1000}, 12, deals)
+	assert.Equal(t, &aggregateDealProgress{
+		Aggregate:    3,
+		Members:      12,
+		Size:         1000,
+		Deals:        6,
+		Transferring: 2,
+		Transferred:  1,
+		Sealed:       2,
+		BytesSent:    300,
+	}, p)
+}
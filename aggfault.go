@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// What happens to the members of an aggregate when one of its deals faults
+const (
+	// make a replacement deal for the aggregate as a whole
+	aggrFaultReplace = "replace"
+	// break the aggregate up so its members get staged again with other
+	// content, or dealt individually if they are large enough
+	aggrFaultSplit = "split"
+)
+
+func validAggregateFaultStrategy(strategy string) error {
+	switch strategy {
+	case aggrFaultReplace, aggrFaultSplit:
+		return nil
+	default:
+		return fmt.Errorf("unknown aggregate fault strategy %q", strategy)
+	}
+}
+
+// aggregateFault records a member content that lost a deal because a deal
+// for the aggregate it is in faulted
+type aggregateFault struct {
+	gorm.Model
+	Aggregate uint   `gorm:"index" json:"aggregate"`
+	Member    uint   `gorm:"index" json:"member"`
+	Deal      uint   `json:"deal"`
+	DealID    int64  `json:"dealId"`
+	Miner     string `json:"miner"`
+	Strategy  string `json:"strategy"`
+}
+
+// handleAggregateFault records every member of an aggregate as affected by a
+// faulted deal and applies the configured strategy to get them replicated
+// again
+func (cm *ContentManager) handleAggregateFault(d *contentDeal) error {
+	var members []Content
+	if err := cm.DB.Find(&members, "aggregated_in = ?", d.Content).Error; err != nil {
+		return err
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	faults := make([]aggregateFault, 0, len(members))
+	for _, m := range members {
+		faults = append(faults, aggregateFault{
+			Aggregate: d.Content,
+			Member:    m.ID,
+			Deal:      d.ID,
+			DealID:    d.DealID,
+			Miner:     d.Miner,
+			Strategy:  cm.aggregateFaultStrategy,
+		})
+	}
+
+	if err := cm.DB.Create(&faults).Error; err != nil {
+		return err
+	}
+
+	log.Warnw("aggregate deal faulted", "aggregate", d.Content, "deal", d.DealID, "miner", d.Miner, "members", len(members), "strategy", cm.aggregateFaultStrategy)
+
+	if cm.aggregateFaultStrategy != aggrFaultSplit {
+		return nil
+	}
+
+	if err := cm.breakAggregate(d.Content); err != nil {
+		return err
+	}
+
+	go func() {
+		for _, m := range members {
+			cm.ToCheck <- m.ID
+		}
+	}()
+	return nil
+}
+
+// breakAggregate detaches the members of an aggregate and deactivates it.
+// The members are then handled like any other content.
+func (cm *ContentManager) breakAggregate(aggr uint) error {
+	return cm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(Content{}).Where("aggregated_in = ?", aggr).UpdateColumns(map[string]interface{}{
+			"aggregated_in": 0,
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(Content{}).Where("id = ?", aggr).UpdateColumns(map[string]interface{}{
+			"active": false,
+		}).Error
+	})
+}
+
+type aggregateFaultSummary struct {
+	Aggregate uint             `json:"aggregate"`
+	Deals     int              `json:"deals"`
+	Members   []uint           `json:"members"`
+	LastFault time.Time        `json:"lastFault"`
+	Faults    []aggregateFault `json:"faults"`
+}
+
+// aggregateFaultSummaries groups recorded aggregate faults by aggregate, so
+// operators can see which members each fault affected
+func (cm *ContentManager) aggregateFaultSummaries(aggr uint) ([]*aggregateFaultSummary, error) {
+	q := cm.DB.Order("created_at asc")
+	if aggr > 0 {
+		q = q.Where("aggregate = ?", aggr)
+	}
+
+	var faults []aggregateFault
+	if err := q.Find(&faults).Error; err != nil {
+		return nil, err
+	}
+
+	var out []*aggregateFaultSummary
+	byAggr := make(map[uint]*aggregateFaultSummary)
+	seenDeal := make(map[uint]bool)
+	seenMember := make(map[[2]uint]bool)
+	for _, f := range faults {
+		s, ok := byAggr[f.Aggregate]
+		if !ok {
+			s = &aggregateFaultSummary{Aggregate: f.Aggregate}
+			byAggr[f.Aggregate] = s
+			out = append(out, s)
+		}
+
+		if !seenDeal[f.Deal] {
+			seenDeal[f.Deal] = true
+			s.Deals++
+		}
+
+		if k := [2]uint{f.Aggregate, f.Member}; !seenMember[k] {
+			seenMember[k] = true
+			s.Members = append(s.Members, f.Member)
+		}
+
+		s.LastFault = f.CreatedAt
+		s.Faults = append(s.Faults, f)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient/retrievehelper"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// aggregateMember is where a content sits in the aggregate it was put in: the
+// index of its link in the aggregate's root directory, and how many bytes of
+// members are linked before it
+type aggregateMember struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Aggregate uint `gorm:"index"`
+	Content   uint `gorm:"unique"`
+	Link      int
+	Offset    uint64
+	Size      uint64
+}
+
+// aggregateLayout lays out the members of an aggregate the way they are
+// linked in its root directory dir. The links are in the order they are
+// encoded in, which go-merkledag sorts by name as strings, not by the content
+// ids the names start with.
+func aggregateLayout(aggregate uint, dir *merkledag.ProtoNode, conts []Content) ([]aggregateMember, error) {
+	nd, err := merkledag.DecodeProtobuf(dir.RawData())
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]Content, len(conts))
+	for _, c := range conts {
+		byName[aggregateLinkName(c)] = c
+	}
+
+	out := make([]aggregateMember, 0, len(conts))
+	var offset uint64
+	for i, l := range nd.Links() {
+		c, ok := byName[l.Name]
+		if !ok {
+			return nil, fmt.Errorf("link %d of aggregate %d, %q, is not one of its contents", i, aggregate, l.Name)
+		}
+
+		out = append(out, aggregateMember{
+			Aggregate: aggregate,
+			Content:   c.ID,
+			Link:      i,
+			Offset:    offset,
+			Size:      uint64(c.Size),
+		})
+		offset += uint64(c.Size)
+	}
+
+	if len(out) != len(conts) {
+		return nil, fmt.Errorf("aggregate %d links %d contents, not %d", aggregate, len(out), len(conts))
+	}
+	return out, nil
+}
+
+func (cm *ContentManager) recordAggregateLayout(aggregate uint, dir *merkledag.ProtoNode, conts []Content) error {
+	members, err := aggregateLayout(aggregate, dir, conts)
+	if err != nil {
+		return err
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	return cm.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "content"}},
+		DoUpdates: clause.AssignmentColumns([]string{"aggregate", "link", "offset", "size"}),
+	}).Create(&members).Error
+}
+
+// aggregateMemberLayout returns where the content is in the aggregate. For
+// aggregates made before layouts were recorded it is worked out from the
+// members the aggregate has now, which is only right if none were removed.
+func (cm *ContentManager) aggregateMemberLayout(ctx context.Context, aggregate, content uint) (*aggregateMember, error) {
+	var am aggregateMember
+	err := cm.DB.First(&am, "content = ? and aggregate = ?", content, aggregate).Error
+	if err == nil {
+		return &am, nil
+	}
+	if !xerrors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var members []Content
+	if err := cm.DB.Find(&members, "aggregated_in = ?", aggregate).Error; err != nil {
+		return nil, err
+	}
+
+	dir, err := cm.createAggregate(ctx, members)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := aggregateLayout(aggregate, dir, members)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range layout {
+		if m.Content == content {
+			return &m, nil
+		}
+	}
+	return nil, fmt.Errorf("content %d is not in aggregate %d", content, aggregate)
+}
+
+// aggregateMemberSelector selects the aggregate's root and the whole dag of
+// the member at the given link, and nothing of the other members
+func aggregateMemberSelector(link int) ipldprime.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	return ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("Links", ssb.ExploreIndex(int64(link), ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Hash", ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())))
+		})))
+	}).Node()
+}
+
+// partialRetrieval is a retrieval of one member of an aggregate, and the
+// bytes it saved over retrieving the whole aggregate
+type partialRetrieval struct {
+	Aggregate  uint
+	BytesSaved uint64
+}
+
+// tryRetrieveMember retrieves one member of an aggregate from a miner with a
+// deal for the aggregate, asking only for the member's subtree
+func (cm *ContentManager) tryRetrieveMember(ctx context.Context, maddr address.Address, member, aggr Content, ask *retrievalmarket.QueryResponse) error {
+	layout, err := cm.aggregateMemberLayout(ctx, aggr.ID, member.ID)
+	if err != nil {
+		return err
+	}
+
+	// the miner's ask is for all of the aggregate, we only pay for the member
+	cost := retrievalCost{
+		Unseal:   ask.UnsealPrice,
+		Transfer: big.Mul(ask.MinPricePerByte, big.NewIntUnsigned(layout.Size)),
+	}
+	if err := cm.authorizeRetrieval(maddr, cost); err != nil {
+		return err
+	}
+
+	protos, err := cm.negotiateRetrieval(ctx, maddr)
+	if err != nil {
+		return err
+	}
+
+	proposal, err := retrievehelper.RetrievalProposalForAsk(cm.retrievalAskWithPaymentInterval(maddr, ask), aggr.Cid.CID, aggregateMemberSelector(layout.Link))
+	if err != nil {
+		return err
+	}
+
+	funding, release, err := cm.fundRetrievalPaych(ctx, maddr, cost)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	stats, err := util.RetrieveContentWithStats(ctx, cm.FilClient, maddr, proposal, nil, cm.retrievalStatsSink(member.ID))
+	if err != nil {
+		return err
+	}
+
+	// the link we asked for must have been the member, or we got some other
+	// member's data
+	bs := cm.Node.Blockstore
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	if err := util.WalkDag(ctx, dserv, member.Cid.CID, cid.NewSet().Visit, cm.dagWalkConcurrency, nil); err != nil {
+		return fmt.Errorf("content %d is incomplete after retrieving link %d of aggregate %d: %w", member.ID, layout.Link, aggr.ID, err)
+	}
+
+	var saved uint64
+	if uint64(aggr.Size) > stats.Size {
+		saved = uint64(aggr.Size) - stats.Size
+	}
+
+	log.Infow("retrieved aggregate member", "content", member.ID, "aggregate", aggr.ID, "link", layout.Link,
+		"size", stats.Size, "aggregateSize", aggr.Size, "bytesSaved", saved)
+	cm.recordRetrievalSuccess(member.ID, member.Cid.CID, maddr, stats, cost, proposal.PaymentInterval, protos, funding, &partialRetrieval{
+		Aggregate:  aggr.ID,
+		BytesSaved: saved,
+	})
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregateLayout(t *testing.T) {
+	objs := makeTestObjects(t, 3)
+	conts := []Content{
+		{ID: 9, Name: "c", Cid: objs[0].Cid, Size: 100},
+		{ID: 10, Name: "a", Cid: objs[1].Cid, Size: 200},
+		{ID: 2, Name: "b", Cid: objs[2].Cid, Size: 50},
+	}
+
+	dir, err := (&ContentManager{}).createAggregate(context.Background(), conts)
+	require.NoError(t, err)
+
+	// linked in order of name as strings, "10-a" before "2-b" before "9-c"
+	layout, err := aggregateLayout(1, dir, conts)
+	require.NoError(t, err)
+	require.Len(t, layout, 3)
+	require.Equal(t, aggregateMember{Aggregate: 1, Content: 10, Link: 0, Offset: 0, Size: 200}, layout[0])
+	require.Equal(t, aggregateMember{Aggregate: 1, Content: 2, Link: 1, Offset: 200, Size: 50}, layout[1])
+	require.Equal(t, aggregateMember{Aggregate: 1, Content: 9, Link: 2, Offset: 250, Size: 100}, layout[2])
+
+	_, err = aggregateLayout(1, dir, conts[:2])
+	require.Error(t, err)
+}
+
+func TestAggregateMemberSelector(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	// ids of different lengths, which aren't linked in numeric order
+	var conts []Content
+	byID := make(map[uint]Content)
+	for _, id := range []uint{2, 9, 10} {
+		nd, err := util.ImportFile(dserv, io.LimitReader(rand.New(rand.NewSource(int64(id))), 3*1024*1024))
+		require.NoError(t, err)
+
+		size, err := nd.Size()
+		require.NoError(t, err)
+
+		c := Content{ID: id, Cid: util.DbCID{nd.Cid()}, Size: int64(size)}
+		conts = append(conts, c)
+		byID[id] = c
+	}
+
+	dir, err := (&ContentManager{}).createAggregate(ctx, conts)
+	require.NoError(t, err)
+	require.NoError(t, bs.Put(ctx, dir))
+
+	layout, err := aggregateLayout(1, dir, conts)
+	require.NoError(t, err)
+
+	for _, m := range layout {
+		member := byID[m.Content]
+
+		want := cid.NewSet()
+		require.NoError(t, merkledag.Walk(ctx, merkledag.GetLinksWithDAG(dserv), member.Cid.CID, want.Visit))
+		want.Add(dir.Cid())
+
+		got := selectedBlocks(t, bs, dir.Cid(), aggregateMemberSelector(m.Link))
+		require.Equal(t, want.Len(), got.Len())
+		require.NoError(t, want.ForEach(func(c cid.Cid) error {
+			require.True(t, got.Has(c), "block %s of content %d was not selected", c, m.Content)
+			return nil
+		}))
+	}
+}
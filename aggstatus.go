@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-metrics-interface"
+)
+
+// how far back we look at aggregated content when averaging the time it took
+// to get a deal on chain
+const aggregationStatsWindow = time.Hour * 24 * 7
+
+type aggregationMetrics struct {
+	waitingMetr    metrics.Gauge
+	waitingBytes   metrics.Gauge
+	zonesMetr      metrics.Gauge
+	inProgressMetr metrics.Gauge
+	timeToDealMetr metrics.Gauge
+}
+
+func newAggregationMetrics() *aggregationMetrics {
+	metCtx := metrics.CtxScope(context.Background(), "content_manager")
+	return &aggregationMetrics{
+		waitingMetr:    metrics.NewCtx(metCtx, "aggregation_waiting_contents", "number of contents in staging zones waiting to be aggregated").Gauge(),
+		waitingBytes:   metrics.NewCtx(metCtx, "aggregation_waiting_bytes", "bytes of content in staging zones waiting to be aggregated").Gauge(),
+		zonesMetr:      metrics.NewCtx(metCtx, "aggregation_staging_zones", "number of open staging zones").Gauge(),
+		inProgressMetr: metrics.NewCtx(metCtx, "aggregation_in_progress", "number of aggregates created that have no deal on chain yet").Gauge(),
+		timeToDealMetr: metrics.NewCtx(metCtx, "aggregation_time_to_deal_seconds", "average time from adding content to its aggregate having a deal on chain").Gauge(),
+	}
+}
+
+type aggregationStatus struct {
+	// contents sitting in open staging zones
+	WaitingContents int   `json:"waitingContents"`
+	WaitingBytes    int64 `json:"waitingBytes"`
+
+	StagingZones int `json:"stagingZones"`
+	ReadyZones   int `json:"readyZones"`
+
+	// aggregates that have been put together but don't have a deal on chain
+	AggregatesInProgress int `json:"aggregatesInProgress"`
+
+	// average time from a content being added until the aggregate it went
+	// into got its first deal on chain, over the last aggregationStatsWindow
+	AvgTimeToDeal    time.Duration `json:"avgTimeToDeal"`
+	DealtContents    int           `json:"dealtContents"`
+	TimeToDealWindow time.Duration `json:"timeToDealWindow"`
+
+	// staging zones are aggregated once they grow past the target size, or
+	// once they're old enough and at least the minimum size
+	TargetAggregateSize int64 `json:"targetAggregateSize"`
+	MinAggregateSize    int64 `json:"minAggregateSize"`
+}
+
+func (cm *ContentManager) aggregationStatus(ctx context.Context) (*aggregationStatus, error) {
+	st := &aggregationStatus{
+		TimeToDealWindow:    aggregationStatsWindow,
+		TargetAggregateSize: int64(stagingZoneSizeLimit - (1 << 30)),
+		MinAggregateSize:    minDealSize,
+	}
+
+	openZones := make(map[uint]bool)
+	for _, zones := range cm.getStagingZoneSnapshot(ctx) {
+		for _, z := range zones {
+			openZones[z.ContID] = true
+			st.StagingZones++
+			st.WaitingContents += len(z.Contents)
+			st.WaitingBytes += z.CurSize
+			if z.isReady() {
+				st.ReadyZones++
+			}
+		}
+	}
+
+	var pending []uint
+	if err := cm.DB.Model(Content{}).
+		Where("aggregate and (active or pinning) and not failed and id not in (?)",
+			cm.DB.Model(contentDeal{}).Select("content").Where("deal_id > 0 and not failed")).
+		Pluck("id", &pending).Error; err != nil {
+		return nil, err
+	}
+
+	for _, id := range pending {
+		if !openZones[id] {
+			st.AggregatesInProgress++
+		}
+	}
+
+	var rows []struct {
+		ID        uint
+		CreatedAt time.Time
+		OnChainAt time.Time
+	}
+	if err := cm.DB.Table("contents").
+		Select("contents.id, contents.created_at, content_deals.on_chain_at").
+		Joins("join content_deals on content_deals.content = contents.aggregated_in").
+		Where("contents.deleted_at is null and contents.aggregated_in > 0 and content_deals.deal_id > 0 and not content_deals.failed and contents.created_at > ?", time.Now().Add(-aggregationStatsWindow)).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	// a content's aggregate may have several deals, the first one to land
+	// on chain is the one that counts
+	firstDeal := make(map[uint]time.Duration)
+	for _, r := range rows {
+		if r.OnChainAt.IsZero() || r.OnChainAt.Before(r.CreatedAt) {
+			continue
+		}
+
+		took := r.OnChainAt.Sub(r.CreatedAt)
+		if prev, ok := firstDeal[r.ID]; !ok || took < prev {
+			firstDeal[r.ID] = took
+		}
+	}
+
+	var total time.Duration
+	for _, took := range firstDeal {
+		total += took
+	}
+	st.DealtContents = len(firstDeal)
+	if st.DealtContents > 0 {
+		st.AvgTimeToDeal = total / time.Duration(st.DealtContents)
+	}
+
+	return st, nil
+}
+
+// updateAggregationMetrics refreshes the aggregation gauges, it runs along
+// with the periodic staging zone check
+func (cm *ContentManager) updateAggregationMetrics(ctx context.Context) {
+	st, err := cm.aggregationStatus(ctx)
+	if err != nil {
+		log.Errorf("failed to compute aggregation status: %s", err)
+		return
+	}
+
+	cm.aggrMetrics.waitingMetr.Set(float64(st.WaitingContents))
+	cm.aggrMetrics.waitingBytes.Set(float64(st.WaitingBytes))
+	cm.aggrMetrics.zonesMetr.Set(float64(st.StagingZones))
+	cm.aggrMetrics.inProgressMetr.Set(float64(st.AggregatesInProgress))
+	cm.aggrMetrics.timeToDealMetr.Set(st.AvgTimeToDeal.Seconds())
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregationStatus(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db := newTestDB(t, &Content{}, &contentDeal{})
+
+	cm := &ContentManager{
+		DB:      db,
+		buckets: make(map[uint][]*contentStagingZone),
+	}
+
+	now := time.Now()
+
+	// an aggregate with a deal on chain two hours after its members were added
+	dealt := &Content{Aggregate: true, Active: true}
+	assert.NoError(db.Create(dealt).Error)
+	for i := 0; i < 2; i++ {
+		assert.NoError(db.Create(&Content{Active: true, AggregatedIn: dealt.ID, CreatedAt: now.Add(-time.Hour * 3)}).Error)
+	}
+	assert.NoError(db.Create(&contentDeal{Content: dealt.ID, DealID: 1, OnChainAt: now.Add(-time.Hour)}).Error)
+	assert.NoError(db.Create(&contentDeal{Content: dealt.ID, DealID: 2, OnChainAt: now}).Error)
+
+	// an aggregate still waiting on its deals
+	waiting := &Content{Aggregate: true, Active: true}
+	assert.NoError(db.Create(waiting).Error)
+	assert.NoError(db.Create(&contentDeal{Content: waiting.ID}).Error)
+
+	// an open staging zone, its aggregate isn't in progress yet
+	open := &Content{Aggregate: true, Pinning: true}
+	assert.NoError(db.Create(open).Error)
+	cm.buckets[1] = []*contentStagingZone{{
+		ContID:   open.ID,
+		Contents: []Content{{ID: 100, Size: 10}, {ID: 101, Size: 20}},
+		CurSize:  30,
+	}}
+
+	st, err := cm.aggregationStatus(ctx)
+	assert.NoError(err)
+	assert.Equal(2, st.WaitingContents)
+	assert.Equal(int64(30), st.WaitingBytes)
+	assert.Equal(1, st.StagingZones)
+	assert.Equal(0, st.ReadyZones)
+	assert.Equal(1, st.AggregatesInProgress)
+	assert.Equal(2, st.DealtContents)
+	assert.InDelta(float64(time.Hour*2), float64(st.AvgTimeToDeal), float64(time.Minute))
+}
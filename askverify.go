@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	"golang.org/x/xerrors"
+)
+
+// errInvalidAsk is wrapped by the errors of asks that are malformed or not
+// signed by the miner they're for
+var errInvalidAsk = errors.New("invalid ask")
+
+// queryAsk gets the storage ask of a miner and checks it was signed by the
+// miner's worker key, so that a spoofed or corrupted ask never makes it into
+// pricing. Failures to look up the worker key are lotus errors and aren't the
+// miner's fault.
+func (cm *ContentManager) queryAsk(ctx context.Context, m address.Address) (*network.AskResponse, error) {
+	ask, err := cm.FilClient.GetAsk(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cm.verifyAsk(ctx, m, ask); err != nil {
+		return nil, err
+	}
+
+	return ask, nil
+}
+
+func (cm *ContentManager) verifyAsk(ctx context.Context, m address.Address, ask *network.AskResponse) error {
+	// check the ask is well formed before making lotus calls for it
+	if err := verifyAskResponse(ask, m, address.Undef); err != nil {
+		return err
+	}
+
+	worker, err := cm.workerKey(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	return verifyAskResponse(ask, m, worker)
+}
+
+// A miner's worker key only changes some hours after the change is sent to
+// chain, so looking it up once in a while is enough. It is cached so that
+// asks queried through the public routes don't cost lotus calls each time.
+const (
+	workerKeyTTL       = time.Hour
+	workerKeyCacheSize = 4096
+)
+
+type cachedWorkerKey struct {
+	key address.Address
+	at  time.Time
+}
+
+// workerKey is the key of miner m's worker, which signs its asks
+func (cm *ContentManager) workerKey(ctx context.Context, m address.Address) (address.Address, error) {
+	if v, ok := cm.workerKeys.Get(m); ok {
+		cached := v.(cachedWorkerKey)
+		if time.Since(cached.at) < workerKeyTTL {
+			return cached.key, nil
+		}
+	}
+
+	minfo, err := cm.Api.StateMinerInfo(ctx, m, types.EmptyTSK)
+	if err != nil {
+		return address.Undef, filclient.NewErrLotusError(xerrors.Errorf("failed to get miner info to verify ask: %w", err))
+	}
+
+	worker, err := cm.Api.StateAccountKey(ctx, minfo.Worker, types.EmptyTSK)
+	if err != nil {
+		return address.Undef, filclient.NewErrLotusError(xerrors.Errorf("failed to resolve worker key to verify ask: %w", err))
+	}
+
+	cm.workerKeys.Add(m, cachedWorkerKey{key: worker, at: time.Now()})
+	return worker, nil
+}
+
+// verifyAskResponse checks the ask is for miner m, has sane values, and is
+// signed by worker. An undefined worker only checks the ask is well formed.
+func verifyAskResponse(resp *network.AskResponse, m address.Address, worker address.Address) error {
+	if resp == nil || resp.Ask == nil || resp.Ask.Ask == nil {
+		return xerrors.Errorf("%w: miner returned an empty ask", errInvalidAsk)
+	}
+
+	ask := resp.Ask.Ask
+	if ask.Miner != m {
+		return xerrors.Errorf("%w: ask is for miner %s, not %s", errInvalidAsk, ask.Miner, m)
+	}
+
+	if err := checkAskPrice("price", ask.Price); err != nil {
+		return err
+	}
+
+	if err := checkAskPrice("verified price", ask.VerifiedPrice); err != nil {
+		return err
+	}
+
+	if ask.MinPieceSize != 0 {
+		if err := ask.MinPieceSize.Validate(); err != nil {
+			return xerrors.Errorf("%w: bad min piece size: %s", errInvalidAsk, err)
+		}
+	}
+
+	if ask.MaxPieceSize != 0 && ask.MaxPieceSize < ask.MinPieceSize {
+		return xerrors.Errorf("%w: max piece size %d is below min piece size %d", errInvalidAsk, ask.MaxPieceSize, ask.MinPieceSize)
+	}
+
+	if worker == address.Undef {
+		return nil
+	}
+
+	if resp.Ask.Signature == nil {
+		return xerrors.Errorf("%w: ask is not signed", errInvalidAsk)
+	}
+
+	buf, err := cborutil.Dump(ask)
+	if err != nil {
+		return xerrors.Errorf("%w: failed to serialize ask: %s", errInvalidAsk, err)
+	}
+
+	if err := sigs.Verify(resp.Ask.Signature, worker, buf); err != nil {
+		return xerrors.Errorf("%w: signature does not match the miner's worker key %s: %s", errInvalidAsk, worker, err)
+	}
+
+	return nil
+}
+
+func checkAskPrice(name string, p big.Int) error {
+	if p.Int == nil {
+		return xerrors.Errorf("%w: ask has no %s", errInvalidAsk, name)
+	}
+
+	if p.Sign() < 0 {
+		return xerrors.Errorf("%w: ask has a negative %s: %s", errInvalidAsk, name, p)
+	}
+
+	return nil
+}
+
+// askVerification is what the query ask endpoint reports about the signature
+// of the ask it got
+type askVerification struct {
+	*minerStorageAsk
+
+	SignatureValid bool   `json:"signatureValid"`
+	SignatureError string `json:"signatureError,omitempty"`
+}
+
+func newAskVerification(ask *network.AskResponse, verr error) *askVerification {
+	out := &askVerification{
+		minerStorageAsk: toDBAsk(ask),
+		SignatureValid:  verr == nil,
+	}
+	if verr != nil {
+		out.SignatureError = verr.Error()
+	}
+	return out
+}
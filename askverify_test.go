@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func signedAsk(t *testing.T, priv []byte, ask *storagemarket.StorageAsk) *network.AskResponse {
+	buf, err := cborutil.Dump(ask)
+	require.NoError(t, err)
+
+	sig, err := sigs.Sign(crypto.SigTypeSecp256k1, priv, buf)
+	require.NoError(t, err)
+
+	return &network.AskResponse{Ask: &storagemarket.SignedStorageAsk{Ask: ask, Signature: sig}}
+}
+
+func TestVerifyAskResponse(t *testing.T) {
+	miner, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	newWorker := func() ([]byte, address.Address) {
+		priv, err := sigs.Generate(crypto.SigTypeSecp256k1)
+		require.NoError(t, err)
+		pub, err := sigs.ToPublic(crypto.SigTypeSecp256k1, priv)
+		require.NoError(t, err)
+		addr, err := address.NewSecp256k1Address(pub)
+		require.NoError(t, err)
+		return priv, addr
+	}
+	priv, worker := newWorker()
+	otherPriv, _ := newWorker()
+
+	ask := func() *storagemarket.StorageAsk {
+		return &storagemarket.StorageAsk{
+			Miner:         miner,
+			Price:         big.NewInt(500000000),
+			VerifiedPrice: big.Zero(),
+			MinPieceSize:  256,
+			MaxPieceSize:  32 << 30,
+		}
+	}
+
+	invalid := func(err error) {
+		require.Error(t, err)
+		require.True(t, xerrors.Is(err, errInvalidAsk), err)
+	}
+
+	require.NoError(t, verifyAskResponse(signedAsk(t, priv, ask()), miner, worker))
+
+	// signed by someone else
+	invalid(verifyAskResponse(signedAsk(t, otherPriv, ask()), miner, worker))
+
+	// tampered with after signing
+	resp := signedAsk(t, priv, ask())
+	resp.Ask.Ask.Price = big.NewInt(1)
+	invalid(verifyAskResponse(resp, miner, worker))
+
+	// not signed at all, which only matters once the worker is known
+	resp = signedAsk(t, priv, ask())
+	resp.Ask.Signature = nil
+	require.NoError(t, verifyAskResponse(resp, miner, address.Undef))
+	invalid(verifyAskResponse(resp, miner, worker))
+
+	// for another miner
+	other, err := address.NewIDAddress(1001)
+	require.NoError(t, err)
+	invalid(verifyAskResponse(signedAsk(t, priv, ask()), other, worker))
+
+	// malformed
+	invalid(verifyAskResponse(nil, miner, worker))
+	invalid(verifyAskResponse(&network.AskResponse{}, miner, worker))
+
+	a := ask()
+	a.Price = big.Int{}
+	invalid(verifyAskResponse(signedAsk(t, priv, a), miner, worker))
+
+	a = ask()
+	a.VerifiedPrice = big.NewInt(-1)
+	invalid(verifyAskResponse(signedAsk(t, priv, a), miner, worker))
+
+	a = ask()
+	a.MinPieceSize = 1000
+	invalid(verifyAskResponse(signedAsk(t, priv, a), miner, worker))
+
+	a = ask()
+	a.MaxPieceSize = 128
+	invalid(verifyAskResponse(signedAsk(t, priv, a), miner, worker))
+}
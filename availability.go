@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// how long a miner that said it isn't taking deals is skipped before it gets
+// another proposal, sectors free up as the miner seals
+const minerAvailabilityRecheck = time.Hour * 6
+
+// Neither asks nor the miner API say whether a miner has room for new deals,
+// but miners that don't say so when they turn a proposal down. These are the
+// parts of those rejections from lotus markets and boost, compared
+// lowercased.
+var notAcceptingDealsSignals = []string{
+	"not accepting storage deals",
+	"not accepting online",
+	"not considering online storage deals",
+	"not accepting new deals",
+	"no free sectors",
+	"no sectors available",
+	"sealing pipeline is full",
+	"deal acceptance is paused",
+	"insufficient space",
+	"not enough space",
+}
+
+// notAcceptingDeals reports whether a deal failure message says the miner
+// isn't taking new deals at the moment, as opposed to rejecting something
+// about our proposal
+func notAcceptingDeals(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, sig := range notAcceptingDealsSignals {
+		if strings.Contains(msg, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+type minerAvailability struct {
+	Since   time.Time `json:"since"`
+	Reason  string    `json:"reason"`
+	Recheck time.Time `json:"recheck"`
+}
+
+// notAccepting returns what the miner said when it last turned a proposal
+// down for not taking deals, nil if that was long enough ago to try again
+func (sm *storageMiner) notAccepting(now time.Time) *minerAvailability {
+	if sm.NotAcceptingSince == nil {
+		return nil
+	}
+
+	recheck := sm.NotAcceptingSince.Add(minerAvailabilityRecheck)
+	if !now.Before(recheck) {
+		return nil
+	}
+
+	return &minerAvailability{
+		Since:   *sm.NotAcceptingSince,
+		Reason:  sm.NotAcceptingReason,
+		Recheck: recheck,
+	}
+}
+
+// unavailableMiners returns the miners that recently said they aren't taking
+// new deals, and what they said
+func (cm *ContentManager) unavailableMiners() (map[address.Address]*minerAvailability, error) {
+	now := time.Now()
+
+	var dbminers []storageMiner
+	if err := cm.DB.Find(&dbminers, "not_accepting_since > ?", now.Add(-minerAvailabilityRecheck)).Error; err != nil {
+		return nil, err
+	}
+
+	out := make(map[address.Address]*minerAvailability, len(dbminers))
+	for _, dbm := range dbminers {
+		if ma := dbm.notAccepting(now); ma != nil {
+			out[dbm.Address.Addr] = ma
+		}
+	}
+	return out, nil
+}
+
+func (cm *ContentManager) recordMinerNotAccepting(m address.Address, reason string) {
+	log.Infow("miner is not accepting deals, skipping it for a while", "miner", m, "reason", reason, "recheck", minerAvailabilityRecheck)
+	if err := cm.DB.Model(storageMiner{}).Where("address = ?", m.String()).Updates(map[string]interface{}{
+		"not_accepting_since":  time.Now(),
+		"not_accepting_reason": reason,
+	}).Error; err != nil {
+		log.Errorf("failed to record miner %s not accepting deals: %s", m, err)
+	}
+}
+
+// recordMinerAccepting clears the signal once the miner takes a proposal
+func (cm *ContentManager) recordMinerAccepting(m address.Address) {
+	if err := cm.DB.Model(storageMiner{}).Where("address = ? AND not_accepting_since IS NOT NULL", m.String()).Updates(map[string]interface{}{
+		"not_accepting_since":  nil,
+		"not_accepting_reason": "",
+	}).Error; err != nil {
+		log.Errorf("failed to clear miner %s not accepting deals: %s", m, err)
+	}
+}
+
+func (cm *ContentManager) addMinerAvailability(stats map[address.Address]*minerDealStats) error {
+	unavailable, err := cm.unavailableMiners()
+	if err != nil {
+		return err
+	}
+
+	for m, ma := range unavailable {
+		if st, ok := stats[m]; ok {
+			st.NotAccepting = ma
+		}
+	}
+	return nil
+}
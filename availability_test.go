@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotAcceptingDeals(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(notAcceptingDeals("deal rejected: miner is not considering online storage deals"))
+	assert.True(notAcceptingDeals("failed to send proposal: deal proposal rejected: No free sectors for new deals"))
+	assert.True(notAcceptingDeals("storage provider is not accepting online deals"))
+
+	// rejections of our proposal say nothing about the miner's capacity
+	assert.False(notAcceptingDeals("deal rejected: proposed price too low"))
+	assert.False(notAcceptingDeals("deal rejected: deal duration out of bounds"))
+}
+
+func TestMinerNotAccepting(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	var sm storageMiner
+	assert.Nil(sm.notAccepting(now))
+
+	since := now.Add(-time.Hour)
+	sm.NotAcceptingSince = &since
+	sm.NotAcceptingReason = "no free sectors"
+
+	ma := sm.notAccepting(now)
+	if assert.NotNil(ma) {
+		assert.Equal("no free sectors", ma.Reason)
+		assert.Equal(since.Add(minerAvailabilityRecheck), ma.Recheck)
+	}
+
+	// tried again once the recheck time comes
+	assert.Nil(sm.notAccepting(since.Add(minerAvailabilityRecheck)))
+}
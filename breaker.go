@@ -0,0 +1,200 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// defaults for the per miner circuit breaker, see minerBreakers
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerWindow   = time.Hour
+	defaultBreakerCooldown = time.Hour * 2
+
+	// a half open miner gets a new trial if the last one never finished
+	breakerTrialTimeout = time.Hour
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// failures in these phases mean the miner couldn't take a deal from us, the
+// others (like price checks) say nothing about whether it is up
+var breakerPhases = map[string]bool{
+	"query-ask":           true,
+	"send-proposal":       true,
+	"propose":             true,
+	"start-data-transfer": true,
+}
+
+type minerBreaker struct {
+	failures []time.Time
+	openedAt time.Time
+	trialAt  time.Time
+	state    string
+}
+
+// minerBreakers keeps miners that keep failing from eating up deal making.
+// After failures consecutive failures within window a miner's breaker opens
+// and the miner is skipped for cooldown. Then it goes half open, a single
+// deal is let through, and the breaker closes again if that deal's proposal
+// is accepted or reopens if it fails.
+type minerBreakers struct {
+	lk       sync.Mutex
+	miners   map[address.Address]*minerBreaker
+	failures int
+	window   time.Duration
+	cooldown time.Duration
+}
+
+func newMinerBreakers() *minerBreakers {
+	return &minerBreakers{
+		miners:   make(map[address.Address]*minerBreaker),
+		failures: defaultBreakerFailures,
+		window:   defaultBreakerWindow,
+		cooldown: defaultBreakerCooldown,
+	}
+}
+
+// get returns the breaker for m with open breakers whose cooldown is over
+// moved to half open. Must be called with the lock held.
+func (mb *minerBreakers) get(m address.Address) *minerBreaker {
+	b, ok := mb.miners[m]
+	if !ok {
+		b = &minerBreaker{state: breakerClosed}
+		mb.miners[m] = b
+	}
+
+	if b.state == breakerOpen && time.Since(b.openedAt) > mb.cooldown {
+		b.state = breakerHalfOpen
+		b.trialAt = time.Time{}
+	}
+	return b
+}
+
+func (mb *minerBreakers) trialFree(b *minerBreaker) bool {
+	return b.trialAt.IsZero() || time.Since(b.trialAt) > breakerTrialTimeout
+}
+
+// available reports whether m could be given a deal right now, without
+// taking up the trial of a half open breaker
+func (mb *minerBreakers) available(m address.Address) bool {
+	mb.lk.Lock()
+	defer mb.lk.Unlock()
+
+	b := mb.get(m)
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return mb.trialFree(b)
+	default:
+		return true
+	}
+}
+
+// allow is like available, but a half open breaker lets only the first
+// caller through until the outcome of that deal is recorded
+func (mb *minerBreakers) allow(m address.Address) bool {
+	mb.lk.Lock()
+	defer mb.lk.Unlock()
+
+	b := mb.get(m)
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if !mb.trialFree(b) {
+			return false
+		}
+		b.trialAt = time.Now()
+		return true
+	default:
+		return true
+	}
+}
+
+// release gives back the trial taken by allow when no deal ended up being
+// proposed to the miner
+func (mb *minerBreakers) release(m address.Address) {
+	mb.lk.Lock()
+	defer mb.lk.Unlock()
+
+	b := mb.get(m)
+	if b.state == breakerHalfOpen {
+		b.trialAt = time.Time{}
+	}
+}
+
+func (mb *minerBreakers) success(m address.Address) {
+	mb.lk.Lock()
+	defer mb.lk.Unlock()
+
+	b := mb.get(m)
+	if b.state != breakerClosed {
+		log.Infow("miner breaker closed", "miner", m)
+	}
+	b.state = breakerClosed
+	b.failures = nil
+	b.trialAt = time.Time{}
+}
+
+func (mb *minerBreakers) failure(m address.Address) {
+	mb.lk.Lock()
+	defer mb.lk.Unlock()
+
+	b := mb.get(m)
+	now := time.Now()
+	switch b.state {
+	case breakerHalfOpen:
+		b.state = breakerOpen
+		b.openedAt = now
+		b.trialAt = time.Time{}
+		log.Warnw("miner breaker reopened after failed trial", "miner", m, "cooldown", mb.cooldown)
+		return
+	case breakerOpen:
+		return
+	}
+
+	recent := b.failures[:0]
+	for _, t := range b.failures {
+		if now.Sub(t) < mb.window {
+			recent = append(recent, t)
+		}
+	}
+	b.failures = append(recent, now)
+
+	if len(b.failures) >= mb.failures {
+		b.state = breakerOpen
+		b.openedAt = now
+		b.failures = nil
+		log.Warnw("miner breaker opened", "miner", m, "cooldown", mb.cooldown)
+	}
+}
+
+type minerBreakerStatus struct {
+	State    string     `json:"state"`
+	Failures int        `json:"failures,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+func (mb *minerBreakers) status(m address.Address) *minerBreakerStatus {
+	mb.lk.Lock()
+	defer mb.lk.Unlock()
+
+	b := mb.get(m)
+	st := &minerBreakerStatus{
+		State:    b.state,
+		Failures: len(b.failures),
+	}
+	if b.state == breakerOpen {
+		until := b.openedAt.Add(mb.cooldown)
+		st.Until = &until
+	}
+	return st
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinerBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := address.NewIDAddress(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := newMinerBreakers()
+	mb.failures = 3
+
+	// a success in between resets the count
+	mb.failure(m)
+	mb.failure(m)
+	mb.success(m)
+	mb.failure(m)
+	mb.failure(m)
+	assert.True(mb.allow(m))
+	assert.Equal(breakerClosed, mb.status(m).State)
+
+	mb.failure(m)
+	assert.False(mb.available(m))
+	assert.False(mb.allow(m))
+	st := mb.status(m)
+	assert.Equal(breakerOpen, st.State)
+	assert.NotNil(st.Until)
+
+	// once the cooldown is over a single trial is let through
+	mb.miners[m].openedAt = time.Now().Add(-mb.cooldown - time.Second)
+	assert.True(mb.available(m))
+	assert.Equal(breakerHalfOpen, mb.status(m).State)
+	assert.True(mb.allow(m))
+	assert.False(mb.allow(m))
+	assert.False(mb.available(m))
+
+	// a failed trial opens the breaker again
+	mb.failure(m)
+	assert.Equal(breakerOpen, mb.status(m).State)
+
+	mb.miners[m].openedAt = time.Now().Add(-mb.cooldown - time.Second)
+	assert.True(mb.allow(m))
+	mb.release(m)
+	assert.True(mb.allow(m))
+
+	// and a successful one closes it
+	mb.success(m)
+	assert.Equal(breakerClosed, mb.status(m).State)
+	assert.True(mb.allow(m))
+	assert.True(mb.allow(m))
+}
+
+func TestMinerBreakerWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := address.NewIDAddress(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := newMinerBreakers()
+	mb.failures = 2
+
+	// failures older than the window don't count
+	mb.failure(m)
+	mb.miners[m].failures[0] = time.Now().Add(-mb.window - time.Second)
+	mb.failure(m)
+	assert.Equal(breakerClosed, mb.status(m).State)
+
+	mb.failure(m)
+	assert.Equal(breakerOpen, mb.status(m).State)
+}
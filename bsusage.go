@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/node"
+	"github.com/application-research/estuary/util"
+)
+
+const blockstoreUsageInterval = time.Minute * 10
+
+// usage over this percentage of the hard cap is recomputed once it is older
+// than blockstoreNearCapMaxAge, adds between the periodic recomputes could
+// otherwise go well past the cap
+const (
+	blockstoreNearCapPercent = 90
+	blockstoreNearCapMaxAge  = time.Second * 30
+)
+
+var ErrBlockstoreFull = errors.New("blockstore full")
+
+type blockstoreUsage struct {
+	Blocks     int64     `json:"blocks"`
+	Bytes      int64     `json:"bytes"`
+	ComputedAt time.Time `json:"computedAt"`
+}
+
+// computeBlockstoreUsage sums up every object that is referenced by
+// non-offloaded content stored on this node
+func (cm *ContentManager) computeBlockstoreUsage(ctx context.Context) (*blockstoreUsage, error) {
+	ctx, span := cm.tracer.Start(ctx, "computeBlockstoreUsage")
+	defer span.End()
+
+	var usage blockstoreUsage
+	if err := cm.DB.WithContext(ctx).Raw(`SELECT count(*) as blocks, coalesce(sum(size), 0) as bytes FROM objects
+		WHERE id IN (
+			SELECT obj_refs.object FROM obj_refs
+			INNER JOIN contents ON obj_refs.content = contents.id
+			WHERE contents.location = 'local' AND obj_refs.offloaded = 0
+		)`).Scan(&usage).Error; err != nil {
+		return nil, err
+	}
+
+	usage.ComputedAt = time.Now()
+	return &usage, nil
+}
+
+// BlockstoreUsage returns the last computed blockstore usage, computing it
+// if it has never been done
+func (cm *ContentManager) BlockstoreUsage(ctx context.Context) (*blockstoreUsage, error) {
+	cm.bsUsageLk.Lock()
+	defer cm.bsUsageLk.Unlock()
+
+	if cm.bsUsage != nil {
+		return cm.bsUsage, nil
+	}
+
+	usage, err := cm.computeBlockstoreUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.bsUsage = usage
+	return usage, nil
+}
+
+// blockstoreFull reports whether the hard cap has been reached, in which
+// case no new data should be written to the local blockstore
+func (cm *ContentManager) blockstoreFull(ctx context.Context) bool {
+	if cm.blockstoreHardCap <= 0 {
+		return false
+	}
+
+	usage, err := cm.BlockstoreUsage(ctx)
+	if err != nil {
+		log.Errorf("failed to get blockstore usage: %s", err)
+		return false
+	}
+
+	if usage.Bytes*100 >= cm.blockstoreHardCap*blockstoreNearCapPercent {
+		usage, err = cm.freshBlockstoreUsage(ctx, blockstoreNearCapMaxAge)
+		if err != nil {
+			log.Errorf("failed to recompute blockstore usage: %s", err)
+			return false
+		}
+	}
+
+	return usage.Bytes >= cm.blockstoreHardCap
+}
+
+// freshBlockstoreUsage returns the blockstore usage, recomputing it if it
+// was computed more than maxAge ago
+func (cm *ContentManager) freshBlockstoreUsage(ctx context.Context, maxAge time.Duration) (*blockstoreUsage, error) {
+	cm.bsUsageLk.Lock()
+	defer cm.bsUsageLk.Unlock()
+
+	if cm.bsUsage != nil && time.Since(cm.bsUsage.ComputedAt) <= maxAge {
+		return cm.bsUsage, nil
+	}
+
+	usage, err := cm.computeBlockstoreUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.bsUsage = usage
+	return usage, nil
+}
+
+func newFreeSpaceGuard(nd *node.Node, cfg config.Content) *util.FreeSpaceGuard {
+	if nd == nil {
+		return nil
+	}
+	return util.NewFreeSpaceGuard(nd.StorageDir, cfg.DagOverheadPercent, cfg.FreeSpaceHeadroom)
+}
+
+// runBlockstoreUsageMonitor periodically recomputes the blockstore usage and
+// offloads the least recently accessed content once the soft cap is exceeded
+func (cm *ContentManager) runBlockstoreUsageMonitor(ctx context.Context) {
+	ticker := time.NewTicker(blockstoreUsageInterval)
+	defer ticker.Stop()
+
+	for {
+		usage, err := cm.computeBlockstoreUsage(ctx)
+		if err != nil {
+			log.Errorf("failed to compute blockstore usage: %s", err)
+		} else {
+			cm.bsUsageLk.Lock()
+			cm.bsUsage = usage
+			cm.bsUsageLk.Unlock()
+
+			if cm.blockstoreSoftCap > 0 && usage.Bytes > cm.blockstoreSoftCap {
+				excess := usage.Bytes - cm.blockstoreSoftCap
+				log.Warnw("blockstore over soft cap, offloading content", "bytes", usage.Bytes, "softCap", cm.blockstoreSoftCap)
+
+				res, err := cm.ClearUnused(ctx, excess, "local", nil, false)
+				if err != nil {
+					log.Errorf("failed to offload content over blockstore soft cap: %s", err)
+				} else {
+					log.Infow("offloaded content over blockstore soft cap", "spaceFreed", res.SpaceFreed, "blocksRemoved", res.BlocksRemoved)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
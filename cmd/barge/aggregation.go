@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	cli "github.com/urfave/cli/v2"
+)
+
+var aggregationStatusCmd = &cli.Command{
+	Name:  "aggregation-status",
+	Usage: "show how small content is moving through aggregation (needs an admin token)",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the raw status as json",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		st, err := c.AggregationStatus(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(st)
+		}
+
+		avg := "-"
+		if st.DealtContents > 0 {
+			avg = st.AvgTimeToDeal.Round(time.Minute).String()
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Waiting contents:\t%d (%s)\n", st.WaitingContents, humanize.IBytes(uint64(st.WaitingBytes)))
+		fmt.Fprintf(w, "Staging zones:\t%d (%d ready)\n", st.StagingZones, st.ReadyZones)
+		fmt.Fprintf(w, "Aggregates awaiting deals:\t%d\n", st.AggregatesInProgress)
+		fmt.Fprintf(w, "Avg time to deal:\t%s (%d contents, last %s)\n", avg, st.DealtContents, st.TimeToDealWindow)
+		fmt.Fprintf(w, "Target aggregate size:\t%s (min %s)\n", humanize.IBytes(uint64(st.TargetAggregateSize)), humanize.IBytes(uint64(st.MinAggregateSize)))
+		return w.Flush()
+	},
+}
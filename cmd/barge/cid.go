@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	cli "github.com/urfave/cli/v2"
+)
+
+// common settings worth comparing a file's CID under
+var cidPresets = []struct {
+	Name   string
+	Params importParams
+}{
+	{"barge", defaultImportParams},
+	{"ipfs-default", importParams{Chunker: "size-262144", CidVersion: 0, RawLeaves: false, MaxLinks: 174}},
+	{"ipfs-cidv1", importParams{Chunker: "size-262144", CidVersion: 1, RawLeaves: true, MaxLinks: 174}},
+	{"ipfs-rabin", importParams{Chunker: "rabin", CidVersion: 1, RawLeaves: true, MaxLinks: 174}},
+	{"ipfs-buzhash", importParams{Chunker: "buzhash", CidVersion: 1, RawLeaves: true, MaxLinks: 174}},
+	{"ipfs-trickle", importParams{Chunker: "size-262144", CidVersion: 1, RawLeaves: true, MaxLinks: 174, Layout: layoutTrickle}},
+}
+
+var bargeCidCmd = &cli.Command{
+	Name:      "cid",
+	Usage:     "compute the root CID a file would have, without storing anything",
+	ArgsUsage: "<file>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "chunker",
+			Usage: "chunking strategy: size, rabin or buzhash",
+			Value: "size",
+		},
+		&cli.Int64Flag{
+			Name:  "chunk-size",
+			Usage: "chunk size in bytes for the size chunker, average chunk size for rabin",
+			Value: 1024 * 1024,
+		},
+		&cli.Uint64Flag{
+			Name:  "cid-version",
+			Value: defaultImportParams.CidVersion,
+		},
+		&cli.BoolFlag{
+			Name:  "raw-leaves",
+			Value: defaultImportParams.RawLeaves,
+		},
+		&cli.IntFlag{
+			Name:  "max-links",
+			Usage: "maximum number of links per intermediate node",
+			Value: defaultImportParams.MaxLinks,
+		},
+		&cli.IntFlag{
+			Name:  "inline-limit",
+			Usage: "inline blocks up to this many bytes into their CID, 0 disables",
+			Value: defaultImportParams.InlineLimit,
+		},
+		&cli.StringFlag{
+			Name:  "layout",
+			Usage: "dag layout: balanced or trickle, the layout changes the resulting CID",
+			Value: defaultImportParams.Layout,
+		},
+		&cli.BoolFlag{
+			Name:  "compare",
+			Usage: "also print the CID under a set of preset configurations",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single file")
+		}
+		fpath := cctx.Args().First()
+
+		var spec string
+		switch c := cctx.String("chunker"); c {
+		case "size":
+			spec = fmt.Sprintf("size-%d", cctx.Int64("chunk-size"))
+		case "rabin":
+			spec = fmt.Sprintf("rabin-%d", cctx.Int64("chunk-size"))
+		case "buzhash":
+			spec = "buzhash"
+		default:
+			return fmt.Errorf("unrecognized chunker %q", c)
+		}
+
+		params := importParams{
+			Chunker:     spec,
+			CidVersion:  cctx.Uint64("cid-version"),
+			RawLeaves:   cctx.Bool("raw-leaves"),
+			MaxLinks:    cctx.Int("max-links"),
+			InlineLimit: cctx.Int("inline-limit"),
+			Layout:      cctx.String("layout"),
+		}
+		if params.CidVersion == 0 && params.RawLeaves {
+			return fmt.Errorf("raw leaves require CID version 1")
+		}
+		if params.CidVersion == 0 && params.InlineLimit > 0 {
+			return fmt.Errorf("inlining requires CID version 1, set --inline-limit=0")
+		}
+
+		if err := checkLayout(params.Layout); err != nil {
+			return err
+		}
+
+		root, size, err := computeFileCid(fpath, params)
+		if err != nil {
+			return err
+		}
+
+		if !cctx.Bool("compare") {
+			fmt.Println(root)
+			fmt.Printf("dag size: %s\n", humanize.IBytes(size))
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "CONFIG\tCHUNKER\tLAYOUT\tCID\tDAG SIZE\n")
+		fmt.Fprintf(w, "flags\t%s\t%s\t%s\t%s\n", params.Chunker, params.Layout, root, humanize.IBytes(size))
+		for _, p := range cidPresets {
+			root, size, err := computeFileCid(fpath, p.Params)
+			if err != nil {
+				return fmt.Errorf("computing cid for preset %s: %w", p.Name, err)
+			}
+
+			layout := p.Params.Layout
+			if layout == "" {
+				layout = layoutBalanced
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Name, p.Params.Chunker, layout, root, humanize.IBytes(size))
+		}
+		return w.Flush()
+	},
+}
+
+// computeFileCid builds the DAG for a file in a throwaway in memory
+// blockstore and returns its root CID and total size
+func computeFileCid(fpath string, params importParams) (cid.Cid, uint64, error) {
+	fi, err := os.Open(fpath)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	defer fi.Close()
+
+	bstore := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bstore, offline.Exchange(bstore)))
+
+	nd, err := importFileWithParams(dserv, fi, params, false)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	size, err := nd.Size()
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	return nd.Cid(), size, nil
+}
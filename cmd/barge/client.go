@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -20,6 +21,7 @@ import (
 	"github.com/application-research/estuary/types"
 	util "github.com/application-research/estuary/util"
 	"github.com/cheggaaa/pb/v3"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
 	"github.com/ipfs/go-cid"
 )
 
@@ -44,6 +46,12 @@ func (hse httpStatusError) Error() string {
 }
 
 func (c *EstClient) doRequest(ctx context.Context, method string, path string, body interface{}, resp interface{}) (int, error) {
+	st, _, err := c.doRequestHeader(ctx, method, path, body, resp)
+	return st, err
+}
+
+// doRequestHeader is doRequest for callers that also need the response headers
+func (c *EstClient) doRequestHeader(ctx context.Context, method string, path string, body interface{}, resp interface{}) (int, http.Header, error) {
 	start := time.Now()
 	defer func() {
 		if c.LogTimings {
@@ -55,14 +63,14 @@ func (c *EstClient) doRequest(ctx context.Context, method string, path string, b
 	if body != nil {
 		data, err := json.Marshal(body)
 		if err != nil {
-			return 0, err
+			return 0, nil, err
 		}
 		bodyr = bytes.NewReader(data)
 	}
 
-	req, err := http.NewRequest(method, c.Host+path, bodyr)
+	req, err := http.NewRequestWithContext(ctx, method, c.Host+path, bodyr)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+c.Tok)
@@ -72,7 +80,7 @@ func (c *EstClient) doRequest(ctx context.Context, method string, path string, b
 
 	r, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
 	defer r.Body.Close()
@@ -80,7 +88,7 @@ func (c *EstClient) doRequest(ctx context.Context, method string, path string, b
 	if !(r.StatusCode >= 200 && r.StatusCode < 300) {
 		var out map[string]interface{}
 		if err := json.NewDecoder(r.Body).Decode(&out); err != nil {
-			return r.StatusCode, &httpStatusError{
+			return r.StatusCode, r.Header, &httpStatusError{
 				StatusCode: r.StatusCode,
 				Status:     r.Status,
 				Extra:      "no error given",
@@ -89,7 +97,7 @@ func (c *EstClient) doRequest(ctx context.Context, method string, path string, b
 
 		errstr, ok := out["error"]
 		if !ok {
-			return r.StatusCode, &httpStatusError{
+			return r.StatusCode, r.Header, &httpStatusError{
 				StatusCode: r.StatusCode,
 				Status:     r.Status,
 				Extra:      "unrecognized error format",
@@ -110,17 +118,23 @@ func (c *EstClient) doRequest(ctx context.Context, method string, path string, b
 			}
 		}
 
-		return r.StatusCode, &httpStatusError{
+		return r.StatusCode, r.Header, &httpStatusError{
 			StatusCode: r.StatusCode,
 			Status:     r.Status,
 			Extra:      extra,
 		}
 	}
 
+	// a writer gets the response body as is
+	if w, ok := resp.(io.Writer); ok {
+		_, err := io.Copy(w, r.Body)
+		return r.StatusCode, r.Header, err
+	}
+
 	if resp != nil {
-		return r.StatusCode, json.NewDecoder(r.Body).Decode(resp)
+		return r.StatusCode, r.Header, json.NewDecoder(r.Body).Decode(resp)
 	}
-	return r.StatusCode, nil
+	return r.StatusCode, r.Header, nil
 }
 
 func (c *EstClient) Viewer(ctx context.Context) (*util.ViewerResponse, error) {
@@ -133,7 +147,10 @@ func (c *EstClient) Viewer(ctx context.Context) (*util.ViewerResponse, error) {
 	return &vresp, nil
 }
 
-func (c *EstClient) AddCar(fpath, name string) (*util.ContentAddResponse, error) {
+// AddCar uploads a CAR file, root picks which of its roots to track the
+// content by and may be empty for CAR files with a single root. An empty
+// priority leaves the content at normal priority.
+func (c *EstClient) AddCar(fpath, name, root, priority string) (*util.ContentAddResponse, error) {
 	fi, err := os.Open(fpath)
 	if err != nil {
 		return nil, err
@@ -151,7 +168,15 @@ func (c *EstClient) AddCar(fpath, name string) (*util.ContentAddResponse, error)
 
 	defer rc.Close()
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/content/add-car", c.Shuttle), rc)
+	q := url.Values{}
+	if root != "" {
+		q.Set("root", root)
+	}
+	if priority != "" {
+		q.Set("priority", priority)
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/content/add-car?%s", c.Shuttle, q.Encode()), rc)
 	if err != nil {
 		return nil, err
 	}
@@ -180,8 +205,64 @@ func (c *EstClient) AddCar(fpath, name string) (*util.ContentAddResponse, error)
 	return &rbody, nil
 }
 
+// AddTar uploads a tar archive, gzipped or not, to be imported as a unixfs
+// directory. The archive is streamed, the server imports it as it arrives.
+func (c *EstClient) AddTar(fpath, name, priority string) (*util.ContentAddResponse, error) {
+	fi, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var rc io.ReadCloser = fi
+	if c.DoProgress {
+		finfo, err := fi.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		rc = pb.Start64(finfo.Size()).NewProxyReader(fi)
+	}
+
+	defer rc.Close()
+
+	q := url.Values{}
+	if name != "" {
+		q.Set("filename", name)
+	}
+	if priority != "" {
+		q.Set("priority", priority)
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/content/add-tar?%s", c.Shuttle, q.Encode()), rc)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.Tok)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		var m map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+			fmt.Println(err)
+		}
+		return nil, fmt.Errorf("got invalid status code: %d (%v)", resp.StatusCode, m["error"])
+	}
+
+	var rbody util.ContentAddResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rbody); err != nil {
+		return nil, err
+	}
+
+	return &rbody, nil
+}
+
 func (c *EstClient) AddFile(fpath, name string) (*util.ContentAddResponse, error) {
-	r, w := io.Pipe()
 	fi, err := os.Open(fpath)
 	if err != nil {
 		return nil, err
@@ -197,6 +278,45 @@ func (c *EstClient) AddFile(fpath, name string) (*util.ContentAddResponse, error
 		rc = pb.Start64(finfo.Size()).NewProxyReader(fi)
 	}
 
+	return c.addData(rc, name)
+}
+
+// AddFromURL streams the body of an http(s) url straight into an upload,
+// without writing anything locally. The response status is checked before
+// any data is sent.
+func (c *EstClient) AddFromURL(ctx context.Context, u, name string) (*util.ContentAddResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the default client follows redirects for us
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", u, err)
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: got status %s", u, resp.Status)
+	}
+
+	var rc io.ReadCloser = resp.Body
+	if c.DoProgress {
+		if resp.ContentLength > 0 {
+			rc = pb.Start64(resp.ContentLength).NewProxyReader(resp.Body)
+		} else {
+			rc = pb.Full.Start64(0).NewProxyReader(resp.Body)
+		}
+	}
+
+	return c.addData(rc, name)
+}
+
+func (c *EstClient) addData(rc io.ReadCloser, name string) (*util.ContentAddResponse, error) {
+	defer rc.Close()
+
+	r, w := io.Pipe()
 	mw := multipart.NewWriter(w)
 
 	go func() {
@@ -310,6 +430,18 @@ func (c *EstClient) CollectionsListDir(ctx context.Context, col, path string) ([
 	return out, nil
 }
 
+func (c *EstClient) CollectionsAddContent(ctx context.Context, col string, contid uint, path string) error {
+	q := url.Values{}
+	q.Set("col", col)
+	q.Set("content", fmt.Sprint(contid))
+	if path != "" {
+		q.Set("path", path)
+	}
+
+	_, err := c.doRequest(ctx, "POST", "/collections/fs/add?"+q.Encode(), nil, nil)
+	return err
+}
+
 func (c *EstClient) PinAdd(ctx context.Context, root cid.Cid, name string, origins []string, meta map[string]interface{}) (*types.IpfsPinStatus, error) {
 	p := &types.IpfsPin{
 		Cid:     root.String(),
@@ -411,3 +543,864 @@ func (c *EstClient) PinStatusByCid(ctx context.Context, cids []string) (map[stri
 	return out, nil
 
 }
+
+// TODO: these mirror the deal status types in the main estuary codebase
+type ContentDeal struct {
+	ID               uint      `json:"ID"`
+	Content          uint      `json:"content"`
+	PropCid          string    `json:"propCid"`
+	Miner            string    `json:"miner"`
+	DealID           int64     `json:"dealId"`
+	Failed           bool      `json:"failed"`
+	FailedAt         time.Time `json:"failedAt"`
+	TransferStarted  time.Time `json:"transferStarted"`
+	TransferFinished time.Time `json:"transferFinished"`
+	OnChainAt        time.Time `json:"onChainAt"`
+	SealedAt         time.Time `json:"sealedAt"`
+	FastRetrieval    bool      `json:"fastRetrieval"`
+	ProposalAttempts int       `json:"proposalAttempts"`
+	Verified         bool      `json:"verified"`
+	TermsReason      string    `json:"termsReason"`
+}
+
+type TransferStatus struct {
+	StatusStr string `json:"statusMessage"`
+	Sent      uint64 `json:"sent"`
+	Received  uint64 `json:"received"`
+	Message   string `json:"message"`
+}
+
+type OnChainDealState struct {
+	SectorStartEpoch int64 `json:"sectorStartEpoch"`
+	LastUpdatedEpoch int64 `json:"lastUpdatedEpoch"`
+	SlashEpoch       int64 `json:"slashEpoch"`
+}
+
+type DealStatus struct {
+	Deal           ContentDeal       `json:"deal"`
+	TransferStatus *TransferStatus   `json:"transfer"`
+	OnChainState   *OnChainDealState `json:"onChainState"`
+	SealEstimate   *SealEstimate     `json:"sealEstimate"`
+}
+
+func (c *EstClient) DealStatusByProposal(ctx context.Context, propcid cid.Cid) (*DealStatus, error) {
+	var out DealStatus
+	_, err := c.doRequestRetries(ctx, "GET", "/deals/status-by-proposal/"+propcid.String(), nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+type DealProposalSummary struct {
+	PropCid    string `json:"propCid"`
+	Miner      string `json:"miner"`
+	Content    uint   `json:"content"`
+	StartEpoch int64  `json:"startEpoch"`
+	EndEpoch   int64  `json:"endEpoch"`
+	Expired    bool   `json:"expired"`
+}
+
+// DealProposals lists the proposals of every deal made for our content
+func (c *EstClient) DealProposals(ctx context.Context) ([]*DealProposalSummary, error) {
+	var out []*DealProposalSummary
+	_, err := c.doRequestRetries(ctx, "GET", "/deals/proposals", nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// DealProposal fetches the signed proposal estuary sent to the miner
+func (c *EstClient) DealProposal(ctx context.Context, propcid cid.Cid) (*market.ClientDealProposal, error) {
+	var out market.ClientDealProposal
+	_, err := c.doRequestRetries(ctx, "GET", "/deals/proposal/"+propcid.String(), nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// ExportPiece writes the CAR a deal's piece commitment was computed over to w
+func (c *EstClient) ExportPiece(ctx context.Context, propcid cid.Cid, w io.Writer) error {
+	_, err := c.doRequest(ctx, "GET", "/deals/piece/"+propcid.String(), nil, w)
+	return err
+}
+
+type TransferEvent struct {
+	Time    time.Time `json:"time"`
+	Deal    uint      `json:"deal"`
+	Chanid  string    `json:"chanid"`
+	Event   string    `json:"event"`
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	Sent    uint64    `json:"sent"`
+}
+
+// TransferLog fetches the timeline of data transfer events recorded for a deal
+func (c *EstClient) TransferLog(ctx context.Context, propcid cid.Cid) ([]*TransferEvent, error) {
+	var out []*TransferEvent
+	_, err := c.doRequestRetries(ctx, "GET", "/deals/transfer/log/"+propcid.String(), nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+type DurabilityTarget struct {
+	Tolerance  int     `json:"tolerance"`
+	Confidence float64 `json:"confidence"`
+	MaxDeals   int     `json:"maxDeals"`
+}
+
+type PlannedReplica struct {
+	Miner           string  `json:"miner"`
+	LossProbability float64 `json:"lossProbability"`
+	Existing        bool    `json:"existing"`
+}
+
+type ReplicationPlan struct {
+	Mode        string `json:"mode"`
+	Replication int    `json:"replication"`
+	Plan        struct {
+		Content    uint             `json:"content"`
+		Target     DurabilityTarget `json:"target"`
+		Replicas   []PlannedReplica `json:"replicas"`
+		Deals      int              `json:"deals"`
+		NewDeals   int              `json:"newDeals"`
+		Confidence float64          `json:"confidence"`
+		Met        bool             `json:"met"`
+	} `json:"plan"`
+}
+
+// ReplicationPlan asks the server how many deals it would make for a content
+// to meet a durability target. Zero values in target use the server's own.
+func (c *EstClient) ReplicationPlan(ctx context.Context, content uint, target DurabilityTarget) (*ReplicationPlan, error) {
+	q := url.Values{}
+	if target.Tolerance > 0 {
+		q.Set("tolerance", strconv.Itoa(target.Tolerance))
+	}
+	if target.Confidence > 0 {
+		q.Set("confidence", strconv.FormatFloat(target.Confidence, 'f', -1, 64))
+	}
+	if target.MaxDeals > 0 {
+		q.Set("max", strconv.Itoa(target.MaxDeals))
+	}
+
+	var out ReplicationPlan
+	_, err := c.doRequest(ctx, "GET", fmt.Sprintf("/content/replication-plan/%d?%s", content, q.Encode()), nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+type SelectionAudit struct {
+	ID       uint                  `json:"id"`
+	Time     time.Time             `json:"time"`
+	Content  uint                  `json:"content"`
+	Count    int                   `json:"count"`
+	Verified bool                  `json:"verified"`
+	Miners   []SelectionAuditMiner `json:"miners"`
+}
+
+type SelectionAuditMiner struct {
+	Miner   string `json:"miner"`
+	Source  string `json:"source"`
+	Rank    int    `json:"rank"`
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason"`
+	Detail  string `json:"detail"`
+
+	// only set with deal size targeting on
+	SizeTarget string `json:"sizeTarget"`
+}
+
+// SelectionAudit fetches every round of miner selection the server recorded
+// for a content, oldest first
+func (c *EstClient) SelectionAudit(ctx context.Context, content uint) ([]*SelectionAudit, error) {
+	var out []*SelectionAudit
+	_, err := c.doRequest(ctx, "GET", fmt.Sprintf("/admin/cm/selection-audit/%d", content), nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+type ReplicaTestResult struct {
+	Deal          uint   `json:"deal"`
+	DealID        int64  `json:"dealId"`
+	Miner         string `json:"miner"`
+	QueryMs       int64  `json:"queryMs"`
+	RetrievalMs   int64  `json:"retrievalMs"`
+	Bytes         uint64 `json:"bytes"`
+	Speed         uint64 `json:"speed"`
+	Available     bool   `json:"available"`
+	Phase         string `json:"phase"`
+	Error         string `json:"error"`
+	FaultRecorded bool   `json:"faultRecorded"`
+}
+
+type ReplicaTestReport struct {
+	Content   uint                 `json:"content"`
+	Replicas  []*ReplicaTestResult `json:"replicas"`
+	Available int                  `json:"available"`
+	Total     int                  `json:"total"`
+}
+
+// TestReplicas has the server test-retrieve the content from every miner
+// with a deal for it. With recordFaults, replicas that fail are recorded as
+// deal faults.
+func (c *EstClient) TestReplicas(ctx context.Context, content uint, recordFaults bool) (*ReplicaTestReport, error) {
+	var out ReplicaTestReport
+	_, err := c.doRequest(ctx, "POST", fmt.Sprintf("/admin/cm/test-replicas/%d?record-faults=%v", content, recordFaults), nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// DealStatusByProposalWait asks the server to hold the request until the next
+// data transfer event for the deal, or until wait runs out. The returned bool
+// is false if the server answered straight away because it doesn't support
+// waiting, callers should fall back to polling then.
+func (c *EstClient) DealStatusByProposalWait(ctx context.Context, propcid cid.Cid, wait time.Duration) (*DealStatus, bool, error) {
+	var out DealStatus
+	_, hdr, err := c.doRequestHeader(ctx, "GET", "/deals/status-by-proposal/"+propcid.String()+"?wait="+wait.String(), nil, &out)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &out, hdr.Get("X-Status-Wait") == "true", nil
+}
+
+type Provider struct {
+	PeerID    string   `json:"peerId"`
+	Addrs     []string `json:"addrs"`
+	Miner     string   `json:"miner,omitempty"`
+	Protocols []string `json:"protocols"`
+}
+
+// FindProviders asks the estuary node which providers the network indexer
+// knows of for a cid
+func (c *EstClient) FindProviders(ctx context.Context, cc cid.Cid) ([]Provider, error) {
+	var out []Provider
+	_, err := c.doRequestRetries(ctx, "GET", "/public/providers/"+cc.String(), nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// ContentChecksums returns the checksums taken on upload of the contents
+// stored with the cid that we may see, without duplicates. Private contents
+// are only listed for a request with our token.
+func (c *EstClient) ContentChecksums(ctx context.Context, cc cid.Cid) ([]string, error) {
+	var out []struct {
+		Content struct {
+			Checksum string `json:"checksum"`
+		} `json:"content"`
+	}
+	_, err := c.doRequestRetries(ctx, "GET", "/content/by-cid/"+cc.String(), nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	var sums []string
+	seen := make(map[string]bool)
+	for _, r := range out {
+		if sum := r.Content.Checksum; sum != "" && !seen[sum] {
+			seen[sum] = true
+			sums = append(sums, sum)
+		}
+	}
+	return sums, nil
+}
+
+// NameResolution is what an IPNS key or DNSLink domain points at
+type NameResolution struct {
+	Name      string `json:"name"`
+	Cid       string `json:"cid"`
+	Remainder string `json:"remainder"`
+	Path      string `json:"path"`
+	// the names the resolution went through, in order
+	Chain []string `json:"chain"`
+	// in seconds, how long the answer can be relied on for
+	TTL     int64     `json:"ttl"`
+	Expires time.Time `json:"expires"`
+}
+
+// ResolveName asks the estuary node to resolve an IPNS key, DNSLink domain
+// or /ipns/ path to a cid
+func (c *EstClient) ResolveName(ctx context.Context, name string) (*NameResolution, error) {
+	var out NameResolution
+	_, err := c.doRequestRetries(ctx, "GET", "/content/resolve?name="+url.QueryEscape(name), nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+type NetAddrs struct {
+	ID        string   `json:"id"`
+	Addresses []string `json:"addresses"`
+}
+
+// PeerAddrs returns the estuary node's addresses in /p2p/ form so they can
+// be dialed directly
+func (c *EstClient) PeerAddrs(ctx context.Context) ([]string, error) {
+	var out NetAddrs
+	_, err := c.doRequestRetries(ctx, "GET", "/public/net/addrs", nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, a := range out.Addresses {
+		addrs = append(addrs, a+"/p2p/"+out.ID)
+	}
+
+	return addrs, nil
+}
+
+type MinerComparison struct {
+	Miner          string  `json:"miner"`
+	Reachable      bool    `json:"reachable"`
+	Error          string  `json:"error"`
+	Price          string  `json:"price"`
+	VerifiedPrice  string  `json:"verifiedPrice"`
+	MinPieceSize   uint64  `json:"minPieceSize"`
+	MaxPieceSize   uint64  `json:"maxPieceSize"`
+	Cost           string  `json:"cost"`
+	CostFil        string  `json:"costFil"`
+	TotalDeals     int     `json:"totalDeals"`
+	ConfirmedDeals int     `json:"confirmedDeals"`
+	SuccessRatio   float64 `json:"successRatio"`
+	AvgResponseMs  int64   `json:"avgResponseMs"`
+}
+
+func (c *EstClient) CompareMiners(ctx context.Context, miners []string, size uint64, duration int64, verified bool) ([]*MinerComparison, error) {
+	q := url.Values{}
+	for _, m := range miners {
+		q.Add("miner", m)
+	}
+	q.Set("size", strconv.FormatUint(size, 10))
+	q.Set("duration", strconv.FormatInt(duration, 10))
+	q.Set("verified", strconv.FormatBool(verified))
+
+	var out []*MinerComparison
+	_, err := c.doRequest(ctx, "GET", "/public/miners/compare?"+q.Encode(), nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+type MinerAsk struct {
+	Miner          string `json:"miner"`
+	Price          string `json:"price"`
+	VerifiedPrice  string `json:"verifiedPrice"`
+	MinPieceSize   uint64 `json:"minPieceSize"`
+	MaxPieceSize   uint64 `json:"maxPieceSize"`
+	SignatureValid bool   `json:"signatureValid"`
+	SignatureError string `json:"signatureError"`
+}
+
+// GetAsk has the server query a miner for its storage ask, and check the
+// ask is signed by the miner's worker key
+func (c *EstClient) GetAsk(ctx context.Context, miner string) (*MinerAsk, error) {
+	var out MinerAsk
+	_, err := c.doRequest(ctx, "GET", "/public/miners/storage/query/"+miner, nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// SealEstimate is the range of time a miner has taken from a finished
+// transfer to an active deal, Low and High are the 10th and 90th percentiles
+type SealEstimate struct {
+	Miner   string        `json:"miner"`
+	Basis   string        `json:"basis"`
+	Samples int           `json:"samples"`
+	Low     time.Duration `json:"low"`
+	Median  time.Duration `json:"median"`
+	High    time.Duration `json:"high"`
+}
+
+func (c *EstClient) SealEstimate(ctx context.Context, miner string) (*SealEstimate, error) {
+	var out SealEstimate
+	_, err := c.doRequest(ctx, "GET", "/public/miners/seal-estimate/"+miner, nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// MinerPipeline is how backed up a miner's sealing pipeline looks, going by
+// the server's deals with it
+type MinerPipeline struct {
+	Miner         string        `json:"miner"`
+	Status        string        `json:"status"`
+	Waiting       int           `json:"waiting"`
+	OldestWaiting time.Duration `json:"oldestWaiting"`
+	Stuck         int           `json:"stuck"`
+	RecentMedian  time.Duration `json:"recentMedian"`
+	RecentSamples int           `json:"recentSamples"`
+	Estimate      *SealEstimate `json:"estimate"`
+	ExpectedSeal  time.Duration `json:"expectedSeal"`
+}
+
+func (c *EstClient) MinerPipeline(ctx context.Context, miner string) (*MinerPipeline, error) {
+	var out MinerPipeline
+	_, err := c.doRequest(ctx, "GET", "/public/miners/pipeline/"+miner, nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// MinerStats is what the server knows about how a miner has done with its
+// deals, location is the miner's region
+type MinerStats struct {
+	Miner            string  `json:"miner"`
+	TotalDeals       int     `json:"totalDeals"`
+	ConfirmedDeals   int     `json:"confirmedDeals"`
+	FailedDeals      int     `json:"failedDeals"`
+	DealFaults       int     `json:"dealFaults"`
+	SuccessRatio     float64 `json:"successRatio"`
+	TotalBytesStored uint64  `json:"totalBytesStored"`
+	AvgResponseMs    int64   `json:"avgResponseMs"`
+	Location         string  `json:"location"`
+}
+
+func (c *EstClient) MinerStats(ctx context.Context) ([]*MinerStats, error) {
+	var out []*MinerStats
+	_, err := c.doRequestRetries(ctx, "GET", "/public/miners/stats", nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+type MinerRanking struct {
+	Miner          string `json:"miner"`
+	TotalDeals     int    `json:"totalDeals"`
+	ConfirmedDeals int    `json:"confirmedDeals"`
+	FailedDeals    int    `json:"failedDeals"`
+	AvgResponseMs  int64  `json:"avgResponseMs"`
+}
+
+// RecomputeMinerRanking makes the server rank its miners again right away
+// and returns the new ranking, it needs an admin token
+func (c *EstClient) RecomputeMinerRanking(ctx context.Context) ([]*MinerRanking, error) {
+	var out []*MinerRanking
+	_, err := c.doRequest(ctx, "POST", "/admin/miners/recompute", nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+type MinerCacheEntry struct {
+	Rank             int     `json:"rank"`
+	Miner            string  `json:"miner"`
+	SuccessRatio     float64 `json:"successRatio"`
+	TotalDeals       int     `json:"totalDeals"`
+	ConfirmedDeals   int     `json:"confirmedDeals"`
+	FailedDeals      int     `json:"failedDeals"`
+	DealFaults       int     `json:"dealFaults"`
+	SlashedDeals     int     `json:"slashedDeals"`
+	TotalBytesStored uint64  `json:"totalBytesStored"`
+	AvgResponseMs    int64   `json:"avgResponseMs"`
+	Price            string  `json:"price,omitempty"`
+	Location         string  `json:"location"`
+	Power            string  `json:"power,omitempty"`
+	Breaker          *struct {
+		State string `json:"state"`
+	} `json:"breaker,omitempty"`
+	NotAccepting *struct {
+		Reason string `json:"reason"`
+	} `json:"notAccepting,omitempty"`
+}
+
+// MinerCache is the miner ranking the server currently picks deals from
+type MinerCache struct {
+	Strategy      string             `json:"strategy"`
+	LastComputed  time.Time          `json:"lastComputed"`
+	NextRecompute time.Time          `json:"nextRecompute"`
+	RecomputeInMs int64              `json:"recomputeInMs"`
+	Miners        []*MinerCacheEntry `json:"miners"`
+}
+
+// MinerCache returns the server's cached miner ranking without having it
+// recomputed, it needs an admin token
+func (c *EstClient) MinerCache(ctx context.Context) (*MinerCache, error) {
+	var out MinerCache
+	_, err := c.doRequest(ctx, "GET", "/admin/miners/cache", nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+type MinerReputation struct {
+	Miner          string `json:"miner"`
+	TotalDeals     int    `json:"totalDeals"`
+	ConfirmedDeals int    `json:"confirmedDeals"`
+	FailedDeals    int    `json:"failedDeals"`
+	DealFaults     int    `json:"dealFaults"`
+}
+
+type MinerReputationExport struct {
+	Version  int               `json:"version"`
+	Source   string            `json:"source"`
+	Exported time.Time         `json:"exported"`
+	Miners   []MinerReputation `json:"miners"`
+}
+
+// ExportMinerReputation fetches the deal counts the server has for the
+// miners it made deals with, it needs an admin token
+func (c *EstClient) ExportMinerReputation(ctx context.Context) (*MinerReputationExport, error) {
+	var out MinerReputationExport
+	_, err := c.doRequest(ctx, "GET", "/admin/miners/reputation", nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// ImportMinerReputation merges an export from another node into the
+// server's miner ranking and returns how many miners it had stats for
+func (c *EstClient) ImportMinerReputation(ctx context.Context, exp *MinerReputationExport) (int, error) {
+	var out struct {
+		Imported int `json:"imported"`
+	}
+	_, err := c.doRequest(ctx, "POST", "/admin/miners/reputation", exp, &out)
+	if err != nil {
+		return 0, err
+	}
+
+	return out.Imported, nil
+}
+
+type AggregationStatus struct {
+	WaitingContents      int           `json:"waitingContents"`
+	WaitingBytes         int64         `json:"waitingBytes"`
+	StagingZones         int           `json:"stagingZones"`
+	ReadyZones           int           `json:"readyZones"`
+	AggregatesInProgress int           `json:"aggregatesInProgress"`
+	AvgTimeToDeal        time.Duration `json:"avgTimeToDeal"`
+	DealtContents        int           `json:"dealtContents"`
+	TimeToDealWindow     time.Duration `json:"timeToDealWindow"`
+	TargetAggregateSize  int64         `json:"targetAggregateSize"`
+	MinAggregateSize     int64         `json:"minAggregateSize"`
+}
+
+// AggregationStatus fetches a snapshot of the aggregation pipeline, it needs
+// an admin token
+func (c *EstClient) AggregationStatus(ctx context.Context) (*AggregationStatus, error) {
+	var out AggregationStatus
+	_, err := c.doRequestRetries(ctx, "GET", "/admin/cm/aggregation-status", nil, &out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+type RebalanceItem struct {
+	Content   uint      `json:"content"`
+	OldDeal   uint      `json:"oldDeal"`
+	State     string    `json:"state"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type RebalanceStatus struct {
+	ID         uint       `json:"id"`
+	Miner      string     `json:"miner"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+
+	Total   int `json:"total"`
+	Pending int `json:"pending"`
+	Sealing int `json:"sealing"`
+	Done    int `json:"done"`
+	Failed  int `json:"failed"`
+
+	Problems []*RebalanceItem `json:"problems"`
+}
+
+// RebalanceMiner starts moving every replica off the miner, or returns the
+// rebalance already in progress for it
+func (c *EstClient) RebalanceMiner(ctx context.Context, miner string) (*RebalanceStatus, error) {
+	var out RebalanceStatus
+	_, err := c.doRequest(ctx, "POST", "/admin/miners/rebalance/"+miner, nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+func (c *EstClient) RebalanceStatus(ctx context.Context, miner string) (*RebalanceStatus, error) {
+	var out RebalanceStatus
+	_, err := c.doRequest(ctx, "GET", "/admin/miners/rebalance/"+miner, nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+type RetrievalStatsSnapshot struct {
+	Miner         string    `json:"miner"`
+	Started       time.Time `json:"started"`
+	BytesReceived uint64    `json:"bytesReceived"`
+	CurrentSpeed  uint64    `json:"currentSpeed"`
+	AverageSpeed  uint64    `json:"averageSpeed"`
+	Payments      int       `json:"payments"`
+	Paid          string    `json:"paid"`
+	Done          bool      `json:"done"`
+	Error         string    `json:"error"`
+}
+
+type RetrievalProgress struct {
+	Content uint                    `json:"content"`
+	Stats   *RetrievalStatsSnapshot `json:"stats"`
+}
+
+// RetrievalProgress returns the latest snapshot of a content's retrieval,
+// waiting up to wait for the next one. It returns nil once the content is no
+// longer being retrieved.
+func (c *EstClient) RetrievalProgress(ctx context.Context, content uint, wait time.Duration) (*RetrievalProgress, error) {
+	var out RetrievalProgress
+	st, err := c.doRequest(ctx, "GET", fmt.Sprintf("/admin/cm/retrieval-progress/%d?wait=%s", content, wait), nil, &out)
+	if err != nil {
+		if st == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+type RehydrateResult struct {
+	Content    uint   `json:"content"`
+	Cid        string `json:"cid"`
+	ServedBy   string `json:"servedBy"`
+	Size       uint64 `json:"size"`
+	DurationMs int64  `json:"durationMs"`
+
+	Checksum         string `json:"checksum,omitempty"`
+	ChecksumVerified bool   `json:"checksumVerified,omitempty"`
+}
+
+// RehydrateContent retrieves an offloaded content back into the node's
+// blockstore, returning once it is servable locally again. With
+// verifyChecksum the node also checks the file against its upload checksum.
+func (c *EstClient) RehydrateContent(ctx context.Context, content uint, verifyChecksum bool) (*RehydrateResult, error) {
+	var out RehydrateResult
+	_, err := c.doRequest(ctx, "POST", fmt.Sprintf("/admin/cm/refresh/%d?verify-checksum=%t", content, verifyChecksum), nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+type DeadlineMiner struct {
+	Miner  string        `json:"miner"`
+	Basis  string        `json:"basis"`
+	Median time.Duration `json:"median"`
+	High   time.Duration `json:"high"`
+	InTime bool          `json:"inTime"`
+}
+
+type DealDeadlineReport struct {
+	Content     uint      `json:"content"`
+	Deadline    time.Time `json:"deadline"`
+	Replication int       `json:"replication"`
+
+	Sealed int `json:"sealed"`
+	InTime int `json:"inTime"`
+	Late   int `json:"late"`
+
+	Transfer   time.Duration    `json:"transfer"`
+	Candidates []*DeadlineMiner `json:"candidates"`
+
+	Achievable        bool `json:"achievable"`
+	ReduceReplication bool `json:"reduceReplication"`
+	ReducedTo         int  `json:"reducedTo"`
+}
+
+// SetDealDeadline sets when a content must be fully replicated by, a nil
+// deadline clears it. The report is nil when clearing.
+func (c *EstClient) SetDealDeadline(ctx context.Context, content uint, deadline *time.Time, reduceReplication bool) (*DealDeadlineReport, error) {
+	body := map[string]interface{}{
+		"reduceReplication": reduceReplication,
+	}
+	if deadline != nil {
+		body["deadline"] = deadline
+	}
+
+	var out DealDeadlineReport
+	_, err := c.doRequest(ctx, "POST", fmt.Sprintf("/content/deadline/%d", content), body, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline == nil {
+		return nil, nil
+	}
+	return &out, nil
+}
+
+// DealQueueEntry is a content waiting to be checked for deals
+type DealQueueEntry struct {
+	Content  uint      `json:"content"`
+	Priority string    `json:"priority"`
+	Queued   time.Time `json:"queued"`
+}
+
+// DealQueue returns the contents waiting to be checked for deals in the
+// order they will be checked, it needs an admin token
+func (c *EstClient) DealQueue(ctx context.Context) ([]DealQueueEntry, error) {
+	var out []DealQueueEntry
+	_, err := c.doRequest(ctx, "GET", "/admin/cm/deal-queue", nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// DealRequest asks for a deal with a miner for a content, given by id or by
+// root cid
+type DealRequest struct {
+	Content     uint   `json:"content,omitempty"`
+	Cid         string `json:"cid,omitempty"`
+	MaxPrice    string `json:"maxPrice,omitempty"`
+	Renegotiate bool   `json:"renegotiate,omitempty"`
+	PieceSize   uint64 `json:"pieceSize,omitempty"`
+	PieceCid    string `json:"pieceCid,omitempty"`
+}
+
+type DealPriceAdjustment struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type DealMade struct {
+	Deal             uint                 `json:"deal"`
+	ProposalAttempts int                  `json:"proposalAttempts"`
+	PriceAdjustment  *DealPriceAdjustment `json:"priceAdjustment,omitempty"`
+}
+
+// MakeDeal proposes a deal for a content to a miner. It needs an admin token.
+func (c *EstClient) MakeDeal(ctx context.Context, miner string, req DealRequest) (*DealMade, error) {
+	var out DealMade
+	_, err := c.doRequest(ctx, "POST", "/deals/make/"+miner, req, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// SlashedDeal is a deal whose miner was slashed for losing the data
+type SlashedDeal struct {
+	Deal       uint      `json:"deal"`
+	DealID     int64     `json:"dealId"`
+	Content    uint      `json:"content"`
+	Miner      string    `json:"miner"`
+	SlashEpoch int64     `json:"slashEpoch"`
+	FailedAt   time.Time `json:"failedAt"`
+}
+
+// SlashedDeals returns the slashed deals, most recent first, at most limit
+// of them unless it is zero. It needs an admin token.
+func (c *EstClient) SlashedDeals(ctx context.Context, limit int) ([]SlashedDeal, error) {
+	var out []SlashedDeal
+	_, err := c.doRequest(ctx, "GET", fmt.Sprintf("/admin/cm/slashed-deals?limit=%d", limit), nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// DealPause says whether deal making on the server is paused
+type DealPause struct {
+	Paused bool      `json:"paused"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+	// contents waiting for deal making to resume
+	Deferred int `json:"deferred"`
+}
+
+// DealPauseStatus needs an admin token
+func (c *EstClient) DealPauseStatus(ctx context.Context) (*DealPause, error) {
+	var out DealPause
+	_, err := c.doRequest(ctx, "GET", "/admin/cm/dealmaking/pause", nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// PauseDealMaking stops the server from proposing new deals until
+// ResumeDealMaking is called, it needs an admin token
+func (c *EstClient) PauseDealMaking(ctx context.Context, reason string) (*DealPause, error) {
+	body := map[string]string{"reason": reason}
+
+	var out DealPause
+	_, err := c.doRequest(ctx, "POST", "/admin/cm/dealmaking/pause", body, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// ResumeDealMaking needs an admin token
+func (c *EstClient) ResumeDealMaking(ctx context.Context) (*DealPause, error) {
+	var out DealPause
+	_, err := c.doRequest(ctx, "POST", "/admin/cm/dealmaking/resume", nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+func (c *EstClient) DealDeadline(ctx context.Context, content uint) (*DealDeadlineReport, error) {
+	var out DealDeadlineReport
+	_, err := c.doRequest(ctx, "GET", fmt.Sprintf("/content/deadline/%d", content), nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/multiformats/go-multihash"
+	cli "github.com/urfave/cli/v2"
+)
+
+var dagDiffCmd = &cli.Command{
+	Name:      "dag-diff",
+	Usage:     "show where the DAGs of two CIDs diverge",
+	ArgsUsage: "<cidA> <cidB>",
+	Description: `Walks both DAGs side by side and reports the first place they differ: a
+directory entry only one of them has, children that split the data at
+different offsets (a different chunker or layout), leaf data that differs,
+or nodes encoded differently (raw leaves, CID version, hash function).
+
+Blocks are fetched from estuary over bitswap, or with --local from the barge
+repo in the current directory.`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "local",
+			Usage: "read blocks from the local barge repo instead of fetching them",
+		},
+		&cli.StringSliceFlag{
+			Name:  "peer",
+			Usage: "additional multiaddrs to fetch blocks from",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "number of differences to report",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "max-blocks",
+			Usage: "stop after reading this many blocks",
+			Value: 10000,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+
+		if cctx.Args().Len() != 2 {
+			return fmt.Errorf("must specify two cids to compare")
+		}
+
+		a, err := cid.Decode(cctx.Args().Get(0))
+		if err != nil {
+			return fmt.Errorf("invalid cid %q: %w", cctx.Args().Get(0), err)
+		}
+
+		b, err := cid.Decode(cctx.Args().Get(1))
+		if err != nil {
+			return fmt.Errorf("invalid cid %q: %w", cctx.Args().Get(1), err)
+		}
+
+		if a.Equals(b) {
+			fmt.Println("the cids are the same")
+			return nil
+		}
+
+		var dserv ipld.DAGService
+		if cctx.Bool("local") {
+			r, err := openRepo(cctx)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			dserv = merkledag.NewDAGService(blockservice.New(r.Filestore, offline.Exchange(r.Filestore)))
+		} else {
+			c, err := loadClient(cctx)
+			if err != nil {
+				return err
+			}
+
+			bstore := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+			pc, err := setupBitswap(ctx, bstore)
+			if err != nil {
+				return err
+			}
+			defer pc.host.Close()
+
+			addrs, err := c.PeerAddrs(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get estuary node addresses: %w", err)
+			}
+			addrs = append(addrs, cctx.StringSlice("peer")...)
+
+			if err := connectToDelegates(ctx, pc.host, addrs); err != nil {
+				return fmt.Errorf("failed to connect to estuary node: %w", err)
+			}
+
+			dserv = merkledag.NewDAGService(blockservice.New(bstore, pc.bitswap))
+		}
+
+		d := &dagDiffer{
+			dserv:     dserv,
+			limit:     cctx.Int("limit"),
+			maxBlocks: cctx.Int("max-blocks"),
+		}
+
+		// one DAG may be a directory of the other, no need to walk them side
+		// by side then
+		for _, sub := range []struct{ in, of cid.Cid }{{a, b}, {b, a}} {
+			path, err := d.findSubdag(ctx, sub.in, sub.of)
+			if err != nil {
+				return err
+			}
+
+			if path != "" {
+				fmt.Printf("%s is in the DAG of %s, at %s\n", sub.of, sub.in, path)
+				return nil
+			}
+		}
+		d.fetched = 0
+
+		if err := d.diff(ctx, a, b, "/", 0); err != nil {
+			if len(d.diffs) == 0 {
+				return err
+			}
+			// still worth showing what was found before giving up
+			defer fmt.Printf("stopped early: %s\n", err)
+		}
+
+		if len(d.diffs) == 0 {
+			fmt.Println("no structural difference found, the DAGs only differ in metadata")
+			return nil
+		}
+
+		for i, df := range d.diffs {
+			if i > 0 {
+				fmt.Println()
+			}
+
+			at := df.Path
+			if df.Offset >= 0 {
+				at = fmt.Sprintf("%s at byte %d", df.Path, df.Offset)
+			}
+
+			fmt.Printf("%s: %s\n", at, df.Kind)
+			fmt.Printf("  A: %s\n", df.A)
+			fmt.Printf("  B: %s\n", df.B)
+		}
+		return nil
+	},
+}
+
+type dagDifference struct {
+	Path string
+	// byte offset into the file at Path, -1 if the difference isn't in a
+	// file's data
+	Offset int64
+	Kind   string
+	A      string
+	B      string
+}
+
+type dagDiffer struct {
+	dserv     ipld.NodeGetter
+	limit     int
+	maxBlocks int
+
+	fetched int
+	diffs   []dagDifference
+}
+
+func (d *dagDiffer) get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if d.fetched >= d.maxBlocks {
+		return nil, fmt.Errorf("read %d blocks without finding all differences, raise --max-blocks to look further", d.fetched)
+	}
+	d.fetched++
+
+	return d.dserv.Get(ctx, c)
+}
+
+func (d *dagDiffer) found(df dagDifference) {
+	d.diffs = append(d.diffs, df)
+}
+
+func (d *dagDiffer) done() bool {
+	return len(d.diffs) >= d.limit
+}
+
+// findSubdag looks for target among the directory entries under root,
+// returning its path, or "" if it isn't there. Files aren't descended into.
+func (d *dagDiffer) findSubdag(ctx context.Context, root, target cid.Cid) (string, error) {
+	// the search is a shortcut, running out of blocks just ends it
+	if d.fetched >= d.maxBlocks {
+		return "", nil
+	}
+
+	nd, err := d.get(ctx, root)
+	if err != nil {
+		return "", err
+	}
+
+	pn, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return "", nil
+	}
+
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil || fsn.Type() != unixfs.TDirectory {
+		return "", nil
+	}
+
+	for _, l := range pn.Links() {
+		if l.Cid.Equals(target) {
+			return "/" + l.Name, nil
+		}
+
+		// raw blocks are never directories
+		if l.Cid.Prefix().Codec != cid.DagProtobuf {
+			continue
+		}
+
+		sub, err := d.findSubdag(ctx, l.Cid, target)
+		if err != nil {
+			return "", err
+		}
+		if sub != "" {
+			return "/" + l.Name + sub, nil
+		}
+	}
+	return "", nil
+}
+
+func (d *dagDiffer) diff(ctx context.Context, a, b cid.Cid, path string, offset int64) error {
+	if a.Equals(b) || d.done() {
+		return nil
+	}
+
+	pa, pb := a.Prefix(), b.Prefix()
+	if pa.Version != pb.Version || pa.MhType != pb.MhType {
+		d.found(dagDifference{Path: path, Offset: offset, Kind: "cids are made differently, every block will differ", A: describePrefix(pa), B: describePrefix(pb)})
+		return nil
+	}
+
+	na, err := d.get(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	nb, err := d.get(ctx, b)
+	if err != nil {
+		return err
+	}
+
+	if pa.Codec != pb.Codec {
+		da, db := leafData(na), leafData(nb)
+		kind := "nodes are encoded differently"
+		if da != nil && db != nil && bytes.Equal(da, db) {
+			kind = "same data, encoded differently (raw leaves setting)"
+		}
+
+		d.found(dagDifference{Path: path, Offset: offset, Kind: kind, A: describeNode(na), B: describeNode(nb)})
+		return nil
+	}
+
+	pna, oka := na.(*merkledag.ProtoNode)
+	pnb, okb := nb.(*merkledag.ProtoNode)
+	if !oka || !okb {
+		d.compareData(path, offset, na.RawData(), nb.RawData())
+		return nil
+	}
+
+	fa, erra := unixfs.FSNodeFromBytes(pna.Data())
+	fb, errb := unixfs.FSNodeFromBytes(pnb.Data())
+	if erra != nil || errb != nil {
+		// not unixfs, compare the links in order
+		return d.diffLinks(ctx, pna, pnb, path)
+	}
+
+	if fa.Type() != fb.Type() {
+		d.found(dagDifference{Path: path, Offset: -1, Kind: "different unixfs node types", A: fa.Type().String(), B: fb.Type().String()})
+		return nil
+	}
+
+	switch fa.Type() {
+	case unixfs.TDirectory, unixfs.THAMTShard:
+		return d.diffDirectory(ctx, pna, pnb, path)
+	case unixfs.TFile, unixfs.TRaw:
+		return d.diffFile(ctx, pna, pnb, fa, fb, path, offset)
+	default:
+		d.compareData(path, offset, fa.Data(), fb.Data())
+		return nil
+	}
+}
+
+func (d *dagDiffer) diffDirectory(ctx context.Context, a, b *merkledag.ProtoNode, path string) error {
+	la, lb := linksByName(a), linksByName(b)
+
+	names := make([]string, 0, len(la)+len(lb))
+	for n := range la {
+		names = append(names, n)
+	}
+	for n := range lb {
+		if _, ok := la[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		if d.done() {
+			return nil
+		}
+
+		ca, oka := la[n]
+		cb, okb := lb[n]
+		switch {
+		case !okb:
+			d.found(dagDifference{Path: path, Offset: -1, Kind: "entry only in A", A: n + " " + ca.String(), B: "missing"})
+		case !oka:
+			d.found(dagDifference{Path: path, Offset: -1, Kind: "entry only in B", A: "missing", B: n + " " + cb.String()})
+		default:
+			if err := d.diff(ctx, ca, cb, joinDagPath(path, n), 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *dagDiffer) diffFile(ctx context.Context, a, b *merkledag.ProtoNode, fa, fb *unixfs.FSNode, path string, offset int64) error {
+	la, lb := a.Links(), b.Links()
+	if len(la) == 0 && len(lb) == 0 {
+		d.compareData(path, offset, fa.Data(), fb.Data())
+		return nil
+	}
+
+	if len(la) == 0 || len(lb) == 0 {
+		d.found(dagDifference{Path: path, Offset: offset, Kind: "data is split differently", A: describeFileNode(fa, len(la)), B: describeFileNode(fb, len(lb))})
+		return nil
+	}
+
+	sa, sb := fa.BlockSizes(), fb.BlockSizes()
+	if len(sa) != len(la) || len(sb) != len(lb) {
+		return d.diffLinks(ctx, a, b, path)
+	}
+
+	n := len(la)
+	if len(lb) < n {
+		n = len(lb)
+	}
+
+	off := offset
+	for i := 0; i < n; i++ {
+		if d.done() {
+			return nil
+		}
+
+		// the last child of the shorter one may still hold a prefix of the
+		// other's child
+		last := i == len(la)-1 || i == len(lb)-1
+		if sa[i] != sb[i] && !last {
+			d.found(dagDifference{Path: path, Offset: off, Kind: fmt.Sprintf("chunk boundaries differ at child %d", i),
+				A: fmt.Sprintf("child of %d bytes", sa[i]), B: fmt.Sprintf("child of %d bytes", sb[i])})
+			return nil
+		}
+
+		if err := d.diff(ctx, la[i].Cid, lb[i].Cid, path, off); err != nil {
+			return err
+		}
+		off += int64(sa[i])
+	}
+
+	if d.done() || len(la) == len(lb) {
+		return nil
+	}
+
+	// everything both have is the same, one just goes on further
+	longer, extra := "A", sumSizes(sa[n:])
+	if len(lb) > len(la) {
+		longer, extra = "B", sumSizes(sb[n:])
+	}
+	d.found(dagDifference{Path: path, Offset: off, Kind: fmt.Sprintf("one is a prefix of the other, %s goes on for %s more here", longer, humanize.IBytes(extra)),
+		A: fmt.Sprintf("%d children, %d bytes", len(la), fa.FileSize()), B: fmt.Sprintf("%d children, %d bytes", len(lb), fb.FileSize())})
+	return nil
+}
+
+// diffLinks compares nodes that aren't unixfs link by link
+func (d *dagDiffer) diffLinks(ctx context.Context, a, b *merkledag.ProtoNode, path string) error {
+	la, lb := a.Links(), b.Links()
+	for i := 0; i < len(la) && i < len(lb); i++ {
+		if err := d.diff(ctx, la[i].Cid, lb[i].Cid, joinDagPath(path, linkName(la[i], i)), -1); err != nil {
+			return err
+		}
+	}
+
+	if len(la) != len(lb) && !d.done() {
+		d.found(dagDifference{Path: path, Offset: -1, Kind: "different number of links", A: fmt.Sprint(len(la)), B: fmt.Sprint(len(lb))})
+	}
+	return nil
+}
+
+func (d *dagDiffer) compareData(path string, offset int64, a, b []byte) {
+	if bytes.Equal(a, b) {
+		return
+	}
+
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	at := int64(-1)
+	if offset >= 0 {
+		at = offset + int64(i)
+	}
+
+	kind := "leaf data differs"
+	if i == len(a) || i == len(b) {
+		kind = "one is a prefix of the other"
+	}
+	d.found(dagDifference{Path: path, Offset: at, Kind: kind,
+		A: fmt.Sprintf("%d bytes, %s", len(a), dataAt(a, i)), B: fmt.Sprintf("%d bytes, %s", len(b), dataAt(b, i))})
+}
+
+func dataAt(data []byte, i int) string {
+	if i >= len(data) {
+		return "ends here"
+	}
+
+	end := i + 8
+	if end > len(data) {
+		end = len(data)
+	}
+	return fmt.Sprintf("% x...", data[i:end])
+}
+
+func leafData(nd ipld.Node) []byte {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return nd.RawData()
+	case *merkledag.ProtoNode:
+		if len(nd.Links()) > 0 {
+			return nil
+		}
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return nil
+		}
+		return fsn.Data()
+	default:
+		return nil
+	}
+}
+
+func linksByName(nd *merkledag.ProtoNode) map[string]cid.Cid {
+	out := make(map[string]cid.Cid, len(nd.Links()))
+	for _, l := range nd.Links() {
+		out[l.Name] = l.Cid
+	}
+	return out
+}
+
+func linkName(l *ipld.Link, i int) string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return fmt.Sprintf("[%d]", i)
+}
+
+func joinDagPath(path, name string) string {
+	return strings.TrimSuffix(path, "/") + "/" + name
+}
+
+func sumSizes(sizes []uint64) uint64 {
+	var total uint64
+	for _, s := range sizes {
+		total += s
+	}
+	return total
+}
+
+func describePrefix(p cid.Prefix) string {
+	return fmt.Sprintf("cidv%d %s %s", p.Version, cid.CodecToStr[p.Codec], multihash.Codes[p.MhType])
+}
+
+func describeNode(nd ipld.Node) string {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return fmt.Sprintf("raw block of %d bytes", len(nd.RawData()))
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return fmt.Sprintf("dag-pb node with %d links", len(nd.Links()))
+		}
+		return "dag-pb " + describeFileNode(fsn, len(nd.Links()))
+	default:
+		return fmt.Sprintf("%s node", cid.CodecToStr[nd.Cid().Prefix().Codec])
+	}
+}
+
+func describeFileNode(fsn *unixfs.FSNode, links int) string {
+	if links == 0 {
+		return fmt.Sprintf("%s node holding %d bytes", strings.ToLower(fsn.Type().String()), len(fsn.Data()))
+	}
+	return fmt.Sprintf("%s node of %d bytes split into %d children", strings.ToLower(fsn.Type().String()), fsn.FileSize(), links)
+}
@@ -0,0 +1,1010 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/go-cid"
+	cli "github.com/urfave/cli/v2"
+)
+
+const (
+	dealPhaseAccepted     = "accepted"
+	dealPhaseTransferring = "transferring"
+	dealPhaseTransferred  = "transferred"
+	dealPhaseSealing      = "sealing"
+	dealPhaseActive       = "active"
+	dealPhaseFailed       = "failed"
+	dealPhaseSlashed      = "slashed"
+)
+
+// Phase reduces a deal status to the step of the deal lifecycle it is in
+func (ds *DealStatus) Phase() string {
+	if ds.Deal.Failed {
+		return dealPhaseFailed
+	}
+
+	if ds.OnChainState != nil {
+		if ds.OnChainState.SlashEpoch > 0 {
+			return dealPhaseSlashed
+		}
+
+		if ds.OnChainState.SectorStartEpoch > 0 {
+			return dealPhaseActive
+		}
+	}
+
+	// once the deal has an ID it has been published and the miner is sealing it
+	if ds.Deal.DealID > 0 {
+		return dealPhaseSealing
+	}
+
+	if !ds.Deal.TransferFinished.IsZero() {
+		return dealPhaseTransferred
+	}
+
+	if ds.TransferStatus != nil || !ds.Deal.TransferStarted.IsZero() {
+		return dealPhaseTransferring
+	}
+
+	return dealPhaseAccepted
+}
+
+func isTerminalDealPhase(phase string) bool {
+	switch phase {
+	case dealPhaseActive, dealPhaseFailed, dealPhaseSlashed:
+		return true
+	default:
+		return false
+	}
+}
+
+var dealsCmd = &cli.Command{
+	Name:  "deals",
+	Usage: "inspect storage deals made for your content",
+	Subcommands: []*cli.Command{
+		dealsStatusCmd,
+		dealsStatusAllCmd,
+		dealsShowProposalCmd,
+		dealsExportPieceCmd,
+		dealsTransferLogCmd,
+		dealsSelectionAuditCmd,
+		dealsReplicationPlanCmd,
+		dealsDeadlineCmd,
+		dealsQueueCmd,
+		dealsPauseCmd,
+		dealsResumeCmd,
+		dealsPauseStatusCmd,
+		dealsSlashedCmd,
+		dealsMakeCmd,
+	},
+}
+
+var dealsStatusCmd = &cli.Command{
+	Name:      "status",
+	Usage:     "show the status of one or more deals",
+	ArgsUsage: "<proposal cid>...",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "watch",
+			Usage: "keep watching and print state transitions and transfer progress until every deal is active or failed",
+		},
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "how often to poll when watching, only used if the server can't notify us of transfer events",
+			Value: time.Second * 30,
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "give up watching after this long (0 watches forever)",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if !cctx.Args().Present() {
+			return fmt.Errorf("must specify at least one proposal cid")
+		}
+
+		var props []cid.Cid
+		for _, a := range cctx.Args().Slice() {
+			pc, err := cid.Decode(a)
+			if err != nil {
+				return fmt.Errorf("invalid proposal cid %q: %w", a, err)
+			}
+			props = append(props, pc)
+		}
+
+		if !cctx.Bool("watch") {
+			w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "PROPOSAL\tMINER\tDEAL ID\tTERMS\tFAST RETRIEVAL\tPROPOSAL SENDS\tSTATE\tEST. ACTIVE\n")
+			for _, pc := range props {
+				ds, err := c.DealStatusByProposal(ctx, pc)
+				if err != nil {
+					return fmt.Errorf("getting status for %s: %w", pc, err)
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%v\t%d\t%s\t%s\n", pc, ds.Deal.Miner, ds.Deal.DealID, dealTermsColumn(ds), ds.Deal.FastRetrieval, ds.Deal.ProposalAttempts, ds.Phase(), sealEstimateColumn(ds))
+			}
+			return w.Flush()
+		}
+
+		var timeout <-chan time.Time
+		if t := cctx.Duration("timeout"); t > 0 {
+			timeout = time.After(t)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		updates := make(chan dealStatusUpdate)
+		for _, pc := range props {
+			go watchDealStatus(ctx, c, pc, cctx.Duration("interval"), updates)
+		}
+
+		lastPhase := make(map[cid.Cid]string)
+		lastProgress := make(map[cid.Cid]uint64)
+		for {
+			done := true
+			for _, pc := range props {
+				if !isTerminalDealPhase(lastPhase[pc]) {
+					done = false
+					break
+				}
+			}
+
+			if done {
+				return nil
+			}
+
+			var u dealStatusUpdate
+			select {
+			case u = <-updates:
+			case <-timeout:
+				return fmt.Errorf("timed out waiting for deals to reach a final state")
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if u.err != nil {
+				// transient errors shouldn't end a long running watch
+				fmt.Fprintf(os.Stderr, "failed to get status for %s: %s\n", u.prop, u.err)
+				continue
+			}
+
+			now := time.Now().Format(time.RFC3339)
+			phase := u.status.Phase()
+			if prev, ok := lastPhase[u.prop]; !ok {
+				fmt.Printf("%s\t%s\t%s\n", now, u.prop, phase)
+			} else if prev != phase {
+				fmt.Printf("%s\t%s\t%s -> %s\n", now, u.prop, prev, phase)
+			}
+			lastPhase[u.prop] = phase
+
+			if ts := u.status.TransferStatus; ts != nil && phase == dealPhaseTransferring {
+				progress := ts.Sent
+				if ts.Received > progress {
+					progress = ts.Received
+				}
+
+				if progress != lastProgress[u.prop] {
+					fmt.Printf("%s\t%s\t%s transferred (%s)\n", now, u.prop, humanize.IBytes(progress), ts.StatusStr)
+					lastProgress[u.prop] = progress
+				}
+			}
+		}
+	},
+}
+
+// how healthy a deal is at a glance, for status-all
+const (
+	dealHealthActive       = "active"
+	dealHealthSealing      = "sealing"
+	dealHealthTransferring = "transferring"
+	dealHealthFailed       = "failed"
+	dealHealthExpired      = "expired"
+)
+
+var dealHealthOrder = []string{
+	dealHealthActive,
+	dealHealthSealing,
+	dealHealthTransferring,
+	dealHealthFailed,
+	dealHealthExpired,
+}
+
+func dealHealth(sum *DealProposalSummary, ds *DealStatus) string {
+	switch phase := ds.Phase(); phase {
+	case dealPhaseFailed, dealPhaseSlashed:
+		return dealHealthFailed
+	case dealPhaseActive:
+		if sum.Expired {
+			return dealHealthExpired
+		}
+		return dealHealthActive
+	default:
+		if sum.Expired {
+			return dealHealthExpired
+		}
+		if phase == dealPhaseSealing {
+			return dealHealthSealing
+		}
+		return dealHealthTransferring
+	}
+}
+
+var dealsStatusAllCmd = &cli.Command{
+	Name:  "status-all",
+	Usage: "check the status of every deal made for your content and summarize it by miner",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "how many deals to check at once",
+			Value: 8,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		props, err := c.DealProposals(ctx)
+		if err != nil {
+			return err
+		}
+
+		if len(props) == 0 {
+			fmt.Println("no deals found")
+			return nil
+		}
+
+		workers := cctx.Int("concurrency")
+		if workers < 1 {
+			workers = 1
+		}
+
+		type result struct {
+			status *DealStatus
+			err    error
+		}
+
+		results := make([]result, len(props))
+		sem := make(chan struct{}, workers)
+		var wg sync.WaitGroup
+		for i, p := range props {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, p *DealProposalSummary) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				pc, err := cid.Decode(p.PropCid)
+				if err != nil {
+					results[i].err = err
+					return
+				}
+				results[i].status, results[i].err = c.DealStatusByProposal(ctx, pc)
+			}(i, p)
+		}
+		wg.Wait()
+
+		order := make([]int, len(props))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return props[order[a]].Miner < props[order[b]].Miner
+		})
+
+		counts := make(map[string]int)
+		var errored int
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "MINER\tPROPOSAL\tCONTENT\tDEAL ID\tSTATE\n")
+		for _, i := range order {
+			p, r := props[i], results[i]
+			if r.err != nil {
+				errored++
+				fmt.Fprintf(w, "%s\t%s\t%d\t-\terror: %s\n", p.Miner, p.PropCid, p.Content, r.err)
+				continue
+			}
+
+			health := dealHealth(p, r.status)
+			counts[health]++
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", p.Miner, p.PropCid, p.Content, r.status.Deal.DealID, health)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		fmt.Println()
+		fmt.Printf("%d deals:", len(props))
+		for _, h := range dealHealthOrder {
+			fmt.Printf(" %d %s,", counts[h], h)
+		}
+		fmt.Printf(" %d could not be checked\n", errored)
+		return nil
+	},
+}
+
+var dealsTransferLogCmd = &cli.Command{
+	Name:      "transfer-log",
+	Usage:     "show the timeline of the data transfer for a deal",
+	ArgsUsage: "<proposal cid>",
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single proposal cid")
+		}
+
+		pc, err := cid.Decode(cctx.Args().First())
+		if err != nil {
+			return fmt.Errorf("invalid proposal cid: %w", err)
+		}
+
+		events, err := c.TransferLog(ctx, pc)
+		if err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			fmt.Println("no transfer events recorded for this deal")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "TIME\tSINCE START\tEVENT\tSTATUS\tSENT\tMESSAGE\n")
+		start := events[0].Time
+		for _, ev := range events {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", ev.Time.Local().Format(time.RFC3339), ev.Time.Sub(start).Round(time.Second), ev.Event, ev.Status, humanize.IBytes(ev.Sent), ev.Message)
+		}
+		return w.Flush()
+	},
+}
+
+var dealsSelectionAuditCmd = &cli.Command{
+	Name:      "selection-audit",
+	Usage:     "show which miners were considered for a content's deals, and why each was selected or filtered",
+	ArgsUsage: "<content id>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "last",
+			Usage: "only show the most recent round of selection",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single content id")
+		}
+
+		contID, err := strconv.ParseUint(cctx.Args().First(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid content id: %w", err)
+		}
+
+		audits, err := c.SelectionAudit(ctx, uint(contID))
+		if err != nil {
+			return err
+		}
+
+		if len(audits) == 0 {
+			fmt.Println("no miner selection recorded for this content")
+			return nil
+		}
+
+		if cctx.Bool("last") {
+			audits = audits[len(audits)-1:]
+		}
+
+		for i, a := range audits {
+			if i > 0 {
+				fmt.Println()
+			}
+
+			fmt.Printf("%s: looking for %d miners (verified = %v)\n", a.Time.Local().Format(time.RFC3339), a.Count, a.Verified)
+
+			w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "MINER\tSOURCE\tRANK\tOUTCOME\tREASON\tDETAIL\tSIZE TARGET\n")
+			for _, m := range a.Miners {
+				rank := "-"
+				if m.Rank > 0 {
+					rank = fmt.Sprint(m.Rank)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", m.Miner, m.Source, rank, m.Outcome, m.Reason, m.Detail, m.SizeTarget)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var bargeTestReplicasCmd = &cli.Command{
+	Name:      "test-replicas",
+	Usage:     "test retrieving a content from every miner with a deal for it, to see how many replicas really serve it",
+	ArgsUsage: "<content id>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "record-faults",
+			Usage: "mark the deals of replicas that fail the test as faulted, so the content is replicated again",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single content id")
+		}
+
+		contID, err := strconv.ParseUint(cctx.Args().First(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid content id: %w", err)
+		}
+
+		fmt.Println("testing replicas, this may take a few minutes...")
+		report, err := c.TestReplicas(ctx, uint(contID), cctx.Bool("record-faults"))
+		if err != nil {
+			return err
+		}
+
+		if report.Total == 0 {
+			fmt.Println("content has no deals on chain to test")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "MINER\tDEAL\tSTATUS\tQUERY\tRETRIEVAL\tSIZE\tSPEED\tERROR\n")
+		for _, r := range report.Replicas {
+			status := "ok"
+			if !r.Available {
+				status = "FAILED (" + r.Phase + ")"
+				if r.FaultRecorded {
+					status += ", fault recorded"
+				}
+			}
+
+			retrieval, size, speed := "-", "-", "-"
+			if r.Available {
+				retrieval = (time.Duration(r.RetrievalMs) * time.Millisecond).String()
+				size = humanize.IBytes(r.Bytes)
+				speed = humanize.IBytes(r.Speed) + "/s"
+			}
+
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Miner, r.DealID, status,
+				time.Duration(r.QueryMs)*time.Millisecond, retrieval, size, speed, r.Error)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		fmt.Printf("\n%d of %d replicas served the content\n", report.Available, report.Total)
+		return nil
+	},
+}
+
+var dealsReplicationPlanCmd = &cli.Command{
+	Name:      "replication-plan",
+	Usage:     "show how many deals the server would make for a content to meet a durability target, and with which miners",
+	ArgsUsage: "<content id>",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "tolerance",
+			Usage: "number of deals the content must survive losing (default: the server's)",
+		},
+		&cli.Float64Flag{
+			Name:  "confidence",
+			Usage: "confidence with which the content must survive, e.g. 0.999 (default: the server's)",
+		},
+		&cli.IntFlag{
+			Name:  "max",
+			Usage: "most deals to plan for (default: the server's)",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single content id")
+		}
+
+		contID, err := strconv.ParseUint(cctx.Args().First(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid content id: %w", err)
+		}
+
+		rp, err := c.ReplicationPlan(ctx, uint(contID), DurabilityTarget{
+			Tolerance:  cctx.Int("tolerance"),
+			Confidence: cctx.Float64("confidence"),
+			MaxDeals:   cctx.Int("max"),
+		})
+		if err != nil {
+			return err
+		}
+
+		plan := rp.Plan
+		fmt.Printf("replication: %d deals (%s)\n", rp.Replication, rp.Mode)
+		fmt.Printf("target: survive losing %d deals with %g confidence, at most %d deals\n", plan.Target.Tolerance, plan.Target.Confidence, plan.Target.MaxDeals)
+
+		met := "met"
+		if !plan.Met {
+			met = "NOT met"
+		}
+		fmt.Printf("plan: %d deals (%d new), confidence %.6f, target %s\n", plan.Deals, plan.NewDeals, plan.Confidence, met)
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "MINER\tLOSS PROBABILITY\tDEAL\n")
+		for _, r := range plan.Replicas {
+			deal := "new"
+			if r.Existing {
+				deal = "existing"
+			}
+			fmt.Fprintf(w, "%s\t%.4f\t%s\n", r.Miner, r.LossProbability, deal)
+		}
+		return w.Flush()
+	},
+}
+
+var dealsDeadlineCmd = &cli.Command{
+	Name:      "deadline",
+	Usage:     "set when a content must be fully replicated by, or check whether it will be",
+	ArgsUsage: "<content id>",
+	Description: `With --by, deals for the content go to the miners that seal fastest, with
+spare deals in case some fail. Without it, shows whether the deadline set
+earlier can still be met.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "by",
+			Usage: "deadline, as a time (RFC 3339) or a duration from now such as 72h",
+		},
+		&cli.BoolFlag{
+			Name:  "reduce-replication",
+			Usage: "make fewer deals if the replication can't be met by the deadline",
+		},
+		&cli.BoolFlag{
+			Name:  "clear",
+			Usage: "remove the content's deadline",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single content id")
+		}
+
+		contID, err := strconv.ParseUint(cctx.Args().First(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid content id: %w", err)
+		}
+
+		var rep *DealDeadlineReport
+		switch {
+		case cctx.Bool("clear"):
+			if _, err := c.SetDealDeadline(ctx, uint(contID), nil, false); err != nil {
+				return err
+			}
+			fmt.Printf("cleared the deal deadline of content %d\n", contID)
+			return nil
+		case cctx.IsSet("by"):
+			deadline, err := parseDeadline(cctx.String("by"))
+			if err != nil {
+				return err
+			}
+
+			rep, err = c.SetDealDeadline(ctx, uint(contID), &deadline, cctx.Bool("reduce-replication"))
+			if err != nil {
+				return err
+			}
+		default:
+			rep, err = c.DealDeadline(ctx, uint(contID))
+			if err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("deadline: %s (in %s)\n", rep.Deadline.Local().Format(time.RFC3339), roundSealTime(time.Until(rep.Deadline)))
+		fmt.Printf("replication: %d deals, %d sealed, %d expected to seal in time, %d late\n", rep.Replication, rep.Sealed, rep.InTime, rep.Late)
+		fmt.Printf("transfer: about %s\n", roundSealTime(rep.Transfer))
+
+		switch {
+		case rep.Achievable:
+			fmt.Println("the deadline can be met")
+		case rep.ReducedTo > 0:
+			fmt.Printf("WARNING: the deadline can't be met, replication reduced to %d deals\n", rep.ReducedTo)
+		default:
+			fmt.Println("WARNING: the deadline can't be met with the target replication, --reduce-replication makes fewer deals instead")
+		}
+
+		if len(rep.Candidates) == 0 {
+			fmt.Println("no miners are expected to seal a new deal in time")
+			return nil
+		}
+
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "MINER\tTYPICAL SEAL\tSLOW SEAL\tBASIS\n")
+		for _, m := range rep.Candidates {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Miner, roundSealTime(m.Median), roundSealTime(m.High), m.Basis)
+		}
+		return w.Flush()
+	},
+}
+
+var dealsQueueCmd = &cli.Command{
+	Name:  "queue",
+	Usage: "show the contents waiting to be checked for deals, in the order they will be checked (needs an admin token)",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "show at most this many contents, 0 for all",
+			Value: 50,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		queue, err := c.DealQueue(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		byPriority := make(map[string]int)
+		for _, e := range queue {
+			byPriority[e.Priority]++
+		}
+		fmt.Printf("%d contents queued", len(queue))
+		for _, p := range []string{"urgent", "high", "normal", "low"} {
+			if n := byPriority[p]; n > 0 {
+				fmt.Printf(", %d %s", n, p)
+			}
+		}
+		fmt.Println()
+
+		if limit := cctx.Int("limit"); limit > 0 && len(queue) > limit {
+			queue = queue[:limit]
+		}
+		if len(queue) == 0 {
+			return nil
+		}
+
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "#\tCONTENT\tPRIORITY\tWAITING\n")
+		for i, e := range queue {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", i+1, e.Content, e.Priority, time.Since(e.Queued).Round(time.Second))
+		}
+		return w.Flush()
+	},
+}
+
+var dealsPauseCmd = &cli.Command{
+	Name:  "pause",
+	Usage: "stop the server from proposing new deals, deals and transfers in progress carry on (needs an admin token)",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "reason",
+			Usage: "why deal making is paused, shown in the pause status",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		st, err := c.PauseDealMaking(cctx.Context, cctx.String("reason"))
+		if err != nil {
+			return err
+		}
+
+		printDealPause(st)
+		return nil
+	},
+}
+
+var dealsResumeCmd = &cli.Command{
+	Name:  "resume",
+	Usage: "resume deal making after a pause (needs an admin token)",
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		st, err := c.DealPauseStatus(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		if _, err := c.ResumeDealMaking(cctx.Context); err != nil {
+			return err
+		}
+
+		if !st.Paused {
+			fmt.Println("deal making was not paused")
+			return nil
+		}
+		fmt.Printf("deal making resumed, %d deferred contents queued for deals\n", st.Deferred)
+		return nil
+	},
+}
+
+var dealsPauseStatusCmd = &cli.Command{
+	Name:  "pause-status",
+	Usage: "show whether deal making is paused (needs an admin token)",
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		st, err := c.DealPauseStatus(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		printDealPause(st)
+		return nil
+	},
+}
+
+var dealsSlashedCmd = &cli.Command{
+	Name:  "slashed",
+	Usage: "list the deals whose miner was slashed for losing the data, most recent first (needs an admin token)",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "show at most this many deals, 0 for all",
+			Value: 50,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		deals, err := c.SlashedDeals(cctx.Context, cctx.Int("limit"))
+		if err != nil {
+			return err
+		}
+
+		if len(deals) == 0 {
+			fmt.Println("no slashed deals")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "DEAL ID\tCONTENT\tMINER\tSLASH EPOCH\tFOUND\n")
+		for _, d := range deals {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%s\n", d.DealID, d.Content, d.Miner, d.SlashEpoch, d.FailedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	},
+}
+
+var dealsMakeCmd = &cli.Command{
+	Name:      "make",
+	Usage:     "propose a deal for a content to a miner (needs an admin token)",
+	ArgsUsage: "<miner> <content id or cid>",
+	Description: `With --renegotiate, a proposal the miner rejects for being priced below its
+ask is sent again at the miner's current price, as long as that is no more
+than --max-price. Rejections for any other reason are not retried.
+
+With --piece-cid, the piece commitment is taken as given, e.g. from a commp
+service, instead of being computed by the server. The server checks it
+against the content as far as it can and refuses it on a mismatch.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "max-price",
+			Usage: "highest price to pay, in FIL per GiB per epoch, instead of the node's limit",
+		},
+		&cli.BoolFlag{
+			Name:  "renegotiate",
+			Usage: "if the miner rejects the price, propose again at its new ask if within --max-price",
+		},
+		&cli.StringFlag{
+			Name:  "piece-size",
+			Usage: "padded size of the piece to propose, e.g. 32GiB, defaults to the smallest the miner accepts",
+		},
+		&cli.StringFlag{
+			Name:  "piece-cid",
+			Usage: "piece commitment of the content computed elsewhere, needs --piece-size",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 2 {
+			return fmt.Errorf("must specify a miner and a content")
+		}
+
+		if cctx.Bool("renegotiate") && !cctx.IsSet("max-price") {
+			return fmt.Errorf("--renegotiate needs a --max-price to renegotiate up to")
+		}
+
+		if cctx.IsSet("piece-cid") && !cctx.IsSet("piece-size") {
+			return fmt.Errorf("--piece-cid needs the --piece-size of its piece")
+		}
+
+		req := DealRequest{
+			MaxPrice:    cctx.String("max-price"),
+			Renegotiate: cctx.Bool("renegotiate"),
+			PieceCid:    cctx.String("piece-cid"),
+		}
+
+		if cctx.IsSet("piece-size") {
+			size, err := humanize.ParseBytes(cctx.String("piece-size"))
+			if err != nil {
+				return fmt.Errorf("invalid piece size: %w", err)
+			}
+			req.PieceSize = size
+		}
+
+		cont := cctx.Args().Get(1)
+		if id, err := strconv.ParseUint(cont, 10, 64); err == nil {
+			req.Content = uint(id)
+		} else if _, err := cid.Decode(cont); err == nil {
+			req.Cid = cont
+		} else {
+			return fmt.Errorf("%q is neither a content id nor a cid", cont)
+		}
+
+		miner := cctx.Args().First()
+		res, err := c.MakeDeal(cctx.Context, miner, req)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("made deal %d with %s (%d proposal attempts)\n", res.Deal, miner, res.ProposalAttempts)
+		if adj := res.PriceAdjustment; adj != nil {
+			fmt.Printf("miner rejected price %s, renegotiated to %s per GiB per epoch\n", adj.From, adj.To)
+		}
+		return nil
+	},
+}
+
+func printDealPause(st *DealPause) {
+	if !st.Paused {
+		fmt.Println("deal making is running")
+		return
+	}
+
+	fmt.Printf("deal making paused for %s", time.Since(st.Since).Round(time.Second))
+	if st.Reason != "" {
+		fmt.Printf(": %s", st.Reason)
+	}
+	fmt.Println()
+	fmt.Printf("%d contents waiting for deals\n", st.Deferred)
+}
+
+// parseDeadline takes either a time or a duration from now
+func parseDeadline(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid deadline %q, must be a time (RFC 3339) or a duration: %w", s, err)
+	}
+	return t, nil
+}
+
+// dealTermsColumn shows whether a deal was made verified or paid, and why
+func dealTermsColumn(ds *DealStatus) string {
+	terms := "paid"
+	if ds.Deal.Verified {
+		terms = "verified"
+	}
+
+	if ds.Deal.TermsReason == "" {
+		return terms
+	}
+	return fmt.Sprintf("%s (%s)", terms, ds.Deal.TermsReason)
+}
+
+// sealEstimateColumn shows when a deal that is waiting on the miner to seal
+// it is expected to become active
+func sealEstimateColumn(ds *DealStatus) string {
+	est := ds.SealEstimate
+	if est == nil || ds.Deal.TransferFinished.IsZero() {
+		return "-"
+	}
+
+	const layout = "Jan 2 15:04"
+	low := ds.Deal.TransferFinished.Add(est.Low)
+	high := ds.Deal.TransferFinished.Add(est.High)
+	return fmt.Sprintf("%s - %s", low.Local().Format(layout), high.Local().Format(layout))
+}
+
+// how long each status request asks the server to wait for a transfer event
+const dealStatusWait = time.Minute * 5
+
+type dealStatusUpdate struct {
+	prop   cid.Cid
+	status *DealStatus
+	err    error
+}
+
+// watchDealStatus sends the status of a deal every time it may have changed
+// until it reaches a final phase. If the server supports it, we wait on its
+// data transfer events, otherwise we fall back to polling every interval.
+func watchDealStatus(ctx context.Context, c *EstClient, pc cid.Cid, interval time.Duration, out chan<- dealStatusUpdate) {
+	send := func(u dealStatusUpdate) bool {
+		select {
+		case out <- u:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	ds, err := c.DealStatusByProposal(ctx, pc)
+	if !send(dealStatusUpdate{prop: pc, status: ds, err: err}) {
+		return
+	}
+
+	subscribed := err == nil
+	for err != nil || !isTerminalDealPhase(ds.Phase()) {
+		if !subscribed {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		ds, subscribed, err = c.DealStatusByProposalWait(ctx, pc, dealStatusWait)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if !send(dealStatusUpdate{prop: pc, status: ds, err: err}) {
+			return
+		}
+	}
+}
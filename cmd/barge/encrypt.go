@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Content encrypted by barge starts with encMagic and a random nonce prefix,
+// followed by the plaintext in encSegmentSize segments each sealed with
+// AES-256-GCM. A segment's nonce is the prefix, its number and whether it is
+// the last one, so segments can't be reordered or dropped and the content
+// can't be truncated without decryption failing.
+const (
+	encCipher      = "aes-256-gcm-stream-v1"
+	encKeySize     = 32
+	encSegmentSize = 64 << 10
+	encPrefixSize  = 7
+)
+
+var encMagic = []byte("BARGEENC")
+
+func newContentAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != encKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", encKeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, seg uint32, last bool) []byte {
+	nonce := make([]byte, 0, encPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = append(nonce, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], seg)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// readSegment reads up to len(buf) bytes, and reports whether they are the
+// last of src
+func readSegment(src *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(src, buf)
+	switch err {
+	case nil:
+		if _, err := src.Peek(1); err != nil {
+			if err == io.EOF {
+				return n, true, nil
+			}
+			return n, false, err
+		}
+		return n, false, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, true, nil
+	default:
+		return n, false, err
+	}
+}
+
+type encryptReader struct {
+	aead   cipher.AEAD
+	prefix []byte
+	src    *bufio.Reader
+
+	seg   uint32
+	done  bool
+	plain []byte
+	out   []byte
+}
+
+// newEncryptReader encrypts everything read from src
+func newEncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newContentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		aead:   aead,
+		prefix: prefix,
+		src:    bufio.NewReader(src),
+		plain:  make([]byte, encSegmentSize),
+		out:    append(append([]byte{}, encMagic...), prefix...),
+	}, nil
+}
+
+func (er *encryptReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+
+		n, last, err := readSegment(er.src, er.plain)
+		if err != nil {
+			return 0, err
+		}
+
+		er.out = er.aead.Seal(er.out[:0], segmentNonce(er.prefix, er.seg, last), er.plain[:n], nil)
+		er.done = last
+
+		er.seg++
+		if er.seg == 0 && !last {
+			return 0, fmt.Errorf("content too large to encrypt")
+		}
+	}
+
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+type decryptReader struct {
+	aead   cipher.AEAD
+	prefix []byte
+	src    *bufio.Reader
+
+	seg    uint32
+	done   bool
+	sealed []byte
+	out    []byte
+}
+
+// newDecryptReader decrypts content encrypted by newEncryptReader, failing if
+// it was encrypted with another key or has been tampered with
+func newDecryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newContentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(src)
+	header := make([]byte, len(encMagic)+encPrefixSize)
+	if _, err := io.ReadFull(br, header); err != nil || !bytes.Equal(header[:len(encMagic)], encMagic) {
+		return nil, fmt.Errorf("content was not encrypted by barge")
+	}
+
+	return &decryptReader{
+		aead:   aead,
+		prefix: header[len(encMagic):],
+		src:    br,
+		sealed: make([]byte, encSegmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+
+		n, last, err := readSegment(dr.src, dr.sealed)
+		if err != nil {
+			return 0, err
+		}
+
+		dr.out, err = dr.aead.Open(dr.out[:0], segmentNonce(dr.prefix, dr.seg, last), dr.sealed[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt segment %d, wrong key or corrupted content", dr.seg)
+		}
+		dr.done = last
+		dr.seg++
+	}
+
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+// contentKey is what barge keeps about the key a content was encrypted with,
+// in ~/.barge/keys/<cid>.json
+type contentKey struct {
+	Cid     string    `json:"cid"`
+	Cipher  string    `json:"cipher"`
+	Created time.Time `json:"created"`
+
+	// the key itself if barge generated it, otherwise the file the user
+	// gave it in, which isn't copied
+	Key     string `json:"key,omitempty"`
+	KeyFile string `json:"keyFile,omitempty"`
+}
+
+func (ck *contentKey) key() ([]byte, error) {
+	if ck.Cipher != encCipher {
+		return nil, fmt.Errorf("unsupported cipher %q", ck.Cipher)
+	}
+
+	if ck.KeyFile != "" {
+		return readKeyFile(ck.KeyFile)
+	}
+	return decodeKey(ck.Key)
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("key must be hex encoded: %w", err)
+	}
+
+	if len(key) != encKeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", encKeySize, len(key))
+	}
+	return key, nil
+}
+
+// readKeyFile reads a key given as hex in a file
+func readKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := decodeKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading key file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func keysDir() (string, error) {
+	dir, err := homedir.Expand("~/.barge/keys")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func writeContentKey(path string, ck *contentKey) error {
+	data, err := json.MarshalIndent(ck, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// newContentKey makes the key for a content about to be encrypted, reading
+// it from keyFile if one is given. The key is saved before anything is
+// uploaded, so that it isn't lost if the upload goes through but barge
+// doesn't get to record its cid. Call the returned function with the cid
+// once it is known.
+func newContentKey(keyFile string) ([]byte, func(cid string) error, error) {
+	ck := &contentKey{
+		Cipher:  encCipher,
+		Created: time.Now(),
+	}
+
+	var key []byte
+	if keyFile != "" {
+		abs, err := filepath.Abs(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, err = readKeyFile(abs)
+		if err != nil {
+			return nil, nil, err
+		}
+		ck.KeyFile = abs
+	} else {
+		key = make([]byte, encKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, nil, err
+		}
+		ck.Key = hex.EncodeToString(key)
+	}
+
+	dir, err := keysDir()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pending := filepath.Join(dir, fmt.Sprintf("pending-%d.json", ck.Created.UnixNano()))
+	if err := writeContentKey(pending, ck); err != nil {
+		return nil, nil, fmt.Errorf("failed to save encryption key: %w", err)
+	}
+
+	commit := func(cid string) error {
+		ck.Cid = cid
+		if err := writeContentKey(filepath.Join(dir, cid+".json"), ck); err != nil {
+			return fmt.Errorf("failed to save encryption key for %s, it is still in %s: %w", cid, pending, err)
+		}
+		return os.Remove(pending)
+	}
+	return key, commit, nil
+}
+
+// loadContentKey returns the key a content was encrypted with by barge
+func loadContentKey(cid string) ([]byte, error) {
+	dir, err := keysDir()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, cid+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no encryption key saved for %s, pass --key-file", cid)
+		}
+		return nil, err
+	}
+
+	var ck contentKey
+	if err := json.Unmarshal(data, &ck); err != nil {
+		return nil, fmt.Errorf("failed to read saved encryption key for %s: %w", cid, err)
+	}
+	return ck.key()
+}
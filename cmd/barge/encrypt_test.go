@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the magic and nonce prefix, and a full segment with its GCM tag
+var (
+	encHeaderSize     = len(encMagic) + encPrefixSize
+	sealedSegmentSize = encSegmentSize + 16
+)
+
+func testKey(t *testing.T) []byte {
+	key := make([]byte, encKeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func testEncrypt(t *testing.T, plain, key []byte) []byte {
+	r, err := newEncryptReader(bytes.NewReader(plain), key)
+	require.NoError(t, err)
+
+	sealed, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return sealed
+}
+
+func testDecrypt(sealed, key []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// sealedSegment returns segment i of encrypted content
+func sealedSegment(sealed []byte, i int) []byte {
+	start := encHeaderSize + i*sealedSegmentSize
+	end := start + sealedSegmentSize
+	if end > len(sealed) {
+		end = len(sealed)
+	}
+	return sealed[start:end]
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := testKey(t)
+
+	for _, size := range []int{0, 1, encSegmentSize - 1, encSegmentSize, encSegmentSize + 1, 3*encSegmentSize + 17} {
+		plain := make([]byte, size)
+		_, err := rand.Read(plain)
+		require.NoError(t, err)
+
+		sealed := testEncrypt(t, plain, key)
+		require.Equal(t, encMagic, sealed[:len(encMagic)])
+
+		out, err := testDecrypt(sealed, key)
+		require.NoError(t, err, "size %d", size)
+		require.True(t, bytes.Equal(plain, out), "size %d", size)
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	sealed := testEncrypt(t, []byte("hello barge"), testKey(t))
+
+	_, err := testDecrypt(sealed, testKey(t))
+	require.Error(t, err)
+
+	_, err = testDecrypt([]byte("not encrypted at all"), testKey(t))
+	require.Error(t, err)
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*encSegmentSize+100)
+	sealed := testEncrypt(t, plain, key)
+
+	for _, i := range []int{encHeaderSize, encHeaderSize + encSegmentSize + 20, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 1
+
+		_, err := testDecrypt(tampered, key)
+		require.Error(t, err, "byte %d", i)
+	}
+
+	// the nonce prefix is in the header
+	tampered := append([]byte{}, sealed...)
+	tampered[len(encMagic)] ^= 1
+	_, err := testDecrypt(tampered, key)
+	require.Error(t, err)
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*encSegmentSize+100)
+	sealed := testEncrypt(t, plain, key)
+
+	// dropping whole segments off the end leaves a segment that wasn't
+	// sealed as the last one
+	for _, segs := range []int{1, 2} {
+		end := encHeaderSize + segs*sealedSegmentSize
+		_, err := testDecrypt(sealed[:end], key)
+		require.Error(t, err, "%d segments", segs)
+	}
+
+	_, err := testDecrypt(sealed[:len(sealed)-10], key)
+	require.Error(t, err)
+
+	_, err = testDecrypt(sealed[:encHeaderSize], key)
+	require.Error(t, err)
+}
+
+func TestDecryptReordered(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 3*encSegmentSize)
+	_, err := rand.Read(plain)
+	require.NoError(t, err)
+	sealed := testEncrypt(t, plain, key)
+
+	var reordered []byte
+	reordered = append(reordered, sealed[:encHeaderSize]...)
+	reordered = append(reordered, sealedSegment(sealed, 1)...)
+	reordered = append(reordered, sealedSegment(sealed, 0)...)
+	reordered = append(reordered, sealedSegment(sealed, 2)...)
+	require.Len(t, reordered, len(sealed))
+
+	_, err = testDecrypt(reordered, key)
+	require.Error(t, err)
+}
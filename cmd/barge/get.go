@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	unixfile "github.com/ipfs/go-unixfs/file"
+	uio "github.com/ipfs/go-unixfs/io"
+	cli "github.com/urfave/cli/v2"
+)
+
+// getFlags are shared by the commands that can retrieve content
+var getFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "output",
+		Aliases: []string{"o"},
+		Usage:   "where to write the content, '-' streams a file to stdout (defaults to the cid in the current directory)",
+	},
+	&cli.StringSliceFlag{
+		Name:  "peer",
+		Usage: "additional multiaddrs to fetch the content from",
+	},
+	&cli.BoolFlag{
+		Name:  "find-providers",
+		Usage: "if no --peer is given, also fetch from bitswap providers the network indexer knows of",
+	},
+	&cli.BoolFlag{
+		Name:  "decrypt",
+		Usage: "decrypt a file uploaded with 'plumb put-file --encrypt', using the key saved for it",
+	},
+	&cli.StringFlag{
+		Name:  "key-file",
+		Usage: "file with the hex encoded key to decrypt with, instead of the saved one",
+	},
+	&cli.BoolFlag{
+		Name:  "verify-checksum",
+		Usage: "check the file against the checksum estuary took when it was uploaded",
+	},
+	&cli.StringFlag{
+		Name:  "checksum",
+		Usage: "check the file against this checksum (sha256:<hex digest>) instead of estuary's",
+	},
+}
+
+var bargeGetCmd = &cli.Command{
+	Name:      "get",
+	Usage:     "retrieve unixfs content from estuary",
+	ArgsUsage: "<cid>",
+	Flags:     getFlags,
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single cid to retrieve")
+		}
+
+		root, err := cid.Decode(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		return getContent(cctx, c, root, "")
+	},
+}
+
+// getContent retrieves the content at the path under root, which is empty or
+// starts with a slash, as set up by the getFlags
+func getContent(cctx *cli.Context, c *EstClient, root cid.Cid, subpath string) error {
+	ctx := cctx.Context
+
+	name := root.String()
+	if subpath != "" {
+		if cctx.Bool("decrypt") {
+			return fmt.Errorf("only whole files uploaded with --encrypt can be decrypted, not a path under %s", root)
+		}
+		name = path.Base(subpath)
+	}
+
+	out := cctx.String("output")
+	if out == "" {
+		out = name
+	}
+
+	if out == "-" && isTerminal(os.Stdout) {
+		return fmt.Errorf("refusing to write binary data to a terminal, redirect stdout or pass --output <path>")
+	}
+
+	// look the key up before fetching anything, so a missing key doesn't
+	// waste a retrieval
+	var key []byte
+	var err error
+	switch {
+	case cctx.IsSet("key-file"):
+		if !cctx.Bool("decrypt") {
+			return fmt.Errorf("--key-file is only used with --decrypt")
+		}
+
+		key, err = readKeyFile(cctx.String("key-file"))
+	case cctx.Bool("decrypt"):
+		key, err = loadContentKey(root.String())
+	}
+	if err != nil {
+		return err
+	}
+
+	checksum, err := expectedChecksum(cctx, c, root, subpath)
+	if err != nil {
+		return err
+	}
+
+	bstore, cleanup, err := tempBlockstore()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	pc, err := setupBitswap(ctx, bstore)
+	if err != nil {
+		return err
+	}
+	defer pc.host.Close()
+
+	addrs, err := c.PeerAddrs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get estuary node addresses: %w", err)
+	}
+	addrs = append(addrs, cctx.StringSlice("peer")...)
+
+	if err := connectToDelegates(ctx, pc.host, addrs); err != nil {
+		return fmt.Errorf("failed to connect to estuary node: %w", err)
+	}
+
+	if cctx.Bool("find-providers") && !cctx.IsSet("peer") {
+		provs, err := c.FindProviders(ctx, root)
+		if err != nil {
+			return fmt.Errorf("failed to find providers: %w", err)
+		}
+
+		for _, p := range provs {
+			if !hasProtocol(p, "bitswap") {
+				continue
+			}
+
+			var paddrs []string
+			for _, a := range p.Addrs {
+				paddrs = append(paddrs, a+"/p2p/"+p.PeerID)
+			}
+
+			// providers come and go, one we can't reach shouldn't stop the retrieval
+			if err := connectToDelegates(ctx, pc.host, paddrs); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to connect to provider %s: %s\n", p.PeerID, err)
+			}
+		}
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(bstore, pc.bitswap))
+	nd, err := dserv.Get(ctx, root)
+	if err != nil {
+		return fmt.Errorf("failed to fetch root %s: %w", root, err)
+	}
+
+	target := root.String() + subpath
+	if subpath != "" {
+		nd, err = walkUnixfsPath(ctx, dserv, nd, subpath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", target, err)
+		}
+	}
+
+	fnd, err := unixfile.NewUnixfsFile(ctx, dserv, nd)
+	if err != nil {
+		return err
+	}
+	defer fnd.Close()
+
+	switch f := fnd.(type) {
+	case files.File:
+		if checksum != "" {
+			return writeChecked(f, key, out, name, checksum)
+		}
+
+		if key != nil {
+			return writeDecrypted(f, key, out, name)
+		}
+
+		if out == "-" {
+			_, err := io.Copy(os.Stdout, f)
+			return err
+		}
+
+		fi, err := os.Stat(out)
+		if err == nil && fi.IsDir() {
+			out = filepath.Join(out, name)
+		}
+
+		return files.WriteTo(f, out)
+	case files.Directory:
+		if key != nil {
+			return fmt.Errorf("%s is a directory, only files uploaded with --encrypt can be decrypted", target)
+		}
+
+		if checksum != "" {
+			return fmt.Errorf("%s is a directory, only files have checksums", target)
+		}
+
+		if out == "-" {
+			return fmt.Errorf("%s is a directory, pass a directory path to --output", target)
+		}
+
+		fi, err := os.Stat(out)
+		switch {
+		case err == nil && !fi.IsDir():
+			return fmt.Errorf("%s is a directory, but output %s is a file", target, out)
+		case err == nil:
+			// reconstruct inside the existing directory
+			out = filepath.Join(out, name)
+		case !os.IsNotExist(err):
+			return err
+		}
+
+		return files.WriteTo(f, out)
+	default:
+		return fmt.Errorf("%s is not a unixfs file or directory", target)
+	}
+}
+
+// tempBlockstore is an on disk blockstore for the blocks of one retrieval, so
+// fetching a large dag doesn't hold all of it in memory. cleanup closes it and
+// removes its directory.
+func tempBlockstore() (blockstore.Blockstore, func(), error) {
+	dir, err := os.MkdirTemp("", "barge-get-")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fds, err := flatfs.CreateOrOpen(dir, flatfs.IPFS_DEF_SHARD, false)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	cleanup := func() {
+		fds.Close()
+		if err := os.RemoveAll(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to remove temporary blockstore %s: %s\n", dir, err)
+		}
+	}
+
+	return blockstore.NewBlockstoreNoPrefix(fds), cleanup, nil
+}
+
+// walkUnixfsPath follows the path down from a unixfs directory, fetching
+// each directory on the way
+func walkUnixfsPath(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, p string) (ipld.Node, error) {
+	for _, seg := range strings.Split(strings.Trim(p, "/"), "/") {
+		if seg == "" {
+			continue
+		}
+
+		dir, err := uio.NewDirectoryFromNode(dserv, nd)
+		if err != nil {
+			return nil, fmt.Errorf("cannot look up %q: %w", seg, err)
+		}
+
+		nd, err = dir.Find(ctx, seg)
+		if err != nil {
+			return nil, fmt.Errorf("looking up %q: %w", seg, err)
+		}
+	}
+	return nd, nil
+}
+
+// expectedChecksum is the checksum to check the retrieved file against, if
+// any was asked for
+func expectedChecksum(cctx *cli.Context, c *EstClient, root cid.Cid, subpath string) (string, error) {
+	if cctx.IsSet("checksum") {
+		return util.ParseChecksum(cctx.String("checksum"))
+	}
+
+	if !cctx.Bool("verify-checksum") {
+		return "", nil
+	}
+
+	// estuary only checksums whole uploads
+	if subpath != "" {
+		return "", fmt.Errorf("estuary has no checksum for a path under %s, pass one with --checksum", root)
+	}
+
+	sums, err := c.ContentChecksums(cctx.Context, root)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up checksum: %w", err)
+	}
+
+	switch len(sums) {
+	case 0:
+		return "", fmt.Errorf("estuary has no checksum for %s", root)
+	case 1:
+		return sums[0], nil
+	default:
+		return "", fmt.Errorf("%s was uploaded with different checksums (%s), pass one with --checksum", root, strings.Join(sums, ", "))
+	}
+}
+
+// writeChecked writes the file to out, decrypting it if key is set, and
+// checks it against checksum once written. The checksum of an encrypted file
+// is of what was uploaded, so it is taken before decrypting. A file that
+// doesn't match is removed.
+func writeChecked(f files.File, key []byte, out, name, checksum string) error {
+	ck := util.NewChecksummer(f)
+
+	var r io.Reader = ck
+	if key != nil {
+		dr, err := newDecryptReader(ck, key)
+		if err != nil {
+			return err
+		}
+		r = dr
+	}
+
+	check := func() error {
+		// drain whatever the decryption didn't need to read
+		if _, err := io.Copy(io.Discard, ck); err != nil {
+			return err
+		}
+
+		if sum := ck.Sum(); sum != checksum {
+			return fmt.Errorf("checksum mismatch: got %s, expected %s", sum, checksum)
+		}
+		return nil
+	}
+
+	if out == "-" {
+		if _, err := io.Copy(os.Stdout, r); err != nil {
+			return err
+		}
+		return check()
+	}
+
+	fi, err := os.Stat(out)
+	if err == nil && fi.IsDir() {
+		out = filepath.Join(out, name)
+	}
+
+	of, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(of, r); err != nil {
+		of.Close()
+		os.Remove(out)
+		return err
+	}
+
+	if err := of.Close(); err != nil {
+		os.Remove(out)
+		return err
+	}
+
+	if err := check(); err != nil {
+		os.Remove(out)
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "checksum verified: %s\n", checksum)
+	return nil
+}
+
+// writeDecrypted writes the decrypted file to out. A file that fails to
+// decrypt part way through is removed rather than left half written.
+func writeDecrypted(f files.File, key []byte, out, name string) error {
+	dr, err := newDecryptReader(f, key)
+	if err != nil {
+		return err
+	}
+
+	if out == "-" {
+		_, err := io.Copy(os.Stdout, dr)
+		return err
+	}
+
+	fi, err := os.Stat(out)
+	if err == nil && fi.IsDir() {
+		out = filepath.Join(out, name)
+	}
+
+	of, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(of, dr); err != nil {
+		of.Close()
+		os.Remove(out)
+		return err
+	}
+	return of.Close()
+}
+
+// isTerminal reports whether f is an interactive character device
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -10,7 +11,9 @@ import (
 	"math/rand"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"text/tabwriter"
@@ -37,6 +40,8 @@ import (
 	"github.com/ipfs/go-unixfs"
 	"github.com/ipfs/go-unixfs/importer/balanced"
 	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	"github.com/ipfs/go-unixfs/importer/trickle"
+	"github.com/ipld/go-car"
 	"github.com/libp2p/go-libp2p"
 	connmgr "github.com/libp2p/go-libp2p-connmgr"
 	"github.com/libp2p/go-libp2p-core/host"
@@ -51,6 +56,7 @@ import (
 	cli "github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
 
+	"github.com/application-research/estuary/util"
 	dagsplit "github.com/application-research/estuary/util/dagsplit"
 )
 
@@ -69,6 +75,18 @@ func main() {
 		bargeSyncCmd,
 		bargeCheckCmd,
 		bargeShareCmd,
+		dealsCmd,
+		bargeTestReplicasCmd,
+		retrievalProgressCmd,
+		rehydrateCmd,
+		bargeGetCmd,
+		bargeCidCmd,
+		dagDiffCmd,
+		minersCmd,
+		rebalanceCmd,
+		findProvidersCmd,
+		aggregationStatusCmd,
+		resolveCmd,
 	}
 	app.Flags = []cli.Flag{
 		&cli.BoolFlag{
@@ -222,7 +240,9 @@ var plumbCmd = &cli.Command{
 	Usage:  "low level plumbing commands",
 	Subcommands: []*cli.Command{
 		plumbPutFileCmd,
+		plumbPutURLCmd,
 		plumbPutCarCmd,
+		plumbPutTarCmd,
 		plumbSplitAddFileCmd,
 		plumbPutDirCmd,
 	},
@@ -254,11 +274,30 @@ func loadClient(cctx *cli.Context) (*EstClient, error) {
 
 var plumbPutFileCmd = &cli.Command{
 	Name: "put-file",
+	Description: `With --encrypt the file is encrypted with AES-256-GCM before it leaves
+this machine, so estuary and the miners it makes deals with only ever store
+ciphertext. The key is read from --key-file (32 bytes, hex encoded) or
+generated, and saved in ~/.barge/keys/<cid>.json for 'barge get --decrypt'.
+
+Anyone with that file can read the content, and without it the content can't
+be recovered by anyone, estuary included: back it up and keep it private.
+Keys given with --key-file aren't copied, only their path is recorded, so
+the key file has to stay where it is or be passed to get again. Encrypted
+content can't be viewed through gateways, and uploading the same file twice
+stores it twice as it is encrypted differently each time.`,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:  "name",
 			Usage: "specify alternate name for file to be added with",
 		},
+		&cli.BoolFlag{
+			Name:  "encrypt",
+			Usage: "encrypt the file before uploading it",
+		},
+		&cli.StringFlag{
+			Name:  "key-file",
+			Usage: "file with the hex encoded key to encrypt with, instead of generating one",
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		if !cctx.Args().Present() {
@@ -276,7 +315,93 @@ var plumbPutFileCmd = &cli.Command{
 			fname = oname
 		}
 
-		resp, err := c.AddFile(f, fname)
+		if !cctx.Bool("encrypt") {
+			if cctx.IsSet("key-file") {
+				return fmt.Errorf("--key-file is only used with --encrypt")
+			}
+
+			resp, err := c.AddFile(f, fname)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(resp.Cid)
+			return nil
+		}
+
+		fi, err := os.Open(f)
+		if err != nil {
+			return err
+		}
+
+		key, saveKey, err := newContentKey(cctx.String("key-file"))
+		if err != nil {
+			return err
+		}
+
+		er, err := newEncryptReader(fi, key)
+		if err != nil {
+			fi.Close()
+			return err
+		}
+
+		resp, err := c.addData(struct {
+			io.Reader
+			io.Closer
+		}{er, fi}, fname)
+		if err != nil {
+			return err
+		}
+
+		if err := saveKey(resp.Cid); err != nil {
+			return err
+		}
+
+		fmt.Println(resp.Cid)
+		return nil
+	},
+}
+
+var plumbPutURLCmd = &cli.Command{
+	Name:      "put-url",
+	Usage:     "stream the contents of an http(s) url to estuary",
+	ArgsUsage: "<url>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "specify alternate name for file to be added with",
+		},
+		&cli.BoolFlag{
+			Name:  "progress",
+			Usage: "show download progress",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if !cctx.Args().Present() {
+			return fmt.Errorf("must specify url to upload")
+		}
+
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+		c.DoProgress = cctx.Bool("progress")
+
+		u, err := url.Parse(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("unsupported url scheme %q, must be http or https", u.Scheme)
+		}
+
+		fname := path.Base(u.Path)
+		if oname := cctx.String("name"); oname != "" {
+			fname = oname
+		}
+
+		resp, err := c.AddFromURL(cctx.Context, u.String(), fname)
 		if err != nil {
 			return err
 		}
@@ -288,8 +413,20 @@ var plumbPutFileCmd = &cli.Command{
 
 var plumbPutDirCmd = &cli.Command{
 	Name: "put-dir",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "layout",
+			Usage: "dag layout to import files with: balanced or trickle, the layout changes the resulting CIDs",
+			Value: layoutBalanced,
+		},
+	},
 	Action: func(cctx *cli.Context) error {
 		ctx := cctx.Context
+		layout := cctx.String("layout")
+		if err := checkLayout(layout); err != nil {
+			return err
+		}
+
 		client, err := loadClient(cctx)
 		if err != nil {
 			return err
@@ -305,7 +442,7 @@ var plumbPutDirCmd = &cli.Command{
 
 		fname := cctx.Args().First()
 
-		dnd, err := addDirectory(ctx, fstore, fname)
+		dnd, err := addDirectory(ctx, fstore, fname, layout)
 		if err != nil {
 			return err
 		}
@@ -316,7 +453,7 @@ var plumbPutDirCmd = &cli.Command{
 	},
 }
 
-func addDirectory(ctx context.Context, fstore *filestore.Filestore, dir string) (*merkledag.ProtoNode, error) {
+func addDirectory(ctx context.Context, fstore *filestore.Filestore, dir, layout string) (*merkledag.ProtoNode, error) {
 	dirents, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
@@ -328,7 +465,7 @@ func addDirectory(ctx context.Context, fstore *filestore.Filestore, dir string)
 	for _, d := range dirents {
 		name := filepath.Join(dir, d.Name())
 		if d.IsDir() {
-			dirn, err := addDirectory(ctx, fstore, name)
+			dirn, err := addDirectory(ctx, fstore, name, layout)
 			if err != nil {
 				return nil, err
 			}
@@ -336,7 +473,7 @@ func addDirectory(ctx context.Context, fstore *filestore.Filestore, dir string)
 				return nil, err
 			}
 		} else {
-			fcid, size, err := filestoreAdd(fstore, name, progCb)
+			fcid, size, err := filestoreAdd(fstore, name, layout, progCb)
 			if err != nil {
 				return nil, err
 			}
@@ -424,12 +561,25 @@ var plumbPutCarCmd = &cli.Command{
 			Name:  "name",
 			Usage: "specify alternate name for file to be added with",
 		},
+		&cli.StringFlag{
+			Name:  "root",
+			Usage: "root cid to track the content by, required if the car file declares more than one",
+		},
+		&cli.StringFlag{
+			Name:  "priority",
+			Usage: "how soon deals are made for the content compared to others: low, normal, high or urgent (admins only)",
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		if !cctx.Args().Present() {
 			return fmt.Errorf("must specify car file to upload")
 		}
 
+		f := cctx.Args().First()
+		if err := checkCarRoot(f, cctx.String("root")); err != nil {
+			return err
+		}
+
 		c, err := loadClient(cctx)
 		if err != nil {
 			return err
@@ -437,13 +587,54 @@ var plumbPutCarCmd = &cli.Command{
 
 		c.DoProgress = true
 
-		f := cctx.Args().First()
 		fname := filepath.Base(f)
 		if oname := cctx.String("name"); oname != "" {
 			fname = oname
 		}
 
-		resp, err := c.AddCar(f, fname)
+		resp, err := c.AddCar(f, fname, cctx.String("root"), cctx.String("priority"))
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(resp.Cid)
+		return nil
+	},
+}
+
+var plumbPutTarCmd = &cli.Command{
+	Name:      "put-tar",
+	Usage:     "upload a tar archive (.tar or .tar.gz) to be stored as a directory",
+	ArgsUsage: "<archive>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "specify alternate name for the directory to be added with",
+		},
+		&cli.StringFlag{
+			Name:  "priority",
+			Usage: "how soon deals are made for the content compared to others: low, normal, high or urgent (admins only)",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if !cctx.Args().Present() {
+			return fmt.Errorf("must specify tar archive to upload")
+		}
+
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		c.DoProgress = true
+
+		f := cctx.Args().First()
+		fname := tarBaseName(f)
+		if oname := cctx.String("name"); oname != "" {
+			fname = oname
+		}
+
+		resp, err := c.AddTar(f, fname, cctx.String("priority"))
 		if err != nil {
 			return err
 		}
@@ -453,6 +644,35 @@ var plumbPutCarCmd = &cli.Command{
 	},
 }
 
+// tarBaseName is the archive's file name without its tar extensions
+func tarBaseName(fpath string) string {
+	name := filepath.Base(fpath)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// checkCarRoot reads the header of a car file so that a missing or wrong root
+// is caught before uploading it
+func checkCarRoot(fpath, root string) error {
+	fi, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	header, err := car.ReadHeader(bufio.NewReader(fi))
+	if err != nil {
+		return fmt.Errorf("failed to read car header: %w", err)
+	}
+
+	_, err = util.CarRoot(header, root)
+	return err
+}
+
 func listCollections(cctx *cli.Context) error {
 	c, err := loadClient(cctx)
 	if err != nil {
@@ -475,11 +695,71 @@ var collectionsCmd = &cli.Command{
 	Name: "collections",
 	Subcommands: []*cli.Command{
 		collectionsCreateCmd,
+		collectionsListCmd,
+		collectionsAddCmd,
 		collectionsLsDirCmd,
 	},
 	Action: listCollections,
 }
 
+var collectionsListCmd = &cli.Command{
+	Name:   "list",
+	Usage:  "list your collections",
+	Action: listCollections,
+}
+
+// cleanCollectionPath normalizes a collection path the same way estuary does
+// so that bad paths are rejected before making a request
+func cleanCollectionPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("paths must start with /")
+	}
+
+	cp := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cp != "/" {
+		cp += "/"
+	}
+	return cp, nil
+}
+
+var collectionsAddCmd = &cli.Command{
+	Name:      "add",
+	Usage:     "add existing content to a collection",
+	ArgsUsage: "<collection> <contentid>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "path to place the content at within the collection",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 2 {
+			return fmt.Errorf("must specify collection ID and content ID")
+		}
+
+		col := cctx.Args().Get(0)
+		contid, err := strconv.ParseUint(cctx.Args().Get(1), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid content ID: %w", err)
+		}
+
+		var cpath string
+		if p := cctx.String("path"); p != "" {
+			cpath, err = cleanCollectionPath(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		return c.CollectionsAddContent(cctx.Context, col, uint(contid), cpath)
+	},
+}
+
 var collectionsCreateCmd = &cli.Command{
 	Name: "create",
 	Flags: []cli.Flag{
@@ -524,9 +804,12 @@ var collectionsLsDirCmd = &cli.Command{
 		}
 
 		col := cctx.Args().Get(0)
-		path := cctx.Args().Get(1)
+		dir, err := cleanCollectionPath(cctx.Args().Get(1))
+		if err != nil {
+			return err
+		}
 
-		ents, err := c.CollectionsListDir(cctx.Context, col, path)
+		ents, err := c.CollectionsListDir(cctx.Context, col, dir)
 		if err != nil {
 			return err
 		}
@@ -543,25 +826,87 @@ var collectionsLsDirCmd = &cli.Command{
 	},
 }
 
-func importFile(dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
-	prefix, err := merkledag.PrefixForCidVersion(1)
+// importParams control how a file is chunked and laid out into a DAG, which
+// decides its root CID
+type importParams struct {
+	// a go-ipfs-chunker spec, e.g. "size-1048576", "rabin" or "buzhash"
+	Chunker    string
+	CidVersion uint64
+	RawLeaves  bool
+	MaxLinks   int
+	// inline blocks up to this many bytes into their CID, zero disables
+	InlineLimit int
+	// balanced or trickle, empty is balanced
+	Layout string
+}
+
+// DAG layouts a file can be imported with. The same file gets a different
+// root CID under each.
+const (
+	// every leaf at the same depth, the ipfs default
+	layoutBalanced = "balanced"
+	// leaves spread over the depths so that data can be appended cheaply,
+	// suits streamed and append-heavy files
+	layoutTrickle = "trickle"
+)
+
+func checkLayout(layout string) error {
+	switch layout {
+	case "", layoutBalanced, layoutTrickle:
+		return nil
+	default:
+		return fmt.Errorf("unknown dag layout %q, must be %s or %s", layout, layoutBalanced, layoutTrickle)
+	}
+}
+
+// the settings barge uploads with
+var defaultImportParams = importParams{
+	Chunker:     "size-1048576",
+	CidVersion:  1,
+	RawLeaves:   true,
+	MaxLinks:    1024,
+	InlineLimit: 32,
+	Layout:      layoutBalanced,
+}
+
+func importFile(dserv ipld.DAGService, fi io.Reader, layout string) (ipld.Node, error) {
+	params := defaultImportParams
+	params.Layout = layout
+	return importFileWithParams(dserv, fi, params, true)
+}
+
+func importFileWithParams(dserv ipld.DAGService, fi io.Reader, params importParams, nocopy bool) (ipld.Node, error) {
+	if err := checkLayout(params.Layout); err != nil {
+		return nil, err
+	}
+
+	prefix, err := merkledag.PrefixForCidVersion(int(params.CidVersion))
 	if err != nil {
 		return nil, err
 	}
 	prefix.MhType = mh.SHA2_256
 
-	spl := chunker.NewSizeSplitter(fi, 1024*1024)
+	var cidBuilder cid.Builder = prefix
+	if params.InlineLimit > 0 {
+		cidBuilder = cidutil.InlineBuilder{
+			Builder: prefix,
+			Limit:   params.InlineLimit,
+		}
+	}
+
+	spl, err := chunker.FromString(fi, params.Chunker)
+	if err != nil {
+		return nil, err
+	}
+
 	dbp := ihelper.DagBuilderParams{
-		Maxlinks:  1024,
-		RawLeaves: true,
+		Maxlinks:  params.MaxLinks,
+		RawLeaves: params.RawLeaves,
 
-		CidBuilder: cidutil.InlineBuilder{
-			Builder: prefix,
-			Limit:   32,
-		},
+		CidBuilder: cidBuilder,
 
 		Dagserv: dserv,
-		NoCopy:  true,
+		NoCopy:  nocopy,
 	}
 
 	db, err := dbp.New(spl)
@@ -569,6 +914,9 @@ func importFile(dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
 		return nil, err
 	}
 
+	if params.Layout == layoutTrickle {
+		return trickle.Layout(db)
+	}
 	return balanced.Layout(db)
 }
 
@@ -636,9 +984,19 @@ var plumbSplitAddFileCmd = &cli.Command{
 		&cli.BoolFlag{
 			Name: "no-pin-only-split",
 		},
+		&cli.StringFlag{
+			Name:  "layout",
+			Usage: "dag layout to import the file with: balanced or trickle, the layout changes the resulting CID",
+			Value: layoutBalanced,
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		ctx := cctx.Context
+		layout := cctx.String("layout")
+		if err := checkLayout(layout); err != nil {
+			return err
+		}
+
 		client, err := loadClient(cctx)
 		if err != nil {
 			return err
@@ -656,7 +1014,7 @@ var plumbSplitAddFileCmd = &cli.Command{
 		fname := cctx.Args().First()
 
 		progcb := func(int64) {}
-		fcid, _, err := filestoreAdd(fstore, fname, progcb)
+		fcid, _, err := filestoreAdd(fstore, fname, layout, progcb)
 		if err != nil {
 			return err
 		}
@@ -790,7 +1148,7 @@ var plumbSplitAddFileCmd = &cli.Command{
 	},
 }
 
-func filestoreAdd(fstore *filestore.Filestore, fpath string, progcb func(int64)) (cid.Cid, uint64, error) {
+func filestoreAdd(fstore *filestore.Filestore, fpath, layout string, progcb func(int64)) (cid.Cid, uint64, error) {
 	ff, err := newFF(fpath, progcb)
 	if err != nil {
 		return cid.Undef, 0, err
@@ -798,7 +1156,7 @@ func filestoreAdd(fstore *filestore.Filestore, fpath string, progcb func(int64))
 	defer ff.Close()
 
 	dserv := merkledag.NewDAGService(blockservice.New(fstore, nil))
-	nd, err := importFile(dserv, ff)
+	nd, err := importFile(dserv, ff, layout)
 	if err != nil {
 		return cid.Undef, 0, err
 	}
@@ -886,6 +1244,10 @@ var bargeAddCmd = &cli.Command{
 		&cli.BoolFlag{
 			Name: "progress",
 		},
+		&cli.StringFlag{
+			Name:  "layout",
+			Usage: "dag layout to import files with: balanced or trickle, the layout changes the resulting CIDs. Defaults to the layout a file was added with before, balanced for new files",
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		r, err := openRepo(cctx)
@@ -893,6 +1255,11 @@ var bargeAddCmd = &cli.Command{
 			return err
 		}
 
+		layout := cctx.String("layout")
+		if err := checkLayout(layout); err != nil {
+			return err
+		}
+
 		progress := cctx.Bool("progress")
 
 		var paths []string
@@ -961,10 +1328,11 @@ var bargeAddCmd = &cli.Command{
 		}
 
 		type updateJob struct {
-			Path  string
-			Found []File
-			Stat  os.FileInfo
-			Cid   cid.Cid
+			Path   string
+			Found  []File
+			Stat   os.FileInfo
+			Cid    cid.Cid
+			Layout string
 		}
 
 		tocheck := make(chan string, 1)
@@ -1000,7 +1368,7 @@ var bargeAddCmd = &cli.Command{
 					existing := found[0]
 
 					// have it already... check if its changed
-					if st.ModTime().Equal(existing.Mtime) {
+					if st.ModTime().Equal(existing.Mtime) && (layout == "" || layout == existing.importLayout()) {
 						// mtime the same, assume its the same file...
 						continue
 					}
@@ -1059,17 +1427,28 @@ var bargeAddCmd = &cli.Command{
 			go func() {
 				defer wg.Done()
 				for aj := range toadd {
-					fcid, _, err := filestoreAdd(r.Filestore, aj.Path, progcb)
+					// stick to the layout the file was added with, so
+					// that it keeps its CID unless asked otherwise
+					l := layout
+					if l == "" {
+						l = layoutBalanced
+						if len(aj.Found) > 0 {
+							l = aj.Found[0].importLayout()
+						}
+					}
+
+					fcid, _, err := filestoreAdd(r.Filestore, aj.Path, l, progcb)
 					if err != nil {
 						fmt.Println(err)
 						return
 					}
 
 					toupdate <- updateJob{
-						Path:  aj.Path,
-						Found: aj.Found,
-						Cid:   fcid,
-						Stat:  aj.Stat,
+						Path:   aj.Path,
+						Found:  aj.Found,
+						Cid:    fcid,
+						Stat:   aj.Stat,
+						Layout: l,
 					}
 				}
 			}()
@@ -1084,10 +1463,11 @@ var bargeAddCmd = &cli.Command{
 		for uj := range toupdate {
 			if len(uj.Found) > 0 {
 				existing := uj.Found[0]
-				if existing.Cid != uj.Cid.String() {
+				if existing.Cid != uj.Cid.String() || existing.Layout != uj.Layout {
 					if err := r.DB.Model(File{}).Where("id = ?", existing.ID).UpdateColumns(map[string]interface{}{
-						"cid":   uj.Cid.String(),
-						"mtime": uj.Stat.ModTime(),
+						"cid":    uj.Cid.String(),
+						"mtime":  uj.Stat.ModTime(),
+						"layout": uj.Layout,
 					}).Error; err != nil {
 						return err
 					}
@@ -1107,9 +1487,10 @@ var bargeAddCmd = &cli.Command{
 			}
 
 			batchCreates = append(batchCreates, &File{
-				Path:  rel,
-				Cid:   uj.Cid.String(),
-				Mtime: uj.Stat.ModTime(),
+				Path:   rel,
+				Cid:    uj.Cid.String(),
+				Mtime:  uj.Stat.ModTime(),
+				Layout: uj.Layout,
 			})
 
 			if len(batchCreates) > 200 {
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/lotus/chain/types"
+	cli "github.com/urfave/cli/v2"
+)
+
+// one day in filecoin epochs
+const epochsPerDay = 2880
+
+var minersCmd = &cli.Command{
+	Name:  "miners",
+	Usage: "inspect the miners estuary makes deals with",
+	Subcommands: []*cli.Command{
+		minersCompareCmd,
+		minersGetAskCmd,
+		minersEstimateSealCmd,
+		minersPipelineCmd,
+		minersReportCmd,
+		minersRecomputeCmd,
+		minersCacheCmd,
+		minersExportReputationCmd,
+		minersImportReputationCmd,
+	},
+}
+
+var minersCompareCmd = &cli.Command{
+	Name:      "compare",
+	Usage:     "compare miners side by side on price, ask limits, success ratio and reachability",
+	ArgsUsage: "<miner>...",
+	Flags: []cli.Flag{
+		&cli.Uint64Flag{
+			Name:  "size",
+			Usage: "deal size in GiB to estimate the cost of",
+			Value: 32,
+		},
+		&cli.Int64Flag{
+			Name:  "days",
+			Usage: "deal duration in days to estimate the cost of",
+			Value: 540,
+		},
+		&cli.BoolFlag{
+			Name:  "verified",
+			Usage: "compare verified deal prices",
+			Value: true,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if !cctx.Args().Present() {
+			return fmt.Errorf("must specify at least one miner")
+		}
+
+		size := cctx.Uint64("size")
+		days := cctx.Int64("days")
+		verified := cctx.Bool("verified")
+
+		cmp, err := c.CompareMiners(cctx.Context, cctx.Args().Slice(), size<<30, days*epochsPerDay, verified)
+		if err != nil {
+			return err
+		}
+
+		best := bestMinerValues(cmp, verified)
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "MINER\tREACHABLE\tPRICE/GiB/EPOCH\tMIN SIZE\tMAX SIZE\tSUCCESS\tRESPONSE\tCOST FOR %d GiB / %d DAYS\n", size, days)
+		for _, mc := range cmp {
+			if !mc.Reachable {
+				fmt.Fprintf(w, "%s\tno\t-\t-\t-\t%s\t-\terror: %s\n", mc.Miner, successColumn(mc, best), mc.Error)
+				continue
+			}
+
+			price := mc.Price
+			if verified {
+				price = mc.VerifiedPrice
+			}
+
+			fmt.Fprintf(w, "%s\tyes\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				mc.Miner,
+				highlight(filColumn(price), price == best.price),
+				humanize.IBytes(mc.MinPieceSize),
+				humanize.IBytes(mc.MaxPieceSize),
+				successColumn(mc, best),
+				highlight(fmt.Sprintf("%dms", mc.AvgResponseMs), mc.AvgResponseMs > 0 && mc.AvgResponseMs == best.responseMs),
+				highlight(mc.CostFil, mc.Cost != "" && mc.Cost == best.cost),
+			)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		fmt.Println("* best value in column")
+		return nil
+	},
+}
+
+var minersGetAskCmd = &cli.Command{
+	Name:      "get-ask",
+	Usage:     "query a miner for its storage ask, and check it is signed by the miner",
+	ArgsUsage: "<miner>",
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a miner")
+		}
+
+		ask, err := c.GetAsk(cctx.Context, cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		price, err := types.BigFromString(ask.Price)
+		if err != nil {
+			return fmt.Errorf("miner returned a bad price: %w", err)
+		}
+
+		vprice, err := types.BigFromString(ask.VerifiedPrice)
+		if err != nil {
+			return fmt.Errorf("miner returned a bad verified price: %w", err)
+		}
+
+		fmt.Printf("Miner:\t\t\t%s\n", ask.Miner)
+		fmt.Printf("Price:\t\t\t%s per GiB per epoch\n", types.FIL(price))
+		fmt.Printf("Verified price:\t\t%s per GiB per epoch\n", types.FIL(vprice))
+		fmt.Printf("Piece size:\t\t%s - %s\n", humanize.IBytes(ask.MinPieceSize), humanize.IBytes(ask.MaxPieceSize))
+		if ask.SignatureValid {
+			fmt.Printf("Signature:\t\tvalid\n")
+		} else {
+			fmt.Printf("Signature:\t\tINVALID (%s)\n", ask.SignatureError)
+		}
+		return nil
+	},
+}
+
+var minersEstimateSealCmd = &cli.Command{
+	Name:      "estimate-seal",
+	Usage:     "estimate how long the miner takes to seal a deal once its data is transferred",
+	ArgsUsage: "<miner>",
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a miner")
+		}
+
+		est, err := c.SealEstimate(cctx.Context, cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Miner:\t\t%s\n", est.Miner)
+		fmt.Printf("Typical:\t%s\n", roundSealTime(est.Median))
+		fmt.Printf("Range:\t\t%s - %s (80%% of deals)\n", roundSealTime(est.Low), roundSealTime(est.High))
+		if est.Basis == "miner" {
+			fmt.Printf("Based on:\t%d sealed deals with this miner\n", est.Samples)
+		} else {
+			fmt.Printf("Based on:\t%d sealed deals with all miners, this miner has too few\n", est.Samples)
+		}
+		return nil
+	},
+}
+
+var minersPipelineCmd = &cli.Command{
+	Name:      "pipeline",
+	Aliases:   []string{"miner-pipeline"},
+	Usage:     "show how backed up the miner's sealing pipeline looks and how long a new deal would take to seal",
+	ArgsUsage: "<miner>",
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a miner")
+		}
+
+		mp, err := c.MinerPipeline(cctx.Context, cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Miner:\t\t%s\n", mp.Miner)
+		fmt.Printf("Status:\t\t%s\n", mp.Status)
+		if mp.Waiting > 0 {
+			fmt.Printf("Waiting:\t%d deals, oldest transferred %s ago\n", mp.Waiting, roundSealTime(mp.OldestWaiting))
+		} else {
+			fmt.Printf("Waiting:\tnone\n")
+		}
+		if mp.Stuck > 0 {
+			fmt.Printf("Stuck:\t\t%d deals never sealed\n", mp.Stuck)
+		}
+		if mp.RecentSamples > 0 {
+			fmt.Printf("Last week:\t%s typical (%d sealed deals)\n", roundSealTime(mp.RecentMedian), mp.RecentSamples)
+		}
+		if mp.Estimate != nil {
+			fmt.Printf("History:\t%s typical, %s - %s", roundSealTime(mp.Estimate.Median), roundSealTime(mp.Estimate.Low), roundSealTime(mp.Estimate.High))
+			if mp.Estimate.Basis == "miner" {
+				fmt.Printf(" (%d sealed deals)\n", mp.Estimate.Samples)
+			} else {
+				fmt.Printf(" (all miners, this miner has too few sealed deals)\n")
+			}
+		}
+		if mp.ExpectedSeal > 0 {
+			fmt.Printf("New deal:\texpected to seal %s after transfer\n", roundSealTime(mp.ExpectedSeal))
+		} else {
+			fmt.Printf("New deal:\tno sealing history to estimate from\n")
+		}
+		return nil
+	},
+}
+
+var minersReportCmd = &cli.Command{
+	Name:  "report",
+	Usage: "write every miner's deal stats to a csv file",
+	Description: `Every row is stamped with the time the report was made, so that reports
+taken over time can be diffed, or collected in one file with --append, to
+spot miners getting worse.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "file to write the report to, stdout if not set",
+		},
+		&cli.BoolFlag{
+			Name:  "append",
+			Usage: "add the rows to the end of the file instead of replacing it, the header is only written to a new file",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		stats, err := c.MinerStats(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		out := os.Stdout
+		header := true
+		if fname := cctx.String("out"); fname != "" {
+			flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+			if cctx.Bool("append") {
+				flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+				if fi, err := os.Stat(fname); err == nil && fi.Size() > 0 {
+					header = false
+				}
+			}
+
+			fi, err := os.OpenFile(fname, flags, 0644)
+			if err != nil {
+				return err
+			}
+			defer fi.Close()
+			out = fi
+		}
+
+		if err := writeMinerReport(out, stats, time.Now(), header); err != nil {
+			return err
+		}
+
+		if out != os.Stdout {
+			fmt.Fprintf(os.Stderr, "wrote stats for %d miners to %s\n", len(stats), cctx.String("out"))
+		}
+		return nil
+	},
+}
+
+func writeMinerReport(w io.Writer, stats []*MinerStats, at time.Time, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		if err := cw.Write([]string{
+			"timestamp", "miner", "total_deals", "confirmed_deals", "failed_deals", "faults",
+			"success_ratio", "total_bytes", "avg_latency_ms", "region",
+		}); err != nil {
+			return err
+		}
+	}
+
+	ts := at.UTC().Format(time.RFC3339)
+	for _, st := range stats {
+		if err := cw.Write([]string{
+			ts,
+			st.Miner,
+			strconv.Itoa(st.TotalDeals),
+			strconv.Itoa(st.ConfirmedDeals),
+			strconv.Itoa(st.FailedDeals),
+			strconv.Itoa(st.DealFaults),
+			strconv.FormatFloat(st.SuccessRatio, 'f', 4, 64),
+			strconv.FormatUint(st.TotalBytesStored, 10),
+			strconv.FormatInt(st.AvgResponseMs, 10),
+			st.Location,
+		}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+var minersRecomputeCmd = &cli.Command{
+	Name:  "recompute",
+	Usage: "rank the miners used for new deals again without waiting for the cached ranking to expire (needs an admin token)",
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		ranking, err := c.RecomputeMinerRanking(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "RANK\tMINER\tDEALS\tCONFIRMED\tFAILED\tRESPONSE\n")
+		for i, m := range ranking {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%dms\n", i+1, m.Miner, m.TotalDeals, m.ConfirmedDeals, m.FailedDeals, m.AvgResponseMs)
+		}
+		return w.Flush()
+	},
+}
+
+var minersCacheCmd = &cli.Command{
+	Name:  "cache",
+	Usage: "show the cached miner ranking new deals are picked from, and the stats it was ranked on (needs an admin token)",
+	Description: `Shows the ranking as it is, without recomputing it. Miners without a rank
+were ranked but are left out of deal making, e.g. because they are suspended.`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the raw cache as json",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		mc, err := c.MinerCache(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(mc)
+		}
+
+		fmt.Printf("strategy: %s\n", mc.Strategy)
+		if mc.LastComputed.IsZero() {
+			fmt.Println("the ranking has not been computed yet, it will be on the next deal")
+			return nil
+		}
+
+		fmt.Printf("computed: %s (%s ago)\n", mc.LastComputed.Local().Format(time.RFC3339), time.Since(mc.LastComputed).Round(time.Second))
+		if mc.RecomputeInMs > 0 {
+			fmt.Printf("next recompute: in %s\n", (time.Duration(mc.RecomputeInMs) * time.Millisecond).Round(time.Second))
+		} else {
+			fmt.Println("next recompute: expired, on the next deal")
+		}
+		fmt.Println()
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "RANK\tMINER\tSUCCESS\tDEALS\tCONFIRMED\tFAILED\tFAULTS\tSTORED\tRESPONSE\tPRICE\tLOCATION\tBREAKER\n")
+		for _, m := range mc.Miners {
+			rank := "-"
+			if m.Rank > 0 {
+				rank = strconv.Itoa(m.Rank)
+			}
+
+			price := "-"
+			if m.Price != "" {
+				price = formatPaid(m.Price)
+			}
+
+			breaker := "-"
+			if m.Breaker != nil {
+				breaker = m.Breaker.State
+			}
+			if m.NotAccepting != nil {
+				breaker += " (not accepting)"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%.2f\t%d\t%d\t%d\t%d\t%s\t%dms\t%s\t%s\t%s\n", rank, m.Miner, m.SuccessRatio,
+				m.TotalDeals, m.ConfirmedDeals, m.FailedDeals, m.DealFaults, humanize.IBytes(m.TotalBytesStored),
+				m.AvgResponseMs, price, m.Location, breaker)
+		}
+		return w.Flush()
+	},
+}
+
+var minersExportReputationCmd = &cli.Command{
+	Name:      "export-reputation",
+	Usage:     "export the deal history of the node's miners for importing into another node (needs an admin token)",
+	ArgsUsage: "[file]",
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		exp, err := c.ExportMinerReputation(cctx.Context)
+		if err != nil {
+			return err
+		}
+
+		out := os.Stdout
+		if cctx.Args().Present() {
+			fi, err := os.Create(cctx.Args().First())
+			if err != nil {
+				return err
+			}
+			defer fi.Close()
+			out = fi
+		}
+
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(exp)
+	},
+}
+
+var minersImportReputationCmd = &cli.Command{
+	Name:      "import-reputation",
+	Usage:     "merge miner deal history exported by another node into this node's ranking (needs an admin token)",
+	ArgsUsage: "<file>",
+	Action: func(cctx *cli.Context) error {
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify the exported file to import")
+		}
+
+		data, err := os.ReadFile(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		var exp MinerReputationExport
+		if err := json.Unmarshal(data, &exp); err != nil {
+			return fmt.Errorf("invalid miner reputation export: %w", err)
+		}
+
+		n, err := c.ImportMinerReputation(cctx.Context, &exp)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("imported stats for %d miners from %s\n", n, exp.Source)
+		return nil
+	},
+}
+
+// roundSealTime drops precision that is meaningless for sealing estimates
+func roundSealTime(d time.Duration) time.Duration {
+	return d.Round(time.Minute)
+}
+
+type bestValues struct {
+	price        string
+	cost         string
+	successRatio float64
+	responseMs   int64
+}
+
+// bestMinerValues finds the best value of each compared column across the
+// reachable miners
+func bestMinerValues(cmp []*MinerComparison, verified bool) bestValues {
+	var best bestValues
+	var bestPrice, bestCost types.BigInt
+	for _, mc := range cmp {
+		if mc.TotalDeals > 0 && mc.SuccessRatio > best.successRatio {
+			best.successRatio = mc.SuccessRatio
+		}
+
+		if !mc.Reachable {
+			continue
+		}
+
+		if mc.AvgResponseMs > 0 && (best.responseMs == 0 || mc.AvgResponseMs < best.responseMs) {
+			best.responseMs = mc.AvgResponseMs
+		}
+
+		price := mc.Price
+		if verified {
+			price = mc.VerifiedPrice
+		}
+		if p, err := types.BigFromString(price); err == nil {
+			if best.price == "" || p.LessThan(bestPrice) {
+				best.price = price
+				bestPrice = p
+			}
+		}
+
+		if cost, err := types.BigFromString(mc.Cost); err == nil {
+			if best.cost == "" || cost.LessThan(bestCost) {
+				best.cost = mc.Cost
+				bestCost = cost
+			}
+		}
+	}
+
+	return best
+}
+
+func successColumn(mc *MinerComparison, best bestValues) string {
+	if mc.TotalDeals == 0 {
+		return "-"
+	}
+
+	col := fmt.Sprintf("%.1f%% (%d/%d)", mc.SuccessRatio*100, mc.ConfirmedDeals, mc.TotalDeals)
+	return highlight(col, mc.SuccessRatio == best.successRatio)
+}
+
+func filColumn(atto string) string {
+	v, err := types.BigFromString(atto)
+	if err != nil {
+		return atto
+	}
+
+	return types.FIL(v).Short()
+}
+
+func highlight(s string, isBest bool) string {
+	if isBest {
+		return s + " *"
+	}
+	return s
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/application-research/estuary/util"
+	"github.com/dustin/go-humanize"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	cli "github.com/urfave/cli/v2"
+)
+
+var dealsShowProposalCmd = &cli.Command{
+	Name:      "show-proposal",
+	Usage:     "show the deal proposal that was sent to the miner",
+	ArgsUsage: "<proposal cid>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the decoded proposal as json",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single proposal cid")
+		}
+
+		pc, err := cid.Decode(cctx.Args().First())
+		if err != nil {
+			return fmt.Errorf("invalid proposal cid: %w", err)
+		}
+
+		prop, err := c.DealProposal(ctx, pc)
+		if err != nil {
+			return err
+		}
+
+		// re-encoding the proposal must give back the cid we asked for,
+		// otherwise something was lost between the saved cbor and json
+		recid, err := util.ProposalCid(prop)
+		if err != nil {
+			return fmt.Errorf("re-encoding proposal: %w", err)
+		}
+		if !recid.Equals(pc) {
+			fmt.Fprintf(os.Stderr, "warning: proposal re-encodes to %s, not %s\n", recid, pc)
+		}
+
+		if cctx.Bool("json") {
+			out, err := json.MarshalIndent(prop, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+
+		p := prop.Proposal
+		duration := p.EndEpoch - p.StartEpoch
+		days := float64(duration) * float64(build.BlockDelaySecs) / (60 * 60 * 24)
+		total := big.Mul(p.StoragePricePerEpoch, big.NewInt(int64(duration)))
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Proposal:\t%s\n", pc)
+		fmt.Fprintf(w, "Piece CID:\t%s\n", p.PieceCID)
+		fmt.Fprintf(w, "Piece Size:\t%d (%s)\n", p.PieceSize, humanize.IBytes(uint64(p.PieceSize)))
+		fmt.Fprintf(w, "Client:\t%s\n", p.Client)
+		fmt.Fprintf(w, "Provider:\t%s\n", p.Provider)
+		fmt.Fprintf(w, "Start Epoch:\t%d\n", p.StartEpoch)
+		fmt.Fprintf(w, "End Epoch:\t%d\n", p.EndEpoch)
+		fmt.Fprintf(w, "Duration:\t%d epochs (%.1f days)\n", duration, days)
+		fmt.Fprintf(w, "Price:\t%s per epoch (%s total)\n", types.FIL(p.StoragePricePerEpoch), types.FIL(total))
+		fmt.Fprintf(w, "Provider Collateral:\t%s\n", types.FIL(p.ProviderCollateral))
+		fmt.Fprintf(w, "Client Collateral:\t%s\n", types.FIL(p.ClientCollateral))
+		fmt.Fprintf(w, "Verified:\t%t\n", p.VerifiedDeal)
+		fmt.Fprintf(w, "Label:\t%q\n", p.Label)
+		fmt.Fprintf(w, "Signature Type:\t%d\n", prop.ClientSignature.Type)
+		return w.Flush()
+	},
+}
+
+var dealsExportPieceCmd = &cli.Command{
+	Name:      "export-piece",
+	Usage:     "download the CAR a deal's piece CID was computed over, and check it reproduces that piece CID",
+	ArgsUsage: "<proposal cid>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "file to write the CAR to, defaults to <proposal cid>.car",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single proposal cid")
+		}
+
+		pc, err := cid.Decode(cctx.Args().First())
+		if err != nil {
+			return fmt.Errorf("invalid proposal cid: %w", err)
+		}
+
+		prop, err := c.DealProposal(ctx, pc)
+		if err != nil {
+			return err
+		}
+
+		out := cctx.String("output")
+		if out == "" {
+			out = pc.String() + ".car"
+		}
+
+		fi, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+
+		cp := new(commp.Calc)
+		if err := c.ExportPiece(ctx, pc, io.MultiWriter(fi, cp)); err != nil {
+			fi.Close()
+			os.Remove(out)
+			return fmt.Errorf("exporting piece: %w", err)
+		}
+
+		st, err := fi.Stat()
+		if err != nil {
+			fi.Close()
+			return err
+		}
+
+		if err := fi.Close(); err != nil {
+			return err
+		}
+
+		fmt.Printf("wrote %s (%s)\n", out, humanize.IBytes(uint64(st.Size())))
+
+		piece, err := dealPieceCid(cp, prop.Proposal.PieceSize)
+		if err != nil {
+			return fmt.Errorf("computing piece cid: %w", err)
+		}
+
+		fmt.Printf("Piece CID:\t%s\n", piece)
+		fmt.Printf("Proposal:\t%s\n", prop.Proposal.PieceCID)
+		if !piece.Equals(prop.Proposal.PieceCID) {
+			fmt.Fprintf(os.Stderr, "warning: the exported CAR does not reproduce the piece CID of the deal proposal\n")
+		}
+		return nil
+	},
+}
+
+// dealPieceCid finishes the piece commitment of the data written to cp, zero
+// padded up to the deal's piece size the way the miner pads it
+func dealPieceCid(cp *commp.Calc, pieceSize abi.PaddedPieceSize) (cid.Cid, error) {
+	raw, size, err := cp.Digest()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if size > uint64(pieceSize) {
+		return cid.Undef, fmt.Errorf("data makes a %d byte piece, larger than the deal's %d", size, pieceSize)
+	}
+
+	if size < uint64(pieceSize) {
+		raw, err = commp.PadCommP(raw, size, uint64(pieceSize))
+		if err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	return commcid.DataCommitmentV1ToCID(raw)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ipfs/go-cid"
+	cli "github.com/urfave/cli/v2"
+)
+
+var findProvidersCmd = &cli.Command{
+	Name:      "find-providers",
+	Usage:     "find providers advertising a cid through the network indexer",
+	ArgsUsage: "<cid>",
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single cid")
+		}
+
+		cc, err := cid.Decode(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		provs, err := c.FindProviders(ctx, cc)
+		if err != nil {
+			return err
+		}
+
+		if len(provs) == 0 {
+			fmt.Println("no providers found")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "PEER\tMINER\tPROTOCOLS\n")
+		for _, p := range provs {
+			miner := p.Miner
+			if miner == "" {
+				miner = "-"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\n", p.PeerID, miner, strings.Join(p.Protocols, ","))
+		}
+		return w.Flush()
+	},
+}
+
+func hasProtocol(p Provider, proto string) bool {
+	for _, pp := range p.Protocols {
+		if pp == proto {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+var rebalanceCmd = &cli.Command{
+	Name:  "rebalance",
+	Usage: "move every replica off a miner to other miners",
+	Description: `Each content with a deal on the miner gets a replacement deal with another
+miner, chosen the same way as for new deals. Once the replacement seals, the
+deal with the old miner no longer counts toward the content's replication.
+
+Rebalancing doesn't stop new deals from going to the miner, suspend it for
+that. Running the command again for a miner being rebalanced shows its
+progress.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "off",
+			Usage:    "miner to move replicas off",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "status",
+			Usage: "only show the progress of the latest rebalance off the miner",
+		},
+		&cli.BoolFlag{
+			Name:  "watch",
+			Usage: "keep showing progress until the rebalance finishes",
+		},
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "how often to check progress when watching",
+			Value: time.Minute,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		miner := cctx.String("off")
+
+		var st *RebalanceStatus
+		if cctx.Bool("status") {
+			st, err = c.RebalanceStatus(ctx, miner)
+		} else {
+			st, err = c.RebalanceMiner(ctx, miner)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !cctx.Bool("watch") {
+			return printRebalanceStatus(st)
+		}
+
+		for {
+			fmt.Printf("%s: %d pending, %d sealing, %d done, %d failed of %d\n", time.Now().Format(time.Kitchen),
+				st.Pending, st.Sealing, st.Done, st.Failed, st.Total)
+			if st.FinishedAt != nil {
+				return printRebalanceStatus(st)
+			}
+
+			select {
+			case <-time.After(cctx.Duration("interval")):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			st, err = c.RebalanceStatus(ctx, miner)
+			if err != nil {
+				return err
+			}
+		}
+	},
+}
+
+func printRebalanceStatus(st *RebalanceStatus) error {
+	state := "in progress"
+	if st.FinishedAt != nil {
+		state = "finished " + st.FinishedAt.Format(time.RFC3339)
+	}
+
+	fmt.Printf("rebalance off %s, started %s, %s\n", st.Miner, st.CreatedAt.Format(time.RFC3339), state)
+	fmt.Printf("contents:\t%d\n", st.Total)
+	fmt.Printf("pending:\t%d\n", st.Pending)
+	fmt.Printf("sealing:\t%d\n", st.Sealing)
+	fmt.Printf("done:\t\t%d\n", st.Done)
+	fmt.Printf("failed:\t\t%d\n", st.Failed)
+
+	if len(st.Problems) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "CONTENT\tDEAL\tSTATE\tATTEMPTS\tERROR\n")
+	for _, it := range st.Problems {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%s\n", it.Content, it.OldDeal, it.State, it.Attempts, it.Error)
+	}
+	return w.Flush()
+}
@@ -42,6 +42,17 @@ type File struct {
 	Path      string `gorm:"index"`
 	Cid       string
 	Mtime     time.Time
+
+	// dag layout the file was imported with, files added before layouts
+	// were recorded were all balanced
+	Layout string
+}
+
+func (f File) importLayout() string {
+	if f.Layout == "" {
+		return layoutBalanced
+	}
+	return f.Layout
 }
 
 type Pin struct {
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cli "github.com/urfave/cli/v2"
+)
+
+var resolveCmd = &cli.Command{
+	Name:      "resolve",
+	Usage:     "resolve an IPNS key or DNSLink domain to a cid through the estuary node",
+	ArgsUsage: "<name>",
+	Description: `The name can be an IPNS key, a DNSLink domain, or an /ipns/ path or ipns://
+url with a path after the name. The resolved cid and the rest of the path are
+printed, along with how long the answer can be relied on for.
+
+With --get the resolved content is retrieved like 'barge get' would, and with
+--pin it is pinned to estuary so deals get made for it.`,
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "get",
+			Usage: "retrieve the resolved content, the flags for 'barge get' apply",
+		},
+		&cli.BoolFlag{
+			Name:  "pin",
+			Usage: "pin the resolved cid to estuary, the whole of it if the name had a path",
+		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "name to pin the content under (defaults to the resolved name)",
+		},
+	}, getFlags...),
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single name to resolve")
+		}
+
+		res, err := c.ResolveName(ctx, cctx.Args().First())
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", cctx.Args().First(), err)
+		}
+
+		root, err := cid.Decode(res.Cid)
+		if err != nil {
+			return fmt.Errorf("estuary resolved %s to an invalid cid: %w", res.Name, err)
+		}
+
+		// content goes to stdout with --get -o -, so keep it clean
+		info := os.Stdout
+		if cctx.Bool("get") && cctx.String("output") == "-" {
+			info = os.Stderr
+		}
+
+		remainder := res.Remainder
+		if remainder == "" {
+			remainder = "-"
+		}
+
+		w := tabwriter.NewWriter(info, 4, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "cid:\t%s\n", root)
+		fmt.Fprintf(w, "remainder:\t%s\n", remainder)
+		if len(res.Chain) > 1 {
+			fmt.Fprintf(w, "via:\t%s\n", strings.Join(res.Chain, " -> "))
+		}
+		if res.TTL > 0 {
+			fmt.Fprintf(w, "ttl:\t%s (until %s)\n", time.Duration(res.TTL)*time.Second, res.Expires.Format(time.RFC3339))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if cctx.Bool("pin") {
+			name := cctx.String("name")
+			if name == "" {
+				name = res.Name
+			}
+
+			st, err := c.PinAdd(ctx, root, name, nil, nil)
+			if err != nil {
+				return fmt.Errorf("failed to pin %s to estuary: %w", root, err)
+			}
+			fmt.Fprintf(info, "pinning %s as %q, request %s is %s\n", root, name, st.Requestid, st.Status)
+		}
+
+		if cctx.Bool("get") {
+			return getContent(cctx, c, root, res.Remainder)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	cli "github.com/urfave/cli/v2"
+)
+
+var retrievalProgressCmd = &cli.Command{
+	Name:      "retrieval-progress",
+	Usage:     "follow a content's retrieval from a miner as it runs",
+	ArgsUsage: "<content id>",
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single content id")
+		}
+
+		contID, err := strconv.ParseUint(cctx.Args().First(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid content id: %w", err)
+		}
+
+		var last *RetrievalStatsSnapshot
+		for {
+			// the server answers as soon as there is a new snapshot
+			prog, err := c.RetrievalProgress(ctx, uint(contID), time.Second*30)
+			if err != nil {
+				return err
+			}
+
+			if prog == nil {
+				if last == nil {
+					fmt.Printf("content %d is not being retrieved\n", contID)
+				} else {
+					fmt.Println()
+					fmt.Println("retrieval finished")
+				}
+				return nil
+			}
+
+			// nothing new if the wait ran out
+			st := prog.Stats
+			if st == nil || (last != nil && *st == *last) {
+				continue
+			}
+			last = st
+
+			fmt.Printf("\r\033[K%s from %s: %s received, %s/s (avg %s/s), %d payments, %s paid", time.Since(st.Started).Round(time.Second),
+				st.Miner, humanize.IBytes(st.BytesReceived), humanize.IBytes(st.CurrentSpeed), humanize.IBytes(st.AverageSpeed), st.Payments, formatPaid(st.Paid))
+
+			if st.Done {
+				fmt.Println()
+				if st.Error != "" {
+					fmt.Printf("retrieval from %s failed: %s\n", st.Miner, st.Error)
+					// another miner may be tried next
+					continue
+				}
+				fmt.Println("retrieval finished")
+				return nil
+			}
+		}
+	},
+}
+
+var rehydrateCmd = &cli.Command{
+	Name:      "rehydrate",
+	Usage:     "retrieve an offloaded content back from its deals so it can be served locally again",
+	ArgsUsage: "<content id>",
+	Description: `The content is retrieved from one of the miners with a deal for it and
+checked against its root cid before it is marked as stored locally again.
+Follow the retrieval with retrieval-progress while this runs.`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "verify-checksum",
+			Usage: "also check the rehydrated file against the checksum taken when it was uploaded",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := cctx.Context
+		c, err := loadClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify a single content id")
+		}
+
+		contID, err := strconv.ParseUint(cctx.Args().First(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid content id: %w", err)
+		}
+
+		res, err := c.RehydrateContent(ctx, uint(contID), cctx.Bool("verify-checksum"))
+		if err != nil {
+			return err
+		}
+
+		servedBy := res.ServedBy
+		if servedBy == "" {
+			servedBy = "unknown miner"
+		}
+
+		fmt.Printf("rehydrated content %d (%s): %s from %s in %s\n", res.Content, res.Cid,
+			humanize.IBytes(res.Size), servedBy, (time.Duration(res.DurationMs) * time.Millisecond).Round(time.Second))
+		if res.ChecksumVerified {
+			fmt.Printf("checksum verified: %s\n", res.Checksum)
+		}
+		return nil
+	},
+}
+
+func formatPaid(s string) string {
+	amt, err := big.FromString(s)
+	if err != nil {
+		return s
+	}
+	return types.FIL(amt).Short()
+}
@@ -4,6 +4,8 @@ import (
 	"time"
 
 	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
@@ -61,3 +63,54 @@ func setupDatabase(dbval string) (*gorm.DB, error) {
 
 	return db, nil
 }
+
+// insertObjectsAndRefs records the objects of a pinned DAG and refs from them
+// to the pin, see util.InsertObjectsAndRefs
+func insertObjectsAndRefs(tx *gorm.DB, pin uint, objects []*Object, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = util.DefaultObjectBatchSize
+	}
+
+	cids := make([]cid.Cid, 0, len(objects))
+	for _, o := range objects {
+		cids = append(cids, o.Cid.CID)
+	}
+
+	ids, err := util.InsertObjectsAndRefs(tx, cids, batchSize, func(idx []int) ([]uint, error) {
+		rows := make([]*Object, 0, len(idx))
+		for _, i := range idx {
+			rows = append(rows, objects[i])
+		}
+
+		if err := tx.CreateInBatches(rows, batchSize).Error; err != nil {
+			return nil, errors.Wrap(err, "failed to create objects in db")
+		}
+
+		ids := make([]uint, 0, len(rows))
+		for _, o := range rows {
+			ids = append(ids, o.ID)
+		}
+		return ids, nil
+	}, func(objIDs []uint) error {
+		refs := make([]ObjRef, 0, len(objIDs))
+		for _, id := range objIDs {
+			refs = append(refs, ObjRef{
+				Pin:    pin,
+				Object: id,
+			})
+		}
+
+		if err := tx.CreateInBatches(refs, batchSize).Error; err != nil {
+			return errors.Wrap(err, "failed to create refs")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, o := range objects {
+		o.ID = ids[i]
+	}
+	return nil
+}
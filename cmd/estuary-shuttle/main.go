@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -90,6 +91,16 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.DataDir = cctx.String("datadir")
 		case "blockstore":
 			cfg.NodeConfig.Blockstore = cctx.String("blockstore")
+		case "s3-endpoint":
+			cfg.NodeConfig.S3Config.Endpoint = cctx.String("s3-endpoint")
+		case "s3-region":
+			cfg.NodeConfig.S3Config.Region = cctx.String("s3-region")
+		case "s3-access-key":
+			cfg.NodeConfig.S3Config.AccessKey = cctx.String("s3-access-key")
+		case "s3-secret-key":
+			cfg.NodeConfig.S3Config.SecretKey = cctx.String("s3-secret-key")
+		case "s3-cache-size":
+			cfg.NodeConfig.S3Config.CacheSize = cctx.Int64("s3-cache-size")
 		case "no-blockstore-cache":
 			cfg.NodeConfig.NoBlockstoreCache = cctx.Bool("no-blockstore-cache")
 		case "write-log-truncate":
@@ -114,6 +125,18 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.Hostname = cctx.String("host")
 		case "disable-local-content-adding":
 			cfg.ContentConfig.DisableLocalAdding = cctx.Bool("disable-local-content-adding")
+		case "object-batch-size":
+			cfg.ContentConfig.ObjectBatchSize = cctx.Int("object-batch-size")
+		case "dag-walk-concurrency":
+			cfg.ContentConfig.DagWalkConcurrency = cctx.Int("dag-walk-concurrency")
+		case "import-buffer-blocks":
+			cfg.ContentConfig.ImportBufferBlocks = cctx.Int("import-buffer-blocks")
+		case "import-buffer-bytes":
+			cfg.ContentConfig.ImportBufferBytes = cctx.Int64("import-buffer-bytes")
+		case "free-space-headroom":
+			cfg.ContentConfig.FreeSpaceHeadroom = cctx.Int64("free-space-headroom")
+		case "dag-overhead-percent":
+			cfg.ContentConfig.DagOverheadPercent = cctx.Int("dag-overhead-percent")
 		case "jaeger-tracing":
 			cfg.JaegerConfig.EnableTracing = cctx.Bool("jaeger-tracing")
 		case "jaeger-provider-url":
@@ -126,6 +149,28 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.NodeConfig.BitswapConfig.MaxOutstandingBytesPerPeer = cctx.Int64("bitswap-max-work-per-peer")
 		case "bitswap-target-message-size":
 			cfg.NodeConfig.BitswapConfig.TargetMessageSize = cctx.Int("bitswap-target-message-size")
+		case "graphsync-max-in-progress-incoming":
+			cfg.NodeConfig.GraphsyncConfig.MaxInProgressIncomingRequests = cctx.Uint64("graphsync-max-in-progress-incoming")
+		case "graphsync-max-in-progress-incoming-per-peer":
+			cfg.NodeConfig.GraphsyncConfig.MaxInProgressIncomingRequestsPerPeer = cctx.Uint64("graphsync-max-in-progress-incoming-per-peer")
+		case "graphsync-max-in-progress-outgoing":
+			cfg.NodeConfig.GraphsyncConfig.MaxInProgressOutgoingRequests = cctx.Uint64("graphsync-max-in-progress-outgoing")
+		case "graphsync-max-memory-responder":
+			cfg.NodeConfig.GraphsyncConfig.MaxMemoryResponder = cctx.Uint64("graphsync-max-memory-responder")
+		case "graphsync-max-memory-per-peer-responder":
+			cfg.NodeConfig.GraphsyncConfig.MaxMemoryPerPeerResponder = cctx.Uint64("graphsync-max-memory-per-peer-responder")
+		case "graphsync-message-send-retries":
+			cfg.NodeConfig.GraphsyncConfig.MessageSendRetries = cctx.Int("graphsync-message-send-retries")
+		case "graphsync-send-message-timeout":
+			cfg.NodeConfig.GraphsyncConfig.SendMessageTimeout = cctx.Duration("graphsync-send-message-timeout")
+		case "provide-rate":
+			cfg.NodeConfig.ProvideConfig.Rate = cctx.Float64("provide-rate")
+		case "provide-burst":
+			cfg.NodeConfig.ProvideConfig.Burst = cctx.Int("provide-burst")
+		case "provide-max-retries":
+			cfg.NodeConfig.ProvideConfig.MaxRetries = cctx.Int("provide-max-retries")
+		case "provide-retry-delay":
+			cfg.NodeConfig.ProvideConfig.RetryDelay = cctx.Duration("provide-retry-delay")
 		case "estuary-api":
 			cfg.EstuaryConfig.Api = cctx.String("estuary-api")
 		case "handle":
@@ -185,9 +230,36 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:  "blockstore",
-			Usage: "specify blockstore parameters",
+			Usage: "specify blockstore parameters, e.g. :flatfs:/path/to/blocks or :s3:bucket/key/prefix",
 			Value: cfg.NodeConfig.Blockstore,
 		},
+		&cli.StringFlag{
+			Name:  "s3-endpoint",
+			Usage: "url of the S3-compatible store for an :s3: blockstore",
+			Value: cfg.NodeConfig.S3Config.Endpoint,
+		},
+		&cli.StringFlag{
+			Name:  "s3-region",
+			Usage: "region of the bucket of an :s3: blockstore",
+			Value: cfg.NodeConfig.S3Config.Region,
+		},
+		&cli.StringFlag{
+			Name:    "s3-access-key",
+			Usage:   "access key id for an :s3: blockstore",
+			Value:   cfg.NodeConfig.S3Config.AccessKey,
+			EnvVars: []string{"AWS_ACCESS_KEY_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "s3-secret-key",
+			Usage:   "secret access key for an :s3: blockstore",
+			Value:   cfg.NodeConfig.S3Config.SecretKey,
+			EnvVars: []string{"AWS_SECRET_ACCESS_KEY"},
+		},
+		&cli.Int64Flag{
+			Name:  "s3-cache-size",
+			Usage: "bytes of recently used blocks of an :s3: blockstore to keep in memory (0 to disable)",
+			Value: cfg.NodeConfig.S3Config.CacheSize,
+		},
 		&cli.StringFlag{
 			Name:  "write-log",
 			Usage: "enable write log blockstore in specified directory",
@@ -255,6 +327,36 @@ func main() {
 			Usage: "disallow new content ingestion on this node",
 			Value: cfg.ContentConfig.DisableLocalAdding,
 		},
+		&cli.IntFlag{
+			Name:  "object-batch-size",
+			Usage: "rows per database insert when recording the blocks of pinned content",
+			Value: cfg.ContentConfig.ObjectBatchSize,
+		},
+		&cli.IntFlag{
+			Name:  "dag-walk-concurrency",
+			Usage: "number of blocks fetched at once when walking a DAG to pin or check it",
+			Value: cfg.ContentConfig.DagWalkConcurrency,
+		},
+		&cli.IntFlag{
+			Name:  "import-buffer-blocks",
+			Usage: "blocks of an upload held in memory before they are written to the blockstore, 0 writes each block as it is made",
+			Value: cfg.ContentConfig.ImportBufferBlocks,
+		},
+		&cli.Int64Flag{
+			Name:  "import-buffer-bytes",
+			Usage: "bytes of an upload held in memory before they are written to the blockstore, 0 writes each block as it is made",
+			Value: cfg.ContentConfig.ImportBufferBytes,
+		},
+		&cli.Int64Flag{
+			Name:  "free-space-headroom",
+			Usage: "bytes of disk space that must be left free after an import or retrieval, they are refused otherwise",
+			Value: cfg.ContentConfig.FreeSpaceHeadroom,
+		},
+		&cli.IntFlag{
+			Name:  "dag-overhead-percent",
+			Usage: "percentage added to the size of content to estimate the disk space its blocks take up",
+			Value: cfg.ContentConfig.DagOverheadPercent,
+		},
 		&cli.BoolFlag{
 			Name:  "no-reload-pin-queue",
 			Usage: "disable reloading pin queue on shuttle start",
@@ -298,6 +400,61 @@ func main() {
 			Name:  "bitswap-target-message-size",
 			Value: cfg.NodeConfig.BitswapConfig.TargetMessageSize,
 		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-in-progress-incoming",
+			Usage: "graphsync requests served at once, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxInProgressIncomingRequests,
+		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-in-progress-incoming-per-peer",
+			Usage: "graphsync requests served at once for a single peer, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxInProgressIncomingRequestsPerPeer,
+		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-in-progress-outgoing",
+			Usage: "graphsync requests made at once, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxInProgressOutgoingRequests,
+		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-memory-responder",
+			Usage: "bytes graphsync may queue to send across all peers, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxMemoryResponder,
+		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-memory-per-peer-responder",
+			Usage: "bytes graphsync may queue to send to a single peer, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxMemoryPerPeerResponder,
+		},
+		&cli.IntFlag{
+			Name:  "graphsync-message-send-retries",
+			Usage: "times graphsync resends a message before failing the request, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MessageSendRetries,
+		},
+		&cli.DurationFlag{
+			Name:  "graphsync-send-message-timeout",
+			Usage: "how long sending a graphsync message may take, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.SendMessageTimeout,
+		},
+		&cli.Float64Flag{
+			Name:  "provide-rate",
+			Usage: "DHT provide announcements sent per second for new content, zero for no limit",
+			Value: cfg.NodeConfig.ProvideConfig.Rate,
+		},
+		&cli.IntFlag{
+			Name:  "provide-burst",
+			Usage: "DHT provide announcements that may be sent at once after the queue has been idle",
+			Value: cfg.NodeConfig.ProvideConfig.Burst,
+		},
+		&cli.IntFlag{
+			Name:  "provide-max-retries",
+			Usage: "times a failed DHT provide announcement is retried before it is given up on",
+			Value: cfg.NodeConfig.ProvideConfig.MaxRetries,
+		},
+		&cli.DurationFlag{
+			Name:  "provide-retry-delay",
+			Usage: "delay before a failed DHT provide announcement is retried, doubled for each retry after the first",
+			Value: cfg.NodeConfig.ProvideConfig.RetryDelay,
+		},
 	}
 
 	app.Commands = []*cli.Command{
@@ -358,7 +515,14 @@ func main() {
 		}
 
 		rhost := routed.Wrap(nd.Host, nd.FilDht)
-		filc, err := filclient.NewClient(rhost, api, nd.Wallet, defaddr, nd.Blockstore, nd.Datastore, cfg.DataDir)
+		gsopts, err := cfg.NodeConfig.GraphsyncConfig.Options()
+		if err != nil {
+			return err
+		}
+
+		filc, err := filclient.NewClient(rhost, api, nd.Wallet, defaddr, nd.Blockstore, nd.Datastore, cfg.DataDir, func(cfg *filclient.Config) {
+			cfg.GraphsyncOpts = append(cfg.GraphsyncOpts, gsopts...)
+		})
 		if err != nil {
 			return err
 		}
@@ -438,8 +602,17 @@ func main() {
 			shuttleHandle:      cfg.EstuaryConfig.Handle,
 			shuttleToken:       cfg.EstuaryConfig.AuthToken,
 			disableLocalAdding: cfg.ContentConfig.DisableLocalAdding,
+			objectBatchSize:    cfg.ContentConfig.ObjectBatchSize,
+			dagWalkConcurrency: cfg.ContentConfig.DagWalkConcurrency,
 			dev:                cfg.Dev,
+			importLimits: util.ImportLimits{
+				MaxBlocks: cfg.ContentConfig.ImportBufferBlocks,
+				MaxBytes:  cfg.ContentConfig.ImportBufferBytes,
+			},
 		}
+
+		s.freeSpace = util.NewFreeSpaceGuard(nd.StorageDir, cfg.ContentConfig.DagOverheadPercent, cfg.ContentConfig.FreeSpaceHeadroom)
+
 		s.PinMgr = pinner.NewPinManager(s.doPinning, s.onPinStatusUpdate, &pinner.PinManagerOpts{
 			MaxActivePerUser: 30,
 		})
@@ -677,8 +850,16 @@ type Shuttle struct {
 
 	Private            bool
 	disableLocalAdding bool
+	objectBatchSize    int
+	dagWalkConcurrency int
 	dev                bool
 
+	// how much of an upload is buffered in memory
+	importLimits util.ImportLimits
+
+	// nil if the blockstore isn't a directory we can check
+	freeSpace *util.FreeSpaceGuard
+
 	hostname      string
 	estuaryHost   string
 	shuttleHandle string
@@ -947,20 +1128,13 @@ func (s *Shuttle) ServeAPI(listen string, logging bool) error {
 	e.GET("/health", s.handleHealth)
 	e.GET("/viewer", withUser(s.handleGetViewer), s.AuthRequired(util.PermLevelUser))
 
-	e.GET("/gw/:path", func(e echo.Context) error {
-		p := "/" + e.Param("path")
-
-		req := e.Request().Clone(e.Request().Context())
-		req.URL.Path = p
-
-		s.gwayHandler.ServeHTTP(e.Response().Writer, req)
-		return nil
-	})
+	e.GET("/gw/:path", s.handleGateway)
 
 	content := e.Group("/content")
 	content.Use(s.AuthRequired(util.PermLevelUpload))
 	content.POST("/add", withUser(s.handleAdd))
 	content.POST("/add-car", withUser(s.handleAddCar))
+	content.POST("/add-tar", withUser(s.handleAddTar))
 	content.GET("/read/:cont", withUser(s.handleReadContent))
 	content.POST("/importdeal", withUser(s.handleImportDeal))
 	//content.POST("/add-ipfs", withUser(d.handleAddIpfs))
@@ -981,6 +1155,32 @@ func (s *Shuttle) ServeAPI(listen string, logging bool) error {
 	return e.Start(listen)
 }
 
+// handleGateway serves the data of contents the primary has granted access
+// to, see util.GatewayGrant. Gateway requests go to the primary first, which
+// checks the caller may see the content and redirects here with a grant.
+func (s *Shuttle) handleGateway(c echo.Context) error {
+	p := "/" + c.Param("path")
+
+	_, cc, _, err := gateway.ParsePath(p)
+	if err != nil {
+		return err
+	}
+
+	if err := util.CheckGatewayGrant(s.shuttleToken, cc, c.QueryParam(util.GatewayGrantParam), time.Now()); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_NOT_AUTHORIZED,
+			Details: fmt.Sprintf("request %s through the primary's gateway: %s", cc, err),
+		}
+	}
+
+	req := c.Request().Clone(c.Request().Context())
+	req.URL.Path = p
+
+	s.gwayHandler.ServeHTTP(c.Response().Writer, req)
+	return nil
+}
+
 func (s *Shuttle) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 
@@ -1058,6 +1258,10 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 		}
 	}
 
+	if err := s.freeSpace.CheckImport(c.Request().ContentLength); err != nil {
+		return err
+	}
+
 	form, err := c.MultipartForm()
 	if err != nil {
 		return err
@@ -1098,12 +1302,13 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	bserv := blockservice.New(bs, nil)
 	dserv := merkledag.NewDAGService(bserv)
 
-	nd, err := s.importFile(ctx, dserv, fi)
+	ck := util.NewChecksummer(fi)
+	nd, err := s.importFile(ctx, dserv, ck)
 	if err != nil {
 		return err
 	}
 
-	contid, err := s.createContent(ctx, u, nd.Cid(), fname, cic)
+	contid, err := s.createContent(ctx, u, nd.Cid(), fname, cic, util.Unknown, ck.Sum())
 	if err != nil {
 		return err
 	}
@@ -1141,19 +1346,8 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 }
 
 func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
-	subCtx, cancel := context.WithTimeout(ctx, time.Second*10)
-	defer cancel()
-
-	if s.Node.FullRT.Ready() {
-		if err := s.Node.FullRT.Provide(subCtx, c, true); err != nil {
-			return errors.Wrap(err, "failed to provide newly added content")
-		}
-	} else {
-		log.Warnf("fullrt not in ready state, falling back to standard dht provide")
-		if err := s.Node.Dht.Provide(subCtx, c, true); err != nil {
-			return errors.Wrap(err, "fallback provide failed")
-		}
-	}
+	// announced as soon as the provide rate allows, and retried if that fails
+	s.Node.ProvideQueue.Add(c)
 
 	go func() {
 		if err := s.Node.Provider.Provide(c); err != nil {
@@ -1171,6 +1365,7 @@ func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
 // @Description  This endpoint uploads content via a car file
 // @Tags         content
 // @Produce      json
+// @Param        root query string false "Root cid to use when the car file declares several"
 // @Router       /content/add-car [post]
 func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
@@ -1182,6 +1377,10 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 		}
 	}
 
+	if err := s.freeSpace.CheckImport(c.Request().ContentLength); err != nil {
+		return err
+	}
+
 	bsid, bs, err := s.StagingMgr.AllocNew()
 	if err != nil {
 		return err
@@ -1198,16 +1397,28 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	defer c.Request().Body.Close()
 	header, err := s.loadCar(ctx, bs, c.Request().Body)
 	if err != nil {
+		var mismatch *util.CarBlockMismatchError
+		if xerrors.As(err, &mismatch) {
+			return &util.HttpError{
+				Code:    400,
+				Message: util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
 		return err
 	}
 
-	if len(header.Roots) != 1 {
-		// if someone wants this feature, let me know
-		return c.JSON(400, map[string]string{"error": "cannot handle uploading car files with multiple roots"})
+	root, err := util.CarRoot(header, c.QueryParam("root"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    400,
+			Message: util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
 	}
 
 	// TODO: how to specify filename?
-	fname := header.Roots[0].String()
+	fname := root.String()
 	if qpname := c.QueryParam("filename"); qpname != "" {
 		fname = qpname
 	}
@@ -1250,12 +1461,10 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	bserv := blockservice.New(bs, nil)
 	dserv := merkledag.NewDAGService(bserv)
 
-	root := header.Roots[0]
-
 	contid, err := s.createContent(ctx, u, root, fname, util.ContentInCollection{
 		Collection:     c.QueryParam("collection"),
 		CollectionPath: c.QueryParam("collectionPath"),
-	})
+	}, util.Unknown, "")
 	if err != nil {
 		return err
 	}
@@ -1314,6 +1523,90 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	})
 }
 
+func (s *Shuttle) handleAddTar(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	if u.StorageDisabled || s.disableLocalAdding {
+		return &util.HttpError{
+			Code:    400,
+			Message: util.ERR_CONTENT_ADDING_DISABLED,
+		}
+	}
+
+	if err := s.freeSpace.CheckImport(c.Request().ContentLength); err != nil {
+		return err
+	}
+
+	bsid, bs, err := s.StagingMgr.AllocNew()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		go func() {
+			if err := s.StagingMgr.CleanUp(bsid); err != nil {
+				log.Errorf("failed to clean up staging blockstore: %s", err)
+			}
+		}()
+	}()
+
+	bserv := blockservice.New(bs, nil)
+	dserv := merkledag.NewDAGService(bserv)
+
+	// a compressed archive can hold far more than was uploaded, check again
+	// against what its files add up to
+	defer c.Request().Body.Close()
+	nd, err := util.ImportTarUpload(ctx, dserv, c.Request().Body, s.importLimits, s.freeSpace.CheckImport)
+	if err != nil {
+		return err
+	}
+	root := nd.Cid()
+
+	fname := root.String()
+	if qpname := c.QueryParam("filename"); qpname != "" {
+		fname = qpname
+	}
+
+	contid, err := s.createContent(ctx, u, root, fname, util.ContentInCollection{
+		Collection:     c.QueryParam("collection"),
+		CollectionPath: c.QueryParam("collectionPath"),
+	}, util.Directory, "")
+	if err != nil {
+		return err
+	}
+
+	pin := &Pin{
+		Content: contid,
+		Cid:     util.DbCID{root},
+		UserID:  u.ID,
+
+		Active:  false,
+		Pinning: true,
+	}
+
+	if err := s.DB.Create(pin).Error; err != nil {
+		return err
+	}
+
+	if err := s.addDatabaseTrackingToContent(ctx, contid, dserv, bs, root, func(int64) {}); err != nil {
+		return xerrors.Errorf("encountered problem computing object references: %w", err)
+	}
+
+	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
+		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
+	}
+
+	if err := s.Provide(ctx, root); err != nil {
+		log.Warn(err)
+	}
+
+	return c.JSON(200, &util.ContentAddResponse{
+		Cid:       root.String(),
+		EstuaryId: contid,
+		Providers: s.addrsForShuttle(),
+	})
+}
+
 // calculateCarSize works out the CAR size using the cids and block sizes
 // for the content stored in the DB
 func (s *Shuttle) calculateCarSize(data cid.Cid) (uint64, error) {
@@ -1339,7 +1632,7 @@ func (s *Shuttle) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Re
 	_, span := s.Tracer.Start(ctx, "loadCar")
 	defer span.End()
 
-	return car.LoadCar(ctx, bs, r)
+	return util.LoadVerifiedCarWithLimits(ctx, bs, r, s.importLimits)
 }
 
 func (s *Shuttle) addrsForShuttle() []string {
@@ -1350,13 +1643,15 @@ func (s *Shuttle) addrsForShuttle() []string {
 	return out
 }
 
-func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, fname string, cic util.ContentInCollection) (uint, error) {
+func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, fname string, cic util.ContentInCollection, ctype util.ContentType, checksum string) (uint, error) {
 
 	data, err := json.Marshal(util.ContentCreateBody{
 		ContentInCollection: cic,
 		Root:                root.String(),
 		Name:                fname,
 		Location:            s.shuttleHandle,
+		Type:                ctype,
+		Checksum:            checksum,
 	})
 	if err != nil {
 		return 0, err
@@ -1544,16 +1839,16 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		d.inflightCidsLk.Unlock()
 	}()
 
-	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+	err := util.WalkDag(ctx, dserv, root, func(c cid.Cid) bool {
+		if !cset.Visit(c) {
+			return false
+		}
+
 		d.inflightCidsLk.Lock()
 		d.inflightCids[c]++
 		d.inflightCidsLk.Unlock()
-
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to Get CID node")
-		}
-
+		return true
+	}, d.dagWalkConcurrency, func(node ipld.Node) error {
 		cb(int64(len(node.RawData())))
 
 		select {
@@ -1563,30 +1858,34 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 
 		objlk.Lock()
 		objects = append(objects, &Object{
-			Cid:  util.DbCID{c},
+			Cid:  util.DbCID{node.Cid()},
 			Size: len(node.RawData()),
 		})
 
 		totalSize += int64(len(node.RawData()))
 		objlk.Unlock()
-
-		if c.Type() == cid.Raw {
-			return nil, nil
-		}
-
-		return node.Links(), nil
-	}, root, cset.Visit, merkledag.Concurrent())
+		return nil
+	})
 	if err != nil {
 		return errors.Wrap(err, "failed to walk DAG")
 	}
 
+	// blocks come in whatever order they were fetched in
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Cid.CID.KeyString() < objects[j].Cid.CID.KeyString()
+	})
+
 	span.SetAttributes(
 		attribute.Int64("totalSize", totalSize),
 		attribute.Int("numObjects", len(objects)),
 	)
 
-	if err := d.DB.CreateInBatches(objects, 300).Error; err != nil {
-		return errors.Wrap(err, "failed to create objects in db")
+	// one transaction for the whole DAG, the database skips the default
+	// transaction so otherwise every batch would be committed separately
+	if err := d.DB.Transaction(func(tx *gorm.DB) error {
+		return insertObjectsAndRefs(tx, dbpin.ID, objects, d.objectBatchSize)
+	}); err != nil {
+		return err
 	}
 
 	if err := d.DB.Model(Pin{}).Where("content = ?", contid).UpdateColumns(map[string]interface{}{
@@ -1597,17 +1896,7 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		return errors.Wrap(err, "failed to update content in database")
 	}
 
-	refs := make([]ObjRef, len(objects))
-	for i := range refs {
-		refs[i].Pin = dbpin.ID
-		refs[i].Object = objects[i].ID
-	}
-
-	if err := d.DB.CreateInBatches(refs, 500).Error; err != nil {
-		return errors.Wrap(err, "failed to create refs")
-	}
-
-	d.sendPinCompleteMessage(ctx, dbpin.Content, totalSize, objects)
+	d.sendPinCompleteMessage(ctx, dbpin.Content, dbpin.Cid.CID, totalSize, objects)
 
 	return nil
 }
@@ -1686,7 +1975,7 @@ func (s *Shuttle) importFile(ctx context.Context, dserv ipld.DAGService, fi io.R
 	_, span := s.Tracer.Start(ctx, "importFile")
 	defer span.End()
 
-	return util.ImportFile(dserv, fi)
+	return util.ImportFileWithLimits(ctx, dserv, fi, s.importLimits)
 }
 
 func (s *Shuttle) dumpBlockstoreTo(ctx context.Context, from, to blockstore.Blockstore) error {
@@ -1731,13 +2020,17 @@ func (s *Shuttle) getUpdatePacket() (*drpc.ShuttleUpdate, error) {
 
 	upd.PinQueueSize = s.PinMgr.PinQueueSize()
 
-	var st unix.Statfs_t
-	if err := unix.Statfs(s.Node.StorageDir, &st); err != nil {
-		log.Errorf("failed to get blockstore disk usage: %s", err)
-	}
+	// blockstores that aren't on local disk report no size or free space,
+	// which estuary doesn't take as running low on space
+	if s.Node.StorageDir != "" {
+		var st unix.Statfs_t
+		if err := unix.Statfs(s.Node.StorageDir, &st); err != nil {
+			log.Errorf("failed to get blockstore disk usage: %s", err)
+		}
 
-	upd.BlockstoreSize = st.Blocks * uint64(st.Bsize)
-	upd.BlockstoreFree = st.Bavail * uint64(st.Bsize)
+		upd.BlockstoreSize = st.Blocks * uint64(st.Bsize)
+		upd.BlockstoreFree = st.Bavail * uint64(st.Bsize)
+	}
 
 	if err := s.DB.Model(Pin{}).Where("active").Count(&upd.NumPins).Error; err != nil {
 		return nil, err
@@ -1949,18 +2242,7 @@ func (s *Shuttle) handleContentHealthCheck(c echo.Context) error {
 	dserv := merkledag.NewDAGService(bserv)
 
 	cset := cid.NewSet()
-	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, err
-		}
-
-		if c.Type() == cid.Raw {
-			return nil, nil
-		}
-
-		return node.Links(), nil
-	}, cc, cset.Visit, merkledag.Concurrent())
+	err = util.WalkDag(ctx, dserv, cc, cset.Visit, s.dagWalkConcurrency, nil)
 
 	errstr := ""
 	if err != nil {
@@ -1998,7 +2280,7 @@ func (s *Shuttle) handleResendPinComplete(c echo.Context) error {
 		return fmt.Errorf("failed to get objects for pin: %w", err)
 	}
 
-	s.sendPinCompleteMessage(ctx, p.Content, p.Size, objects)
+	s.sendPinCompleteMessage(ctx, p.Content, p.Cid.CID, p.Size, objects)
 
 	return c.JSON(200, map[string]string{})
 }
@@ -2186,7 +2468,7 @@ func (s *Shuttle) handleImportDeal(c echo.Context, u *User) error {
 		break
 	}
 
-	contid, err := s.createContent(ctx, u, cc, body.Name, body.ContentInCollection)
+	contid, err := s.createContent(ctx, u, cc, body.Name, body.ContentInCollection, util.Unknown, "")
 	if err != nil {
 		return err
 	}
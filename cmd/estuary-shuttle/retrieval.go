@@ -84,7 +84,7 @@ func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, deals [
 			return fmt.Errorf("failed to get objects for pin: %w", err)
 		}
 
-		s.sendPinCompleteMessage(ctx, pin.Content, pin.Size, objects)
+		s.sendPinCompleteMessage(ctx, pin.Content, pin.Cid.CID, pin.Size, objects)
 		return nil
 	}
 
@@ -107,6 +107,11 @@ func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, deals [
 		}
 		log.Infow("got retrieval ask", "content", contentToFetch, "miner", deal.Miner, "ask", ask)
 
+		// every miner has the same data, so there's no point trying the next
+		if err := s.freeSpace.CheckWrite(int64(ask.Size)); err != nil {
+			return fmt.Errorf("refusing to retrieve content %d: %w", contentToFetch, err)
+		}
+
 		if err := s.tryRetrieve(ctx, deal.Miner, root, ask, sel); err != nil {
 			span.RecordError(err)
 			log.Errorw("failed to retrieve content", "miner", deal.Miner, "content", root, "err", err)
@@ -148,7 +153,15 @@ func (s *Shuttle) tryRetrieve(ctx context.Context, maddr address.Address, c cid.
 		return err
 	}
 
-	stats, err := s.Filc.RetrieveContent(ctx, maddr, proposal)
+	updates := make(chan util.RetrievalStatsSnapshot, 1)
+	go func() {
+		for st := range updates {
+			log.Debugw("retrieval progress", "cid", c, "miner", maddr, "received", st.BytesReceived,
+				"speed", st.CurrentSpeed, "payments", st.Payments, "paid", st.Paid, "done", st.Done)
+		}
+	}()
+
+	stats, err := util.RetrieveContentWithStats(ctx, s.Filc, maddr, proposal, nil, updates)
 	if err != nil {
 		return err
 	}
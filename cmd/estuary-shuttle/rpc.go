@@ -13,6 +13,7 @@ import (
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	cbor "github.com/ipfs/go-ipld-cbor"
 	"github.com/ipfs/go-merkledag"
 	"go.opentelemetry.io/otel/attribute"
@@ -95,6 +96,13 @@ func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user ui
 		return err
 	}
 
+	if len(search) == 0 {
+		// the size of what we're pinning isn't known until it's fetched
+		if err := d.freeSpace.CheckWrite(0); err != nil {
+			return xerrors.Errorf("refusing to pin content %d: %w", contid, err)
+		}
+	}
+
 	if len(search) > 0 {
 		// already have a pin with this content id
 		if len(search) > 1 {
@@ -173,7 +181,7 @@ func (s *Shuttle) resendPinComplete(ctx context.Context, pin Pin) error {
 		return fmt.Errorf("failed to get objects for pin: %s", err)
 	}
 
-	s.sendPinCompleteMessage(ctx, pin.Content, pin.Size, objects)
+	s.sendPinCompleteMessage(ctx, pin.Content, pin.Cid.CID, pin.Size, objects)
 	return nil
 }
 
@@ -240,10 +248,17 @@ func (s *Shuttle) sendSplitContentComplete(ctx context.Context, cont uint) {
 	}
 }
 
-func (d *Shuttle) sendPinCompleteMessage(ctx context.Context, cont uint, size int64, objects []*Object) {
+func (d *Shuttle) sendPinCompleteMessage(ctx context.Context, cont uint, root cid.Cid, size int64, objects []*Object) {
 	ctx, span := d.Tracer.Start(ctx, "sendPinCompleteMessage")
 	defer span.End()
 
+	// the data is all local by now, so this doesn't go out to the network
+	dserv := merkledag.NewDAGService(blockservice.New(d.Node.Blockstore, offline.Exchange(d.Node.Blockstore)))
+	mt, err := util.DetectMimeType(ctx, dserv, root)
+	if err != nil {
+		log.Warnf("failed to detect mime type of content %d: %s", cont, err)
+	}
+
 	objs := make([]drpc.PinObj, 0, len(objects))
 	for _, o := range objects {
 		objs = append(objs, drpc.PinObj{
@@ -256,9 +271,10 @@ func (d *Shuttle) sendPinCompleteMessage(ctx context.Context, cont uint, size in
 		Op: drpc.OP_PinComplete,
 		Params: drpc.MsgParams{
 			PinComplete: &drpc.PinComplete{
-				DBID:    cont,
-				Size:    size,
-				Objects: objs,
+				DBID:     cont,
+				Size:     size,
+				MimeType: mt,
+				Objects:  objs,
 			},
 		},
 	}); err != nil {
@@ -376,7 +392,7 @@ func (d *Shuttle) handleRpcAggregateContent(ctx context.Context, cmd *drpc.Aggre
 		return err
 	}
 
-	go d.sendPinCompleteMessage(ctx, cmd.DBID, totalSize, nil)
+	go d.sendPinCompleteMessage(ctx, cmd.DBID, pin.Cid.CID, totalSize, nil)
 	return nil
 }
 
@@ -0,0 +1,21 @@
+package config
+
+// BlockstoreLimits are sizes in bytes, zero disables the limit
+type BlockstoreLimits struct {
+	SoftCap int64 `json:",omitempty"` // offload least recently used content above this
+	HardCap int64 `json:",omitempty"` // refuse new imports and retrievals above this
+}
+
+// S3Blockstore is where an :s3: blockstore keeps its blocks. The blockstore
+// spec names the bucket and key prefix, this has the rest.
+type S3Blockstore struct {
+	// e.g. https://s3.us-east-1.amazonaws.com, or the url of a self hosted
+	// S3-compatible store
+	Endpoint  string `json:",omitempty"`
+	Region    string `json:",omitempty"`
+	AccessKey string `json:",omitempty"`
+	SecretKey string `json:",omitempty"`
+
+	// bytes of recently used blocks kept in memory, zero disables the cache
+	CacheSize int64 `json:",omitempty"`
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	rcmgr "github.com/libp2p/go-libp2p-resource-manager"
@@ -95,6 +96,34 @@ func TestApplyLimits(t *testing.T) {
 	assert.Equal(limiter.TransientLimits.GetFDLimit(), config.TransientLimitConfig.FD)
 }
 
+func TestGraphsyncOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	opts, err := NewEstuary().NodeConfig.GraphsyncConfig.Options()
+	assert.NoError(err)
+	assert.Empty(opts)
+
+	opts, err = Graphsync{
+		MaxInProgressIncomingRequests: 100,
+		MaxMemoryPerPeerResponder:     64 << 20,
+		SendMessageTimeout:            time.Minute * 5,
+	}.Options()
+	assert.NoError(err)
+	assert.Len(opts, 3)
+
+	_, err = Graphsync{
+		MaxInProgressIncomingRequests:        10,
+		MaxInProgressIncomingRequestsPerPeer: 20,
+	}.Options()
+	assert.Error(err)
+
+	_, err = Graphsync{
+		MaxMemoryResponder:        16 << 20,
+		MaxMemoryPerPeerResponder: 32 << 20,
+	}.Options()
+	assert.Error(err)
+}
+
 func TestEstuaryJSONRoundtrip(t *testing.T) {
 	assert := assert.New(t)
 	config := NewEstuary()
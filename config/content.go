@@ -3,4 +3,29 @@ package config
 type Content struct {
 	DisableLocalAdding  bool `json:",omitempty"`
 	DisableGlobalAdding bool `json:",omitempty"` // not valid for shuttle
+
+	// rows per insert statement when recording the objects of a pinned DAG
+	ObjectBatchSize int `json:",omitempty"`
+
+	// nodes fetched at once when walking a DAG to pin or check it
+	DagWalkConcurrency int `json:",omitempty"`
+
+	// blocks and bytes of an upload held in memory before they are written
+	// to the blockstore, whichever comes first. With either at zero blocks
+	// are written one at a time as they are made.
+	ImportBufferBlocks int   `json:",omitempty"`
+	ImportBufferBytes  int64 `json:",omitempty"`
+
+	// one of stop-deals, offload or delete, not valid for shuttle
+	ExpiryAction string `json:",omitempty"`
+
+	// replace or split, what to do with an aggregate when one of its deals
+	// faults, not valid for shuttle
+	AggregateFaultStrategy string `json:",omitempty"`
+
+	// imports and retrievals are refused unless the disk holding the
+	// blockstore has room for the data, plus DagOverheadPercent of its size,
+	// with FreeSpaceHeadroom bytes to spare
+	FreeSpaceHeadroom  int64 `json:",omitempty"`
+	DagOverheadPercent int   `json:",omitempty"`
 }
@@ -1,7 +1,92 @@
 package config
 
+import "time"
+
 type Deal struct {
 	FailOnTransferFailure bool `json:",omitempty"`
 	Disable               bool `json:",omitempty"`
 	Verified              bool `json:",omitempty"`
+	RankByLatency         bool `json:",omitempty"`
+	RankBySize            bool `json:",omitempty"`
+	MaxInflightTransfers  int  `json:",omitempty"` // zero means no limit
+
+	// one of success-ratio, lowest-price or region-diverse
+	MinerSelectionStrategy string `json:",omitempty"`
+
+	// when set, new deals start StartEpochSlack epochs after the current
+	// chain head instead of the fixed delay filclient uses
+	AutoStartEpoch  bool  `json:",omitempty"`
+	StartEpochSlack int64 `json:",omitempty"`
+	// bytes per second we expect transfers to run at, used to warn when the
+	// slack is too short for a deal's data to reach the miner
+	EstimatedTransferRate int64 `json:",omitempty"`
+
+	// when a new proposal has the same cid as one we already saved, bump its
+	// start epoch until it is distinct instead of reusing the saved one
+	BumpDuplicateProposals bool `json:",omitempty"`
+
+	// avoid making deals for the same content with miners that share an
+	// owner, worker or network block
+	MinerDiversity bool `json:",omitempty"`
+
+	// don't ask miners to keep an unsealed copy of our data for fast
+	// retrieval, only honored by miners on the v1.1.0 deal protocol
+	DisableFastRetrieval bool `json:",omitempty"`
+
+	// when our deal duration is outside the range a miner accepts, shorten
+	// or lengthen it to fit instead of skipping the miner
+	AdjustDealDuration bool `json:",omitempty"`
+
+	// proposals that waited this many epochs to be sent get their start
+	// epoch and collateral recomputed and are signed again, zero disables it
+	ProposalStaleEpochs int64 `json:",omitempty"`
+
+	// times to try sending a proposal when we fail to reach the miner, e.g.
+	// because the stream dropped, before giving up on the deal. Proposals
+	// the miner answered are never resent.
+	ProposalSendAttempts int `json:",omitempty"`
+
+	// fixed makes every deal verified or not as Verified says, per-miner
+	// only makes a replica verified if its miner takes verified deals for
+	// free and there is datacap left, and pays for the rest
+	VerifiedPolicy string `json:",omitempty"`
+
+	// fixed makes Replication deals for content that doesn't set its own,
+	// adaptive makes as many as it takes, up to MaxReplication, for the
+	// content to survive losing DurabilityTolerance of its deals with
+	// DurabilityConfidence, going by the deal history of the miners
+	ReplicationMode      string  `json:",omitempty"`
+	DurabilityTolerance  int     `json:",omitempty"`
+	DurabilityConfidence float64 `json:",omitempty"`
+	MaxReplication       int     `json:",omitempty"`
+
+	// how often every content's sealed deals are counted against its
+	// replication, alerting on the contents that fell short, zero disables
+	// the check. The alerts are logged, and posted as json to
+	// RedundancyAlertWebhook if set.
+	RedundancyCheckInterval time.Duration `json:",omitempty"`
+	RedundancyAlertWebhook  string        `json:",omitempty"`
+
+	// how deal proposals are labeled: estuary records the content id along
+	// with the payload cid, cid only has the payload cid
+	LabelScheme string `json:",omitempty"`
+
+	// deals only go to miners that got at least this share of our past deals
+	// on chain, for content that doesn't set its own. Zero allows any miner.
+	MinSuccessRatio float64 `json:",omitempty"`
+
+	// how often every active deal is looked up on chain to catch slashing,
+	// zero disables the check. Slashed deals are also caught when their
+	// content is checked.
+	SlashCheckInterval time.Duration `json:",omitempty"`
+
+	// how long the audit of each round of miner selection is kept, zero
+	// keeps them forever
+	SelectionAuditRetention time.Duration `json:",omitempty"`
+
+	// prefer miners whose preferred deal sizes fit the content, and size
+	// aggregates, splits and deal pieces to what the miners prefer. A
+	// miner's preference is set through its info, or learned from its deal
+	// history or ask.
+	DealSizeTargeting bool `json:",omitempty"`
 }
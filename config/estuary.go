@@ -2,6 +2,7 @@ package config
 
 import (
 	"path/filepath"
+	"time"
 
 	"github.com/application-research/estuary/build"
 )
@@ -19,6 +20,9 @@ type Estuary struct {
 	JaegerConfig           Jaeger
 	DealConfig             Deal
 	ContentConfig          Content
+	RetrievalConfig        Retrieval
+	WalletConfig           Wallet
+	BlockstoreLimits       BlockstoreLimits
 	LowMem                 bool
 	DisableFilecoinStorage bool
 	Replication            int
@@ -42,6 +46,7 @@ func (cfg *Estuary) SetRequiredOptions() error {
 	cfg.NodeConfig.WalletDir = filepath.Join(cfg.DataDir, "estuary-wallet")
 	cfg.NodeConfig.DatastoreDir = filepath.Join(cfg.DataDir, "estuary-leveldb")
 	cfg.NodeConfig.Libp2pKeyFile = filepath.Join(cfg.DataDir, "estuary-peer.key")
+	cfg.RetrievalConfig.Provider.KeyFile = filepath.Join(cfg.DataDir, "retrieval-provider-peer.key")
 
 	if cfg.NodeConfig.Blockstore == "" {
 		cfg.NodeConfig.Blockstore = filepath.Join(cfg.DataDir, "estuary-blocks")
@@ -62,14 +67,54 @@ func NewEstuary() *Estuary {
 		EnableAutoRetrieve:     false,
 
 		DealConfig: Deal{
-			Disable:               false,
-			FailOnTransferFailure: false,
-			Verified:              true,
+			Disable:                false,
+			FailOnTransferFailure:  false,
+			Verified:               true,
+			MinerSelectionStrategy: "success-ratio",
+			StartEpochSlack:        2880,
+			EstimatedTransferRate:  1 << 20,
+			ProposalStaleEpochs:    120,
+			ProposalSendAttempts:   3,
+			VerifiedPolicy:         "fixed",
+			ReplicationMode:        "fixed",
+			DurabilityTolerance:    1,
+			DurabilityConfidence:   0.999,
+			MaxReplication:         10,
+
+			RedundancyCheckInterval: time.Hour,
+			SlashCheckInterval:      time.Hour * 6,
+			SelectionAuditRetention: time.Hour * 24 * 30,
+			LabelScheme:             "estuary",
 		},
 
 		ContentConfig: Content{
-			DisableLocalAdding:  false,
-			DisableGlobalAdding: false,
+			DisableLocalAdding:     false,
+			DisableGlobalAdding:    false,
+			ObjectBatchSize:        1000,
+			DagWalkConcurrency:     32,
+			ImportBufferBlocks:     1000,
+			ImportBufferBytes:      4 << 20,
+			ExpiryAction:           "stop-deals",
+			AggregateFaultStrategy: "replace",
+			FreeSpaceHeadroom:      1 << 30,
+			DagOverheadPercent:     10,
+		},
+
+		RetrievalConfig: Retrieval{
+			IndexerURL:         "https://cid.contact",
+			CheckpointInterval: 256 << 20,
+			PaychFunding: PaychFunding{
+				BufferPercent: 20,
+				Amount:        "0.02",
+			},
+			Provider: RetrievalProvider{
+				Enabled: false,
+				ListenAddrs: []string{
+					"/ip4/0.0.0.0/tcp/6746",
+				},
+				PaymentInterval:         1 << 20,
+				PaymentIntervalIncrease: 1 << 20,
+			},
 		},
 
 		JaegerConfig: Jaeger{
@@ -91,6 +136,11 @@ func NewEstuary() *Estuary {
 			WriteLogTruncate:  false,
 			NoBlockstoreCache: false,
 
+			S3Config: S3Blockstore{
+				Region:    "us-east-1",
+				CacheSize: 512 << 20,
+			},
+
 			BitswapConfig: BitswapConfig{
 				MaxOutstandingBytesPerPeer: 5 << 20,
 				TargetMessageSize:          0,
@@ -129,6 +179,13 @@ func NewEstuary() *Estuary {
 				LowWater:  2000,
 				HighWater: 3000,
 			},
+			ProvideConfig: Provide{
+				Rate:       10,
+				Burst:      50,
+				MaxRetries: 3,
+				RetryDelay: time.Minute,
+				Timeout:    time.Second * 10,
+			},
 		},
 	}
 }
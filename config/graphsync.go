@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+)
+
+// Graphsync tunes the graphsync instances that move data for storage deals
+// and retrievals: filclient's, used for our own deals and retrievals, and the
+// retrieval provider's, which serves retrievals to other peers. A zero value
+// leaves the setting at the instance's default, noted on each field as
+// filclient / retrieval provider.
+//
+// High-bandwidth links generally want more requests in progress and more
+// responder memory, high-latency links a longer send timeout. Graphsync
+// doesn't let the size of its messages be set.
+type Graphsync struct {
+	// requests we serve at once, across all peers (200 / 6). Each takes up
+	// to MaxMemoryPerPeerResponder while it sends, 1-1000 is sensible.
+	MaxInProgressIncomingRequests uint64 `json:",omitempty"`
+	// requests we serve at once for a single peer (20 / unlimited), at most
+	// MaxInProgressIncomingRequests
+	MaxInProgressIncomingRequestsPerPeer uint64 `json:",omitempty"`
+	// requests we make at once, each a deal transfer or retrieval in
+	// progress (200 / 6), 1-1000 is sensible
+	MaxInProgressOutgoingRequests uint64 `json:",omitempty"`
+
+	// bytes of blocks queued to send, across all peers (8GiB / 256MiB)
+	MaxMemoryResponder uint64 `json:",omitempty"`
+	// bytes of blocks queued to send to a single peer (32MiB / 16MiB), at
+	// most MaxMemoryResponder. Raising it lets a fast link keep more data in
+	// flight to each peer.
+	MaxMemoryPerPeerResponder uint64 `json:",omitempty"`
+
+	// times a message is resent before the request fails (2 / 10)
+	MessageSendRetries int `json:",omitempty"`
+	// how long sending a message may take (2m / 10m), raise it for slow or
+	// high-latency links
+	SendMessageTimeout time.Duration `json:",omitempty"`
+}
+
+// Options returns the graphsync options for the settings that are set, to
+// apply after the instance's defaults
+func (cfg Graphsync) Options() ([]gsimpl.Option, error) {
+	if cfg.MaxInProgressIncomingRequests > 0 && cfg.MaxInProgressIncomingRequestsPerPeer > cfg.MaxInProgressIncomingRequests {
+		return nil, fmt.Errorf("graphsync MaxInProgressIncomingRequestsPerPeer (%d) is more than MaxInProgressIncomingRequests (%d)",
+			cfg.MaxInProgressIncomingRequestsPerPeer, cfg.MaxInProgressIncomingRequests)
+	}
+
+	if cfg.MaxMemoryResponder > 0 && cfg.MaxMemoryPerPeerResponder > cfg.MaxMemoryResponder {
+		return nil, fmt.Errorf("graphsync MaxMemoryPerPeerResponder (%d) is more than MaxMemoryResponder (%d)",
+			cfg.MaxMemoryPerPeerResponder, cfg.MaxMemoryResponder)
+	}
+
+	if cfg.MessageSendRetries < 0 {
+		return nil, fmt.Errorf("graphsync MessageSendRetries can't be negative")
+	}
+
+	if cfg.SendMessageTimeout < 0 {
+		return nil, fmt.Errorf("graphsync SendMessageTimeout can't be negative")
+	}
+
+	var opts []gsimpl.Option
+	if cfg.MaxInProgressIncomingRequests > 0 {
+		opts = append(opts, gsimpl.MaxInProgressIncomingRequests(cfg.MaxInProgressIncomingRequests))
+	}
+	if cfg.MaxInProgressIncomingRequestsPerPeer > 0 {
+		opts = append(opts, gsimpl.MaxInProgressIncomingRequestsPerPeer(cfg.MaxInProgressIncomingRequestsPerPeer))
+	}
+	if cfg.MaxInProgressOutgoingRequests > 0 {
+		opts = append(opts, gsimpl.MaxInProgressOutgoingRequests(cfg.MaxInProgressOutgoingRequests))
+	}
+	if cfg.MaxMemoryResponder > 0 {
+		opts = append(opts, gsimpl.MaxMemoryResponder(cfg.MaxMemoryResponder))
+	}
+	if cfg.MaxMemoryPerPeerResponder > 0 {
+		opts = append(opts, gsimpl.MaxMemoryPerPeerResponder(cfg.MaxMemoryPerPeerResponder))
+	}
+	if cfg.MessageSendRetries > 0 {
+		opts = append(opts, gsimpl.MessageSendRetries(cfg.MessageSendRetries))
+	}
+	if cfg.SendMessageTimeout > 0 {
+		opts = append(opts, gsimpl.SendMessageTimeout(cfg.SendMessageTimeout))
+	}
+	return opts, nil
+}
@@ -8,6 +8,7 @@ type Node struct {
 	EnableWebsocketListenAddr bool
 
 	Blockstore string
+	S3Config   S3Blockstore
 
 	WriteLogDir       string
 	HardFlushWriteLog bool
@@ -22,8 +23,10 @@ type Node struct {
 	WalletDir string
 
 	BitswapConfig           BitswapConfig
+	GraphsyncConfig         Graphsync
 	LimitsConfig            Limits
 	ConnectionManagerConfig ConnectionManager
+	ProvideConfig           Provide
 }
 
 type BitswapConfig struct {
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Provide paces the DHT provide announcements made for newly added content.
+// Rather than announcing everything the moment it lands, which floods the
+// DHT when a lot of content comes in at once, announcements go through a
+// queue that sends them at most Rate per second and retries the ones that
+// fail. The batched reprovider isn't affected.
+type Provide struct {
+	// announcements sent per second, zero for no limit
+	Rate float64 `json:",omitempty"`
+	// announcements that may be sent at once after the queue has been idle,
+	// at least 1
+	Burst int `json:",omitempty"`
+	// times a failed announcement is retried before it's given up on
+	MaxRetries int `json:",omitempty"`
+	// delay before a failed announcement is retried, doubled for each retry
+	// after the first
+	RetryDelay time.Duration `json:",omitempty"`
+	// how long a single announcement may take
+	Timeout time.Duration `json:",omitempty"`
+}
+
+func (cfg Provide) Validate() error {
+	if cfg.Rate < 0 {
+		return fmt.Errorf("provide Rate can't be negative")
+	}
+	if cfg.Rate > 0 && cfg.Burst < 1 {
+		return fmt.Errorf("provide Burst must be at least 1")
+	}
+	if cfg.MaxRetries < 0 {
+		return fmt.Errorf("provide MaxRetries can't be negative")
+	}
+	if cfg.RetryDelay < 0 || cfg.Timeout < 0 {
+		return fmt.Errorf("provide RetryDelay and Timeout can't be negative")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package config
+
+// Retrieval caps are FIL amounts (e.g. "0.0001"), an empty value disables the cap
+type Retrieval struct {
+	MaxUnsealPrice   string `json:",omitempty"`
+	MaxTransferPrice string `json:",omitempty"`
+
+	// PaymentInterval is the number of bytes to pay for at a time, zero uses
+	// whatever the miner asks for. It can't be larger than the miner's maximum.
+	PaymentInterval uint64 `json:",omitempty"`
+
+	// CheckpointInterval is the number of bytes received between checkpoints
+	// of a retrieval's progress, zero disables checkpointing
+	CheckpointInterval uint64 `json:",omitempty"`
+
+	// IndexerURL is the network indexer (IPNI) queried for providers of a
+	// CID, empty disables indexer lookups
+	IndexerURL string `json:",omitempty"`
+
+	PaychFunding PaychFunding
+
+	Provider RetrievalProvider
+}
+
+// PaychFunding decides how much goes into the payment channel to a miner
+// before retrieving from it. Fewer, larger top ups mean fewer on-chain
+// messages but more FIL locked up in channels.
+type PaychFunding struct {
+	// Strategy is "exact" for the retrieval's cost, "with-buffer" for the
+	// cost and BufferPercent on top, or "fixed-amount" for Amount at a time.
+	// Empty leaves funding to filclient, which adds 0.02 FIL to a channel
+	// with less than 0.01 FIL in it.
+	Strategy      string `json:",omitempty"`
+	BufferPercent int    `json:",omitempty"`
+	// Amount is in FIL
+	Amount string `json:",omitempty"`
+
+	// FundEveryRetrieval adds the full funding for every retrieval, rather
+	// than reusing what the channel already holds and only topping it up
+	// when it is short
+	FundEveryRetrieval bool `json:",omitempty"`
+}
+
+// RetrievalProvider serves retrievals of content in our blockstore to other
+// peers, on its own libp2p host
+type RetrievalProvider struct {
+	Enabled     bool     `json:",omitempty"`
+	ListenAddrs []string `json:",omitempty"`
+	KeyFile     string   `json:",omitempty"`
+
+	// Price is in FIL per GiB, empty or zero serves retrievals for free
+	Price                   string `json:",omitempty"`
+	PaymentInterval         uint64 `json:",omitempty"`
+	PaymentIntervalIncrease uint64 `json:",omitempty"`
+}
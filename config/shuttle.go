@@ -3,6 +3,7 @@ package config
 import (
 	"errors"
 	"path/filepath"
+	"time"
 )
 
 const DefaultWebsocketAddr = "/ip4/0.0.0.0/tcp/6747/ws"
@@ -78,6 +79,12 @@ func NewShuttle() *Shuttle {
 
 		ContentConfig: Content{
 			DisableLocalAdding: false,
+			ObjectBatchSize:    1000,
+			DagWalkConcurrency: 32,
+			ImportBufferBlocks: 1000,
+			ImportBufferBytes:  4 << 20,
+			FreeSpaceHeadroom:  1 << 30,
+			DagOverheadPercent: 10,
 		},
 
 		JaegerConfig: Jaeger{
@@ -103,6 +110,11 @@ func NewShuttle() *Shuttle {
 			WriteLogTruncate:  false,
 			NoBlockstoreCache: false,
 
+			S3Config: S3Blockstore{
+				Region:    "us-east-1",
+				CacheSize: 512 << 20,
+			},
+
 			BitswapConfig: BitswapConfig{
 				MaxOutstandingBytesPerPeer: 5 << 20,
 				TargetMessageSize:          16 << 10,
@@ -141,6 +153,13 @@ func NewShuttle() *Shuttle {
 				LowWater:  2000,
 				HighWater: 3000,
 			},
+			ProvideConfig: Provide{
+				Rate:       10,
+				Burst:      50,
+				MaxRetries: 3,
+				RetryDelay: time.Minute,
+				Timeout:    time.Second * 10,
+			},
 		},
 
 		EstuaryConfig: EstuaryRemoteConfig{
@@ -0,0 +1,11 @@
+package config
+
+// Wallet configures where deal proposals get signed. When RemoteSignerURL is
+// set, proposals are made from RemoteSignerAddress and signed by the lotus
+// wallet API at that URL instead of the local keystore. Without an address
+// set the wallet's only address is used. The API token is read from the
+// ESTUARY_REMOTE_SIGNER_TOKEN environment variable.
+type Wallet struct {
+	RemoteSignerURL     string `json:",omitempty"`
+	RemoteSignerAddress string `json:",omitempty"`
+}
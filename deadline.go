@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+const (
+	// deals made on top of the ones still needed for content with a
+	// deadline, as a fraction of those, so that a deal or two running late
+	// doesn't mean missing it
+	deadlineSpareDeals = 0.5
+
+	// how often content with a deadline is checked on, instead of the
+	// usual ten minutes, so failed deals get replaced sooner
+	deadlineCheckInterval = time.Minute * 2
+
+	// ranked miners whose seal times are looked at for each deal round
+	deadlinePoolSize = 50
+)
+
+// deadlineMiner is a miner's expected time to seal a new deal for a content
+// with a deadline
+type deadlineMiner struct {
+	Miner  string        `json:"miner"`
+	Basis  string        `json:"basis"`
+	Median time.Duration `json:"median"`
+	High   time.Duration `json:"high"`
+	// whether a deal made now should seal before the deadline, going by the
+	// median of past deals
+	InTime bool `json:"inTime"`
+}
+
+// dealDeadlineReport says whether a content can be replicated by its deal
+// deadline, given the deals it has and the seal times of the miners it could
+// still get deals with
+type dealDeadlineReport struct {
+	Content     uint      `json:"content"`
+	Deadline    time.Time `json:"deadline"`
+	Replication int       `json:"replication"`
+
+	Sealed int `json:"sealed"`
+	// deals in progress expected to seal before the deadline, and after it
+	InTime int `json:"inTime"`
+	Late   int `json:"late"`
+
+	// estimated time to transfer the content to a miner
+	Transfer time.Duration `json:"transfer"`
+	// miners expected to seal a deal made now in time, fastest first
+	Candidates []deadlineMiner `json:"candidates"`
+
+	Achievable bool `json:"achievable"`
+	// set when replication is reduced to what can be done by the deadline
+	ReduceReplication bool `json:"reduceReplication"`
+	ReducedTo         int  `json:"reducedTo,omitempty"`
+}
+
+// sealsBy reports whether a deal whose data is transferred at start should
+// seal before deadline, going by the median of the miner's past deals
+func sealsBy(est *sealEstimate, start, deadline time.Time) bool {
+	if est == nil {
+		return false
+	}
+	return !start.Add(est.Median).After(deadline)
+}
+
+// deadlineReplication is the replication a content with a deadline gets:
+// what it asked for, unless that can't be done in time and it asked for it
+// to be reduced, then as many deals as are expected to seal in time. Deals
+// are never reduced below one.
+func deadlineReplication(target, sealed, inTime, candidates int, reduce bool) (achievable bool, reduced int) {
+	possible := sealed + inTime + candidates
+	if possible >= target {
+		return true, 0
+	}
+
+	if !reduce {
+		return false, 0
+	}
+
+	if possible < 1 {
+		possible = 1
+	}
+	return false, possible
+}
+
+// deadlineDeals is how many deals to make in a round for a content with a
+// deadline that still needs needed deals, with spares for the late deals in
+// progress that aren't expected to seal in time. There are never more spares
+// than late deals: one that fails is replaced at the next check, a few
+// minutes later, so spares are only needed for deals that may never make it.
+func deadlineDeals(needed, late int) int {
+	if needed <= 0 {
+		return needed
+	}
+
+	spares := int(math.Ceil(float64(needed) * deadlineSpareDeals))
+	if spares > late {
+		spares = late
+	}
+	return needed + spares
+}
+
+func (cm *ContentManager) transferEstimate(size int64) time.Duration {
+	if cm.estimatedTransferRate <= 0 {
+		return 0
+	}
+	return time.Duration(size/cm.estimatedTransferRate) * time.Second
+}
+
+// hasDealDeadline reports whether the content has a deadline that hasn't
+// passed yet
+func (c Content) hasDealDeadline(now time.Time) bool {
+	return c.DealDeadline != nil && now.Before(*c.DealDeadline)
+}
+
+// deadlineMiners looks up how long the miners take to seal and orders them
+// fastest first, miners without enough history to say come last
+func (cm *ContentManager) deadlineMiners(content Content, miners []address.Address) ([]deadlineMiner, error) {
+	start := time.Now().Add(cm.transferEstimate(content.Size))
+
+	out := make([]deadlineMiner, 0, len(miners))
+	for _, m := range miners {
+		est, err := cm.sealEstimate(m.String())
+		if err != nil {
+			return nil, err
+		}
+
+		dm := deadlineMiner{Miner: m.String()}
+		if est != nil {
+			dm.Basis = est.Basis
+			dm.Median = est.Median
+			dm.High = est.High
+			dm.InTime = sealsBy(est, start, *content.DealDeadline)
+		}
+		out = append(out, dm)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if (out[i].Basis == "") != (out[j].Basis == "") {
+			return out[j].Basis == ""
+		}
+		return out[i].Median < out[j].Median
+	})
+	return out, nil
+}
+
+// deadlineCandidates returns the ranked miners that can make new deals for
+// the content, the ones expected to seal in time first, fastest first, then
+// the rest
+func (cm *ContentManager) deadlineCandidates(content Content, sorted []address.Address, exclude map[address.Address]bool) ([]deadlineMiner, error) {
+	var pool []address.Address
+	for _, m := range sorted {
+		if len(pool) >= deadlinePoolSize {
+			break
+		}
+		if !exclude[m] {
+			pool = append(pool, m)
+		}
+	}
+
+	dms, err := cm.deadlineMiners(content, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(dms, func(i, j int) bool {
+		return dms[i].InTime && !dms[j].InTime
+	})
+	return dms, nil
+}
+
+// tooSlowDetail says why a miner isn't expected to seal before the deadline
+func tooSlowDetail(dm deadlineMiner, deadline time.Time) string {
+	if dm.Basis == "" {
+		return "not enough sealing history"
+	}
+	return fmt.Sprintf("seals in %s, deadline is in %s", dm.Median.Round(time.Minute), time.Until(deadline).Round(time.Minute))
+}
+
+// dealDeadlineReport works out whether the content can be replicated by its
+// deadline
+func (cm *ContentManager) dealDeadlineReport(content Content) (*dealDeadlineReport, error) {
+	if content.DealDeadline == nil {
+		return nil, fmt.Errorf("content %d has no deal deadline", content.ID)
+	}
+
+	rep := &dealDeadlineReport{
+		Content:           content.ID,
+		Deadline:          *content.DealDeadline,
+		Replication:       cm.replicationFor(content),
+		Transfer:          cm.transferEstimate(content.Size),
+		ReduceReplication: content.DeadlineReduceReplication,
+		Candidates:        []deadlineMiner{},
+	}
+
+	var deals []contentDeal
+	if err := cm.DB.Find(&deals, "content = ? AND NOT failed AND NOT retired", content.ID).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	have := make(map[address.Address]bool)
+	for _, d := range deals {
+		maddr, err := d.MinerAddr()
+		if err != nil {
+			return nil, err
+		}
+		have[maddr] = true
+
+		if !d.SealedAt.IsZero() {
+			rep.Sealed++
+			continue
+		}
+
+		est, err := cm.sealEstimate(d.Miner)
+		if err != nil {
+			return nil, err
+		}
+
+		start := now.Add(rep.Transfer)
+		if !d.TransferFinished.IsZero() {
+			start = d.TransferFinished
+		}
+
+		if sealsBy(est, start, rep.Deadline) {
+			rep.InTime++
+		} else {
+			rep.Late++
+		}
+	}
+
+	if content.hasDealDeadline(now) {
+		sorted, _, err := cm.sortedMinerList()
+		if err != nil {
+			return nil, err
+		}
+
+		suspended, err := cm.suspendedMiners()
+		if err != nil {
+			return nil, err
+		}
+
+		unavailable, err := cm.unavailableMiners()
+		if err != nil {
+			return nil, err
+		}
+
+		var pool []address.Address
+		for _, m := range sorted {
+			if len(pool) >= deadlinePoolSize {
+				break
+			}
+
+			if _, ok := suspended[m]; ok {
+				continue
+			}
+			if _, ok := unavailable[m]; ok {
+				continue
+			}
+			if have[m] || !cm.minerBreakers.available(m) {
+				continue
+			}
+			pool = append(pool, m)
+		}
+
+		dms, err := cm.deadlineMiners(content, pool)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dm := range dms {
+			if dm.InTime {
+				rep.Candidates = append(rep.Candidates, dm)
+			}
+		}
+	}
+
+	rep.Achievable, rep.ReducedTo = deadlineReplication(rep.Replication, rep.Sealed, rep.InTime, len(rep.Candidates), content.DeadlineReduceReplication)
+	return rep, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDealDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	est := &sealEstimate{Median: time.Hour * 10, High: time.Hour * 30}
+
+	assert.True(sealsBy(est, now, now.Add(time.Hour*12)))
+	assert.False(sealsBy(est, now, now.Add(time.Hour*8)))
+	// the median decides, a slow deal may still be late
+	assert.True(sealsBy(est, now, now.Add(time.Hour*10)))
+	assert.False(sealsBy(nil, now, now.Add(time.Hour*1000)))
+
+	ok, reduced := deadlineReplication(6, 2, 1, 5, false)
+	assert.True(ok)
+	assert.Equal(0, reduced)
+
+	ok, reduced = deadlineReplication(6, 2, 1, 2, false)
+	assert.False(ok)
+	assert.Equal(0, reduced)
+
+	ok, reduced = deadlineReplication(6, 2, 1, 2, true)
+	assert.False(ok)
+	assert.Equal(5, reduced)
+
+	// never fewer than one deal
+	ok, reduced = deadlineReplication(6, 0, 0, 0, true)
+	assert.False(ok)
+	assert.Equal(1, reduced)
+
+	assert.Equal(0, deadlineDeals(0, 2))
+	assert.Equal(2, deadlineDeals(1, 1))
+	assert.Equal(6, deadlineDeals(4, 3))
+	assert.Equal(8, deadlineDeals(5, 5))
+
+	// spares only stand in for late deals
+	assert.Equal(4, deadlineDeals(4, 0))
+	assert.Equal(5, deadlineDeals(4, 1))
+
+	past := now.Add(-time.Minute)
+	assert.False(Content{}.hasDealDeadline(now))
+	assert.False(Content{DealDeadline: &past}.hasDealDeadline(now))
+}
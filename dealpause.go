@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// dealPauseRecord keeps deal making paused across restarts, there is only
+// ever the one row
+type dealPauseRecord struct {
+	ID       uint `gorm:"primarykey"`
+	Paused   bool
+	Reason   string
+	PausedAt time.Time
+}
+
+const dealPauseRecordID = 1
+
+// dealPause stops new deal proposals from being made, without touching the
+// deals already in progress. Contents that came up for deals while paused are
+// remembered so they can be checked again as soon as deal making resumes.
+type dealPause struct {
+	lk     sync.Mutex
+	paused bool
+	reason string
+	since  time.Time
+
+	// content id to its priority
+	deferred map[uint]int
+}
+
+type dealPauseStatus struct {
+	Paused bool      `json:"paused"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+	// contents waiting for deal making to resume
+	Deferred int `json:"deferred"`
+}
+
+func newDealPause() *dealPause {
+	return &dealPause{
+		deferred: make(map[uint]int),
+	}
+}
+
+func (dp *dealPause) isPaused() bool {
+	dp.lk.Lock()
+	defer dp.lk.Unlock()
+	return dp.paused
+}
+
+// pause returns false if deal making was already paused, the reason and time
+// of the first pause are kept
+func (dp *dealPause) pause(reason string, now time.Time) bool {
+	dp.lk.Lock()
+	defer dp.lk.Unlock()
+
+	if dp.paused {
+		return false
+	}
+
+	dp.paused = true
+	dp.reason = reason
+	dp.since = now
+	return true
+}
+
+// resume returns the contents deferred while paused
+func (dp *dealPause) resume() map[uint]int {
+	dp.lk.Lock()
+	defer dp.lk.Unlock()
+
+	deferred := dp.deferred
+	dp.paused = false
+	dp.reason = ""
+	dp.since = time.Time{}
+	dp.deferred = make(map[uint]int)
+	return deferred
+}
+
+// deferContent remembers a content that would have had deals made for it,
+// it returns false if deal making isn't paused
+func (dp *dealPause) deferContent(content uint, priority int) bool {
+	dp.lk.Lock()
+	defer dp.lk.Unlock()
+
+	if !dp.paused {
+		return false
+	}
+
+	if p, ok := dp.deferred[content]; !ok || priority > p {
+		dp.deferred[content] = priority
+	}
+	return true
+}
+
+func (dp *dealPause) status() dealPauseStatus {
+	dp.lk.Lock()
+	defer dp.lk.Unlock()
+
+	return dealPauseStatus{
+		Paused:   dp.paused,
+		Reason:   dp.reason,
+		Since:    dp.since,
+		Deferred: len(dp.deferred),
+	}
+}
+
+// loadDealPause restores a pause that was in effect when estuary stopped
+func loadDealPause(db *gorm.DB) (*dealPause, error) {
+	dp := newDealPause()
+
+	var rec dealPauseRecord
+	if err := db.Find(&rec, "id = ?", dealPauseRecordID).Error; err != nil {
+		return nil, err
+	}
+
+	if rec.Paused {
+		dp.pause(rec.Reason, rec.PausedAt)
+		log.Warnw("deal making is paused", "reason", rec.Reason, "since", rec.PausedAt)
+	}
+	return dp, nil
+}
+
+func saveDealPause(db *gorm.DB, st dealPauseStatus) error {
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&dealPauseRecord{
+		ID:       dealPauseRecordID,
+		Paused:   st.Paused,
+		Reason:   st.Reason,
+		PausedAt: st.Since,
+	}).Error
+}
+
+// PauseDealMaking stops new deals from being proposed until
+// ResumeDealMaking is called, transfers and deals already in progress carry
+// on. The pause is kept across restarts.
+func (cm *ContentManager) PauseDealMaking(reason string) error {
+	if !cm.dealPause.pause(reason, time.Now()) {
+		return nil
+	}
+
+	if err := saveDealPause(cm.DB, cm.dealPause.status()); err != nil {
+		cm.dealPause.resume()
+		return xerrors.Errorf("saving deal pause: %w", err)
+	}
+
+	log.Warnw("deal making paused", "reason", reason)
+	return nil
+}
+
+// ResumeDealMaking lifts a pause, the contents that came up for deals while
+// paused are queued to be checked again
+func (cm *ContentManager) ResumeDealMaking() error {
+	if !cm.dealPause.isPaused() {
+		return nil
+	}
+
+	if err := saveDealPause(cm.DB, dealPauseStatus{}); err != nil {
+		return xerrors.Errorf("saving deal pause: %w", err)
+	}
+
+	deferred := cm.dealPause.resume()
+	for c, p := range deferred {
+		cm.dealQueue.push(c, p)
+	}
+
+	log.Infow("deal making resumed", "deferred", len(deferred))
+	return nil
+}
+
+func (cm *ContentManager) DealMakingPaused() bool {
+	return cm.dealPause.isPaused()
+}
+
+// errDealMakingPaused is returned when a deal is asked for directly while
+// deal making is paused
+func errDealMakingPaused(st dealPauseStatus) error {
+	if st.Reason == "" {
+		return fmt.Errorf("deal making is paused")
+	}
+	return fmt.Errorf("deal making is paused: %s", st.Reason)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDealPause(t *testing.T) {
+	assert := assert.New(t)
+
+	dp := newDealPause()
+	assert.False(dp.deferContent(1, priorityNormal), "nothing is deferred while running")
+
+	now := time.Now()
+	assert.True(dp.pause("budget freeze", now))
+	assert.False(dp.pause("maintenance", now.Add(time.Hour)), "pausing again keeps the first pause")
+	assert.True(dp.isPaused())
+
+	assert.True(dp.deferContent(1, priorityNormal))
+	assert.True(dp.deferContent(2, priorityLow))
+	assert.True(dp.deferContent(1, priorityHigh))
+	assert.True(dp.deferContent(1, priorityLow))
+
+	st := dp.status()
+	assert.True(st.Paused)
+	assert.Equal("budget freeze", st.Reason)
+	assert.Equal(now, st.Since)
+	assert.Equal(2, st.Deferred)
+
+	deferred := dp.resume()
+	assert.Equal(map[uint]int{1: priorityHigh, 2: priorityLow}, deferred)
+	assert.False(dp.isPaused())
+	assert.Equal(dealPauseStatus{}, dp.status())
+	assert.False(dp.deferContent(3, priorityNormal))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// dealPricing is a caller's limit on what a deal may cost, nil leaves it to
+// the node's own limits
+type dealPricing struct {
+	// per GiB per epoch, replaces the node's limit for the deal
+	MaxPrice abi.TokenAmount
+
+	// when the miner rejects the proposal's price, query its ask again and
+	// propose once more at the new price if it is within MaxPrice
+	Renegotiate bool
+
+	// set once a deal was made at a price other than the one first proposed
+	Adjusted *dealPriceAdjustment
+}
+
+type dealPriceAdjustment struct {
+	From abi.TokenAmount
+	To   abi.TokenAmount
+}
+
+// priceRejections are the reasons miners give for turning down a proposal
+// over its price, in both lotus markets and boost
+var priceRejections = []string{
+	"less than asking price",
+}
+
+// isPriceRejection reports whether a failed proposal was rejected for being
+// priced below the miner's ask, rather than for any other reason
+func isPriceRejection(err error) bool {
+	msg := err.Error()
+	for _, r := range priceRejections {
+		if strings.Contains(msg, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDealPrice checks a miner's price against the caller's ceiling if one
+// was given, and the node's limits otherwise
+func (cm *ContentManager) checkDealPrice(miner address.Address, price abi.TokenAmount, verified bool, pricing *dealPricing) error {
+	if pricing != nil && !pricing.MaxPrice.Nil() {
+		if price.GreaterThan(pricing.MaxPrice) {
+			return fmt.Errorf("miner %s price %s is above the maximum of %s", miner, types.FIL(price), types.FIL(pricing.MaxPrice))
+		}
+		return nil
+	}
+
+	if cm.priceIsTooHigh(price, verified) {
+		return fmt.Errorf("miners price is too high: %s %s", miner, price)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsPriceRejection(t *testing.T) {
+	// as filclient reports the rejections of lotus markets and boost
+	require.True(t, isPriceRejection(errors.New("deal proposal rejected: storage price per epoch less than asking price: 5000 < 9765")))
+	require.True(t, isPriceRejection(fmt.Errorf("%w (after 2 attempts)", errors.New("deal rejected: storage price per epoch less than asking price: 1 < 2"))))
+
+	require.False(t, isPriceRejection(errors.New("deal proposal rejected: deal rejected as unverified deals are not accepted")))
+	require.False(t, isPriceRejection(errors.New("failed to open stream to peer")))
+}
+
+func TestCheckDealPrice(t *testing.T) {
+	cm := &ContentManager{}
+	miner, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	// verified deals are only made for free by default
+	require.Error(t, cm.checkDealPrice(miner, fil("0.0000001"), true, nil))
+	require.NoError(t, cm.checkDealPrice(miner, big.Zero(), true, nil))
+
+	// a caller's ceiling replaces that
+	pricing := &dealPricing{MaxPrice: fil("0.0000002")}
+	require.NoError(t, cm.checkDealPrice(miner, fil("0.0000001"), true, pricing))
+	require.NoError(t, cm.checkDealPrice(miner, fil("0.0000002"), true, pricing))
+	require.Error(t, cm.checkDealPrice(miner, fil("0.0000003"), true, pricing))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+// Where a miner's preferred deal sizes come from, in order of precedence
+const (
+	// set through the miner's info
+	dealSizeSourceConfigured = "configured"
+
+	// around the sizes of the miner's past deals with us
+	dealSizeSourceHistory = "history"
+
+	// the piece sizes the miner's ask allows
+	dealSizeSourceAsk = "ask"
+)
+
+// confirmed deals a miner needs before its preferred deal sizes are learned
+// from them rather than from its ask
+const dealSizeHistoryMinDeals = 5
+
+// dealSizeRange is the range of padded piece sizes a miner prefers deals of,
+// a zero bound means there is none
+type dealSizeRange struct {
+	Min    abi.PaddedPieceSize `json:"min,omitempty"`
+	Max    abi.PaddedPieceSize `json:"max,omitempty"`
+	Source string              `json:"source,omitempty"`
+}
+
+func (r dealSizeRange) fits(size abi.PaddedPieceSize) bool {
+	if r.Min != 0 && size < r.Min {
+		return false
+	}
+	if r.Max != 0 && size > r.Max {
+		return false
+	}
+	return true
+}
+
+func (r dealSizeRange) String() string {
+	bound := func(s abi.PaddedPieceSize) string {
+		if s == 0 {
+			return "any"
+		}
+		return humanize.IBytes(uint64(s))
+	}
+	return fmt.Sprintf("%s to %s (%s)", bound(r.Min), bound(r.Max), r.Source)
+}
+
+// minerDealSizeRange returns the deal sizes a miner prefers: the range set
+// in its info if there is one, else between half and twice the average size
+// of its confirmed deals with us rounded out to piece sizes, else whatever its
+// ask allows. Learned ranges never go outside of the ask.
+func minerDealSizeRange(sm *storageMiner, askMin, askMax abi.PaddedPieceSize, st *minerDealStats) dealSizeRange {
+	if sm != nil && (sm.MinDealSize > 0 || sm.MaxDealSize > 0) {
+		return dealSizeRange{
+			Min:    abi.PaddedPieceSize(sm.MinDealSize),
+			Max:    abi.PaddedPieceSize(sm.MaxDealSize),
+			Source: dealSizeSourceConfigured,
+		}
+	}
+
+	ask := dealSizeRange{Min: askMin, Max: askMax, Source: dealSizeSourceAsk}
+
+	if st == nil || st.ConfirmedDeals < dealSizeHistoryMinDeals {
+		return ask
+	}
+
+	avg := st.TotalBytesStored / uint64(st.ConfirmedDeals)
+	if avg == 0 {
+		return ask
+	}
+
+	hist := dealSizeRange{
+		Min:    abi.PaddedPieceSize(floorPow2(avg / 2)),
+		Max:    abi.PaddedPieceSize(ceilPow2(avg * 2)),
+		Source: dealSizeSourceHistory,
+	}
+	if hist.Min < askMin {
+		hist.Min = askMin
+	}
+	if askMax != 0 && hist.Max > askMax {
+		hist.Max = askMax
+	}
+	if hist.Max < hist.Min {
+		return ask
+	}
+	return hist
+}
+
+func floorPow2(v uint64) uint64 {
+	if v == 0 {
+		return 0
+	}
+	return 1 << (bits.Len64(v) - 1)
+}
+
+func ceilPow2(v uint64) uint64 {
+	if v <= 1 {
+		return 1
+	}
+	return 1 << bits.Len64(v-1)
+}
+
+// validDealSizeRange checks a range set through a miner's info, zero leaves
+// a bound unset
+func validDealSizeRange(min, max int64) error {
+	if min < 0 || max < 0 || (max > 0 && min > max) {
+		return fmt.Errorf("invalid deal size range: min %d, max %d", min, max)
+	}
+
+	for _, s := range []int64{min, max} {
+		if s == 0 {
+			continue
+		}
+		if err := abi.PaddedPieceSize(s).Validate(); err != nil {
+			return fmt.Errorf("invalid deal size %d, must be a padded piece size: %w", s, err)
+		}
+	}
+	return nil
+}
+
+// minerSizeInfo is what the deal sizes miners prefer are worked out from,
+// loaded once for a round of picking miners or making deals
+type minerSizeInfo struct {
+	miners map[address.Address]*storageMiner
+	stats  map[address.Address]*minerDealStats
+}
+
+// loadMinerSizeInfo loads the miners' info and their stats in the cached
+// ranking, for all the miners if none are given
+func (cm *ContentManager) loadMinerSizeInfo(miners []address.Address) (*minerSizeInfo, error) {
+	q := cm.DB
+	if miners != nil {
+		names := make([]string, 0, len(miners))
+		for _, m := range miners {
+			names = append(names, m.String())
+		}
+		q = q.Where("address in ?", names)
+	}
+
+	var dbminers []storageMiner
+	if err := q.Find(&dbminers).Error; err != nil {
+		return nil, err
+	}
+
+	_, stats, err := cm.sortedMinerList()
+	if err != nil {
+		return nil, err
+	}
+
+	si := &minerSizeInfo{
+		miners: make(map[address.Address]*storageMiner, len(dbminers)),
+		stats:  make(map[address.Address]*minerDealStats, len(stats)),
+	}
+	for i, sm := range dbminers {
+		si.miners[sm.Address.Addr] = &dbminers[i]
+	}
+	for _, st := range stats {
+		si.stats[st.Miner] = st
+	}
+	return si, nil
+}
+
+// rangeFor returns the deal sizes m prefers given the piece sizes its ask
+// allows
+func (si *minerSizeInfo) rangeFor(m address.Address, askMin, askMax abi.PaddedPieceSize) dealSizeRange {
+	return minerDealSizeRange(si.miners[m], askMin, askMax, si.stats[m])
+}
+
+// dealPieceTarget is the size to pad a piece up to for a miner that prefers
+// deals of the given range, zero if the piece already fits it
+func dealPieceTarget(r dealSizeRange, piece abi.PaddedPieceSize) abi.PaddedPieceSize {
+	if r.Min > piece {
+		return r.Min
+	}
+	return 0
+}
+
+// dealSizeTarget is the last targetContentSize worked out, before it's
+// capped to a limit, and the ranking it was worked out from
+type dealSizeTarget struct {
+	size    int64
+	ranking time.Time
+	at      time.Time
+}
+
+// targetContentSize returns how much content to put in a piece for the miner
+// deals are most likely to be made with, the highest ranked one that has an
+// upper bound on the deal sizes it prefers. Aggregates are filled up to it
+// and content over it is split, so it is never below what gets a deal of
+// its own, and never above limit. Zero means no miner has a preference.
+//
+// Staging zones are opened with bucketLk held, so this goes by the ranking as
+// it was last computed, even if it has expired, rather than recomputing it
+// and asking miners. It only reads the miners' info and cached asks from the
+// database, once per ranking or minerListTTL, whichever comes first.
+func (cm *ContentManager) targetContentSize(limit int64) (int64, error) {
+	sorted, stats, computed := cm.cachedMinerList()
+
+	cm.dealSizeTargetLk.Lock()
+	defer cm.dealSizeTargetLk.Unlock()
+
+	t := cm.dealSizeTarget
+	if t == nil || !t.ranking.Equal(computed) || time.Since(t.at) > minerListTTL {
+		size, err := cm.computeTargetContentSize(sorted, stats)
+		if err != nil {
+			return 0, err
+		}
+
+		t = &dealSizeTarget{size: size, ranking: computed, at: time.Now()}
+		cm.dealSizeTarget = t
+	}
+
+	if t.size > limit {
+		return limit, nil
+	}
+	return t.size, nil
+}
+
+func (cm *ContentManager) computeTargetContentSize(sorted []address.Address, stats []*minerDealStats) (int64, error) {
+	byMiner := make(map[address.Address]*minerDealStats, len(stats))
+	for _, st := range stats {
+		byMiner[st.Miner] = st
+	}
+
+	var dbminers []storageMiner
+	if err := cm.DB.Find(&dbminers, "not suspended").Error; err != nil {
+		return 0, err
+	}
+
+	miners := make(map[address.Address]*storageMiner, len(dbminers))
+	for i, sm := range dbminers {
+		miners[sm.Address.Addr] = &dbminers[i]
+	}
+
+	var asks []minerStorageAsk
+	if err := cm.DB.Find(&asks).Error; err != nil {
+		return 0, err
+	}
+
+	askBy := make(map[string]minerStorageAsk, len(asks))
+	for _, a := range asks {
+		askBy[a.Miner] = a
+	}
+
+	for _, m := range sorted {
+		sm, ok := miners[m]
+		if !ok {
+			continue
+		}
+
+		ask := askBy[m.String()]
+		r := minerDealSizeRange(sm, ask.MinPieceSize, ask.MaxPieceSize, byMiner[m])
+		if r.Max == 0 {
+			continue
+		}
+
+		// same packing overhead as individualDealThreshold
+		size := int64(r.Max.Unpadded()) * 9 / 10
+		if size < int64(individualDealThreshold) {
+			size = int64(individualDealThreshold)
+		}
+		return size, nil
+	}
+
+	return 0, nil
+}
+
+// dealSizeTargetDetail describes for the selection audit how a piece of the
+// given size compares to the deal sizes a miner prefers
+func dealSizeTargetDetail(r dealSizeRange, piece abi.PaddedPieceSize) string {
+	fit := "fits"
+	if !r.fits(piece) {
+		fit = "doesn't fit"
+	}
+	return fmt.Sprintf("prefers %s, %s piece %s", r, humanize.IBytes(uint64(piece)), fit)
+}
+
+func paddedPieceDetail(piece abi.PaddedPieceSize) string {
+	return fmt.Sprintf("piece padded to %s for the miner's preferred deal size", humanize.IBytes(uint64(piece)))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinerDealSizeRange(t *testing.T) {
+	const (
+		askMin = abi.PaddedPieceSize(256 << 20)
+		askMax = abi.PaddedPieceSize(32 << 30)
+	)
+
+	// nothing to go by but the ask
+	r := minerDealSizeRange(nil, askMin, askMax, nil)
+	require.Equal(t, dealSizeRange{Min: askMin, Max: askMax, Source: dealSizeSourceAsk}, r)
+
+	// too few deals to learn from
+	few := &minerDealStats{ConfirmedDeals: dealSizeHistoryMinDeals - 1, TotalBytesStored: 4 << 30}
+	require.Equal(t, dealSizeSourceAsk, minerDealSizeRange(&storageMiner{}, askMin, askMax, few).Source)
+
+	// deals averaging 6GiB make for a range of 2GiB to 16GiB
+	hist := &minerDealStats{ConfirmedDeals: 10, TotalBytesStored: 10 * (6 << 30)}
+	r = minerDealSizeRange(&storageMiner{}, askMin, askMax, hist)
+	require.Equal(t, dealSizeRange{Min: 2 << 30, Max: 16 << 30, Source: dealSizeSourceHistory}, r)
+
+	// learned ranges stay within the ask
+	r = minerDealSizeRange(&storageMiner{}, askMin, 8<<30, hist)
+	require.Equal(t, dealSizeRange{Min: 2 << 30, Max: 8 << 30, Source: dealSizeSourceHistory}, r)
+	r = minerDealSizeRange(&storageMiner{}, 32<<30, askMax, hist)
+	require.Equal(t, dealSizeSourceAsk, r.Source)
+
+	// a configured range wins over everything
+	sm := &storageMiner{MinDealSize: 16 << 30}
+	r = minerDealSizeRange(sm, askMin, askMax, hist)
+	require.Equal(t, dealSizeRange{Min: 16 << 30, Source: dealSizeSourceConfigured}, r)
+}
+
+func TestDealSizeRangeFits(t *testing.T) {
+	r := dealSizeRange{Min: 1 << 30, Max: 8 << 30}
+	require.False(t, r.fits(512<<20))
+	require.True(t, r.fits(1<<30))
+	require.True(t, r.fits(8<<30))
+	require.False(t, r.fits(16<<30))
+
+	require.True(t, dealSizeRange{}.fits(64<<30))
+
+	require.Equal(t, abi.PaddedPieceSize(1<<30), dealPieceTarget(r, 512<<20))
+	require.Zero(t, dealPieceTarget(r, 2<<30))
+}
+
+func TestValidDealSizeRange(t *testing.T) {
+	require.NoError(t, validDealSizeRange(0, 0))
+	require.NoError(t, validDealSizeRange(1<<30, 0))
+	require.NoError(t, validDealSizeRange(1<<30, 32<<30))
+
+	require.Error(t, validDealSizeRange(-1, 0))
+	require.Error(t, validDealSizeRange(32<<30, 1<<30))
+	require.Error(t, validDealSizeRange(3<<30, 0))
+}
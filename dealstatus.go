@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/filclient"
+	smtypes "github.com/filecoin-project/boost/storagemarket/types"
+	"github.com/filecoin-project/boost/storagemarket/types/dealcheckpoints"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	inet "github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// dealStatus asks a miner for the state of one of our deals. Miners only
+// answer requests signed by the deal's client, and filclient signs them with
+// the node's wallet, so with a remote signer we make the request ourselves
+// and have the remote signer sign it.
+//
+// Retrievals and their payment channels stay with the node's wallet either
+// way, miners don't tie them to the client of a deal.
+func (cm *ContentManager) dealStatus(ctx context.Context, maddr address.Address, propCid cid.Cid, dealUUID *uuid.UUID) (*storagemarket.ProviderDealState, error) {
+	if cm.remoteSignerAddr == address.Undef {
+		return cm.FilClient.DealStatus(ctx, maddr, propCid, dealUUID)
+	}
+
+	protos := []protocol.ID{filclient.DealStatusProtocolv110}
+	if dealUUID != nil {
+		// v1.2.0 looks deals up by uuid, which older deals don't have
+		protos = []protocol.ID{filclient.DealStatusProtocolv120, filclient.DealStatusProtocolv110}
+	}
+
+	pid, err := cm.FilClient.ConnectToMiner(ctx, maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := cm.Node.Host.NewStream(ctx, pid, protos...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream to peer: %w", err)
+	}
+	defer s.Close()
+
+	if s.Protocol() == filclient.DealStatusProtocolv110 {
+		cidb, err := cborutil.Dump(propCid)
+		if err != nil {
+			return nil, err
+		}
+
+		sig, err := cm.signer.WalletSign(ctx, cm.remoteSignerAddr, cidb, api.MsgMeta{Type: api.MTUnknown})
+		if err != nil {
+			return nil, fmt.Errorf("signing status request failed: %w", err)
+		}
+
+		var resp network.DealStatusResponse
+		if err := dealStatusRPC(ctx, s, &network.DealStatusRequest{Proposal: propCid, Signature: *sig}, &resp); err != nil {
+			return nil, err
+		}
+		return &resp.DealState, nil
+	}
+
+	uuidBytes, err := dealUUID.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("getting uuid bytes: %w", err)
+	}
+
+	sig, err := cm.signer.WalletSign(ctx, cm.remoteSignerAddr, uuidBytes, api.MsgMeta{Type: api.MTUnknown})
+	if err != nil {
+		return nil, fmt.Errorf("signing status request failed: %w", err)
+	}
+
+	var resp smtypes.DealStatusResponse
+	if err := dealStatusRPC(ctx, s, &smtypes.DealStatusRequest{DealUUID: *dealUUID, Signature: *sig}, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("deal status error: %s", resp.Error)
+	}
+
+	st := resp.DealStatus
+	if st == nil {
+		return nil, fmt.Errorf("deal status is nil")
+	}
+
+	return &storagemarket.ProviderDealState{
+		State:         legacyDealStatus(st),
+		Message:       st.Error,
+		Proposal:      &st.Proposal,
+		ProposalCid:   &st.SignedProposalCid,
+		PublishCid:    st.PublishCid,
+		DealID:        st.ChainDealID,
+		FastRetrieval: true,
+	}, nil
+}
+
+func dealStatusRPC(ctx context.Context, s inet.Stream, req, resp interface{}) error {
+	if dline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dline)
+		defer s.SetDeadline(time.Time{})
+	}
+
+	if err := cborutil.WriteCborRPC(s, req); err != nil {
+		return fmt.Errorf("deal status rpc: failed to send request: %w", err)
+	}
+
+	if err := cborutil.ReadCborRPC(s, resp); err != nil {
+		return fmt.Errorf("deal status rpc: failed to read response: %w", err)
+	}
+	return nil
+}
+
+// legacyDealStatus maps a v1.2.0 deal checkpoint to the v1.1.0 deal states
+// the rest of estuary works with, as filclient does
+func legacyDealStatus(ds *smtypes.DealStatus) storagemarket.StorageDealStatus {
+	if ds.Error != "" {
+		return storagemarket.StorageDealError
+	}
+
+	switch ds.Status {
+	case dealcheckpoints.Accepted.String():
+		return storagemarket.StorageDealWaitingForData
+	case dealcheckpoints.Transferred.String():
+		return storagemarket.StorageDealVerifyData
+	case dealcheckpoints.Published.String():
+		return storagemarket.StorageDealPublishing
+	case dealcheckpoints.PublishConfirmed.String():
+		return storagemarket.StorageDealStaged
+	case dealcheckpoints.AddedPiece.String(), dealcheckpoints.IndexedAndAnnounced.String():
+		return storagemarket.StorageDealAwaitingPreCommit
+	case dealcheckpoints.Complete.String():
+		return storagemarket.StorageDealSealing
+	}
+
+	return storagemarket.StorageDealUnknown
+}
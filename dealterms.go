@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// How deals pick between verified (datacap) and unverified (paid) terms
+const (
+	// every deal uses the node's verified deal setting
+	verifiedPolicyFixed = "fixed"
+
+	// each replica is verified if its miner takes verified deals for free and
+	// we have the datacap left, otherwise it is paid for
+	verifiedPolicyPerMiner = "per-miner"
+)
+
+func validVerifiedPolicy(policy string) error {
+	switch policy {
+	case "", verifiedPolicyFixed, verifiedPolicyPerMiner:
+		return nil
+	default:
+		return fmt.Errorf("unknown verified deal policy %q", policy)
+	}
+}
+
+// dealTerms are the terms one replica is made on, and why
+type dealTerms struct {
+	Verified bool
+	Price    abi.TokenAmount
+	Reason   string
+}
+
+// chooseDealTerms picks the terms for a deal with the miner behind ask.
+// datacap is what's left of ours for this round of deals, nil if we don't
+// know. It errors if the miner's price for the chosen terms is too high.
+func (cm *ContentManager) chooseDealTerms(ask *storagemarket.StorageAsk, size abi.PaddedPieceSize, datacap *big.Int) (dealTerms, error) {
+	terms := chooseDealTerms(cm.verifiedPolicy, cm.VerifiedDeal, ask, size, datacap)
+
+	if cm.priceIsTooHigh(terms.Price, terms.Verified) {
+		return terms, fmt.Errorf("miners price is too high: %s (verified = %v)", types.FIL(terms.Price), terms.Verified)
+	}
+	return terms, nil
+}
+
+func chooseDealTerms(policy string, verified bool, ask *storagemarket.StorageAsk, size abi.PaddedPieceSize, datacap *big.Int) dealTerms {
+	unverified := func(reason string) dealTerms {
+		return dealTerms{Price: ask.Price, Reason: reason}
+	}
+
+	if !verified {
+		return unverified("verified deals are disabled")
+	}
+
+	if policy != verifiedPolicyPerMiner {
+		return dealTerms{Verified: true, Price: ask.VerifiedPrice, Reason: "verified deals are enabled"}
+	}
+
+	if datacap != nil && datacap.LessThan(big.NewIntUnsigned(uint64(size))) {
+		return unverified("not enough datacap left")
+	}
+
+	if ask.VerifiedPrice.GreaterThan(big.Zero()) {
+		return unverified(fmt.Sprintf("miner charges %s for verified deals", types.FIL(ask.VerifiedPrice)))
+	}
+
+	return dealTerms{Verified: true, Price: ask.VerifiedPrice, Reason: "miner takes verified deals for free"}
+}
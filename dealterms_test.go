@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChooseDealTerms(t *testing.T) {
+	assert := assert.New(t)
+
+	free := &storagemarket.StorageAsk{Price: abi.NewTokenAmount(100), VerifiedPrice: abi.NewTokenAmount(0)}
+	charges := &storagemarket.StorageAsk{Price: abi.NewTokenAmount(100), VerifiedPrice: abi.NewTokenAmount(10)}
+
+	plenty := big.NewInt(1 << 40)
+	little := big.NewInt(1 << 10)
+
+	// the fixed policy does what the verified setting says
+	dt := chooseDealTerms(verifiedPolicyFixed, true, charges, 1<<20, nil)
+	assert.True(dt.Verified)
+	assert.Equal(abi.NewTokenAmount(10), dt.Price)
+
+	dt = chooseDealTerms(verifiedPolicyPerMiner, false, free, 1<<20, &plenty)
+	assert.False(dt.Verified)
+	assert.Equal(abi.NewTokenAmount(100), dt.Price)
+
+	dt = chooseDealTerms(verifiedPolicyPerMiner, true, free, 1<<20, &plenty)
+	assert.True(dt.Verified)
+	assert.Equal(abi.NewTokenAmount(0), dt.Price)
+
+	// falls back to paid terms when the miner charges or datacap runs out
+	dt = chooseDealTerms(verifiedPolicyPerMiner, true, charges, 1<<20, &plenty)
+	assert.False(dt.Verified)
+	assert.Contains(dt.Reason, "charges")
+
+	dt = chooseDealTerms(verifiedPolicyPerMiner, true, free, 1<<20, &little)
+	assert.False(dt.Verified)
+	assert.Equal("not enough datacap left", dt.Reason)
+
+	assert.NoError(validVerifiedPolicy(""))
+	assert.Error(validVerifiedPolicy("sometimes"))
+}
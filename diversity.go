@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// how long the owner and network of a miner are trusted before they are
+// looked up on chain again
+const minerIdentityTTL = time.Hour
+
+// minerIdentity is what we know about who operates a miner. Miners that
+// share an owner, worker or network are likely run by the same entity.
+type minerIdentity struct {
+	Owner    address.Address
+	Worker   address.Address
+	Networks []string
+
+	fetched time.Time
+}
+
+// keys returns the groups the miner belongs to, two miners sharing any key
+// are not considered independent replicas
+func (mi *minerIdentity) keys() []string {
+	keys := []string{
+		"owner:" + mi.Owner.String(),
+		"worker:" + mi.Worker.String(),
+	}
+	for _, n := range mi.Networks {
+		keys = append(keys, "network:"+n)
+	}
+	return keys
+}
+
+func (cm *ContentManager) getMinerIdentity(ctx context.Context, m address.Address) (*minerIdentity, error) {
+	cm.minerIdentLk.Lock()
+	mi, ok := cm.minerIdent[m]
+	cm.minerIdentLk.Unlock()
+	if ok && time.Since(mi.fetched) < minerIdentityTTL {
+		return mi, nil
+	}
+
+	minfo, err := cm.Api.StateMinerInfo(ctx, m, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	mi = &minerIdentity{
+		Owner:   minfo.Owner,
+		Worker:  minfo.Worker,
+		fetched: time.Now(),
+	}
+
+	seen := make(map[string]bool)
+	for _, b := range minfo.Multiaddrs {
+		maddr, err := multiaddr.NewMultiaddrBytes(b)
+		if err != nil {
+			continue
+		}
+
+		n := networkForAddr(maddr)
+		if n != "" && !seen[n] {
+			seen[n] = true
+			mi.Networks = append(mi.Networks, n)
+		}
+	}
+
+	cm.minerIdentLk.Lock()
+	cm.minerIdent[m] = mi
+	cm.minerIdentLk.Unlock()
+
+	return mi, nil
+}
+
+// networkForAddr returns the network block a miner address is in, a /24 for
+// ipv4 and a /48 for ipv6. DNS names are used as they are.
+func networkForAddr(maddr multiaddr.Multiaddr) string {
+	if v, err := maddr.ValueForProtocol(multiaddr.P_IP4); err == nil {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return ""
+		}
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+
+	if v, err := maddr.ValueForProtocol(multiaddr.P_IP6); err == nil {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return ""
+		}
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+	}
+
+	for _, p := range []int{multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6} {
+		if v, err := maddr.ValueForProtocol(p); err == nil {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// minerDiversity tracks the groups taken by the miners chosen for one piece
+// of content so that the next miner can be checked against them
+type minerDiversity struct {
+	cm    *ContentManager
+	taken map[string]address.Address
+}
+
+func (cm *ContentManager) newMinerDiversity(ctx context.Context, existing []contentDeal) *minerDiversity {
+	md := &minerDiversity{
+		cm:    cm,
+		taken: make(map[string]address.Address),
+	}
+
+	for _, d := range existing {
+		maddr, err := d.MinerAddr()
+		if err != nil {
+			continue
+		}
+		md.add(ctx, maddr)
+	}
+
+	return md
+}
+
+// conflict returns an already chosen miner that shares a group with m. If we
+// can't look m up it is allowed, a chain hiccup shouldn't stop deal making.
+func (md *minerDiversity) conflict(ctx context.Context, m address.Address) (address.Address, string, bool) {
+	mi, err := md.cm.getMinerIdentity(ctx, m)
+	if err != nil {
+		log.Warnf("failed to get identity of miner %s: %s", m, err)
+		return address.Undef, "", false
+	}
+
+	for _, k := range mi.keys() {
+		if other, ok := md.taken[k]; ok && other != m {
+			return other, k, true
+		}
+	}
+	return address.Undef, "", false
+}
+
+func (md *minerDiversity) add(ctx context.Context, m address.Address) {
+	mi, err := md.cm.getMinerIdentity(ctx, m)
+	if err != nil {
+		log.Warnf("failed to get identity of miner %s: %s", m, err)
+		return
+	}
+
+	for _, k := range mi.keys() {
+		if _, ok := md.taken[k]; !ok {
+			md.taken[k] = m
+		}
+	}
+}
+
+type minerGroup struct {
+	Key    string            `json:"key"`
+	Miners []address.Address `json:"miners"`
+}
+
+// minerGroups lists every owner, worker and network shared by more than one
+// of our miners, these miners won't be picked together when the diversity
+// constraint is on
+func (cm *ContentManager) minerGroups(ctx context.Context) ([]*minerGroup, error) {
+	var miners []storageMiner
+	if err := cm.DB.Find(&miners).Error; err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]*minerGroup)
+	for _, m := range miners {
+		mi, err := cm.getMinerIdentity(ctx, m.Address.Addr)
+		if err != nil {
+			log.Warnf("failed to get identity of miner %s: %s", m.Address.Addr, err)
+			continue
+		}
+
+		for _, k := range mi.keys() {
+			g, ok := byKey[k]
+			if !ok {
+				g = &minerGroup{Key: k}
+				byKey[k] = g
+			}
+			g.Miners = append(g.Miners, m.Address.Addr)
+		}
+	}
+
+	out := make([]*minerGroup, 0)
+	for _, g := range byKey {
+		if len(g.Miners) > 1 {
+			out = append(out, g)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].Miners) != len(out[j].Miners) {
+			return len(out[i].Miners) > len(out[j].Miners)
+		}
+		return out[i].Key < out[j].Key
+	})
+
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkForAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	for addr, expected := range map[string]string{
+		"/ip4/10.1.2.3/tcp/24001":        "10.1.2.0/24",
+		"/ip6/2001:db8:1:2::5/tcp/24001": "2001:db8:1::/48",
+		"/dns4/sp.example.com/tcp/1234":  "sp.example.com",
+		"/p2p-circuit":                   "",
+	} {
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(expected, networkForAddr(maddr), addr)
+	}
+}
+
+func TestMinerDiversity(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	id := func(n uint64) address.Address {
+		a, err := address.NewIDAddress(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	cm := &ContentManager{minerIdent: make(map[address.Address]*minerIdentity)}
+	ident := func(m, owner, worker uint64, nets ...string) {
+		cm.minerIdent[id(m)] = &minerIdentity{Owner: id(owner), Worker: id(worker), Networks: nets, fetched: time.Now()}
+	}
+	ident(1000, 1, 2, "10.0.0.0/24")
+	ident(1001, 1, 3, "10.0.1.0/24")    // same owner as 1000
+	ident(1002, 4, 5, "10.0.0.0/24")    // same network as 1000
+	ident(1003, 6, 7, "192.168.0.0/24") // independent
+
+	md := cm.newMinerDiversity(ctx, nil)
+	md.add(ctx, id(1000))
+
+	other, group, ok := md.conflict(ctx, id(1001))
+	assert.True(ok)
+	assert.Equal(id(1000), other)
+	assert.Equal("owner:"+id(1).String(), group)
+
+	_, group, ok = md.conflict(ctx, id(1002))
+	assert.True(ok)
+	assert.Equal("network:10.0.0.0/24", group)
+
+	_, _, ok = md.conflict(ctx, id(1003))
+	assert.False(ok)
+
+	// a miner never conflicts with itself
+	_, _, ok = md.conflict(ctx, id(1000))
+	assert.False(ok)
+}
@@ -189,6 +189,8 @@ const OP_PinComplete = "PinComplete"
 type PinComplete struct {
 	DBID uint
 	Size int64
+	// empty if it couldn't be detected or the shuttle doesn't detect it
+	MimeType string
 
 	Objects []PinObj
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/application-research/estuary/util"
+	"gorm.io/gorm"
+)
+
+// formats the content graph can be dumped in
+const dumpFormatJSON = "json"
+
+// contents read from the database at a time while dumping
+const defaultDumpBatchSize = 1000
+
+type dumpedContent struct {
+	ID           uint          `json:"id"`
+	Cid          util.DbCID    `json:"cid"`
+	Name         string        `json:"name"`
+	UserID       uint          `json:"userId"`
+	Size         int64         `json:"size"`
+	Type         string        `json:"type"`
+	State        string        `json:"state"`
+	Replication  int           `json:"replication"`
+	Location     string        `json:"location"`
+	AggregatedIn uint          `json:"aggregatedIn,omitempty"`
+	SplitFrom    uint          `json:"splitFrom,omitempty"`
+	Deals        []*dumpedDeal `json:"deals"`
+}
+
+type dumpedDeal struct {
+	ID       uint   `json:"id"`
+	Miner    string `json:"miner"`
+	DealID   int64  `json:"dealId"`
+	Verified bool   `json:"verified"`
+	State    string `json:"state"`
+}
+
+func contentTypeName(t util.ContentType) string {
+	switch t {
+	case util.File:
+		return "file"
+	case util.Directory:
+		return "directory"
+	default:
+		return "unknown"
+	}
+}
+
+// contentState sums up a content's state flags, the first that applies wins
+func contentState(c Content) string {
+	switch {
+	case c.Failed:
+		return "failed"
+	case c.Pinning:
+		return "pinning"
+	case c.Offloaded:
+		return "offloaded"
+	case c.AggregatedIn > 0:
+		return "aggregated"
+	case c.Active:
+		return "active"
+	default:
+		return "inactive"
+	}
+}
+
+// dealState sums up where a deal is at, the first that applies wins
+func dealState(d contentDeal) string {
+	switch {
+	case d.Failed:
+		return "failed"
+	case d.Retired:
+		return "retired"
+	case !d.SealedAt.IsZero():
+		return "sealed"
+	case !d.OnChainAt.IsZero() || d.DealID > 0:
+		return "on-chain"
+	case !d.TransferFinished.IsZero():
+		return "transferred"
+	case !d.TransferStarted.IsZero():
+		return "transferring"
+	default:
+		return "proposed"
+	}
+}
+
+type contentDumpOptions struct {
+	// only contents with a higher id are dumped, to carry on from an
+	// earlier dump
+	After uint
+
+	// most contents to dump, zero for all of them
+	Limit int
+
+	BatchSize int
+}
+
+// dumpContentGraph writes every content after opts.After, in id order and
+// along with its deals, to w as a json array. Contents are read BatchSize at
+// a time and written out before the next batch is read, so the dump never
+// holds more than a batch in memory however big the database is. It returns
+// how many contents were written and the id of the last one, to pass as After
+// to carry on from there.
+func dumpContentGraph(db *gorm.DB, w io.Writer, opts contentDumpOptions) (int, uint, error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultDumpBatchSize
+	}
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return 0, 0, err
+	}
+
+	var n int
+	cursor := opts.After
+	for {
+		limit := batchSize
+		if opts.Limit > 0 {
+			if n >= opts.Limit {
+				break
+			}
+			if left := opts.Limit - n; left < limit {
+				limit = left
+			}
+		}
+
+		var contents []Content
+		if err := db.Order("id asc").Limit(limit).Find(&contents, "id > ?", cursor).Error; err != nil {
+			return n, cursor, err
+		}
+
+		if len(contents) == 0 {
+			break
+		}
+
+		ids := make([]uint, 0, len(contents))
+		for _, c := range contents {
+			ids = append(ids, c.ID)
+		}
+
+		var deals []contentDeal
+		if err := db.Order("id asc").Find(&deals, "content in ?", ids).Error; err != nil {
+			return n, cursor, err
+		}
+
+		byContent := make(map[uint][]*dumpedDeal, len(contents))
+		for _, d := range deals {
+			byContent[d.Content] = append(byContent[d.Content], &dumpedDeal{
+				ID:       d.ID,
+				Miner:    d.Miner,
+				DealID:   d.DealID,
+				Verified: d.Verified,
+				State:    dealState(d),
+			})
+		}
+
+		for _, c := range contents {
+			dc := &dumpedContent{
+				ID:           c.ID,
+				Cid:          c.Cid,
+				Name:         c.Name,
+				UserID:       c.UserID,
+				Size:         c.Size,
+				Type:         contentTypeName(c.Type),
+				State:        contentState(c),
+				Replication:  c.Replication,
+				Location:     c.Location,
+				AggregatedIn: c.AggregatedIn,
+				SplitFrom:    c.SplitFrom,
+				Deals:        byContent[c.ID],
+			}
+			if dc.Deals == nil {
+				dc.Deals = []*dumpedDeal{}
+			}
+
+			b, err := json.Marshal(dc)
+			if err != nil {
+				return n, cursor, err
+			}
+
+			sep := ",\n"
+			if n == 0 {
+				sep = "\n"
+			}
+
+			if _, err := fmt.Fprintf(w, "%s%s", sep, b); err != nil {
+				return n, cursor, err
+			}
+
+			n++
+			cursor = c.ID
+		}
+
+		if len(contents) < limit {
+			break
+		}
+	}
+
+	if _, err := io.WriteString(w, "\n]\n"); err != nil {
+		return n, cursor, err
+	}
+	return n, cursor, nil
+}
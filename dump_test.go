@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpContentGraph(t *testing.T) {
+	db := newTestDB(t, &Content{}, &contentDeal{})
+
+	for i, o := range makeTestObjects(t, 5) {
+		require.NoError(t, db.Create(&Content{
+			Cid:         o.Cid,
+			Name:        "file",
+			Size:        int64((i + 1) * 100),
+			Type:        util.File,
+			Active:      true,
+			Replication: 6,
+			Location:    "local",
+		}).Error)
+	}
+	require.NoError(t, db.Model(Content{}).Where("id = ?", 4).UpdateColumn("failed", true).Error)
+
+	require.NoError(t, db.Create(&contentDeal{Content: 2, Miner: "f01000", DealID: 12, SealedAt: time.Now()}).Error)
+	require.NoError(t, db.Create(&contentDeal{Content: 2, Miner: "f01001", Failed: true}).Error)
+	require.NoError(t, db.Create(&contentDeal{Content: 5, Miner: "f01000"}).Error)
+
+	dump := func(opts contentDumpOptions) ([]dumpedContent, int, uint) {
+		var buf bytes.Buffer
+		n, last, err := dumpContentGraph(db, &buf, opts)
+		require.NoError(t, err)
+
+		var out []dumpedContent
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &out), buf.String())
+		require.Len(t, out, n)
+		return out, n, last
+	}
+
+	// batches smaller than the database still dump all of it
+	all, n, last := dump(contentDumpOptions{BatchSize: 2})
+	require.Equal(t, 5, n)
+	require.Equal(t, uint(5), last)
+	for i, c := range all {
+		require.Equal(t, uint(i+1), c.ID)
+		require.True(t, c.Cid.CID.Defined())
+		require.Equal(t, "file", c.Type)
+		require.NotNil(t, c.Deals)
+	}
+
+	require.Equal(t, "active", all[0].State)
+	require.Equal(t, "failed", all[3].State)
+
+	require.Len(t, all[1].Deals, 2)
+	require.Equal(t, dumpedDeal{ID: 1, Miner: "f01000", DealID: 12, State: "sealed"}, *all[1].Deals[0])
+	require.Equal(t, "failed", all[1].Deals[1].State)
+	require.Equal(t, "proposed", all[4].Deals[0].State)
+
+	// pages carry on from each other
+	page, n, last := dump(contentDumpOptions{Limit: 2, BatchSize: 1})
+	require.Equal(t, 2, n)
+	require.Equal(t, uint(2), last)
+	require.Equal(t, uint(1), page[0].ID)
+
+	page, n, last = dump(contentDumpOptions{After: last, Limit: 2})
+	require.Equal(t, 2, n)
+	require.Equal(t, uint(4), last)
+	require.Equal(t, uint(3), page[0].ID)
+
+	page, _, _ = dump(contentDumpOptions{After: last, Limit: 2})
+	require.Len(t, page, 1)
+
+	empty, n, _ := dump(contentDumpOptions{After: 5})
+	require.Zero(t, n)
+	require.Empty(t, empty)
+}
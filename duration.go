@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/actors/policy"
+)
+
+// dealDurationForMiner returns the duration to propose to m for a piece of
+// the given size. The chain's limits always apply, on top of them a miner
+// can have a narrower range set through its info. If dealDuration doesn't
+// fit we either move it into range or, when adjusting is off, return an
+// error so the miner is skipped before a proposal it would reject is sent.
+func (cm *ContentManager) dealDurationForMiner(m address.Address, size abi.PaddedPieceSize) (abi.ChainEpoch, error) {
+	minDur, maxDur := policy.DealDurationBounds(size)
+
+	var sm storageMiner
+	if err := cm.DB.Find(&sm, "address = ?", m.String()).Error; err != nil {
+		return 0, err
+	}
+
+	if sm.MinDealDuration > 0 && abi.ChainEpoch(sm.MinDealDuration) > minDur {
+		minDur = abi.ChainEpoch(sm.MinDealDuration)
+	}
+	if sm.MaxDealDuration > 0 && abi.ChainEpoch(sm.MaxDealDuration) < maxDur {
+		maxDur = abi.ChainEpoch(sm.MaxDealDuration)
+	}
+
+	return fitDealDuration(dealDuration, minDur, maxDur, cm.adjustDealDuration)
+}
+
+func fitDealDuration(dur, minDur, maxDur abi.ChainEpoch, adjust bool) (abi.ChainEpoch, error) {
+	if minDur > maxDur {
+		return 0, fmt.Errorf("accepted deal duration range is empty (min %d > max %d)", minDur, maxDur)
+	}
+
+	switch {
+	case dur < minDur:
+		if !adjust {
+			return 0, fmt.Errorf("deal duration %d is below the minimum of %d", dur, minDur)
+		}
+		return minDur, nil
+	case dur > maxDur:
+		if !adjust {
+			return 0, fmt.Errorf("deal duration %d is above the maximum of %d", dur, maxDur)
+		}
+		return maxDur, nil
+	default:
+		return dur, nil
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFitDealDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	dur, err := fitDealDuration(1000, 500, 2000, false)
+	assert.NoError(err)
+	assert.Equal(abi.ChainEpoch(1000), dur)
+
+	_, err = fitDealDuration(1000, 1500, 2000, false)
+	assert.Error(err)
+
+	dur, err = fitDealDuration(1000, 1500, 2000, true)
+	assert.NoError(err)
+	assert.Equal(abi.ChainEpoch(1500), dur)
+
+	_, err = fitDealDuration(3000, 1500, 2000, false)
+	assert.Error(err)
+
+	dur, err = fitDealDuration(3000, 1500, 2000, true)
+	assert.NoError(err)
+	assert.Equal(abi.ChainEpoch(2000), dur)
+
+	// nothing to adjust into when the miner's range misses the chain's
+	_, err = fitDealDuration(1000, 2500, 2000, true)
+	assert.Error(err)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const contentReaperInterval = time.Minute * 10
+
+// What happens to content once it passes its ExpiresAt. Expired content never
+// gets new deals, whichever action is configured.
+const (
+	expiryActionStopDeals = "stop-deals"
+	expiryActionOffload   = "offload"
+	expiryActionDelete    = "delete"
+)
+
+func validExpiryAction(action string) error {
+	switch action {
+	case expiryActionStopDeals, expiryActionOffload, expiryActionDelete:
+		return nil
+	default:
+		return fmt.Errorf("unknown content expiry action %q", action)
+	}
+}
+
+func (c *Content) Expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+// runContentReaper periodically applies the configured expiry action to
+// content that has passed its expiry time
+func (cm *ContentManager) runContentReaper(ctx context.Context) {
+	ticker := time.NewTicker(contentReaperInterval)
+	defer ticker.Stop()
+
+	// with stop-deals there is nothing to change in the database, so only
+	// report content that expired since the previous pass
+	var lastPass time.Time
+	for {
+		now := time.Now()
+		if err := cm.reapExpiredContent(ctx, lastPass, now); err != nil {
+			log.Errorf("failed to reap expired content: %s", err)
+		} else {
+			lastPass = now
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cm *ContentManager) reapExpiredContent(ctx context.Context, since, now time.Time) error {
+	q := cm.DB.Where("expires_at IS NOT NULL AND expires_at <= ?", now)
+	switch cm.expiryAction {
+	case expiryActionStopDeals:
+		q = q.Where("expires_at > ?", since)
+	case expiryActionOffload:
+		q = q.Where("active AND NOT offloaded")
+	}
+
+	var expired []Content
+	if err := q.Find(&expired).Error; err != nil {
+		return err
+	}
+
+	for _, c := range expired {
+		switch cm.expiryAction {
+		case expiryActionStopDeals:
+			log.Infow("content expired, no longer making deals for it", "content", c.ID, "expiredAt", c.ExpiresAt)
+		case expiryActionOffload:
+			if c.AggregatedIn > 0 {
+				// its blocks belong to the aggregate, they go when it does
+				continue
+			}
+
+			log.Infow("content expired, offloading", "content", c.ID, "expiredAt", c.ExpiresAt, "location", c.Location)
+			if _, err := cm.OffloadContents(ctx, []uint{c.ID}); err != nil {
+				log.Errorf("failed to offload expired content %d: %s", c.ID, err)
+			}
+		case expiryActionDelete:
+			log.Infow("content expired, deleting", "content", c.ID, "expiredAt", c.ExpiresAt, "location", c.Location)
+			if c.AggregatedIn == 0 && !c.Offloaded {
+				if _, err := cm.OffloadContents(ctx, []uint{c.ID}); err != nil {
+					log.Errorf("failed to remove blocks of expired content %d: %s", c.ID, err)
+					continue
+				}
+			}
+
+			if err := cm.unpinContent(ctx, c.ID); err != nil {
+				log.Errorf("failed to delete expired content %d: %s", c.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
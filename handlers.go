@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/hex"
 	"encoding/json"
@@ -50,6 +49,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/multiformats/go-multiaddr"
 	promhttp "github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/websocket"
@@ -96,6 +96,7 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	}
 
 	e.Use(s.tracingMiddleware)
+	e.Use(s.rejectWhenShuttingDown)
 	e.HTTPErrorHandler = func(err error, ctx echo.Context) {
 		var herr *util.HttpError
 		if xerrors.As(err, &herr) {
@@ -177,6 +178,7 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	uploads.POST("/add", withUser(s.handleAdd))
 	uploads.POST("/add-ipfs", withUser(s.handleAddIpfs))
 	uploads.POST("/add-car", withUser(s.handleAddCar))
+	uploads.POST("/add-tar", withUser(s.handleAddTar))
 	uploads.POST("/create", withUser(s.handleCreateContent))
 
 	content := contmeta.Group("", s.AuthRequired(util.PermLevelUser))
@@ -187,10 +189,18 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	content.GET("/list", withUser(s.handleListContent))
 	content.GET("/deals", withUser(s.handleListContentWithDeals))
 	content.GET("/failures/:content", withUser(s.handleGetContentFailures))
+	content.GET("/replication-plan/:content", withUser(s.handleGetReplicationPlan))
 	content.GET("/bw-usage/:content", withUser(s.handleGetContentBandwidth))
 	content.GET("/staging-zones", withUser(s.handleGetStagingZoneForUser))
 	content.GET("/aggregated/:content", withUser(s.handleGetAggregatedForContent))
 	content.GET("/all-deals", withUser(s.handleGetAllDealsForUser))
+	content.POST("/promote/:id", withUser(s.handlePromoteContent))
+	content.POST("/deadline/:id", withUser(s.handleSetDealDeadline))
+	content.GET("/deadline/:id", withUser(s.handleGetDealDeadline))
+	content.GET("/shared", withUser(s.handleListSharedContent))
+	content.GET("/resolve", s.handleResolveName)
+	content.GET("/access/:id", withUser(s.handleGetContentAccess))
+	content.PUT("/access/:id", withUser(s.handleSetContentAccess))
 
 	// TODO: the commented out routes here are still fairly useful, but maybe
 	// need to have some sort of 'super user' permission level in order to use
@@ -199,6 +209,7 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	deals.Use(s.AuthRequired(util.PermLevelUser))
 	deals.GET("/status/:deal", withUser(s.handleGetDealStatus))
 	deals.GET("/status-by-proposal/:propcid", withUser(s.handleGetDealStatusByPropCid))
+	deals.GET("/proposals", withUser(s.handleListDealProposals))
 	deals.GET("/query/:miner", s.handleQueryAsk)
 	deals.POST("/make/:miner", withUser(s.handleMakeDeal))
 	//deals.POST("/transfer/start/:miner/:propcid/:datacid", s.handleTransferStart)
@@ -208,6 +219,8 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	deals.GET("/status/:miner/:propcid", s.handleDealStatus)
 	deals.POST("/estimate", s.handleEstimateDealCost)
 	deals.GET("/proposal/:propcid", s.handleGetProposal)
+	deals.GET("/transfer/log/:propcid", withUser(s.handleGetTransferLog))
+	deals.GET("/piece/:propcid", withUser(s.handleExportPiece))
 	deals.GET("/info/:dealid", s.handleGetDealInfo)
 	deals.GET("/failures", s.handleStorageFailures)
 
@@ -240,7 +253,7 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	public.GET("/by-cid/:cid", s.handleGetContentByCid)
 	public.GET("/deals/failures", s.handleStorageFailures)
 	public.GET("/info", s.handleGetPublicNodeInfo)
-	public.GET("/miners", s.handlePublicGetMinerStats)
+	public.GET("/providers/:cid", s.handleFindProviders)
 
 	metrics := public.Group("/metrics")
 	metrics.GET("/deals-on-chain", s.handleMetricsDealOnChain)
@@ -253,8 +266,14 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	miners.GET("", s.handleAdminGetMiners)
 	miners.GET("/failures/:miner", s.handleGetMinerFailures)
 	miners.GET("/deals/:miner", s.handleGetMinerDeals)
+	miners.GET("/stats", s.handlePublicGetMinerStats)
 	miners.GET("/stats/:miner", s.handleGetMinerStats)
+	miners.GET("/seal-estimate/:miner", s.handleGetMinerSealEstimate)
+	miners.GET("/pipeline/:miner", s.handleGetMinerPipeline)
 	miners.GET("/storage/query/:miner", s.handleQueryAsk)
+	// probing a miner dials it, so this one needs an account
+	miners.GET("/retrieval/protocols/:miner", s.handleGetMinerRetrievalProtocols, s.AuthRequired(util.PermLevelUser))
+	miners.GET("/compare", s.handleCompareMiners)
 
 	admin := e.Group("/admin")
 	admin.Use(s.AuthRequired(util.PermLevelAdmin))
@@ -262,6 +281,7 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	admin.POST("/add-escrow/:amt", s.handleAdminAddEscrow)
 	admin.GET("/dealstats", s.handleDealStats)
 	admin.GET("/disk-info", s.handleDiskSpaceCheck)
+	admin.GET("/fs-stats", s.handleGetFsStats)
 	admin.GET("/stats", s.handleAdminStats)
 
 	// miners
@@ -272,7 +292,14 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	admin.PUT("/miners/set-info/:miner", withUser(s.handleMinersSetInfo))
 	admin.GET("/miners", s.handleAdminGetMiners)
 	admin.GET("/miners/stats", s.handleAdminGetMinerStats)
+	admin.POST("/miners/recompute", s.handleAdminRecomputeMiners)
+	admin.GET("/miners/cache", s.handleAdminGetMinerCache)
+	admin.GET("/miners/reputation", s.handleAdminExportMinerReputation)
+	admin.POST("/miners/reputation", s.handleAdminImportMinerReputation)
+	admin.GET("/miners/groups", s.handleAdminGetMinerGroups)
 	admin.GET("/miners/transfers/:miner", s.handleMinerTransferDiagnostics)
+	admin.POST("/miners/rebalance/:miner", s.handleAdminRebalanceMiner)
+	admin.GET("/miners/rebalance/:miner", s.handleAdminGetRebalance)
 
 	admin.GET("/cm/progress", s.handleAdminGetProgress)
 	admin.GET("/cm/all-deals", s.handleDebugGetAllDeals)
@@ -282,13 +309,27 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	admin.POST("/cm/offload/:content", s.handleOffloadContent)
 	admin.POST("/cm/offload/collect", s.handleRunOffloadingCollection)
 	admin.GET("/cm/refresh/:content", s.handleRefreshContent)
+	admin.POST("/cm/refresh/:content", s.handleRefreshContent)
+	admin.GET("/cm/retrieval-progress/:content", s.handleGetRetrievalProgress)
+	admin.POST("/cm/repair/:content", s.handleRepairContent)
 	admin.POST("/cm/gc", s.handleRunGc)
 	admin.POST("/cm/move", s.handleMoveContent)
 	admin.GET("/cm/buckets", s.handleGetBucketDiag)
+	admin.GET("/cm/transfer-slots", s.handleGetTransferSlots)
+	admin.GET("/cm/deal-queue", s.handleGetDealQueue)
+	admin.GET("/cm/under-replicated", s.handleGetUnderReplicated)
+	admin.GET("/cm/slashed-deals", s.handleGetSlashedDeals)
 	admin.GET("/cm/health/:id", s.handleContentHealthCheck)
+	admin.GET("/cm/selection-audit/:content", s.handleGetSelectionAudit)
+	admin.POST("/cm/test-replicas/:content", s.handleTestReplicas)
 	admin.GET("/cm/health-by-cid/:cid", s.handleContentHealthCheckByCid)
 	admin.POST("/cm/dealmaking", s.handleSetDealMaking)
+	admin.GET("/cm/dealmaking/pause", s.handleGetDealPause)
+	admin.POST("/cm/dealmaking/pause", s.handlePauseDealMaking)
+	admin.POST("/cm/dealmaking/resume", s.handleResumeDealMaking)
 	admin.POST("/cm/break-aggregate/:content", s.handleAdminBreakAggregate)
+	admin.GET("/cm/aggregate-faults", s.handleAdminGetAggregateFaults)
+	admin.GET("/cm/aggregation-status", s.handleAdminGetAggregationStatus)
 	admin.POST("/cm/transfer/restart/:chanid", s.handleTransferRestart)
 	admin.POST("/cm/repinall/:shuttle", s.handleShuttleRepinAll)
 
@@ -306,6 +347,8 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 
 	users := admin.Group("/users")
 	users.GET("", s.handleAdminGetUsers)
+	users.GET("/quota/:user", s.handleAdminGetUserQuota)
+	users.PUT("/quota/:user", s.handleAdminSetUserQuota)
 
 	shuttle := admin.Group("/shuttle")
 	shuttle.POST("/init", s.handleShuttleInit)
@@ -323,6 +366,11 @@ func (s *Server) ServeAPI(srv string, logging bool, lsteptok string, cachedir st
 	if os.Getenv("ENABLE_SWAGGER_ENDPOINT") == "true" {
 		e.GET("/swagger/*", echoSwagger.WrapHandler)
 	}
+
+	s.echoLk.Lock()
+	s.echo = e
+	s.echoLk.Unlock()
+
 	return e.Start(srv)
 }
 
@@ -472,6 +520,10 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 		}
 	}
 
+	if err := checkUserQuota(s.DB, u.ID, 0); err != nil {
+		return err
+	}
+
 	var params util.ContentAddIpfsBody
 	if err := c.Bind(&params); err != nil {
 		return err
@@ -557,6 +609,8 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 // @Param 		 filename query string false "Filename"
 // @Param 		 commp query string false "Commp"
 // @Param 		 size query string false "Size"
+// @Param 		 root query string false "Root cid to use when the car file declares several"
+// @Param 		 priority query string false "Deal making priority: low, normal, high or urgent, urgent is for admins only"
 // @Router       /content/add-car [post]
 func (s *Server) handleAddCar(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
@@ -568,6 +622,28 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 		}
 	}
 
+	if s.CM.blockstoreFull(ctx) {
+		return &util.HttpError{
+			Code:    http.StatusInsufficientStorage,
+			Message: util.ERR_BLOCKSTORE_FULL,
+		}
+	}
+
+	// the request body is the best guess we have for the size of the upload,
+	// it's -1 when unknown
+	uploadSize := c.Request().ContentLength
+	if uploadSize < 0 {
+		uploadSize = 0
+	}
+
+	if err := checkUserQuota(s.DB, u.ID, uploadSize); err != nil {
+		return err
+	}
+
+	if err := s.CM.freeSpace.CheckImport(uploadSize); err != nil {
+		return err
+	}
+
 	bsid, sbs, err := s.StagingMgr.AllocNew()
 	if err != nil {
 		return err
@@ -584,14 +660,25 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 	defer c.Request().Body.Close()
 	header, err := s.loadCar(ctx, sbs, c.Request().Body)
 	if err != nil {
+		var mismatch *util.CarBlockMismatchError
+		if xerrors.As(err, &mismatch) {
+			return &util.HttpError{
+				Code:    400,
+				Message: util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
 		return err
 	}
 
-	if len(header.Roots) != 1 {
-		// if someone wants this feature, let me know
-		return c.JSON(400, map[string]string{"error": "cannot handle uploading car files with multiple roots"})
+	rootCID, err := util.CarRoot(header, c.QueryParam("root"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    400,
+			Message: util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
 	}
-	rootCID := header.Roots[0]
 
 	if c.QueryParam("ignore-dupes") == "true" {
 		isDup, err := s.isDupCIDContent(c, rootCID, u)
@@ -641,10 +728,15 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 		commpcid = cc
 	}
 
+	priority, err := priorityParam(c.QueryParam("priority"), u)
+	if err != nil {
+		return err
+	}
+
 	bserv := blockservice.New(sbs, nil)
 	dserv := merkledag.NewDAGService(bserv)
 
-	cont, err := s.CM.addDatabaseTracking(ctx, u, dserv, s.Node.Blockstore, rootCID, filename, s.CM.Replication)
+	cont, err := s.CM.addDatabaseTracking(ctx, u, dserv, s.Node.Blockstore, rootCID, filename, s.CM.Replication, priority, "")
 	if err != nil {
 		return err
 	}
@@ -654,7 +746,7 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 	}
 
 	if commpcid.Defined() {
-		carSize, err := s.CM.calculateCarSize(ctx, header.Roots[0])
+		carSize, err := s.CM.calculateCarSize(ctx, rootCID)
 		if err != nil {
 			return fmt.Errorf("failed to calculate CAR size: %w", err)
 		}
@@ -689,7 +781,126 @@ func (s *Server) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Rea
 	_, span := s.tracer.Start(ctx, "loadCar")
 	defer span.End()
 
-	return car.LoadCar(ctx, bs, r)
+	return util.LoadVerifiedCarWithLimits(ctx, bs, r, s.CM.importLimits)
+}
+
+// handleAddTar godoc
+// @Summary      Add a tar archive as a directory
+// @Description  This endpoint is used to upload a tar archive, optionally gzipped, as a unixfs directory with the archive's paths as its structure. The archive is imported as it is uploaded, without being held in full.
+// @Tags         content
+// @Produce      json
+// @Param        body body string true "Tar archive"
+// @Param        filename query string false "Filename"
+// @Param        priority query string false "Deal making priority: low, normal, high or urgent, urgent is for admins only"
+// @Router       /content/add-tar [post]
+func (s *Server) handleAddTar(c echo.Context, u *User) error {
+	ctx, span := s.tracer.Start(c.Request().Context(), "handleAddTar", trace.WithAttributes(attribute.Int("user", int(u.ID))))
+	defer span.End()
+
+	if s.CM.contentAddingDisabled || u.StorageDisabled || s.CM.localContentAddingDisabled {
+		return &util.HttpError{
+			Code:    400,
+			Message: util.ERR_CONTENT_ADDING_DISABLED,
+		}
+	}
+
+	if s.CM.blockstoreFull(ctx) {
+		return &util.HttpError{
+			Code:    http.StatusInsufficientStorage,
+			Message: util.ERR_BLOCKSTORE_FULL,
+		}
+	}
+
+	// the request body is the best guess we have for the size of the upload,
+	// it's -1 when unknown
+	uploadSize := c.Request().ContentLength
+	if uploadSize < 0 {
+		uploadSize = 0
+	}
+
+	if err := checkUserQuota(s.DB, u.ID, uploadSize); err != nil {
+		return err
+	}
+
+	if err := s.CM.freeSpace.CheckImport(uploadSize); err != nil {
+		return err
+	}
+
+	priority, err := priorityParam(c.QueryParam("priority"), u)
+	if err != nil {
+		return err
+	}
+
+	bsid, bs, err := s.StagingMgr.AllocNew()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		go func() {
+			if err := s.StagingMgr.CleanUp(bsid); err != nil {
+				log.Errorf("failed to clean up staging blockstore: %s", err)
+			}
+		}()
+	}()
+
+	bserv := blockservice.New(bs, nil)
+	dserv := merkledag.NewDAGService(bserv)
+
+	// a compressed archive can hold far more than was uploaded, check again
+	// against what its files add up to
+	defer c.Request().Body.Close()
+	nd, err := util.ImportTarUpload(ctx, dserv, c.Request().Body, s.CM.importLimits, func(size int64) error {
+		if err := checkUserQuota(s.DB, u.ID, size); err != nil {
+			return err
+		}
+		return s.CM.freeSpace.CheckImport(size)
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.QueryParam("ignore-dupes") == "true" {
+		isDup, err := s.isDupCIDContent(c, nd.Cid(), u)
+		if err != nil || isDup {
+			return err
+		}
+	}
+
+	fname := nd.Cid().String()
+	if qpname := c.QueryParam("filename"); qpname != "" {
+		fname = qpname
+	}
+
+	content, err := s.CM.addDatabaseTracking(ctx, u, dserv, bs, nd.Cid(), fname, s.CM.Replication, priority, "")
+	if err != nil {
+		return xerrors.Errorf("encountered problem computing object references: %w", err)
+	}
+
+	if err := s.DB.Model(Content{}).Where("id = ?", content.ID).UpdateColumn("type", util.Directory).Error; err != nil {
+		return err
+	}
+	content.Type = util.Directory
+
+	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
+		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
+	}
+
+	go func() {
+		s.CM.ToCheck <- content.ID
+	}()
+
+	go func() {
+		if err := s.Node.Provider.Provide(nd.Cid()); err != nil {
+			log.Warnf("failed to announce providers: %s", err)
+		}
+	}()
+
+	return c.JSON(200, &util.ContentAddResponse{
+		Cid:       nd.Cid().String(),
+		EstuaryId: content.ID,
+		Providers: s.CM.pinDelegatesForContent(*content),
+	})
 }
 
 // handleAdd godoc
@@ -699,6 +910,7 @@ func (s *Server) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Rea
 // @Produce      json
 // @Accept       multipart/form-data
 // @Param        file formData file true "File to upload"
+// @Param        priority formData string false "Deal making priority: low, normal, high or urgent, urgent is for admins only"
 // @Router       /content/add [post]
 func (s *Server) handleAdd(c echo.Context, u *User) error {
 	ctx, span := s.tracer.Start(c.Request().Context(), "handleAdd", trace.WithAttributes(attribute.Int("user", int(u.ID))))
@@ -720,6 +932,28 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		}
 	}
 
+	if s.CM.blockstoreFull(ctx) {
+		return &util.HttpError{
+			Code:    http.StatusInsufficientStorage,
+			Message: util.ERR_BLOCKSTORE_FULL,
+		}
+	}
+
+	// the request body is the best guess we have for the size of the upload,
+	// it's -1 when unknown
+	uploadSize := c.Request().ContentLength
+	if uploadSize < 0 {
+		uploadSize = 0
+	}
+
+	if err := checkUserQuota(s.DB, u.ID, uploadSize); err != nil {
+		return err
+	}
+
+	if err := s.CM.freeSpace.CheckImport(uploadSize); err != nil {
+		return err
+	}
+
 	form, err := c.MultipartForm()
 	if err != nil {
 		return err
@@ -755,6 +989,11 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		}
 	}
 
+	priority, err := priorityParam(c.FormValue("priority"), u)
+	if err != nil {
+		return err
+	}
+
 	collection := c.FormValue("collection")
 	var col *Collection
 	if collection != "" {
@@ -792,7 +1031,8 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 	bserv := blockservice.New(bs, nil)
 	dserv := merkledag.NewDAGService(bserv)
 
-	nd, err := s.importFile(ctx, dserv, fi)
+	ck := util.NewChecksummer(fi)
+	nd, err := s.importFile(ctx, dserv, ck)
 	if err != nil {
 		return err
 	}
@@ -804,7 +1044,7 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		}
 	}
 
-	content, err := s.CM.addDatabaseTracking(ctx, u, dserv, bs, nd.Cid(), fname, replication)
+	content, err := s.CM.addDatabaseTracking(ctx, u, dserv, bs, nd.Cid(), fname, replication, priority, ck.Sum())
 	if err != nil {
 		return xerrors.Errorf("encountered problem computing object references: %w", err)
 	}
@@ -829,12 +1069,7 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 	}()
 
 	if c.QueryParam("lazy-provide") != "true" {
-		subctx, cancel := context.WithTimeout(ctx, time.Second*10)
-		defer cancel()
-		if err := s.Node.FullRT.Provide(subctx, nd.Cid(), true); err != nil {
-			span.RecordError(fmt.Errorf("provide error: %w", err))
-			log.Errorf("fullrt provide call errored: %s", err)
-		}
+		s.Node.ProvideQueue.Add(nd.Cid())
 	}
 
 	go func() {
@@ -854,7 +1089,7 @@ func (s *Server) importFile(ctx context.Context, dserv ipld.DAGService, fi io.Re
 	_, span := s.tracer.Start(ctx, "importFile")
 	defer span.End()
 
-	return util.ImportFile(dserv, fi)
+	return util.ImportFileWithLimits(ctx, dserv, fi, s.CM.importLimits)
 }
 
 var noDataTimeout = time.Minute * 10
@@ -904,17 +1139,18 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 		cm.inflightCidsLk.Unlock()
 	}()
 
-	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-		// cset.Visit gets called first, so if we reach here we should immediately track the CID
+	err := util.WalkDag(ctx, dserv, root, func(c cid.Cid) bool {
+		if !cset.Visit(c) {
+			return false
+		}
+
+		// the deferred cleanup above goes over everything in cset, so track
+		// the CID as soon as it's visited
 		cm.inflightCidsLk.Lock()
 		cm.inflightCids[c]++
 		cm.inflightCidsLk.Unlock()
-
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, err
-		}
-
+		return true
+	}, cm.dagWalkConcurrency, func(node ipld.Node) error {
 		cb(int64(len(node.RawData())))
 
 		select {
@@ -924,22 +1160,22 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 
 		objlk.Lock()
 		objects = append(objects, &Object{
-			Cid:  util.DbCID{c},
+			Cid:  util.DbCID{node.Cid()},
 			Size: len(node.RawData()),
 		})
 		objlk.Unlock()
-
-		if c.Type() == cid.Raw {
-			return nil, nil
-		}
-
-		return node.Links(), nil
-	}, root, cset.Visit, merkledag.Concurrent())
+		return nil
+	})
 
 	if err != nil {
 		return err
 	}
 
+	// blocks come in whatever order they were fetched in
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Cid.CID.KeyString() < objects[j].Cid.CID.KeyString()
+	})
+
 	if err = cm.addObjectsToDatabase(ctx, cont, dserv, root, objects, "local"); err != nil {
 		return err
 	}
@@ -947,7 +1183,7 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 	return nil
 }
 
-func (cm *ContentManager) addDatabaseTracking(ctx context.Context, u *User, dserv ipld.NodeGetter, bs blockstore.Blockstore, root cid.Cid, fname string, replication int) (*Content, error) {
+func (cm *ContentManager) addDatabaseTracking(ctx context.Context, u *User, dserv ipld.NodeGetter, bs blockstore.Blockstore, root cid.Cid, fname string, replication, priority int, checksum string) (*Content, error) {
 	ctx, span := cm.tracer.Start(ctx, "computeObjRefs")
 	defer span.End()
 
@@ -959,6 +1195,9 @@ func (cm *ContentManager) addDatabaseTracking(ctx context.Context, u *User, dser
 		UserID:      u.ID,
 		Replication: replication,
 		Location:    "local",
+		Priority:    priority,
+		Checksum:    checksum,
+		Access:      util.ContentAccessOwner,
 	}
 
 	if err := cm.DB.Create(content).Error; err != nil {
@@ -1110,12 +1349,18 @@ type onChainDealState struct {
 	SectorStartEpoch abi.ChainEpoch `json:"sectorStartEpoch"`
 	LastUpdatedEpoch abi.ChainEpoch `json:"lastUpdatedEpoch"`
 	SlashEpoch       abi.ChainEpoch `json:"slashEpoch"`
+
+	// the deal's label as read from chain, nil if it isn't in a scheme we
+	// know. Its content is set for labels that record it.
+	Label *util.DealLabel `json:"label,omitempty"`
 }
 
 type dealStatus struct {
 	Deal           contentDeal             `json:"deal"`
 	TransferStatus *filclient.ChannelState `json:"transfer"`
 	OnChainState   *onChainDealState       `json:"onChainState"`
+	// set while the data has been transferred but the deal isn't active yet
+	SealEstimate *sealEstimate `json:"sealEstimate,omitempty"`
 }
 
 // handleContentStatus godoc
@@ -1137,15 +1382,26 @@ func (s *Server) handleContentStatus(c echo.Context, u *User) error {
 		return err
 	}
 
-	if content.UserID != u.ID {
+	ok, err := canAccessContent(s.DB, u, content)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
 		return &util.HttpError{
 			Code:    403,
 			Message: util.ERR_NOT_AUTHORIZED,
 		}
 	}
 
+	// aggregated content is stored by the deals of its aggregate
+	dealCont, err := dealsContent(s.DB, content)
+	if err != nil {
+		return err
+	}
+
 	var deals []contentDeal
-	if err := s.DB.Find(&deals, "content = ?", content.ID).Error; err != nil {
+	if err := s.DB.Find(&deals, "content = ?", dealCont.ID).Error; err != nil {
 		return err
 	}
 
@@ -1160,7 +1416,7 @@ func (s *Server) handleContentStatus(c echo.Context, u *User) error {
 				Deal: d,
 			}
 
-			chanst, err := s.CM.GetTransferStatus(ctx, &d, &content)
+			chanst, err := s.CM.GetTransferStatus(ctx, &d, &dealCont)
 			if err != nil {
 				log.Errorf("failed to get transfer status: %s", err)
 			}
@@ -1195,11 +1451,32 @@ func (s *Server) handleContentStatus(c echo.Context, u *User) error {
 		return err
 	}
 
-	return c.JSON(200, map[string]interface{}{
+	var sealed bool
+	for _, d := range ds {
+		if !d.Deal.Failed && dealIsSealed(d) {
+			sealed = true
+			break
+		}
+	}
+
+	resp := map[string]interface{}{
 		"content":       content,
 		"deals":         ds,
 		"failuresCount": failCount,
-	})
+		// for aggregated content, only once its aggregate has a deal sealed
+		"sealed": sealed,
+	}
+
+	if dealCont.Aggregate {
+		var members int64
+		if err := s.DB.Model(Content{}).Where("aggregated_in = ?", dealCont.ID).Count(&members).Error; err != nil {
+			return err
+		}
+
+		resp["aggregate"] = summarizeAggregateDeals(dealCont, members, ds)
+	}
+
+	return c.JSON(200, resp)
 }
 
 // handleGetDealStatus godoc
@@ -1231,10 +1508,16 @@ func (s *Server) handleGetDealStatus(c echo.Context, u *User) error {
 // @Tags         deals
 // @Produce      json
 // @Param 		propcid path string true "PropCid"
+// @Param        wait query string false "Wait up to this long (e.g. 30s) for the next transfer event before responding"
 // @Router       /deal/status-by-proposal/{propcid} [get]
 func (s *Server) handleGetDealStatusByPropCid(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
 
+	wait, err := statusWait(c)
+	if err != nil {
+		return err
+	}
+
 	propcid, err := cid.Decode(c.Param("propcid"))
 	if err != nil {
 		return err
@@ -1245,6 +1528,21 @@ func (s *Server) handleGetDealStatusByPropCid(c echo.Context, u *User) error {
 		return err
 	}
 
+	// with wait set, hold the request until the next transfer event for the
+	// deal (or the wait runs out) so clients don't have to poll
+	if wait > 0 {
+		event, cancel := s.CM.transferEvents.wait(deal.ID)
+		timer := time.NewTimer(wait)
+		select {
+		case <-event:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		cancel()
+		c.Response().Header().Set("X-Status-Wait", "true")
+	}
+
 	dstatus, err := s.dealStatusByID(ctx, deal.ID)
 	if err != nil {
 		return err
@@ -1253,6 +1551,109 @@ func (s *Server) handleGetDealStatusByPropCid(c echo.Context, u *User) error {
 	return c.JSON(200, dstatus)
 }
 
+// statusWait parses the wait query param of a status request, capped at
+// maxStatusWait. It is zero when wait isn't set.
+func statusWait(c echo.Context) (time.Duration, error) {
+	w := c.QueryParam("wait")
+	if w == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(w)
+	if err != nil || wait < 0 {
+		return 0, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid wait %q, must be a duration like 30s", w),
+		}
+	}
+
+	if wait > maxStatusWait {
+		wait = maxStatusWait
+	}
+	return wait, nil
+}
+
+type dealProposalSummary struct {
+	PropCid    string         `json:"propCid"`
+	Miner      string         `json:"miner"`
+	Content    uint           `json:"content"`
+	StartEpoch abi.ChainEpoch `json:"startEpoch"`
+	EndEpoch   abi.ChainEpoch `json:"endEpoch"`
+
+	// the deal ran its term, or the miner never got it sealed by its start
+	Expired bool `json:"expired"`
+}
+
+// dealProposalExpired says whether a deal is past its end, or past its start
+// without having been sealed. SealedAt is only set once the deal gets checked
+// after its sector went on chain, so activated reports what the chain says
+// for deals that don't have it set yet.
+func dealProposalExpired(d contentDeal, prop *market.DealProposal, head abi.ChainEpoch, activated bool) bool {
+	if head >= prop.EndEpoch {
+		return true
+	}
+	return head >= prop.StartEpoch && !d.Failed && d.SealedAt.IsZero() && !activated
+}
+
+// handleListDealProposals godoc
+// @Summary      List deal proposals
+// @Description  This endpoint lists the proposals of every deal made for the user's content, with their start and end epochs and whether they have expired, for checking the status of all of them in bulk
+// @Tags         deals
+// @Produce      json
+// @Router       /deals/proposals [get]
+func (s *Server) handleListDealProposals(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	var deals []contentDeal
+	if err := s.DB.Model(contentDeal{}).
+		Joins("left join contents on content_deals.content = contents.id").
+		Where("contents.user_id = ?", u.ID).
+		Order("content_deals.id asc").
+		Find(&deals).Error; err != nil {
+		return err
+	}
+
+	head, err := s.Api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	props, err := s.CM.proposalsForDeals(deals)
+	if err != nil {
+		return err
+	}
+
+	out := make([]dealProposalSummary, 0, len(deals))
+	for _, d := range deals {
+		sum := dealProposalSummary{
+			PropCid: d.PropCid.CID.String(),
+			Miner:   d.Miner,
+			Content: d.Content,
+		}
+
+		if prop, ok := props[d.PropCid.CID]; ok {
+			sum.StartEpoch = prop.Proposal.StartEpoch
+			sum.EndEpoch = prop.Proposal.EndEpoch
+
+			// only published deals past their start that we haven't seen
+			// sealed need asking the chain about. A deal the market no
+			// longer has never got activated in time.
+			var activated bool
+			if d.DealID > 0 && !d.Failed && d.SealedAt.IsZero() && head.Height() >= prop.Proposal.StartEpoch && head.Height() < prop.Proposal.EndEpoch {
+				md, err := s.Api.StateMarketStorageDeal(ctx, abi.DealID(d.DealID), types.EmptyTSK)
+				activated = err == nil && md.State.SectorStartEpoch > 0
+			}
+
+			sum.Expired = dealProposalExpired(d, &prop.Proposal, head.Height(), activated)
+		}
+
+		out = append(out, sum)
+	}
+
+	return c.JSON(200, out)
+}
+
 func (s *Server) dealStatusByID(ctx context.Context, dealid uint) (*dealStatus, error) {
 	var deal contentDeal
 	if err := s.DB.First(&deal, "id = ?", dealid).Error; err != nil {
@@ -1284,7 +1685,26 @@ func (s *Server) dealStatusByID(ctx context.Context, dealid uint) (*dealStatus,
 				LastUpdatedEpoch: markDeal.State.LastUpdatedEpoch,
 				SlashEpoch:       markDeal.State.SlashEpoch,
 			}
+
+			dl, err := util.DecodeDealLabel(markDeal.Proposal.Label)
+			if err != nil {
+				log.Warnw("failed to decode deal label", "dealID", deal.DealID, "label", markDeal.Proposal.Label, "error", err)
+			} else {
+				if dl.Content > 0 && dl.Content != deal.Content {
+					log.Warnw("on chain deal label is for another content", "dealID", deal.DealID, "content", deal.Content, "labelContent", dl.Content)
+				}
+				dstatus.OnChainState.Label = dl
+			}
+		}
+	}
+
+	if !deal.Failed && deal.SealedAt.IsZero() && !deal.TransferFinished.IsZero() &&
+		(dstatus.OnChainState == nil || dstatus.OnChainState.SectorStartEpoch <= 0) {
+		est, err := estimateSealTime(s.DB, deal.Miner)
+		if err != nil {
+			log.Warnw("failed to estimate seal time", "miner", deal.Miner, "error", err)
 		}
+		dstatus.SealEstimate = est
 	}
 
 	return &dstatus, nil
@@ -1297,30 +1717,19 @@ type getContentResponse struct {
 	Deals        []*contentDeal `json:"deals"`
 }
 
-func (s *Server) calcSelector(aggregatedIn uint, contentID uint) (string, error) {
-	// sort the known content IDs aggregated in a CAR, and use the index in the sorted list
-	// to build the CAR sub-selector
-
-	var ordinal uint
-	result := s.DB.Raw(`SELECT ordinal - 1 FROM (
-				SELECT
-					id, ROW_NUMBER() OVER ( ORDER BY CAST(id AS TEXT) ) AS ordinal
-				FROM contents
-				WHERE aggregated_in = ?
-			) subq
-				WHERE id = ?
-			`, aggregatedIn, contentID).Scan(&ordinal)
-
-	if result.Error != nil {
-		return "", result.Error
+func (s *Server) calcSelector(ctx context.Context, aggregatedIn uint, contentID uint) (string, error) {
+	// the content's link is its index in the aggregate's root directory
+	am, err := s.CM.aggregateMemberLayout(ctx, aggregatedIn, contentID)
+	if err != nil {
+		return "", err
 	}
 
-	return fmt.Sprintf("/Links/%d/Hash", ordinal), nil
+	return fmt.Sprintf("/Links/%d/Hash", am.Link), nil
 }
 
 // handleGetContentByCid godoc
 // @Summary      Get Content by Cid
-// @Description  This endpoint returns the content associated with a CID
+// @Description  This endpoint returns the content associated with a CID that the caller may see: public content, and on /content/by-cid also the caller's own content and content shared with them
 // @Tags         public
 // @Produce      json
 // @Param 		cid path string true "Cid"
@@ -1331,11 +1740,12 @@ func (s *Server) handleGetContentByCid(c echo.Context) error {
 		return err
 	}
 
-	v0 := cid.NewCidV0(obj.Hash())
-	v1 := cid.NewCidV1(obj.Prefix().Codec, obj.Hash())
+	// set on /content/by-cid, nil on /public/by-cid which only lists public
+	// contents
+	u, _ := c.Get("user").(*User)
 
 	var contents []Content
-	if err := s.DB.Find(&contents, "(cid=? or cid=?) and active", v0.Bytes(), v1.Bytes()).Error; err != nil {
+	if err := accessibleContents(contentsForCid(s.DB, obj), u).Find(&contents, "active").Error; err != nil {
 		return err
 	}
 
@@ -1356,7 +1766,7 @@ func (s *Server) handleGetContentByCid(c echo.Context) error {
 			resp.AggregatedIn = &aggr
 
 			// no need to early return here, the selector is mostly cosmetic atm
-			if selector, err := s.calcSelector(cont.AggregatedIn, cont.ID); err == nil {
+			if selector, err := s.calcSelector(c.Request().Context(), cont.AggregatedIn, cont.ID); err == nil {
 				resp.Selector = selector
 			}
 
@@ -1378,10 +1788,11 @@ func (s *Server) handleGetContentByCid(c echo.Context) error {
 
 // handleQueryAsk godoc
 // @Summary      Query Ask
-// @Description  This endpoint returns the ask for a given CID
+// @Description  This endpoint returns the ask of a miner, and whether it is signed by the miner's worker key
 // @Tags         deals
 // @Produce      json
 // @Param 		 miner path string true "CID"
+// @Param 		 addr query string false "Multiaddr to reach the miner at instead of its addresses on chain, admins only"
 // @Router       /deal/query/{miner} [get]
 func (s *Server) handleQueryAsk(c echo.Context) error {
 	addr, err := address.NewFromString(c.Param("miner"))
@@ -1389,26 +1800,204 @@ func (s *Server) handleQueryAsk(c echo.Context) error {
 		return err
 	}
 
+	if maddr := c.QueryParam("addr"); maddr != "" {
+		// dialing a caller supplied address is for admins checking on a
+		// miner, not for anyone who can reach the public routes
+		u, ok := c.Get("user").(*User)
+		if !ok || u.Perm < util.PermLevelAdmin {
+			return &util.HttpError{
+				Code:    http.StatusForbidden,
+				Message: util.ERR_NOT_AUTHORIZED,
+				Details: "only admins may query a miner at a given address",
+			}
+		}
+
+		ma, err := multiaddr.NewMultiaddr(maddr)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid multiaddr: %s", err),
+			}
+		}
+
+		if _, err := connectToMinerAddr(c.Request().Context(), s.Api, s.Node.Host, addr, ma, peerstore.TempAddrTTL); err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadGateway,
+				Message: util.ERR_MINER_UNREACHABLE,
+				Details: fmt.Sprintf("failed to connect to miner at %s: %s", ma, err),
+			}
+		}
+	} else {
+		s.CM.connectMinerOverride(c.Request().Context(), addr)
+	}
+
 	ask, err := s.FilClient.GetAsk(c.Request().Context(), addr)
 	if err != nil {
-		return c.JSON(500, map[string]string{"error": err.Error()})
+		return &util.HttpError{
+			Code:    http.StatusBadGateway,
+			Message: util.ERR_MINER_UNREACHABLE,
+			Details: fmt.Sprintf("failed to query ask of miner %s: %s", addr, err),
+		}
+	}
+
+	// an ask that fails verification is still shown, unless it's too
+	// malformed to show at all
+	verr := s.CM.verifyAsk(c.Request().Context(), addr, ask)
+	if verr != nil {
+		if !xerrors.Is(verr, errInvalidAsk) {
+			return verr
+		}
+
+		if ask.Ask == nil || ask.Ask.Ask == nil {
+			return c.JSON(500, map[string]string{"error": verr.Error()})
+		}
 	}
 
 	if err := s.CM.updateMinerVersion(c.Request().Context(), addr); err != nil {
 		return err
 	}
 
-	return c.JSON(200, toDBAsk(ask))
+	return c.JSON(200, newAskVerification(ask, verr))
+}
+
+// handleGetMinerRetrievalProtocols godoc
+// @Summary      Get miner retrieval protocols
+// @Description  This endpoint returns the retrieval transports a miner advertises, and whether we are able to retrieve from it. It dials the miner, so unlike the rest of /public/miners it requires an API key.
+// @Tags         public,miner
+// @Produce      json
+// @Param 		 miner path string true "Miner"
+// @Router       /public/miners/retrieval/protocols/{miner} [get]
+func (s *Server) handleGetMinerRetrievalProtocols(c echo.Context) error {
+	addr, err := address.NewFromString(c.Param("miner"))
+	if err != nil {
+		return err
+	}
+
+	protos, err := s.CM.minerRetrievalProtocols(c.Request().Context(), addr)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, protos)
+}
+
+// maxCompareMiners is how many miners handleCompareMiners compares at once
+const maxCompareMiners = 10
+
+// handleCompareMiners godoc
+// @Summary      Compare miners
+// @Description  This endpoint fetches the asks of the given miners and returns them alongside their deal stats and the cost of a deal of the given size and duration
+// @Tags         public,miner
+// @Produce      json
+// @Param        miner query []string true "Miners to compare, at most 10"
+// @Param        size query int false "Deal size in bytes, defaults to 32GiB"
+// @Param        duration query int false "Deal duration in epochs"
+// @Param        verified query bool false "Price verified deals"
+// @Router       /public/miners/compare [get]
+func (s *Server) handleCompareMiners(c echo.Context) error {
+	var miners []address.Address
+	seen := make(map[address.Address]bool)
+	for _, m := range c.QueryParams()["miner"] {
+		maddr, err := address.NewFromString(m)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid miner address %q: %s", m, err),
+			}
+		}
+
+		if !seen[maddr] {
+			seen[maddr] = true
+			miners = append(miners, maddr)
+		}
+	}
+
+	// every miner is a query of its ask, anyone can call this
+	if len(miners) > maxCompareMiners {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("can compare at most %d miners at once", maxCompareMiners),
+		}
+	}
+
+	if len(miners) == 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: "must specify at least one miner",
+		}
+	}
+
+	size := uint64(32 << 30)
+	if sizestr := c.QueryParam("size"); sizestr != "" {
+		v, err := strconv.ParseUint(sizestr, 10, 64)
+		if err != nil {
+			return err
+		}
+		size = v
+	}
+
+	duration := abi.ChainEpoch(dealDuration)
+	if durstr := c.QueryParam("duration"); durstr != "" {
+		v, err := strconv.ParseInt(durstr, 10, 64)
+		if err != nil {
+			return err
+		}
+		duration = abi.ChainEpoch(v)
+	}
+
+	verified := s.CM.VerifiedDeal
+	if vstr := c.QueryParam("verified"); vstr != "" {
+		verified = vstr == "true"
+	}
+
+	cmp, err := s.CM.compareMiners(c.Request().Context(), miners, padreader.PaddedSize(size).Padded(), duration, verified)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, cmp)
 }
 
 type dealRequest struct {
 	Content uint            `json:"content"`
 	Miner   address.Address `json:"miner"`
+
+	// root cid of content that's already been added, used instead of the
+	// content id. Its dag has to be complete in our blockstore.
+	Cid string `json:"cid,omitempty"`
+
+	// optional collateral overrides, in FIL (e.g. "0.01")
+	ClientCollateral   string `json:"clientCollateral"`
+	ProviderCollateral string `json:"providerCollateral"`
+
+	// ask the miner to keep an unsealed copy, defaults to the node's setting
+	FastRetrieval *bool `json:"fastRetrieval,omitempty"`
+
+	// padded piece size to propose, a power of two at least as large as the
+	// content's piece, e.g. 34359738368 to fill a 32GiB sector. Defaults to
+	// the smallest piece the miner accepts.
+	PieceSize uint64 `json:"pieceSize,omitempty"`
+
+	// piece commitment of the content computed elsewhere, proposed instead of
+	// computing it here. PieceSize has to be the padded size of its piece.
+	PieceCid string `json:"pieceCid,omitempty"`
+
+	// highest price to accept, in FIL per GiB per epoch, instead of the
+	// node's limit
+	MaxPrice string `json:"maxPrice,omitempty"`
+
+	// if the miner rejects the proposal for being priced below its ask,
+	// propose again at its current ask if that is within MaxPrice
+	Renegotiate bool `json:"renegotiate,omitempty"`
 }
 
 // handleMakeDeal godoc
 // @Summary      Make Deal
-// @Description  This endpoint makes a deal for a given content and miner
+// @Description  This endpoint makes a deal for a given content and miner. The content can be given by id or by the cid of content whose dag is already in the blockstore. With renegotiate and a maxPrice, a proposal the miner rejects for being priced below its ask is sent again at the miner's new price, if that is within maxPrice. A pieceCid and pieceSize computed elsewhere are proposed without computing the piece commitment here. They are checked against the content's own piece commitment if it was already computed, otherwise the content's car has to fit in the piece. A piece given this way is only used for this deal.
 // @Tags         deals
 // @Produce      json
 // @Param miner path string true "Miner"
@@ -1435,18 +2024,193 @@ func (s *Server) handleMakeDeal(c echo.Context, u *User) error {
 	}
 
 	var cont Content
-	if err := s.DB.First(&cont, "id = ?", req.Content).Error; err != nil {
-		return err
+	if req.Cid != "" {
+		cc, err := cid.Decode(req.Cid)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid cid: %s", err),
+			}
+		}
+
+		if err := s.DB.Order("id desc").First(&cont, "cid = ? and active", cc.Bytes()).Error; err != nil {
+			if xerrors.Is(err, gorm.ErrRecordNotFound) {
+				return &util.HttpError{
+					Code:    http.StatusNotFound,
+					Message: util.ERR_RECORD_NOT_FOUND,
+					Details: fmt.Sprintf("no active content with cid %s", cc),
+				}
+			}
+			return err
+		}
+
+		// content on a shuttle is checked there when the deal's data is prepared
+		if cont.Location == "local" {
+			if err := s.CM.checkDagComplete(ctx, cc); err != nil {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Message: util.ERR_INVALID_INPUT,
+					Details: err.Error(),
+				}
+			}
+		}
+	} else {
+		if err := s.DB.First(&cont, "id = ?", req.Content).Error; err != nil {
+			return err
+		}
+	}
+
+	var coll *dealCollateral
+	if req.ClientCollateral != "" || req.ProviderCollateral != "" {
+		coll = &dealCollateral{}
+		if req.ClientCollateral != "" {
+			amt, err := types.ParseFIL(req.ClientCollateral)
+			if err != nil {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Message: util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("invalid client collateral: %s", err),
+				}
+			}
+			coll.Client = abi.TokenAmount(amt)
+		}
+
+		if req.ProviderCollateral != "" {
+			amt, err := types.ParseFIL(req.ProviderCollateral)
+			if err != nil {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Message: util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("invalid provider collateral: %s", err),
+				}
+			}
+			coll.Provider = abi.TokenAmount(amt)
+		}
+	}
+
+	fastRetrieval := s.CM.fastRetrieval
+	if req.FastRetrieval != nil {
+		fastRetrieval = *req.FastRetrieval
+	}
+
+	pieceSize := abi.PaddedPieceSize(req.PieceSize)
+	if pieceSize != 0 && req.PieceCid == "" {
+		// the piece is of the content's car, which is larger than its data
+		_, _, contentPiece, err := s.CM.getPieceCommitment(ctx, cont.Cid.CID, s.CM.Blockstore)
+		if err != nil {
+			if xerrors.Is(err, ErrWaitForRemoteCompute) {
+				return &util.HttpError{
+					Code:    http.StatusServiceUnavailable,
+					Message: util.ERR_PIECE_PENDING,
+					Details: "the content's piece commitment is still being computed to check the piece size against, try again later",
+				}
+			}
+			return err
+		}
+
+		if _, err := dealPieceSize(contentPiece, pieceSize, 0, 0); err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+	}
+
+	if req.PieceCid != "" {
+		if pieceSize == 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: "a piece cid needs the padded size of its piece",
+			}
+		}
+
+		if err := pieceSize.Validate(); err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid piece size %d: %s", pieceSize, err),
+			}
+		}
+
+		pc, err := cid.Decode(req.PieceCid)
+		if err == nil {
+			_, err = commcid.CIDToPieceCommitmentV1(pc)
+		}
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid piece cid: %s", err),
+			}
+		}
+
+		ctx, err = s.CM.withSuppliedPiece(ctx, cont, pc, pieceSize)
+		if err != nil {
+			var pme *pieceMismatchError
+			if xerrors.As(err, &pme) {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Message: util.ERR_PIECE_MISMATCH,
+					Details: err.Error(),
+				}
+			}
+			return err
+		}
+	}
+
+	var pricing *dealPricing
+	if req.MaxPrice != "" {
+		amt, err := types.ParseFIL(req.MaxPrice)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid max price: %s", err),
+			}
+		}
+
+		pricing = &dealPricing{
+			MaxPrice:    abi.TokenAmount(amt),
+			Renegotiate: req.Renegotiate,
+		}
+	} else if req.Renegotiate {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: "renegotiating a deal's price needs a max price",
+		}
 	}
 
-	id, err := s.CM.makeDealWithMiner(ctx, cont, addr, true)
+	id, err := s.CM.makeDealWithMiner(ctx, cont, addr, true, fastRetrieval, coll, pieceSize, pricing)
 	if err != nil {
 		return err
 	}
 
-	return c.JSON(200, map[string]interface{}{
-		"deal": id,
-	})
+	var deal contentDeal
+	if err := s.DB.First(&deal, "id = ?", id).Error; err != nil {
+		return err
+	}
+
+	out := map[string]interface{}{
+		"deal":             id,
+		"fastRetrieval":    fastRetrieval,
+		"pieceSize":        req.PieceSize,
+		"proposalAttempts": deal.ProposalAttempts,
+	}
+	if req.PieceCid != "" {
+		out["pieceCid"] = req.PieceCid
+	}
+	if pricing != nil && pricing.Adjusted != nil {
+		out["priceAdjustment"] = map[string]string{
+			"from": types.FIL(pricing.Adjusted.From).String(),
+			"to":   types.FIL(pricing.Adjusted.To).String(),
+		}
+	}
+
+	return c.JSON(200, out)
 }
 
 // handleTransferStatus godoc
@@ -1638,7 +2402,7 @@ func (s *Server) handleDealStatus(c echo.Context) error {
 		}
 		dealUUID = &parsed
 	}
-	status, err := s.FilClient.DealStatus(ctx, addr, propCid, dealUUID)
+	status, err := s.CM.dealStatus(ctx, addr, propCid, dealUUID)
 	if err != nil {
 		return xerrors.Errorf("getting deal status: %w", err)
 	}
@@ -1656,99 +2420,303 @@ func (s *Server) handleDealStatus(c echo.Context) error {
 func (s *Server) handleGetProposal(c echo.Context) error {
 	propCid, err := cid.Decode(c.Param("propcid"))
 	if err != nil {
-		return err
-	}
-
-	var proprec proposalRecord
-	if err := s.DB.First(&proprec, "prop_cid = ?", propCid.Bytes()).Error; err != nil {
-		return err
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid proposal cid: %s", err),
+		}
 	}
 
-	var prop market.ClientDealProposal
-	if err := prop.UnmarshalCBOR(bytes.NewReader(proprec.Data)); err != nil {
+	prop, err := s.CM.getProposalRecord(propCid)
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("no proposal saved for %s", propCid),
+			}
+		}
 		return err
 	}
 
 	return c.JSON(200, prop)
 }
 
-// handleGetDealInfo godoc
-// @Summary      Get Deal Info
-// @Description  This endpoint returns the deal info for a deal
+// handleGetTransferLog godoc
+// @Summary      Get the transfer log of a deal
+// @Description  This endpoint returns the timeline of data transfer events (requested, started, restarts, stalls, completion) recorded for a deal
 // @Tags         deals
 // @Produce      json
-// @Param 	  	 dealid path int true "Deal ID"
-// @Router       /deal/info/{dealid} [get]
-func (s *Server) handleGetDealInfo(c echo.Context) error {
-	dealid, err := strconv.ParseInt(c.Param("dealid"), 10, 64)
+// @Param propcid path string true "Proposal CID"
+// @Router       /deal/transfer/log/{propcid} [get]
+func (s *Server) handleGetTransferLog(c echo.Context, u *User) error {
+	propCid, err := cid.Decode(c.Param("propcid"))
 	if err != nil {
-		return err
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid proposal cid: %s", err),
+		}
 	}
 
-	deal, err := s.Api.StateMarketStorageDeal(c.Request().Context(), abi.DealID(dealid), types.EmptyTSK)
-	if err != nil {
+	var deal contentDeal
+	if err := s.DB.First(&deal, "prop_cid = ?", propCid.Bytes()).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("no deal with proposal %s", propCid),
+			}
+		}
 		return err
 	}
 
-	return c.JSON(200, deal)
-}
-
-type getInvitesResp struct {
-	Code      string `json:"code"`
-	Username  string `json:"createdBy"`
-	ClaimedBy string `json:"claimedBy"`
-}
-
-func (s *Server) handleAdminGetInvites(c echo.Context) error {
-	var invites []getInvitesResp
-	if err := s.DB.Model(&InviteCode{}).
-		Select("code, username, (?) as claimed_by", s.DB.Table("users").Select("username").Where("id = invite_codes.claimed_by")).
-		//Where("claimed_by IS NULL").
-		Joins("left join users on users.id = invite_codes.created_by").
-		Scan(&invites).Error; err != nil {
+	var cont Content
+	if err := s.DB.First(&cont, "id = ?", deal.Content).Error; err != nil {
 		return err
 	}
 
-	return c.JSON(200, invites)
-}
-
-func (s *Server) handleAdminCreateInvite(c echo.Context, u *User) error {
-	code := c.Param("code")
-	invite := &InviteCode{
-		Code:      code,
-		CreatedBy: u.ID,
-	}
-	if err := s.DB.Create(invite).Error; err != nil {
-		return err
+	if u.Perm < util.PermLevelAdmin && cont.UserID != u.ID {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_NOT_AUTHORIZED,
+		}
 	}
 
-	return c.JSON(200, map[string]string{
-		"code": invite.Code,
-	})
-}
-
-func (s *Server) handleAdminBalance(c echo.Context) error {
-	balance, err := s.FilClient.Balance(c.Request().Context())
+	events, err := transferEventsForDeal(s.DB, deal.ID)
 	if err != nil {
 		return err
 	}
 
-	return c.JSON(200, balance)
+	return c.JSON(200, events)
 }
 
-func (s *Server) handleAdminAddEscrow(c echo.Context) error {
-	amt, err := types.ParseFIL(c.Param("amt"))
+// handleExportPiece godoc
+// @Summary      Export the CAR of a deal's piece
+// @Description  This endpoint streams the CARv1 of a deal's data in the canonical order its piece commitment was computed over, so that running a CommP tool over it reproduces the piece CID of the deal proposal
+// @Tags         deals
+// @Produce      application/vnd.ipld.car
+// @Param propcid path string true "Proposal CID"
+// @Router       /deals/piece/{propcid} [get]
+func (s *Server) handleExportPiece(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	propCid, err := cid.Decode(c.Param("propcid"))
 	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid proposal cid: %s", err),
+		}
+	}
+
+	var deal contentDeal
+	if err := s.DB.First(&deal, "prop_cid = ?", propCid.Bytes()).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("no deal with proposal %s", propCid),
+			}
+		}
 		return err
 	}
 
-	resp, err := s.FilClient.LockMarketFunds(context.TODO(), amt)
-	if err != nil {
+	var cont Content
+	if err := s.DB.First(&cont, "id = ?", deal.Content).Error; err != nil {
 		return err
 	}
 
-	return c.JSON(200, resp)
-}
+	if u.Perm < util.PermLevelAdmin && cont.UserID != u.ID {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_NOT_AUTHORIZED,
+		}
+	}
+
+	if cont.Location != "local" || cont.Offloaded {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("the data of content %d is not on this node, retrieve it first", cont.ID),
+		}
+	}
+
+	// preparing walks the whole dag, so missing blocks show up before
+	// anything is sent
+	prepared, err := util.PieceCar(ctx, s.Node.Blockstore, cont.Cid.CID)
+	if err != nil {
+		return xerrors.Errorf("failed to prepare piece car: %w", err)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/vnd.ipld.car")
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatUint(prepared.Size(), 10))
+	c.Response().WriteHeader(http.StatusOK)
+
+	if err := prepared.Dump(ctx, c.Response()); err != nil {
+		log.Errorw("failed to write piece car", "propcid", propCid, "content", cont.ID, "err", err)
+	}
+	return nil
+}
+
+// handleGetSelectionAudit godoc
+// @Summary      Get the miner selection audit log of a content
+// @Description  This endpoint returns every round of miner selection made for a content: the miners considered, why each one that was left out was filtered (excluded, suspended, cooldown, not-accepting, too-slow, ask-failed, piece-size, diversity, price, duration), and which were selected
+// @Tags         admin
+// @Produce      json
+// @Param content path int true "Content ID"
+// @Router       /admin/cm/selection-audit/{content} [get]
+func (s *Server) handleGetSelectionAudit(c echo.Context) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id: %s", err),
+		}
+	}
+
+	var cont Content
+	if err := s.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("content %d was not found", contID),
+			}
+		}
+		return err
+	}
+
+	audits, err := selectionAuditsForContent(s.DB, cont.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, audits)
+}
+
+// handleTestReplicas godoc
+// @Summary      Test retrieving every replica of a content
+// @Description  This endpoint queries every miner with a deal on chain for a content and retrieves a small part of the content from each, reporting per miner whether it served the content and how fast. Replicas that fail can be recorded as deal faults, so that the content is replicated again.
+// @Tags         admin
+// @Produce      json
+// @Param        content path int true "Content ID"
+// @Param        record-faults query bool false "Mark the deals of replicas that failed as faulted"
+// @Router       /admin/cm/test-replicas/{content} [post]
+func (s *Server) handleTestReplicas(c echo.Context) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id: %s", err),
+		}
+	}
+
+	var cont Content
+	if err := s.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("content %d was not found", contID),
+			}
+		}
+		return err
+	}
+
+	// the replicas of aggregated content are the aggregate's
+	dealCont, err := dealsContent(s.DB, cont)
+	if err != nil {
+		return err
+	}
+
+	report, err := s.CM.testReplicas(c.Request().Context(), dealCont, c.QueryParam("record-faults") == "true")
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, report)
+}
+
+// handleGetDealInfo godoc
+// @Summary      Get Deal Info
+// @Description  This endpoint returns the deal info for a deal
+// @Tags         deals
+// @Produce      json
+// @Param 	  	 dealid path int true "Deal ID"
+// @Router       /deal/info/{dealid} [get]
+func (s *Server) handleGetDealInfo(c echo.Context) error {
+	dealid, err := strconv.ParseInt(c.Param("dealid"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	deal, err := s.Api.StateMarketStorageDeal(c.Request().Context(), abi.DealID(dealid), types.EmptyTSK)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, deal)
+}
+
+type getInvitesResp struct {
+	Code      string `json:"code"`
+	Username  string `json:"createdBy"`
+	ClaimedBy string `json:"claimedBy"`
+}
+
+func (s *Server) handleAdminGetInvites(c echo.Context) error {
+	var invites []getInvitesResp
+	if err := s.DB.Model(&InviteCode{}).
+		Select("code, username, (?) as claimed_by", s.DB.Table("users").Select("username").Where("id = invite_codes.claimed_by")).
+		//Where("claimed_by IS NULL").
+		Joins("left join users on users.id = invite_codes.created_by").
+		Scan(&invites).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(200, invites)
+}
+
+func (s *Server) handleAdminCreateInvite(c echo.Context, u *User) error {
+	code := c.Param("code")
+	invite := &InviteCode{
+		Code:      code,
+		CreatedBy: u.ID,
+	}
+	if err := s.DB.Create(invite).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(200, map[string]string{
+		"code": invite.Code,
+	})
+}
+
+func (s *Server) handleAdminBalance(c echo.Context) error {
+	balance, err := s.CM.dealBalance(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, balance)
+}
+
+func (s *Server) handleAdminAddEscrow(c echo.Context) error {
+	amt, err := types.ParseFIL(c.Param("amt"))
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.CM.addDealEscrow(c.Request().Context(), amt)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, resp)
+}
 
 type adminStatsResponse struct {
 	TotalDealAttempted   int64 `json:"totalDealsAttempted"`
@@ -1763,6 +2731,10 @@ type adminStatsResponse struct {
 	NumRetrFailures    int64 `json:"numRetrievalFailures"`
 	NumStorageFailures int64 `json:"numStorageFailures"`
 
+	// faulted aggregate deals, and how many contents lost a deal to them
+	NumAggregateFaults     int64 `json:"numAggregateFaults"`
+	NumAggrFaultedContents int64 `json:"numAggregateFaultedContents"`
+
 	PinQueueSize int `json:"pinQueueSize"`
 }
 
@@ -1813,17 +2785,29 @@ func (s *Server) handleAdminStats(c echo.Context) error {
 		return err
 	}
 
+	var numAggrFaults int64
+	if err := s.DB.Model(&aggregateFault{}).Distinct("deal").Count(&numAggrFaults).Error; err != nil {
+		return err
+	}
+
+	var numAggrFaultedContents int64
+	if err := s.DB.Model(&aggregateFault{}).Distinct("member").Count(&numAggrFaultedContents).Error; err != nil {
+		return err
+	}
+
 	return c.JSON(200, &adminStatsResponse{
-		TotalDealAttempted:   dealsTotal,
-		TotalDealsSuccessful: dealsSuccessful,
-		TotalDealsFailed:     dealsFailed,
-		NumMiners:            numMiners,
-		NumUsers:             numUsers,
-		NumFiles:             numFiles,
-		NumRetrievals:        numRetrievals,
-		NumRetrFailures:      numRetrievalFailures,
-		NumStorageFailures:   numStorageFailures,
-		PinQueueSize:         s.CM.pinMgr.PinQueueSize(),
+		TotalDealAttempted:     dealsTotal,
+		TotalDealsSuccessful:   dealsSuccessful,
+		TotalDealsFailed:       dealsFailed,
+		NumMiners:              numMiners,
+		NumUsers:               numUsers,
+		NumFiles:               numFiles,
+		NumRetrievals:          numRetrievals,
+		NumRetrFailures:        numRetrievalFailures,
+		NumStorageFailures:     numStorageFailures,
+		NumAggregateFaults:     numAggrFaults,
+		NumAggrFaultedContents: numAggrFaultedContents,
+		PinQueueSize:           s.CM.pinMgr.PinQueueSize(),
 	})
 }
 
@@ -1833,6 +2817,11 @@ type minerResp struct {
 	Suspended       bool            `json:"suspended"`
 	SuspendedReason string          `json:"suspendedReason,omitempty"`
 	Version         string          `json:"version"`
+	MinDealDuration int64           `json:"minDealDuration,omitempty"`
+	MaxDealDuration int64           `json:"maxDealDuration,omitempty"`
+	MinDealSize     int64           `json:"minDealSize,omitempty"`
+	MaxDealSize     int64           `json:"maxDealSize,omitempty"`
+	Multiaddr       string          `json:"multiaddr,omitempty"`
 }
 
 // handleAdminGetMiners godoc
@@ -1854,11 +2843,22 @@ func (s *Server) handleAdminGetMiners(c echo.Context) error {
 		out[i].SuspendedReason = m.SuspendedReason
 		out[i].Name = m.Name
 		out[i].Version = m.Version
+		out[i].MinDealDuration = m.MinDealDuration
+		out[i].MaxDealDuration = m.MaxDealDuration
+		out[i].MinDealSize = m.MinDealSize
+		out[i].MaxDealSize = m.MaxDealSize
+		out[i].Multiaddr = m.Multiaddr
 	}
 
 	return c.JSON(200, out)
 }
 
+// handlePublicGetMinerStats godoc
+// @Summary      Get deal stats of the miners we use
+// @Description  This endpoint returns how each miner used for new deals has done with our deals, in the order they are ranked in
+// @Tags         public,miners
+// @Produce      json
+// @Router       /public/miners/stats [get]
 func (s *Server) handlePublicGetMinerStats(c echo.Context) error {
 	_, stats, err := s.CM.sortedMinerList()
 	if err != nil {
@@ -1877,8 +2877,172 @@ func (s *Server) handleAdminGetMinerStats(c echo.Context) error {
 	return c.JSON(200, sml)
 }
 
+// handleAdminRecomputeMiners godoc
+// @Summary      Rank miners again now
+// @Description  This endpoint ranks the miners used for new deals again without waiting for the cached ranking to expire, and returns the new ranking
+// @Tags         admin,miners
+// @Produce      json
+// @Router       /admin/miners/recompute [post]
+func (s *Server) handleAdminRecomputeMiners(c echo.Context) error {
+	_, stats, err := s.CM.ForceRecompute()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, stats)
+}
+
+// handleAdminGetMinerCache godoc
+// @Summary      Get the cached miner ranking
+// @Description  This endpoint returns the miner ranking new deals are currently picked from, as cached, with the stats each miner was ranked on, when the ranking was computed and when it will be computed again. It never recomputes the ranking. Miners with a rank of zero are ranked but left out of deal making, e.g. because they are suspended.
+// @Tags         admin,miners
+// @Produce      json
+// @Router       /admin/miners/cache [get]
+func (s *Server) handleAdminGetMinerCache(c echo.Context) error {
+	return c.JSON(200, s.CM.MinerCache())
+}
+
+// handleAdminRebalanceMiner godoc
+// @Summary      Move replicas off a miner
+// @Description  This endpoint starts moving every replica off a miner: each content with a deal on the miner gets a replacement deal with another miner, and once that seals the deal with this miner no longer counts toward the content's replication. If the miner is already being rebalanced, that rebalance is returned.
+// @Tags         admin,miners
+// @Produce      json
+// @Param        miner path string true "Miner"
+// @Router       /admin/miners/rebalance/{miner} [post]
+func (s *Server) handleAdminRebalanceMiner(c echo.Context) error {
+	m, err := address.NewFromString(c.Param("miner"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid miner address: %s", err),
+		}
+	}
+
+	if _, err := s.CM.startRebalance(m); err != nil {
+		return err
+	}
+
+	st, err := s.CM.rebalanceStatus(m)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, st)
+}
+
+// handleAdminGetRebalance godoc
+// @Summary      Get the progress of moving replicas off a miner
+// @Description  This endpoint reports on the latest rebalance off a miner: how many contents are waiting for a replacement deal, waiting for it to seal, done or failed, and the contents that couldn't be rebalanced
+// @Tags         admin,miners
+// @Produce      json
+// @Param        miner path string true "Miner"
+// @Router       /admin/miners/rebalance/{miner} [get]
+func (s *Server) handleAdminGetRebalance(c echo.Context) error {
+	m, err := address.NewFromString(c.Param("miner"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid miner address: %s", err),
+		}
+	}
+
+	st, err := s.CM.rebalanceStatus(m)
+	if err != nil {
+		return err
+	}
+
+	if st == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Message: util.ERR_RECORD_NOT_FOUND,
+			Details: fmt.Sprintf("miner %s was never rebalanced", m),
+		}
+	}
+
+	return c.JSON(200, st)
+}
+
+// handleAdminExportMinerReputation godoc
+// @Summary      Export miner reputation
+// @Description  This endpoint exports the deal counts of every miner this node has made deals with, for importing into other nodes. Stats imported from other nodes are not included.
+// @Tags         admin,miners
+// @Produce      json
+// @Router       /admin/miners/reputation [get]
+func (s *Server) handleAdminExportMinerReputation(c echo.Context) error {
+	exp, err := exportMinerReputation(s.DB, s.Node.Host.ID().String())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, exp)
+}
+
+// handleAdminImportMinerReputation godoc
+// @Summary      Import miner reputation
+// @Description  This endpoint imports the miner reputation exported by another node and merges it into the ranking, replacing anything imported from that node before
+// @Tags         admin,miners
+// @Accept       json
+// @Produce      json
+// @Param        body body main.minerReputationExport true "Exported miner reputation"
+// @Router       /admin/miners/reputation [post]
+func (s *Server) handleAdminImportMinerReputation(c echo.Context) error {
+	var exp minerReputationExport
+	if err := c.Bind(&exp); err != nil {
+		return err
+	}
+
+	n, err := importMinerReputation(s.DB, s.Node.Host.ID().String(), &exp)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	if _, _, err := s.CM.ForceRecompute(); err != nil {
+		return err
+	}
+
+	return c.JSON(200, map[string]interface{}{
+		"source":   exp.Source,
+		"imported": n,
+	})
+}
+
+// handleAdminGetMinerGroups godoc
+// @Summary      List miners that share an operator
+// @Description  This endpoint lists every owner, worker and network block shared by more than one miner. When miner diversity is on, miners in the same group are not picked for the same content.
+// @Tags         admin,miners
+// @Produce      json
+// @Router       /admin/miners/groups [get]
+func (s *Server) handleAdminGetMinerGroups(c echo.Context) error {
+	groups, err := s.CM.minerGroups(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, groups)
+}
+
 type minerSetInfoParams struct {
 	Name string `json:"name"`
+
+	// deal durations in epochs the miner accepts, left unchanged when unset
+	// and zero to fall back to the chain's limits
+	MinDealDuration *int64 `json:"minDealDuration"`
+	MaxDealDuration *int64 `json:"maxDealDuration"`
+
+	// padded piece sizes the miner prefers deals of, left unchanged when
+	// unset and zero to learn them from its deal history or ask
+	MinDealSize *int64 `json:"minDealSize"`
+	MaxDealSize *int64 `json:"maxDealSize"`
+
+	// multiaddr to reach the miner at instead of the ones it has on chain,
+	// an empty string clears it
+	Multiaddr *string `json:"multiaddr"`
 }
 
 func (s *Server) handleMinersSetInfo(c echo.Context, u *User) error {
@@ -1904,7 +3068,68 @@ func (s *Server) handleMinersSetInfo(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := s.DB.Model(storageMiner{}).Where("address = ?", m.String()).Update("name", params.Name).Error; err != nil {
+	updates := map[string]interface{}{
+		"name": params.Name,
+	}
+
+	if params.MinDealDuration != nil {
+		updates["min_deal_duration"] = *params.MinDealDuration
+	}
+	if params.MaxDealDuration != nil {
+		updates["max_deal_duration"] = *params.MaxDealDuration
+	}
+	if params.MinDealSize != nil {
+		updates["min_deal_size"] = *params.MinDealSize
+	}
+	if params.MaxDealSize != nil {
+		updates["max_deal_size"] = *params.MaxDealSize
+	}
+	if params.Multiaddr != nil {
+		if *params.Multiaddr != "" {
+			if _, err := multiaddr.NewMultiaddr(*params.Multiaddr); err != nil {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Message: util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("invalid multiaddr: %s", err),
+				}
+			}
+		}
+		updates["multiaddr"] = *params.Multiaddr
+	}
+
+	minDur, maxDur := sm.MinDealDuration, sm.MaxDealDuration
+	if params.MinDealDuration != nil {
+		minDur = *params.MinDealDuration
+	}
+	if params.MaxDealDuration != nil {
+		maxDur = *params.MaxDealDuration
+	}
+
+	if minDur < 0 || maxDur < 0 || (maxDur > 0 && minDur > maxDur) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid deal duration range: min %d, max %d", minDur, maxDur),
+		}
+	}
+
+	minSize, maxSize := sm.MinDealSize, sm.MaxDealSize
+	if params.MinDealSize != nil {
+		minSize = *params.MinDealSize
+	}
+	if params.MaxDealSize != nil {
+		maxSize = *params.MaxDealSize
+	}
+
+	if err := validDealSizeRange(minSize, maxSize); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	if err := s.DB.Model(storageMiner{}).Where("address = ?", m.String()).Updates(updates).Error; err != nil {
 		return err
 	}
 
@@ -2040,7 +3265,7 @@ func (s *Server) handleDealStats(c echo.Context) error {
 			}
 			dealUUID = &parsed
 		}
-		st, err := s.FilClient.DealStatus(ctx, maddr, d.PropCid.CID, dealUUID)
+		st, err := s.CM.dealStatus(ctx, maddr, d.PropCid.CID, dealUUID)
 		if err != nil {
 			log.Errorf("checking deal status failed (%s): %s", maddr, err)
 			continue
@@ -2087,9 +3312,113 @@ type lmdbStat struct {
 	Entries       uint64 `json:"entries"`
 }
 
-type diskSpaceInfo struct {
-	BstoreSize uint64 `json:"bstoreSize"`
-	BstoreFree uint64 `json:"bstoreFree"`
+// handleGetTransferSlots godoc
+// @Summary      Get transfer slot usage
+// @Description  This endpoint returns the in-flight transfer limit, how many transfers are in flight and how many deals are waiting for a slot
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/cm/transfer-slots [get]
+func (s *Server) handleGetTransferSlots(c echo.Context) error {
+	st := s.CM.transferLimiter.status()
+
+	n, err := s.CM.countInflightTransfers()
+	if err != nil {
+		return err
+	}
+	st.InFlight = n
+
+	return c.JSON(200, st)
+}
+
+// handleGetDealQueue godoc
+// @Summary      Get the deal making queue
+// @Description  This endpoint returns the contents waiting to be checked for deals, in the order they will be checked: highest priority first, then the order they were queued in
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/cm/deal-queue [get]
+func (s *Server) handleGetDealQueue(c echo.Context) error {
+	return c.JSON(200, s.CM.dealQueue.list())
+}
+
+// handleGetSlashedDeals godoc
+// @Summary      List slashed deals
+// @Description  This endpoint returns the deals whose miner was slashed for losing the data, most recent first. Their contents are queued for new deals when the slashing is found.
+// @Tags         admin
+// @Produce      json
+// @Param        limit query int false "Maximum number of deals to return, all if unset"
+// @Router       /admin/cm/slashed-deals [get]
+func (s *Server) handleGetSlashedDeals(c echo.Context) error {
+	var limit int
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid limit %q", l),
+			}
+		}
+		limit = n
+	}
+
+	deals, err := s.CM.slashedDeals(limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, deals)
+}
+
+// handleGetUnderReplicated godoc
+// @Summary      Get content below its replication target
+// @Description  This endpoint returns the result of the latest replication check: the contents with fewer active sealed deals than their replication target, most short first, with the deals still in progress for each
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/cm/under-replicated [get]
+func (s *Server) handleGetUnderReplicated(c echo.Context) error {
+	rep := s.CM.redundancy.report()
+	if rep == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Message: util.ERR_RECORD_NOT_FOUND,
+			Details: "replication has not been checked yet, or the check is disabled",
+		}
+	}
+
+	return c.JSON(200, rep)
+}
+
+type fsStatsResponse struct {
+	Usage   *blockstoreUsage `json:"usage"`
+	SoftCap int64            `json:"softCap"`
+	HardCap int64            `json:"hardCap"`
+	Full    bool             `json:"full"`
+}
+
+// handleGetFsStats godoc
+// @Summary      Get blockstore usage
+// @Description  This endpoint returns the number of blocks and bytes held in the local blockstore, along with the configured caps
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/fs-stats [get]
+func (s *Server) handleGetFsStats(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	usage, err := s.CM.BlockstoreUsage(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, &fsStatsResponse{
+		Usage:   usage,
+		SoftCap: s.CM.blockstoreSoftCap,
+		HardCap: s.CM.blockstoreHardCap,
+		Full:    s.CM.blockstoreHardCap > 0 && usage.Bytes >= s.CM.blockstoreHardCap,
+	})
+}
+
+type diskSpaceInfo struct {
+	BstoreSize uint64 `json:"bstoreSize"`
+	BstoreFree uint64 `json:"bstoreFree"`
 
 	LmdbUsage uint64 `json:"lmdbUsage"`
 
@@ -2137,9 +3466,26 @@ func (s *Server) handleGetRetrievalInfo(c echo.Context) error {
 		return err
 	}
 
+	// the protocol versions each miner was retrieved from over, to spot
+	// miners drifting to versions we don't speak
+	var protocols []struct {
+		Miner      string `json:"miner"`
+		Protocols  string `json:"protocols"`
+		Retrievals int    `json:"retrievals"`
+	}
+	if err := s.DB.Model(&retrievalSuccessRecord{}).
+		Select("miner, protocols, count(*) as retrievals").
+		Where("protocols != ''").
+		Group("miner, protocols").
+		Order("miner").
+		Scan(&protocols).Error; err != nil {
+		return err
+	}
+
 	return c.JSON(200, map[string]interface{}{
-		"records":  infos,
-		"failures": failures,
+		"records":   infos,
+		"failures":  failures,
+		"protocols": protocols,
 	})
 }
 
@@ -2162,6 +3508,10 @@ type estimateDealBody struct {
 	Replication  int    `json:"replication"`
 	DurationBlks int    `json:"durationBlks"`
 	Verified     bool   `json:"verified"`
+
+	// optional padded piece size to price the deals at instead of the
+	// smallest one the data fits in
+	PieceSize uint64 `json:"pieceSize,omitempty"`
 }
 
 type askResponse struct {
@@ -2175,6 +3525,11 @@ type priceEstimateResponse struct {
 	TotalStr string `json:"totalFil"`
 	Total    string `json:"totalAttoFil"`
 	Asks     []*minerStorageAsk
+
+	// the piece size the deals are priced at, and how much of it is padding
+	PieceSize       uint64  `json:"pieceSize"`
+	PaddingBytes    uint64  `json:"paddingBytes"`
+	PaddingOverhead float64 `json:"paddingOverhead"`
 }
 
 // handleEstimateDealCost godoc
@@ -2192,17 +3547,32 @@ func (s *Server) handleEstimateDealCost(c echo.Context) error {
 		return err
 	}
 
-	rounded := padreader.PaddedSize(body.Size)
+	pieceSize, err := dealPieceSize(padreader.PaddedSize(body.Size), abi.PaddedPieceSize(body.PieceSize), 0, 0)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
 
-	estimate, err := s.CM.estimatePrice(ctx, body.Replication, rounded.Padded(), abi.ChainEpoch(body.DurationBlks), body.Verified)
+	estimate, err := s.CM.estimatePrice(ctx, body.Replication, pieceSize, abi.ChainEpoch(body.DurationBlks), body.Verified)
 	if err != nil {
 		return err
 	}
 
+	var padding uint64
+	if uint64(pieceSize) > body.Size {
+		padding = uint64(pieceSize) - body.Size
+	}
+
 	return c.JSON(200, &priceEstimateResponse{
-		TotalStr: types.FIL(*estimate.Total).String(),
-		Total:    estimate.Total.String(),
-		Asks:     estimate.Asks,
+		TotalStr:        types.FIL(*estimate.Total).String(),
+		Total:           estimate.Total.String(),
+		Asks:            estimate.Asks,
+		PieceSize:       uint64(pieceSize),
+		PaddingBytes:    padding,
+		PaddingOverhead: paddingOverhead(body.Size, pieceSize),
 	})
 }
 
@@ -2236,6 +3606,14 @@ type minerStatsResp struct {
 	ErrorCount      int64           `json:"errorCount"`
 	Suspended       bool            `json:"suspended"`
 	SuspendedReason string          `json:"suspendedReason"`
+	AvgResponseMs   int64           `json:"avgResponseMs"`
+
+	// set if the miner recently said it isn't taking new deals, it gets no
+	// proposals until the recheck time
+	NotAccepting *minerAvailability `json:"notAccepting,omitempty"`
+
+	// padded piece bytes of the miner's confirmed deals
+	TotalBytesStored uint64 `json:"totalBytesStored"`
 
 	ChainInfo *minerChainInfo `json:"chainInfo"`
 }
@@ -2306,19 +3684,77 @@ func (s *Server) handleGetMinerStats(c echo.Context) error {
 		return err
 	}
 
+	stored, err := minerBytesStored(s.DB, maddr.String())
+	if err != nil {
+		return err
+	}
+
 	return c.JSON(200, &minerStatsResp{
-		Miner:           maddr,
-		UsedByEstuary:   true,
-		DealCount:       dealscount,
-		ErrorCount:      errorcount,
-		Suspended:       m.Suspended,
-		SuspendedReason: m.SuspendedReason,
-		Name:            m.Name,
-		Version:         m.Version,
-		ChainInfo:       &ci,
+		Miner:            maddr,
+		UsedByEstuary:    true,
+		DealCount:        dealscount,
+		ErrorCount:       errorcount,
+		Suspended:        m.Suspended,
+		SuspendedReason:  m.SuspendedReason,
+		AvgResponseMs:    s.CM.minerResponseTime(maddr).Milliseconds(),
+		NotAccepting:     m.notAccepting(time.Now()),
+		TotalBytesStored: stored[maddr.String()],
+		Name:             m.Name,
+		Version:          m.Version,
+		ChainInfo:        &ci,
 	})
 }
 
+// handleGetMinerSealEstimate godoc
+// @Summary      Estimate miner sealing time
+// @Description  This endpoint estimates how long the miner takes from a finished transfer to an active deal, based on its past deals
+// @Tags         public,miner
+// @Produce      json
+// @Param miner path string true "Miner"
+// @Router       /public/miners/seal-estimate/{miner} [get]
+func (s *Server) handleGetMinerSealEstimate(c echo.Context) error {
+	maddr, err := address.NewFromString(c.Param("miner"))
+	if err != nil {
+		return err
+	}
+
+	est, err := estimateSealTime(s.DB, maddr.String())
+	if err != nil {
+		return err
+	}
+
+	if est == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Message: util.ERR_RECORD_NOT_FOUND,
+			Details: "not enough sealed deals to estimate sealing time",
+		}
+	}
+
+	return c.JSON(http.StatusOK, est)
+}
+
+// handleGetMinerPipeline godoc
+// @Summary      Probe miner sealing pipeline
+// @Description  This endpoint estimates how backed up the miner's sealing pipeline is from our deals it has the data for but hasn't sealed yet, and how long its recent deals took to seal compared to before. The status is one of ok, slowing, backed-up or unknown. expectedSeal is how long a deal made now is expected to take to seal once its data is transferred.
+// @Tags         public,miner
+// @Produce      json
+// @Param miner path string true "Miner"
+// @Router       /public/miners/pipeline/{miner} [get]
+func (s *Server) handleGetMinerPipeline(c echo.Context) error {
+	maddr, err := address.NewFromString(c.Param("miner"))
+	if err != nil {
+		return err
+	}
+
+	mp, err := estimateMinerPipeline(s.DB, maddr.String())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, mp)
+}
+
 type minerDealsResp struct {
 	ID               uint `json:"id"`
 	CreatedAt        time.Time
@@ -2352,9 +3788,12 @@ func (s *Server) handleGetMinerDeals(c echo.Context) error {
 		return err
 	}
 
+	// only the deals of contents anyone may see. Aggregates are only visible
+	// to their owner, so the deals of aggregated contents aren't listed.
 	q := s.DB.Model(contentDeal{}).Order("created_at desc").
 		Joins("left join contents on contents.id = content_deals.content").
 		Where("miner = ?", maddr.String())
+	q = accessibleContents(q, nil)
 
 	if c.QueryParam("ignore-failed") != "" {
 		q = q.Where("not content_deals.failed")
@@ -2446,6 +3885,103 @@ func (s *Server) handleGetAggregatedForContent(c echo.Context, u *User) error {
 	return c.JSON(200, sub)
 }
 
+type replicationPlanResponse struct {
+	// what decides the number of deals for the content: content for its own
+	// replication setting, otherwise the node's fixed or adaptive mode
+	Mode        string           `json:"mode"`
+	Replication int              `json:"replication"`
+	Plan        *replicationPlan `json:"plan"`
+}
+
+// handleGetReplicationPlan godoc
+// @Summary      Get the adaptive replication plan of a content
+// @Description  This endpoint returns how many deals the adaptive replication mode would make for a content, and with which miners, to meet a durability target. The node's target is used unless tolerance, confidence or max are given.
+// @Tags         content
+// @Produce      json
+// @Param content path int true "Content ID"
+// @Param tolerance query int false "Number of deals the content must survive losing"
+// @Param confidence query number false "Confidence with which the content must survive"
+// @Param max query int false "Most deals to plan for"
+// @Router       /content/replication-plan/{content} [get]
+func (s *Server) handleGetReplicationPlan(c echo.Context, u *User) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id: %s", err),
+		}
+	}
+
+	var content Content
+	if err := s.DB.First(&content, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("content %d was not found", contID),
+			}
+		}
+		return err
+	}
+
+	if content.UserID != u.ID && u.Perm < util.PermLevelAdmin {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_NOT_AUTHORIZED,
+		}
+	}
+
+	// aggregated content is stored by the deals of its aggregate
+	dealCont, err := dealsContent(s.DB, content)
+	if err != nil {
+		return err
+	}
+
+	target := s.CM.durabilityTarget
+	if v := c.QueryParam("tolerance"); v != "" {
+		target.Tolerance, err = strconv.Atoi(v)
+	}
+	if v := c.QueryParam("confidence"); v != "" && err == nil {
+		target.Confidence, err = strconv.ParseFloat(v, 64)
+	}
+	if v := c.QueryParam("max"); v != "" && err == nil {
+		target.MaxDeals, err = strconv.Atoi(v)
+	}
+	if err == nil {
+		err = target.validate()
+	}
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid durability target: %s", err),
+		}
+	}
+
+	plan, err := s.CM.replicationPlanForContent(dealCont, target)
+	if err != nil {
+		return err
+	}
+
+	resp := replicationPlanResponse{
+		Mode:        s.CM.replicationMode,
+		Replication: s.CM.Replication,
+		Plan:        plan,
+	}
+	switch {
+	case dealCont.Replication > 0:
+		resp.Mode = "content"
+		resp.Replication = dealCont.Replication
+	case s.CM.replicationMode == replicationModeAdaptive:
+		resp.Replication = s.CM.replicationFor(dealCont)
+	default:
+		resp.Mode = replicationModeFixed
+	}
+
+	return c.JSON(200, resp)
+}
+
 // handleGetContentFailures godoc
 // @Summary      List all failures for a content
 // @Description  This endpoint returns all failures for a content
@@ -2553,17 +4089,160 @@ func (s *Server) handleMoveContent(c echo.Context) error {
 	return c.JSON(200, map[string]string{})
 }
 
+type retrievalProgressResponse struct {
+	Content uint `json:"content"`
+	// nil until the retrieval from a miner starts, and for retrievals run
+	// by a shuttle
+	Stats *util.RetrievalStatsSnapshot `json:"stats"`
+}
+
+// handleGetRetrievalProgress godoc
+// @Summary      Get the progress of a content's retrieval
+// @Description  This endpoint returns the latest snapshot of a retrieval in progress: bytes received, current and average speed, and the payments made so far
+// @Tags         admin
+// @Produce      json
+// @Param        content path int true "Content ID"
+// @Param        wait query string false "Wait up to this long (e.g. 30s) for the next snapshot before responding"
+// @Router       /admin/cm/retrieval-progress/{content} [get]
+func (s *Server) handleGetRetrievalProgress(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	wait, err := statusWait(c)
+	if err != nil {
+		return err
+	}
+
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id: %s", err),
+		}
+	}
+
+	s.CM.retrLk.Lock()
+	prog, ok := s.CM.retrievalsInProgress[uint(contID)]
+	s.CM.retrLk.Unlock()
+	if !ok {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Message: util.ERR_RECORD_NOT_FOUND,
+			Details: fmt.Sprintf("content %d is not being retrieved", contID),
+		}
+	}
+
+	st, updated := prog.Stats()
+
+	// with wait set, hold the request until the next snapshot so clients
+	// can follow the retrieval without polling
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-updated:
+		case <-prog.Wait:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+
+		st, _ = prog.Stats()
+	}
+
+	return c.JSON(200, retrievalProgressResponse{
+		Content: uint(contID),
+		Stats:   st,
+	})
+}
+
+// handleRefreshContent godoc
+// @Summary      Retrieve content back from its deals
+// @Description  This endpoint retrieves a content back from one of its deals. Content brought back into the local blockstore is checked against its root cid and made servable locally again, and the response says which miner served the data. If the content is already being retrieved, this waits for that to finish. With verify-checksum, the file is also checked against the checksum taken when it was uploaded.
+// @Tags         admin
+// @Produce      json
+// @Param        content path int true "Content ID"
+// @Param        verify-checksum query bool false "Check the retrieved file against its upload checksum"
+// @Router       /admin/cm/refresh/{content} [post]
 func (s *Server) handleRefreshContent(c echo.Context) error {
 	cont, err := strconv.Atoi(c.Param("content"))
 	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("content")),
+		}
+	}
+
+	var content Content
+	if err := s.DB.First(&content, "id = ?", cont).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("content %d was not found", cont),
+			}
+		}
 		return err
 	}
 
-	if err := s.CM.RefreshContent(c.Request().Context(), uint(cont)); err != nil {
-		return c.JSON(500, map[string]string{"error": err.Error()})
+	verify := c.QueryParam("verify-checksum") == "true"
+	if verify && content.Checksum == "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d has no checksum to verify", cont),
+		}
 	}
 
-	return c.JSON(200, map[string]string{})
+	ctx := c.Request().Context()
+	res, err := s.CM.RefreshContent(ctx, uint(cont))
+	if err != nil {
+		return err
+	}
+
+	if res == nil {
+		// refreshed onto a shuttle, which has the data to check
+		return c.JSON(200, map[string]string{})
+	}
+
+	res.Checksum = content.Checksum
+	if verify {
+		if err := s.CM.checksumRehydrated(ctx, content); err != nil {
+			if xerrors.Is(err, errChecksumMismatch) {
+				return &util.HttpError{
+					Code:    http.StatusInternalServerError,
+					Message: util.ERR_CHECKSUM_MISMATCH,
+					Details: err.Error(),
+				}
+			}
+			return err
+		}
+		res.ChecksumVerified = true
+	}
+
+	return c.JSON(200, res)
+}
+
+// handleRepairContent godoc
+// @Summary      Repair content from its deals
+// @Description  This endpoint retrieves a content back into the local blockstore from one of the miners holding it, and optionally queues it to replace faulted deals
+// @Tags         admin
+// @Produce      json
+// @Param        content path int true "Content ID"
+// @Param        remake query bool false "Re-make deals to restore replication"
+// @Router       /admin/cm/repair/{content} [post]
+func (s *Server) handleRepairContent(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	res, err := s.CM.repairContent(c.Request().Context(), uint(cont), c.QueryParam("remake") == "true")
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, res)
 }
 
 func (s *Server) handleReadLocalContent(c echo.Context) error {
@@ -2594,6 +4273,10 @@ func (s *Server) handleReadLocalContent(c echo.Context) error {
 		})
 	}
 
+	if content.MimeType != "" && content.MimeType != util.DirectoryMimeType {
+		c.Response().Header().Set(echo.HeaderContentType, content.MimeType)
+	}
+
 	io.Copy(c.Response(), r)
 	return nil
 }
@@ -2903,6 +4586,12 @@ func (s *Server) handleGetViewer(c echo.Context, u *User) error {
 		return err
 	}
 
+	// shuttles go by this to decide whether to take uploads from the user
+	overQuota, err := userOverQuota(s.DB, u.ID)
+	if err != nil {
+		return err
+	}
+
 	return c.JSON(200, &util.ViewerResponse{
 		ID:       u.ID,
 		Username: u.Username,
@@ -2915,8 +4604,9 @@ func (s *Server) handleGetViewer(c echo.Context, u *User) error {
 			DealDuration:          dealDuration,
 			MaxStagingWait:        maxStagingZoneLifetime,
 			FileStagingThreshold:  int64(individualDealThreshold),
-			ContentAddingDisabled: s.CM.contentAddingDisabled || u.StorageDisabled,
+			ContentAddingDisabled: s.CM.contentAddingDisabled || u.StorageDisabled || overQuota,
 			DealMakingDisabled:    s.CM.dealMakingDisabled(),
+			DealMakingPaused:      s.CM.DealMakingPaused(),
 			UploadEndpoints:       uep,
 		},
 		AuthExpiry: u.authToken.Expiry,
@@ -3410,45 +5100,149 @@ func (s *Server) handleAdminGetUsers(c echo.Context) error {
 	return c.JSON(200, resp)
 }
 
-type publicStatsResponse struct {
-	TotalStorage     int64 `json:"totalStorage"`
-	TotalFilesStored int64 `json:"totalFiles"`
-	DealsOnChain     int64 `json:"dealsOnChain"`
+type userQuotaResponse struct {
+	Quota *userQuota `json:"quota"`
+	Usage *userUsage `json:"usage"`
 }
 
-// handlePublicStats godoc
-// @Summary      Public stats
-// @Description  This endpoint is used to get public stats.
-// @Tags         public
+// handleAdminGetUserQuota godoc
+// @Summary      Get a user's quota
+// @Description  This endpoint returns the quota of a user along with their current usage. Limits of zero mean no limit.
+// @Tags         admin
 // @Produce      json
-// @Router       /public/stats [get]
-func (s *Server) handlePublicStats(c echo.Context) error {
-	val, err := s.cacher.Get("public/stats", time.Minute*2, func() (interface{}, error) {
-		return s.computePublicStats()
-	})
-
+// @Param        user path int true "User ID"
+// @Router       /admin/users/quota/{user} [get]
+func (s *Server) handleAdminGetUserQuota(c echo.Context) error {
+	user, err := strconv.Atoi(c.Param("user"))
 	if err != nil {
 		return err
 	}
 
-	return c.JSON(200, val)
-}
-
-func (s *Server) computePublicStats() (*publicStatsResponse, error) {
-	var stats publicStatsResponse
-	if err := s.DB.Model(Content{}).Where("active and not aggregated_in > 0").Select("SUM(size) as total_storage").Scan(&stats).Error; err != nil {
-		return nil, err
+	q, err := getUserQuota(s.DB, uint(user))
+	if err != nil {
+		return err
 	}
 
-	if err := s.DB.Model(Content{}).Where("active and not aggregate").Count(&stats.TotalFilesStored).Error; err != nil {
-		return nil, err
+	usage, err := getUserUsage(s.DB, uint(user))
+	if err != nil {
+		return err
 	}
 
-	if err := s.DB.Model(contentDeal{}).Where("not failed and deal_id > 0").Count(&stats.DealsOnChain).Error; err != nil {
-		return nil, err
-	}
+	return c.JSON(200, &userQuotaResponse{
+		Quota: q,
+		Usage: usage,
+	})
+}
 
-	return &stats, nil
+type userQuotaBody struct {
+	// limits left out are unchanged, zero removes a limit
+	MaxBytes           *int64 `json:"maxBytes"`
+	MaxContents        *int64 `json:"maxContents"`
+	MaxConcurrentDeals *int64 `json:"maxConcurrentDeals"`
+}
+
+// handleAdminSetUserQuota godoc
+// @Summary      Set a user's quota
+// @Description  This endpoint changes the limits on how much a user can store and how many deals can be in progress for their content at once.
+// @Tags         admin
+// @Produce      json
+// @Param        user path int true "User ID"
+// @Param        body body userQuotaBody true "Quota"
+// @Router       /admin/users/quota/{user} [put]
+func (s *Server) handleAdminSetUserQuota(c echo.Context) error {
+	user, err := strconv.Atoi(c.Param("user"))
+	if err != nil {
+		return err
+	}
+
+	var body userQuotaBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	var u User
+	if err := s.DB.First(&u, "id = ?", user).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_USER_NOT_FOUND,
+				Details: fmt.Sprintf("user %d not found", user),
+			}
+		}
+		return err
+	}
+
+	q, err := getUserQuota(s.DB, u.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range []*int64{body.MaxBytes, body.MaxContents, body.MaxConcurrentDeals} {
+		if v != nil && *v < 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: "quota limits cannot be negative",
+			}
+		}
+	}
+
+	if body.MaxBytes != nil {
+		q.MaxBytes = *body.MaxBytes
+	}
+	if body.MaxContents != nil {
+		q.MaxContents = *body.MaxContents
+	}
+	if body.MaxConcurrentDeals != nil {
+		q.MaxConcurrentDeals = *body.MaxConcurrentDeals
+	}
+
+	if err := setUserQuota(s.DB, q); err != nil {
+		return err
+	}
+
+	return c.JSON(200, q)
+}
+
+type publicStatsResponse struct {
+	TotalStorage     int64 `json:"totalStorage"`
+	TotalFilesStored int64 `json:"totalFiles"`
+	DealsOnChain     int64 `json:"dealsOnChain"`
+}
+
+// handlePublicStats godoc
+// @Summary      Public stats
+// @Description  This endpoint is used to get public stats.
+// @Tags         public
+// @Produce      json
+// @Router       /public/stats [get]
+func (s *Server) handlePublicStats(c echo.Context) error {
+	val, err := s.cacher.Get("public/stats", time.Minute*2, func() (interface{}, error) {
+		return s.computePublicStats()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(200, val)
+}
+
+func (s *Server) computePublicStats() (*publicStatsResponse, error) {
+	var stats publicStatsResponse
+	if err := s.DB.Model(Content{}).Where("active and not aggregated_in > 0").Select("SUM(size) as total_storage").Scan(&stats).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.DB.Model(Content{}).Where("active and not aggregate").Count(&stats.TotalFilesStored).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.DB.Model(contentDeal{}).Where("not failed and deal_id > 0").Count(&stats.DealsOnChain).Error; err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
 }
 
 func (s *Server) handleGetBucketDiag(c echo.Context) error {
@@ -3750,6 +5544,52 @@ func (s *Server) handleSetDealMaking(c echo.Context) error {
 	return c.JSON(200, map[string]string{})
 }
 
+// handleGetDealPause godoc
+// @Summary      Get whether deal making is paused
+// @Description  This endpoint returns whether deal making is paused, why and since when, and how many contents are waiting for it to resume
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/cm/dealmaking/pause [get]
+func (s *Server) handleGetDealPause(c echo.Context) error {
+	return c.JSON(200, s.CM.dealPause.status())
+}
+
+type pauseDealMakingBody struct {
+	Reason string `json:"reason"`
+}
+
+// handlePauseDealMaking godoc
+// @Summary      Pause deal making
+// @Description  This endpoint stops new deals from being proposed until deal making is resumed, deals and transfers already in progress carry on. The pause is kept across restarts.
+// @Tags         admin
+// @Produce      json
+// @Param        body body main.pauseDealMakingBody false "Why deal making is paused"
+// @Router       /admin/cm/dealmaking/pause [post]
+func (s *Server) handlePauseDealMaking(c echo.Context) error {
+	var body pauseDealMakingBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if err := s.CM.PauseDealMaking(body.Reason); err != nil {
+		return err
+	}
+	return c.JSON(200, s.CM.dealPause.status())
+}
+
+// handleResumeDealMaking godoc
+// @Summary      Resume deal making
+// @Description  This endpoint lifts a pause on deal making, the contents that came up for deals while paused are checked again right away
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/cm/dealmaking/resume [post]
+func (s *Server) handleResumeDealMaking(c echo.Context) error {
+	if err := s.CM.ResumeDealMaking(); err != nil {
+		return err
+	}
+	return c.JSON(200, s.CM.dealPause.status())
+}
+
 func (s *Server) handleContentHealthCheck(c echo.Context) error {
 	ctx := c.Request().Context()
 	val, err := strconv.Atoi(c.Param("id"))
@@ -3786,6 +5626,10 @@ func (s *Server) handleContentHealthCheck(c echo.Context) error {
 			return fmt.Errorf("failed to create aggregate: %w", err)
 		}
 
+		if err := s.CM.recordAggregateLayout(cont.ID, nd, children); err != nil {
+			return err
+		}
+
 		// just to be safe, put it into the blockstore again
 		if err := s.Node.Blockstore.Put(ctx, nd); err != nil {
 			return err
@@ -3894,18 +5738,7 @@ func (s *Server) handleContentHealthCheck(c echo.Context) error {
 	dserv := merkledag.NewDAGService(bserv)
 
 	cset := cid.NewSet()
-	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, err
-		}
-
-		if c.Type() == cid.Raw {
-			return nil, nil
-		}
-
-		return node.Links(), nil
-	}, cont.Cid.CID, cset.Visit, merkledag.Concurrent())
+	err = util.WalkDag(ctx, dserv, cont.Cid.CID, cset.Visit, s.CM.dagWalkConcurrency, nil)
 
 	errstr := ""
 	if err != nil {
@@ -3967,18 +5800,7 @@ func (s *Server) handleContentHealthCheckByCid(c echo.Context) error {
 	dserv := merkledag.NewDAGService(bserv)
 
 	cset := cid.NewSet()
-	err = merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, err
-		}
-
-		if c.Type() == cid.Raw {
-			return nil, nil
-		}
-
-		return node.Links(), nil
-	}, cc, cset.Visit, merkledag.Concurrent())
+	err = util.WalkDag(ctx, dserv, cc, cset.Visit, s.CM.dagWalkConcurrency, nil)
 
 	errstr := ""
 	if err != nil {
@@ -4188,151 +6010,582 @@ func (s *Server) handleAutoretrieveHeartbeat(c echo.Context) error {
 		AddrInfo:       addrInfo,
 	}
 
-	return c.JSON(200, out)
+	return c.JSON(200, out)
+}
+
+type allDealsQuery struct {
+	Miner  string
+	Cid    util.DbCID
+	DealID int64
+}
+
+func (s *Server) handleDebugGetAllDeals(c echo.Context) error {
+	var out []allDealsQuery
+	if err := s.DB.Model(contentDeal{}).Where("deal_id > 0 and not content_deals.failed").
+		Joins("left join contents on content_deals.content = contents.id").
+		Select("miner, contents.cid as cid, deal_id").
+		Scan(&out).
+		Error; err != nil {
+		return err
+	}
+	return c.JSON(200, out)
+}
+
+type logLevelBody struct {
+	System string `json:"system"`
+	Level  string `json:"level"`
+}
+
+func (s *Server) handleLogLevel(c echo.Context) error {
+	var body logLevelBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	logging.SetLogLevel(body.System, body.Level)
+
+	return c.JSON(200, map[string]interface{}{})
+}
+
+// handleStorageFailures godoc
+// @Summary      Get storage failures
+// @Description  This endpoint returns a list of storage failures
+// @Tags         deals
+// @Produce      json
+// @Router       /deals/failures [get]
+func (s *Server) handleStorageFailures(c echo.Context) error {
+	limit := 2000
+	if limstr := c.QueryParam("limit"); limstr != "" {
+		nlim, err := strconv.Atoi(limstr)
+		if err != nil {
+			return err
+		}
+		limit = nlim
+	}
+
+	q := s.DB.Model(dfeRecord{}).Limit(limit).Order("created_at desc")
+
+	if bef := c.QueryParam("before"); bef != "" {
+		beftime, err := time.Parse(time.RFC3339, bef)
+		if err != nil {
+			return err
+		}
+
+		q = q.Where("created_at <= ?", beftime)
+	}
+
+	var recs []dfeRecord
+	if err := q.Scan(&recs).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(200, recs)
+}
+
+// handleCreateContent godoc
+// @Summary      Add a new content
+// @Description  This endpoint adds a new content
+// @Tags         content
+// @Produce      json
+// @Param        body body string true "Content"
+// @Router       /content/create [post]
+func (s *Server) handleCreateContent(c echo.Context, u *User) error {
+	var req util.ContentCreateBody
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := checkUserQuota(s.DB, u.ID, 0); err != nil {
+		return err
+	}
+
+	rootCID, err := cid.Decode(req.Root)
+	if err != nil {
+		return err
+	}
+
+	if c.QueryParam("ignore-dupes") == "true" {
+		isDup, err := s.isDupCIDContent(c, rootCID, u)
+		if err != nil || isDup {
+			return err
+		}
+	}
+
+	var col Collection
+	if req.Collection != "" {
+		if err := s.DB.First(&col, "uuid = ?", req.Collection).Error; err != nil {
+			return err
+		}
+
+		if col.UserID != u.ID {
+			return fmt.Errorf("attempted to create content in collection %s not owned by the user (%d)", c, u.ID)
+		}
+	}
+
+	var expiresAt *time.Time
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid ttl %q, must be a positive duration such as 720h", req.TTL),
+			}
+		}
+
+		exp := time.Now().Add(ttl)
+		expiresAt = &exp
+	}
+
+	priority, err := priorityParam(req.Priority, u)
+	if err != nil {
+		return err
+	}
+
+	if err := validMinSuccessRatio(req.MinSuccessRatio); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	var checksum string
+	if req.Checksum != "" {
+		checksum, err = util.ParseChecksum(req.Checksum)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+	}
+
+	content := &Content{
+		Cid:         util.DbCID{CID: rootCID},
+		Name:        req.Name,
+		Active:      false,
+		Pinning:     false,
+		UserID:      u.ID,
+		Replication: s.CM.Replication,
+		Location:    req.Location,
+		ExpiresAt:   expiresAt,
+		Priority:    priority,
+		Type:        req.Type,
+
+		MinSuccessRatio: req.MinSuccessRatio,
+		Checksum:        checksum,
+		Access:          util.ContentAccessOwner,
+	}
+
+	if req.NoDeal {
+		content.Replication = 0
+		content.HotOnly = true
+	}
+
+	if err := s.DB.Create(content).Error; err != nil {
+		return err
+	}
+
+	if req.Collection != "" {
+		var path *string
+		if req.CollectionPath != "" {
+			sp, err := sanitizePath(req.CollectionPath)
+			if err != nil {
+				return err
+			}
+
+			path = &sp
+		}
+
+		if err := s.DB.Create(&CollectionRef{
+			Collection: col.ID,
+			Content:    content.ID,
+			Path:       path,
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(200, util.ContentCreateResponse{
+		ID: content.ID,
+	})
+}
+
+// handlePromoteContent godoc
+// @Summary      Start making deals for hot-only content
+// @Description  This endpoint promotes content created with noDeal so that deals get made for it, optionally with a given replication factor.
+// @Tags         content
+// @Produce      json
+// @Param        id path int true "Content ID"
+// @Param        body body util.ContentPromoteBody false "Promotion options"
+// @Router       /content/promote/{id} [post]
+func (s *Server) handlePromoteContent(c echo.Context, u *User) error {
+	contID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("id")),
+		}
+	}
+
+	var req util.ContentPromoteBody
+	if c.Request().ContentLength > 0 {
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+	}
+
+	if req.Replication < 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: "replication can't be negative",
+		}
+	}
+
+	var content Content
+	if err := s.DB.First(&content, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("content %d not found", contID),
+			}
+		}
+		return err
+	}
+
+	if content.UserID != u.ID && u.Perm < util.PermLevelAdmin {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_NOT_AUTHORIZED,
+		}
+	}
+
+	if !content.HotOnly {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is already having deals made for it", contID),
+		}
+	}
+
+	repl := req.Replication
+	if repl == 0 {
+		repl = s.CM.Replication
+	}
+
+	if err := s.DB.Model(Content{}).Where("id = ?", content.ID).UpdateColumns(map[string]interface{}{
+		"hot_only":    false,
+		"replication": repl,
+	}).Error; err != nil {
+		return err
+	}
+
+	if content.Active {
+		s.CM.queueMgr.add(content.ID, 0)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"id":          content.ID,
+		"replication": repl,
+	})
+}
+
+// contentForDeadline loads the content whose deals a deal deadline applies
+// to, the aggregate for aggregated content
+func (s *Server) contentForDeadline(c echo.Context, u *User) (Content, error) {
+	contID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return Content{}, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("id")),
+		}
+	}
+
+	var content Content
+	if err := s.DB.First(&content, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return Content{}, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("content %d not found", contID),
+			}
+		}
+		return Content{}, err
+	}
+
+	if content.UserID != u.ID && u.Perm < util.PermLevelAdmin {
+		return Content{}, &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_NOT_AUTHORIZED,
+		}
+	}
+
+	return dealsContent(s.DB, content)
+}
+
+// handleSetDealDeadline godoc
+// @Summary      Set the deal deadline of a content
+// @Description  This endpoint sets when a content must be fully replicated by. Its deals then go to the miners that seal fastest, with spare deals in case some fail, and the response says whether the deadline can be met. With reduceReplication the content gets fewer deals if its replication can't be met in time. Aggregated content takes the deadline of its aggregate. Leaving out the deadline clears it.
+// @Tags         content
+// @Produce      json
+// @Param        id path int true "Content ID"
+// @Param        body body util.ContentDeadlineBody true "Deadline"
+// @Router       /content/deadline/{id} [post]
+func (s *Server) handleSetDealDeadline(c echo.Context, u *User) error {
+	var req util.ContentDeadlineBody
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Deadline != nil && !req.Deadline.After(time.Now()) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("deadline %s has already passed", req.Deadline.Format(time.RFC3339)),
+		}
+	}
+
+	content, err := s.contentForDeadline(c, u)
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Model(Content{}).Where("id = ?", content.ID).UpdateColumns(map[string]interface{}{
+		"deal_deadline":               req.Deadline,
+		"deadline_reduce_replication": req.ReduceReplication,
+	}).Error; err != nil {
+		return err
+	}
+
+	if req.Deadline == nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"content": content.ID,
+		})
+	}
+
+	content.DealDeadline = req.Deadline
+	content.DeadlineReduceReplication = req.ReduceReplication
+
+	rep, err := s.CM.dealDeadlineReport(content)
+	if err != nil {
+		return err
+	}
+
+	if content.Active {
+		s.CM.ToCheck <- content.ID
+	}
+
+	return c.JSON(http.StatusOK, rep)
+}
+
+// handleGetDealDeadline godoc
+// @Summary      Check on the deal deadline of a content
+// @Description  This endpoint reports whether a content can still be replicated by its deal deadline: its sealed deals, the deals in progress expected to seal in time and the miners expected to seal new deals in time, fastest first.
+// @Tags         content
+// @Produce      json
+// @Param        id path int true "Content ID"
+// @Router       /content/deadline/{id} [get]
+func (s *Server) handleGetDealDeadline(c echo.Context, u *User) error {
+	content, err := s.contentForDeadline(c, u)
+	if err != nil {
+		return err
+	}
+
+	if content.DealDeadline == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Message: util.ERR_RECORD_NOT_FOUND,
+			Details: fmt.Sprintf("content %d has no deal deadline", content.ID),
+		}
+	}
+
+	rep, err := s.CM.dealDeadlineReport(content)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, rep)
 }
 
-type allDealsQuery struct {
-	Miner  string
-	Cid    util.DbCID
-	DealID int64
+type contentAccessResponse struct {
+	Content uint     `json:"content"`
+	Access  string   `json:"access"`
+	Users   []string `json:"users,omitempty"`
 }
 
-func (s *Server) handleDebugGetAllDeals(c echo.Context) error {
-	var out []allDealsQuery
-	if err := s.DB.Model(contentDeal{}).Where("deal_id > 0 and not content_deals.failed").
-		Joins("left join contents on content_deals.content = contents.id").
-		Select("miner, contents.cid as cid, deal_id").
-		Scan(&out).
-		Error; err != nil {
-		return err
+// contentForAccess loads the content whose access is looked at or changed,
+// which only its owner and admins may do
+func (s *Server) contentForAccess(c echo.Context, u *User) (Content, error) {
+	contID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return Content{}, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("id")),
+		}
 	}
-	return c.JSON(200, out)
-}
-
-type logLevelBody struct {
-	System string `json:"system"`
-	Level  string `json:"level"`
-}
 
-func (s *Server) handleLogLevel(c echo.Context) error {
-	var body logLevelBody
-	if err := c.Bind(&body); err != nil {
-		return err
+	var content Content
+	if err := s.DB.First(&content, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return Content{}, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("content %d not found", contID),
+			}
+		}
+		return Content{}, err
 	}
 
-	logging.SetLogLevel(body.System, body.Level)
+	if content.UserID != u.ID && u.Perm < util.PermLevelAdmin {
+		return Content{}, &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_NOT_AUTHORIZED,
+		}
+	}
 
-	return c.JSON(200, map[string]interface{}{})
+	return content, nil
 }
 
-// handleStorageFailures godoc
-// @Summary      Get storage failures
-// @Description  This endpoint returns a list of storage failures
-// @Tags         deals
-// @Produce      json
-// @Router       /deals/failures [get]
-func (s *Server) handleStorageFailures(c echo.Context) error {
-	limit := 2000
-	if limstr := c.QueryParam("limit"); limstr != "" {
-		nlim, err := strconv.Atoi(limstr)
-		if err != nil {
-			return err
-		}
-		limit = nlim
+func (s *Server) contentAccessResponse(content Content) (*contentAccessResponse, error) {
+	resp := &contentAccessResponse{
+		Content: content.ID,
+		Access:  content.Access,
 	}
 
-	q := s.DB.Model(dfeRecord{}).Limit(limit).Order("created_at desc")
+	if contentIsPublic(content) {
+		resp.Access = util.ContentAccessPublic
+	}
 
-	if bef := c.QueryParam("before"); bef != "" {
-		beftime, err := time.Parse(time.RFC3339, bef)
-		if err != nil {
-			return err
+	if content.Access == util.ContentAccessShared {
+		if err := s.DB.Model(User{}).
+			Joins("join content_access_grants on content_access_grants.user_id = users.id").
+			Where("content_access_grants.content = ?", content.ID).
+			Order("users.username").
+			Pluck("users.username", &resp.Users).Error; err != nil {
+			return nil, err
 		}
+	}
 
-		q = q.Where("created_at <= ?", beftime)
+	return resp, nil
+}
+
+// handleGetContentAccess godoc
+// @Summary      Get who may see a content
+// @Description  This endpoint returns the access of a content: owner for its owner only, shared for its owner and the users listed, or public for anyone.
+// @Tags         content
+// @Produce      json
+// @Param        id path int true "Content ID"
+// @Router       /content/access/{id} [get]
+func (s *Server) handleGetContentAccess(c echo.Context, u *User) error {
+	content, err := s.contentForAccess(c, u)
+	if err != nil {
+		return err
 	}
 
-	var recs []dfeRecord
-	if err := q.Scan(&recs).Error; err != nil {
+	resp, err := s.contentAccessResponse(content)
+	if err != nil {
 		return err
 	}
 
-	return c.JSON(200, recs)
+	return c.JSON(http.StatusOK, resp)
 }
 
-// handleCreateContent godoc
-// @Summary      Add a new content
-// @Description  This endpoint adds a new content
+// handleSetContentAccess godoc
+// @Summary      Set who may see a content
+// @Description  This endpoint sets the access of a content: owner for its owner only, the default for new content, shared for its owner and the users listed, or public for anyone, including requests without a token. Users who may not see a content don't get it listed, its status or its data through the gateway. The parts of a split content follow it.
 // @Tags         content
 // @Produce      json
-// @Param        body body string true "Content"
-// @Router       /content/create [post]
-func (s *Server) handleCreateContent(c echo.Context, u *User) error {
-	var req util.ContentCreateBody
+// @Param        id path int true "Content ID"
+// @Param        body body util.ContentAccessBody true "Access"
+// @Router       /content/access/{id} [put]
+func (s *Server) handleSetContentAccess(c echo.Context, u *User) error {
+	var req util.ContentAccessBody
 	if err := c.Bind(&req); err != nil {
 		return err
 	}
 
-	rootCID, err := cid.Decode(req.Root)
+	if !validContentAccess(req.Access) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid access %q, must be %s, %s or %s", req.Access, util.ContentAccessOwner, util.ContentAccessShared, util.ContentAccessPublic),
+		}
+	}
+
+	if len(req.Users) > 0 && req.Access != util.ContentAccessShared {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("users can only be given with %s access", util.ContentAccessShared),
+		}
+	}
+
+	content, err := s.contentForAccess(c, u)
 	if err != nil {
 		return err
 	}
 
-	if c.QueryParam("ignore-dupes") == "true" {
-		isDup, err := s.isDupCIDContent(c, rootCID, u)
-		if err != nil || isDup {
-			return err
+	var users []uint
+	seen := make(map[string]bool)
+	for _, name := range req.Users {
+		if seen[name] {
+			continue
 		}
-	}
+		seen[name] = true
 
-	var col Collection
-	if req.Collection != "" {
-		if err := s.DB.First(&col, "uuid = ?", req.Collection).Error; err != nil {
+		var user User
+		if err := s.DB.First(&user, "username = ?", name).Error; err != nil {
+			if xerrors.Is(err, gorm.ErrRecordNotFound) {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Message: util.ERR_USER_NOT_FOUND,
+					Details: fmt.Sprintf("user %q not found", name),
+				}
+			}
 			return err
 		}
 
-		if col.UserID != u.ID {
-			return fmt.Errorf("attempted to create content in collection %s not owned by the user (%d)", c, u.ID)
+		// the owner can see it anyway
+		if user.ID != content.UserID {
+			users = append(users, user.ID)
 		}
 	}
 
-	content := &Content{
-		Cid:         util.DbCID{CID: rootCID},
-		Name:        req.Name,
-		Active:      false,
-		Pinning:     false,
-		UserID:      u.ID,
-		Replication: s.CM.Replication,
-		Location:    req.Location,
+	if err := setContentAccess(s.DB, content, req.Access, users); err != nil {
+		return err
 	}
 
-	if err := s.DB.Create(content).Error; err != nil {
+	content.Access = req.Access
+	resp, err := s.contentAccessResponse(content)
+	if err != nil {
 		return err
 	}
 
-	if req.Collection != "" {
-		var path *string
-		if req.CollectionPath != "" {
-			sp, err := sanitizePath(req.CollectionPath)
-			if err != nil {
-				return err
-			}
+	return c.JSON(http.StatusOK, resp)
+}
 
-			path = &sp
-		}
+// handleListSharedContent godoc
+// @Summary      List content shared with the user
+// @Description  This endpoint lists the active content other users have shared with the user
+// @Tags         content
+// @Produce      json
+// @Router       /content/shared [get]
+func (s *Server) handleListSharedContent(c echo.Context, u *User) error {
+	grants := s.DB.Model(contentAccessGrant{}).Select("content").Where("user_id = ?", u.ID)
 
-		if err := s.DB.Create(&CollectionRef{
-			Collection: col.ID,
-			Content:    content.ID,
-			Path:       path,
-		}).Error; err != nil {
-			return err
-		}
+	var contents []Content
+	if err := s.DB.Find(&contents, "active and access = ? and user_id != ? and id in (?)", util.ContentAccessShared, u.ID, grants).Error; err != nil {
+		return err
 	}
 
-	return c.JSON(200, util.ContentCreateResponse{
-		ID: content.ID,
-	})
+	return c.JSON(http.StatusOK, contents)
 }
 
 type claimMinerBody struct {
@@ -4438,7 +6691,7 @@ func (s *Server) checkNewMiner(ctx context.Context, addr address.Address) error
 		return fmt.Errorf("miner must have at least 1TiB of power to be considered by estuary")
 	}
 
-	ask, err := s.FilClient.GetAsk(ctx, addr)
+	ask, err := s.CM.queryAsk(ctx, addr)
 	if err != nil {
 		return fmt.Errorf("failed to get ask from miner: %w", err)
 	}
@@ -4541,18 +6794,7 @@ func (s *Server) handleAdminBreakAggregate(c echo.Context) error {
 		for _, c := range children {
 
 			cset := cid.NewSet()
-			err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-				node, err := dserv.Get(ctx, c)
-				if err != nil {
-					return nil, err
-				}
-
-				if c.Type() == cid.Raw {
-					return nil, nil
-				}
-
-				return node.Links(), nil
-			}, cont.Cid.CID, cset.Visit, merkledag.Concurrent())
+			err := util.WalkDag(ctx, dserv, cont.Cid.CID, cset.Visit, s.CM.dagWalkConcurrency, nil)
 			res := map[string]interface{}{
 				"content":     c,
 				"foundBlocks": cset.Len(),
@@ -4568,23 +6810,62 @@ func (s *Server) handleAdminBreakAggregate(c echo.Context) error {
 		})
 	}
 
-	if err := s.DB.Model(Content{}).Where("aggregated_in = ?", aggr).UpdateColumns(map[string]interface{}{
-		"aggregated_in": 0,
-	}).Error; err != nil {
+	if err := s.CM.breakAggregate(uint(aggr)); err != nil {
 		return err
 	}
 
-	if err := s.DB.Model(Content{}).Where("id = ?", aggr).UpdateColumns(map[string]interface{}{
-		"active": false,
-	}).Error; err != nil {
+	return c.JSON(200, map[string]string{})
+}
+
+// handleAdminGetAggregationStatus godoc
+// @Summary      Get aggregation status
+// @Description  This endpoint shows how much small content is waiting to be aggregated, how many aggregates are still waiting for a deal and how long aggregated content takes to get one
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/cm/aggregation-status [get]
+func (s *Server) handleAdminGetAggregationStatus(c echo.Context) error {
+	st, err := s.CM.aggregationStatus(c.Request().Context())
+	if err != nil {
 		return err
 	}
 
-	return c.JSON(200, map[string]string{})
+	return c.JSON(200, st)
+}
+
+// handleAdminGetAggregateFaults godoc
+// @Summary      Get aggregate faults
+// @Description  This endpoint lists faulted aggregate deals grouped by aggregate, along with the member contents each fault affected
+// @Tags         admin
+// @Produce      json
+// @Param        aggregate query int false "Only show faults for this aggregate"
+// @Router       /admin/cm/aggregate-faults [get]
+func (s *Server) handleAdminGetAggregateFaults(c echo.Context) error {
+	var aggr int
+	if a := c.QueryParam("aggregate"); a != "" {
+		v, err := strconv.Atoi(a)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid aggregate: %s", err),
+			}
+		}
+		aggr = v
+	}
+
+	sums, err := s.CM.aggregateFaultSummaries(uint(aggr))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, sums)
 }
 
 type publicNodeInfo struct {
 	PrimaryAddress address.Address `json:"primaryAddress"`
+
+	// where to retrieve content from us, if we serve retrievals
+	RetrievalProvider *peer.AddrInfo `json:"retrievalProvider,omitempty"`
 }
 
 // handleGetPublicNodeInfo godoc
@@ -4594,9 +6875,84 @@ type publicNodeInfo struct {
 // @Produce      json
 // @Router       /public/info [get]
 func (s *Server) handleGetPublicNodeInfo(c echo.Context) error {
-	return c.JSON(200, &publicNodeInfo{
-		PrimaryAddress: s.FilClient.ClientAddr,
-	})
+	info := &publicNodeInfo{
+		PrimaryAddress: s.CM.dealAddr(),
+	}
+
+	if s.RetrievalProvider != nil {
+		ai := s.RetrievalProvider.AddrInfo()
+		info.RetrievalProvider = &ai
+	}
+
+	return c.JSON(200, info)
+}
+
+// handleFindProviders godoc
+// @Summary      Find providers of a cid
+// @Description  This endpoint asks the network indexer which providers advertise a cid, and returns their peer IDs, miner addresses where known and the retrieval protocols they support
+// @Tags         public
+// @Produce      json
+// @Param        cid path string true "Cid"
+// @Router       /public/providers/{cid} [get]
+func (s *Server) handleFindProviders(c echo.Context) error {
+	cc, err := cid.Decode(c.Param("cid"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid cid: %s", err),
+		}
+	}
+
+	provs, err := s.CM.findProviders(c.Request().Context(), cc)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, provs)
+}
+
+// handleResolveName godoc
+// @Summary      Resolve an IPNS or DNSLink name
+// @Description  This endpoint resolves an IPNS key or DNSLink domain, optionally followed by a path, to the cid it points at. It returns the cid, the rest of the path and how many seconds the answer can be relied on for.
+// @Tags         content
+// @Produce      json
+// @Param        name query string true "IPNS key, DNSLink domain or /ipns/ path"
+// @Router       /content/resolve [get]
+func (s *Server) handleResolveName(c echo.Context) error {
+	name := strings.TrimSpace(c.QueryParam("name"))
+	if name == "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: "must specify a name to resolve",
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), resolveTimeout)
+	defer cancel()
+
+	res, err := s.resolver.resolve(ctx, name)
+	if err != nil {
+		switch {
+		case xerrors.Is(err, errInvalidName):
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Message: util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		case xerrors.Is(err, errNameNotResolved), xerrors.Is(err, context.DeadlineExceeded):
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Message: util.ERR_RECORD_NOT_FOUND,
+				Details: err.Error(),
+			}
+		default:
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
 }
 
 type retrievalCandidate struct {
@@ -4622,7 +6978,7 @@ func (s *Server) handleGetRetrievalCandidates(c echo.Context) error {
 	if err := s.DB.
 		Table("content_deals").
 		Where("content IN (?) AND NOT content_deals.failed",
-			s.DB.Table("contents").Select("CASE WHEN @aggregated_in = 0 THEN id ELSE aggregated_in END").Where("id in (?)",
+			accessibleContents(s.DB.Table("contents"), nil).Select("CASE WHEN @aggregated_in = 0 THEN id ELSE aggregated_in END").Where("id in (?)",
 				s.DB.Table("obj_refs").Select("content").Where(
 					"object IN (?)", s.DB.Table("objects").Select("id").Where("cid = ?", util.DbCID{CID: cid}),
 				),
@@ -4667,10 +7023,18 @@ func (s *Server) handleShuttleCreateContent(c echo.Context) error {
 		UserID:      req.User,
 		Replication: s.CM.Replication,
 		Location:    req.Location,
+		Access:      util.ContentAccessOwner,
 	}
 	if req.DagSplitRoot != 0 {
 		content.DagSplit = true
 		content.SplitFrom = req.DagSplitRoot
+
+		// the parts of a split content can be seen by whoever can see it
+		var root Content
+		if err := s.DB.First(&root, "id = ?", req.DagSplitRoot).Error; err != nil {
+			return err
+		}
+		content.Access = root.Access
 	}
 
 	if err := s.DB.Create(content).Error; err != nil {
@@ -4782,6 +7146,7 @@ type collectionListQueryRes struct {
 	Size     int64
 	Path     *string
 	Type     util.ContentType
+	MimeType string
 	Filename *string
 }
 
@@ -4794,11 +7159,12 @@ const (
 )
 
 type collectionListResponse struct {
-	Name   string      `json:"name"`
-	Type   CidType     `json:"type"`
-	Size   int64       `json:"size"`
-	ContID uint        `json:"contId"`
-	Cid    *util.DbCID `json:"cid,omitempty"`
+	Name     string      `json:"name"`
+	Type     CidType     `json:"type"`
+	MimeType string      `json:"mimeType,omitempty"`
+	Size     int64       `json:"size"`
+	ContID   uint        `json:"contId"`
+	Cid      *util.DbCID `json:"cid,omitempty"`
 }
 
 // handleColfsListDir godoc
@@ -4836,7 +7202,7 @@ func (s *Server) handleColfsListDir(c echo.Context, u *User) error {
 	if err := s.DB.Model(CollectionRef{}).
 		Joins("left join contents on contents.id = collection_refs.content").
 		Where("collection = ?", col.ID).
-		Select("contents.id as cont_id, contents.cid as cid, contents.name as filename, path, size, contents.type").
+		Select("contents.id as cont_id, contents.cid as cid, contents.name as filename, path, size, contents.type, contents.mime_type").
 		Scan(&refs).Error; err != nil {
 		return err
 	}
@@ -4899,11 +7265,12 @@ func (s *Server) handleColfsListDir(c echo.Context, u *User) error {
 			}
 			out = append(out, collectionListResponse{
 				// Name: filepath.Base(relp),
-				Name:   *r.Filename,
-				Type:   contentType,
-				Size:   r.Size,
-				ContID: r.ContID,
-				Cid:    &util.DbCID{r.Cid.CID},
+				Name:     *r.Filename,
+				Type:     contentType,
+				MimeType: r.MimeType,
+				Size:     r.Size,
+				ContID:   r.ContID,
+				Cid:      &util.DbCID{r.Cid.CID},
 			})
 			continue
 		}
@@ -5023,12 +7390,27 @@ func (s *Server) handleGateway(c echo.Context) error {
 		return err
 	}
 
+	if err := s.checkGatewayAccess(c, cc); err != nil {
+		return err
+	}
+
 	redir, err := s.checkGatewayRedirect(proto, cc, segs)
 	if err != nil {
 		return err
 	}
 
 	if redir == "" {
+		if len(segs) == 0 {
+			mt, err := s.contentMimeType(cc)
+			if err != nil {
+				return err
+			}
+
+			// the gateway falls back to sniffing the data itself
+			if mt != "" {
+				c.Response().Header().Set(echo.HeaderContentType, mt)
+			}
+		}
 
 		req := c.Request().Clone(c.Request().Context())
 		req.URL.Path = npath
@@ -5040,8 +7422,68 @@ func (s *Server) handleGateway(c echo.Context) error {
 	return c.Redirect(307, redir)
 }
 
+// checkGatewayAccess keeps the gateway from serving, or redirecting to a
+// shuttle serving, data only held by contents the caller may not see. A token
+// is optional, without one only the data of public contents is served. Data
+// none of our contents hold is served as before.
+func (s *Server) checkGatewayAccess(c echo.Context, cc cid.Cid) error {
+	var u *User
+	if c.Request().Header.Get("Authorization") != "" {
+		auth, err := util.ExtractAuth(c)
+		if err != nil {
+			return err
+		}
+
+		u, err = s.checkTokenAuth(auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	var allowed []Content
+	if err := accessibleContents(contentsHoldingCid(s.DB, cc), u).Select("contents.id").Limit(1).Find(&allowed).Error; err != nil {
+		return err
+	}
+
+	if len(allowed) > 0 {
+		return nil
+	}
+
+	var held []Content
+	if err := contentsHoldingCid(s.DB, cc).Select("contents.id").Limit(1).Find(&held).Error; err != nil {
+		return err
+	}
+
+	if len(held) > 0 {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_NOT_AUTHORIZED,
+			Details: fmt.Sprintf("%s is not public", cc),
+		}
+	}
+	return nil
+}
+
+// contentMimeType returns the media type detected when cc was added, if it
+// is a file we know the type of
+func (s *Server) contentMimeType(cc cid.Cid) (string, error) {
+	var conts []Content
+	if err := s.DB.Limit(1).Find(&conts, "cid = ? and active and mime_type != '' and mime_type != ?", &util.DbCID{cc}, util.DirectoryMimeType).Error; err != nil {
+		return "", err
+	}
+
+	if len(conts) == 0 {
+		return "", nil
+	}
+	return conts[0].MimeType, nil
+}
+
 const bestGateway = "dweb.link"
 
+// gatewayGrantTTL is how long the link a gateway request is redirected to on
+// a shuttle works for
+const gatewayGrantTTL = time.Hour
+
 func (s *Server) checkGatewayRedirect(proto string, cc cid.Cid, segs []string) (string, error) {
 	if proto != "ipfs" {
 		return fmt.Sprintf("https://%s/%s/%s/%s", bestGateway, proto, cc, strings.Join(segs, "/")), nil
@@ -5068,7 +7510,9 @@ func (s *Server) checkGatewayRedirect(proto string, cc cid.Cid, segs []string) (
 		return "", err
 	}
 
-	return fmt.Sprintf("https://%s/gw/%s/%s/%s", shuttle.Host, proto, cc, strings.Join(segs, "/")), nil
+	// the shuttle only serves what we grant, having checked access already
+	grant := util.GatewayGrant(shuttle.Token, cc, time.Now().Add(gatewayGrantTTL))
+	return fmt.Sprintf("https://%s/gw/%s/%s/%s?%s=%s", shuttle.Host, proto, cc, strings.Join(segs, "/"), util.GatewayGrantParam, grant), nil
 }
 
 func (s *Server) isDupCIDContent(c echo.Context, rootCID cid.Cid, u *User) (bool, error) {
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// how long our peer ID to miner mapping is trusted before it is rebuilt, how
+// long a rebuild may take, and how long the peer ID of each miner is kept
+// across rebuilds
+const (
+	peerMinersRefreshInterval = time.Hour
+	peerMinersRebuildTimeout  = time.Minute * 10
+	minerPeerIDTTL            = time.Hour * 24
+)
+
+// Indexer answers for popular CIDs can list thousands of providers, only the
+// first ones are returned, and only so much of the answer is read
+const (
+	maxIndexerProviders    = 100
+	maxIndexerResponseSize = 16 << 20
+)
+
+var indexerClient = &http.Client{Timeout: time.Second * 30}
+
+// transport multicodecs found at the start of indexer provider metadata
+var indexerProtocols = map[uint64]string{
+	0x0900: "bitswap",
+	0x0910: "graphsync",
+	0x0920: "http",
+}
+
+type indexerProvider struct {
+	PeerID    string   `json:"peerId"`
+	Addrs     []string `json:"addrs"`
+	Miner     string   `json:"miner,omitempty"`
+	Protocols []string `json:"protocols"`
+}
+
+type indexerFindResponse struct {
+	MultihashResults []struct {
+		ProviderResults []struct {
+			Metadata []byte
+			Provider struct {
+				ID    string
+				Addrs []string
+			}
+		}
+	}
+}
+
+// findProviders asks the network indexer which providers advertise a CID.
+// Providers we know as storage miners have their miner address filled in.
+func (cm *ContentManager) findProviders(ctx context.Context, c cid.Cid) ([]indexerProvider, error) {
+	ctx, span := cm.tracer.Start(ctx, "findProviders", trace.WithAttributes(
+		attribute.Stringer("cid", c),
+	))
+	defer span.End()
+
+	if cm.indexerURL == "" {
+		return nil, fmt.Errorf("no indexer configured")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(cm.indexerURL, "/")+"/cid/"+c.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := indexerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// the indexer answers 404 for CIDs nobody advertises
+	if resp.StatusCode == http.StatusNotFound {
+		return []indexerProvider{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("indexer returned status %s", resp.Status)
+	}
+
+	var ifr indexerFindResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxIndexerResponseSize)).Decode(&ifr); err != nil {
+		return nil, fmt.Errorf("decoding indexer response: %w", err)
+	}
+
+	// a provider shows up once for every advertisement that included the
+	// CID, merge those into one entry per provider
+	out := []indexerProvider{}
+	byPeer := make(map[string]int)
+	for _, mhr := range ifr.MultihashResults {
+		for _, pr := range mhr.ProviderResults {
+			i, ok := byPeer[pr.Provider.ID]
+			if !ok {
+				if len(out) >= maxIndexerProviders {
+					continue
+				}
+
+				i = len(out)
+				byPeer[pr.Provider.ID] = i
+				out = append(out, indexerProvider{
+					PeerID: pr.Provider.ID,
+					Addrs:  pr.Provider.Addrs,
+				})
+			}
+
+			proto := metadataProtocol(pr.Metadata)
+			if !containsString(out[i].Protocols, proto) {
+				out[i].Protocols = append(out[i].Protocols, proto)
+			}
+		}
+	}
+
+	peerMiners, err := cm.minersByPeer(ctx)
+	if err != nil {
+		log.Warnf("failed to look up the peers of miners: %s", err)
+		return out, nil
+	}
+
+	for i := range out {
+		pid, err := peer.Decode(out[i].PeerID)
+		if err != nil {
+			continue
+		}
+
+		if maddr, ok := peerMiners[pid]; ok {
+			out[i].Miner = maddr.String()
+		}
+	}
+
+	return out, nil
+}
+
+// metadataProtocol reads the transport an indexer advertisement was made for
+// from the varint prefix of its metadata
+func metadataProtocol(md []byte) string {
+	code, n := binary.Uvarint(md)
+	if n <= 0 {
+		return "unknown"
+	}
+
+	if p, ok := indexerProtocols[code]; ok {
+		return p
+	}
+	return fmt.Sprintf("unknown (0x%x)", code)
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type minerPeerID struct {
+	peer    *peer.ID
+	fetched time.Time
+}
+
+// peerMinersRebuild is a rebuild of the peer ID to miner mapping, done is
+// closed once pm and err are set
+type peerMinersRebuild struct {
+	done chan struct{}
+	pm   map[peer.ID]address.Address
+	err  error
+}
+
+// minersByPeer maps libp2p peer IDs to the storage miners using them. Only
+// miners in our database are considered, the chain has no reverse lookup.
+// The map is rebuilt every peerMinersRefreshInterval, without holding up the
+// lookups that come in meanwhile, and only miners whose peer ID we haven't
+// looked up within minerPeerIDTTL are looked up again. Only one rebuild runs
+// at a time, lookups made before there is any map wait for it.
+func (cm *ContentManager) minersByPeer(ctx context.Context) (map[peer.ID]address.Address, error) {
+	cm.peerMinersLk.Lock()
+	pm := cm.peerMiners
+	if pm != nil && time.Since(cm.peerMinersTime) < peerMinersRefreshInterval {
+		cm.peerMinersLk.Unlock()
+		return pm, nil
+	}
+
+	rb := cm.peerMinersRebuild
+	if rb == nil {
+		rb = &peerMinersRebuild{done: make(chan struct{})}
+		cm.peerMinersRebuild = rb
+		go cm.rebuildMinersByPeer(rb)
+	}
+	cm.peerMinersLk.Unlock()
+
+	if pm != nil {
+		return pm, nil
+	}
+
+	select {
+	case <-rb.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if rb.pm == nil {
+		return nil, rb.err
+	}
+	return rb.pm, nil
+}
+
+// rebuildMinersByPeer runs a rebuild of the peer ID to miner mapping. It
+// isn't tied to the lookup that started it, whose request may end first.
+// A map missing miners whose peer ID couldn't be looked up is handed to the
+// lookups waiting for it but isn't kept, the next lookup rebuilds it.
+func (cm *ContentManager) rebuildMinersByPeer(rb *peerMinersRebuild) {
+	ctx, cancel := context.WithTimeout(context.Background(), peerMinersRebuildTimeout)
+	defer cancel()
+
+	rb.pm, rb.err = cm.lookupMinersByPeer(ctx)
+
+	cm.peerMinersLk.Lock()
+	if rb.err == nil {
+		cm.peerMiners = rb.pm
+		cm.peerMinersTime = time.Now()
+	}
+	cm.peerMinersRebuild = nil
+	cm.peerMinersLk.Unlock()
+
+	if rb.err != nil {
+		log.Warnf("failed to build peer ID to miner mapping: %s", rb.err)
+	}
+	close(rb.done)
+}
+
+// lookupMinersByPeer looks up the peer ID of every miner we know of. The map
+// is returned with an error if some of them couldn't be looked up.
+func (cm *ContentManager) lookupMinersByPeer(ctx context.Context) (map[peer.ID]address.Address, error) {
+	var miners []storageMiner
+	if err := cm.DB.WithContext(ctx).Find(&miners).Error; err != nil {
+		return nil, err
+	}
+
+	pm := make(map[peer.ID]address.Address)
+	var failed int
+	var lastErr error
+	for _, m := range miners {
+		pid, err := cm.minerPeer(ctx, m.Address.Addr)
+		if err != nil {
+			log.Warnf("failed to get miner info for %s: %s", m.Address.Addr, err)
+			failed++
+			lastErr = err
+			continue
+		}
+
+		if pid != nil {
+			pm[*pid] = m.Address.Addr
+		}
+	}
+
+	if failed > 0 {
+		return pm, fmt.Errorf("failed to look up the peer ID of %d of %d miners: %w", failed, len(miners), lastErr)
+	}
+	return pm, nil
+}
+
+// minerPeer returns the peer ID the miner has set on chain, nil if it has
+// none, looked up at most every minerPeerIDTTL
+func (cm *ContentManager) minerPeer(ctx context.Context, m address.Address) (*peer.ID, error) {
+	cm.peerMinersLk.Lock()
+	cached, ok := cm.minerPeerIDs[m]
+	cm.peerMinersLk.Unlock()
+	if ok && time.Since(cached.fetched) < minerPeerIDTTL {
+		return cached.peer, nil
+	}
+
+	minfo, err := cm.Api.StateMinerInfo(ctx, m, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.peerMinersLk.Lock()
+	cm.minerPeerIDs[m] = minerPeerID{peer: minfo.PeerId, fetched: time.Now()}
+	cm.peerMinersLk.Unlock()
+	return minfo.PeerId, nil
+}
+
+// indexedMiners returns the miners the indexer says are providing a CID, for
+// retrievals of content we don't have deals for
+func (cm *ContentManager) indexedMiners(ctx context.Context, c cid.Cid) ([]address.Address, error) {
+	provs, err := cm.findProviders(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []address.Address
+	for _, p := range provs {
+		if p.Miner == "" || !containsString(p.Protocols, "graphsync") {
+			continue
+		}
+
+		maddr, err := address.NewFromString(p.Miner)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, maddr)
+	}
+
+	return out, nil
+}
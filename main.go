@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"go.opencensus.io/stats/view"
@@ -21,10 +26,12 @@ import (
 	"github.com/application-research/estuary/util"
 	"github.com/application-research/estuary/util/gateway"
 	"github.com/application-research/filclient"
+	"github.com/dustin/go-humanize"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
 	gsimpl "github.com/ipfs/go-graphsync/impl"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/labstack/echo/v4"
 	routed "github.com/libp2p/go-libp2p/p2p/host/routed"
 	"github.com/mitchellh/go-homedir"
 	"github.com/multiformats/go-multiaddr"
@@ -36,6 +43,7 @@ import (
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
 	lcli "github.com/filecoin-project/lotus/cli"
 	cli "github.com/urfave/cli/v2"
 
@@ -60,6 +68,25 @@ type storageMiner struct {
 	Version         string
 	Location        string
 	Owner           uint
+
+	// range of deal durations in epochs the miner accepts, zero means the
+	// miner follows the chain's limits
+	MinDealDuration int64
+	MaxDealDuration int64
+
+	// range of padded piece sizes the miner prefers deals of, zero means
+	// they are learned from its deal history or ask, see minerDealSizeRange
+	MinDealSize int64
+	MaxDealSize int64
+
+	// dialed instead of the multiaddrs on chain when those are stale, see
+	// connectMinerOverride
+	Multiaddr string
+
+	// set when the miner last turned a proposal down because it isn't
+	// taking new deals, see notAcceptingDeals
+	NotAcceptingSince  *time.Time
+	NotAcceptingReason string
 }
 
 type Content struct {
@@ -74,6 +101,7 @@ type Content struct {
 	Description string           `json:"description"`
 	Size        int64            `json:"size"`
 	Type        util.ContentType `json:"type"`
+	MimeType    string           `json:"mimeType,omitempty"`
 	Path        string           `json:"path"`
 	Active      bool             `json:"active"`
 	Offloaded   bool             `json:"offloaded"`
@@ -102,6 +130,48 @@ type Content struct {
 	// them (unlike with aggregates)
 	DagSplit  bool `json:"dagSplit"`
 	SplitFrom uint `json:"splitFrom"`
+
+	// If set, the configured expiry action is applied to this content once
+	// this time has passed
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" gorm:"index"`
+
+	// If set, this content is only pinned and served over ipfs, no deals are
+	// made for it until it is promoted
+	HotOnly bool `json:"hotOnly"`
+
+	// If set, deals for this content go to miners expected to seal before
+	// this time, see dealDeadlineReport. With DeadlineReduceReplication the
+	// content gets fewer deals if its replication can't be met in time.
+	DealDeadline              *time.Time `json:"dealDeadline,omitempty"`
+	DeadlineReduceReplication bool       `json:"deadlineReduceReplication,omitempty"`
+
+	// Contents with a higher priority are checked for deals before others,
+	// see the priority tiers. Aggregates get the highest priority of the
+	// contents in them.
+	Priority int `json:"priority"`
+
+	// If set, deals for this content only go to miners with at least this
+	// success ratio, instead of the configured one. Aggregates get the
+	// highest ratio of the contents in them.
+	MinSuccessRatio float64 `json:"minSuccessRatio,omitempty"`
+
+	// Checksum of the file's bytes as uploaded, see util.Checksummer. Only
+	// set for files imported by us or created with one.
+	Checksum string `json:"checksum,omitempty"`
+
+	// When the content got through each stage of onboarding after being
+	// added, see markOnboardingStage. Aggregated content gets the stages of its
+	// aggregate's deals, so the time to the first proposal includes the
+	// time spent waiting to be aggregated.
+	FirstDealProposedAt *time.Time `json:"firstDealProposedAt,omitempty"`
+	FirstTransferredAt  *time.Time `json:"firstTransferredAt,omitempty"`
+	FirstSealedAt       *time.Time `json:"firstSealedAt,omitempty"`
+	ReplicatedAt        *time.Time `json:"replicatedAt,omitempty"`
+
+	// Who may see the content, one of the util.ContentAccess values, see
+	// canAccessContent. Content added before access control existed has
+	// none and stays public, as all content was then.
+	Access string `json:"access"`
 }
 
 type Object struct {
@@ -150,7 +220,7 @@ func (s *Server) updateAutoretrieveIndex(tickInterval time.Duration, quit chan s
 		case <-ticker.C:
 			continue
 		case <-quit:
-			break
+			return nil
 		}
 	}
 }
@@ -169,6 +239,20 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.DataDir = cctx.String("datadir")
 		case "blockstore":
 			cfg.NodeConfig.Blockstore = cctx.String("blockstore")
+		case "s3-endpoint":
+			cfg.NodeConfig.S3Config.Endpoint = cctx.String("s3-endpoint")
+		case "s3-region":
+			cfg.NodeConfig.S3Config.Region = cctx.String("s3-region")
+		case "s3-access-key":
+			cfg.NodeConfig.S3Config.AccessKey = cctx.String("s3-access-key")
+		case "s3-secret-key":
+			cfg.NodeConfig.S3Config.SecretKey = cctx.String("s3-secret-key")
+		case "s3-cache-size":
+			cfg.NodeConfig.S3Config.CacheSize = cctx.Int64("s3-cache-size")
+		case "blockstore-soft-cap":
+			cfg.BlockstoreLimits.SoftCap = cctx.Int64("blockstore-soft-cap")
+		case "blockstore-hard-cap":
+			cfg.BlockstoreLimits.HardCap = cctx.Int64("blockstore-hard-cap")
 		case "no-blockstore-cache":
 			cfg.NodeConfig.NoBlockstoreCache = cctx.Bool("no-blockstore-cache")
 		case "write-log-truncate":
@@ -207,10 +291,106 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.DealConfig.Disable = cctx.Bool("disable-deal-making")
 		case "verified-deal":
 			cfg.DealConfig.Verified = cctx.Bool("verified-deal")
+		case "max-inflight-transfers":
+			cfg.DealConfig.MaxInflightTransfers = cctx.Int("max-inflight-transfers")
+		case "miner-selection-strategy":
+			cfg.DealConfig.MinerSelectionStrategy = cctx.String("miner-selection-strategy")
+		case "deal-start-epoch-auto":
+			cfg.DealConfig.AutoStartEpoch = cctx.Bool("deal-start-epoch-auto")
+		case "deal-start-epoch-slack":
+			cfg.DealConfig.StartEpochSlack = cctx.Int64("deal-start-epoch-slack")
+		case "estimated-transfer-rate":
+			cfg.DealConfig.EstimatedTransferRate = cctx.Int64("estimated-transfer-rate")
+		case "bump-duplicate-proposals":
+			cfg.DealConfig.BumpDuplicateProposals = cctx.Bool("bump-duplicate-proposals")
+		case "fast-retrieval":
+			cfg.DealConfig.DisableFastRetrieval = !cctx.Bool("fast-retrieval")
+		case "adjust-deal-duration":
+			cfg.DealConfig.AdjustDealDuration = cctx.Bool("adjust-deal-duration")
+		case "proposal-stale-epochs":
+			cfg.DealConfig.ProposalStaleEpochs = cctx.Int64("proposal-stale-epochs")
+		case "proposal-send-attempts":
+			cfg.DealConfig.ProposalSendAttempts = cctx.Int("proposal-send-attempts")
+		case "verified-deal-policy":
+			cfg.DealConfig.VerifiedPolicy = cctx.String("verified-deal-policy")
+		case "replication-mode":
+			cfg.DealConfig.ReplicationMode = cctx.String("replication-mode")
+		case "durability-tolerance":
+			cfg.DealConfig.DurabilityTolerance = cctx.Int("durability-tolerance")
+		case "durability-confidence":
+			cfg.DealConfig.DurabilityConfidence = cctx.Float64("durability-confidence")
+		case "max-replication":
+			cfg.DealConfig.MaxReplication = cctx.Int("max-replication")
+		case "redundancy-check-interval":
+			cfg.DealConfig.RedundancyCheckInterval = cctx.Duration("redundancy-check-interval")
+		case "redundancy-alert-webhook":
+			cfg.DealConfig.RedundancyAlertWebhook = cctx.String("redundancy-alert-webhook")
+		case "deal-label-scheme":
+			cfg.DealConfig.LabelScheme = cctx.String("deal-label-scheme")
+		case "min-success-ratio":
+			cfg.DealConfig.MinSuccessRatio = cctx.Float64("min-success-ratio")
+		case "slash-check-interval":
+			cfg.DealConfig.SlashCheckInterval = cctx.Duration("slash-check-interval")
+		case "selection-audit-retention":
+			cfg.DealConfig.SelectionAuditRetention = cctx.Duration("selection-audit-retention")
+		case "miner-diversity":
+			cfg.DealConfig.MinerDiversity = cctx.Bool("miner-diversity")
+		case "deal-size-targeting":
+			cfg.DealConfig.DealSizeTargeting = cctx.Bool("deal-size-targeting")
+		case "rank-miners-by-latency":
+			cfg.DealConfig.RankByLatency = cctx.Bool("rank-miners-by-latency")
+		case "rank-miners-by-deal-size":
+			cfg.DealConfig.RankBySize = cctx.Bool("rank-miners-by-deal-size")
 		case "fail-deals-on-transfer-failure":
 			cfg.DealConfig.FailOnTransferFailure = cctx.Bool("fail-deals-on-transfer-failure")
+		case "remote-signer-url":
+			cfg.WalletConfig.RemoteSignerURL = cctx.String("remote-signer-url")
+		case "remote-signer-address":
+			cfg.WalletConfig.RemoteSignerAddress = cctx.String("remote-signer-address")
+		case "retrieval-max-unseal-price":
+			cfg.RetrievalConfig.MaxUnsealPrice = cctx.String("retrieval-max-unseal-price")
+		case "retrieval-max-transfer-price":
+			cfg.RetrievalConfig.MaxTransferPrice = cctx.String("retrieval-max-transfer-price")
+		case "retrieval-payment-interval":
+			cfg.RetrievalConfig.PaymentInterval = cctx.Uint64("retrieval-payment-interval")
+		case "retrieval-checkpoint-interval":
+			cfg.RetrievalConfig.CheckpointInterval = cctx.Uint64("retrieval-checkpoint-interval")
+		case "indexer-url":
+			cfg.RetrievalConfig.IndexerURL = cctx.String("indexer-url")
+		case "retrieval-paych-funding":
+			cfg.RetrievalConfig.PaychFunding.Strategy = cctx.String("retrieval-paych-funding")
+		case "retrieval-paych-buffer-percent":
+			cfg.RetrievalConfig.PaychFunding.BufferPercent = cctx.Int("retrieval-paych-buffer-percent")
+		case "retrieval-paych-fixed-amount":
+			cfg.RetrievalConfig.PaychFunding.Amount = cctx.String("retrieval-paych-fixed-amount")
+		case "retrieval-paych-fund-every-retrieval":
+			cfg.RetrievalConfig.PaychFunding.FundEveryRetrieval = cctx.Bool("retrieval-paych-fund-every-retrieval")
+		case "retrieval-provider":
+			cfg.RetrievalConfig.Provider.Enabled = cctx.Bool("retrieval-provider")
+		case "retrieval-provider-listen":
+			cfg.RetrievalConfig.Provider.ListenAddrs = cctx.StringSlice("retrieval-provider-listen")
+		case "retrieval-provider-price":
+			cfg.RetrievalConfig.Provider.Price = cctx.String("retrieval-provider-price")
+		case "retrieval-provider-payment-interval":
+			cfg.RetrievalConfig.Provider.PaymentInterval = cctx.Uint64("retrieval-provider-payment-interval")
 		case "disable-local-content-adding":
 			cfg.ContentConfig.DisableLocalAdding = cctx.Bool("disable-local-content-adding")
+		case "object-batch-size":
+			cfg.ContentConfig.ObjectBatchSize = cctx.Int("object-batch-size")
+		case "dag-walk-concurrency":
+			cfg.ContentConfig.DagWalkConcurrency = cctx.Int("dag-walk-concurrency")
+		case "import-buffer-blocks":
+			cfg.ContentConfig.ImportBufferBlocks = cctx.Int("import-buffer-blocks")
+		case "import-buffer-bytes":
+			cfg.ContentConfig.ImportBufferBytes = cctx.Int64("import-buffer-bytes")
+		case "free-space-headroom":
+			cfg.ContentConfig.FreeSpaceHeadroom = cctx.Int64("free-space-headroom")
+		case "dag-overhead-percent":
+			cfg.ContentConfig.DagOverheadPercent = cctx.Int("dag-overhead-percent")
+		case "content-expiry-action":
+			cfg.ContentConfig.ExpiryAction = cctx.String("content-expiry-action")
+		case "aggregate-fault-strategy":
+			cfg.ContentConfig.AggregateFaultStrategy = cctx.String("aggregate-fault-strategy")
 		case "disable-content-adding":
 			cfg.ContentConfig.DisableGlobalAdding = cctx.Bool("disable-content-adding")
 		case "jaeger-tracing":
@@ -227,6 +407,28 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.NodeConfig.BitswapConfig.MaxOutstandingBytesPerPeer = cctx.Int64("bitswap-max-work-per-peer")
 		case "bitswap-target-message-size":
 			cfg.NodeConfig.BitswapConfig.TargetMessageSize = cctx.Int("bitswap-target-message-size")
+		case "graphsync-max-in-progress-incoming":
+			cfg.NodeConfig.GraphsyncConfig.MaxInProgressIncomingRequests = cctx.Uint64("graphsync-max-in-progress-incoming")
+		case "graphsync-max-in-progress-incoming-per-peer":
+			cfg.NodeConfig.GraphsyncConfig.MaxInProgressIncomingRequestsPerPeer = cctx.Uint64("graphsync-max-in-progress-incoming-per-peer")
+		case "graphsync-max-in-progress-outgoing":
+			cfg.NodeConfig.GraphsyncConfig.MaxInProgressOutgoingRequests = cctx.Uint64("graphsync-max-in-progress-outgoing")
+		case "graphsync-max-memory-responder":
+			cfg.NodeConfig.GraphsyncConfig.MaxMemoryResponder = cctx.Uint64("graphsync-max-memory-responder")
+		case "graphsync-max-memory-per-peer-responder":
+			cfg.NodeConfig.GraphsyncConfig.MaxMemoryPerPeerResponder = cctx.Uint64("graphsync-max-memory-per-peer-responder")
+		case "graphsync-message-send-retries":
+			cfg.NodeConfig.GraphsyncConfig.MessageSendRetries = cctx.Int("graphsync-message-send-retries")
+		case "graphsync-send-message-timeout":
+			cfg.NodeConfig.GraphsyncConfig.SendMessageTimeout = cctx.Duration("graphsync-send-message-timeout")
+		case "provide-rate":
+			cfg.NodeConfig.ProvideConfig.Rate = cctx.Float64("provide-rate")
+		case "provide-burst":
+			cfg.NodeConfig.ProvideConfig.Burst = cctx.Int("provide-burst")
+		case "provide-max-retries":
+			cfg.NodeConfig.ProvideConfig.MaxRetries = cctx.Int("provide-max-retries")
+		case "provide-retry-delay":
+			cfg.NodeConfig.ProvideConfig.RetryDelay = cctx.Duration("provide-retry-delay")
 		case "announce-addr":
 			cfg.NodeConfig.AnnounceAddrs = cctx.StringSlice("announce-addr")
 
@@ -340,6 +542,131 @@ func main() {
 			Usage: "Defaults to makes deals as verified deal using datacap. Set to false to make deal as regular deal using real FIL(no datacap)",
 			Value: cfg.DealConfig.Verified,
 		},
+		&cli.IntFlag{
+			Name:  "max-inflight-transfers",
+			Usage: "maximum number of deal data transfers in progress at once, new deals wait for a slot (0 for no limit)",
+			Value: cfg.DealConfig.MaxInflightTransfers,
+		},
+		&cli.StringFlag{
+			Name:  "miner-selection-strategy",
+			Usage: "how to rank miners for new deals: success-ratio, lowest-price or region-diverse",
+			Value: cfg.DealConfig.MinerSelectionStrategy,
+		},
+		&cli.BoolFlag{
+			Name:  "deal-start-epoch-auto",
+			Usage: "start new deals a configurable number of epochs after the current head instead of a week out",
+			Value: cfg.DealConfig.AutoStartEpoch,
+		},
+		&cli.Int64Flag{
+			Name:  "deal-start-epoch-slack",
+			Usage: "number of epochs between the current head and the start of new deals when deal-start-epoch-auto is set",
+			Value: cfg.DealConfig.StartEpochSlack,
+		},
+		&cli.Int64Flag{
+			Name:  "estimated-transfer-rate",
+			Usage: "expected deal transfer rate in bytes per second, used to warn when the start epoch slack is too short",
+			Value: cfg.DealConfig.EstimatedTransferRate,
+		},
+		&cli.BoolFlag{
+			Name:  "bump-duplicate-proposals",
+			Usage: "make proposals identical to one already saved distinct by bumping their start epoch, instead of reusing the saved proposal",
+			Value: cfg.DealConfig.BumpDuplicateProposals,
+		},
+		&cli.BoolFlag{
+			Name:  "fast-retrieval",
+			Usage: "ask miners to keep an unsealed copy of the data for fast retrieval, can be overridden per deal",
+			Value: !cfg.DealConfig.DisableFastRetrieval,
+		},
+		&cli.BoolFlag{
+			Name:  "adjust-deal-duration",
+			Usage: "fit the deal duration into the range a miner accepts instead of skipping miners it doesn't suit",
+			Value: cfg.DealConfig.AdjustDealDuration,
+		},
+		&cli.Int64Flag{
+			Name:  "proposal-stale-epochs",
+			Usage: "refresh and re-sign deal proposals that waited this many epochs to be sent (0 to disable)",
+			Value: cfg.DealConfig.ProposalStaleEpochs,
+		},
+		&cli.IntFlag{
+			Name:  "proposal-send-attempts",
+			Usage: "times to try sending a deal proposal when the miner can't be reached, a miner's rejection is never retried",
+			Value: cfg.DealConfig.ProposalSendAttempts,
+		},
+		&cli.StringFlag{
+			Name:  "verified-deal-policy",
+			Usage: "fixed makes every deal as verified-deal says, per-miner makes a replica verified only if its miner takes verified deals for free and datacap is left, paying for the rest",
+			Value: cfg.DealConfig.VerifiedPolicy,
+		},
+		&cli.StringFlag{
+			Name:  "replication-mode",
+			Usage: "fixed makes replication deals for each content, adaptive makes as many as it takes to meet the durability target given how reliable miners have been",
+			Value: cfg.DealConfig.ReplicationMode,
+		},
+		&cli.IntFlag{
+			Name:  "durability-tolerance",
+			Usage: "number of deals content must survive losing under the adaptive replication mode",
+			Value: cfg.DealConfig.DurabilityTolerance,
+		},
+		&cli.Float64Flag{
+			Name:  "durability-confidence",
+			Usage: "confidence with which content must survive losing durability-tolerance deals under the adaptive replication mode",
+			Value: cfg.DealConfig.DurabilityConfidence,
+		},
+		&cli.IntFlag{
+			Name:  "max-replication",
+			Usage: "most deals the adaptive replication mode makes for a content",
+			Value: cfg.DealConfig.MaxReplication,
+		},
+		&cli.DurationFlag{
+			Name:  "redundancy-check-interval",
+			Usage: "how often to check for content with fewer sealed deals than its replication target, 0 disables the check",
+			Value: cfg.DealConfig.RedundancyCheckInterval,
+		},
+		&cli.StringFlag{
+			Name:  "redundancy-alert-webhook",
+			Usage: "url to post json alerts to when content falls below its replication target",
+			Value: cfg.DealConfig.RedundancyAlertWebhook,
+		},
+		&cli.StringFlag{
+			Name:  "deal-label-scheme",
+			Usage: "how deal proposals are labeled: estuary (estuary:<content id>:v1:<payload cid>) or cid (the payload cid only)",
+			Value: cfg.DealConfig.LabelScheme,
+		},
+		&cli.Float64Flag{
+			Name:  "min-success-ratio",
+			Usage: "only make deals with miners that got at least this share of our past deals on chain, 0 allows any miner. Content can ask for its own",
+			Value: cfg.DealConfig.MinSuccessRatio,
+		},
+		&cli.DurationFlag{
+			Name:  "slash-check-interval",
+			Usage: "how often to look up every active deal on chain to catch slashed deals, 0 disables the check",
+			Value: cfg.DealConfig.SlashCheckInterval,
+		},
+		&cli.DurationFlag{
+			Name:  "selection-audit-retention",
+			Usage: "how long to keep the audit of each round of miner selection, 0 keeps them forever",
+			Value: cfg.DealConfig.SelectionAuditRetention,
+		},
+		&cli.BoolFlag{
+			Name:  "miner-diversity",
+			Usage: "don't replicate content to multiple miners that share an owner, worker or network block",
+			Value: cfg.DealConfig.MinerDiversity,
+		},
+		&cli.BoolFlag{
+			Name:  "deal-size-targeting",
+			Usage: "prefer miners whose preferred deal sizes fit the content, and size aggregates, splits and deal pieces to what the miners prefer",
+			Value: cfg.DealConfig.DealSizeTargeting,
+		},
+		&cli.BoolFlag{
+			Name:  "rank-miners-by-latency",
+			Usage: "prefer faster responding miners among those with similar deal success ratios",
+			Value: cfg.DealConfig.RankByLatency,
+		},
+		&cli.BoolFlag{
+			Name:  "rank-miners-by-deal-size",
+			Usage: "prefer miners that have stored more data for us among those with similar deal success ratios",
+			Value: cfg.DealConfig.RankBySize,
+		},
 		&cli.BoolFlag{
 			Name:  "disable-content-adding",
 			Usage: "disallow new content ingestion globally",
@@ -350,11 +677,163 @@ func main() {
 			Usage: "disallow new content ingestion on this node (shuttles are unaffected)",
 			Value: cfg.ContentConfig.DisableLocalAdding,
 		},
+		&cli.IntFlag{
+			Name:  "object-batch-size",
+			Usage: "rows per database insert when recording the blocks of pinned content",
+			Value: cfg.ContentConfig.ObjectBatchSize,
+		},
+		&cli.IntFlag{
+			Name:  "dag-walk-concurrency",
+			Usage: "number of blocks fetched at once when walking a DAG to pin or check it",
+			Value: cfg.ContentConfig.DagWalkConcurrency,
+		},
+		&cli.IntFlag{
+			Name:  "import-buffer-blocks",
+			Usage: "blocks of an upload held in memory before they are written to the blockstore, 0 writes each block as it is made",
+			Value: cfg.ContentConfig.ImportBufferBlocks,
+		},
+		&cli.Int64Flag{
+			Name:  "import-buffer-bytes",
+			Usage: "bytes of an upload held in memory before they are written to the blockstore, 0 writes each block as it is made",
+			Value: cfg.ContentConfig.ImportBufferBytes,
+		},
+		&cli.Int64Flag{
+			Name:  "free-space-headroom",
+			Usage: "bytes of disk space that must be left free after an import or retrieval, they are refused otherwise",
+			Value: cfg.ContentConfig.FreeSpaceHeadroom,
+		},
+		&cli.IntFlag{
+			Name:  "dag-overhead-percent",
+			Usage: "percentage added to the size of content to estimate the disk space its blocks take up",
+			Value: cfg.ContentConfig.DagOverheadPercent,
+		},
+		&cli.StringFlag{
+			Name:  "content-expiry-action",
+			Usage: "what to do with content past its expiry time: stop-deals, offload or delete",
+			Value: cfg.ContentConfig.ExpiryAction,
+		},
+		&cli.StringFlag{
+			Name:  "aggregate-fault-strategy",
+			Usage: "when an aggregate's deal faults, replace the deal for the whole aggregate or split it so its contents are re-staged or dealt individually",
+			Value: cfg.ContentConfig.AggregateFaultStrategy,
+		},
+		&cli.StringFlag{
+			Name:  "remote-signer-url",
+			Usage: "lotus wallet API to sign deal proposals with instead of the local wallet, authenticated with ESTUARY_REMOTE_SIGNER_TOKEN",
+			Value: cfg.WalletConfig.RemoteSignerURL,
+		},
+		&cli.StringFlag{
+			Name:  "remote-signer-address",
+			Usage: "address to make deals from when using a remote signer, defaults to its only address",
+			Value: cfg.WalletConfig.RemoteSignerAddress,
+		},
+		&cli.StringFlag{
+			Name:  "retrieval-max-unseal-price",
+			Usage: "refuse retrievals whose one-time unseal price exceeds this amount of FIL",
+			Value: cfg.RetrievalConfig.MaxUnsealPrice,
+		},
+		&cli.StringFlag{
+			Name:  "retrieval-max-transfer-price",
+			Usage: "refuse retrievals whose total per-byte transfer price exceeds this amount of FIL",
+			Value: cfg.RetrievalConfig.MaxTransferPrice,
+		},
+		&cli.Uint64Flag{
+			Name:  "retrieval-payment-interval",
+			Usage: "pay for retrievals every this many bytes, capped at the miner's max payment interval (0 uses the miner's)",
+			Value: cfg.RetrievalConfig.PaymentInterval,
+		},
+		&cli.Uint64Flag{
+			Name:  "retrieval-checkpoint-interval",
+			Usage: "checkpoint the progress of retrievals every this many bytes so they can be resumed after a crash (0 disables)",
+			Value: cfg.RetrievalConfig.CheckpointInterval,
+		},
+		&cli.StringFlag{
+			Name:  "indexer-url",
+			Usage: "network indexer to look up providers of a cid with, empty disables indexer lookups",
+			Value: cfg.RetrievalConfig.IndexerURL,
+		},
+		&cli.StringFlag{
+			Name:  "retrieval-paych-funding",
+			Usage: "how much to fund payment channels with before paid retrievals: exact, with-buffer or fixed-amount (empty leaves it to filclient)",
+			Value: cfg.RetrievalConfig.PaychFunding.Strategy,
+		},
+		&cli.IntFlag{
+			Name:  "retrieval-paych-buffer-percent",
+			Usage: "percentage of a retrieval's cost added on top with the with-buffer funding strategy",
+			Value: cfg.RetrievalConfig.PaychFunding.BufferPercent,
+		},
+		&cli.StringFlag{
+			Name:  "retrieval-paych-fixed-amount",
+			Usage: "amount of FIL payment channels are funded with at a time with the fixed-amount funding strategy",
+			Value: cfg.RetrievalConfig.PaychFunding.Amount,
+		},
+		&cli.BoolFlag{
+			Name:  "retrieval-paych-fund-every-retrieval",
+			Usage: "fund payment channels in full for every retrieval, instead of topping up what they already hold",
+			Value: cfg.RetrievalConfig.PaychFunding.FundEveryRetrieval,
+		},
+		&cli.BoolFlag{
+			Name:  "retrieval-provider",
+			Usage: "serve retrievals of content in our blockstore to other peers",
+			Value: cfg.RetrievalConfig.Provider.Enabled,
+		},
+		&cli.StringSliceFlag{
+			Name:  "retrieval-provider-listen",
+			Usage: "multiaddrs the retrieval provider listens on",
+			Value: cli.NewStringSlice(cfg.RetrievalConfig.Provider.ListenAddrs...),
+		},
+		&cli.StringFlag{
+			Name:  "retrieval-provider-price",
+			Usage: "price in FIL per GiB to charge for serving retrievals, empty or zero serves them for free",
+			Value: cfg.RetrievalConfig.Provider.Price,
+		},
+		&cli.Uint64Flag{
+			Name:  "retrieval-provider-payment-interval",
+			Usage: "number of bytes sent between payments for paid retrievals",
+			Value: cfg.RetrievalConfig.Provider.PaymentInterval,
+		},
 		&cli.StringFlag{
 			Name:  "blockstore",
-			Usage: "specify blockstore parameters",
+			Usage: "specify blockstore parameters, e.g. :flatfs:/path/to/blocks or :s3:bucket/key/prefix",
 			Value: cfg.NodeConfig.Blockstore,
 		},
+		&cli.StringFlag{
+			Name:  "s3-endpoint",
+			Usage: "url of the S3-compatible store for an :s3: blockstore",
+			Value: cfg.NodeConfig.S3Config.Endpoint,
+		},
+		&cli.StringFlag{
+			Name:  "s3-region",
+			Usage: "region of the bucket of an :s3: blockstore",
+			Value: cfg.NodeConfig.S3Config.Region,
+		},
+		&cli.StringFlag{
+			Name:    "s3-access-key",
+			Usage:   "access key id for an :s3: blockstore",
+			Value:   cfg.NodeConfig.S3Config.AccessKey,
+			EnvVars: []string{"AWS_ACCESS_KEY_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "s3-secret-key",
+			Usage:   "secret access key for an :s3: blockstore",
+			Value:   cfg.NodeConfig.S3Config.SecretKey,
+			EnvVars: []string{"AWS_SECRET_ACCESS_KEY"},
+		},
+		&cli.Int64Flag{
+			Name:  "s3-cache-size",
+			Usage: "bytes of recently used blocks of an :s3: blockstore to keep in memory (0 to disable)",
+			Value: cfg.NodeConfig.S3Config.CacheSize,
+		},
+		&cli.Int64Flag{
+			Name:  "blockstore-soft-cap",
+			Usage: "offload least recently used content once the local blockstore holds more than this many bytes",
+			Value: cfg.BlockstoreLimits.SoftCap,
+		},
+		&cli.Int64Flag{
+			Name:  "blockstore-hard-cap",
+			Usage: "refuse new local imports and retrievals once the local blockstore holds this many bytes",
+			Value: cfg.BlockstoreLimits.HardCap,
+		},
 		&cli.BoolFlag{
 			Name:  "write-log-truncate",
 			Usage: "enables log truncating",
@@ -403,6 +882,61 @@ func main() {
 			Name:  "bitswap-target-message-size",
 			Value: cfg.NodeConfig.BitswapConfig.TargetMessageSize,
 		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-in-progress-incoming",
+			Usage: "graphsync requests served at once, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxInProgressIncomingRequests,
+		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-in-progress-incoming-per-peer",
+			Usage: "graphsync requests served at once for a single peer, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxInProgressIncomingRequestsPerPeer,
+		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-in-progress-outgoing",
+			Usage: "graphsync requests made at once, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxInProgressOutgoingRequests,
+		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-memory-responder",
+			Usage: "bytes graphsync may queue to send across all peers, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxMemoryResponder,
+		},
+		&cli.Uint64Flag{
+			Name:  "graphsync-max-memory-per-peer-responder",
+			Usage: "bytes graphsync may queue to send to a single peer, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MaxMemoryPerPeerResponder,
+		},
+		&cli.IntFlag{
+			Name:  "graphsync-message-send-retries",
+			Usage: "times graphsync resends a message before failing the request, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.MessageSendRetries,
+		},
+		&cli.DurationFlag{
+			Name:  "graphsync-send-message-timeout",
+			Usage: "how long sending a graphsync message may take, zero keeps the default",
+			Value: cfg.NodeConfig.GraphsyncConfig.SendMessageTimeout,
+		},
+		&cli.Float64Flag{
+			Name:  "provide-rate",
+			Usage: "DHT provide announcements sent per second for new content, zero for no limit",
+			Value: cfg.NodeConfig.ProvideConfig.Rate,
+		},
+		&cli.IntFlag{
+			Name:  "provide-burst",
+			Usage: "DHT provide announcements that may be sent at once after the queue has been idle",
+			Value: cfg.NodeConfig.ProvideConfig.Burst,
+		},
+		&cli.IntFlag{
+			Name:  "provide-max-retries",
+			Usage: "times a failed DHT provide announcement is retried before it is given up on",
+			Value: cfg.NodeConfig.ProvideConfig.MaxRetries,
+		},
+		&cli.DurationFlag{
+			Name:  "provide-retry-delay",
+			Usage: "delay before a failed DHT provide announcement is retried, doubled for each retry after the first",
+			Value: cfg.NodeConfig.ProvideConfig.RetryDelay,
+		},
 		&cli.StringSliceFlag{
 			Name:  "announce-addr",
 			Usage: "specify multiaddrs that this node can be connected to on",
@@ -475,6 +1009,216 @@ func main() {
 				}
 				return cfg.Save(configFile)
 			},
+		}, {
+			Name:  "objects",
+			Usage: "Lists the largest or most referenced objects along with their reference counts",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "limit",
+					Usage: "number of objects to list",
+					Value: 20,
+				},
+				&cli.StringFlag{
+					Name:  "sort",
+					Usage: "order objects by size or refs",
+					Value: objectsBySize,
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				db, err := setupDatabase(cfg.DatabaseConnString)
+				if err != nil {
+					return err
+				}
+
+				objs, err := topObjects(db, cctx.String("sort"), cctx.Int("limit"))
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+				fmt.Fprintf(w, "CID\tSIZE\tREFS\tCONTENTS\tLAST ACCESS\n")
+				for _, o := range objs {
+					lastAccess := "never"
+					if !o.LastAccess.IsZero() {
+						lastAccess = o.LastAccess.Format(time.RFC3339)
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", o.Cid.CID, humanize.IBytes(uint64(o.Size)), o.Refs, o.Contents, lastAccess)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:  "retrieval-stats",
+			Usage: "Sums up successful retrievals per content: count, bytes served, average speed and cost",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "limit",
+					Usage: "number of contents to list (0 for all)",
+					Value: 20,
+				},
+				&cli.StringFlag{
+					Name:  "sort",
+					Usage: "order contents by retrievals, bytes or cost",
+					Value: retrievalStatsByCount,
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				db, err := setupDatabase(cfg.DatabaseConnString)
+				if err != nil {
+					return err
+				}
+
+				stats, err := retrievalStatsByContent(db, cctx.String("sort"), cctx.Int("limit"))
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+				fmt.Fprintf(w, "CONTENT\tCID\tRETRIEVALS\tMINERS\tBYTES SERVED\tAVG SPEED\tCOST\tLAST RETRIEVAL\n")
+				for _, st := range stats {
+					content := "-"
+					if st.Content != 0 {
+						content = strconv.FormatUint(uint64(st.Content), 10)
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s/s\t%s\t%s\n", content, st.Cid.CID, st.Retrievals, st.Miners,
+						humanize.IBytes(st.BytesServed), humanize.IBytes(st.AverageSpeed), types.FIL(st.TotalPayment), st.LastRetrieval.Format(time.RFC3339))
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:  "onboarding-stats",
+			Usage: "Sums up how long contents took from being added to being replicated, step by step",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "since",
+					Usage: "only count contents added this long ago or later",
+					Value: time.Hour * 24 * 30,
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the report as json",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				// only reads, like dump
+				db, err := util.SetupDatabase(cfg.DatabaseConnString)
+				if err != nil {
+					return err
+				}
+
+				rep, err := onboardingStats(db, time.Now().Add(-cctx.Duration("since")))
+				if err != nil {
+					return err
+				}
+
+				if cctx.Bool("json") {
+					enc := json.NewEncoder(os.Stdout)
+					enc.SetIndent("", "  ")
+					return enc.Encode(rep)
+				}
+
+				fmt.Printf("%d contents added since %s, %d not replicated yet\n\n", rep.Contents, rep.Since.Format(time.RFC3339), rep.Pending)
+
+				w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+				fmt.Fprintf(w, "FROM\tTO\tSAMPLES\tP10\tMEDIAN\tP90\tP99\tMAX\n")
+				for _, st := range rep.Steps {
+					fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", st.From, st.To, st.Samples,
+						st.Low.Round(time.Second), st.Median.Round(time.Second), st.High.Round(time.Second), st.P99.Round(time.Second), st.Max.Round(time.Second))
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:  "dump",
+			Usage: "Writes every content and its deals to stdout, for external tools",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "output format, only json for now",
+					Value: dumpFormatJSON,
+				},
+				&cli.UintFlag{
+					Name:  "after",
+					Usage: "only dump contents with an id above this one, to carry on from an earlier dump",
+				},
+				&cli.IntFlag{
+					Name:  "limit",
+					Usage: "number of contents to dump (0 for all)",
+				},
+				&cli.IntFlag{
+					Name:  "batch-size",
+					Usage: "number of contents to read from the database at a time",
+					Value: defaultDumpBatchSize,
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if f := cctx.String("format"); f != dumpFormatJSON {
+					return fmt.Errorf("unsupported dump format %q", f)
+				}
+
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				// only reads, so it doesn't migrate the schema or add the
+				// default miners under a running node, which would also
+				// print to stdout
+				db, err := util.SetupDatabase(cfg.DatabaseConnString)
+				if err != nil {
+					return err
+				}
+
+				w := bufio.NewWriter(os.Stdout)
+				n, last, err := dumpContentGraph(db, w, contentDumpOptions{
+					After:     cctx.Uint("after"),
+					Limit:     cctx.Int("limit"),
+					BatchSize: cctx.Int("batch-size"),
+				})
+				if err != nil {
+					return err
+				}
+
+				if err := w.Flush(); err != nil {
+					return err
+				}
+
+				// the cursor goes to stderr to keep stdout valid json
+				if limit := cctx.Int("limit"); limit > 0 && n == limit {
+					fmt.Fprintf(os.Stderr, "dumped %d contents, continue with --after=%d\n", n, last)
+				}
+				return nil
+			},
 		},
 	}
 	app.Action = func(cctx *cli.Context) error {
@@ -536,6 +1280,7 @@ func main() {
 			tracer:      otel.Tracer("api"),
 			cacher:      memo.NewCacher(),
 			gwayHandler: gateway.NewGatewayHandler(nd.Blockstore),
+			resolver:    newNameResolver(nd.FullRT),
 		}
 
 		// TODO: this is an ugly self referential hack... should fix
@@ -561,6 +1306,17 @@ func main() {
 			})
 		}
 
+		gsopts, err := cfg.NodeConfig.GraphsyncConfig.Options()
+		if err != nil {
+			return err
+		}
+
+		// applied after the low memory settings, so that settings made
+		// explicitly win
+		opts = append(opts, func(cfg *filclient.Config) {
+			cfg.GraphsyncOpts = append(cfg.GraphsyncOpts, gsopts...)
+		})
+
 		fc, err := filclient.NewClient(rhost, api, nd.Wallet, addr, nd.Blockstore, nd.Datastore, cfg.DataDir, opts...)
 		if err != nil {
 			return err
@@ -592,14 +1348,46 @@ func main() {
 		fc.SetPieceCommFunc(cm.getPieceCommitment)
 		s.FilClient = fc
 
+		if err := cm.subscribeToTransferEvents(); err != nil {
+			return err
+		}
+
+		if cfg.RetrievalConfig.Provider.Enabled {
+			rp, err := node.NewRetrievalProvider(context.TODO(), cfg.RetrievalConfig.Provider, api, nd.Wallet, addr, nd.Datastore, nd.Blockstore, cm.retrievalAllowed, gsopts...)
+			if err != nil {
+				return fmt.Errorf("failed to start retrieval provider: %w", err)
+			}
+			s.RetrievalProvider = rp
+		}
+
 		if cfg.EnableAutoRetrieve {
 			init.trackingBstore.SetCidReqFunc(cm.RefreshContentForCid)
 		}
 
+		wctx, stopWorkers := context.WithCancel(context.Background())
+		s.stopWorkers = stopWorkers
+
 		if !cfg.DisableFilecoinStorage {
-			go cm.ContentWatcher()
+			s.goWorker(cm.ContentWatcher)
+			s.goWorker(func() { cm.runRebalancer(wctx) })
+
+			if cfg.DealConfig.RedundancyCheckInterval > 0 {
+				s.goWorker(func() { cm.runRedundancyMonitor(wctx) })
+			}
+
+			if cfg.DealConfig.SlashCheckInterval > 0 {
+				s.goWorker(func() { cm.runSlashMonitor(wctx) })
+			}
+
+			if cfg.DealConfig.SelectionAuditRetention > 0 {
+				s.goWorker(func() { cm.runSelectionAuditPruner(wctx) })
+			}
 		}
 
+		s.goWorker(func() { cm.runBlockstoreUsageMonitor(wctx) })
+		s.goWorker(func() { cm.runContentReaper(wctx) })
+		s.goWorker(func() { cm.runDealPieceSizeBackfill(wctx) })
+
 		if !cm.contentAddingDisabled {
 			go func() {
 				// wait for shuttles to reconnect
@@ -624,17 +1412,41 @@ func main() {
 		}
 
 		stopUpdateIndex := make(chan struct{})
-		go s.updateAutoretrieveIndex(time.Duration(intervalMinutes)*time.Minute, stopUpdateIndex)
+		s.goWorker(func() {
+			_ = s.updateAutoretrieveIndex(time.Duration(intervalMinutes)*time.Minute, stopUpdateIndex)
+		})
+		go func() {
+			<-wctx.Done()
+			close(stopUpdateIndex)
+		}()
 
 		go func() {
 			time.Sleep(time.Second * 10)
 
+			if err := cm.reconcileInflightDeals(context.TODO()); err != nil {
+				log.Errorf("failed to reconcile deals in flight at last shutdown: %s", err)
+			}
+
 			if err := s.RestartAllTransfersForLocation(context.TODO(), "local"); err != nil {
 				log.Errorf("failed to restart transfers: %s", err)
 			}
 		}()
 
-		return s.ServeAPI(cfg.ApiListen, cfg.LoggingConfig.ApiEndpointLogging, cfg.LightstepToken, cfg.ServerCacheDir)
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- s.ServeAPI(cfg.ApiListen, cfg.LoggingConfig.ApiEndpointLogging, cfg.LightstepToken, cfg.ServerCacheDir)
+		}()
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+		select {
+		case err := <-serveErr:
+			return err
+		case sig := <-sigs:
+			log.Infow("shutting down", "signal", sig)
+			return s.Shutdown(context.TODO())
+		}
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -659,6 +1471,7 @@ func setupDatabase(dbConnStr string) (*gorm.DB, error) {
 	}
 
 	db.AutoMigrate(&Content{})
+	db.AutoMigrate(&contentAccessGrant{})
 	db.AutoMigrate(&Object{})
 	db.AutoMigrate(&ObjRef{})
 	db.AutoMigrate(&Collection{})
@@ -668,13 +1481,23 @@ func setupDatabase(dbConnStr string) (*gorm.DB, error) {
 	db.AutoMigrate(&dfeRecord{})
 	db.AutoMigrate(&PieceCommRecord{})
 	db.AutoMigrate(&proposalRecord{})
+	db.AutoMigrate(&inflightDealRecord{})
+	db.AutoMigrate(&transferEventRecord{})
+	db.AutoMigrate(&selectionAuditRecord{}, &selectionAuditMiner{})
+	db.AutoMigrate(&aggregateFault{})
 	db.AutoMigrate(&util.RetrievalFailureRecord{})
 	db.AutoMigrate(&retrievalSuccessRecord{})
+	db.AutoMigrate(&aggregateMember{})
+	db.AutoMigrate(&minerRebalance{}, &rebalanceItem{})
+	db.AutoMigrate(&retrievalCheckpoint{}, &retrievalSubtree{})
+	db.AutoMigrate(&dealPauseRecord{})
 
 	db.AutoMigrate(&minerStorageAsk{})
 	db.AutoMigrate(&storageMiner{})
+	db.AutoMigrate(&importedMinerStats{})
 
 	db.AutoMigrate(&User{})
+	db.AutoMigrate(&userQuota{})
 	db.AutoMigrate(&AuthToken{})
 	db.AutoMigrate(&InviteCode{})
 
@@ -711,9 +1534,32 @@ type Server struct {
 	CM         *ContentManager
 	StagingMgr *stagingbs.StagingBSMgr
 
+	// nil unless we serve retrievals to other peers
+	RetrievalProvider *node.RetrievalProvider
+
 	gwayHandler *gateway.GatewayHandler
 
+	// resolves IPNS and DNSLink names for /content/resolve
+	resolver *nameResolver
+
 	cacher *memo.Cacher
+
+	// the api server, set once ServeAPI started it
+	echoLk sync.Mutex
+	echo   *echo.Echo
+
+	// the background workers, stopped and waited for on shutdown
+	workers     sync.WaitGroup
+	stopWorkers context.CancelFunc
+}
+
+// goWorker runs a background worker that Shutdown waits for
+func (s *Server) goWorker(f func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		f()
+	}()
 }
 
 func (s *Server) GarbageCollect(ctx context.Context) error {
@@ -27,6 +27,12 @@ var (
 	Direction, _  = tag.NewKey("direction")
 	UseFD, _      = tag.NewKey("use_fd")
 	Op, _         = tag.NewKey("op")
+
+	// provide queue
+	ProvideResult, _ = tag.NewKey("result")
+
+	// onboarding
+	OnboardingStage, _ = tag.NewKey("stage")
 )
 
 // Measures
@@ -43,6 +49,14 @@ var (
 	RcmgrProto  = stats.Int64("rcmgr/proto", "Number of allowed streams attached to a protocol", stats.UnitDimensionless)
 	RcmgrSvc    = stats.Int64("rcmgr/svc", "Number of streams attached to a service", stats.UnitDimensionless)
 	RcmgrMem    = stats.Int64("rcmgr/mem", "Number of memory reservations", stats.UnitDimensionless)
+
+	// provide queue
+	ProvideQueueDepth = stats.Int64("provide/queue_depth", "Number of DHT provides waiting to be sent or retried", stats.UnitDimensionless)
+	ProvideResults    = stats.Int64("provide/results", "Number of DHT provides sent, tagged by how they went", stats.UnitDimensionless)
+	ProvideDuration   = stats.Float64("provide/duration_ms", "Duration of DHT provides", stats.UnitMilliseconds)
+
+	// onboarding
+	OnboardingLatency = stats.Float64("onboarding/latency_ms", "Time from content being added to it reaching an onboarding stage", stats.UnitMilliseconds)
 )
 
 var (
@@ -89,6 +103,34 @@ var (
 		Measure:     RcmgrMem,
 		Aggregation: view.Count(),
 	}
+
+	// provide queue
+	ProvideQueueDepthView = &view.View{
+		Measure:     ProvideQueueDepth,
+		Aggregation: view.LastValue(),
+	}
+
+	// the success rate is the "success" count over the "success" and
+	// "failure" counts, "dropped" counts provides given up on after their
+	// last retry failed
+	ProvideResultsView = &view.View{
+		Measure:     ProvideResults,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{ProvideResult},
+	}
+
+	ProvideDurationView = &view.View{
+		Measure:     ProvideDuration,
+		Aggregation: view.Distribution(10, 50, 100, 500, 1000, 2000, 5000, 10000, 30000, 60000),
+	}
+
+	// onboarding, from a minute to a month
+	OnboardingLatencyView = &view.View{
+		Measure: OnboardingLatency,
+		Aggregation: view.Distribution(durationBuckets(time.Minute, 10*time.Minute, time.Hour, 6*time.Hour, 12*time.Hour,
+			24*time.Hour, 48*time.Hour, 72*time.Hour, 120*time.Hour, 168*time.Hour, 336*time.Hour, 720*time.Hour)...),
+		TagKeys: []tag.Key{OnboardingStage},
+	}
 )
 
 // DefaultViews is an array of OpenCensus views for metric gathering purposes
@@ -101,12 +143,25 @@ var DefaultViews = func() []*view.View {
 		RcmgrProtoView,
 		RcmgrSvcView,
 		RcmgrMemView,
+		ProvideQueueDepthView,
+		ProvideResultsView,
+		ProvideDurationView,
+		OnboardingLatencyView,
 	}
 	views = append(views, blockstore.DefaultViews...)
 	views = append(views, rpcmetrics.DefaultViews...)
 	return views
 }()
 
+// durationBuckets returns the bounds of distribution buckets in milliseconds
+func durationBuckets(bounds ...time.Duration) []float64 {
+	out := make([]float64, 0, len(bounds))
+	for _, b := range bounds {
+		out = append(out, float64(b)/float64(time.Millisecond))
+	}
+	return out
+}
+
 // SinceInMilliseconds returns the duration of time since the provide time as a float64.
 func SinceInMilliseconds(startTime time.Time) float64 {
 	return float64(time.Since(startTime).Nanoseconds()) / 1e6
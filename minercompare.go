@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+type minerComparison struct {
+	Miner address.Address `json:"miner"`
+
+	// whether the miner answered a fresh ask query
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+
+	Price         string              `json:"price,omitempty"`
+	VerifiedPrice string              `json:"verifiedPrice,omitempty"`
+	MinPieceSize  abi.PaddedPieceSize `json:"minPieceSize"`
+	MaxPieceSize  abi.PaddedPieceSize `json:"maxPieceSize"`
+
+	// cost of a deal of the requested size and duration at the miner's ask
+	Cost    *abi.TokenAmount `json:"cost,omitempty"`
+	CostFil string           `json:"costFil,omitempty"`
+
+	TotalDeals     int     `json:"totalDeals"`
+	ConfirmedDeals int     `json:"confirmedDeals"`
+	SuccessRatio   float64 `json:"successRatio"`
+	AvgResponseMs  int64   `json:"avgResponseMs"`
+}
+
+// compareMiners queries every miner's ask concurrently and lines it up with
+// the ranking stats we keep for it, so they can be compared side by side
+func (cm *ContentManager) compareMiners(ctx context.Context, miners []address.Address, size abi.PaddedPieceSize, duration abi.ChainEpoch, verified bool) ([]*minerComparison, error) {
+	_, rawStats, err := cm.sortedMinerList()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[address.Address]*minerDealStats)
+	for _, st := range rawStats {
+		stats[st.Miner] = st
+	}
+
+	out := make([]*minerComparison, len(miners))
+	var wg sync.WaitGroup
+	for i, m := range miners {
+		mc := &minerComparison{
+			Miner: m,
+		}
+		out[i] = mc
+
+		if st, ok := stats[m]; ok {
+			mc.TotalDeals = st.TotalDeals
+			mc.ConfirmedDeals = st.ConfirmedDeals
+			if st.TotalDeals > 0 {
+				mc.SuccessRatio = st.SuccessRatio()
+			}
+		}
+
+		wg.Add(1)
+		go func(mc *minerComparison) {
+			defer wg.Done()
+
+			// always go to the network so we know the miner is reachable right now
+			ask, err := cm.getAsk(ctx, mc.Miner, 0)
+			mc.AvgResponseMs = cm.minerResponseTime(mc.Miner).Milliseconds()
+			if err != nil {
+				mc.Error = err.Error()
+				return
+			}
+
+			mc.Reachable = true
+			mc.Price = ask.Price
+			mc.VerifiedPrice = ask.VerifiedPrice
+			mc.MinPieceSize = ask.MinPieceSize
+			mc.MaxPieceSize = ask.MaxPieceSize
+
+			cost, err := ask.dealCost(size, duration, verified)
+			if err != nil {
+				mc.Error = err.Error()
+				return
+			}
+			mc.Cost = cost
+			mc.CostFil = types.FIL(*cost).String()
+		}(mc)
+	}
+	wg.Wait()
+
+	return out, nil
+}
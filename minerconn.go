@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// connectMinerOverride dials m at the multiaddr set for it through set-info,
+// for miners whose addresses on chain are stale. filclient always looks
+// miners up with StateMinerInfo, but it doesn't redial a peer we are already
+// connected to and the address stays in our peerstore for later dials. It
+// should be called before talking to a miner through filclient, failures are
+// only logged and filclient is left to try the addresses on chain.
+func (cm *ContentManager) connectMinerOverride(ctx context.Context, m address.Address) {
+	var sm storageMiner
+	if err := cm.DB.Find(&sm, "address = ?", m.String()).Error; err != nil {
+		log.Warnf("failed to look up miner %s: %s", m, err)
+		return
+	}
+
+	if sm.Multiaddr == "" {
+		return
+	}
+
+	ma, err := multiaddr.NewMultiaddr(sm.Multiaddr)
+	if err != nil {
+		log.Warnf("miner %s has an invalid address override %q: %s", m, sm.Multiaddr, err)
+		return
+	}
+
+	if _, err := connectToMinerAddr(ctx, cm.Api, cm.Host, m, ma, peerstore.PermanentAddrTTL); err != nil {
+		log.Warnf("failed to connect to miner %s at %s: %s", m, ma, err)
+	}
+}
+
+// connectToMinerAddr connects to miner m at ma instead of the addresses it
+// has on chain, keeping ma in the peerstore for ttl. If ma has no /p2p part
+// the miner's peer ID from chain is used, if it has one that doesn't match the
+// chain we don't dial it at all.
+func connectToMinerAddr(ctx context.Context, gw api.Gateway, h host.Host, m address.Address, ma multiaddr.Multiaddr, ttl time.Duration) (peer.ID, error) {
+	minfo, err := gw.StateMinerInfo(ctx, m, types.EmptyTSK)
+	if err != nil {
+		return "", err
+	}
+
+	ai, err := minerAddrInfo(ma, minfo.PeerId)
+	if err != nil {
+		return "", err
+	}
+
+	if minfo.PeerId != nil && ai.ID != *minfo.PeerId {
+		return "", fmt.Errorf("peer ID %s of address %s doesn't match miner %s's peer ID on chain %s", ai.ID, ma, m, *minfo.PeerId)
+	}
+
+	h.Peerstore().AddAddrs(ai.ID, ai.Addrs, ttl)
+	if err := h.Connect(ctx, *ai); err != nil {
+		return "", err
+	}
+
+	return ai.ID, nil
+}
+
+func minerAddrInfo(ma multiaddr.Multiaddr, chainPeer *peer.ID) (*peer.AddrInfo, error) {
+	if _, err := ma.ValueForProtocol(multiaddr.P_P2P); err == nil {
+		return peer.AddrInfoFromP2pAddr(ma)
+	}
+
+	if chainPeer == nil {
+		return nil, fmt.Errorf("address %s has no peer ID and the miner has none set on chain", ma)
+	}
+
+	return &peer.AddrInfo{
+		ID:    *chainPeer,
+		Addrs: []multiaddr.Multiaddr{ma},
+	}, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinerAddrInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	newPeer := func() peer.ID {
+		_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pid, err := peer.IDFromPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pid
+	}
+	chainPeer := newPeer()
+	otherPeer := newPeer()
+
+	ma := multiaddr.StringCast("/ip4/10.1.2.3/tcp/24001")
+
+	// no peer ID in the address, the one from chain is used
+	ai, err := minerAddrInfo(ma, &chainPeer)
+	assert.NoError(err)
+	assert.Equal(chainPeer, ai.ID)
+	assert.Equal([]multiaddr.Multiaddr{ma}, ai.Addrs)
+
+	_, err = minerAddrInfo(ma, nil)
+	assert.Error(err)
+
+	// a peer ID in the address wins, even if it isn't the one on chain
+	withPeer := multiaddr.StringCast("/ip4/10.1.2.3/tcp/24001/p2p/" + otherPeer.String())
+	ai, err = minerAddrInfo(withPeer, &chainPeer)
+	assert.NoError(err)
+	assert.Equal(otherPeer, ai.ID)
+	assert.True(ai.Addrs[0].Equal(ma))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+)
+
+func validMinSuccessRatio(r float64) error {
+	if r < 0 || r > 1 {
+		return fmt.Errorf("invalid minimum success ratio %v, must be between 0 and 1", r)
+	}
+	return nil
+}
+
+// minSuccessRatioFor is the success ratio a miner needs for deals with the
+// content, zero means any miner will do
+func (cm *ContentManager) minSuccessRatioFor(content Content) float64 {
+	if content.MinSuccessRatio > 0 {
+		return content.MinSuccessRatio
+	}
+	return cm.minSuccessRatio
+}
+
+// minerSuccessRatios maps the miners we have made deals with to the share of
+// those deals that made it on chain, miners without any deals are left out
+func minerSuccessRatios(stats []*minerDealStats) map[address.Address]float64 {
+	out := make(map[address.Address]float64, len(stats))
+	for _, st := range stats {
+		if st.TotalDeals > 0 {
+			out[st.Miner] = st.SuccessRatio()
+		}
+	}
+	return out
+}
+
+// qualifyingMiners keeps the ranked miners with at least the min success
+// ratio, in their ranked order
+func qualifyingMiners(sorted []address.Address, ratios map[address.Address]float64, min float64) []address.Address {
+	var out []address.Address
+	for _, m := range sorted {
+		if r, ok := ratios[m]; ok && r >= min {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// successRatioDetail says why a miner doesn't meet the min success ratio, or
+// returns false if it does
+func successRatioDetail(ratios map[address.Address]float64, m address.Address, min float64) (string, bool) {
+	r, ok := ratios[m]
+	if !ok {
+		return "no deal history", true
+	}
+	if r < min {
+		return fmt.Sprintf("success ratio %.2f is below %.2f", r, min), true
+	}
+	return "", false
+}
+
+// stagingZoneMinSuccessRatio is the highest min success ratio of the
+// contents in the zone, which the aggregate made from it gets
+func stagingZoneMinSuccessRatio(b *contentStagingZone) float64 {
+	var r float64
+	for _, c := range b.Contents {
+		if c.MinSuccessRatio > r {
+			r = c.MinSuccessRatio
+		}
+	}
+	return r
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQualifyingMiners(t *testing.T) {
+	assert := assert.New(t)
+
+	stats := []*minerDealStats{
+		testMinerStats(t, 1000, 9, 10, -1, ""),
+		testMinerStats(t, 1001, 5, 10, -1, ""),
+		testMinerStats(t, 1002, 0, 0, -1, ""),
+		testMinerStats(t, 1003, 19, 20, -1, ""),
+	}
+	ratios := minerSuccessRatios(stats)
+	assert.Len(ratios, 3, "miners without deals have no ratio")
+
+	sorted := []address.Address{stats[3].Miner, stats[0].Miner, stats[1].Miner, stats[2].Miner}
+	assert.Equal([]address.Address{stats[3].Miner, stats[0].Miner}, qualifyingMiners(sorted, ratios, 0.9))
+	assert.Equal(sorted[:3], qualifyingMiners(sorted, ratios, 0.5))
+	assert.Empty(qualifyingMiners(sorted, ratios, 1))
+
+	_, low := successRatioDetail(ratios, stats[0].Miner, 0.9)
+	assert.False(low)
+
+	detail, low := successRatioDetail(ratios, stats[1].Miner, 0.9)
+	assert.True(low)
+	assert.Equal("success ratio 0.50 is below 0.90", detail)
+
+	detail, low = successRatioDetail(ratios, stats[2].Miner, 0.9)
+	assert.True(low)
+	assert.Equal("no deal history", detail)
+}
+
+func TestMinSuccessRatioFor(t *testing.T) {
+	assert := assert.New(t)
+
+	cm := &ContentManager{minSuccessRatio: 0.5}
+	assert.Equal(0.5, cm.minSuccessRatioFor(Content{}))
+	assert.Equal(0.95, cm.minSuccessRatioFor(Content{MinSuccessRatio: 0.95}))
+
+	assert.NoError(validMinSuccessRatio(0))
+	assert.NoError(validMinSuccessRatio(1))
+	assert.Error(validMinSuccessRatio(-0.1))
+	assert.Error(validMinSuccessRatio(1.5))
+
+	zone := &contentStagingZone{Contents: []Content{{MinSuccessRatio: 0.8}, {}, {MinSuccessRatio: 0.9}}}
+	assert.Equal(0.9, stagingZoneMinSuccessRatio(zone))
+}
@@ -0,0 +1,151 @@
+package node
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// blockCache keeps the most recently used blocks of a remote blockstore in
+// memory, up to size bytes, so that reading the same dag again (for commP,
+// transfers to miners, retrievals) doesn't go back to the remote store for
+// every block. Blocks are keyed by multihash like the blockstore below, so a
+// block cached under one cid is found under any cid with the same hash.
+type blockCache struct {
+	EstuaryBlockstore
+
+	size int64
+
+	lk     sync.Mutex
+	used   int64
+	lru    *list.List
+	blocks map[string]*list.Element
+}
+
+type cachedBlock struct {
+	key  string
+	data []byte
+}
+
+func newBlockCache(bs EstuaryBlockstore, size int64) *blockCache {
+	return &blockCache{
+		EstuaryBlockstore: bs,
+		size:              size,
+		lru:               list.New(),
+		blocks:            make(map[string]*list.Element),
+	}
+}
+
+func (bc *blockCache) get(c cid.Cid) ([]byte, bool) {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+
+	el, ok := bc.blocks[string(c.Hash())]
+	if !ok {
+		return nil, false
+	}
+	bc.lru.MoveToFront(el)
+	return el.Value.(*cachedBlock).data, true
+}
+
+func (bc *blockCache) add(c cid.Cid, data []byte) {
+	if int64(len(data)) > bc.size {
+		return
+	}
+
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+
+	key := string(c.Hash())
+	if el, ok := bc.blocks[key]; ok {
+		bc.lru.MoveToFront(el)
+		return
+	}
+
+	bc.blocks[key] = bc.lru.PushFront(&cachedBlock{key: key, data: data})
+	bc.used += int64(len(data))
+
+	for bc.used > bc.size {
+		bc.removeElement(bc.lru.Back())
+	}
+}
+
+func (bc *blockCache) remove(c cid.Cid) {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+
+	if el, ok := bc.blocks[string(c.Hash())]; ok {
+		bc.removeElement(el)
+	}
+}
+
+func (bc *blockCache) removeElement(el *list.Element) {
+	cb := bc.lru.Remove(el).(*cachedBlock)
+	delete(bc.blocks, cb.key)
+	bc.used -= int64(len(cb.data))
+}
+
+func (bc *blockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if data, ok := bc.get(c); ok {
+		return blocks.NewBlockWithCid(data, c)
+	}
+
+	blk, err := bc.EstuaryBlockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	bc.add(c, blk.RawData())
+	return blk, nil
+}
+
+func (bc *blockCache) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if data, ok := bc.get(c); ok {
+		return len(data), nil
+	}
+	return bc.EstuaryBlockstore.GetSize(ctx, c)
+}
+
+func (bc *blockCache) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if _, ok := bc.get(c); ok {
+		return true, nil
+	}
+	return bc.EstuaryBlockstore.Has(ctx, c)
+}
+
+// Put writes through to the remote store, blocks that were just written are
+// usually read again soon after to make deals for them
+func (bc *blockCache) Put(ctx context.Context, blk blocks.Block) error {
+	if err := bc.EstuaryBlockstore.Put(ctx, blk); err != nil {
+		return err
+	}
+
+	bc.add(blk.Cid(), blk.RawData())
+	return nil
+}
+
+func (bc *blockCache) PutMany(ctx context.Context, blks []blocks.Block) error {
+	if err := bc.EstuaryBlockstore.PutMany(ctx, blks); err != nil {
+		return err
+	}
+
+	for _, blk := range blks {
+		bc.add(blk.Cid(), blk.RawData())
+	}
+	return nil
+}
+
+func (bc *blockCache) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	bc.remove(c)
+	return bc.EstuaryBlockstore.DeleteBlock(ctx, c)
+}
+
+func (bc *blockCache) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		bc.remove(c)
+	}
+	return bc.EstuaryBlockstore.DeleteMany(ctx, cids)
+}
@@ -0,0 +1,74 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingBlockstore counts the reads that make it past the cache
+type countingBlockstore struct {
+	EstuaryBlockstore
+	gets int
+}
+
+func (cb *countingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	cb.gets++
+	return cb.EstuaryBlockstore.Get(ctx, c)
+}
+
+func TestBlockCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	base := &countingBlockstore{EstuaryBlockstore: &deleteManyWrap{blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))}}
+	a := blocks.NewBlock([]byte("aaaaaaaaaa"))
+	b := blocks.NewBlock([]byte("bbbbbbbbbb"))
+	c := blocks.NewBlock([]byte("cccccccccc"))
+	assert.NoError(base.PutMany(ctx, []blocks.Block{a, b, c}))
+
+	bc := newBlockCache(base, 25)
+
+	for i := 0; i < 3; i++ {
+		blk, err := bc.Get(ctx, a.Cid())
+		assert.NoError(err)
+		assert.Equal(a.RawData(), blk.RawData())
+	}
+	assert.Equal(1, base.gets)
+
+	// a cached block is found under another cid of the same hash
+	blk, err := bc.Get(ctx, cid.NewCidV1(cid.DagCBOR, a.Cid().Hash()))
+	assert.NoError(err)
+	assert.Equal(uint64(cid.DagCBOR), blk.Cid().Prefix().Codec)
+	assert.Equal(1, base.gets)
+
+	// b and c don't both fit next to a, a was used least recently
+	bc.Get(ctx, b.Cid())
+	bc.Get(ctx, c.Cid())
+	assert.Equal(3, base.gets)
+	bc.Get(ctx, a.Cid())
+	assert.Equal(4, base.gets)
+	assert.Equal(int64(20), bc.used)
+
+	// deletes go through to the store and drop the cached copy
+	assert.NoError(bc.DeleteMany(ctx, []cid.Cid{a.Cid()}))
+	has, err := bc.Has(ctx, a.Cid())
+	assert.NoError(err)
+	assert.False(has)
+	_, err = bc.Get(ctx, a.Cid())
+	assert.Equal(blockstore.ErrNotFound, err)
+
+	// blocks bigger than the whole cache are never cached
+	big := blocks.NewBlock(make([]byte, 30))
+	assert.NoError(bc.Put(ctx, big))
+	assert.Equal(int64(10), bc.used)
+	size, err := bc.GetSize(ctx, big.Cid())
+	assert.NoError(err)
+	assert.Equal(30, size)
+}
@@ -111,6 +111,21 @@ type Node struct {
 	Bwc *metrics.BandwidthCounter
 
 	Config *config.Node
+
+	// ProvideQueue announces newly added content to the DHT at the rate set
+	// by Config.ProvideConfig
+	ProvideQueue *ProvideQueue
+
+	blockstoreSync func(context.Context) error
+}
+
+// SyncBlockstore makes every block written so far durable, flushing the write
+// log if there is one. Stores that don't sync on demand are left as they are.
+func (nd *Node) SyncBlockstore(ctx context.Context) error {
+	if nd.blockstoreSync == nil {
+		return nil
+	}
+	return nd.blockstoreSync(ctx)
 }
 
 func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
@@ -204,7 +219,7 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		return nil, err
 	}
 
-	mbs, stordir, err := loadBlockstore(cfg.Blockstore, cfg.WriteLogDir, cfg.HardFlushWriteLog, cfg.WriteLogTruncate, cfg.NoBlockstoreCache)
+	mbs, stordir, bsSync, err := loadBlockstore(cfg.Blockstore, cfg.S3Config, cfg.WriteLogDir, cfg.HardFlushWriteLog, cfg.WriteLogTruncate, cfg.NoBlockstoreCache)
 	if err != nil {
 		return nil, err
 	}
@@ -256,6 +271,19 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 
 	prov.Run() // TODO: call close at some point
 
+	provideQueue, err := NewProvideQueue(cfg.ProvideConfig, func(ctx context.Context, c cid.Cid) error {
+		if frt.Ready() {
+			return frt.Provide(ctx, c, true)
+		}
+		log.Warnf("fullrt not in ready state, falling back to standard dht provide")
+		return ipfsdht.Provide(ctx, c, true)
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("setup provide queue: %w", err)
+	}
+
+	go provideQueue.Run(ctx)
+
 	return &Node{
 		Dht:        ipfsdht,
 		FilDht:     fildht,
@@ -270,6 +298,9 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		Bwc:        bwc,
 		Config:     cfg,
 		StorageDir: stordir,
+
+		ProvideQueue:   provideQueue,
+		blockstoreSync: bsSync,
 	}, nil
 }
 
@@ -314,8 +345,9 @@ func parseBsCfg(bscfg string) (string, []string, string, error) {
 
 /* format:
 :lmdb:/path/to/thing
+:s3:bucket/key/prefix
 */
-func constructBlockstore(bscfg string) (EstuaryBlockstore, string, error) {
+func constructBlockstore(bscfg string, s3cfg config.S3Blockstore) (EstuaryBlockstore, string, error) {
 	if !strings.HasPrefix(bscfg, ":") {
 		lmdbs, err := lmdb.Open(&lmdb.Options{
 			Path:   bscfg,
@@ -356,18 +388,40 @@ func constructBlockstore(bscfg string) (EstuaryBlockstore, string, error) {
 			return nil, "", err
 		}
 
-		return &deleteManyWrap{blockstore.NewBlockstoreNoPrefix(ds)}, path, nil
+		return &syncWrap{
+			EstuaryBlockstore: &deleteManyWrap{blockstore.NewBlockstoreNoPrefix(ds)},
+			sync: func(ctx context.Context) error {
+				return ds.Sync(ctx, datastore.NewKey("/"))
+			},
+		}, path, nil
+	case "s3":
+		if len(params) > 0 {
+			return nil, "", fmt.Errorf("s3 params not supported, see the s3 config")
+		}
+
+		ds, err := newS3Datastore(context.TODO(), s3cfg, path)
+		if err != nil {
+			return nil, "", err
+		}
+
+		var bs EstuaryBlockstore = &deleteManyWrap{blockstore.NewBlockstoreNoPrefix(ds)}
+		if s3cfg.CacheSize > 0 {
+			bs = newBlockCache(bs, s3cfg.CacheSize)
+		}
+
+		// nothing is stored on local disk
+		return bs, "", nil
 	case "migrate":
 		if len(params) != 2 {
 			return nil, "", fmt.Errorf("migrate blockstore requires two params (%d given)", len(params))
 		}
 
-		from, _, err := constructBlockstore(params[0])
+		from, _, err := constructBlockstore(params[0], s3cfg)
 		if err != nil {
 			return nil, "", fmt.Errorf("failed to construct source blockstore for migration: %w", err)
 		}
 
-		to, destPath, err := constructBlockstore(params[1])
+		to, destPath, err := constructBlockstore(params[1], s3cfg)
 		if err != nil {
 			return nil, "", fmt.Errorf("failed to construct dest blockstore for migration: %w", err)
 		}
@@ -383,10 +437,17 @@ func constructBlockstore(bscfg string) (EstuaryBlockstore, string, error) {
 	}
 }
 
-func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool) (blockstore.Blockstore, string, error) {
-	bstore, dir, err := constructBlockstore(bscfg)
+// loadBlockstore also returns a func that makes everything written to the
+// blockstore so far durable, as far as the underlying store allows it
+func loadBlockstore(bscfg string, s3cfg config.S3Blockstore, wal string, flush, walTruncate, nocache bool) (blockstore.Blockstore, string, func(context.Context) error, error) {
+	bstore, dir, err := constructBlockstore(bscfg, s3cfg)
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, err
+	}
+
+	var syncs []func(context.Context) error
+	if sw, ok := bstore.(*syncWrap); ok {
+		syncs = append(syncs, sw.sync)
 	}
 
 	if wal != "" {
@@ -395,24 +456,27 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 
 		writelog, err := badgerbs.Open(opts)
 		if err != nil {
-			return nil, "", err
+			return nil, "", nil, err
 		}
 
 		ab, err := autobatch.NewBlockstore(bstore, writelog, 200, 200, flush)
 		if err != nil {
-			return nil, "", err
+			return nil, "", nil, err
 		}
 
 		if flush {
 			if err := ab.Flush(context.Background()); err != nil {
-				return nil, "", err
+				return nil, "", nil, err
 			}
 		}
 
 		if walTruncate {
-			return nil, "", fmt.Errorf("truncation and full flush complete, halting execution")
+			return nil, "", nil, fmt.Errorf("truncation and full flush complete, halting execution")
 		}
 
+		// blocks sit in the write log until they're flushed, flush them
+		// before syncing the store they're flushed to
+		syncs = append([]func(context.Context) error{ab.Flush}, syncs...)
 		bstore = ab
 	}
 
@@ -427,7 +491,7 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 			HasARCCacheSize: 8 << 20,
 		})
 		if err != nil {
-			return nil, "", err
+			return nil, "", nil, err
 		}
 		bstore = &deleteManyWrap{cbstore}
 	}
@@ -437,7 +501,16 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 
 	var blkst blockstore.Blockstore = mbs
 
-	return blkst, dir, nil
+	sync := func(ctx context.Context) error {
+		for _, s := range syncs {
+			if err := s(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return blkst, dir, sync, nil
 }
 
 func loadOrInitPeerKey(kf string) (crypto.PrivKey, error) {
@@ -467,6 +540,21 @@ func loadOrInitPeerKey(kf string) (crypto.PrivKey, error) {
 }
 
 func setupWallet(dir string) (*wallet.LocalWallet, error) {
+	if k := os.Getenv(WalletKeyEnvVar); k != "" {
+		w, err := loadEnvWallet(k)
+		if err != nil {
+			return nil, err
+		}
+
+		defaddr, err := w.GetDefault()
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Printf("Wallet address is: %s (from %s)\n", defaddr, WalletKeyEnvVar)
+		return w, nil
+	}
+
 	kstore, err := keystore.OpenOrInitKeystore(dir)
 	if err != nil {
 		return nil, err
@@ -499,6 +587,12 @@ func setupWallet(dir string) (*wallet.LocalWallet, error) {
 	return wallet, nil
 }
 
+// syncWrap is a blockstore whose writes can be made durable on demand
+type syncWrap struct {
+	EstuaryBlockstore
+	sync func(context.Context) error
+}
+
 type deleteManyWrap struct {
 	blockstore.Blockstore
 }
@@ -0,0 +1,35 @@
+package node
+
+import (
+	"context"
+
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/lotus/api"
+	rpcstmgr "github.com/filecoin-project/lotus/chain/stmgr/rpc"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"github.com/filecoin-project/lotus/paychmgr"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+)
+
+// NewClientPaychManager opens a payment channel manager over the channels
+// filclient pays for retrievals with, so that they can be funded ahead of a
+// retrieval. filclient keeps its channels under /paych in the datastore it
+// was given, the state of the channels is shared through it.
+//
+// filclient doesn't expose its own manager, so this is a second one over the
+// same channels. The managers only share what is in the datastore, so
+// callers must keep them from working on a channel at the same time, and
+// this one must be the only one that adds funds: callers keep channels above
+// what filclient tops them up to. It isn't started, since starting resumes
+// the channel messages still pending, which filclient's manager already does
+// and which must only be done once.
+func NewClientPaychManager(ctx context.Context, gapi api.Gateway, w *wallet.LocalWallet, ds datastore.Batching) *paychmgr.Manager {
+	pchctx, shutdown := context.WithCancel(ctx)
+	store := paychmgr.NewStore(namespace.Wrap(ds, datastore.NewKey("paych")))
+	return paychmgr.NewManager(pchctx, shutdown, rpcstmgr.NewRPCStateManager(gapi), store, &paychAPI{
+		Gateway: gapi,
+		wallet:  w,
+		mp:      filclient.NewMsgPusher(gapi, w),
+	})
+}
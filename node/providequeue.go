@@ -0,0 +1,239 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/metrics"
+	"github.com/ipfs/go-cid"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"golang.org/x/time/rate"
+)
+
+// how a provide went, as tagged on metrics.ProvideResults
+const (
+	provideSuccess = "success"
+	provideFailure = "failure"
+	provideDropped = "dropped"
+)
+
+type provideFunc func(context.Context, cid.Cid) error
+
+type pendingProvide struct {
+	c        cid.Cid
+	attempts int
+	retryAt  time.Time
+}
+
+// ProvideQueue spreads the DHT provide announcements for new content out over
+// time, as set by config.Provide. Announcements are sent in the order they
+// were added, retried with a growing delay when they fail, and a cid that is
+// already waiting to be announced isn't queued again.
+type ProvideQueue struct {
+	provide provideFunc
+	cfg     config.Provide
+	limiter *rate.Limiter
+
+	lk sync.Mutex
+	// every provide waiting to be sent or retried, by multihash since that's
+	// what the DHT announces
+	pending map[string]struct{}
+	queue   []*pendingProvide
+	retries []*pendingProvide
+
+	wake chan struct{}
+}
+
+func NewProvideQueue(cfg config.Provide, provide provideFunc) (*ProvideQueue, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	limit := rate.Inf
+	if cfg.Rate > 0 {
+		limit = rate.Limit(cfg.Rate)
+	}
+
+	return &ProvideQueue{
+		provide: provide,
+		cfg:     cfg,
+		limiter: rate.NewLimiter(limit, cfg.Burst),
+		pending: make(map[string]struct{}),
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+// Add queues an announcement for c, returning false if one is already
+// waiting to be sent or retried
+func (pq *ProvideQueue) Add(c cid.Cid) bool {
+	pq.lk.Lock()
+	defer pq.lk.Unlock()
+
+	k := string(c.Hash())
+	if _, ok := pq.pending[k]; ok {
+		return false
+	}
+
+	pq.pending[k] = struct{}{}
+	pq.queue = append(pq.queue, &pendingProvide{c: c})
+	pq.recordDepth()
+
+	select {
+	case pq.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Len returns how many announcements are waiting to be sent or retried
+func (pq *ProvideQueue) Len() int {
+	pq.lk.Lock()
+	defer pq.lk.Unlock()
+	return len(pq.pending)
+}
+
+// Run sends queued announcements until ctx is cancelled. Each is sent once
+// the rate limit allows it, without waiting for the ones before it to finish,
+// so a slow DHT doesn't hold back the rate.
+func (pq *ProvideQueue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		p, ok := pq.next(ctx)
+		if !ok {
+			return
+		}
+
+		if err := pq.limiter.Wait(ctx); err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pq.send(ctx, p)
+		}()
+	}
+}
+
+// next waits for an announcement to send: a retry that is due, or else the
+// oldest one queued
+func (pq *ProvideQueue) next(ctx context.Context) (*pendingProvide, bool) {
+	for {
+		pq.lk.Lock()
+		now := time.Now()
+		var wait time.Duration
+		due := -1
+		for i, p := range pq.retries {
+			if !p.retryAt.After(now) {
+				due = i
+				break
+			}
+			if d := p.retryAt.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+		}
+
+		if due >= 0 {
+			p := pq.retries[due]
+			pq.retries = append(pq.retries[:due], pq.retries[due+1:]...)
+			pq.lk.Unlock()
+			return p, true
+		}
+
+		if len(pq.queue) > 0 {
+			p := pq.queue[0]
+			pq.queue[0] = nil
+			pq.queue = pq.queue[1:]
+			pq.lk.Unlock()
+			return p, true
+		}
+		pq.lk.Unlock()
+
+		var retry <-chan time.Time
+		var t *time.Timer
+		if wait > 0 {
+			t = time.NewTimer(wait)
+			retry = t.C
+		}
+
+		select {
+		case <-pq.wake:
+		case <-retry:
+		case <-ctx.Done():
+		}
+
+		if t != nil {
+			t.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+	}
+}
+
+func (pq *ProvideQueue) send(ctx context.Context, p *pendingProvide) {
+	subctx := ctx
+	if pq.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		subctx, cancel = context.WithTimeout(ctx, pq.cfg.Timeout)
+		defer cancel()
+	}
+
+	stop := metrics.Timer(ctx, metrics.ProvideDuration)
+	err := pq.provide(subctx, p.c)
+	stop()
+
+	if err == nil {
+		recordProvideResult(provideSuccess)
+		pq.done(p)
+		return
+	}
+
+	recordProvideResult(provideFailure)
+	if ctx.Err() != nil {
+		return
+	}
+
+	p.attempts++
+	if p.attempts > pq.cfg.MaxRetries {
+		log.Warnf("giving up on providing %s after %d attempts: %s", p.c, p.attempts, err)
+		recordProvideResult(provideDropped)
+		pq.done(p)
+		return
+	}
+
+	delay := pq.cfg.RetryDelay << (p.attempts - 1)
+	log.Debugf("providing %s failed, retrying in %s: %s", p.c, delay, err)
+
+	pq.lk.Lock()
+	p.retryAt = time.Now().Add(delay)
+	pq.retries = append(pq.retries, p)
+	pq.lk.Unlock()
+
+	select {
+	case pq.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (pq *ProvideQueue) done(p *pendingProvide) {
+	pq.lk.Lock()
+	defer pq.lk.Unlock()
+	delete(pq.pending, string(p.c.Hash()))
+	pq.recordDepth()
+}
+
+// recordDepth must be called with pq.lk held
+func (pq *ProvideQueue) recordDepth() {
+	stats.Record(context.Background(), metrics.ProvideQueueDepth.M(int64(len(pq.pending))))
+}
+
+func recordProvideResult(result string) {
+	ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.ProvideResult, result))
+	stats.Record(ctx, metrics.ProvideResults.M(1))
+}
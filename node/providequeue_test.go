@@ -0,0 +1,128 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func testProvideCid(t *testing.T, data string) cid.Cid {
+	mh, err := multihash.Sum([]byte(data), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+func TestProvideQueue(t *testing.T) {
+	var lk sync.Mutex
+	provided := make(map[cid.Cid]int)
+	fails := make(map[cid.Cid]int)
+	done := make(chan cid.Cid, 10)
+
+	pq, err := NewProvideQueue(config.Provide{
+		Rate:       1000,
+		Burst:      1,
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+	}, func(ctx context.Context, c cid.Cid) error {
+		lk.Lock()
+		defer lk.Unlock()
+		provided[c]++
+		if fails[c] > 0 {
+			fails[c]--
+			return errors.New("provide failed")
+		}
+		done <- c
+		return nil
+	})
+	require.NoError(t, err)
+
+	a := testProvideCid(t, "a")
+	b := testProvideCid(t, "b")
+	dropped := testProvideCid(t, "dropped")
+	fails[b] = 2
+	fails[dropped] = 3
+
+	require.True(t, pq.Add(a))
+	require.True(t, pq.Add(b))
+	require.True(t, pq.Add(dropped))
+
+	// the same multihash is already pending, whatever the cid version
+	require.False(t, pq.Add(a))
+	require.False(t, pq.Add(cid.NewCidV0(b.Hash())))
+	require.Equal(t, 3, pq.Len())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pq.Run(ctx)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for provides")
+		}
+	}
+
+	require.Eventually(t, func() bool { return pq.Len() == 0 }, 5*time.Second, time.Millisecond)
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Equal(t, 1, provided[a])
+	require.Equal(t, 3, provided[b])
+	require.Equal(t, 3, provided[dropped])
+
+	// once sent, a cid can be queued again
+	require.True(t, pq.Add(a))
+}
+
+func TestProvideQueueRate(t *testing.T) {
+	var lk sync.Mutex
+	var sent []time.Time
+
+	pq, err := NewProvideQueue(config.Provide{Rate: 20, Burst: 1}, func(ctx context.Context, c cid.Cid) error {
+		lk.Lock()
+		defer lk.Unlock()
+		sent = append(sent, time.Now())
+		return nil
+	})
+	require.NoError(t, err)
+
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		require.True(t, pq.Add(testProvideCid(t, s)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pq.Run(ctx)
+
+	require.Eventually(t, func() bool { return pq.Len() == 0 }, 5*time.Second, time.Millisecond)
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Len(t, sent, 5)
+	// four waits of 50ms each after the first provide
+	require.GreaterOrEqual(t, sent[4].Sub(sent[0]), 150*time.Millisecond)
+}
+
+func TestProvideQueueConfig(t *testing.T) {
+	provide := func(context.Context, cid.Cid) error { return nil }
+
+	_, err := NewProvideQueue(config.Provide{}, provide)
+	require.NoError(t, err)
+
+	_, err = NewProvideQueue(config.Provide{Rate: 10}, provide)
+	require.Error(t, err)
+
+	_, err = NewProvideQueue(config.Provide{Rate: -1, Burst: 1}, provide)
+	require.Error(t, err)
+
+	_, err = NewProvideQueue(config.Provide{MaxRetries: -1}, provide)
+	require.Error(t, err)
+}
@@ -0,0 +1,560 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	dtimpl "github.com/filecoin-project/go-data-transfer/impl"
+	dtnet "github.com/filecoin-project/go-data-transfer/network"
+	gst "github.com/filecoin-project/go-data-transfer/transport/graphsync"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	rpcstmgr "github.com/filecoin-project/lotus/chain/stmgr/rpc"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"github.com/filecoin-project/lotus/paychmgr"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/storeutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	inet "github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// RetrievalProvider serves retrievals of content in the blockstore to other
+// peers, answering retrieval queries and sending the data over graphsync.
+//
+// It runs on its own libp2p host: filclient already runs a data transfer
+// manager on the node's host for our own deals and retrievals, and it
+// doesn't validate incoming retrieval requests.
+type RetrievalProvider struct {
+	host    host.Host
+	bstore  blockstore.Blockstore
+	dt      datatransfer.Manager
+	pchmgr  *paychmgr.Manager
+	payAddr address.Address
+
+	pricePerByte            abi.TokenAmount
+	paymentInterval         uint64
+	paymentIntervalIncrease uint64
+
+	// decides what data may be retrieved, see RetrievalAllowFunc
+	allow RetrievalAllowFunc
+
+	lk    sync.Mutex
+	deals map[datatransfer.ChannelID]*providerDeal
+
+	// sizes of the DAGs we answered queries for, and a slot for each walk
+	// of a DAG to size it that may run at once
+	sizes *lru.Cache
+	walks chan struct{}
+}
+
+// how many DAG sizes are kept for answering queries, and for how long, a
+// DAG may be garbage collected in the meantime
+const (
+	querySizeCacheSize = 1024
+	querySizeCacheTTL  = 10 * time.Minute
+)
+
+// how many DAGs are walked at once to answer queries, queries for others
+// wait their turn
+const maxQueryWalks = 4
+
+type cachedDagSize struct {
+	size uint64
+	at   time.Time
+}
+
+type providerDeal struct {
+	proposal  retrievalmarket.DealProposal
+	receiver  peer.ID
+	started   time.Time
+	interval  uint64
+	sent      uint64
+	paidFor   uint64
+	received  abi.TokenAmount
+	lastFunds bool
+}
+
+// RetrievalAllowFunc reports whether the DAG under root may be retrieved by
+// anyone. Retrievals come from peers, not users, so data that isn't meant
+// for everyone must not be served.
+type RetrievalAllowFunc func(ctx context.Context, root cid.Cid) (bool, error)
+
+// NewRetrievalProvider starts serving retrievals of the DAGs allow permits.
+// Payment vouchers are validated and kept by a payment channel manager of
+// our own, paid retrievals are paid to payAddr. gsopts tune its graphsync
+// instance.
+func NewRetrievalProvider(ctx context.Context, cfg config.RetrievalProvider, gapi api.Gateway, w *wallet.LocalWallet, payAddr address.Address, ds datastore.Batching, bstore blockstore.Blockstore, allow RetrievalAllowFunc, gsopts ...gsimpl.Option) (*RetrievalProvider, error) {
+	pricePerByte, err := pricePerByteFromGiB(cfg.Price)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retrieval provider price: %w", err)
+	}
+
+	if !pricePerByte.IsZero() && cfg.PaymentInterval == 0 {
+		return nil, fmt.Errorf("paid retrievals need a payment interval")
+	}
+
+	peerkey, err := loadOrInitPeerKey(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := libp2p.New(
+		libp2p.ListenAddrStrings(cfg.ListenAddrs...),
+		libp2p.Identity(peerkey),
+		libp2p.DefaultTransports,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	gs := gsimpl.New(ctx, gsnet.NewFromLibp2pHost(h), storeutil.LinkSystemForBlockstore(bstore), gsopts...)
+	tpt := gst.NewTransport(h.ID(), gs)
+	dt, err := dtimpl.NewDataTransfer(namespace.Wrap(ds, datastore.NewKey("/retrieval-provider/datatransfer")), dtnet.NewFromLibp2pHost(h), tpt)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes, err := lru.New(querySizeCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := &RetrievalProvider{
+		sizes:                   sizes,
+		walks:                   make(chan struct{}, maxQueryWalks),
+		host:                    h,
+		bstore:                  bstore,
+		dt:                      dt,
+		payAddr:                 payAddr,
+		pricePerByte:            pricePerByte,
+		paymentInterval:         cfg.PaymentInterval,
+		paymentIntervalIncrease: cfg.PaymentIntervalIncrease,
+		allow:                   allow,
+		deals:                   make(map[datatransfer.ChannelID]*providerDeal),
+	}
+
+	if !pricePerByte.IsZero() {
+		pchctx, shutdown := context.WithCancel(ctx)
+		store := paychmgr.NewStore(namespace.Wrap(ds, datastore.NewKey("/retrieval-provider/paych")))
+		rp.pchmgr = paychmgr.NewManager(pchctx, shutdown, rpcstmgr.NewRPCStateManager(gapi), store, &paychAPI{
+			Gateway: gapi,
+			wallet:  w,
+			mp:      filclient.NewMsgPusher(gapi, w),
+		})
+		if err := rp.pchmgr.Start(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := dt.RegisterVoucherType(&retrievalmarket.DealProposal{}, rp); err != nil {
+		return nil, err
+	}
+	if err := dt.RegisterRevalidator(&retrievalmarket.DealPayment{}, rp); err != nil {
+		return nil, err
+	}
+	if err := dt.RegisterVoucherResultType(&retrievalmarket.DealResponse{}); err != nil {
+		return nil, err
+	}
+
+	dt.SubscribeToEvents(rp.onEvent)
+	if err := dt.Start(ctx); err != nil {
+		return nil, err
+	}
+
+	h.SetStreamHandler(filclient.RetrievalQueryProtocol, rp.handleQuery)
+
+	log.Infow("serving retrievals", "peer", h.ID(), "addrs", h.Addrs(), "pricePerByte", pricePerByte, "paymentAddr", payAddr)
+	return rp, nil
+}
+
+// pricePerByteFromGiB turns a FIL per GiB price into attoFIL per byte
+func pricePerByteFromGiB(price string) (abi.TokenAmount, error) {
+	if price == "" {
+		return big.Zero(), nil
+	}
+
+	perGiB, err := types.ParseFIL(price)
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+
+	return big.Div(abi.TokenAmount(perGiB), big.NewInt(1<<30)), nil
+}
+
+// AddrInfo is how other peers reach the provider
+func (rp *RetrievalProvider) AddrInfo() peer.AddrInfo {
+	return peer.AddrInfo{
+		ID:    rp.host.ID(),
+		Addrs: rp.host.Addrs(),
+	}
+}
+
+func (rp *RetrievalProvider) Close() error {
+	if err := rp.dt.Stop(context.Background()); err != nil {
+		log.Errorf("failed to stop retrieval provider data transfer: %s", err)
+	}
+	return rp.host.Close()
+}
+
+func (rp *RetrievalProvider) handleQuery(s inet.Stream) {
+	defer s.Close()
+
+	var q retrievalmarket.Query
+	if err := cborutil.ReadCborRPC(s, &q); err != nil {
+		log.Warnf("failed to read retrieval query from %s: %s", s.Conn().RemotePeer(), err)
+		return
+	}
+
+	resp := retrievalmarket.QueryResponse{
+		Status:                     retrievalmarket.QueryResponseUnavailable,
+		PieceCIDFound:              retrievalmarket.QueryItemUnavailable,
+		PaymentAddress:             rp.payAddr,
+		MinPricePerByte:            rp.pricePerByte,
+		MaxPaymentInterval:         rp.paymentInterval,
+		MaxPaymentIntervalIncrease: rp.paymentIntervalIncrease,
+		UnsealPrice:                big.Zero(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	size, err := rp.allowedDagSize(ctx, q.PayloadCID)
+	if err != nil {
+		resp.Message = err.Error()
+	} else {
+		resp.Status = retrievalmarket.QueryResponseAvailable
+		resp.PieceCIDFound = retrievalmarket.QueryItemAvailable
+		resp.Size = size
+	}
+
+	if err := cborutil.WriteCborRPC(s, &resp); err != nil {
+		log.Warnf("failed to write retrieval query response to %s: %s", s.Conn().RemotePeer(), err)
+	}
+}
+
+// allowedDagSize is dagSize for DAGs that may be retrieved, others are
+// reported as not available so their presence isn't given away
+func (rp *RetrievalProvider) allowedDagSize(ctx context.Context, root cid.Cid) (uint64, error) {
+	ok, err := rp.allow(ctx, root)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.New("content not available")
+	}
+
+	return rp.dagSize(ctx, root)
+}
+
+// dagSize returns the size of the DAG under root, it errors unless every
+// block of it is in our blockstore. Anyone can query us, so sizes are cached
+// and only a few DAGs are walked at once.
+func (rp *RetrievalProvider) dagSize(ctx context.Context, root cid.Cid) (uint64, error) {
+	if v, ok := rp.sizes.Get(root); ok {
+		cs := v.(cachedDagSize)
+		if time.Since(cs.at) < querySizeCacheTTL {
+			return cs.size, nil
+		}
+		rp.sizes.Remove(root)
+	}
+
+	select {
+	case rp.walks <- struct{}{}:
+	case <-ctx.Done():
+		return 0, fmt.Errorf("content not available: %w", ctx.Err())
+	}
+	defer func() {
+		<-rp.walks
+	}()
+
+	size, err := rp.walkDagSize(ctx, root)
+	if err != nil {
+		return 0, err
+	}
+
+	rp.sizes.Add(root, cachedDagSize{size: size, at: time.Now()})
+	return size, nil
+}
+
+func (rp *RetrievalProvider) walkDagSize(ctx context.Context, root cid.Cid) (uint64, error) {
+	dserv := merkledag.NewDAGService(blockservice.New(rp.bstore, offline.Exchange(rp.bstore)))
+
+	var size uint64
+	var sizeLk sync.Mutex
+	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*format.Link, error) {
+		nd, err := dserv.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		sizeLk.Lock()
+		size += uint64(len(nd.RawData()))
+		sizeLk.Unlock()
+
+		return nd.Links(), nil
+	}, root, cid.NewSet().Visit, merkledag.Concurrent())
+	if err != nil {
+		return 0, fmt.Errorf("content not available: %w", err)
+	}
+
+	return size, nil
+}
+
+func (rp *RetrievalProvider) ValidatePush(isRestart bool, chid datatransfer.ChannelID, sender peer.ID, voucher datatransfer.Voucher, baseCid cid.Cid, selector ipld.Node) (datatransfer.VoucherResult, error) {
+	return nil, errors.New("retrieval provider does not accept pushes")
+}
+
+func (rp *RetrievalProvider) ValidatePull(isRestart bool, chid datatransfer.ChannelID, receiver peer.ID, voucher datatransfer.Voucher, baseCid cid.Cid, selector ipld.Node) (datatransfer.VoucherResult, error) {
+	proposal, ok := voucher.(*retrievalmarket.DealProposal)
+	if !ok {
+		return nil, errors.New("wrong voucher type")
+	}
+
+	if isRestart {
+		rp.lk.Lock()
+		_, ok := rp.deals[chid]
+		rp.lk.Unlock()
+		if ok {
+			return nil, nil
+		}
+	}
+
+	reject := func(err error) (datatransfer.VoucherResult, error) {
+		log.Infow("rejected retrieval", "peer", receiver, "cid", baseCid, "err", err)
+		return &retrievalmarket.DealResponse{
+			ID:      proposal.ID,
+			Status:  retrievalmarket.DealStatusRejected,
+			Message: err.Error(),
+		}, err
+	}
+
+	if !proposal.PayloadCID.Equals(baseCid) {
+		return reject(errors.New("incorrect cid for this proposal"))
+	}
+
+	allowed, err := rp.allow(context.TODO(), baseCid)
+	if err != nil {
+		return nil, err
+	}
+
+	has, err := rp.bstore.Has(context.TODO(), baseCid)
+	if err != nil {
+		return nil, err
+	}
+	if !has || !allowed {
+		return &retrievalmarket.DealResponse{
+			ID:      proposal.ID,
+			Status:  retrievalmarket.DealStatusDealNotFound,
+			Message: "content not found",
+		}, retrievalmarket.ErrNotFound
+	}
+
+	// without a payment channel manager we couldn't take the vouchers
+	if rp.pchmgr == nil && !proposal.PricePerByte.IsZero() {
+		return reject(fmt.Errorf("retrievals are free here, not accepting payments of %s per byte", proposal.PricePerByte))
+	}
+
+	if proposal.PricePerByte.LessThan(rp.pricePerByte) {
+		return reject(fmt.Errorf("price per byte %s is below our price %s", proposal.PricePerByte, rp.pricePerByte))
+	}
+
+	if !rp.pricePerByte.IsZero() && (proposal.PaymentInterval == 0 || proposal.PaymentInterval > rp.paymentInterval) {
+		return reject(fmt.Errorf("payment interval %d must be between 1 and %d", proposal.PaymentInterval, rp.paymentInterval))
+	}
+
+	rp.lk.Lock()
+	rp.deals[chid] = &providerDeal{
+		proposal: *proposal,
+		receiver: receiver,
+		started:  time.Now(),
+		interval: proposal.PaymentInterval,
+		received: big.Zero(),
+	}
+	rp.lk.Unlock()
+
+	log.Infow("accepted retrieval", "peer", receiver, "cid", baseCid, "dealID", proposal.ID, "pricePerByte", proposal.PricePerByte)
+	return &retrievalmarket.DealResponse{
+		ID:     proposal.ID,
+		Status: retrievalmarket.DealStatusAccepted,
+	}, nil
+}
+
+// OnPullDataSent asks for payment each time another payment interval worth
+// of data has been sent, pausing the transfer until it comes in
+func (rp *RetrievalProvider) OnPullDataSent(chid datatransfer.ChannelID, additionalBytesSent uint64) (bool, datatransfer.VoucherResult, error) {
+	rp.lk.Lock()
+	defer rp.lk.Unlock()
+
+	d, ok := rp.deals[chid]
+	if !ok {
+		return false, nil, nil
+	}
+
+	d.sent += additionalBytesSent
+	if d.proposal.PricePerByte.IsZero() || d.sent < d.interval {
+		return true, nil, nil
+	}
+
+	owed := big.Mul(big.NewIntUnsigned(d.sent-d.paidFor), d.proposal.PricePerByte)
+	d.interval = d.proposal.Params.NextInterval(d.interval)
+	return true, &retrievalmarket.DealResponse{
+		ID:          d.proposal.ID,
+		Status:      retrievalmarket.DealStatusFundsNeeded,
+		PaymentOwed: owed,
+	}, datatransfer.ErrPause
+}
+
+func (rp *RetrievalProvider) OnPushDataReceived(chid datatransfer.ChannelID, additionalBytesReceived uint64) (bool, datatransfer.VoucherResult, error) {
+	return false, nil, nil
+}
+
+// OnComplete asks for whatever is still owed before completing the deal
+func (rp *RetrievalProvider) OnComplete(chid datatransfer.ChannelID) (bool, datatransfer.VoucherResult, error) {
+	rp.lk.Lock()
+	defer rp.lk.Unlock()
+
+	d, ok := rp.deals[chid]
+	if !ok {
+		return false, nil, nil
+	}
+
+	owed := big.Mul(big.NewIntUnsigned(d.sent-d.paidFor), d.proposal.PricePerByte)
+	if owed.IsZero() {
+		return true, &retrievalmarket.DealResponse{
+			ID:     d.proposal.ID,
+			Status: retrievalmarket.DealStatusCompleted,
+		}, nil
+	}
+
+	d.lastFunds = true
+	return true, &retrievalmarket.DealResponse{
+		ID:          d.proposal.ID,
+		Status:      retrievalmarket.DealStatusFundsNeededLastPayment,
+		PaymentOwed: owed,
+	}, datatransfer.ErrPause
+}
+
+// Revalidate takes a payment voucher, checks it against the payment channel
+// and resumes the transfer once everything owed so far has been paid
+func (rp *RetrievalProvider) Revalidate(chid datatransfer.ChannelID, voucher datatransfer.Voucher) (datatransfer.VoucherResult, error) {
+	payment, ok := voucher.(*retrievalmarket.DealPayment)
+	if !ok {
+		return nil, errors.New("wrong voucher type")
+	}
+
+	rp.lk.Lock()
+	defer rp.lk.Unlock()
+
+	d, ok := rp.deals[chid]
+	if !ok {
+		return nil, nil
+	}
+
+	if rp.pchmgr == nil {
+		return nil, errors.New("not accepting payments")
+	}
+
+	received, err := rp.pchmgr.AddVoucherInbound(context.TODO(), payment.PaymentChannel, payment.PaymentVoucher, nil, big.Zero())
+	if err != nil {
+		return &retrievalmarket.DealResponse{
+			ID:      d.proposal.ID,
+			Status:  retrievalmarket.DealStatusErrored,
+			Message: err.Error(),
+		}, err
+	}
+
+	d.received = big.Add(d.received, received)
+	d.paidFor = big.Div(d.received, d.proposal.PricePerByte).Uint64()
+
+	required := big.Mul(big.NewIntUnsigned(d.proposal.Params.IntervalLowerBound(d.interval)), d.proposal.PricePerByte)
+	if d.lastFunds {
+		required = big.Mul(big.NewIntUnsigned(d.sent), d.proposal.PricePerByte)
+	}
+
+	if owed := big.Sub(required, d.received); owed.GreaterThan(big.Zero()) {
+		return &retrievalmarket.DealResponse{
+			ID:          d.proposal.ID,
+			Status:      retrievalmarket.DealStatusFundsNeeded,
+			PaymentOwed: owed,
+		}, datatransfer.ErrPause
+	}
+
+	if d.lastFunds {
+		return &retrievalmarket.DealResponse{
+			ID:     d.proposal.ID,
+			Status: retrievalmarket.DealStatusCompleted,
+		}, datatransfer.ErrResume
+	}
+
+	return nil, datatransfer.ErrResume
+}
+
+func (rp *RetrievalProvider) onEvent(event datatransfer.Event, st datatransfer.ChannelState) {
+	switch event.Code {
+	case datatransfer.CleanupComplete, datatransfer.Error, datatransfer.Cancel:
+	default:
+		return
+	}
+
+	rp.lk.Lock()
+	d, ok := rp.deals[st.ChannelID()]
+	delete(rp.deals, st.ChannelID())
+	rp.lk.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if event.Code == datatransfer.CleanupComplete {
+		log.Infow("served retrieval", "peer", d.receiver, "cid", d.proposal.PayloadCID, "dealID", d.proposal.ID, "bytes", st.Sent(), "paid", types.FIL(d.received), "took", time.Since(d.started))
+		return
+	}
+
+	log.Warnw("retrieval ended early", "peer", d.receiver, "cid", d.proposal.PayloadCID, "dealID", d.proposal.ID, "bytes", st.Sent(), "paid", types.FIL(d.received), "event", datatransfer.Events[event.Code], "message", event.Message)
+}
+
+// paychAPI gives the payment channel manager what it needs from the chain
+// and our wallet to accept vouchers and collect on them, or to fund the
+// channels we pay with
+type paychAPI struct {
+	api.Gateway
+	wallet *wallet.LocalWallet
+	mp     *filclient.MsgPusher
+}
+
+func (a *paychAPI) MpoolPushMessage(ctx context.Context, msg *types.Message, maxFee *api.MessageSendSpec) (*types.SignedMessage, error) {
+	return a.mp.MpoolPushMessage(ctx, msg, maxFee)
+}
+
+func (a *paychAPI) WalletHas(ctx context.Context, addr address.Address) (bool, error) {
+	return a.wallet.WalletHas(ctx, addr)
+}
+
+func (a *paychAPI) WalletSign(ctx context.Context, addr address.Address, data []byte) (*crypto.Signature, error) {
+	return a.wallet.WalletSign(ctx, addr, data, api.MsgMeta{Type: api.MTUnknown})
+}
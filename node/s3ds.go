@@ -0,0 +1,384 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+const s3RequestTimeout = time.Minute
+
+// s3Datastore keeps values as objects in a bucket of an S3-compatible store.
+// Requests are signed with AWS signature version 4 and address the bucket
+// path-style, which AWS and the usual self hosted stores all accept.
+type s3Datastore struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+
+	client *http.Client
+}
+
+var _ datastore.Batching = (*s3Datastore)(nil)
+
+// newS3Datastore opens the bucket and key prefix given as bucket/prefix, and
+// checks it can be listed with the configured credentials
+func newS3Datastore(ctx context.Context, cfg config.S3Blockstore, loc string) (*s3Datastore, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("s3 blockstore needs an endpoint")
+	}
+
+	ep, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+
+	bucket, prefix := loc, ""
+	if i := strings.Index(loc, "/"); i >= 0 {
+		bucket, prefix = loc[:i], strings.Trim(loc[i+1:], "/")
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 blockstore needs a bucket")
+	}
+
+	sds := &s3Datastore{
+		endpoint:  ep,
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    cfg.Region,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		client:    &http.Client{Timeout: s3RequestTimeout},
+	}
+
+	if _, _, err := sds.list(ctx, sds.prefix, "", 1); err != nil {
+		return nil, fmt.Errorf("failed to access s3 bucket %q: %w", bucket, err)
+	}
+
+	return sds, nil
+}
+
+func (sds *s3Datastore) objectKey(k datastore.Key) string {
+	name := strings.TrimPrefix(k.String(), "/")
+	if sds.prefix == "" {
+		return name
+	}
+	return sds.prefix + "/" + name
+}
+
+func (sds *s3Datastore) dsKey(obj string) datastore.Key {
+	if sds.prefix != "" {
+		obj = strings.TrimPrefix(obj, sds.prefix+"/")
+	}
+	return datastore.NewKey(obj)
+}
+
+func (sds *s3Datastore) Get(ctx context.Context, k datastore.Key) ([]byte, error) {
+	resp, err := sds.do(ctx, "GET", sds.objectKey(k), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, datastore.ErrNotFound
+	default:
+		return nil, s3Error(resp)
+	}
+}
+
+func (sds *s3Datastore) Has(ctx context.Context, k datastore.Key) (bool, error) {
+	_, err := sds.GetSize(ctx, k)
+	switch err {
+	case nil:
+		return true, nil
+	case datastore.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (sds *s3Datastore) GetSize(ctx context.Context, k datastore.Key) (int, error) {
+	resp, err := sds.do(ctx, "HEAD", sds.objectKey(k), nil, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return int(resp.ContentLength), nil
+	case http.StatusNotFound:
+		return -1, datastore.ErrNotFound
+	default:
+		return -1, s3Error(resp)
+	}
+}
+
+func (sds *s3Datastore) Put(ctx context.Context, k datastore.Key, value []byte) error {
+	resp, err := sds.do(ctx, "PUT", sds.objectKey(k), nil, value)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (sds *s3Datastore) Delete(ctx context.Context, k datastore.Key) error {
+	resp, err := sds.do(ctx, "DELETE", sds.objectKey(k), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// deleting a missing object isn't an error, for S3 or for datastores
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s3Error(resp)
+	}
+}
+
+// Sync does nothing, objects are durable once a put returns
+func (sds *s3Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	return nil
+}
+
+func (sds *s3Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	return datastore.NewBasicBatch(sds), nil
+}
+
+func (sds *s3Datastore) Close() error {
+	return nil
+}
+
+// Query lists the bucket a page at a time as results are read, fetching
+// values only if the query asks for them
+func (sds *s3Datastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	prefix := sds.prefix
+	if p := strings.Trim(q.Prefix, "/"); p != "" {
+		prefix = sds.objectKey(datastore.NewKey(p)) + "/"
+	} else if prefix != "" {
+		prefix += "/"
+	}
+
+	var page []s3Object
+	var token string
+	var done bool
+	next := func() (dsq.Result, bool) {
+		for len(page) == 0 {
+			if done {
+				return dsq.Result{}, false
+			}
+
+			var err error
+			page, token, err = sds.list(ctx, prefix, token, 1000)
+			if err != nil {
+				done = true
+				return dsq.Result{Error: err}, true
+			}
+			done = token == ""
+		}
+
+		obj := page[0]
+		page = page[1:]
+
+		e := dsq.Entry{
+			Key:  sds.dsKey(obj.Key).String(),
+			Size: int(obj.Size),
+		}
+		if !q.KeysOnly {
+			val, err := sds.Get(ctx, datastore.RawKey(e.Key))
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			e.Value = val
+		}
+		return dsq.Result{Entry: e}, true
+	}
+
+	// the listing has the prefix applied, the rest of the query is applied
+	// to what it returns
+	naive := q
+	naive.Prefix = ""
+	return dsq.NaiveQueryApply(naive, dsq.ResultsFromIterator(q, dsq.Iterator{Next: next})), nil
+}
+
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// list returns a page of the objects under prefix, and the token of the next
+// page if there is one
+func (sds *s3Datastore) list(ctx context.Context, prefix, token string, max int) ([]s3Object, string, error) {
+	q := url.Values{
+		"list-type": {"2"},
+		"max-keys":  {fmt.Sprint(max)},
+	}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+
+	resp, err := sds.do(ctx, "GET", "", q, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", s3Error(resp)
+	}
+
+	var res s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, "", fmt.Errorf("failed to decode s3 listing: %w", err)
+	}
+
+	if !res.IsTruncated {
+		return res.Contents, "", nil
+	}
+	return res.Contents, res.NextContinuationToken, nil
+}
+
+func (sds *s3Datastore) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *sds.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + sds.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	if sds.accessKey != "" {
+		sds.sign(req, body, time.Now())
+	}
+
+	return sds.client.Do(req)
+}
+
+// sign adds an AWS signature version 4 authorization header to the request
+func (sds *s3Datastore) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + sds.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := []byte("AWS4" + sds.secretKey)
+	for _, part := range []string{day, sds.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sds.accessKey, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, the way
+// signature version 4 expects, leaving slashes alone unless encodeSlash
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3Error(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, bytes.TrimSpace(msg))
+}
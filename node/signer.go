@@ -0,0 +1,112 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+)
+
+// WalletKeyEnvVar holds a wallet key in the hex format produced by
+// `lotus wallet export`. When set, the key is kept in memory only and never
+// written to the wallet directory.
+const WalletKeyEnvVar = "ESTUARY_WALLET_KEY"
+
+// RemoteSignerTokenEnvVar holds the API token for the remote signer, if it
+// needs one
+const RemoteSignerTokenEnvVar = "ESTUARY_REMOTE_SIGNER_TOKEN"
+
+// Signer signs data on behalf of a wallet address. The local wallet
+// implements it, as does any remote lotus wallet API.
+type Signer interface {
+	WalletSign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error)
+}
+
+var _ Signer = (*wallet.LocalWallet)(nil)
+
+// NewRemoteSigner connects to a lotus wallet API (such as lotus-wallet,
+// which can front a ledger) so signing requests are forwarded to it instead
+// of using keys from our own keystore. The closer ends the connection.
+func NewRemoteSigner(ctx context.Context, url, token string) (api.Wallet, jsonrpc.ClientCloser, error) {
+	headers := http.Header{}
+	if token != "" {
+		headers.Add("Authorization", "Bearer "+token)
+	}
+
+	w, closer, err := client.NewWalletRPCV0(ctx, url, headers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to remote signer: %w", err)
+	}
+
+	return w, closer, nil
+}
+
+// RemoteSignerAddress picks the address a remote wallet makes deals from:
+// the configured one, which the wallet has to hold the key of, or else the
+// only address the wallet has
+func RemoteSignerAddress(ctx context.Context, w api.Wallet, configured string) (address.Address, error) {
+	if configured != "" {
+		addr, err := address.NewFromString(configured)
+		if err != nil {
+			return address.Undef, fmt.Errorf("invalid remote signer address %q: %w", configured, err)
+		}
+
+		has, err := w.WalletHas(ctx, addr)
+		if err != nil {
+			return address.Undef, fmt.Errorf("checking remote signer for %s: %w", addr, err)
+		}
+		if !has {
+			return address.Undef, fmt.Errorf("remote signer doesn't hold the key of %s", addr)
+		}
+		return addr, nil
+	}
+
+	addrs, err := w.WalletList(ctx)
+	if err != nil {
+		return address.Undef, fmt.Errorf("listing remote signer addresses: %w", err)
+	}
+
+	if len(addrs) != 1 {
+		return address.Undef, fmt.Errorf("remote signer has %d addresses, configure the one to make deals from", len(addrs))
+	}
+	return addrs[0], nil
+}
+
+// loadEnvWallet builds an in memory wallet holding the key from
+// WalletKeyEnvVar as its default address
+func loadEnvWallet(encoded string) (*wallet.LocalWallet, error) {
+	kb, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", WalletKeyEnvVar, err)
+	}
+
+	var ki types.KeyInfo
+	if err := json.Unmarshal(kb, &ki); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", WalletKeyEnvVar, err)
+	}
+
+	w, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := w.WalletImport(context.TODO(), &ki)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.SetDefault(addr); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
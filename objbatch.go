@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+)
+
+// insertObjectsAndRefs records the objects of a DAG and refs from them to the
+// given content. Blocks that already have an object row, because other
+// content shares them, reuse that row and only get a new ref, so the same
+// bytes aren't accounted for twice. Everything happens in one transaction
+// with batchSize rows per insert statement, our database handle skips the
+// default transaction so without it every batch would be committed (and
+// synced) on its own.
+//
+// BenchmarkInsertObjects compares this with inserting row by row.
+func insertObjectsAndRefs(db *gorm.DB, content uint, objects []*Object, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = util.DefaultObjectBatchSize
+	}
+
+	cids := make([]cid.Cid, 0, len(objects))
+	for _, o := range objects {
+		cids = append(cids, o.Cid.CID)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		ids, err := util.InsertObjectsAndRefs(tx, cids, batchSize, func(idx []int) ([]uint, error) {
+			rows := make([]*Object, 0, len(idx))
+			for _, i := range idx {
+				rows = append(rows, objects[i])
+			}
+
+			if err := tx.CreateInBatches(rows, batchSize).Error; err != nil {
+				return nil, err
+			}
+
+			ids := make([]uint, 0, len(rows))
+			for _, o := range rows {
+				ids = append(ids, o.ID)
+			}
+			return ids, nil
+		}, func(objIDs []uint) error {
+			refs := make([]ObjRef, 0, len(objIDs))
+			for _, id := range objIDs {
+				refs = append(refs, ObjRef{
+					Content: content,
+					Object:  id,
+				})
+			}
+			return tx.CreateInBatches(refs, batchSize).Error
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, o := range objects {
+			o.ID = ids[i]
+		}
+		return nil
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestObjects(t testing.TB, n int) []*Object {
+	objects := make([]*Object, 0, n)
+	for i := 0; i < n; i++ {
+		h, err := multihash.Sum([]byte(fmt.Sprint(i)), multihash.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		objects = append(objects, &Object{
+			Cid:  util.DbCID{cid.NewCidV1(cid.Raw, h)},
+			Size: i,
+		})
+	}
+	return objects
+}
+
+func TestInsertObjectsAndRefs(t *testing.T) {
+	assert := assert.New(t)
+	db := newTestDB(t, &Object{}, &ObjRef{})
+
+	objects := makeTestObjects(t, 2500)
+	assert.NoError(insertObjectsAndRefs(db, 7, objects, 1000))
+
+	var numRefs int64
+	assert.NoError(db.Model(&ObjRef{}).Where("content = ?", 7).Count(&numRefs).Error)
+	assert.Equal(int64(len(objects)), numRefs)
+
+	for _, o := range objects {
+		assert.NotZero(o.ID)
+	}
+}
+
+func TestInsertObjectsAndRefsSharedObjects(t *testing.T) {
+	assert := assert.New(t)
+	db := newTestDB(t, &Object{}, &ObjRef{})
+
+	// two versions of a dataset that share half their blocks
+	all := makeTestObjects(t, 30)
+	first := all[:20]
+	second := make([]*Object, 0, 20)
+	for _, o := range all[10:] {
+		second = append(second, &Object{Cid: o.Cid, Size: o.Size})
+	}
+	// and a block that shows up twice in the same DAG
+	second = append(second, &Object{Cid: all[25].Cid, Size: all[25].Size})
+
+	assert.NoError(insertObjectsAndRefs(db, 1, first, 7))
+	assert.NoError(insertObjectsAndRefs(db, 2, second, 7))
+
+	var numObjects int64
+	assert.NoError(db.Model(&Object{}).Count(&numObjects).Error)
+	assert.Equal(int64(30), numObjects)
+
+	var numRefs int64
+	assert.NoError(db.Model(&ObjRef{}).Where("content = ?", 2).Count(&numRefs).Error)
+	assert.Equal(int64(20), numRefs)
+
+	// the overlap points at the same rows
+	for i, o := range second[:10] {
+		assert.Equal(first[10+i].ID, o.ID)
+	}
+	assert.Equal(second[15].ID, second[20].ID)
+
+	var shared int64
+	assert.NoError(db.Model(&ObjRef{}).
+		Where("content = ? and object in (?)", 2, db.Model(&ObjRef{}).Select("object").Where("content = ?", 1)).
+		Count(&shared).Error)
+	assert.Equal(int64(10), shared)
+
+	var unique struct{ Bytes int64 }
+	assert.NoError(db.Model(&Object{}).Select("sum(size) as bytes").Scan(&unique).Error)
+	var want int64
+	for _, o := range all {
+		want += int64(o.Size)
+	}
+	assert.Equal(want, unique.Bytes)
+}
+
+func BenchmarkInsertObjects(b *testing.B) {
+	const numObjects = 100000
+
+	b.Run("per-row", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := newTestDB(b, &Object{}, &ObjRef{})
+			objects := makeTestObjects(b, numObjects)
+			b.StartTimer()
+
+			for _, o := range objects {
+				if err := db.Create(o).Error; err != nil {
+					b.Fatal(err)
+				}
+
+				if err := db.Create(&ObjRef{Content: 1, Object: o.ID}).Error; err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := newTestDB(b, &Object{}, &ObjRef{})
+			objects := makeTestObjects(b, numObjects)
+			b.StartTimer()
+
+			if err := insertObjectsAndRefs(db, 1, objects, util.DefaultObjectBatchSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"gorm.io/gorm"
+)
+
+// how objects can be ordered when listing them
+const (
+	objectsBySize = "size"
+	objectsByRefs = "refs"
+)
+
+type objectRefCount struct {
+	ID         uint       `json:"id"`
+	Cid        util.DbCID `json:"cid"`
+	Size       int        `json:"size"`
+	LastAccess time.Time  `json:"lastAccess"`
+	Refs       int64      `json:"refs"`
+	Contents   int64      `json:"contents"`
+}
+
+// topObjects lists the largest or most referenced objects along with how many
+// references and distinct contents point at each of them
+func topObjects(db *gorm.DB, orderBy string, limit int) ([]objectRefCount, error) {
+	var order string
+	switch orderBy {
+	case "", objectsBySize:
+		order = "objects.size desc, refs desc"
+	case objectsByRefs:
+		order = "refs desc, objects.size desc"
+	default:
+		return nil, fmt.Errorf("unknown object ordering %q", orderBy)
+	}
+
+	var out []objectRefCount
+	if err := db.Table("objects").
+		Select("objects.id, objects.cid, objects.size, objects.last_access, count(distinct obj_refs.id) as refs, count(distinct obj_refs.content) as contents").
+		Joins("left join obj_refs on obj_refs.object = objects.id").
+		Group("objects.id").
+		Order(order).
+		Limit(limit).
+		Scan(&out).Error; err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopObjects(t *testing.T) {
+	assert := assert.New(t)
+	db := newTestDB(t, &Object{}, &ObjRef{})
+
+	objects := makeTestObjects(t, 5)
+	assert.NoError(db.Create(&objects).Error)
+
+	// object 1 is shared by three contents, one of which references it twice
+	for _, ref := range []ObjRef{
+		{Content: 1, Object: objects[1].ID},
+		{Content: 2, Object: objects[1].ID},
+		{Content: 3, Object: objects[1].ID},
+		{Content: 3, Object: objects[1].ID},
+		{Content: 1, Object: objects[4].ID},
+	} {
+		ref := ref
+		assert.NoError(db.Create(&ref).Error)
+	}
+
+	bySize, err := topObjects(db, objectsBySize, 2)
+	assert.NoError(err)
+	if assert.Len(bySize, 2) {
+		assert.Equal(objects[4].ID, bySize[0].ID)
+		assert.Equal(int64(1), bySize[0].Refs)
+		assert.Equal(objects[3].ID, bySize[1].ID)
+		assert.Equal(int64(0), bySize[1].Refs)
+	}
+
+	byRefs, err := topObjects(db, objectsByRefs, 1)
+	assert.NoError(err)
+	if assert.Len(byRefs, 1) {
+		assert.Equal(objects[1].ID, byRefs[0].ID)
+		assert.Equal(objects[1].Cid.CID, byRefs[0].Cid.CID)
+		assert.Equal(int64(4), byRefs[0].Refs)
+		assert.Equal(int64(3), byRefs[0].Contents)
+	}
+
+	_, err = topObjects(db, "bogus", 1)
+	assert.Error(err)
+}
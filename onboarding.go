@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/application-research/estuary/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"gorm.io/gorm"
+)
+
+// The stages a content goes through after being added, in order, each the
+// column of Content it is recorded in. Each is recorded the first time one of
+// the content's deals gets there, the last once the content has as many
+// sealed deals as it should.
+const (
+	onboardingProposed    = "first_deal_proposed_at"
+	onboardingTransferred = "first_transferred_at"
+	onboardingSealed      = "first_sealed_at"
+	onboardingReplicated  = "replicated_at"
+)
+
+// onboardingStageNames are what the stages are called in reports and metrics
+var onboardingStageNames = map[string]string{
+	onboardingProposed:    "proposed",
+	onboardingTransferred: "transferred",
+	onboardingSealed:      "sealed",
+	onboardingReplicated:  "replicated",
+}
+
+// markOnboardingStage records that a content, and the contents aggregated in
+// it, reached an onboarding stage at the given time, unless they already had.
+// The later stages are only recorded for contents with a proposal recorded,
+// so contents whose deals were made before the stages were recorded don't
+// report a latency counted from partway through.
+func (cm *ContentManager) markOnboardingStage(contID uint, stage string, at time.Time) error {
+	cm.onboardingLk.Lock()
+	defer cm.onboardingLk.Unlock()
+
+	unmarked := func() *gorm.DB {
+		q := cm.DB.Model(Content{}).Where("(id = ? or aggregated_in = ?) and "+stage+" is null", contID, contID)
+		if stage != onboardingProposed {
+			q = q.Where(onboardingProposed + " is not null")
+		}
+		return q
+	}
+
+	var added []time.Time
+	if err := unmarked().Where("not aggregate").Pluck("created_at", &added).Error; err != nil {
+		return err
+	}
+
+	if err := unmarked().UpdateColumn(stage, at).Error; err != nil {
+		return err
+	}
+
+	ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.OnboardingStage, onboardingStageNames[stage]))
+	for _, t := range added {
+		stats.Record(ctx, metrics.OnboardingLatency.M(float64(at.Sub(t))/float64(time.Millisecond)))
+	}
+	return nil
+}
+
+// recordOnboardingStage marks that a content reached an onboarding stage now,
+// only logging failures since they shouldn't hold up its deals
+func (cm *ContentManager) recordOnboardingStage(contID uint, stage string) {
+	if err := cm.markOnboardingStage(contID, stage, time.Now()); err != nil {
+		log.Warnw("failed to record onboarding stage", "content", contID, "stage", onboardingStageNames[stage], "err", err)
+	}
+}
+
+// onboardingLatency sums up how long one step of onboarding took across
+// contents. Low, Median and High are the 10th, 50th and 90th percentiles.
+type onboardingLatency struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Samples int           `json:"samples"`
+	Low     time.Duration `json:"low"`
+	Median  time.Duration `json:"median"`
+	High    time.Duration `json:"high"`
+	P99     time.Duration `json:"p99"`
+	Max     time.Duration `json:"max"`
+}
+
+type onboardingReport struct {
+	Since time.Time `json:"since"`
+	// contents added since then
+	Contents int `json:"contents"`
+	// of those, the ones not replicated yet
+	Pending int `json:"pending"`
+
+	// each step in turn, then from added to replicated
+	Steps []*onboardingLatency `json:"steps"`
+}
+
+// onboardingStats reports how long the contents added since the given time
+// took to get through each step of onboarding, and from being added to being
+// replicated. Comparing the steps shows where the pipeline is slow: the step
+// to the first proposal covers staging and aggregation, the ones after cover
+// the transfer and the miner sealing. Aggregates themselves and split
+// contents aren't counted.
+func onboardingStats(db *gorm.DB, since time.Time) (*onboardingReport, error) {
+	var contents []Content
+	if err := db.Select("id, created_at, first_deal_proposed_at, first_transferred_at, first_sealed_at, replicated_at").
+		Where("created_at >= ? and not aggregate and not dag_split", since).
+		Find(&contents).Error; err != nil {
+		return nil, err
+	}
+
+	stages := []string{"added", onboardingStageNames[onboardingProposed], onboardingStageNames[onboardingTransferred],
+		onboardingStageNames[onboardingSealed], onboardingStageNames[onboardingReplicated]}
+
+	// the steps between consecutive stages, then the whole way through
+	durs := make([][]time.Duration, len(stages))
+
+	rep := &onboardingReport{
+		Since:    since,
+		Contents: len(contents),
+	}
+
+	for _, c := range contents {
+		added := c.CreatedAt
+		times := []*time.Time{&added, c.FirstDealProposedAt, c.FirstTransferredAt, c.FirstSealedAt, c.ReplicatedAt}
+
+		if c.ReplicatedAt == nil {
+			rep.Pending++
+		} else {
+			durs[len(stages)-1] = append(durs[len(stages)-1], c.ReplicatedAt.Sub(added))
+		}
+
+		for i := 1; i < len(times); i++ {
+			if times[i-1] != nil && times[i] != nil {
+				durs[i-1] = append(durs[i-1], times[i].Sub(*times[i-1]))
+			}
+		}
+	}
+
+	for i, d := range durs {
+		from, to := "added", stages[len(stages)-1]
+		if i < len(stages)-1 {
+			from, to = stages[i], stages[i+1]
+		}
+
+		lat := &onboardingLatency{
+			From:    from,
+			To:      to,
+			Samples: len(d),
+		}
+
+		if len(d) > 0 {
+			sort.Slice(d, func(i, j int) bool {
+				return d[i] < d[j]
+			})
+
+			lat.Low = durationPercentile(d, 10)
+			lat.Median = durationPercentile(d, 50)
+			lat.High = durationPercentile(d, 90)
+			lat.P99 = durationPercentile(d, 99)
+			lat.Max = d[len(d)-1]
+		}
+
+		rep.Steps = append(rep.Steps, lat)
+	}
+
+	return rep, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnboardingStats(t *testing.T) {
+	db := newTestDB(t, &Content{})
+
+	cm := &ContentManager{DB: db}
+
+	objs := makeTestObjects(t, 4)
+	conts := []*Content{
+		{Cid: objs[0].Cid, Active: true},
+		{Cid: objs[1].Cid, Active: true, Aggregate: true},
+		{Cid: objs[2].Cid, Active: true},
+		{Cid: objs[3].Cid, Active: true},
+	}
+	for _, c := range conts {
+		require.NoError(t, db.Create(c).Error)
+	}
+
+	// the third content is aggregated in the second, the fourth never gets
+	// a deal
+	require.NoError(t, db.Model(Content{}).Where("id = ?", 3).UpdateColumn("aggregated_in", 2).Error)
+
+	added := conts[0].CreatedAt
+	stage := func(id uint, stage string, after time.Duration) {
+		require.NoError(t, cm.markOnboardingStage(id, stage, added.Add(after)))
+	}
+
+	stage(1, onboardingProposed, time.Hour)
+	stage(2, onboardingProposed, 2*time.Hour)
+	stage(1, onboardingTransferred, 3*time.Hour)
+	stage(2, onboardingTransferred, 4*time.Hour)
+
+	// only the first time counts
+	stage(1, onboardingTransferred, 10*time.Hour)
+
+	stage(1, onboardingSealed, 5*time.Hour)
+	stage(2, onboardingSealed, 6*time.Hour)
+	stage(1, onboardingReplicated, 7*time.Hour)
+
+	// a content with no proposal recorded doesn't get the later stages
+	stage(4, onboardingSealed, 8*time.Hour)
+
+	var aggregated Content
+	require.NoError(t, db.First(&aggregated, "id = ?", 3).Error)
+	require.NotNil(t, aggregated.FirstSealedAt)
+	require.Nil(t, aggregated.ReplicatedAt)
+
+	var none Content
+	require.NoError(t, db.First(&none, "id = ?", 4).Error)
+	require.Nil(t, none.FirstSealedAt)
+
+	rep, err := onboardingStats(db, added.Add(-time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 3, rep.Contents)
+	require.Equal(t, 2, rep.Pending)
+	require.Len(t, rep.Steps, 5)
+
+	// content 3 was added about when content 1 was, give or take the inserts
+	near := func(want, got time.Duration) {
+		require.InDelta(t, float64(want), float64(got), float64(time.Second))
+	}
+
+	proposed := rep.Steps[0]
+	require.Equal(t, "added", proposed.From)
+	require.Equal(t, "proposed", proposed.To)
+	require.Equal(t, 2, proposed.Samples)
+	near(time.Hour, proposed.Low)
+	near(2*time.Hour, proposed.Max)
+
+	for _, st := range rep.Steps[1:3] {
+		require.Equal(t, 2, st.Samples)
+		near(2*time.Hour, st.Median)
+	}
+
+	replicated := rep.Steps[3]
+	require.Equal(t, "sealed", replicated.From)
+	require.Equal(t, 1, replicated.Samples)
+	near(2*time.Hour, replicated.Median)
+
+	endToEnd := rep.Steps[4]
+	require.Equal(t, "added", endToEnd.From)
+	require.Equal(t, "replicated", endToEnd.To)
+	require.Equal(t, 1, endToEnd.Samples)
+	near(7*time.Hour, endToEnd.Median)
+}
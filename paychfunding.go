@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/application-research/estuary/config"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/paychmgr"
+)
+
+const (
+	paychFundExact      = "exact"
+	paychFundWithBuffer = "with-buffer"
+	paychFundFixed      = "fixed-amount"
+)
+
+// filclient adds funds to a channel itself when less than this was ever put
+// in it, so we never leave a channel below it
+var filclientMinPaychFunds = abi.TokenAmount(types.MustParseFIL("0.01"))
+
+type paychFundingStrategy struct {
+	mode      string
+	bufferPct int64
+	amount    abi.TokenAmount
+	fundEvery bool
+}
+
+// newPaychFundingStrategy returns nil when funding is left to filclient
+func newPaychFundingStrategy(cfg config.PaychFunding) (*paychFundingStrategy, error) {
+	s := &paychFundingStrategy{
+		mode:      cfg.Strategy,
+		fundEvery: cfg.FundEveryRetrieval,
+	}
+
+	switch cfg.Strategy {
+	case "":
+		return nil, nil
+	case paychFundExact:
+	case paychFundWithBuffer:
+		if cfg.BufferPercent < 0 {
+			return nil, fmt.Errorf("invalid payment channel buffer percent %d", cfg.BufferPercent)
+		}
+		s.bufferPct = int64(cfg.BufferPercent)
+	case paychFundFixed:
+		amt, err := types.ParseFIL(cfg.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payment channel funding amount %q: %w", cfg.Amount, err)
+		}
+		if !abi.TokenAmount(amt).GreaterThan(big.Zero()) {
+			return nil, fmt.Errorf("payment channel funding amount must be more than zero")
+		}
+		s.amount = abi.TokenAmount(amt)
+	default:
+		return nil, fmt.Errorf("unknown payment channel funding strategy %q, must be %s, %s or %s", cfg.Strategy, paychFundExact, paychFundWithBuffer, paychFundFixed)
+	}
+	return s, nil
+}
+
+// target is how much a channel is funded with for a retrieval costing cost
+func (s *paychFundingStrategy) target(cost abi.TokenAmount) abi.TokenAmount {
+	switch s.mode {
+	case paychFundWithBuffer:
+		buf := big.Div(big.Mul(cost, big.NewInt(s.bufferPct)), big.NewInt(100))
+		return big.Add(cost, buf)
+	case paychFundFixed:
+		// a retrieval that costs more than the amount still has to be paid for
+		return big.Max(s.amount, cost)
+	default:
+		return cost
+	}
+}
+
+// fundingFor is how much to add to a channel with available unspent funds,
+// and confirmed funds in total, before a retrieval costing cost
+func (s *paychFundingStrategy) fundingFor(cost, available, confirmed abi.TokenAmount) abi.TokenAmount {
+	target := s.target(cost)
+
+	var add abi.TokenAmount
+	switch {
+	case s.fundEvery:
+		add = target
+	case !available.LessThan(cost):
+		add = big.Zero()
+	default:
+		add = big.Sub(target, available)
+	}
+
+	if after := big.Add(confirmed, add); after.LessThan(filclientMinPaychFunds) {
+		add = big.Sub(filclientMinPaychFunds, confirmed)
+	}
+	return add
+}
+
+// paychFunding is how a retrieval's payment channel was funded
+type paychFunding struct {
+	Strategy string
+	// who the channel pays, the miner's owner
+	To      address.Address
+	Channel address.Address
+	Added   abi.TokenAmount
+}
+
+func (cm *ContentManager) paychLock(to address.Address) *sync.Mutex {
+	cm.paychLk.Lock()
+	defer cm.paychLk.Unlock()
+
+	lk, ok := cm.paychLocks[to]
+	if !ok {
+		lk = new(sync.Mutex)
+		cm.paychLocks[to] = lk
+	}
+	return lk
+}
+
+// minerPaychTo is who filclient pays for retrievals from the miner
+func (cm *ContentManager) minerPaychTo(ctx context.Context, maddr address.Address) (address.Address, error) {
+	minfo, err := cm.Api.StateMinerInfo(ctx, maddr, types.EmptyTSK)
+	if err != nil {
+		return address.Undef, err
+	}
+	return minfo.Owner, nil
+}
+
+// paychBalance is what is left to spend in the channel, counting funds that
+// are on their way
+func (cm *ContentManager) paychBalance(ctx context.Context, to address.Address) (abi.TokenAmount, abi.TokenAmount, *address.Address, error) {
+	avail, err := cm.paychMgr.AvailableFundsByFromTo(ctx, cm.FilClient.ClientAddr, to)
+	if err != nil {
+		return abi.TokenAmount{}, abi.TokenAmount{}, nil, err
+	}
+
+	total := big.Add(avail.ConfirmedAmt, avail.PendingAmt)
+	left := big.Sub(total, avail.VoucherReedeemedAmt)
+	if left.LessThan(big.Zero()) {
+		left = big.Zero()
+	}
+	return left, avail.ConfirmedAmt, avail.Channel, nil
+}
+
+// fundRetrievalPaych funds the channel to the miner ahead of a retrieval
+// costing cost, per the funding strategy. It returns nil when funding is
+// left to filclient or the retrieval is free.
+//
+// filclient pays out of the channel with a paych manager of its own, see
+// node.NewClientPaychManager, and the two must never work on a channel at
+// the same time. The channel stays locked, for this retrieval only, until the
+// returned func is called once the retrieval is done and recorded.
+func (cm *ContentManager) fundRetrievalPaych(ctx context.Context, maddr address.Address, cost retrievalCost) (*paychFunding, func(), error) {
+	total := big.Add(cost.Unseal, cost.Transfer)
+	if cm.paychFunding == nil || !total.GreaterThan(big.Zero()) {
+		return nil, func() {}, nil
+	}
+
+	to, err := cm.minerPaychTo(ctx, maddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("looking up who to pay miner %s: %w", maddr, err)
+	}
+
+	lk := cm.paychLock(to)
+	lk.Lock()
+
+	out, err := cm.fundPaychLocked(ctx, maddr, to, total)
+	if err != nil {
+		lk.Unlock()
+		return nil, nil, err
+	}
+	return out, lk.Unlock, nil
+}
+
+func (cm *ContentManager) fundPaychLocked(ctx context.Context, maddr, to address.Address, total abi.TokenAmount) (*paychFunding, error) {
+	available, confirmed, ch, err := cm.paychBalance(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &paychFunding{
+		Strategy: cm.paychFunding.mode,
+		To:       to,
+		Added:    cm.paychFunding.fundingFor(total, available, confirmed),
+	}
+	if ch != nil {
+		out.Channel = *ch
+	}
+
+	if !out.Added.GreaterThan(big.Zero()) {
+		log.Infow("reusing payment channel funds", "miner", maddr, "channel", out.Channel, "available", types.FIL(available), "cost", types.FIL(total))
+		return out, nil
+	}
+
+	log.Infow("funding payment channel", "miner", maddr, "strategy", out.Strategy, "available", types.FIL(available), "cost", types.FIL(total), "adding", types.FIL(out.Added))
+	pch, mcid, err := cm.paychMgr.GetPaych(ctx, cm.FilClient.ClientAddr, to, out.Added, paychmgr.GetOpts{})
+	if err != nil {
+		return nil, fmt.Errorf("funding payment channel to %s: %w", maddr, err)
+	}
+
+	// filclient only goes by confirmed funds, wait for ours to land
+	if mcid.Defined() {
+		pch, err = cm.paychMgr.GetPaychWaitReady(ctx, mcid)
+		if err != nil {
+			return nil, fmt.Errorf("waiting for payment channel to %s to be funded: %w", maddr, err)
+		}
+	}
+	out.Channel = pch
+	return out, nil
+}
+
+// finishPaychFunding notes how much was left in the channel once the
+// retrieval was paid for, the channel must still be locked
+func (cm *ContentManager) finishPaychFunding(ctx context.Context, maddr address.Address, f *paychFunding, rec *retrievalSuccessRecord) {
+	if f == nil {
+		return
+	}
+
+	rec.PaychFunding = f.Strategy
+	rec.PaychFunded = f.Added.String()
+	if f.Channel != address.Undef {
+		rec.Paych = f.Channel.String()
+	}
+
+	left, _, _, err := cm.paychBalance(ctx, f.To)
+	if err != nil {
+		log.Warnw("failed to look up payment channel balance", "miner", maddr, "err", err)
+		return
+	}
+	rec.PaychBalance = left.String()
+}
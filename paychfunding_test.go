@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/stretchr/testify/require"
+)
+
+func fil(s string) abi.TokenAmount {
+	return abi.TokenAmount(types.MustParseFIL(s))
+}
+
+func TestPaychFundingStrategy(t *testing.T) {
+	s, err := newPaychFundingStrategy(config.PaychFunding{})
+	require.NoError(t, err)
+	require.Nil(t, s)
+
+	_, err = newPaychFundingStrategy(config.PaychFunding{Strategy: "lots"})
+	require.Error(t, err)
+	_, err = newPaychFundingStrategy(config.PaychFunding{Strategy: paychFundFixed, Amount: "0"})
+	require.Error(t, err)
+
+	// a channel that has seen plenty of funds before, so filclient's minimum
+	// doesn't come into it
+	confirmed := fil("1")
+
+	exact, err := newPaychFundingStrategy(config.PaychFunding{Strategy: paychFundExact})
+	require.NoError(t, err)
+	require.Equal(t, fil("0.5"), exact.fundingFor(fil("0.5"), big.Zero(), confirmed))
+	// tops up only the shortfall
+	require.Equal(t, fil("0.2"), exact.fundingFor(fil("0.5"), fil("0.3"), confirmed))
+	// enough left over from earlier retrievals
+	require.Equal(t, big.Zero(), exact.fundingFor(fil("0.5"), fil("0.6"), confirmed))
+
+	buffered, err := newPaychFundingStrategy(config.PaychFunding{Strategy: paychFundWithBuffer, BufferPercent: 20})
+	require.NoError(t, err)
+	require.Equal(t, fil("0.6"), buffered.fundingFor(fil("0.5"), big.Zero(), confirmed))
+	require.Equal(t, fil("0.4"), buffered.fundingFor(fil("0.5"), fil("0.2"), confirmed))
+	require.Equal(t, big.Zero(), buffered.fundingFor(fil("0.5"), fil("0.5"), confirmed))
+
+	fixed, err := newPaychFundingStrategy(config.PaychFunding{Strategy: paychFundFixed, Amount: "2"})
+	require.NoError(t, err)
+	require.Equal(t, fil("2"), fixed.fundingFor(fil("0.1"), big.Zero(), confirmed))
+	require.Equal(t, fil("1.95"), fixed.fundingFor(fil("0.1"), fil("0.05"), confirmed))
+	require.Equal(t, big.Zero(), fixed.fundingFor(fil("0.1"), fil("0.5"), confirmed))
+	// a retrieval costing more than the amount still gets funded for
+	require.Equal(t, fil("3"), fixed.fundingFor(fil("3"), big.Zero(), confirmed))
+
+	every, err := newPaychFundingStrategy(config.PaychFunding{Strategy: paychFundExact, FundEveryRetrieval: true})
+	require.NoError(t, err)
+	require.Equal(t, fil("0.5"), every.fundingFor(fil("0.5"), fil("5"), confirmed))
+}
+
+func TestPaychFundingFilclientMinimum(t *testing.T) {
+	exact, err := newPaychFundingStrategy(config.PaychFunding{Strategy: paychFundExact})
+	require.NoError(t, err)
+
+	// a new channel is funded up to the point filclient leaves it alone
+	require.Equal(t, filclientMinPaychFunds, exact.fundingFor(fil("0.0001"), big.Zero(), big.Zero()))
+	require.Equal(t, fil("0.004"), exact.fundingFor(fil("0.0001"), big.Zero(), fil("0.006")))
+
+	// and once it has had that much, only what is needed
+	require.Equal(t, fil("0.0001"), exact.fundingFor(fil("0.0001"), big.Zero(), fil("0.01")))
+}
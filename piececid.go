@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+// pieceMismatchError is returned when a piece commitment computed elsewhere
+// turns out not to be the content's
+type pieceMismatchError struct {
+	Piece   cid.Cid
+	Content uint
+	Reason  string
+}
+
+func (e *pieceMismatchError) Error() string {
+	return fmt.Sprintf("piece %s doesn't match content %d: %s", e.Piece, e.Content, e.Reason)
+}
+
+// checkPieceCommitment checks a piece commitment computed elsewhere against
+// the one we computed for the content, which the piece has to be, zero padded
+// up to size if size is larger.
+func checkPieceCommitment(content uint, piece cid.Cid, size abi.PaddedPieceSize, pcr *PieceCommRecord) error {
+	mismatch := func(format string, args ...interface{}) error {
+		return &pieceMismatchError{
+			Piece:   piece,
+			Content: content,
+			Reason:  fmt.Sprintf(format, args...),
+		}
+	}
+
+	if size.Unpadded() < pcr.Size {
+		return mismatch("piece size %d is smaller than the content's piece of %d", size, pcr.Size.Padded())
+	}
+
+	expected := pcr.Piece.CID
+	if size.Unpadded() > pcr.Size {
+		padded, err := filclient.ZeroPadPieceCommitment(pcr.Piece.CID, pcr.Size, size.Unpadded())
+		if err != nil {
+			return err
+		}
+		expected = padded
+	}
+
+	if !expected.Equals(piece) {
+		return mismatch("the content's piece of size %d is %s", size, expected)
+	}
+	return nil
+}
+
+// suppliedPiece is a piece commitment computed elsewhere, e.g. by a dedicated
+// commp service, that a deal is made with instead of computing our own
+type suppliedPiece struct {
+	Data    cid.Cid
+	Piece   cid.Cid
+	Size    abi.PaddedPieceSize
+	CarSize uint64
+}
+
+type suppliedPieceKey struct{}
+
+// suppliedPieceFor returns the piece supplied for data through the context,
+// if any, see withSuppliedPiece
+func suppliedPieceFor(ctx context.Context, data cid.Cid) *suppliedPiece {
+	sp, ok := ctx.Value(suppliedPieceKey{}).(*suppliedPiece)
+	if !ok || !sp.Data.Equals(data) {
+		return nil
+	}
+	return sp
+}
+
+// withSuppliedPiece returns a context that deals for a content are proposed
+// with to use a piece commitment computed elsewhere. When we have the
+// content's own piece on record the supplied one is checked against it.
+// Otherwise the supplied piece is used as is, as long as the content's car
+// fits in it, saving us from computing it. It is only used for the deals
+// proposed with the returned context and never recorded as the content's, so
+// a piece we were given never ends up in the deals of others.
+func (cm *ContentManager) withSuppliedPiece(ctx context.Context, content Content, piece cid.Cid, size abi.PaddedPieceSize) (context.Context, error) {
+	pcr, err := cm.lookupPieceCommRecord(content.Cid.CID)
+	if err != nil {
+		return nil, err
+	}
+
+	if pcr != nil {
+		if err := checkPieceCommitment(content.ID, piece, size, pcr); err != nil {
+			return nil, err
+		}
+		return ctx, nil
+	}
+
+	carSize, err := cm.calculateCarSize(ctx, content.Cid.CID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate car size: %w", err)
+	}
+
+	if carSize > uint64(size.Unpadded()) {
+		return nil, &pieceMismatchError{
+			Piece:   piece,
+			Content: content.ID,
+			Reason:  fmt.Sprintf("the content's car of %d bytes doesn't fit in a piece of size %d", carSize, size),
+		}
+	}
+
+	return context.WithValue(ctx, suppliedPieceKey{}, &suppliedPiece{
+		Data:    content.Cid.CID,
+		Piece:   piece,
+		Size:    size,
+		CarSize: carSize,
+	}), nil
+}
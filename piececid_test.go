@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestCheckPieceCommitment(t *testing.T) {
+	piece, err := commcid.DataCommitmentV1ToCID(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	other, err := commcid.DataCommitmentV1ToCID(bytes.Repeat([]byte{8}, 32))
+	require.NoError(t, err)
+
+	const size = abi.PaddedPieceSize(1 << 20)
+	pcr := &PieceCommRecord{Piece: util.DbCID{CID: piece}, Size: size.Unpadded()}
+
+	var pme *pieceMismatchError
+
+	// the piece on record
+	require.NoError(t, checkPieceCommitment(1, piece, size, pcr))
+	require.ErrorAs(t, checkPieceCommitment(1, other, size, pcr), &pme)
+	require.ErrorAs(t, checkPieceCommitment(1, piece, size/2, pcr), &pme)
+
+	// the piece on record padded up to a larger one
+	padded, err := filclient.ZeroPadPieceCommitment(piece, size.Unpadded(), (size * 4).Unpadded())
+	require.NoError(t, err)
+	require.NoError(t, checkPieceCommitment(1, padded, size*4, pcr))
+	require.ErrorAs(t, checkPieceCommitment(1, piece, size*4, pcr), &pme)
+
+	err = checkPieceCommitment(1, other, size, pcr)
+	require.ErrorAs(t, err, &pme)
+	require.Equal(t, other, pme.Piece)
+	require.Equal(t, uint(1), pme.Content)
+}
+
+func TestWithSuppliedPiece(t *testing.T) {
+	ctx := context.Background()
+
+	db := newTestDB(t, &Object{}, &ObjRef{}, &Content{}, &PieceCommRecord{})
+
+	cm := &ContentManager{DB: db, tracer: trace.NewNoopTracerProvider().Tracer("")}
+
+	objs := makeTestObjects(t, 4)
+	cont := Content{Cid: objs[0].Cid, Active: true}
+	require.NoError(t, db.Create(&cont).Error)
+	require.NoError(t, insertObjectsAndRefs(db, cont.ID, objs, 100))
+
+	piece, err := commcid.DataCommitmentV1ToCID(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	other, err := commcid.DataCommitmentV1ToCID(bytes.Repeat([]byte{8}, 32))
+	require.NoError(t, err)
+
+	const size = abi.PaddedPieceSize(1 << 20)
+	var pme *pieceMismatchError
+
+	// without a piece of our own the supplied one is used as is, for deals
+	// made with the context only
+	pctx, err := cm.withSuppliedPiece(ctx, cont, piece, size)
+	require.NoError(t, err)
+
+	pc, carSize, pieceSize, err := cm.getPieceCommitment(pctx, cont.Cid.CID, nil)
+	require.NoError(t, err)
+	require.Equal(t, piece, pc)
+	require.NotZero(t, carSize)
+	require.Equal(t, size.Unpadded(), pieceSize)
+	require.Nil(t, suppliedPieceFor(ctx, cont.Cid.CID))
+
+	pcr, err := cm.lookupPieceCommRecord(cont.Cid.CID)
+	require.NoError(t, err)
+	require.Nil(t, pcr, "a supplied piece isn't recorded as the content's")
+
+	// the car has to fit in the piece
+	_, err = cm.withSuppliedPiece(ctx, cont, piece, 128)
+	require.ErrorAs(t, err, &pme)
+
+	// with a piece of our own, the supplied one has to match it
+	require.NoError(t, db.Create(&PieceCommRecord{Data: cont.Cid, Piece: util.DbCID{CID: piece}, Size: size.Unpadded()}).Error)
+
+	_, err = cm.withSuppliedPiece(ctx, cont, other, size)
+	require.ErrorAs(t, err, &pme)
+
+	pctx, err = cm.withSuppliedPiece(ctx, cont, piece, size)
+	require.NoError(t, err)
+	require.Nil(t, suppliedPieceFor(pctx, cont.Cid.CID))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+// dealPieceSize picks the padded size of the piece to propose for content
+// whose piece is contentPiece. It's padded up to the miner's minimum, and
+// with a target set further up to exactly that size, e.g. to fill a whole
+// sector. A zero target or miner limit means there is none.
+func dealPieceSize(contentPiece abi.UnpaddedPieceSize, target, minerMin, minerMax abi.PaddedPieceSize) (abi.PaddedPieceSize, error) {
+	size := contentPiece.Padded()
+
+	if target != 0 {
+		if err := target.Validate(); err != nil {
+			return 0, fmt.Errorf("invalid target piece size %d: %w", target, err)
+		}
+
+		if target < size {
+			return 0, fmt.Errorf("target piece size %d is smaller than the content's piece of %d", target, size)
+		}
+
+		if target < minerMin {
+			return 0, fmt.Errorf("target piece size %d is below the miner's minimum of %d", target, minerMin)
+		}
+
+		size = target
+	}
+
+	if size < minerMin {
+		size = minerMin
+	}
+
+	if minerMax != 0 && size > minerMax {
+		return 0, fmt.Errorf("piece size %d is above the miner's maximum of %d", size, minerMax)
+	}
+
+	return size, nil
+}
+
+// paddingOverhead is the fraction of a piece of the given size that is
+// padding rather than data
+func paddingOverhead(dataSize uint64, pieceSize abi.PaddedPieceSize) float64 {
+	if pieceSize == 0 || dataSize >= uint64(pieceSize) {
+		return 0
+	}
+	return float64(uint64(pieceSize)-dataSize) / float64(pieceSize)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDealPieceSize(t *testing.T) {
+	assert := assert.New(t)
+
+	// 1000 bytes of content fits in a 1KiB piece
+	content := abi.PaddedPieceSize(1024).Unpadded()
+
+	size, err := dealPieceSize(content, 0, 0, 0)
+	assert.NoError(err)
+	assert.Equal(abi.PaddedPieceSize(1024), size)
+
+	size, err = dealPieceSize(content, 0, 256<<10, 32<<30)
+	assert.NoError(err)
+	assert.Equal(abi.PaddedPieceSize(256<<10), size)
+
+	size, err = dealPieceSize(content, 32<<30, 256<<10, 32<<30)
+	assert.NoError(err)
+	assert.Equal(abi.PaddedPieceSize(32<<30), size)
+
+	// not a power of two
+	_, err = dealPieceSize(content, 3000, 0, 0)
+	assert.Error(err)
+
+	// smaller than the content
+	_, err = dealPieceSize(content, 512, 0, 0)
+	assert.Error(err)
+
+	// below the miner's minimum
+	_, err = dealPieceSize(content, 2048, 256<<10, 0)
+	assert.Error(err)
+
+	// above the miner's maximum
+	_, err = dealPieceSize(content, 64<<30, 0, 32<<30)
+	assert.Error(err)
+}
+
+func TestPaddingOverhead(t *testing.T) {
+	assert.Equal(t, 0.75, paddingOverhead(256, 1024))
+	assert.Equal(t, 0.0, paddingOverhead(1024, 1024))
+	assert.Equal(t, 0.0, paddingOverhead(10, 0))
+}
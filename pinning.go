@@ -135,10 +135,8 @@ func (s *Server) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 		}
 	}
 
-	// this provide call goes out immediately
-	if err := s.Node.FullRT.Provide(ctx, op.Obj, true); err != nil {
-		log.Warnf("provider broadcast failed: %s", err)
-	}
+	// this provide goes out as soon as the provide rate allows
+	s.Node.ProvideQueue.Add(op.Obj)
 
 	// this one adds to a queue
 	if err := s.Node.Provider.Provide(op.Obj); err != nil {
@@ -182,6 +180,13 @@ func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid
 		return nil, xerrors.Errorf("selecting location for content failed: %w", err)
 	}
 
+	// the size of what we're pinning isn't known until it's fetched
+	if loc == "local" {
+		if err := cm.freeSpace.CheckImport(0); err != nil {
+			return nil, err
+		}
+	}
+
 	var metab string
 	if meta != nil {
 		b, err := json.Marshal(meta)
@@ -203,6 +208,7 @@ func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid
 		PinMeta: metab,
 
 		Location: loc,
+		Access:   util.ContentAccessOwner,
 
 		/*
 			Size        int64  `json:"size"`
@@ -672,6 +678,10 @@ func (s *Server) handleAddPin(e echo.Context, u *User) error {
 		}
 	}
 
+	if err := checkUserQuota(s.DB, u.ID, 0); err != nil {
+		return err
+	}
+
 	var pin types.IpfsPin
 	if err := e.Bind(&pin); err != nil {
 		return err
@@ -923,6 +933,12 @@ func (cm *ContentManager) handlePinningComplete(ctx context.Context, handle stri
 		return xerrors.Errorf("failed to add objects to database: %w", err)
 	}
 
+	if pincomp.MimeType != "" {
+		if err := cm.DB.Model(Content{}).Where("id = ?", cont.ID).UpdateColumn("mime_type", pincomp.MimeType).Error; err != nil {
+			return err
+		}
+	}
+
 	cm.ToCheck <- cont.ID
 
 	return nil
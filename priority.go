@@ -0,0 +1,248 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-metrics-interface"
+)
+
+// Content priority tiers. Contents with a higher priority are checked for
+// deals first, so they get miners and transfer slots before the ones that
+// can wait.
+const (
+	priorityLow    = -1
+	priorityNormal = 0
+	priorityHigh   = 1
+	priorityUrgent = 2
+)
+
+var priorityTiers = map[string]int{
+	"low":    priorityLow,
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+	"urgent": priorityUrgent,
+}
+
+// parsePriority takes the name of a priority tier, empty is normal
+func parsePriority(s string) (int, error) {
+	if s == "" {
+		return priorityNormal, nil
+	}
+
+	p, ok := priorityTiers[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid priority %q, must be one of low, normal, high or urgent", s)
+	}
+	return p, nil
+}
+
+// priorityParam parses a priority given in a request by u. Urgent contents
+// jump ahead of everyone else's, so only admins may use it.
+func priorityParam(s string, u *User) (int, error) {
+	p, err := parsePriority(s)
+	if err != nil {
+		return 0, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Message: util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	if p == priorityUrgent && u.Perm < util.PermLevelAdmin {
+		return 0, &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_NOT_AUTHORIZED,
+			Details: "only admins may make contents urgent",
+		}
+	}
+	return p, nil
+}
+
+func priorityName(p int) string {
+	for name, tier := range priorityTiers {
+		if tier == p {
+			return name
+		}
+	}
+	return fmt.Sprint(p)
+}
+
+type dealQueueEntry struct {
+	Content  uint      `json:"content"`
+	Priority string    `json:"priority"`
+	Queued   time.Time `json:"queued"`
+
+	priority int
+	seq      uint64
+	index    int
+}
+
+// checkedBefore puts higher priorities first, and contents of the same
+// priority in the order they were queued
+func checkedBefore(a, b *dealQueueEntry) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.seq < b.seq
+}
+
+type dealQueueHeap []*dealQueueEntry
+
+func (h dealQueueHeap) Len() int {
+	return len(h)
+}
+
+func (h dealQueueHeap) Less(i, j int) bool {
+	return checkedBefore(h[i], h[j])
+}
+
+func (h dealQueueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *dealQueueHeap) Push(e interface{}) {
+	qe := e.(*dealQueueEntry)
+	qe.index = len(*h)
+	*h = append(*h, qe)
+}
+
+func (h *dealQueueHeap) Pop() interface{} {
+	old := *h
+	out := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return out
+}
+
+// dealQueue holds the contents waiting to be checked by the content watcher,
+// highest priority first. A content is only queued once, queueing it again
+// while it waits keeps its place, or moves it up if its priority was raised.
+type dealQueue struct {
+	lk        sync.Mutex
+	entries   dealQueueHeap
+	byContent map[uint]*dealQueueEntry
+	seq       uint64
+
+	// signalled when the queue has entries
+	ready chan struct{}
+
+	sizeMetr metrics.Gauge
+}
+
+func newDealQueue() *dealQueue {
+	metCtx := metrics.CtxScope(context.Background(), "content_manager")
+	return &dealQueue{
+		byContent: make(map[uint]*dealQueueEntry),
+		ready:     make(chan struct{}, 1),
+		sizeMetr:  metrics.NewCtx(metCtx, "deal_queue_size", "number of contents waiting to be checked for deals").Gauge(),
+	}
+}
+
+func (dq *dealQueue) push(content uint, priority int) {
+	dq.lk.Lock()
+	defer dq.lk.Unlock()
+
+	if qe, ok := dq.byContent[content]; ok {
+		if priority > qe.priority {
+			qe.priority = priority
+			heap.Fix(&dq.entries, qe.index)
+		}
+		return
+	}
+
+	dq.seq++
+	qe := &dealQueueEntry{
+		Content:  content,
+		Queued:   time.Now(),
+		priority: priority,
+		seq:      dq.seq,
+	}
+	heap.Push(&dq.entries, qe)
+	dq.byContent[content] = qe
+	dq.sizeMetr.Set(float64(len(dq.entries)))
+
+	dq.signal()
+}
+
+// pop takes the content with the highest priority off the queue
+func (dq *dealQueue) pop() (uint, bool) {
+	dq.lk.Lock()
+	defer dq.lk.Unlock()
+
+	if len(dq.entries) == 0 {
+		return 0, false
+	}
+
+	qe := heap.Pop(&dq.entries).(*dealQueueEntry)
+	delete(dq.byContent, qe.Content)
+	dq.sizeMetr.Set(float64(len(dq.entries)))
+
+	if len(dq.entries) > 0 {
+		dq.signal()
+	}
+	return qe.Content, true
+}
+
+func (dq *dealQueue) signal() {
+	select {
+	case dq.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (dq *dealQueue) len() int {
+	dq.lk.Lock()
+	defer dq.lk.Unlock()
+	return len(dq.entries)
+}
+
+// list returns the queued contents in the order they will be checked
+func (dq *dealQueue) list() []dealQueueEntry {
+	dq.lk.Lock()
+	out := make([]dealQueueEntry, 0, len(dq.entries))
+	for _, qe := range dq.entries {
+		out = append(out, *qe)
+	}
+	dq.lk.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return checkedBefore(&out[i], &out[j])
+	})
+
+	for i := range out {
+		out[i].Priority = priorityName(out[i].priority)
+	}
+	return out
+}
+
+// feedDealQueue moves the contents sent to be checked into the deal queue
+// along with their priority
+func (cm *ContentManager) feedDealQueue() {
+	for c := range cm.ToCheck {
+		var content Content
+		if err := cm.DB.Select("priority").First(&content, "id = ?", c).Error; err != nil {
+			log.Errorf("looking up priority of content %d: %s", c, err)
+		}
+		cm.dealQueue.push(c, content.Priority)
+	}
+}
+
+// stagingZonePriority is the highest priority of the contents in the zone,
+// which the aggregate made from it gets
+func stagingZonePriority(b *contentStagingZone) int {
+	p := priorityLow
+	for _, c := range b.Contents {
+		if c.Priority > p {
+			p = c.Priority
+		}
+	}
+	return p
+}
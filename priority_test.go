@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestParsePriority(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := parsePriority("")
+	assert.NoError(err)
+	assert.Equal(priorityNormal, p)
+
+	p, err = parsePriority("urgent")
+	assert.NoError(err)
+	assert.Equal(priorityUrgent, p)
+	assert.Equal("urgent", priorityName(p))
+
+	_, err = parsePriority("asap")
+	assert.Error(err)
+}
+
+func TestPriorityParamUrgentAdminOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	user := &User{Perm: util.PermLevelUser}
+	p, err := priorityParam("high", user)
+	assert.NoError(err)
+	assert.Equal(priorityHigh, p)
+
+	_, err = priorityParam("urgent", user)
+	var herr *util.HttpError
+	if assert.True(xerrors.As(err, &herr)) {
+		assert.Equal(http.StatusForbidden, herr.Code)
+	}
+
+	p, err = priorityParam("urgent", &User{Perm: util.PermLevelAdmin})
+	assert.NoError(err)
+	assert.Equal(priorityUrgent, p)
+}
+
+func TestDealQueueOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	dq := newDealQueue()
+	dq.push(1, priorityNormal)
+	dq.push(2, priorityLow)
+	dq.push(3, priorityHigh)
+	dq.push(4, priorityNormal)
+	dq.push(5, priorityUrgent)
+
+	// already queued, only moves up
+	dq.push(4, priorityHigh)
+	dq.push(3, priorityLow)
+
+	var listed []uint
+	for _, e := range dq.list() {
+		listed = append(listed, e.Content)
+	}
+	assert.Equal([]uint{5, 3, 4, 1, 2}, listed)
+	assert.Equal("high", dq.list()[2].Priority)
+
+	var popped []uint
+	for {
+		c, ok := dq.pop()
+		if !ok {
+			break
+		}
+		popped = append(popped, c)
+	}
+	assert.Equal(listed, popped)
+	assert.Equal(0, dq.len())
+
+	// a content can be queued again once it has been checked
+	dq.push(1, priorityNormal)
+	assert.Equal(1, dq.len())
+}
+
+func TestStagingZonePriority(t *testing.T) {
+	b := &contentStagingZone{
+		Contents: []Content{{Priority: priorityLow}, {Priority: priorityHigh}, {}},
+	}
+	assert.Equal(t, priorityHigh, stagingZonePriority(b))
+}
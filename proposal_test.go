@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSigner struct{}
+
+func (testSigner) WalletSign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+	return &crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: msg[:8]}, nil
+}
+
+func setupProposalCM(t *testing.T, bump bool) *ContentManager {
+	db := newTestDB(t, &proposalRecord{})
+
+	return &ContentManager{
+		DB:                     db,
+		signer:                 testSigner{},
+		bumpDuplicateProposals: bump,
+	}
+}
+
+func makeTestProposal(t *testing.T) *market.ClientDealProposal {
+	h, err := multihash.Sum([]byte("piece"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := address.NewIDAddress(1000)
+	provider, _ := address.NewIDAddress(1001)
+	return &market.ClientDealProposal{
+		Proposal: market.DealProposal{
+			PieceCID:             cid.NewCidV1(cid.FilCommitmentUnsealed, h),
+			PieceSize:            1 << 20,
+			Client:               client,
+			Provider:             provider,
+			StartEpoch:           100,
+			EndEpoch:             1100,
+			StoragePricePerEpoch: big.Zero(),
+			ProviderCollateral:   big.Zero(),
+			ClientCollateral:     big.Zero(),
+		},
+	}
+}
+
+func proposalCid(t *testing.T, prop *market.ClientDealProposal) cid.Cid {
+	pc, err := util.ProposalCid(prop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func TestPutProposalRecordDuplicate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("reuse", func(t *testing.T) {
+		assert := assert.New(t)
+		cm := setupProposalCM(t, false)
+
+		first := makeTestProposal(t)
+		assert.NoError(cm.putProposalRecord(ctx, first))
+
+		second := makeTestProposal(t)
+		assert.NoError(cm.putProposalRecord(ctx, second))
+		assert.Equal(proposalCid(t, first), proposalCid(t, second))
+
+		var count int64
+		assert.NoError(cm.DB.Model(&proposalRecord{}).Count(&count).Error)
+		assert.Equal(int64(1), count)
+	})
+
+	t.Run("bump", func(t *testing.T) {
+		assert := assert.New(t)
+		cm := setupProposalCM(t, true)
+
+		first := makeTestProposal(t)
+		assert.NoError(cm.putProposalRecord(ctx, first))
+
+		second := makeTestProposal(t)
+		assert.NoError(cm.putProposalRecord(ctx, second))
+		assert.NotEqual(proposalCid(t, first), proposalCid(t, second))
+		assert.Equal(first.Proposal.StartEpoch+1, second.Proposal.StartEpoch)
+		assert.Equal(first.Proposal.EndEpoch+1, second.Proposal.EndEpoch)
+
+		// a third identical proposal has to skip past both saved ones
+		third := makeTestProposal(t)
+		assert.NoError(cm.putProposalRecord(ctx, third))
+		assert.Equal(first.Proposal.StartEpoch+2, third.Proposal.StartEpoch)
+
+		for _, p := range []*market.ClientDealProposal{first, second, third} {
+			saved, err := cm.getProposalRecord(proposalCid(t, p))
+			assert.NoError(err)
+			assert.Equal(p.Proposal.StartEpoch, saved.Proposal.StartEpoch)
+		}
+	})
+}
+
+func TestProposalsForDeals(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	cm := setupProposalCM(t, true)
+
+	var deals []contentDeal
+	for i := 0; i < 3; i++ {
+		prop := makeTestProposal(t)
+		assert.NoError(cm.putProposalRecord(ctx, prop))
+		deals = append(deals, contentDeal{PropCid: util.DbCID{proposalCid(t, prop)}})
+	}
+
+	// a deal whose proposal wasn't recorded is left out
+	missing := makeTestProposal(t)
+	missing.Proposal.StartEpoch = 5000
+	deals = append(deals, contentDeal{PropCid: util.DbCID{proposalCid(t, missing)}})
+
+	props, err := cm.proposalsForDeals(deals)
+	assert.NoError(err)
+	assert.Len(props, 3)
+	for i, d := range deals[:3] {
+		assert.Equal(abi.ChainEpoch(100+i), props[d.PropCid.CID].Proposal.StartEpoch)
+	}
+}
+
+type chainGateway struct {
+	api.Gateway
+
+	height abi.ChainEpoch
+	bounds api.DealCollateralBounds
+}
+
+func (g *chainGateway) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	b := mock.MkBlock(nil, 1, 1)
+	b.Height = g.height
+	return types.NewTipSet([]*types.BlockHeader{b})
+}
+
+func (g *chainGateway) StateDealProviderCollateralBounds(ctx context.Context, size abi.PaddedPieceSize, verified bool, tsk types.TipSetKey) (api.DealCollateralBounds, error) {
+	return g.bounds, nil
+}
+
+func TestRefreshStaleProposal(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	g := &chainGateway{
+		height: 50,
+		bounds: api.DealCollateralBounds{Min: big.NewInt(100), Max: big.NewInt(1000)},
+	}
+	cm := &ContentManager{
+		Api:                 g,
+		signer:              testSigner{},
+		proposalStaleEpochs: 60,
+	}
+
+	prop := makeTestProposal(t)
+	before := proposalCid(t, prop)
+
+	// not stale yet
+	refreshed, err := cm.refreshStaleProposal(ctx, prop, 0)
+	assert.NoError(err)
+	assert.False(refreshed)
+	assert.Equal(before, proposalCid(t, prop))
+
+	g.height = 80
+	refreshed, err = cm.refreshStaleProposal(ctx, prop, 0)
+	assert.NoError(err)
+	assert.True(refreshed)
+	assert.NotEqual(before, proposalCid(t, prop))
+	assert.Equal(abi.ChainEpoch(180), prop.Proposal.StartEpoch)
+	assert.Equal(abi.ChainEpoch(1180), prop.Proposal.EndEpoch)
+	assert.Equal(big.NewInt(110), prop.Proposal.ProviderCollateral)
+
+	// disabled
+	cm.proposalStaleEpochs = 0
+	refreshed, err = cm.refreshStaleProposal(ctx, prop, 0)
+	assert.NoError(err)
+	assert.False(refreshed)
+}
+
+func TestClampProviderCollateral(t *testing.T) {
+	assert := assert.New(t)
+
+	minColl, maxColl := big.NewInt(100), big.NewInt(1000)
+	assert.Equal(big.NewInt(110), clampProviderCollateral(big.NewInt(10), minColl, maxColl))
+	assert.Equal(big.NewInt(500), clampProviderCollateral(big.NewInt(500), minColl, maxColl))
+	assert.Equal(maxColl, clampProviderCollateral(big.NewInt(5000), minColl, maxColl))
+}
+
+func TestDealProposalExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	prop := &market.DealProposal{StartEpoch: 100, EndEpoch: 1000}
+	sealed := contentDeal{SealedAt: time.Now()}
+
+	assert.False(dealProposalExpired(contentDeal{}, prop, 50, false))
+	assert.True(dealProposalExpired(contentDeal{}, prop, 100, false))
+	assert.False(dealProposalExpired(sealed, prop, 500, false))
+	assert.False(dealProposalExpired(contentDeal{Failed: true}, prop, 500, false))
+	assert.True(dealProposalExpired(sealed, prop, 1000, false))
+
+	// sealed on chain before we noticed
+	assert.False(dealProposalExpired(contentDeal{DealID: 7}, prop, 500, true))
+	assert.True(dealProposalExpired(contentDeal{DealID: 7}, prop, 1000, true))
+}
+
+func TestSendProposalWithRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	old := proposalResendBackoff
+	proposalResendBackoff = time.Millisecond
+	defer func() { proposalResendBackoff = old }()
+
+	cm := &ContentManager{proposalSendAttempts: 3}
+	ctx := context.Background()
+
+	// a dropped stream is retried
+	var calls int
+	propPhase, attempts, err := cm.sendProposalWithRetries(ctx, address.Undef, func() (bool, error) {
+		calls++
+		if calls < 2 {
+			return false, fmt.Errorf("stream reset")
+		}
+		return false, nil
+	})
+	assert.NoError(err)
+	assert.False(propPhase)
+	assert.Equal(2, attempts)
+
+	// a rejection is not
+	calls = 0
+	propPhase, attempts, err = cm.sendProposalWithRetries(ctx, address.Undef, func() (bool, error) {
+		calls++
+		return true, fmt.Errorf("deal rejected")
+	})
+	assert.Error(err)
+	assert.True(propPhase)
+	assert.Equal(1, attempts)
+	assert.Equal(1, calls)
+
+	// and it gives up eventually
+	calls = 0
+	_, attempts, err = cm.sendProposalWithRetries(ctx, address.Undef, func() (bool, error) {
+		calls++
+		return false, fmt.Errorf("stream reset")
+	})
+	assert.Error(err)
+	assert.Equal(3, attempts)
+	assert.Equal(3, calls)
+}
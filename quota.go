@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// userQuota limits how much of a shared node one user can take up. Users
+// without a quota, and limits left at zero, are unlimited.
+type userQuota struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	UserID    uint      `gorm:"unique" json:"userId"`
+
+	MaxBytes    int64 `json:"maxBytes"`
+	MaxContents int64 `json:"maxContents"`
+	// deals for the user's content that haven't been published yet
+	MaxConcurrentDeals int64 `json:"maxConcurrentDeals"`
+}
+
+type userUsage struct {
+	Bytes        int64 `json:"bytes"`
+	Contents     int64 `json:"contents"`
+	PendingDeals int64 `json:"pendingDeals"`
+}
+
+func getUserQuota(db *gorm.DB, userID uint) (*userQuota, error) {
+	var quotas []userQuota
+	if err := db.Find(&quotas, "user_id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+
+	if len(quotas) == 0 {
+		return &userQuota{UserID: userID}, nil
+	}
+	return &quotas[0], nil
+}
+
+func setUserQuota(db *gorm.DB, q *userQuota) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "max_bytes", "max_contents", "max_concurrent_deals"}),
+	}).Create(q).Error
+}
+
+func getUserUsage(db *gorm.DB, userID uint) (*userUsage, error) {
+	var u userUsage
+	if err := db.Model(Content{}).
+		Select("coalesce(sum(size), 0) as bytes, count(*) as contents").
+		Where("user_id = ? and not aggregate and (active or pinning) and not failed", userID).
+		Scan(&u).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(contentDeal{}).
+		Joins("join contents on contents.id = content_deals.content").
+		Where("contents.user_id = ? and contents.deleted_at is null and not content_deals.failed and content_deals.deal_id = 0", userID).
+		Count(&u.PendingDeals).Error; err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// checkUserQuota errors if adding size more bytes of content for the user
+// would take them over their quota. Pass zero when the size isn't known up
+// front, users that are already at a limit are still turned away.
+func checkUserQuota(db *gorm.DB, userID uint, size int64) error {
+	q, err := getUserQuota(db, userID)
+	if err != nil {
+		return err
+	}
+
+	if q.MaxBytes == 0 && q.MaxContents == 0 {
+		return nil
+	}
+
+	u, err := getUserUsage(db, userID)
+	if err != nil {
+		return err
+	}
+
+	if q.MaxContents > 0 && u.Contents+1 > q.MaxContents {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_QUOTA_EXCEEDED,
+			Details: fmt.Sprintf("user has %d of %d allowed contents", u.Contents, q.MaxContents),
+		}
+	}
+
+	if q.MaxBytes > 0 && u.Bytes+size > q.MaxBytes {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Message: util.ERR_QUOTA_EXCEEDED,
+			Details: fmt.Sprintf("user has stored %d of %d allowed bytes, cannot add %d more", u.Bytes, q.MaxBytes, size),
+		}
+	}
+
+	return nil
+}
+
+// userOverQuota is checkUserQuota for callers that only need a yes or no
+func userOverQuota(db *gorm.DB, userID uint) (bool, error) {
+	err := checkUserQuota(db, userID, 0)
+	if err == nil {
+		return false, nil
+	}
+
+	var herr *util.HttpError
+	if xerrors.As(err, &herr) && herr.Message == util.ERR_QUOTA_EXCEEDED {
+		return true, nil
+	}
+	return false, err
+}
+
+// userDealSlots returns how many more deals can be started for the user's
+// content right now, or -1 if they have no limit
+func userDealSlots(db *gorm.DB, userID uint) (int, error) {
+	q, err := getUserQuota(db, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if q.MaxConcurrentDeals == 0 {
+		return -1, nil
+	}
+
+	u, err := getUserUsage(db, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if u.PendingDeals >= q.MaxConcurrentDeals {
+		return 0, nil
+	}
+	return int(q.MaxConcurrentDeals - u.PendingDeals), nil
+}
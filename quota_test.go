@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestUserQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &Content{}, &contentDeal{}, &userQuota{})
+
+	// no quota, no limits
+	assert.NoError(checkUserQuota(db, 1, 1<<40))
+	slots, err := userDealSlots(db, 1)
+	assert.NoError(err)
+	assert.Equal(-1, slots)
+
+	for _, c := range []Content{
+		{UserID: 1, Size: 100, Active: true},
+		{UserID: 1, Size: 200, Pinning: true},
+		{UserID: 1, Size: 1000, Active: true, Failed: true},
+		{UserID: 1, Size: 1000, Active: true, Aggregate: true},
+		{UserID: 2, Size: 5000, Active: true},
+	} {
+		c := c
+		assert.NoError(db.Create(&c).Error)
+	}
+	for _, d := range []contentDeal{
+		{Content: 1},
+		{Content: 1, DealID: 10},
+		{Content: 2, Failed: true},
+		{Content: 4},
+		{Content: 5},
+	} {
+		d := d
+		assert.NoError(db.Create(&d).Error)
+	}
+
+	usage, err := getUserUsage(db, 1)
+	assert.NoError(err)
+	assert.Equal(&userUsage{Bytes: 300, Contents: 2, PendingDeals: 2}, usage)
+
+	assert.NoError(setUserQuota(db, &userQuota{UserID: 1, MaxBytes: 1000, MaxConcurrentDeals: 3}))
+	assert.NoError(checkUserQuota(db, 1, 700))
+
+	err = checkUserQuota(db, 1, 701)
+	var herr *util.HttpError
+	if assert.True(xerrors.As(err, &herr)) {
+		assert.Equal(util.ERR_QUOTA_EXCEEDED, herr.Message)
+	}
+
+	slots, err = userDealSlots(db, 1)
+	assert.NoError(err)
+	assert.Equal(1, slots)
+
+	// setting the quota again updates it in place
+	assert.NoError(setUserQuota(db, &userQuota{UserID: 1, MaxContents: 2, MaxConcurrentDeals: 2}))
+	q, err := getUserQuota(db, 1)
+	assert.NoError(err)
+	assert.Equal(int64(0), q.MaxBytes)
+	assert.Equal(int64(2), q.MaxContents)
+
+	over, err := userOverQuota(db, 1)
+	assert.NoError(err)
+	assert.True(over)
+
+	slots, err = userDealSlots(db, 1)
+	assert.NoError(err)
+	assert.Equal(0, slots)
+
+	over, err = userOverQuota(db, 2)
+	assert.NoError(err)
+	assert.False(over)
+}
@@ -1,14 +1,64 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
 )
 
 const minerListTTL = time.Minute
 
+// weight given to each new observation in a miner's moving average response time
+const minerLatencyAlpha = 0.2
+
+// width of the success ratio bands miners are considered equal within when
+// ranking by latency or deal size, see ratioBand
+const rankingTolerance = 0.05
+
+// width of the response time bands miners are considered equal within when
+// ranking by latency, see latencyBand
+const latencyBandMs = 250
+
+// defaults for the miner stats enrichment, see enrichMinerStats
+const (
+	defaultMinerEnrichConcurrency = 8
+	defaultMinerEnrichTimeout     = time.Second * 15
+	defaultMinerEnrichTTL         = time.Hour
+
+	// a miner whose lookup failed isn't looked up again for this long, so
+	// an unreachable lotus node doesn't hold up every ranking
+	minerEnrichRetryInterval = time.Minute * 10
+)
+
+// recordMinerLatency folds how long a miner took to answer an ask or a
+// proposal into its exponential moving average response time
+func (cm *ContentManager) recordMinerLatency(m address.Address, took time.Duration) {
+	cm.minerLatencyLk.Lock()
+	defer cm.minerLatencyLk.Unlock()
+
+	avg, ok := cm.minerLatency[m]
+	if !ok {
+		cm.minerLatency[m] = took
+		return
+	}
+
+	cm.minerLatency[m] = time.Duration(minerLatencyAlpha*float64(took) + (1-minerLatencyAlpha)*float64(avg))
+}
+
+func (cm *ContentManager) minerResponseTime(m address.Address) time.Duration {
+	cm.minerLatencyLk.Lock()
+	defer cm.minerLatencyLk.Unlock()
+	return cm.minerLatency[m]
+}
+
 func (cm *ContentManager) sortedMinerList() ([]address.Address, []*minerDealStats, error) {
 	cm.minerLk.Lock()
 	defer cm.minerLk.Unlock()
@@ -16,6 +66,33 @@ func (cm *ContentManager) sortedMinerList() ([]address.Address, []*minerDealStat
 		return cm.sortedMiners, cm.rawData, nil
 	}
 
+	return cm.recomputeMinerList()
+}
+
+// cachedMinerList returns the ranking as it was last computed and when, even
+// if it has expired, without recomputing it. Both lists are nil if it was
+// never computed.
+func (cm *ContentManager) cachedMinerList() ([]address.Address, []*minerDealStats, time.Time) {
+	cm.minerLk.Lock()
+	defer cm.minerLk.Unlock()
+	return cm.sortedMiners, cm.rawData, cm.lastComputed
+}
+
+// ForceRecompute ranks the miners again right away instead of waiting for
+// minerListTTL, for after miners are added or removed or a batch of deals
+// lands. Readers of sortedMinerList block until it is done and then get the
+// new list, lists handed out earlier are never modified. If ranking fails the
+// previous list is kept, but the next read will try again.
+func (cm *ContentManager) ForceRecompute() ([]address.Address, []*minerDealStats, error) {
+	cm.minerLk.Lock()
+	defer cm.minerLk.Unlock()
+
+	cm.lastComputed = time.Time{}
+	return cm.recomputeMinerList()
+}
+
+// recomputeMinerList must be called with minerLk held
+func (cm *ContentManager) recomputeMinerList() ([]address.Address, []*minerDealStats, error) {
 	sml, err := cm.computeSortedMinerList()
 	if err != nil {
 		return nil, nil, err
@@ -39,6 +116,68 @@ func (cm *ContentManager) sortedMinerList() ([]address.Address, []*minerDealStat
 	return sortedAddrs, sml, nil
 }
 
+// minerCacheEntry is a ranked miner as it is in the cached ranking. Rank is
+// its place in the list deals are made from, zero if it was left out of it.
+type minerCacheEntry struct {
+	Rank         int     `json:"rank"`
+	SuccessRatio float64 `json:"successRatio"`
+	*minerDealStats
+}
+
+// minerCache is the miner ranking new deals are currently picked from
+type minerCache struct {
+	Strategy     string    `json:"strategy"`
+	LastComputed time.Time `json:"lastComputed,omitempty"`
+	// when the ranking expires, it is recomputed on the first read after
+	NextRecompute time.Time `json:"nextRecompute,omitempty"`
+	// zero once the ranking has expired
+	RecomputeInMs int64 `json:"recomputeInMs"`
+
+	Miners []*minerCacheEntry `json:"miners"`
+}
+
+// MinerCache returns the cached miner ranking without recomputing it, even
+// if it has expired
+func (cm *ContentManager) MinerCache() *minerCache {
+	cm.minerLk.Lock()
+	defer cm.minerLk.Unlock()
+
+	return newMinerCache(cm.minerSelection.Name(), cm.sortedMiners, cm.rawData, cm.lastComputed, time.Now())
+}
+
+func newMinerCache(strategy string, sorted []address.Address, stats []*minerDealStats, computed, now time.Time) *minerCache {
+	mc := &minerCache{
+		Strategy: strategy,
+		Miners:   make([]*minerCacheEntry, 0, len(stats)),
+	}
+
+	if !computed.IsZero() {
+		mc.LastComputed = computed
+		mc.NextRecompute = computed.Add(minerListTTL)
+		if left := mc.NextRecompute.Sub(now); left > 0 {
+			mc.RecomputeInMs = left.Milliseconds()
+		}
+	}
+
+	ranks := make(map[address.Address]int, len(sorted))
+	for i, m := range sorted {
+		ranks[m] = i + 1
+	}
+
+	for _, st := range stats {
+		e := &minerCacheEntry{
+			Rank:           ranks[st.Miner],
+			minerDealStats: st,
+		}
+		// a miner with no deals yet has no ratio, and NaN doesn't encode
+		if st.TotalDeals > 0 {
+			e.SuccessRatio = st.SuccessRatio()
+		}
+		mc.Miners = append(mc.Miners, e)
+	}
+	return mc
+}
+
 func (cm *ContentManager) minerIsSuspended(m address.Address) (bool, error) {
 	var miner storageMiner
 	if err := cm.DB.Find(&miner, "address = ?", m.String()).Error; err != nil {
@@ -55,60 +194,388 @@ type minerDealStats struct {
 	ConfirmedDeals int `json:"confirmedDeals"`
 	FailedDeals    int `json:"failedDeals"`
 	DealFaults     int `json:"dealFaults"`
+	// faults the miner was slashed for, also counted in DealFaults
+	SlashedDeals int `json:"slashedDeals"`
+
+	// padded piece bytes of the miner's confirmed deals
+	TotalBytesStored uint64 `json:"totalBytesStored"`
+
+	// moving average of how long the miner takes to respond to asks and
+	// proposals, zero if we haven't talked to it since startup
+	AvgResponseMs int64 `json:"avgResponseMs"`
+
+	// the miner's last known ask price for the kind of deals we make, nil
+	// if we have never gotten an ask from it
+	Price    *abi.TokenAmount `json:"price,omitempty"`
+	Location string           `json:"location"`
+
+	// the miner's quality adjusted power, nil if it couldn't be looked up.
+	// Miners without power are ranked last, see powerlessLast.
+	Power *abi.StoragePower `json:"power,omitempty"`
+
+	Breaker *minerBreakerStatus `json:"breaker,omitempty"`
+
+	// set if the miner recently said it isn't taking new deals
+	NotAccepting *minerAvailability `json:"notAccepting,omitempty"`
 }
 
+// SuccessRatio is the share of deals that made it on chain and stayed there,
+// a slashed deal counts as slashedDealWeight lost deals
 func (mds *minerDealStats) SuccessRatio() float64 {
-	return float64(mds.ConfirmedDeals) / float64(mds.TotalDeals)
+	total := mds.TotalDeals + (slashedDealWeight-1)*mds.SlashedDeals
+	return float64(mds.ConfirmedDeals) / float64(total)
+}
+
+// MarshalJSON adds the success ratio, zero for miners we have no deals with,
+// so clients don't work it out again without the slashing weight
+func (mds *minerDealStats) MarshalJSON() ([]byte, error) {
+	type stats minerDealStats
+
+	var ratio float64
+	if mds.TotalDeals > 0 {
+		ratio = mds.SuccessRatio()
+	}
+
+	return json.Marshal(struct {
+		*stats
+		SuccessRatio float64 `json:"successRatio"`
+	}{(*stats)(mds), ratio})
+}
+
+// ratioBand quantizes a success ratio into bands rankingTolerance wide,
+// centered on its multiples so the common round ratios aren't on an edge.
+// Miners are compared by band rather than by how far apart their ratios are,
+// which keeps the ordering transitive: with a distance, a can be close to b
+// and b to c while a isn't close to c. Miners without a ratio yet come last.
+func ratioBand(ratio float64) int {
+	if math.IsNaN(ratio) {
+		return -1
+	}
+	// the epsilon keeps ratios that land exactly on a band's edge in the
+	// upper band
+	return int(math.Floor(ratio/rankingTolerance + 0.5 + 1e-9))
+}
+
+// latencyBand quantizes a response time into bands latencyBandMs wide, for
+// the same reason as ratioBand. Miners we haven't heard from since startup
+// come after all the others.
+func latencyBand(ms int64) int64 {
+	if ms <= 0 {
+		return math.MaxInt64
+	}
+	return ms / latencyBandMs
 }
 
 // The comparison function that decides 'miner X is better than miner Y'
-func (mds *minerDealStats) Better(o *minerDealStats) bool {
+// If useSize is set, miners in the same success ratio band are ordered by how
+// much data they have stored for us, then if useLatency is set by their
+// response time band, and only then by their exact success ratio. Without either,
+// miners are ordered by success ratio alone, and those with the same ratio
+// keep their order.
+func (mds *minerDealStats) Better(o *minerDealStats, useLatency, useSize bool) bool {
+	if useSize || useLatency {
+		if a, b := ratioBand(mds.SuccessRatio()), ratioBand(o.SuccessRatio()); a != b {
+			return a > b
+		}
+
+		if useSize && mds.TotalBytesStored != o.TotalBytesStored {
+			return mds.TotalBytesStored > o.TotalBytesStored
+		}
+
+		if useLatency {
+			if a, b := latencyBand(mds.AvgResponseMs), latencyBand(o.AvgResponseMs); a != b {
+				return a < b
+			}
+		}
+	}
+
 	return mds.SuccessRatio() > o.SuccessRatio()
 }
 
 func (cm *ContentManager) computeSortedMinerList() ([]*minerDealStats, error) {
-	var deals []contentDeal
-	if err := cm.DB.Find(&deals).Error; err != nil {
+	stats, err := localMinerDealStats(cm.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mergeImportedMinerStats(cm.DB, stats); err != nil {
+		return nil, err
+	}
+
+	minerStatsArr := make([]*minerDealStats, 0, len(stats))
+	for _, st := range stats {
+		st.AvgResponseMs = cm.minerResponseTime(st.Miner).Milliseconds()
+		st.Breaker = cm.minerBreakers.status(st.Miner)
+		minerStatsArr = append(minerStatsArr, st)
+	}
+
+	if err := cm.addMinerAskInfo(stats); err != nil {
+		return nil, err
+	}
+
+	if err := cm.addMinerAvailability(stats); err != nil {
 		return nil, err
 	}
 
-	stats := make(map[address.Address]*minerDealStats)
-	for _, d := range deals {
-		maddr, err := d.MinerAddr()
+	cm.enrichMinerStats(context.TODO(), minerStatsArr)
+
+	return powerlessLast(cm.minerSelection.Rank(minerStatsArr)), nil
+}
+
+// powerlessLast moves the miners known to have no power after the others,
+// keeping the order of both. A miner without power can't prove it stores
+// anything, so deals with it won't make it on chain however well it did
+// before. Miners whose power couldn't be looked up keep their place.
+func powerlessLast(ranked []*minerDealStats) []*minerDealStats {
+	out := make([]*minerDealStats, 0, len(ranked))
+	var powerless []*minerDealStats
+	for _, st := range ranked {
+		if st.Power != nil && st.Power.IsZero() {
+			powerless = append(powerless, st)
+			continue
+		}
+		out = append(out, st)
+	}
+	return append(out, powerless...)
+}
+
+// minerEnrichment holds what we look up over the network about a miner when
+// ranking it, so that recomputing the list doesn't redo every lookup. Failed
+// lookups are remembered too, see minerEnrichRetryInterval.
+type minerEnrichment struct {
+	Power   abi.StoragePower
+	failed  bool
+	fetched time.Time
+}
+
+func (me *minerEnrichment) fresh(ttl time.Duration) bool {
+	if me.failed {
+		ttl = minerEnrichRetryInterval
+	}
+	return time.Since(me.fetched) < ttl
+}
+
+func (me *minerEnrichment) apply(st *minerDealStats) {
+	if me.failed {
+		return
+	}
+	p := me.Power
+	st.Power = &p
+}
+
+// enrichMinerStats fills in the stats that need network lookups. Lookups run
+// on at most minerEnrichConcurrency workers with minerEnrichTimeout each, a
+// miner whose lookup fails or times out is ranked without that information.
+func (cm *ContentManager) enrichMinerStats(ctx context.Context, stats []*minerDealStats) {
+	var todo []*minerDealStats
+	cm.minerEnrichLk.Lock()
+	for _, st := range stats {
+		if me, ok := cm.minerEnrich[st.Miner]; ok && me.fresh(cm.minerEnrichTTL) {
+			me.apply(st)
+			continue
+		}
+		todo = append(todo, st)
+	}
+	cm.minerEnrichLk.Unlock()
+
+	workers := cm.minerEnrichConcurrency
+	if workers <= 0 {
+		workers = 1
+	}
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, st := range todo {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(st *minerDealStats) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			me, err := cm.fetchMinerEnrichment(ctx, st.Miner)
+			if err != nil {
+				log.Warnf("failed to look up ranking info for miner %s: %s", st.Miner, err)
+				me = &minerEnrichment{failed: true, fetched: time.Now()}
+			}
+
+			cm.minerEnrichLk.Lock()
+			cm.minerEnrich[st.Miner] = me
+			cm.minerEnrichLk.Unlock()
+
+			me.apply(st)
+		}(st)
+	}
+	wg.Wait()
+}
+
+func (cm *ContentManager) fetchMinerEnrichment(ctx context.Context, m address.Address) (*minerEnrichment, error) {
+	if cm.minerEnrichTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cm.minerEnrichTimeout)
+		defer cancel()
+	}
+
+	pow, err := cm.Api.StateMinerPower(ctx, m, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &minerEnrichment{
+		Power:   pow.MinerPower.QualityAdjPower,
+		fetched: time.Now(),
+	}, nil
+}
+
+// addMinerAskInfo fills in the cached ask price and location of each miner
+func (cm *ContentManager) addMinerAskInfo(stats map[address.Address]*minerDealStats) error {
+	var asks []minerStorageAsk
+	if err := cm.DB.Find(&asks).Error; err != nil {
+		return err
+	}
+
+	for _, a := range asks {
+		maddr, err := address.NewFromString(a.Miner)
 		if err != nil {
-			return nil, err
+			continue
 		}
 
 		st, ok := stats[maddr]
 		if !ok {
-			st = &minerDealStats{
-				Miner: maddr,
-			}
-			stats[maddr] = st
+			continue
 		}
 
-		st.TotalDeals++
-		if d.DealID > 0 {
-			if d.Failed {
-				st.DealFaults++
-			} else {
-				st.ConfirmedDeals++
-			}
-		} else if d.Failed {
-			st.FailedDeals++
-		} else {
-			// in progress
+		getPrice := a.GetPrice
+		if cm.VerifiedDeal {
+			getPrice = a.GetVerifiedPrice
 		}
+
+		price, err := getPrice()
+		if err != nil {
+			log.Warnf("miner %s has invalid ask price: %s", a.Miner, err)
+			continue
+		}
+		st.Price = price
 	}
 
-	minerStatsArr := make([]*minerDealStats, 0, len(stats))
-	for _, st := range stats {
-		minerStatsArr = append(minerStatsArr, st)
+	var miners []storageMiner
+	if err := cm.DB.Find(&miners).Error; err != nil {
+		return err
 	}
 
-	sort.Slice(minerStatsArr, func(i, j int) bool {
-		return minerStatsArr[i].Better(minerStatsArr[j])
+	for _, m := range miners {
+		if st, ok := stats[m.Address.Addr]; ok {
+			st.Location = m.Location
+		}
+	}
+
+	return nil
+}
+
+// minerSelectionStrategy decides the order in which miners are picked for
+// new deals. Rank receives the stats for every miner we've made deals with
+// and returns them sorted best first.
+type minerSelectionStrategy interface {
+	Name() string
+	Rank(stats []*minerDealStats) []*minerDealStats
+}
+
+const (
+	minerSelectionSuccessRatio  = "success-ratio"
+	minerSelectionLowestPrice   = "lowest-price"
+	minerSelectionRegionDiverse = "region-diverse"
+)
+
+func newMinerSelectionStrategy(name string, useLatency, useSize bool) (minerSelectionStrategy, error) {
+	switch name {
+	case "", minerSelectionSuccessRatio:
+		return &successRatioStrategy{useLatency: useLatency, useSize: useSize}, nil
+	case minerSelectionLowestPrice:
+		return &lowestPriceStrategy{}, nil
+	case minerSelectionRegionDiverse:
+		return &regionDiverseStrategy{base: &successRatioStrategy{useLatency: useLatency, useSize: useSize}}, nil
+	default:
+		return nil, fmt.Errorf("unknown miner selection strategy %q", name)
+	}
+}
+
+// successRatioStrategy prefers the miners that have gotten the largest share
+// of our deals on chain
+type successRatioStrategy struct {
+	useLatency bool
+	useSize    bool
+}
+
+func (s *successRatioStrategy) Name() string {
+	return minerSelectionSuccessRatio
+}
+
+func (s *successRatioStrategy) Rank(stats []*minerDealStats) []*minerDealStats {
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Better(stats[j], s.useLatency, s.useSize)
 	})
+	return stats
+}
+
+// lowestPriceStrategy prefers the cheapest miners, miners we have no price
+// for go last. Equal prices fall back to the success ratio.
+type lowestPriceStrategy struct{}
+
+func (s *lowestPriceStrategy) Name() string {
+	return minerSelectionLowestPrice
+}
+
+func (s *lowestPriceStrategy) Rank(stats []*minerDealStats) []*minerDealStats {
+	sort.SliceStable(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		switch {
+		case a.Price == nil && b.Price == nil:
+			return a.Better(b, false, false)
+		case a.Price == nil:
+			return false
+		case b.Price == nil:
+			return true
+		}
 
-	return minerStatsArr, nil
+		if c := a.Price.Int.Cmp(b.Price.Int); c != 0 {
+			return c < 0
+		}
+		return a.Better(b, false, false)
+	})
+	return stats
+}
+
+// regionDiverseStrategy ranks miners with the base strategy, then
+// interleaves locations so that the top of the list spreads deals across as
+// many regions as possible
+type regionDiverseStrategy struct {
+	base minerSelectionStrategy
+}
+
+func (s *regionDiverseStrategy) Name() string {
+	return minerSelectionRegionDiverse
+}
+
+func (s *regionDiverseStrategy) Rank(stats []*minerDealStats) []*minerDealStats {
+	ranked := s.base.Rank(stats)
+
+	var regions []string
+	byRegion := make(map[string][]*minerDealStats)
+	for _, st := range ranked {
+		if _, ok := byRegion[st.Location]; !ok {
+			regions = append(regions, st.Location)
+		}
+		byRegion[st.Location] = append(byRegion[st.Location], st)
+	}
+
+	out := make([]*minerDealStats, 0, len(ranked))
+	for len(out) < len(ranked) {
+		for _, r := range regions {
+			if len(byRegion[r]) == 0 {
+				continue
+			}
+			out = append(out, byRegion[r][0])
+			byRegion[r] = byRegion[r][1:]
+		}
+	}
+	return out
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMinerStats(t *testing.T, id uint64, confirmed, total int, price int64, location string) *minerDealStats {
+	maddr, err := address.NewIDAddress(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := &minerDealStats{
+		Miner:          maddr,
+		TotalDeals:     total,
+		ConfirmedDeals: confirmed,
+		Location:       location,
+	}
+	if price >= 0 {
+		p := abi.TokenAmount(big.NewInt(price))
+		st.Price = &p
+	}
+	return st
+}
+
+func minerIDs(t *testing.T, stats []*minerDealStats) []uint64 {
+	var out []uint64
+	for _, st := range stats {
+		id, err := address.IDFromAddress(st.Miner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, id)
+	}
+	return out
+}
+
+func TestSuccessRatioStrategy(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newMinerSelectionStrategy("", false, false)
+	assert.NoError(err)
+	assert.Equal(minerSelectionSuccessRatio, s.Name())
+
+	ranked := s.Rank([]*minerDealStats{
+		testMinerStats(t, 1000, 1, 10, 0, ""),
+		testMinerStats(t, 1001, 9, 10, 0, ""),
+		testMinerStats(t, 1002, 5, 10, 0, ""),
+	})
+	assert.Equal([]uint64{1001, 1002, 1000}, minerIDs(t, ranked))
+}
+
+func TestSuccessRatioStrategyLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	slow := testMinerStats(t, 1000, 9, 10, 0, "")
+	slow.AvgResponseMs = 3000
+	fast := testMinerStats(t, 1001, 89, 100, 0, "")
+	fast.AvgResponseMs = 200
+
+	s, err := newMinerSelectionStrategy(minerSelectionSuccessRatio, true, false)
+	assert.NoError(err)
+
+	ranked := s.Rank([]*minerDealStats{slow, fast})
+	assert.Equal([]uint64{1001, 1000}, minerIDs(t, ranked))
+
+	// close response times are the same, miners we haven't heard from come
+	// after the rest in their band, and the order is the same whichever
+	// way the miners come in
+	near := testMinerStats(t, 1002, 91, 100, 0, "")
+	near.AvgResponseMs = 300
+	unknown := testMinerStats(t, 1003, 92, 100, 0, "")
+	fast.AvgResponseMs = 260
+
+	for _, in := range [][]*minerDealStats{{slow, fast, near, unknown}, {unknown, near, fast, slow}, {near, unknown, slow, fast}} {
+		ranked = s.Rank(in)
+		assert.Equal([]uint64{1002, 1001, 1000, 1003}, minerIDs(t, ranked))
+	}
+}
+
+func TestSuccessRatioStrategyRatioBand(t *testing.T) {
+	assert := assert.New(t)
+
+	// a faster miner only comes first within the same ratio band
+	slow := testMinerStats(t, 1000, 95, 100, 0, "")
+	slow.AvgResponseMs = 3000
+	fast := testMinerStats(t, 1001, 92, 100, 0, "")
+	fast.AvgResponseMs = 200
+
+	s, err := newMinerSelectionStrategy(minerSelectionSuccessRatio, true, false)
+	assert.NoError(err)
+
+	ranked := s.Rank([]*minerDealStats{fast, slow})
+	assert.Equal([]uint64{1000, 1001}, minerIDs(t, ranked))
+}
+
+func TestLatencyBand(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(int64(0), latencyBand(1))
+	assert.Equal(int64(1), latencyBand(260))
+	assert.Equal(latencyBand(260), latencyBand(300))
+	assert.Equal(int64(math.MaxInt64), latencyBand(0))
+}
+
+func TestSuccessRatioStrategySize(t *testing.T) {
+	assert := assert.New(t)
+
+	small := testMinerStats(t, 1000, 92, 100, 0, "")
+	small.TotalBytesStored = 92 << 20
+	big := testMinerStats(t, 1001, 91, 100, 0, "")
+	big.TotalBytesStored = 91 * (32 << 30)
+	tied := testMinerStats(t, 1002, 46, 50, 0, "")
+	tied.TotalBytesStored = 46 << 30
+	other := testMinerStats(t, 1003, 85, 100, 0, "")
+	other.TotalBytesStored = 1 << 50
+
+	// without weighting by size, miners with the same ratio keep their order
+	s, err := newMinerSelectionStrategy(minerSelectionSuccessRatio, false, false)
+	assert.NoError(err)
+	ranked := s.Rank([]*minerDealStats{small, big, tied, other})
+	assert.Equal([]uint64{1000, 1002, 1001, 1003}, minerIDs(t, ranked))
+
+	// bytes stored only count within a success ratio band
+	s, err = newMinerSelectionStrategy(minerSelectionSuccessRatio, false, true)
+	assert.NoError(err)
+	ranked = s.Rank([]*minerDealStats{small, other, big, tied})
+	assert.Equal([]uint64{1001, 1002, 1000, 1003}, minerIDs(t, ranked))
+}
+
+func TestRatioBand(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(18, ratioBand(0.9))
+	assert.Equal(18, ratioBand(0.89))
+	assert.Equal(18, ratioBand(0.924))
+	assert.Equal(19, ratioBand(0.925))
+	assert.Equal(20, ratioBand(1))
+	assert.Equal(0, ratioBand(0))
+	assert.Equal(-1, ratioBand(math.NaN()))
+}
+
+func TestLowestPriceStrategy(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newMinerSelectionStrategy(minerSelectionLowestPrice, false, false)
+	assert.NoError(err)
+
+	ranked := s.Rank([]*minerDealStats{
+		testMinerStats(t, 1000, 9, 10, -1, ""),
+		testMinerStats(t, 1001, 1, 10, 50, ""),
+		testMinerStats(t, 1002, 9, 10, 100, ""),
+		testMinerStats(t, 1003, 5, 10, 50, ""),
+	})
+	assert.Equal([]uint64{1003, 1001, 1002, 1000}, minerIDs(t, ranked))
+}
+
+func TestRegionDiverseStrategy(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newMinerSelectionStrategy(minerSelectionRegionDiverse, false, false)
+	assert.NoError(err)
+
+	ranked := s.Rank([]*minerDealStats{
+		testMinerStats(t, 1000, 10, 10, 0, "us"),
+		testMinerStats(t, 1001, 9, 10, 0, "us"),
+		testMinerStats(t, 1002, 8, 10, 0, "us"),
+		testMinerStats(t, 1003, 7, 10, 0, "eu"),
+		testMinerStats(t, 1004, 6, 10, 0, "asia"),
+	})
+	assert.Equal([]uint64{1000, 1003, 1004, 1001, 1002}, minerIDs(t, ranked))
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	_, err := newMinerSelectionStrategy("fastest-horse", false, false)
+	assert.Error(t, err)
+}
+
+func TestMinerCache(t *testing.T) {
+	assert := assert.New(t)
+
+	mc := newMinerCache(minerSelectionSuccessRatio, nil, nil, time.Time{}, time.Now())
+	assert.True(mc.LastComputed.IsZero())
+	assert.Zero(mc.RecomputeInMs)
+	assert.Empty(mc.Miners)
+
+	stats := []*minerDealStats{
+		testMinerStats(t, 1001, 9, 10, 0, ""),
+		testMinerStats(t, 1002, 5, 10, 0, ""),
+		testMinerStats(t, 1003, 0, 0, 0, ""),
+	}
+	// 1002 is suspended, so left out of the sorted list
+	sorted := []address.Address{stats[0].Miner, stats[2].Miner}
+
+	computed := time.Now()
+	mc = newMinerCache(minerSelectionSuccessRatio, sorted, stats, computed, computed.Add(time.Second*20))
+	assert.Equal(computed.Add(minerListTTL), mc.NextRecompute)
+	assert.Equal((minerListTTL - time.Second*20).Milliseconds(), mc.RecomputeInMs)
+
+	assert.Len(mc.Miners, 3)
+	assert.Equal(1, mc.Miners[0].Rank)
+	assert.Equal(0.9, mc.Miners[0].SuccessRatio)
+	assert.Equal(0, mc.Miners[1].Rank)
+	assert.Equal(2, mc.Miners[2].Rank)
+	assert.Zero(mc.Miners[2].SuccessRatio)
+
+	// an expired ranking waits for the next read to be recomputed
+	mc = newMinerCache(minerSelectionSuccessRatio, sorted, stats, computed, computed.Add(minerListTTL*2))
+	assert.Zero(mc.RecomputeInMs)
+}
+
+type powerGateway struct {
+	api.Gateway
+
+	lk       sync.Mutex
+	calls    int
+	inflight int
+	peak     int
+	hang     map[address.Address]bool
+}
+
+func (g *powerGateway) StateMinerPower(ctx context.Context, m address.Address, tsk types.TipSetKey) (*api.MinerPower, error) {
+	g.lk.Lock()
+	g.calls++
+	g.inflight++
+	if g.inflight > g.peak {
+		g.peak = g.inflight
+	}
+	g.lk.Unlock()
+
+	defer func() {
+		g.lk.Lock()
+		g.inflight--
+		g.lk.Unlock()
+	}()
+
+	if g.hang[m] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	time.Sleep(time.Millisecond * 10)
+	return &api.MinerPower{MinerPower: power.Claim{QualityAdjPower: big.NewInt(1 << 40)}}, nil
+}
+
+func TestEnrichMinerStats(t *testing.T) {
+	assert := assert.New(t)
+
+	var stats []*minerDealStats
+	for i := uint64(0); i < 10; i++ {
+		stats = append(stats, testMinerStats(t, 1000+i, 1, 1, 0, ""))
+	}
+
+	g := &powerGateway{hang: map[address.Address]bool{stats[0].Miner: true}}
+	cm := &ContentManager{
+		Api:                    g,
+		minerEnrich:            make(map[address.Address]*minerEnrichment),
+		minerEnrichConcurrency: 3,
+		minerEnrichTimeout:     time.Millisecond * 50,
+		minerEnrichTTL:         time.Hour,
+	}
+
+	cm.enrichMinerStats(context.Background(), stats)
+	assert.Equal(10, g.calls)
+	assert.LessOrEqual(g.peak, 3)
+
+	// the hanging miner timed out and is ranked without power
+	assert.Nil(stats[0].Power)
+	for _, st := range stats[1:] {
+		if assert.NotNil(st.Power) {
+			assert.Equal(int64(1<<40), st.Power.Int64())
+		}
+	}
+
+	// nothing is looked up again, not even the miner whose lookup failed
+	for _, st := range stats {
+		st.Power = nil
+	}
+	cm.enrichMinerStats(context.Background(), stats)
+	assert.Equal(10, g.calls)
+	assert.Nil(stats[0].Power)
+	assert.NotNil(stats[1].Power)
+
+	// until it's been long enough to try again
+	cm.minerEnrich[stats[0].Miner].fetched = time.Now().Add(-minerEnrichRetryInterval)
+	cm.enrichMinerStats(context.Background(), stats)
+	assert.Equal(11, g.calls)
+}
+
+func TestPowerlessLast(t *testing.T) {
+	assert := assert.New(t)
+
+	var stats []*minerDealStats
+	for i := uint64(0); i < 4; i++ {
+		stats = append(stats, testMinerStats(t, 1000+i, 1, 1, 0, ""))
+	}
+
+	none, some := big.Zero(), big.NewInt(1<<40)
+	stats[0].Power = &none
+	stats[1].Power = &some
+	stats[3].Power = &none
+
+	assert.Equal([]uint64{1001, 1002, 1000, 1003}, minerIDs(t, powerlessLast(stats)))
+}
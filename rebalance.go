@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+const (
+	rebalanceInterval = time.Minute * 10
+
+	// contents given replacement deals in one pass, the rest wait for the
+	// next so that a big miner doesn't flood the deal pipeline
+	rebalanceBatchSize = 20
+
+	// times a content gets replacement deals before giving up on it
+	rebalanceMaxAttempts = 3
+)
+
+// The states a content goes through while its replicas are moved off a miner
+const (
+	// waiting for a replacement deal to be made
+	rebalancePending = "pending"
+	// replacement deal made, waiting for it to seal
+	rebalanceSealing = "sealing"
+	// a replacement sealed and the deal with the old miner no longer counts
+	rebalanceDone = "done"
+	// couldn't be moved, see the item's error
+	rebalanceFailed = "failed"
+)
+
+// minerRebalance moves every replica off a miner we no longer trust. Each
+// content with a deal on the miner gets a replacement deal with another miner,
+// and once that seals the old deal is retired: it stays on chain, but doesn't
+// count toward the content's replication anymore.
+type minerRebalance struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	Miner      string     `gorm:"index" json:"miner"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type rebalanceItem struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Rebalance uint   `gorm:"index" json:"-"`
+	Content   uint   `json:"content"`
+	OldDeal   uint   `json:"oldDeal"`
+	State     string `json:"state"`
+	Attempts  int    `json:"attempts"`
+	Error     string `json:"error,omitempty"`
+
+	// when the latest replacement deals were made, deals for the content
+	// made since are replacements
+	DealsMadeAt time.Time `json:"-"`
+}
+
+// startRebalance starts moving replicas off the miner, or returns the
+// rebalance already in progress for it
+func (cm *ContentManager) startRebalance(maddr address.Address) (*minerRebalance, error) {
+	var rb minerRebalance
+	err := cm.DB.First(&rb, "miner = ? AND finished_at IS NULL", maddr.String()).Error
+	if err == nil {
+		return &rb, nil
+	}
+	if !xerrors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var deals []contentDeal
+	if err := cm.DB.Model(contentDeal{}).
+		Joins("left join contents on content_deals.content = contents.id").
+		Where("content_deals.miner = ? AND NOT content_deals.failed AND NOT content_deals.retired AND contents.active", maddr.String()).
+		Find(&deals).Error; err != nil {
+		return nil, err
+	}
+
+	rb = minerRebalance{Miner: maddr.String()}
+	if err := cm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&rb).Error; err != nil {
+			return err
+		}
+
+		if len(deals) == 0 {
+			now := time.Now()
+			rb.FinishedAt = &now
+			return tx.Model(&rb).Update("finished_at", now).Error
+		}
+
+		items := make([]rebalanceItem, 0, len(deals))
+		for _, d := range deals {
+			items = append(items, rebalanceItem{
+				Rebalance: rb.ID,
+				Content:   d.Content,
+				OldDeal:   d.ID,
+				State:     rebalancePending,
+			})
+		}
+		return tx.CreateInBatches(items, 500).Error
+	}); err != nil {
+		return nil, err
+	}
+
+	log.Infow("rebalancing replicas off miner", "miner", maddr, "contents", len(deals))
+	go func() {
+		if err := cm.advanceRebalances(context.TODO()); err != nil {
+			log.Errorf("failed to advance miner rebalances: %s", err)
+		}
+	}()
+	return &rb, nil
+}
+
+// runRebalancer periodically moves rebalances in progress along
+func (cm *ContentManager) runRebalancer(ctx context.Context) {
+	ticker := time.NewTicker(rebalanceInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := cm.advanceRebalances(ctx); err != nil {
+			log.Errorf("failed to advance miner rebalances: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cm *ContentManager) advanceRebalances(ctx context.Context) error {
+	cm.rebalanceLk.Lock()
+	defer cm.rebalanceLk.Unlock()
+
+	var rbs []minerRebalance
+	if err := cm.DB.Find(&rbs, "finished_at IS NULL").Error; err != nil {
+		return err
+	}
+
+	for _, rb := range rbs {
+		if err := cm.advanceRebalance(ctx, rb); err != nil {
+			log.Errorw("failed to advance miner rebalance", "miner", rb.Miner, "err", err)
+		}
+	}
+	return nil
+}
+
+func (cm *ContentManager) advanceRebalance(ctx context.Context, rb minerRebalance) error {
+	var sealing []rebalanceItem
+	if err := cm.DB.Find(&sealing, "rebalance = ? AND state = ?", rb.ID, rebalanceSealing).Error; err != nil {
+		return err
+	}
+
+	for i := range sealing {
+		if err := cm.checkRebalanceItem(rb, &sealing[i]); err != nil {
+			log.Errorw("failed to check replacement deals", "miner", rb.Miner, "content", sealing[i].Content, "err", err)
+		}
+	}
+
+	var pending []rebalanceItem
+	if err := cm.DB.Limit(rebalanceBatchSize).Order("id").Find(&pending, "rebalance = ? AND state = ?", rb.ID, rebalancePending).Error; err != nil {
+		return err
+	}
+
+	for i := range pending {
+		if err := cm.replaceRebalanceItem(ctx, rb, &pending[i]); err != nil {
+			log.Errorw("failed to make replacement deal", "miner", rb.Miner, "content", pending[i].Content, "err", err)
+		}
+	}
+
+	var left int64
+	if err := cm.DB.Model(rebalanceItem{}).Where("rebalance = ? AND state IN ?", rb.ID, []string{rebalancePending, rebalanceSealing}).Count(&left).Error; err != nil {
+		return err
+	}
+
+	if left == 0 {
+		log.Infow("finished rebalancing replicas off miner", "miner", rb.Miner)
+		return cm.DB.Model(&rb).Update("finished_at", time.Now()).Error
+	}
+	return nil
+}
+
+// replaceRebalanceItem makes a replacement deal for the content, with any
+// miner but the one being rebalanced off and those it already has deals with
+func (cm *ContentManager) replaceRebalanceItem(ctx context.Context, rb minerRebalance, item *rebalanceItem) error {
+	var content Content
+	if err := cm.DB.First(&content, "id = ?", item.Content).Error; err != nil {
+		return err
+	}
+
+	var old contentDeal
+	if err := cm.DB.First(&old, "id = ?", item.OldDeal).Error; err != nil {
+		return err
+	}
+
+	if !content.Active {
+		return cm.finishRebalanceItem(item, rebalanceFailed, "content is no longer active")
+	}
+
+	if old.Failed {
+		// the deal is being replaced the usual way already
+		return cm.finishRebalanceItem(item, rebalanceDone, "deal with the miner failed before it was replaced")
+	}
+
+	deals, err := cm.activeDealsForContent(content.ID)
+	if err != nil {
+		return err
+	}
+
+	exclude := make(map[address.Address]bool)
+	for _, d := range deals {
+		maddr, err := d.MinerAddr()
+		if err != nil {
+			return err
+		}
+		exclude[maddr] = true
+	}
+
+	item.Attempts++
+	item.DealsMadeAt = time.Now()
+	if err := cm.makeDealsForContent(ctx, content, 1, exclude, cm.VerifiedDeal); err != nil {
+		if item.Attempts >= rebalanceMaxAttempts {
+			return cm.finishRebalanceItem(item, rebalanceFailed, err.Error())
+		}
+
+		return cm.DB.Model(item).Updates(map[string]interface{}{
+			"attempts": item.Attempts,
+			"error":    err.Error(),
+		}).Error
+	}
+
+	return cm.DB.Model(item).Updates(map[string]interface{}{
+		"state":         rebalanceSealing,
+		"attempts":      item.Attempts,
+		"deals_made_at": item.DealsMadeAt,
+		"error":         "",
+	}).Error
+}
+
+// checkRebalanceItem retires the old deal once a replacement has sealed, and
+// sends the content back for another replacement if they all failed
+func (cm *ContentManager) checkRebalanceItem(rb minerRebalance, item *rebalanceItem) error {
+	sealed, live, err := replacementDeals(cm.DB, item, rb.Miner)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case sealed:
+		if err := cm.DB.Model(contentDeal{}).Where("id = ?", item.OldDeal).UpdateColumns(map[string]interface{}{
+			"retired":    true,
+			"retired_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		log.Infow("retired deal after replacing it", "miner", rb.Miner, "content", item.Content, "deal", item.OldDeal)
+		return cm.finishRebalanceItem(item, rebalanceDone, "")
+	case live:
+		return nil
+	case item.Attempts >= rebalanceMaxAttempts:
+		return cm.finishRebalanceItem(item, rebalanceFailed, "replacement deals failed")
+	default:
+		return cm.DB.Model(item).Updates(map[string]interface{}{
+			"state": rebalancePending,
+			"error": "replacement deal failed",
+		}).Error
+	}
+}
+
+// replacementDeals reports whether a deal made for the item's content since
+// its replacement deals were made has sealed, and whether any are still
+// making progress
+func replacementDeals(db *gorm.DB, item *rebalanceItem, oldMiner string) (sealed bool, live bool, err error) {
+	var deals []contentDeal
+	if err := db.Find(&deals, "content = ? AND miner != ? AND created_at >= ? AND NOT failed", item.Content, oldMiner, item.DealsMadeAt).Error; err != nil {
+		return false, false, err
+	}
+
+	for _, d := range deals {
+		if !d.SealedAt.IsZero() {
+			return true, true, nil
+		}
+	}
+	return false, len(deals) > 0, nil
+}
+
+func (cm *ContentManager) finishRebalanceItem(item *rebalanceItem, state, msg string) error {
+	if state == rebalanceFailed {
+		log.Warnw("could not rebalance content", "content", item.Content, "deal", item.OldDeal, "err", msg)
+	}
+
+	return cm.DB.Model(item).Updates(map[string]interface{}{
+		"state":    state,
+		"attempts": item.Attempts,
+		"error":    msg,
+	}).Error
+}
+
+type rebalanceStatus struct {
+	*minerRebalance
+
+	Total   int `json:"total"`
+	Pending int `json:"pending"`
+	Sealing int `json:"sealing"`
+	Done    int `json:"done"`
+	Failed  int `json:"failed"`
+
+	// contents that couldn't be rebalanced, and pending ones whose last
+	// attempt failed
+	Problems []rebalanceItem `json:"problems"`
+}
+
+// rebalanceStatus reports on the latest rebalance off the miner, nil if
+// there never was one
+func (cm *ContentManager) rebalanceStatus(maddr address.Address) (*rebalanceStatus, error) {
+	var rb minerRebalance
+	if err := cm.DB.Order("id desc").First(&rb, "miner = ?", maddr.String()).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var items []rebalanceItem
+	if err := cm.DB.Order("id").Find(&items, "rebalance = ?", rb.ID).Error; err != nil {
+		return nil, err
+	}
+
+	st := &rebalanceStatus{
+		minerRebalance: &rb,
+		Total:          len(items),
+		Problems:       []rebalanceItem{},
+	}
+	for _, it := range items {
+		switch it.State {
+		case rebalancePending:
+			st.Pending++
+		case rebalanceSealing:
+			st.Sealing++
+		case rebalanceDone:
+			st.Done++
+		case rebalanceFailed:
+			st.Failed++
+		default:
+			return nil, fmt.Errorf("rebalance item %d in unknown state %q", it.ID, it.State)
+		}
+
+		if it.Error != "" && it.State != rebalanceDone {
+			st.Problems = append(st.Problems, it)
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebalanceReplacementDeals(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &contentDeal{}, &minerRebalance{}, &rebalanceItem{})
+
+	old := &contentDeal{Content: 1, Miner: "f01000", DealID: 1, SealedAt: time.Now()}
+	assert.NoError(db.Create(old).Error)
+
+	item := &rebalanceItem{Content: 1, OldDeal: old.ID, State: rebalanceSealing, DealsMadeAt: time.Now().Add(-time.Second)}
+
+	// the old deal is sealed, but it isn't a replacement
+	sealed, live, err := replacementDeals(db, item, "f01000")
+	assert.NoError(err)
+	assert.False(sealed)
+	assert.False(live)
+
+	assert.NoError(db.Create(&contentDeal{Content: 1, Miner: "f01001", Failed: true}).Error)
+	sealed, live, err = replacementDeals(db, item, "f01000")
+	assert.NoError(err)
+	assert.False(sealed)
+	assert.False(live)
+
+	repl := &contentDeal{Content: 1, Miner: "f01002"}
+	assert.NoError(db.Create(repl).Error)
+	sealed, live, err = replacementDeals(db, item, "f01000")
+	assert.NoError(err)
+	assert.False(sealed)
+	assert.True(live)
+
+	assert.NoError(db.Model(repl).Update("sealed_at", time.Now()).Error)
+	sealed, _, err = replacementDeals(db, item, "f01000")
+	assert.NoError(err)
+	assert.True(sealed)
+
+	// retired deals stop counting toward replication
+	deals := withoutRetiredDeals([]contentDeal{*old, {Miner: "f01003", Retired: true}})
+	assert.Len(deals, 1)
+	assert.Equal("f01000", deals[0].Miner)
+
+	cm := &ContentManager{DB: db}
+	maddr, _ := address.NewFromString("f01000")
+
+	st, err := cm.rebalanceStatus(maddr)
+	assert.NoError(err)
+	assert.Nil(st)
+
+	rb := &minerRebalance{Miner: maddr.String()}
+	assert.NoError(db.Create(rb).Error)
+	assert.NoError(db.Create(&[]rebalanceItem{
+		{Rebalance: rb.ID, Content: 1, State: rebalanceDone},
+		{Rebalance: rb.ID, Content: 2, State: rebalancePending, Attempts: 1, Error: "no miners available"},
+		{Rebalance: rb.ID, Content: 3, State: rebalanceFailed, Attempts: 3, Error: "replacement deals failed"},
+		{Rebalance: rb.ID, Content: 4, State: rebalanceSealing},
+	}).Error)
+
+	st, err = cm.rebalanceStatus(maddr)
+	assert.NoError(err)
+	assert.Equal(4, st.Total)
+	assert.Equal(1, st.Done)
+	assert.Equal(1, st.Pending)
+	assert.Equal(1, st.Failed)
+	assert.Equal(1, st.Sealing)
+	assert.Len(st.Problems, 2)
+	assert.Equal(uint(2), st.Problems[0].Content)
+	assert.Equal(uint(3), st.Problems[1].Content)
+}
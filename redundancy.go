@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-metrics-interface"
+	"golang.org/x/xerrors"
+)
+
+// content younger than this is most likely still getting its first deals,
+// being short of its replication isn't a loss yet
+const redundancyGracePeriod = time.Hour * 72
+
+var redundancyWebhookClient = &http.Client{Timeout: time.Second * 30}
+
+// redundancyAlert is a content with fewer sealed deals than its replication
+// target, because deals faulted, expired or were slashed
+type redundancyAlert struct {
+	Content uint   `json:"content"`
+	Cid     string `json:"cid"`
+	Target  int    `json:"target"`
+	// active sealed deals that count toward the target
+	Effective int `json:"effective"`
+	Shortfall int `json:"shortfall"`
+	// deals in progress that may make up some of the shortfall
+	Pending int       `json:"pending"`
+	Since   time.Time `json:"since"`
+}
+
+type redundancyReport struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	// contents checked against their replication target
+	Checked int `json:"checked"`
+	// most short first
+	Alerts []redundancyAlert `json:"alerts"`
+}
+
+// redundancyMonitor keeps the result of the latest check, so that a content
+// is only alerted on again when its shortfall changes
+type redundancyMonitor struct {
+	interval time.Duration
+	webhook  string
+
+	lk   sync.Mutex
+	last *redundancyReport
+
+	shortMetr     metrics.Gauge
+	shortfallMetr metrics.Gauge
+}
+
+func newRedundancyMonitor(interval time.Duration, webhook string) *redundancyMonitor {
+	metCtx := metrics.CtxScope(context.Background(), "content_manager")
+	return &redundancyMonitor{
+		interval:      interval,
+		webhook:       webhook,
+		shortMetr:     metrics.NewCtx(metCtx, "under_replicated_contents", "number of contents with fewer sealed deals than their replication target").Gauge(),
+		shortfallMetr: metrics.NewCtx(metCtx, "replication_shortfall", "sealed deals missing across all under-replicated contents").Gauge(),
+	}
+}
+
+func (rm *redundancyMonitor) report() *redundancyReport {
+	rm.lk.Lock()
+	defer rm.lk.Unlock()
+	return rm.last
+}
+
+// findShortfalls compares the sealed deals of each content against its
+// replication target
+func findShortfalls(contents []Content, target func(Content) int, sealed, pending map[uint]int, now time.Time) []redundancyAlert {
+	var out []redundancyAlert
+	for _, c := range contents {
+		t := target(c)
+		if sealed[c.ID] >= t {
+			continue
+		}
+
+		out = append(out, redundancyAlert{
+			Content:   c.ID,
+			Cid:       c.Cid.CID.String(),
+			Target:    t,
+			Effective: sealed[c.ID],
+			Shortfall: t - sealed[c.ID],
+			Pending:   pending[c.ID],
+			Since:     now,
+		})
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Shortfall > out[j].Shortfall
+	})
+	return out
+}
+
+// changedShortfalls returns the alerts that are new or whose shortfall
+// changed since the previous check, carrying over when the content first
+// fell short, and the contents that are no longer short
+func changedShortfalls(prev *redundancyReport, cur []redundancyAlert) ([]redundancyAlert, []uint) {
+	before := make(map[uint]redundancyAlert)
+	if prev != nil {
+		for _, a := range prev.Alerts {
+			before[a.Content] = a
+		}
+	}
+
+	var changed []redundancyAlert
+	for i, a := range cur {
+		b, ok := before[a.Content]
+		if ok {
+			cur[i].Since = b.Since
+			delete(before, a.Content)
+			if b.Shortfall == a.Shortfall {
+				continue
+			}
+		}
+		changed = append(changed, cur[i])
+	}
+
+	var resolved []uint
+	for c := range before {
+		resolved = append(resolved, c)
+	}
+	sort.Slice(resolved, func(i, j int) bool {
+		return resolved[i] < resolved[j]
+	})
+	return changed, resolved
+}
+
+// runRedundancyMonitor periodically checks every content against its
+// replication target and alerts on those that fell short of it
+func (cm *ContentManager) runRedundancyMonitor(ctx context.Context) {
+	ticker := time.NewTicker(cm.redundancy.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := cm.checkRedundancy(ctx); err != nil {
+			log.Errorf("failed to check content replication: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cm *ContentManager) checkRedundancy(ctx context.Context) error {
+	now := time.Now()
+
+	// aggregated contents are replicated by their aggregate, and the root of
+	// a split dag by its children
+	var contents []Content
+	if err := cm.DB.Where("active AND aggregated_in = 0 AND NOT hot_only AND NOT (dag_split AND split_from = 0) AND created_at < ?", now.Add(-redundancyGracePeriod)).
+		Find(&contents).Error; err != nil {
+		return err
+	}
+
+	var checked []Content
+	for _, c := range contents {
+		if !c.Expired(now) {
+			checked = append(checked, c)
+		}
+	}
+
+	sealed, err := cm.countDealsByContent("NOT failed AND NOT retired AND deal_id > 0 AND sealed_at > ?", time.Unix(1, 0))
+	if err != nil {
+		return err
+	}
+
+	pending, err := cm.countDealsByContent("NOT failed AND NOT retired AND sealed_at < ?", time.Unix(1, 0))
+	if err != nil {
+		return err
+	}
+
+	alerts := findShortfalls(checked, cm.replicationFor, sealed, pending, now)
+
+	rm := cm.redundancy
+	rm.lk.Lock()
+	changed, resolved := changedShortfalls(rm.last, alerts)
+	rep := &redundancyReport{
+		CheckedAt: now,
+		Checked:   len(checked),
+		Alerts:    alerts,
+	}
+	rm.last = rep
+	rm.lk.Unlock()
+
+	var shortfall int
+	for _, a := range alerts {
+		shortfall += a.Shortfall
+	}
+	rm.shortMetr.Set(float64(len(alerts)))
+	rm.shortfallMetr.Set(float64(shortfall))
+
+	for _, a := range changed {
+		log.Warnw("content is below its replication target", "content", a.Content, "cid", a.Cid,
+			"target", a.Target, "effective", a.Effective, "shortfall", a.Shortfall, "pending", a.Pending)
+	}
+	for _, c := range resolved {
+		log.Infow("content is back at its replication target", "content", c)
+	}
+
+	if len(changed) > 0 && rm.webhook != "" {
+		if err := postRedundancyAlerts(ctx, rm.webhook, &redundancyReport{
+			CheckedAt: now,
+			Checked:   len(checked),
+			Alerts:    changed,
+		}); err != nil {
+			log.Errorf("failed to send replication alerts to webhook: %s", err)
+		}
+	}
+	return nil
+}
+
+func (cm *ContentManager) countDealsByContent(where string, args ...interface{}) (map[uint]int, error) {
+	var rows []struct {
+		Content uint
+		Count   int
+	}
+	if err := cm.DB.Model(contentDeal{}).
+		Select("content, count(*) as count").
+		Where(where, args...).
+		Group("content").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	out := make(map[uint]int, len(rows))
+	for _, r := range rows {
+		out[r.Content] = r.Count
+	}
+	return out, nil
+}
+
+// postRedundancyAlerts sends the alerts that changed in a check to the
+// webhook as json
+func postRedundancyAlerts(ctx context.Context, url string, rep *redundancyReport) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := redundancyWebhookClient.Do(req)
+	if err != nil {
+		return xerrors.Errorf("posting to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindShortfalls(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	contents := []Content{{ID: 1}, {ID: 2, Replication: 3}, {ID: 3}, {ID: 4}}
+	target := func(c Content) int {
+		if c.Replication > 0 {
+			return c.Replication
+		}
+		return 6
+	}
+	sealed := map[uint]int{1: 6, 2: 1, 3: 5}
+	pending := map[uint]int{3: 1}
+
+	alerts := findShortfalls(contents, target, sealed, pending, now)
+	assert.Equal([]redundancyAlert{
+		{Content: 4, Cid: contents[3].Cid.CID.String(), Target: 6, Effective: 0, Shortfall: 6, Since: now},
+		{Content: 2, Cid: contents[1].Cid.CID.String(), Target: 3, Effective: 1, Shortfall: 2, Since: now},
+		{Content: 3, Cid: contents[2].Cid.CID.String(), Target: 6, Effective: 5, Shortfall: 1, Pending: 1, Since: now},
+	}, alerts)
+}
+
+func TestChangedShortfalls(t *testing.T) {
+	assert := assert.New(t)
+
+	first := time.Now().Add(-time.Hour)
+	now := time.Now()
+
+	cur := []redundancyAlert{
+		{Content: 1, Shortfall: 2, Since: now},
+		{Content: 2, Shortfall: 1, Since: now},
+	}
+	changed, resolved := changedShortfalls(nil, cur)
+	assert.Len(changed, 2)
+	assert.Empty(resolved)
+
+	prev := &redundancyReport{Alerts: []redundancyAlert{
+		{Content: 1, Shortfall: 2, Since: first},
+		{Content: 2, Shortfall: 2, Since: first},
+		{Content: 3, Shortfall: 1, Since: first},
+	}}
+	cur = []redundancyAlert{
+		{Content: 1, Shortfall: 2, Since: now},
+		{Content: 2, Shortfall: 1, Since: now},
+		{Content: 4, Shortfall: 1, Since: now},
+	}
+	changed, resolved = changedShortfalls(prev, cur)
+
+	// unchanged shortfalls aren't alerted on again
+	assert.Equal([]redundancyAlert{
+		{Content: 2, Shortfall: 1, Since: first},
+		{Content: 4, Shortfall: 1, Since: now},
+	}, changed)
+	assert.Equal([]uint{3}, resolved)
+	assert.Equal(first, cur[0].Since)
+}
+
+func TestPostRedundancyAlerts(t *testing.T) {
+	assert := assert.New(t)
+
+	var got redundancyReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("POST", r.Method)
+		assert.NoError(json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer srv.Close()
+
+	rep := &redundancyReport{
+		Checked: 10,
+		Alerts:  []redundancyAlert{{Content: 1, Target: 6, Effective: 4, Shortfall: 2}},
+	}
+	assert.NoError(postRedundancyAlerts(context.Background(), srv.URL, rep))
+	assert.Equal(10, got.Checked)
+	assert.Equal(rep.Alerts[0].Shortfall, got.Alerts[0].Shortfall)
+
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer fail.Close()
+	assert.Error(postRedundancyAlerts(context.Background(), fail.URL, rep))
+}
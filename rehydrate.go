@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+type rehydrateResult struct {
+	Content    uint   `json:"content"`
+	Cid        string `json:"cid"`
+	ServedBy   string `json:"servedBy"`
+	Size       uint64 `json:"size"`
+	DurationMs int64  `json:"durationMs"`
+
+	Checksum         string `json:"checksum,omitempty"`
+	ChecksumVerified bool   `json:"checksumVerified,omitempty"`
+}
+
+// rehydrateContent brings a content back into the local blockstore from one
+// of its deals, and marks it as stored locally again once all of its dag is
+// there
+func (cm *ContentManager) rehydrateContent(ctx context.Context, content Content) (*rehydrateResult, error) {
+	ctx, span := cm.tracer.Start(ctx, "rehydrateContent", trace.WithAttributes(
+		attribute.Int("content", int(content.ID)),
+	))
+	defer span.End()
+
+	if cm.blockstoreFull(ctx) {
+		return nil, ErrBlockstoreFull
+	}
+
+	start := time.Now()
+	if err := cm.retrieveContent(ctx, content.ID); err != nil {
+		return nil, err
+	}
+
+	root := content.Cid.CID
+	if err := cm.verifyRehydrated(ctx, root); err != nil {
+		return nil, xerrors.Errorf("content %d is not complete after retrieval: %w", content.ID, err)
+	}
+
+	// the retrieval records which miner served it, it may have been started
+	// by another refresh before this one
+	var rec retrievalSuccessRecord
+	if err := cm.DB.Order("id desc").Limit(1).Find(&rec, "content = ?", content.ID).Error; err != nil {
+		return nil, err
+	}
+
+	if err := cm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Content{}).Where("id = ?", content.ID).Update("offloaded", false).Error; err != nil {
+			return err
+		}
+		return tx.Model(&ObjRef{}).Where("content = ?", content.ID).Update("offloaded", 0).Error
+	}); err != nil {
+		return nil, err
+	}
+
+	log.Infow("rehydrated content", "content", content.ID, "miner", rec.Miner, "size", rec.Size, "duration", time.Since(start))
+	return &rehydrateResult{
+		Content:    content.ID,
+		Cid:        root.String(),
+		ServedBy:   rec.Miner,
+		Size:       rec.Size,
+		DurationMs: time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// verifyRehydrated checks that the root block hashes to the content's cid,
+// and that every block of its dag is in the blockstore
+func (cm *ContentManager) verifyRehydrated(ctx context.Context, root cid.Cid) error {
+	blk, err := cm.Blockstore.Get(ctx, root)
+	if err != nil {
+		return xerrors.Errorf("root block missing: %w", err)
+	}
+
+	sum, err := root.Prefix().Sum(blk.RawData())
+	if err != nil {
+		return err
+	}
+
+	if !sum.Equals(root) {
+		return fmt.Errorf("retrieved data does not match root cid %s (got %s)", root, sum)
+	}
+
+	bs := cm.Node.Blockstore
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	return util.WalkDag(ctx, dserv, root, cid.NewSet().Visit, cm.dagWalkConcurrency, nil)
+}
+
+// checksumRehydrated reassembles the content's file from the blockstore and
+// checks it against the checksum taken when it was uploaded
+func (cm *ContentManager) checksumRehydrated(ctx context.Context, content Content) error {
+	bs := cm.Node.Blockstore
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	sum, err := util.ChecksumUnixfsFile(ctx, dserv, content.Cid.CID)
+	if err != nil {
+		return err
+	}
+
+	if sum != content.Checksum {
+		return fmt.Errorf("%w: content %d has checksum %s, expected %s", errChecksumMismatch, content.ID, sum, content.Checksum)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"github.com/application-research/estuary/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/xerrors"
+)
+
+type repairResult struct {
+	Content       uint   `json:"content"`
+	Cid           string `json:"cid"`
+	RecoveredFrom string `json:"recoveredFrom"`
+	DealsRequeued bool   `json:"dealsRequeued"`
+}
+
+// repairContent rebuilds the local copy of a content by retrieving it from
+// one of the miners that has an active deal for it. If remakeDeals is set the
+// content is put back in the queue so that any faulted deals get replaced.
+func (cm *ContentManager) repairContent(ctx context.Context, contID uint, remakeDeals bool) (*repairResult, error) {
+	ctx, span := cm.tracer.Start(ctx, "repairContent", trace.WithAttributes(
+		attribute.Int("content", int(contID)),
+	))
+	defer span.End()
+
+	var content Content
+	if err := cm.DB.First(&content, "id = ?", contID).Error; err != nil {
+		return nil, err
+	}
+
+	if content.Location != "local" {
+		return nil, fmt.Errorf("content %d is stored on %s, only local content can be repaired", contID, content.Location)
+	}
+
+	if cm.blockstoreFull(ctx) {
+		return nil, ErrBlockstoreFull
+	}
+
+	if err := cm.freeSpace.CheckWrite(content.Size); err != nil {
+		return nil, err
+	}
+
+	var deals []contentDeal
+	if err := cm.DB.Find(&deals, "content = ? and not failed and deal_id > 0", contID).Error; err != nil {
+		return nil, err
+	}
+
+	if len(deals) == 0 {
+		return nil, fmt.Errorf("no healthy deals to repair content %d from", contID)
+	}
+
+	root := content.Cid.CID
+	for _, i := range rand.Perm(len(deals)) {
+		maddr, err := deals[i].MinerAddr()
+		if err != nil {
+			log.Errorf("deal %d had bad miner address: %s", deals[i].ID, err)
+			continue
+		}
+
+		cm.connectMinerOverride(ctx, maddr)
+
+		ask, err := cm.retrievalQuery(ctx, maddr, root)
+		if err != nil {
+			cm.recordRetrievalFailure(&util.RetrievalFailureRecord{
+				Miner:   maddr.String(),
+				Phase:   "query",
+				Message: err.Error(),
+				Content: content.ID,
+				Cid:     content.Cid,
+			})
+			continue
+		}
+
+		if err := cm.tryRetrieve(ctx, maddr, content.ID, root, ask); err != nil {
+			log.Errorw("failed to retrieve content for repair", "miner", maddr, "content", contID, "err", err)
+			cm.recordRetrievalFailure(&util.RetrievalFailureRecord{
+				Miner:   maddr.String(),
+				Phase:   "retrieval",
+				Message: err.Error(),
+				Content: content.ID,
+				Cid:     content.Cid,
+			})
+			continue
+		}
+
+		// make sure what we got back is actually the content we asked for
+		blk, err := cm.Blockstore.Get(ctx, root)
+		if err != nil {
+			return nil, xerrors.Errorf("root block missing after retrieval from %s: %w", maddr, err)
+		}
+
+		sum, err := root.Prefix().Sum(blk.RawData())
+		if err != nil {
+			return nil, err
+		}
+
+		if !sum.Equals(root) {
+			return nil, fmt.Errorf("data retrieved from %s does not match root cid %s (got %s)", maddr, root, sum)
+		}
+
+		// a retrieval that ended early leaves the root with parts of the
+		// dag missing, which another miner may still have
+		if err := cm.checkDagComplete(ctx, root); err != nil {
+			log.Errorw("content incomplete after retrieval for repair", "miner", maddr, "content", contID, "err", err)
+			cm.recordRetrievalFailure(&util.RetrievalFailureRecord{
+				Miner:   maddr.String(),
+				Phase:   "verify",
+				Message: err.Error(),
+				Content: content.ID,
+				Cid:     content.Cid,
+			})
+			continue
+		}
+
+		if err := cm.DB.Model(&Content{}).Where("id = ?", contID).Update("offloaded", false).Error; err != nil {
+			return nil, err
+		}
+
+		if err := cm.DB.Model(&ObjRef{}).Where("content = ?", contID).Update("offloaded", 0).Error; err != nil {
+			return nil, err
+		}
+
+		log.Infow("repaired content", "content", contID, "miner", maddr)
+
+		if remakeDeals {
+			cm.queueMgr.add(contID, 0)
+		}
+
+		return &repairResult{
+			Content:       contID,
+			Cid:           root.String(),
+			RecoveredFrom: maddr.String(),
+			DealsRequeued: remakeDeals,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("failed to retrieve content %d from any of its %d deals", contID, len(deals))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient/retrievehelper"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/xerrors"
+)
+
+// longest we wait on one miner when testing the replicas of a content
+const replicaTestTimeout = time.Minute * 2
+
+// deepest a test retrieval goes down the dag
+const replicaTestDepth = 32
+
+// most miners we test at once, so content with many deals doesn't open a
+// retrieval to every one of its miners at the same time
+const replicaTestConcurrency = 8
+
+// replicaTestResult is how one miner with a deal for a content did at serving
+// it back to us
+type replicaTestResult struct {
+	Deal   uint   `json:"deal"`
+	DealID int64  `json:"dealId"`
+	Miner  string `json:"miner"`
+
+	QueryMs     int64  `json:"queryMs"`
+	RetrievalMs int64  `json:"retrievalMs,omitempty"`
+	Bytes       uint64 `json:"bytes,omitempty"`
+	Speed       uint64 `json:"speed,omitempty"` // bytes per second
+
+	Available bool `json:"available"`
+
+	// retrieval protocol versions negotiated with the miner
+	Protocols string `json:"protocols,omitempty"`
+
+	// step the test failed at: protocol, query, price or retrieval.
+	// Replicas we have no protocol in common with or wouldn't pay to test
+	// aren't held against the miner.
+	Phase string `json:"phase,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// the deal was marked as faulted because of the test
+	FaultRecorded bool `json:"faultRecorded,omitempty"`
+}
+
+type replicaTestReport struct {
+	Content  uint                 `json:"content"`
+	Replicas []*replicaTestResult `json:"replicas"`
+
+	// replicas that served the content, the redundancy it really has
+	Available int `json:"available"`
+	Total     int `json:"total"`
+}
+
+// replicaTestSelector selects the root of a dag and the path from it down to
+// its first leaf, enough to show a miner can serve the data without fetching
+// all of it
+func replicaTestSelector() ipldprime.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	return ssb.ExploreRecursive(selector.RecursionLimitDepth(replicaTestDepth),
+		ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Links", ssb.ExploreIndex(0, ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+				efsb.Insert("Hash", ssb.ExploreRecursiveEdge())
+			})))
+		})).Node()
+}
+
+// testReplicas asks every miner with a deal for the content on chain for it,
+// and retrieves a small part of it. With recordFaults, deals whose miner
+// failed to serve the content are marked as faulted so that the content is
+// replicated again and the miner ranks lower.
+func (cm *ContentManager) testReplicas(ctx context.Context, content Content, recordFaults bool) (*replicaTestReport, error) {
+	ctx, span := cm.tracer.Start(ctx, "testReplicas", trace.WithAttributes(
+		attribute.Int64("content", int64(content.ID)),
+	))
+	defer span.End()
+
+	var deals []contentDeal
+	if err := cm.DB.Find(&deals, "content = ? and deal_id > 0 and not failed", content.ID).Error; err != nil {
+		return nil, err
+	}
+
+	report := &replicaTestReport{
+		Content:  content.ID,
+		Replicas: make([]*replicaTestResult, len(deals)),
+		Total:    len(deals),
+	}
+
+	sem := make(chan struct{}, replicaTestConcurrency)
+	var wg sync.WaitGroup
+	for i := range deals {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			report.Replicas[i] = cm.testReplica(ctx, content, &deals[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, res := range report.Replicas {
+		if res.Available {
+			report.Available++
+			continue
+		}
+
+		if !recordFaults || res.Phase == "protocol" || res.Phase == "price" {
+			continue
+		}
+
+		if err := cm.repairDeal(&deals[i], repairReplicaTest); err != nil {
+			log.Errorw("failed to record fault for replica that failed its test", "deal", deals[i].ID, "err", err)
+			continue
+		}
+		res.FaultRecorded = true
+	}
+
+	return report, nil
+}
+
+func (cm *ContentManager) testReplica(ctx context.Context, content Content, d *contentDeal) *replicaTestResult {
+	res := &replicaTestResult{
+		Deal:   d.ID,
+		DealID: d.DealID,
+		Miner:  d.Miner,
+	}
+
+	fail := func(phase string, err error) *replicaTestResult {
+		res.Phase = phase
+		res.Error = err.Error()
+		if phase != "protocol" && phase != "price" {
+			cm.recordRetrievalFailure(&util.RetrievalFailureRecord{
+				Miner:   d.Miner,
+				Phase:   "replica-test-" + phase,
+				Message: err.Error(),
+				Content: content.ID,
+				Cid:     content.Cid,
+			})
+		}
+		return res
+	}
+
+	maddr, err := d.MinerAddr()
+	if err != nil {
+		return fail("query", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, replicaTestTimeout)
+	defer cancel()
+
+	cm.connectMinerOverride(ctx, maddr)
+
+	protos, err := cm.negotiateRetrieval(ctx, maddr)
+	if err != nil {
+		if xerrors.Is(err, errNoCompatibleRetrievalProtocol) {
+			return fail("protocol", err)
+		}
+		return fail("query", err)
+	}
+	res.Protocols = protos.String()
+
+	start := time.Now()
+	ask, err := cm.FilClient.RetrievalQuery(ctx, maddr, content.Cid.CID)
+	res.QueryMs = time.Since(start).Milliseconds()
+	if err != nil {
+		return fail("query", err)
+	}
+
+	if ask.Status != retrievalmarket.QueryResponseAvailable {
+		return fail("query", fmt.Errorf("miner says the content is unavailable: %s", ask.Message))
+	}
+
+	if err := cm.authorizeRetrieval(maddr, costForAsk(ask)); err != nil {
+		return fail("price", err)
+	}
+
+	proposal, err := retrievehelper.RetrievalProposalForAsk(cm.retrievalAskWithPaymentInterval(maddr, ask), content.Cid.CID, replicaTestSelector())
+	if err != nil {
+		return fail("retrieval", err)
+	}
+
+	stats, err := cm.FilClient.RetrieveContent(ctx, maddr, proposal)
+	if err != nil {
+		return fail("retrieval", err)
+	}
+
+	res.Available = true
+	res.RetrievalMs = stats.Duration.Milliseconds()
+	res.Bytes = stats.Size
+	res.Speed = stats.AverageSpeed
+	return res
+}
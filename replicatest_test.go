@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicaTestSelector(t *testing.T) {
+	ctx := context.Background()
+
+	sel := replicaTestSelector()
+	_, err := selector.ParseSelector(sel)
+	require.NoError(t, err)
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	nd, err := util.ImportFile(dserv, io.LimitReader(rand.New(rand.NewSource(3)), 8*1024*1024))
+	require.NoError(t, err)
+
+	// the root and the first link of every node down to the first leaf
+	expected := cid.NewSet()
+	expected.Add(nd.Cid())
+	cur := nd
+	for len(cur.Links()) > 0 {
+		next, err := cur.Links()[0].GetNode(ctx, dserv)
+		require.NoError(t, err)
+		expected.Add(next.Cid())
+		cur = next
+	}
+	require.Greater(t, len(nd.Links()), 2)
+
+	visited := selectedBlocks(t, bs, nd.Cid(), sel)
+	require.Equal(t, expected.Len(), visited.Len())
+	require.NoError(t, expected.ForEach(func(c cid.Cid) error {
+		require.True(t, visited.Has(c))
+		return nil
+	}))
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"math/rand"
+	"os"
 	"sort"
 	"sync"
 	"time"
@@ -27,7 +28,10 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
 	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/paychmgr"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin"
 	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
 	lru "github.com/hashicorp/golang-lru"
 	blocks "github.com/ipfs/go-block-format"
@@ -77,19 +81,144 @@ type ContentManager struct {
 	ToCheck  chan uint
 	queueMgr *queueManager
 
+	// contents sent to ToCheck wait here, highest priority first
+	dealQueue *dealQueue
+
+	transferLimiter *transferLimiter
+
+	aggrMetrics *aggregationMetrics
+
+	// checks for content below its replication target, see
+	// runRedundancyMonitor
+	redundancy *redundancyMonitor
+
+	minerBreakers *minerBreakers
+
 	retrLk               sync.Mutex
 	retrievalsInProgress map[uint]*util.RetrievalProgress
 
+	// held while moving miner rebalances along, see advanceRebalances
+	rebalanceLk sync.Mutex
+
+	// held while recording onboarding stages, see markOnboardingStage
+	onboardingLk sync.Mutex
+
 	contentLk sync.RWMutex
 
 	contentSizeLimit int64
 
+	// rows per insert when recording the objects of pinned content
+	objectBatchSize int
+
+	// nodes fetched at once when walking a dag, see util.WalkDag
+	dagWalkConcurrency int
+
+	// how much of an upload is buffered in memory
+	importLimits util.ImportLimits
+
+	// what the content reaper does with expired content
+	expiryAction string
+
+	aggregateFaultStrategy string
+
+	// closed when shutting down, see Shutdown
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+
+	// stops the transfer events subscribeToTransferEvents subscribed to
+	unsubscribeTransfers func()
+
+	// deals whose proposal is being sent to the miner
+	proposingLk sync.Mutex
+	proposing   map[uint]struct{}
+
+	bsUsageLk         sync.Mutex
+	bsUsage           *blockstoreUsage
+	blockstoreSoftCap int64
+	blockstoreHardCap int64
+
+	// nil if the blockstore isn't a directory we can check
+	freeSpace *util.FreeSpaceGuard
+
 	// Some fields for miner reputation management
 	minerLk      sync.Mutex
 	sortedMiners []address.Address
 	rawData      []*minerDealStats
 	lastComputed time.Time
 
+	minerLatencyLk sync.Mutex
+	minerLatency   map[address.Address]time.Duration
+
+	// network lookups done when ranking miners, see enrichMinerStats
+	minerEnrichLk          sync.Mutex
+	minerEnrich            map[address.Address]*minerEnrichment
+	minerEnrichConcurrency int
+	minerEnrichTimeout     time.Duration
+	minerEnrichTTL         time.Duration
+
+	minerSelection minerSelectionStrategy
+
+	// when set, deal start epochs are computed from the chain head plus this
+	// slack rather than left at filclient's default
+	autoStartEpoch        bool
+	startEpochSlack       abi.ChainEpoch
+	estimatedTransferRate int64
+
+	// see putProposalRecord
+	bumpDuplicateProposals bool
+
+	// whether proposals ask miners to keep an unsealed copy
+	fastRetrieval bool
+
+	// see dealDurationForMiner
+	adjustDealDuration bool
+
+	// see refreshStaleProposal
+	proposalStaleEpochs abi.ChainEpoch
+
+	// see chooseDealTerms
+	verifiedPolicy string
+
+	// see sendProposalWithRetries
+	proposalSendAttempts int
+
+	// see replicationFor
+	replicationMode  string
+	durabilityTarget durabilityTarget
+	replPlans        *lru.Cache
+
+	// see sealEstimate
+	sealEstimates *lru.Cache
+
+	// see workerKey
+	workerKeys *lru.Cache
+
+	// see minSuccessRatioFor
+	minSuccessRatio float64
+
+	// see runSlashMonitor
+	slashCheckInterval time.Duration
+
+	// see runSelectionAuditPruner
+	selectionAuditRetention time.Duration
+
+	// see minerDiversity
+	minerDiversity bool
+	minerIdentLk   sync.Mutex
+	minerIdent     map[address.Address]*minerIdentity
+
+	// see minerDealSizeRange
+	dealSizeTargeting bool
+
+	// signs deal proposals, the node's wallet unless a remote signer is
+	// configured, in which case deals are made from remoteSignerAddr
+	signer           node.Signer
+	remoteSignerAddr address.Address
+	closeSigner      func()
+
+	// labels deal proposals, see applyDealLabel
+	dealLabeler util.DealLabeler
+
 	// deal bucketing stuff
 	bucketLk sync.Mutex
 	buckets  map[uint][]*contentStagingZone
@@ -100,6 +229,9 @@ type ContentManager struct {
 	dealDisabledLk       sync.Mutex
 	isDealMakingDisabled bool
 
+	// paused by an admin, unlike disabling this is kept across restarts
+	dealPause *dealPause
+
 	contentAddingDisabled      bool
 	localContentAddingDisabled bool
 
@@ -116,11 +248,42 @@ type ContentManager struct {
 	shuttles   map[string]*ShuttleConnection
 
 	remoteTransferStatus *lru.ARCCache
+	transferEvents       *transferNotifier
+	transferLog          *transferLogger
 
 	inflightCids   map[cid.Cid]uint
 	inflightCidsLk sync.Mutex
 
 	VerifiedDeal bool
+
+	// retrieval price caps, a nil value means no cap
+	retrievalMaxUnsealPrice   abi.TokenAmount
+	retrievalMaxTransferPrice abi.TokenAmount
+
+	retrievalPaymentInterval uint64
+
+	// nil leaves funding payment channels to filclient, see
+	// fundRetrievalPaych
+	paychFunding *paychFundingStrategy
+	paychMgr     *paychmgr.Manager
+	paychLk      sync.Mutex
+	paychLocks   map[address.Address]*sync.Mutex
+
+	// bytes received between checkpoints of a retrieval, zero disables them
+	retrievalCheckpointBytes uint64
+
+	indexerURL string
+
+	// see targetContentSize
+	dealSizeTargetLk sync.Mutex
+	dealSizeTarget   *dealSizeTarget
+
+	// miners we know of by their libp2p peer ID, for mapping indexer results
+	peerMinersLk      sync.Mutex
+	peerMiners        map[peer.ID]address.Address
+	peerMinersTime    time.Time
+	peerMinersRebuild *peerMinersRebuild
+	minerPeerIDs      map[address.Address]minerPeerID
 }
 
 func (cm *ContentManager) isInflight(c cid.Cid) bool {
@@ -181,6 +344,19 @@ func (cb *contentStagingZone) DeepCopy() *contentStagingZone {
 }
 
 func (cm *ContentManager) newContentStagingZone(user uint, loc string) (*contentStagingZone, error) {
+	// with deal size targeting, aggregates are filled up to what the miners
+	// deals are likely made with prefer
+	maxSize := int64(stagingZoneSizeLimit)
+	if cm.dealSizeTargeting {
+		target, err := cm.targetContentSize(maxSize)
+		if err != nil {
+			return nil, err
+		}
+		if target > 0 {
+			maxSize = target
+		}
+	}
+
 	content := &Content{
 		Size:        0,
 		Name:        "aggregate",
@@ -190,6 +366,7 @@ func (cm *ContentManager) newContentStagingZone(user uint, loc string) (*content
 		Replication: cm.Replication,
 		Aggregate:   true,
 		Location:    loc,
+		Access:      util.ContentAccessOwner,
 	}
 
 	if err := cm.DB.Create(content).Error; err != nil {
@@ -199,8 +376,8 @@ func (cm *ContentManager) newContentStagingZone(user uint, loc string) (*content
 	return &contentStagingZone{
 		ZoneOpened: time.Now(),
 		CloseTime:  time.Now().Add(maxStagingZoneLifetime),
-		MinSize:    int64(stagingZoneSizeLimit - (1 << 30)),
-		MaxSize:    int64(stagingZoneSizeLimit),
+		MinSize:    maxSize - (1 << 30),
+		MaxSize:    maxSize,
 		MaxItems:   maxBucketItems,
 		User:       user,
 		ContID:     content.ID,
@@ -307,6 +484,102 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		return nil, err
 	}
 
+	replPlans, err := lru.New(replicationPlanCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	sealEstimates, err := lru.New(sealEstimateCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	workerKeys, err := lru.New(workerKeyCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	transferLog, err := newTransferLogger(db)
+	if err != nil {
+		return nil, err
+	}
+
+	maxUnseal, err := parseRetrievalPriceCap(cfg.RetrievalConfig.MaxUnsealPrice)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retrieval max unseal price: %w", err)
+	}
+
+	maxTransfer, err := parseRetrievalPriceCap(cfg.RetrievalConfig.MaxTransferPrice)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retrieval max transfer price: %w", err)
+	}
+
+	paychFunding, err := newPaychFundingStrategy(cfg.RetrievalConfig.PaychFunding)
+	if err != nil {
+		return nil, err
+	}
+
+	var paychMgr *paychmgr.Manager
+	if paychFunding != nil {
+		paychMgr = node.NewClientPaychManager(context.TODO(), api, nd.Wallet, nd.Datastore)
+	}
+
+	minerSelection, err := newMinerSelectionStrategy(cfg.DealConfig.MinerSelectionStrategy, cfg.DealConfig.RankByLatency, cfg.DealConfig.RankBySize)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, remoteSignerAddr, closeSigner, err := newDealSigner(context.TODO(), nd, cfg.WalletConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	dealLabeler, err := util.NewDealLabeler(cfg.DealConfig.LabelScheme)
+	if err != nil {
+		return nil, err
+	}
+
+	dealPause, err := loadDealPause(db)
+	if err != nil {
+		return nil, xerrors.Errorf("loading deal pause: %w", err)
+	}
+
+	if err := validExpiryAction(cfg.ContentConfig.ExpiryAction); err != nil {
+		return nil, err
+	}
+
+	if err := validAggregateFaultStrategy(cfg.ContentConfig.AggregateFaultStrategy); err != nil {
+		return nil, err
+	}
+
+	if err := validVerifiedPolicy(cfg.DealConfig.VerifiedPolicy); err != nil {
+		return nil, err
+	}
+
+	if err := validReplicationMode(cfg.DealConfig.ReplicationMode); err != nil {
+		return nil, err
+	}
+
+	if err := validMinSuccessRatio(cfg.DealConfig.MinSuccessRatio); err != nil {
+		return nil, err
+	}
+
+	durability := durabilityTarget{
+		Tolerance:  cfg.DealConfig.DurabilityTolerance,
+		Confidence: cfg.DealConfig.DurabilityConfidence,
+		MaxDeals:   cfg.DealConfig.MaxReplication,
+	}
+	if cfg.DealConfig.ReplicationMode == replicationModeAdaptive {
+		if err := durability.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	importLimits := util.ImportLimits{
+		MaxBlocks: cfg.ContentConfig.ImportBufferBlocks,
+		MaxBytes:  cfg.ContentConfig.ImportBufferBytes,
+	}
+
 	var stages []Content
 	if err := db.Find(&stages, "not active and pinning and aggregate").Error; err != nil {
 		return nil, err
@@ -357,21 +630,79 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		NotifyBlockstore:           nbs,
 		Tracker:                    tbs,
 		ToCheck:                    make(chan uint, 100000),
+		dealQueue:                  newDealQueue(),
 		retrievalsInProgress:       make(map[uint]*util.RetrievalProgress),
 		buckets:                    zones,
 		pinJobs:                    make(map[uint]*pinner.PinningOperation),
 		pinMgr:                     pinmgr,
 		remoteTransferStatus:       cache,
+		transferEvents:             newTransferNotifier(),
+		transferLog:                transferLog,
 		shuttles:                   make(map[string]*ShuttleConnection),
 		contentSizeLimit:           defaultContentSizeLimit,
+		objectBatchSize:            cfg.ContentConfig.ObjectBatchSize,
+		dagWalkConcurrency:         cfg.ContentConfig.DagWalkConcurrency,
+		importLimits:               importLimits,
+		expiryAction:               cfg.ContentConfig.ExpiryAction,
+		aggregateFaultStrategy:     cfg.ContentConfig.AggregateFaultStrategy,
+		shutdownCh:                 make(chan struct{}),
+		unsubscribeTransfers:       func() {},
+		proposing:                  make(map[uint]struct{}),
+		blockstoreSoftCap:          cfg.BlockstoreLimits.SoftCap,
+		blockstoreHardCap:          cfg.BlockstoreLimits.HardCap,
+		freeSpace:                  newFreeSpaceGuard(nd, cfg.ContentConfig),
 		hostname:                   cfg.Hostname,
 		inflightCids:               make(map[cid.Cid]uint),
+		transferLimiter:            newTransferLimiter(cfg.DealConfig.MaxInflightTransfers),
+		aggrMetrics:                newAggregationMetrics(),
+		redundancy:                 newRedundancyMonitor(cfg.DealConfig.RedundancyCheckInterval, cfg.DealConfig.RedundancyAlertWebhook),
+		minerBreakers:              newMinerBreakers(),
+		minerLatency:               make(map[address.Address]time.Duration),
+		minerEnrich:                make(map[address.Address]*minerEnrichment),
+		minerEnrichConcurrency:     defaultMinerEnrichConcurrency,
+		minerEnrichTimeout:         defaultMinerEnrichTimeout,
+		minerEnrichTTL:             defaultMinerEnrichTTL,
+		minerSelection:             minerSelection,
+		autoStartEpoch:             cfg.DealConfig.AutoStartEpoch,
+		bumpDuplicateProposals:     cfg.DealConfig.BumpDuplicateProposals,
+		minerDiversity:             cfg.DealConfig.MinerDiversity,
+		dealSizeTargeting:          cfg.DealConfig.DealSizeTargeting,
+		fastRetrieval:              !cfg.DealConfig.DisableFastRetrieval,
+		adjustDealDuration:         cfg.DealConfig.AdjustDealDuration,
+		proposalStaleEpochs:        abi.ChainEpoch(cfg.DealConfig.ProposalStaleEpochs),
+		verifiedPolicy:             cfg.DealConfig.VerifiedPolicy,
+		replicationMode:            cfg.DealConfig.ReplicationMode,
+		durabilityTarget:           durability,
+		replPlans:                  replPlans,
+		sealEstimates:              sealEstimates,
+		workerKeys:                 workerKeys,
+		proposalSendAttempts:       cfg.DealConfig.ProposalSendAttempts,
+		minerIdent:                 make(map[address.Address]*minerIdentity),
+		startEpochSlack:            abi.ChainEpoch(cfg.DealConfig.StartEpochSlack),
+		estimatedTransferRate:      cfg.DealConfig.EstimatedTransferRate,
+		signer:                     signer,
+		remoteSignerAddr:           remoteSignerAddr,
+		closeSigner:                closeSigner,
+		dealLabeler:                dealLabeler,
+		minSuccessRatio:            cfg.DealConfig.MinSuccessRatio,
+		slashCheckInterval:         cfg.DealConfig.SlashCheckInterval,
+		selectionAuditRetention:    cfg.DealConfig.SelectionAuditRetention,
 		FailDealOnTransferFailure:  cfg.DealConfig.FailOnTransferFailure,
 		isDealMakingDisabled:       cfg.DealConfig.Disable,
+		dealPause:                  dealPause,
 		contentAddingDisabled:      cfg.ContentConfig.DisableGlobalAdding,
 		localContentAddingDisabled: cfg.ContentConfig.DisableLocalAdding,
 		VerifiedDeal:               cfg.DealConfig.Verified,
 		Replication:                cfg.Replication,
+		retrievalMaxUnsealPrice:    maxUnseal,
+		retrievalMaxTransferPrice:  maxTransfer,
+		retrievalPaymentInterval:   cfg.RetrievalConfig.PaymentInterval,
+		paychFunding:               paychFunding,
+		paychMgr:                   paychMgr,
+		paychLocks:                 make(map[address.Address]*sync.Mutex),
+		minerPeerIDs:               make(map[address.Address]minerPeerID),
+		retrievalCheckpointBytes:   cfg.RetrievalConfig.CheckpointInterval,
+		indexerURL:                 cfg.RetrievalConfig.IndexerURL,
 		tracer:                     otel.Tracer("replicator"),
 	}
 	qm := newQueueManager(func(c uint) {
@@ -387,11 +718,20 @@ func (cm *ContentManager) ContentWatcher() {
 		log.Errorf("failed to recheck existing content: %s", err)
 	}
 
+	go cm.feedDealQueue()
+
 	timer := time.NewTimer(time.Minute * 5)
 
 	for {
 		select {
-		case c := <-cm.ToCheck:
+		case <-cm.shutdownCh:
+			return
+		case <-cm.dealQueue.ready:
+			c, ok := cm.dealQueue.pop()
+			if !ok {
+				continue
+			}
+
 			var content Content
 			if err := cm.DB.First(&content, "id = ?", c).Error; err != nil {
 				log.Errorf("finding content %d in database: %s", c, err)
@@ -408,7 +748,7 @@ func (cm *ContentManager) ContentWatcher() {
 			}
 
 		case <-timer.C:
-			log.Infow("content check queue", "length", len(cm.queueMgr.queue.elems), "nextEvent", cm.queueMgr.nextEvent)
+			log.Infow("content check queue", "length", len(cm.queueMgr.queue.elems), "nextEvent", cm.queueMgr.nextEvent, "dealQueue", cm.dealQueue.len())
 
 			/*
 				if err := cm.queueAllContent(); err != nil {
@@ -425,6 +765,8 @@ func (cm *ContentManager) ContentWatcher() {
 				}
 			}
 
+			cm.updateAggregationMetrics(context.TODO())
+
 			timer.Reset(time.Minute * 5)
 		}
 	}
@@ -639,6 +981,10 @@ func (cm *ContentManager) aggregateContent(ctx context.Context, b *contentStagin
 		return xerrors.Errorf("failed to create aggregate: %w", err)
 	}
 
+	if err := cm.recordAggregateLayout(b.ContID, dir, b.Contents); err != nil {
+		return xerrors.Errorf("failed to record aggregate layout: %w", err)
+	}
+
 	ncid := dir.Cid()
 	size, err := dir.Size()
 	if err != nil {
@@ -650,8 +996,10 @@ func (cm *ContentManager) aggregateContent(ctx context.Context, b *contentStagin
 	}
 
 	if err := cm.DB.Model(Content{}).Where("id = ?", b.ContID).UpdateColumns(map[string]interface{}{
-		"cid":  util.DbCID{ncid},
-		"size": size,
+		"cid":               util.DbCID{ncid},
+		"size":              size,
+		"priority":          stagingZonePriority(b),
+		"min_success_ratio": stagingZoneMinSuccessRatio(b),
 	}).Error; err != nil {
 		return err
 	}
@@ -710,7 +1058,7 @@ func (cm *ContentManager) createAggregate(ctx context.Context, conts []Content)
 	log.Info("aggregating contents in staging zone into new content")
 	dir := unixfs.EmptyDirNode()
 	for _, c := range conts {
-		dir.AddRawLink(fmt.Sprintf("%d-%s", c.ID, c.Name), &ipld.Link{
+		dir.AddRawLink(aggregateLinkName(c), &ipld.Link{
 			Size: uint64(c.Size),
 			Cid:  c.Cid.CID,
 		})
@@ -719,6 +1067,12 @@ func (cm *ContentManager) createAggregate(ctx context.Context, conts []Content)
 	return dir, nil
 }
 
+// aggregateLinkName is the name of a content's link in the root directory of
+// the aggregate it is in
+func aggregateLinkName(c Content) string {
+	return fmt.Sprintf("%d-%s", c.ID, c.Name)
+}
+
 func (cm *ContentManager) startup() error {
 	return cm.queueAllContent()
 }
@@ -757,7 +1111,7 @@ func (cm *ContentManager) estimatePrice(ctx context.Context, repl int, size abi.
 	))
 	defer span.End()
 
-	miners, err := cm.pickMiners(ctx, Content{}, repl, size, nil)
+	miners, err := cm.pickMiners(ctx, Content{}, repl, size, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -775,27 +1129,7 @@ func (cm *ContentManager) estimatePrice(ctx context.Context, repl int, size abi.
 
 		asks = append(asks, ask)
 
-		var price *abi.TokenAmount
-		if verified {
-			p, err := ask.GetVerifiedPrice()
-			if err != nil {
-				return nil, err
-			}
-			price = p
-		} else {
-			p, err := ask.GetPrice()
-			if err != nil {
-				return nil, err
-			}
-			price = p
-		}
-
-		dealSize := size
-		if dealSize < ask.MinPieceSize {
-			dealSize = ask.MinPieceSize
-		}
-
-		cost, err := filclient.ComputePrice(*price, dealSize, duration)
+		cost, err := ask.dealCost(size, duration, verified)
 		if err != nil {
 			return nil, err
 		}
@@ -809,6 +1143,27 @@ func (cm *ContentManager) estimatePrice(ctx context.Context, repl int, size abi.
 	}, nil
 }
 
+// dealCost is what a deal of the given size and duration would cost at this
+// ask, accounting for the miner's minimum piece size
+func (msa *minerStorageAsk) dealCost(size abi.PaddedPieceSize, duration abi.ChainEpoch, verified bool) (*abi.TokenAmount, error) {
+	getPrice := msa.GetPrice
+	if verified {
+		getPrice = msa.GetVerifiedPrice
+	}
+
+	price, err := getPrice()
+	if err != nil {
+		return nil, err
+	}
+
+	dealSize := size
+	if dealSize < msa.MinPieceSize {
+		dealSize = msa.MinPieceSize
+	}
+
+	return filclient.ComputePrice(*price, dealSize, duration)
+}
+
 type minerStorageAsk struct {
 	gorm.Model    `json:"-"`
 	Miner         string              `gorm:"unique" json:"miner"`
@@ -850,7 +1205,7 @@ func (cm *ContentManager) pickMinerDist(n int) (int, int) {
 
 const topMinerSel = 15
 
-func (cm *ContentManager) pickMiners(ctx context.Context, cont Content, n int, size abi.PaddedPieceSize, exclude map[address.Address]bool) ([]address.Address, error) {
+func (cm *ContentManager) pickMiners(ctx context.Context, cont Content, n int, size abi.PaddedPieceSize, exclude map[address.Address]bool, audit *selectionAudit) ([]address.Address, error) {
 	ctx, span := cm.tracer.Start(ctx, "pickMiners", trace.WithAttributes(
 		attribute.Int("count", n),
 	))
@@ -864,43 +1219,176 @@ func (cm *ContentManager) pickMiners(ctx context.Context, cont Content, n int, s
 	// give miners more of a chance to prove themselves
 	_, nrand := cm.pickMinerDist(n)
 
+	sortedminers, stats, err := cm.sortedMinerList()
+	if err != nil {
+		return nil, err
+	}
+	audit.setRanking(sortedminers)
+
+	// content that asks for reliable miners only gets deals with those, and
+	// not at all if there aren't enough of them for its replication
+	minRatio := cm.minSuccessRatioFor(cont)
+	ratios := minerSuccessRatios(stats)
+	if minRatio > 0 {
+		sortedminers = qualifyingMiners(sortedminers, ratios, minRatio)
+		if target := cm.replicationFor(cont); len(sortedminers) < target {
+			return nil, fmt.Errorf("only %d miners have a success ratio of at least %.2f, content %d needs %d for its replication", len(sortedminers), minRatio, cont.ID, target)
+		}
+	}
+
+	suspended, err := cm.suspendedMiners()
+	if err != nil {
+		return nil, err
+	}
+
+	unavailable, err := cm.unavailableMiners()
+	if err != nil {
+		return nil, err
+	}
+
 	randminers, err := cm.randomMinerList()
 	if err != nil {
 		return nil, err
 	}
 
-	var out []address.Address
-	for _, m := range randminers {
-		if len(out) >= nrand {
-			break
+	// with deal size targeting, miners whose preferred deal sizes the content
+	// doesn't fit are set aside, and only make up for a shortfall
+	var offsize []address.Address
+	var sizeInfo *minerSizeInfo
+	if cm.dealSizeTargeting {
+		sizeInfo, err = cm.loadMinerSizeInfo(nil)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	// checks a miner against everything but its place in the list, and
+	// notes why it was left out
+	check := func(m address.Address, source string) bool {
+		audit.consider(m, source)
 
 		if exclude[m] {
-			continue
+			audit.filter(m, selectionExcluded, "")
+			return false
 		}
 
 		exclude[m] = true
 
+		if reason, ok := suspended[m]; ok {
+			audit.filter(m, selectionSuspended, reason)
+			return false
+		}
+
+		if ma, ok := unavailable[m]; ok {
+			audit.filter(m, selectionNotAccepting, ma.Reason)
+			return false
+		}
+
+		if minRatio > 0 {
+			if detail, low := successRatioDetail(ratios, m, minRatio); low {
+				audit.filter(m, selectionLowSuccess, detail)
+				return false
+			}
+		}
+
+		if !cm.minerBreakers.available(m) {
+			audit.filter(m, selectionCooldown, breakerDetail(cm.minerBreakers.status(m)))
+			return false
+		}
+
 		ask, err := cm.getAsk(ctx, m, time.Minute*30)
 		if err != nil {
 			log.Errorf("getting ask from %s failed: %s", m, err)
-			continue
+			audit.filter(m, selectionAskFailed, err.Error())
+			return false
+		}
+
+		if !cm.sizeIsCloseEnough(size, ask.MinPieceSize) {
+			audit.filter(m, selectionPieceSize, fmt.Sprintf("piece size %d is not over the miner's minimum of %d", size, ask.MinPieceSize))
+			return false
 		}
 
-		if cm.sizeIsCloseEnough(size, ask.MinPieceSize) {
+		if cm.dealSizeTargeting {
+			r := sizeInfo.rangeFor(m, ask.MinPieceSize, ask.MaxPieceSize)
+			audit.sizeTarget(m, dealSizeTargetDetail(r, size))
+			if !r.fits(size) {
+				offsize = append(offsize, m)
+				return false
+			}
+		}
+		return true
+	}
+
+	fillOffsize := func(out []address.Address) []address.Address {
+		for _, m := range offsize {
+			if len(out) >= n {
+				break
+			}
 			out = append(out, m)
 		}
+		return out
 	}
 
-	sortedminers, _, err := cm.sortedMinerList()
-	if err != nil {
-		return nil, err
+	// content with a deal deadline goes to miners expected to seal in time
+	// first, fastest first, there is no time to give others a chance. The
+	// rest only make up for a shortfall.
+	if cont.hasDealDeadline(time.Now()) {
+		dms, err := cm.deadlineCandidates(cont, sortedminers, exclude)
+		if err != nil {
+			return nil, err
+		}
+
+		var out []address.Address
+		for _, dm := range dms {
+			m, err := address.NewFromString(dm.Miner)
+			if err != nil {
+				continue
+			}
+
+			if len(out) >= n {
+				if !dm.InTime {
+					audit.consider(m, selectionSourceDeadline)
+					audit.filter(m, selectionTooSlow, tooSlowDetail(dm, *cont.DealDeadline))
+				}
+				continue
+			}
+
+			if check(m, selectionSourceDeadline) {
+				out = append(out, m)
+			}
+		}
+		return fillOffsize(out), nil
+	}
+
+	// under the adaptive mode, the miners the content's deal count was
+	// planned with, the rest of the picks make up for any left out
+	var out []address.Address
+	for _, m := range cm.plannedMiners(cont) {
+		if len(out) >= n {
+			break
+		}
+
+		if check(m, selectionSourcePlanned) {
+			out = append(out, m)
+		}
+	}
+
+	for _, m := range randminers {
+		if len(out) >= nrand {
+			break
+		}
+
+		if check(m, selectionSourceRandom) {
+			out = append(out, m)
+		}
 	}
 
 	if len(sortedminers) > topMinerSel {
 		sortedminers = sortedminers[:topMinerSel]
 	}
 
+	// shuffle a copy, lists handed out by sortedMinerList are shared
+	sortedminers = append([]address.Address(nil), sortedminers...)
 	rand.Shuffle(len(sortedminers), func(i, j int) {
 		sortedminers[i], sortedminers[j] = sortedminers[j], sortedminers[i]
 	})
@@ -910,21 +1398,25 @@ func (cm *ContentManager) pickMiners(ctx context.Context, cont Content, n int, s
 			break
 		}
 
-		if exclude[m] {
-			continue
+		if check(m, selectionSourceRanked) {
+			out = append(out, m)
 		}
+	}
 
-		ask, err := cm.getAsk(ctx, m, time.Minute*30)
-		if err != nil {
-			log.Errorf("getting ask from %s failed: %s", m, err)
-			continue
-		}
+	return fillOffsize(out), nil
+}
 
-		if cm.sizeIsCloseEnough(size, ask.MinPieceSize) {
-			out = append(out, m)
-		}
+// suspendedMiners returns the miners we don't make deals with, and why
+func (cm *ContentManager) suspendedMiners() (map[address.Address]string, error) {
+	var dbminers []storageMiner
+	if err := cm.DB.Find(&dbminers, "suspended").Error; err != nil {
+		return nil, err
 	}
 
+	out := make(map[address.Address]string, len(dbminers))
+	for _, dbm := range dbminers {
+		out[dbm.Address.Addr] = dbm.SuspendedReason
+	}
 	return out, nil
 }
 
@@ -966,7 +1458,10 @@ func (cm *ContentManager) getAsk(ctx context.Context, m address.Address, maxCach
 		return &msa, nil
 	}
 
-	netask, err := cm.FilClient.GetAsk(ctx, m)
+	cm.connectMinerOverride(ctx, m)
+
+	askStart := time.Now()
+	netask, err := cm.queryAsk(ctx, m)
 	if err != nil {
 		var clientErr *filclient.Error
 		if !(xerrors.As(err, &clientErr) && clientErr.Code == filclient.ErrLotusError) {
@@ -979,6 +1474,7 @@ func (cm *ContentManager) getAsk(ctx context.Context, m address.Address, maxCach
 		span.RecordError(err)
 		return nil, err
 	}
+	cm.recordMinerLatency(m, time.Since(askStart))
 
 	if err := cm.updateMinerVersion(ctx, m); err != nil {
 		log.Warnf("failed to update miner version: %s", err)
@@ -1066,6 +1562,31 @@ type contentDeal struct {
 
 	OnChainAt time.Time `json:"onChainAt"`
 	SealedAt  time.Time `json:"sealedAt"`
+
+	// whether the proposal asked the miner to keep an unsealed copy
+	FastRetrieval bool `json:"fastRetrieval"`
+
+	// how many times the proposal was sent before the miner got it
+	ProposalAttempts int `json:"proposalAttempts"`
+
+	// why the deal was made verified or not, see chooseDealTerms
+	TermsReason string `json:"termsReason"`
+
+	// set once the deal has been replaced by a deal with another miner, see
+	// minerRebalance. It no longer counts toward replication.
+	Retired   bool      `json:"retired"`
+	RetiredAt time.Time `json:"retiredAt,omitempty"`
+
+	// why the deal failed, only set for slashed deals for now
+	FailedReason string `json:"failedReason,omitempty" gorm:"index"`
+	SlashEpoch   int64  `json:"slashEpoch,omitempty"`
+
+	// the piece size the deal was proposed with, zero for deals made before
+	// it was recorded until backfillDealPieceSizes gets to them
+	PieceSize abi.PaddedPieceSize `json:"pieceSize"`
+	// set by backfillDealPieceSizes for deals whose proposal we don't have,
+	// their piece size stays zero
+	PieceSizeUnknown bool `json:"pieceSizeUnknown,omitempty"`
 }
 
 func (cd contentDeal) MinerAddr() (address.Address, error) {
@@ -1210,6 +1731,12 @@ func (cm *ContentManager) popReadyStagingZone() []*contentStagingZone {
 		cm.buckets[uid] = keep
 	}
 
+	// aggregates of higher priority contents are made, and checked for
+	// deals, first
+	sort.SliceStable(out, func(i, j int) bool {
+		return stagingZonePriority(out[i]) > stagingZonePriority(out[j])
+	})
+
 	return out
 }
 
@@ -1235,16 +1762,30 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 		return nil
 	}
 
-	if cm.contentInStagingZone(ctx, content) {
-		// This content is already scheduled to be aggregated and is waiting in a bucket
+	if content.Expired(time.Now()) {
+		// Expired content doesn't get new or replacement deals
 		return nil
 	}
 
-	// its too big, need to split it up into chunks
-	if content.Size > cm.contentSizeLimit {
-		if err := cm.splitContent(ctx, content, cm.contentSizeLimit); err != nil {
-			return err
-		}
+	if content.HotOnly {
+		// Only pinned until someone promotes it
+		return nil
+	}
+
+	if cm.ShuttingDown() {
+		return nil
+	}
+
+	if cm.contentInStagingZone(ctx, content) {
+		// This content is already scheduled to be aggregated and is waiting in a bucket
+		return nil
+	}
+
+	// its too big, need to split it up into chunks
+	if content.Size > cm.contentSizeLimit {
+		if err := cm.splitContent(ctx, content, cm.contentSizeLimit); err != nil {
+			return err
+		}
 		done(time.Minute * 15)
 		return nil
 	}
@@ -1266,6 +1807,24 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 		return err
 	}
 
+	// with deal size targeting, content bigger than the miners deals are
+	// likely made with prefer is split into pieces they do, if its user
+	// allows splitting
+	if cm.dealSizeTargeting && len(deals) == 0 && !content.Aggregate && content.SplitFrom == 0 && user.FlagSplitContent() {
+		target, err := cm.targetContentSize(cm.contentSizeLimit)
+		if err != nil {
+			return err
+		}
+
+		if target > 0 && content.Size > target {
+			if err := cm.splitContent(ctx, content, target); err != nil {
+				return err
+			}
+			done(time.Minute * 15)
+			return nil
+		}
+	}
+
 	if len(deals) == 0 &&
 		content.Size < int64(individualDealThreshold) &&
 		!content.Aggregate &&
@@ -1277,9 +1836,25 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 		return nil
 	}
 
-	replicationFactor := cm.Replication
-	if content.Replication > 0 {
-		replicationFactor = content.Replication
+	replicationFactor := cm.replicationFor(content)
+
+	hasDeadline := content.hasDealDeadline(time.Now())
+	var deadlineRep *dealDeadlineReport
+	if hasDeadline {
+		rep, err := cm.dealDeadlineReport(content)
+		if err != nil {
+			return err
+		}
+		deadlineRep = rep
+
+		if !rep.Achievable {
+			log.Warnw("content can't be replicated by its deal deadline", "content", content.ID, "deadline", rep.Deadline,
+				"replication", rep.Replication, "sealed", rep.Sealed, "inTime", rep.InTime, "candidates", len(rep.Candidates), "reducedTo", rep.ReducedTo)
+		}
+
+		if rep.ReducedTo > 0 {
+			replicationFactor = rep.ReducedTo
+		}
 	}
 
 	minersAlready := make(map[address.Address]bool)
@@ -1296,6 +1871,9 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 		minersAlready[maddr] = true
 	}
 
+	// retired deals are left alone, but we don't go back to their miners
+	deals = withoutRetiredDeals(deals)
+
 	// check on each of the existing deals, see if they need fixing
 	var countLk sync.Mutex
 	var numSealed, numPublished, numProgress int
@@ -1322,7 +1900,11 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 			defer countLk.Unlock()
 			switch status {
 			case DEAL_CHECK_UNKNOWN, DEAL_NEARLY_EXPIRED:
-				if err := cm.repairDeal(&d); err != nil {
+				reason := repairFaulted
+				if status == DEAL_NEARLY_EXPIRED {
+					reason = repairExpiring
+				}
+				if err := cm.repairDeal(&d, reason); err != nil {
 					errs[i] = xerrors.Errorf("repairing deal failed: %w", err)
 					return
 				}
@@ -1332,6 +1914,8 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 				numPublished++
 			case DEAL_CHECK_PROGRESS:
 				numProgress++
+			case DEAL_CHECK_SLASHED:
+				// already failed, new deals are made to replace it below
 			default:
 				log.Errorf("unrecognized deal check status: %d", status)
 			}
@@ -1376,7 +1960,7 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 
 		if content.Offloaded {
 			go func() {
-				if err := cm.RefreshContent(context.Background(), content.ID); err != nil {
+				if _, err := cm.RefreshContent(context.Background(), content.ID); err != nil {
 					log.Errorf("failed to retrieve content in need of repair %d: %s", content.ID, err)
 				}
 
@@ -1392,9 +1976,17 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 			return nil
 		}
 
-		// only verified deals need datacap checks
-		if verified {
-			bl, err := cm.FilClient.Balance(ctx)
+		// checked again as soon as deal making resumes
+		if cm.dealPause.deferContent(content.ID, content.Priority) {
+			log.Infow("deal making is paused, deferring content", "content", content.ID)
+			done(time.Minute * 60)
+			return nil
+		}
+
+		// only verified deals need datacap checks, with the per-miner policy
+		// deals are paid for once datacap runs out instead
+		if verified && cm.verifiedPolicy != verifiedPolicyPerMiner {
+			bl, err := cm.dealBalance(ctx)
 			if err != nil {
 				return errors.Wrap(err, "could not retrieve dataCap from client balance")
 			}
@@ -1405,19 +1997,52 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content Content, do
 			}
 		}
 
+		newDeals := replicationFactor - len(deals)
+		if hasDeadline {
+			// spare deals so that the ones running late don't miss the
+			// deadline
+			newDeals = deadlineDeals(newDeals, deadlineRep.Late)
+		}
+
+		slots, err := userDealSlots(cm.DB, content.UserID)
+		if err != nil {
+			return err
+		}
+
+		// users at their limit of concurrent deals wait for some to publish
+		if slots == 0 {
+			log.Infow("user is at their concurrent deal limit, waiting", "content", content.ID, "user", content.UserID)
+			done(time.Minute * 30)
+			return nil
+		}
+		if slots > 0 && newDeals > slots {
+			newDeals = slots
+		}
+
 		go func() {
 			// make some more deals!
-			log.Infow("making more deals for content", "content", content.ID, "curDealCount", len(deals), "newDeals", replicationFactor-len(deals))
-			if err := cm.makeDealsForContent(ctx, content, replicationFactor-len(deals), minersAlready, verified); err != nil {
+			log.Infow("making more deals for content", "content", content.ID, "curDealCount", len(deals), "newDeals", newDeals)
+			if err := cm.makeDealsForContent(ctx, content, newDeals, minersAlready, verified); err != nil {
 				log.Errorf("failed to make more deals: %s", err)
 			}
-			done(time.Minute * 10)
+			if hasDeadline {
+				done(deadlineCheckInterval)
+			} else {
+				done(time.Minute * 10)
+			}
 		}()
 		return nil
 	}
 
 	if numSealed >= replicationFactor {
+		// content proposed before the stages were recorded never gets the
+		// later ones, don't try again on every check
+		if content.ReplicatedAt == nil && content.FirstDealProposedAt != nil {
+			cm.recordOnboardingStage(content.ID, onboardingReplicated)
+		}
 		done(time.Hour * 24)
+	} else if hasDeadline {
+		done(deadlineCheckInterval)
 	} else if numSealed+numPublished >= replicationFactor {
 		done(time.Hour)
 	} else {
@@ -1468,6 +2093,7 @@ const (
 	DEAL_CHECK_DEALID_ON_CHAIN
 	DEAL_CHECK_SECTOR_ON_CHAIN
 	DEAL_NEARLY_EXPIRED
+	DEAL_CHECK_SLASHED
 )
 
 const minSafeDealLifetime = (2880 * 21) // three weeks
@@ -1498,12 +2124,10 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 
 		if deal.State.SlashEpoch > 0 {
 			// Deal slashed!
-			cm.recordDealFailure(&DealFailureError{
-				Miner:   maddr,
-				Phase:   "check-chain-deal",
-				Message: fmt.Sprintf("deal %d was slashed at epoch %d", d.DealID, deal.State.SlashEpoch),
-			})
-			return DEAL_CHECK_UNKNOWN, nil
+			if err := cm.handleSlashedDeal(d, deal.State.SlashEpoch); err != nil {
+				return DEAL_CHECK_UNKNOWN, xerrors.Errorf("handling slashed deal: %w", err)
+			}
+			return DEAL_CHECK_SLASHED, nil
 		}
 
 		head, err := cm.Api.ChainHead(ctx)
@@ -1519,6 +2143,7 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumn("sealed_at", time.Now()).Error; err != nil {
 				return DEAL_CHECK_UNKNOWN, err
 			}
+			cm.recordOnboardingStage(d.Content, onboardingSealed)
 			return DEAL_CHECK_SECTOR_ON_CHAIN, nil
 		}
 
@@ -1547,7 +2172,7 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 
 	var provds *storagemarket.ProviderDealState
 	if err == nil {
-		provds, err = cm.FilClient.DealStatus(subctx, maddr, d.PropCid.CID, dealUUID)
+		provds, err = cm.dealStatus(subctx, maddr, d.PropCid.CID, dealUUID)
 	}
 	if err != nil {
 		log.Warnf("failed to check deal status for deal %s with miner %s: %s", statusCheckID, maddr, err)
@@ -1598,7 +2223,14 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			return DEAL_CHECK_UNKNOWN, xerrors.Errorf("failed to look up piece commitment for content: %w", err)
 		}
 
-		if deal.Proposal.Provider != maddr || deal.Proposal.PieceCID != pcr.Piece.CID {
+		// deals padded up to a larger piece than the content's carry the
+		// commitment of the padded piece, which is in our proposal
+		pieceCid := pcr.Piece.CID
+		if prop, err := cm.getProposalRecord(d.PropCid.CID); err == nil {
+			pieceCid = prop.Proposal.PieceCID
+		}
+
+		if deal.Proposal.Provider != maddr || deal.Proposal.PieceCID != pieceCid {
 			log.Errorf("proposal in deal ID miner sent back did not match our expectations")
 			return DEAL_CHECK_UNKNOWN, nil
 		}
@@ -1741,6 +2373,11 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			}).Error; err != nil {
 				return DEAL_CHECK_UNKNOWN, err
 			}
+			cm.recordOnboardingStage(content.ID, onboardingTransferred)
+
+			if content.Aggregate {
+				log.Infow("aggregate transfer finished", "aggregate", content.ID, "deal", d.ID, "miner", maddr, "size", content.Size)
+			}
 		}
 
 		// these are all okay
@@ -1759,6 +2396,9 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 		}
 		*/
 		// expected, this is fine
+		if content.Aggregate {
+			log.Infow("aggregate transfer in progress", "aggregate", content.ID, "deal", d.ID, "miner", maddr, "sent", status.Sent, "size", content.Size)
+		}
 	default:
 		fmt.Printf("Unexpected data transfer state: %d (msg = %s)\n", status.Status, status.Message)
 	}
@@ -1834,6 +2474,10 @@ func (cm *ContentManager) updateTransferStatus(ctx context.Context, loc string,
 		Shuttle:  loc,
 		Received: time.Now(),
 	})
+	cm.transferEvents.notify(dealdbid)
+	if st != nil {
+		cm.transferLog.recordStatus(dealdbid, st.TransferID, st)
+	}
 }
 
 func (cm *ContentManager) getLocalTransferStatus(ctx context.Context, d *contentDeal, content *Content) (*filclient.ChannelState, error) {
@@ -1893,12 +2537,12 @@ func (cm *ContentManager) getDealID(ctx context.Context, pubcid cid.Cid, d *cont
 
 	dealix := -1
 	for i, pd := range params.Deals {
-		nd, err := cborutil.AsIpld(&pd)
+		pc, err := util.ProposalCid(&pd)
 		if err != nil {
-			return 0, xerrors.Errorf("failed to compute deal proposal ipld node: %w", err)
+			return 0, err
 		}
 
-		if nd.Cid() == d.PropCid.CID {
+		if pc == d.PropCid.CID {
 			dealix = i
 			break
 		}
@@ -1924,8 +2568,22 @@ func (cm *ContentManager) getDealID(ctx context.Context, pubcid cid.Cid, d *cont
 	return retval.IDs[dealix], nil
 }
 
-func (cm *ContentManager) repairDeal(d *contentDeal) error {
-	if d.DealID != 0 {
+// Why a deal is given up on and replaced, see repairDeal
+const (
+	// the deal is gone from chain, or never made it there
+	repairFaulted = "faulted"
+	// the deal is about to end, the content needs a new one to stay stored
+	repairExpiring = "expiring"
+	// the miner failed to serve the content back when we tested it
+	repairReplicaTest = "replica-test"
+)
+
+// repairDeal marks a deal as failed so that the content gets a new one in its
+// place. Only deals that faulted count against the miner and, for
+// aggregates, against the members of the aggregate.
+func (cm *ContentManager) repairDeal(d *contentDeal, reason string) error {
+	faulted := reason == repairFaulted && d.DealID != 0
+	if faulted {
 		log.Infow("miner faulted on deal", "deal", d.DealID, "content", d.Content, "miner", d.Miner)
 		maddr, err := d.MinerAddr()
 		if err != nil {
@@ -1939,7 +2597,7 @@ func (cm *ContentManager) repairDeal(d *contentDeal) error {
 			Content: d.Content,
 		})
 	}
-	log.Infow("repair deal", "propcid", d.PropCid.CID, "miner", d.Miner, "content", d.Content)
+	log.Infow("repair deal", "propcid", d.PropCid.CID, "miner", d.Miner, "content", d.Content, "reason", reason)
 	if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumns(map[string]interface{}{
 		"failed":    true,
 		"failed_at": time.Now(),
@@ -1947,6 +2605,13 @@ func (cm *ContentManager) repairDeal(d *contentDeal) error {
 		return err
 	}
 
+	if faulted {
+		// if this was an aggregate, every content in it just lost a deal too
+		if err := cm.handleAggregateFault(d); err != nil {
+			return xerrors.Errorf("recording aggregate fault: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -1975,11 +2640,59 @@ func (cm *ContentManager) priceIsTooHigh(price abi.TokenAmount, verified bool) b
 	return false
 }
 
+// proposalRecord holds the signed proposal sent to a miner, keyed by its
+// proposal cid. Proposals are kept in the database rather than as individual
+// files, lookups go through the prop_cid index.
 type proposalRecord struct {
 	PropCid util.DbCID `gorm:"index"`
 	Data    []byte
 }
 
+// activeDealsForContent returns the deals for a content that have not failed,
+// whether they are still in progress or already on chain
+func (cm *ContentManager) activeDealsForContent(contID uint) ([]contentDeal, error) {
+	var deals []contentDeal
+	if err := cm.DB.Find(&deals, "content = ? and not failed", contID).Error; err != nil {
+		return nil, err
+	}
+	return deals, nil
+}
+
+// withoutRetiredDeals filters out the deals that no longer count toward
+// replication
+func withoutRetiredDeals(deals []contentDeal) []contentDeal {
+	out := make([]contentDeal, 0, len(deals))
+	for _, d := range deals {
+		if !d.Retired {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// withoutDealMiners filters out the miners that are already party to one of
+// the given deals
+func withoutDealMiners(miners []address.Address, deals []contentDeal) []address.Address {
+	have := make(map[address.Address]bool)
+	for _, d := range deals {
+		maddr, err := d.MinerAddr()
+		if err != nil {
+			continue
+		}
+		have[maddr] = true
+	}
+
+	out := make([]address.Address, 0, len(miners))
+	for _, m := range miners {
+		if have[m] {
+			log.Debugw("skipping miner that already has a deal for content", "miner", m)
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
 func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Content, count int, exclude map[address.Address]bool, verified bool) error {
 	ctx, span := cm.tracer.Start(ctx, "makeDealsForContent", trace.WithAttributes(
 		attribute.Int64("content", int64(content.ID)),
@@ -1995,21 +2708,95 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 		return fmt.Errorf("cannot make more deals for offloaded content, must retrieve first")
 	}
 
+	if content.AggregatedIn > 0 {
+		return fmt.Errorf("content %d is aggregated in %d, deals are made for the whole aggregate", content.ID, content.AggregatedIn)
+	}
+
 	_, _, size, err := cm.getPieceCommitment(ctx, content.Cid.CID, cm.Blockstore)
 	if err != nil {
 		return xerrors.Errorf("failed to compute piece commitment while making deals %d: %w", content.ID, err)
 	}
 
-	minerpool, err := cm.pickMiners(ctx, content, count*2, size.Padded(), exclude)
+	poolSize := count * 2
+	if cm.minerDiversity {
+		// some of the pool will be skipped for sharing an operator with
+		// another pick, look further down the list to make up for it
+		poolSize = count * 4
+	}
+
+	audit := newSelectionAudit(content.ID, count, verified)
+	defer func() {
+		if err := audit.save(cm.DB); err != nil {
+			log.Errorw("failed to record miner selection", "content", content.ID, "err", err)
+		}
+	}()
+
+	minerpool, err := cm.pickMiners(ctx, content, poolSize, size.Padded(), exclude, audit)
 	if err != nil {
 		return err
 	}
 
+	// the exclude list may be stale by now, check again so that we never end
+	// up with two deals for this content with the same miner
+	existing, err := cm.activeDealsForContent(content.ID)
+	if err != nil {
+		return err
+	}
+	pool := withoutDealMiners(minerpool, existing)
+	audit.filterDropped(minerpool, pool, selectionExcluded, "already has an active deal for the content")
+	minerpool = pool
+
+	var diversity *minerDiversity
+	if cm.minerDiversity {
+		diversity = cm.newMinerDiversity(ctx, existing)
+	}
+
+	// with the per-miner policy every verified replica draws on our datacap,
+	// the rest fall back to paid deals once it runs out
+	var datacap *big.Int
+	if verified && cm.verifiedPolicy == verifiedPolicyPerMiner {
+		dc := big.Zero()
+		bl, err := cm.dealBalance(ctx)
+		if err != nil {
+			log.Warnw("failed to get datacap balance, making paid deals", "content", content.ID, "err", err)
+		} else if bl.VerifiedClientBalance != nil {
+			dc = *bl.VerifiedClientBalance
+		}
+		datacap = &dc
+	}
+
 	var asks []*network.AskResponse
 	var ms []address.Address
+	var durations []abi.ChainEpoch
+	var pieceSizes []abi.PaddedPieceSize
+	var terms []dealTerms
 	var successes int
+	var sizeInfo *minerSizeInfo
+	if cm.dealSizeTargeting {
+		sizeInfo, err = cm.loadMinerSizeInfo(minerpool)
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, m := range minerpool {
-		ask, err := cm.FilClient.GetAsk(ctx, m)
+		if diversity != nil {
+			if other, group, ok := diversity.conflict(ctx, m); ok {
+				log.Infow("skipping miner that shares a group with another replica", "miner", m, "other", other, "group", group, "content", content.ID)
+				audit.filter(m, selectionDiversity, fmt.Sprintf("shares %s with %s", group, other))
+				continue
+			}
+		}
+
+		if !cm.minerBreakers.allow(m) {
+			audit.filter(m, selectionCooldown, breakerDetail(cm.minerBreakers.status(m)))
+			continue
+		}
+
+		cm.connectMinerOverride(ctx, m)
+
+		askStart := time.Now()
+		ask, err := cm.queryAsk(ctx, m)
 		if err != nil {
 			var clientErr *filclient.Error
 			if !(xerrors.As(err, &clientErr) && clientErr.Code == filclient.ErrLotusError) {
@@ -2021,52 +2808,115 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 				})
 			}
 			log.Warnf("failed to get ask for miner %s: %s\n", m, err)
+			audit.filter(m, selectionAskFailed, err.Error())
 			continue
 		}
+		cm.recordMinerLatency(m, time.Since(askStart))
+
+		// with deal size targeting the piece is padded up to the smallest
+		// size the miner prefers
+		var target abi.PaddedPieceSize
+		if cm.dealSizeTargeting {
+			r := sizeInfo.rangeFor(m, ask.Ask.Ask.MinPieceSize, ask.Ask.Ask.MaxPieceSize)
+			target = dealPieceTarget(r, size.Padded())
+		}
 
-		price := ask.Ask.Ask.Price
-		if verified {
-			price = ask.Ask.Ask.VerifiedPrice
+		// the piece gets padded up to the miner's minimum, and that's what
+		// a verified deal takes out of our datacap
+		pieceSize, err := dealPieceSize(size, target, ask.Ask.Ask.MinPieceSize, 0)
+		if err != nil {
+			// a configured preference the ask doesn't allow
+			target = 0
+			pieceSize, _ = dealPieceSize(size, 0, ask.Ask.Ask.MinPieceSize, 0)
+		}
+
+		dt, err := cm.chooseDealTerms(ask.Ask.Ask, pieceSize, datacap)
+		if err != nil {
+			log.Infow("miners price is too high", "miner", m, "price", dt.Price, "verified", dt.Verified)
+			audit.filter(m, selectionPrice, err.Error())
+			cm.minerBreakers.release(m)
+			cm.recordDealFailure(&DealFailureError{
+				Miner:   m,
+				Phase:   "miner-search",
+				Message: err.Error(),
+				Content: content.ID,
+			})
+			continue
 		}
 
-		if cm.priceIsTooHigh(price, verified) {
-			log.Infow("miners price is too high", "miner", m, "price", price)
+		dur, err := cm.dealDurationForMiner(m, size.Padded())
+		if err != nil {
+			log.Infow("deal duration not accepted by miner", "miner", m, "err", err)
+			audit.filter(m, selectionDuration, err.Error())
+			cm.minerBreakers.release(m)
 			cm.recordDealFailure(&DealFailureError{
 				Miner:   m,
 				Phase:   "miner-search",
-				Message: fmt.Sprintf("miners price is too high: %s (verified = %v)", types.FIL(price), verified),
+				Message: err.Error(),
 				Content: content.ID,
 			})
 			continue
 		}
 
+		detail := dealTermsDetail(dt)
+		if target != 0 {
+			detail += ", " + paddedPieceDetail(target)
+		}
+		audit.selected(m, detail)
 		ms = append(ms, m)
 		asks = append(asks, ask)
+		pieceSizes = append(pieceSizes, pieceSize)
+		durations = append(durations, dur)
+		terms = append(terms, dt)
+		if dt.Verified && datacap != nil {
+			*datacap = big.Sub(*datacap, big.NewIntUnsigned(uint64(pieceSize)))
+		}
 		successes++
+		if diversity != nil {
+			diversity.add(ctx, m)
+		}
 		if len(ms) >= count {
 			break
 		}
 	}
 
+	head, err := cm.Api.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("failed to get chain head: %w", err)
+	}
+	builtAt := head.Height()
+
 	proposals := make([]*network.Proposal, len(ms))
 	for i, m := range ms {
 		if asks[i] == nil {
 			continue
 		}
 
-		price := asks[i].Ask.Ask.Price
-		if verified {
-			price = asks[i].Ask.Ask.VerifiedPrice
-		}
+		log.Infow("deal terms chosen", "content", content.ID, "miner", m, "verified", terms[i].Verified, "reason", terms[i].Reason)
 
-		prop, err := cm.FilClient.MakeDeal(ctx, m, content.Cid.CID, price, asks[i].Ask.Ask.MinPieceSize, dealDuration, verified)
+		prop, err := cm.FilClient.MakeDeal(ctx, m, content.Cid.CID, terms[i].Price, pieceSizes[i], durations[i], terms[i].Verified)
 		if err != nil {
 			return xerrors.Errorf("failed to construct a deal proposal: %w", err)
 		}
+		prop.FastRetrieval = cm.fastRetrieval
+
+		if err := cm.applyRemoteSigner(ctx, prop.DealProposal); err != nil {
+			return xerrors.Errorf("failed to sign deal proposal: %w", err)
+		}
+
+		if err := cm.applyDealLabel(ctx, prop.DealProposal, content); err != nil {
+			return xerrors.Errorf("failed to label deal proposal: %w", err)
+		}
+
+		if cm.autoStartEpoch {
+			if err := cm.applyAutoStartEpoch(ctx, prop.DealProposal, content.Size); err != nil {
+				return xerrors.Errorf("failed to set deal start epoch: %w", err)
+			}
+		}
 
 		proposals[i] = prop
 
-		if err := cm.putProposalRecord(prop.DealProposal); err != nil {
+		if err := cm.putProposalRecord(ctx, prop.DealProposal); err != nil {
 			return err
 		}
 	}
@@ -2078,8 +2928,37 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 			continue
 		}
 
+		// wait for a transfer slot so we don't start more transfers than we can handle
+		releaseSlot, err := cm.waitForTransferSlot(ctx, content.Priority)
+		if err != nil {
+			return xerrors.Errorf("waiting for transfer slot: %w", err)
+		}
+
+		// deal making may have been paused while we waited, the proposals
+		// already sent go ahead but no more are sent
+		if cm.dealPause.deferContent(content.ID, content.Priority) {
+			releaseSlot()
+			log.Infow("deal making was paused, not sending the remaining proposals", "content", content.ID)
+			break
+		}
+
+		// the wait for a slot can be long enough for the proposal to go stale
+		refreshed, err := cm.refreshStaleProposal(ctx, p.DealProposal, builtAt)
+		if err != nil {
+			releaseSlot()
+			return xerrors.Errorf("failed to refresh stale deal proposal: %w", err)
+		}
+
+		if refreshed {
+			if err := cm.putProposalRecord(ctx, p.DealProposal); err != nil {
+				releaseSlot()
+				return err
+			}
+		}
+
 		proto, err := cm.FilClient.DealProtocolForMiner(ctx, ms[i])
 		if err != nil {
+			releaseSlot()
 			cm.recordDealFailure(&DealFailureError{
 				Miner:   ms[i],
 				Phase:   "send-proposal",
@@ -2089,36 +2968,52 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 			continue
 		}
 
-		propnd, err := cborutil.AsIpld(p.DealProposal)
+		propCid, err := util.ProposalCid(p.DealProposal)
 		if err != nil {
-			return xerrors.Errorf("failed to compute deal proposal ipld node: %w", err)
+			releaseSlot()
+			return err
 		}
 
 		dealUUID := uuid.New()
 		cd := &contentDeal{
-			Content:  content.ID,
-			PropCid:  util.DbCID{propnd.Cid()},
-			DealUUID: dealUUID.String(),
-			Miner:    ms[i].String(),
-			Verified: verified,
-		}
-
-		if err := cm.DB.Create(cd).Error; err != nil {
+			Content:       content.ID,
+			PropCid:       util.DbCID{propCid},
+			DealUUID:      dealUUID.String(),
+			Miner:         ms[i].String(),
+			Verified:      terms[i].Verified,
+			TermsReason:   terms[i].Reason,
+			FastRetrieval: p.FastRetrieval,
+			PieceSize:     p.DealProposal.Proposal.PieceSize,
+		}
+
+		err = cm.DB.Create(cd).Error
+		// the new deal counts towards the in-flight transfers from here on
+		releaseSlot()
+		if err != nil {
 			return xerrors.Errorf("failed to create database entry for deal: %w", err)
 		}
 
 		// Send the deal proposal to the storage provider
+		proposalDone := cm.trackProposal(cd.ID)
 		var cleanupDealPrep func() error
 		var propPhase bool
 		isPushTransfer := proto == filclient.DealProtocolv110
 		switch proto {
 		case filclient.DealProtocolv110:
-			propPhase, err = cm.FilClient.SendProposalV110(ctx, *p, propnd.Cid())
+			propPhase, cd.ProposalAttempts, err = cm.sendProposalWithRetries(ctx, ms[i], func() (bool, error) {
+				propStart := time.Now()
+				propPhase, err := cm.FilClient.SendProposalV110(ctx, *p, propCid)
+				if err == nil {
+					cm.recordMinerLatency(p.DealProposal.Proposal.Provider, time.Since(propStart))
+				}
+				return propPhase, err
+			})
 		case filclient.DealProtocolv120:
-			cleanupDealPrep, propPhase, err = cm.sendProposalV120(ctx, content.Location, *p, propnd.Cid(), dealUUID, cd.ID)
+			cleanupDealPrep, propPhase, cd.ProposalAttempts, err = cm.sendProposalV120(ctx, content.Location, *p, propCid, dealUUID, cd.ID)
 		default:
 			err = fmt.Errorf("unrecognized deal protocol %s", proto)
 		}
+		proposalDone()
 
 		if err != nil {
 			// Clean up the database entry
@@ -2147,6 +3042,11 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 			continue
 		}
 
+		cm.minerBreakers.success(ms[i])
+		cm.recordMinerAccepting(ms[i])
+		cm.saveProposalAttempts(cd)
+		cm.recordOnboardingStage(content.ID, onboardingProposed)
+
 		responses[i] = &isPushTransfer
 		deals[i] = cd
 	}
@@ -2182,7 +3082,7 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content Conte
 	return nil
 }
 
-func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc string, netprop network.Proposal, propCid cid.Cid, dealUUID uuid.UUID, dbid uint) (func() error, bool, error) {
+func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc string, netprop network.Proposal, propCid cid.Cid, dealUUID uuid.UUID, dbid uint) (func() error, bool, int, error) {
 	// In deal protocol v120 the transfer will be initiated by the
 	// storage provider (a pull transfer) so we need to prepare for
 	// the data request
@@ -2190,7 +3090,7 @@ func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc strin
 	// Create an auth token to be used in the request
 	authToken, err := httptransport.GenerateAuthToken()
 	if err != nil {
-		return nil, false, xerrors.Errorf("generating auth token for deal: %w", err)
+		return nil, false, 0, xerrors.Errorf("generating auth token for deal: %w", err)
 	}
 
 	rootCid := netprop.Piece.Root
@@ -2198,24 +3098,24 @@ func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc strin
 	var announceAddr multiaddr.Multiaddr
 	if contentLoc == "local" {
 		if len(cm.Node.Config.AnnounceAddrs) == 0 {
-			return nil, false, xerrors.Errorf("cannot serve deal data: no announce address configured")
+			return nil, false, 0, xerrors.Errorf("cannot serve deal data: no announce address configured")
 		}
 
 		addrstr := cm.Node.Config.AnnounceAddrs[0] + "/p2p/" + cm.Node.Host.ID().String()
 		announceAddr, err = multiaddr.NewMultiaddr(addrstr)
 		if err != nil {
-			return nil, false, xerrors.Errorf("cannot parse announce address '%s': %w", addrstr, err)
+			return nil, false, 0, xerrors.Errorf("cannot parse announce address '%s': %w", addrstr, err)
 		}
 
 		// Add an auth token for the data to the auth DB
 		err := cm.FilClient.Libp2pTransferMgr.PrepareForDataRequest(ctx, dbid, authToken, propCid, rootCid, size)
 		if err != nil {
-			return nil, false, xerrors.Errorf("preparing for data request: %w", err)
+			return nil, false, 0, xerrors.Errorf("preparing for data request: %w", err)
 		}
 	} else {
 		// first check if shuttle is online
 		if !cm.shuttleIsOnline(contentLoc) {
-			return nil, false, xerrors.Errorf("shuttle is not online: %s", contentLoc)
+			return nil, false, 0, xerrors.Errorf("shuttle is not online: %s", contentLoc)
 		}
 
 		addrInfo := cm.shuttleAddrInfo(contentLoc)
@@ -2225,12 +3125,12 @@ func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc strin
 		// that mean that messages from Estuary primary node would go through
 		// public internet to get to shuttle?
 		if addrInfo == nil || len(addrInfo.Addrs) == 0 {
-			return nil, false, xerrors.Errorf("no address found for shuttle: %s", contentLoc)
+			return nil, false, 0, xerrors.Errorf("no address found for shuttle: %s", contentLoc)
 		}
 		addrstr := addrInfo.Addrs[0].String() + "/p2p/" + addrInfo.ID.String()
 		announceAddr, err = multiaddr.NewMultiaddr(addrstr)
 		if err != nil {
-			return nil, false, xerrors.Errorf("cannot parse announce address '%s': %w", addrstr, err)
+			return nil, false, 0, xerrors.Errorf("cannot parse announce address '%s': %w", addrstr, err)
 		}
 
 		// If the content is not on the primary estuary node (it's on a shuttle)
@@ -2238,7 +3138,7 @@ func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc strin
 		// so add an auth token for the data to the shuttle's auth DB
 		err := cm.sendPrepareForDataRequestCommand(ctx, contentLoc, dbid, authToken, propCid, rootCid, size)
 		if err != nil {
-			return nil, false, xerrors.Errorf("sending prepare for data request command to shuttle: %w", err)
+			return nil, false, 0, xerrors.Errorf("sending prepare for data request command to shuttle: %w", err)
 		}
 	}
 
@@ -2250,11 +3150,359 @@ func (cm *ContentManager) sendProposalV120(ctx context.Context, contentLoc strin
 	}
 
 	// Send the deal proposal to the storage provider
-	propPhase, err := cm.FilClient.SendProposalV120(ctx, dbid, netprop, dealUUID, announceAddr, authToken)
-	return cleanup, propPhase, err
+	miner := netprop.DealProposal.Proposal.Provider
+	propPhase, attempts, err := cm.sendProposalWithRetries(ctx, miner, func() (bool, error) {
+		propStart := time.Now()
+		propPhase, err := cm.FilClient.SendProposalV120(ctx, dbid, netprop, dealUUID, announceAddr, authToken)
+		if err == nil {
+			cm.recordMinerLatency(miner, time.Since(propStart))
+		}
+		return propPhase, err
+	})
+	return cleanup, propPhase, attempts, err
 }
 
-func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content, miner address.Address, verified bool) (uint, error) {
+// base delay before resending a proposal, it grows with each attempt
+var proposalResendBackoff = time.Second * 5
+
+// sendProposalWithRetries calls send until the miner answers the proposal,
+// and returns how many times it was sent. Failing to reach the miner, e.g.
+// because the stream dropped, is retried with the same proposal up to
+// proposalSendAttempts times. Once the miner has answered (propPhase is set)
+// the answer stands, a rejection is never retried.
+func (cm *ContentManager) sendProposalWithRetries(ctx context.Context, miner address.Address, send func() (bool, error)) (bool, int, error) {
+	maxAttempts := cm.proposalSendAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var attempt int
+	for {
+		attempt++
+		propPhase, err := send()
+		if err == nil || propPhase || attempt >= maxAttempts {
+			if err != nil && attempt > 1 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return propPhase, attempt, err
+		}
+
+		log.Warnw("failed to send deal proposal, retrying", "miner", miner, "attempt", attempt, "err", err)
+
+		select {
+		case <-time.After(proposalResendBackoff * time.Duration(attempt)):
+		case <-ctx.Done():
+			return false, attempt, fmt.Errorf("%w (gave up after %d attempts: %s)", err, attempt, ctx.Err())
+		}
+	}
+}
+
+// saveProposalAttempts records how many sends it took the proposal of a deal
+// to reach its miner
+func (cm *ContentManager) saveProposalAttempts(cd *contentDeal) {
+	if err := cm.DB.Model(contentDeal{}).Where("id = ?", cd.ID).UpdateColumn("proposal_attempts", cd.ProposalAttempts).Error; err != nil {
+		log.Errorw("failed to save proposal attempts", "deal", cd.ID, "err", err)
+	}
+}
+
+// dealCollateral overrides the collateral filclient picks for a proposal.
+// Both amounts are in attoFIL, a nil amount keeps the default (10% above the
+// chain minimum for the provider, zero for the client).
+type dealCollateral struct {
+	Client   abi.TokenAmount
+	Provider abi.TokenAmount
+}
+
+// applyDealCollateral validates the collateral overrides against the chain's
+// bounds for the deal and re-signs the proposal with them applied. The chain
+// only bounds the client collateral by the total supply, so it is held to the
+// provider's maximum instead, and to what our escrow has free to lock for the
+// deal, which the market would otherwise reject the deal for once published.
+// Asks carry no collateral terms, so the provider collateral is held to what
+// the miner has free to lock in the market for the same reason.
+func (cm *ContentManager) applyDealCollateral(ctx context.Context, cprop *market.ClientDealProposal, coll *dealCollateral) error {
+	prop := cprop.Proposal
+
+	bounds, err := cm.Api.StateDealProviderCollateralBounds(ctx, prop.PieceSize, prop.VerifiedDeal, types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("failed to get provider collateral bounds: %w", err)
+	}
+
+	if !coll.Provider.Nil() {
+		if coll.Provider.LessThan(bounds.Min) {
+			return fmt.Errorf("provider collateral %s is below the chain minimum of %s", types.FIL(coll.Provider), types.FIL(bounds.Min))
+		}
+
+		if coll.Provider.GreaterThan(bounds.Max) {
+			return fmt.Errorf("provider collateral %s is above the chain maximum of %s", types.FIL(coll.Provider), types.FIL(bounds.Max))
+		}
+
+		pbal, err := cm.Api.StateMarketBalance(ctx, prop.Provider, types.EmptyTSK)
+		if err != nil {
+			return fmt.Errorf("failed to get miner market balance: %w", err)
+		}
+
+		if avail := big.Sub(pbal.Escrow, pbal.Locked); coll.Provider.GreaterThan(avail) {
+			return fmt.Errorf("provider collateral %s is more than the %s miner %s has free to lock", types.FIL(coll.Provider), types.FIL(avail), prop.Provider)
+		}
+		prop.ProviderCollateral = coll.Provider
+	}
+
+	if !coll.Client.Nil() {
+		if coll.Client.LessThan(big.Zero()) {
+			return fmt.Errorf("client collateral cannot be negative: %s", coll.Client)
+		}
+
+		if coll.Client.GreaterThan(bounds.Max) {
+			return fmt.Errorf("client collateral %s is above the provider collateral maximum of %s", types.FIL(coll.Client), types.FIL(bounds.Max))
+		}
+		prop.ClientCollateral = coll.Client
+
+		mbal, err := cm.Api.StateMarketBalance(ctx, prop.Client, types.EmptyTSK)
+		if err != nil {
+			return fmt.Errorf("failed to get market balance: %w", err)
+		}
+
+		avail := big.Sub(mbal.Escrow, mbal.Locked)
+		if need := prop.ClientBalanceRequirement(); need.GreaterThan(avail) {
+			return fmt.Errorf("client collateral %s and storage fee %s need %s of escrow, only %s is available",
+				types.FIL(prop.ClientCollateral), types.FIL(prop.TotalStorageFee()), types.FIL(need), types.FIL(avail))
+		}
+	}
+
+	return cm.resignProposal(ctx, cprop, prop)
+}
+
+// applyAutoStartEpoch moves the deal to start startEpochSlack epochs from
+// now, keeping its duration, and warns if we don't expect the transfer to
+// finish before then
+func (cm *ContentManager) applyAutoStartEpoch(ctx context.Context, cprop *market.ClientDealProposal, size int64) error {
+	prop := cprop.Proposal
+
+	head, err := cm.Api.ChainHead(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chain head: %w", err)
+	}
+
+	if cm.estimatedTransferRate > 0 {
+		xferEpochs := abi.ChainEpoch(size / cm.estimatedTransferRate / int64(build.BlockDelaySecs))
+		if xferEpochs > cm.startEpochSlack {
+			log.Warnw("estimated transfer time exceeds deal start epoch slack",
+				"size", size, "transferEpochs", xferEpochs, "slack", cm.startEpochSlack)
+		}
+	}
+
+	duration := prop.EndEpoch - prop.StartEpoch
+	prop.StartEpoch = head.Height() + cm.startEpochSlack
+	prop.EndEpoch = prop.StartEpoch + duration
+
+	return cm.resignProposal(ctx, cprop, prop)
+}
+
+// refreshStaleProposal brings a proposal built at builtAt up to date if the
+// chain has moved on by proposalStaleEpochs or more since. The start and end
+// epochs are moved forward by as much as the chain has, keeping the same
+// lead time, and the provider collateral is moved back within the chain's
+// current bounds. Returns whether the proposal was changed and re-signed.
+func (cm *ContentManager) refreshStaleProposal(ctx context.Context, cprop *market.ClientDealProposal, builtAt abi.ChainEpoch) (bool, error) {
+	if cm.proposalStaleEpochs <= 0 {
+		return false, nil
+	}
+
+	head, err := cm.Api.ChainHead(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get chain head: %w", err)
+	}
+
+	moved := head.Height() - builtAt
+	if moved < cm.proposalStaleEpochs {
+		return false, nil
+	}
+
+	prop := cprop.Proposal
+	prop.StartEpoch += moved
+	prop.EndEpoch += moved
+
+	bounds, err := cm.Api.StateDealProviderCollateralBounds(ctx, prop.PieceSize, prop.VerifiedDeal, types.EmptyTSK)
+	if err != nil {
+		return false, fmt.Errorf("failed to get provider collateral bounds: %w", err)
+	}
+	prop.ProviderCollateral = clampProviderCollateral(prop.ProviderCollateral, bounds.Min, bounds.Max)
+
+	log.Infow("refreshing stale deal proposal", "miner", prop.Provider, "epochsSinceBuilt", moved,
+		"startEpoch", prop.StartEpoch, "providerCollateral", types.FIL(prop.ProviderCollateral))
+
+	if err := cm.resignProposal(ctx, cprop, prop); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// clampProviderCollateral moves coll within [min, max]. Collateral below the
+// minimum is set 10% above it like filclient does, so that small changes in
+// the bounds don't fail the deal.
+func clampProviderCollateral(coll, minColl, maxColl abi.TokenAmount) abi.TokenAmount {
+	if coll.LessThan(minColl) {
+		coll = big.Div(big.Mul(minColl, big.NewInt(11)), big.NewInt(10))
+	}
+	if coll.GreaterThan(maxColl) {
+		coll = maxColl
+	}
+	return coll
+}
+
+// newDealSigner returns the signer for deal proposals and a func closing it.
+// Without a remote signer configured that is the node's wallet and the
+// returned address is undefined.
+func newDealSigner(ctx context.Context, nd *node.Node, cfg config.Wallet) (node.Signer, address.Address, func(), error) {
+	if cfg.RemoteSignerURL == "" {
+		return nd.Wallet, address.Undef, func() {}, nil
+	}
+
+	signer, closer, err := node.NewRemoteSigner(ctx, cfg.RemoteSignerURL, os.Getenv(node.RemoteSignerTokenEnvVar))
+	if err != nil {
+		return nil, address.Undef, nil, err
+	}
+
+	addr, err := node.RemoteSignerAddress(ctx, signer, cfg.RemoteSignerAddress)
+	if err != nil {
+		closer()
+		return nil, address.Undef, nil, err
+	}
+
+	return signer, addr, func() { closer() }, nil
+}
+
+// dealAddr is the address deals are made from, and whose escrow pays for them
+func (cm *ContentManager) dealAddr() address.Address {
+	if cm.remoteSignerAddr != address.Undef {
+		return cm.remoteSignerAddr
+	}
+	return cm.FilClient.ClientAddr
+}
+
+// dealBalance is filclient's Balance for the address deals are made from,
+// which filclient doesn't know of with a remote signer
+func (cm *ContentManager) dealBalance(ctx context.Context) (*filclient.Balance, error) {
+	if cm.remoteSignerAddr == address.Undef {
+		return cm.FilClient.Balance(ctx)
+	}
+
+	addr := cm.remoteSignerAddr
+	act, err := cm.Api.StateGetActor(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	mbal, err := cm.Api.StateMarketBalance(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	vcstatus, err := cm.Api.StateVerifiedClientStatus(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filclient.Balance{
+		Account:               addr,
+		Balance:               types.FIL(act.Balance),
+		MarketEscrow:          types.FIL(mbal.Escrow),
+		MarketLocked:          types.FIL(mbal.Locked),
+		MarketAvailable:       types.FIL(types.BigSub(mbal.Escrow, mbal.Locked)),
+		VerifiedClientBalance: vcstatus,
+	}, nil
+}
+
+// addDealEscrow adds amt to the market escrow of the address deals are made
+// from. With a remote signer the node's wallet pays it in, the market lets
+// anyone add to the escrow of any address.
+func (cm *ContentManager) addDealEscrow(ctx context.Context, amt types.FIL) (*filclient.LockFundsResp, error) {
+	if cm.remoteSignerAddr == address.Undef {
+		return cm.FilClient.LockMarketFunds(ctx, amt)
+	}
+
+	from := cm.FilClient.ClientAddr
+	act, err := cm.Api.StateGetActor(ctx, from, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	if types.BigCmp(types.BigInt(amt), act.Balance) > 0 {
+		return nil, fmt.Errorf("not enough funds to add: %s < %s", types.FIL(act.Balance), amt)
+	}
+
+	params, err := cborutil.Dump(&cm.remoteSignerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	smsg, err := filclient.NewMsgPusher(cm.Api, cm.Node.Wallet).MpoolPushMessage(ctx, &types.Message{
+		From:   from,
+		To:     builtin.StorageMarketActorAddr,
+		Method: builtin.MethodsMarket.AddBalance,
+		Value:  types.BigInt(amt),
+		Params: params,
+	}, &api.MessageSendSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &filclient.LockFundsResp{MsgCid: smsg.Cid()}, nil
+}
+
+// applyRemoteSigner makes the proposal come from the remote signer's address.
+// filclient builds and signs proposals with the local wallet, so we swap the
+// client and get the remote signer to sign it instead.
+func (cm *ContentManager) applyRemoteSigner(ctx context.Context, cprop *market.ClientDealProposal) error {
+	if cm.remoteSignerAddr == address.Undef {
+		return nil
+	}
+
+	prop := cprop.Proposal
+	prop.Client = cm.remoteSignerAddr
+
+	return cm.resignProposal(ctx, cprop, prop)
+}
+
+// applyDealLabel labels the proposal with the configured scheme, so the deal
+// can be traced back to the content on chain. filclient labels proposals
+// with the payload cid, they are only signed again if the label changes.
+func (cm *ContentManager) applyDealLabel(ctx context.Context, cprop *market.ClientDealProposal, content Content) error {
+	label, err := cm.dealLabeler.Label(content.ID, content.Cid.CID)
+	if err != nil {
+		return err
+	}
+
+	if label == cprop.Proposal.Label {
+		return nil
+	}
+
+	prop := cprop.Proposal
+	prop.Label = label
+
+	return cm.resignProposal(ctx, cprop, prop)
+}
+
+// resignProposal replaces the proposal in cprop with prop, signed by the
+// deal signer
+func (cm *ContentManager) resignProposal(ctx context.Context, cprop *market.ClientDealProposal, prop market.DealProposal) error {
+	raw, err := cborutil.Dump(&prop)
+	if err != nil {
+		return err
+	}
+
+	sig, err := cm.signer.WalletSign(ctx, prop.Client, raw, api.MsgMeta{Type: api.MTDealProposal})
+	if err != nil {
+		return fmt.Errorf("failed to sign deal proposal: %w", err)
+	}
+
+	cprop.Proposal = prop
+	cprop.ClientSignature = *sig
+	return nil
+}
+
+func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content, miner address.Address, verified, fastRetrieval bool, coll *dealCollateral, pieceSize abi.PaddedPieceSize, pricing *dealPricing) (uint, error) {
 	ctx, span := cm.tracer.Start(ctx, "makeDealWithMiner", trace.WithAttributes(
 		attribute.Int64("content", int64(content.ID)),
 		attribute.Stringer("miner", miner),
@@ -2265,7 +3513,52 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content
 		return 0, fmt.Errorf("cannot make more deals for offloaded content, must retrieve first")
 	}
 
-	ask, err := cm.FilClient.GetAsk(ctx, miner)
+	if cm.ShuttingDown() {
+		return 0, fmt.Errorf("not making new deals while shutting down")
+	}
+
+	if cm.DealMakingPaused() {
+		return 0, errDealMakingPaused(cm.dealPause.status())
+	}
+
+	existing, err := cm.activeDealsForContent(content.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(withoutDealMiners([]address.Address{miner}, existing)) == 0 {
+		return 0, fmt.Errorf("miner %s already has a deal for content %d", miner, content.ID)
+	}
+
+	cm.connectMinerOverride(ctx, miner)
+
+	id, price, err := cm.proposeDealWithMiner(ctx, content, miner, verified, fastRetrieval, coll, pieceSize, pricing, abi.TokenAmount{})
+	if err == nil || pricing == nil || !pricing.Renegotiate || !isPriceRejection(err) {
+		return id, err
+	}
+
+	// the miner's ask moved since we queried it, try once more at its new price
+	log.Infow("miner rejected deal price, renegotiating", "miner", miner, "content", content.ID, "price", types.FIL(price), "err", err)
+	id, newPrice, err := cm.proposeDealWithMiner(ctx, content, miner, verified, fastRetrieval, coll, pieceSize, pricing, price)
+	if err != nil {
+		return 0, xerrors.Errorf("renegotiating after the miner rejected price %s: %w", types.FIL(price), err)
+	}
+
+	pricing.Adjusted = &dealPriceAdjustment{
+		From: price,
+		To:   newPrice,
+	}
+	log.Infow("renegotiated deal price", "miner", miner, "content", content.ID, "from", types.FIL(price), "to", types.FIL(newPrice))
+	return id, nil
+}
+
+// proposeDealWithMiner queries the miner's ask and proposes a deal at its
+// price, returning the price it proposed. When rejected is set the proposal
+// is a renegotiation after the miner turned down that price, and is only
+// sent if the miner's price has changed since.
+func (cm *ContentManager) proposeDealWithMiner(ctx context.Context, content Content, miner address.Address, verified, fastRetrieval bool, coll *dealCollateral, pieceSize abi.PaddedPieceSize, pricing *dealPricing, rejected abi.TokenAmount) (uint, abi.TokenAmount, error) {
+	askStart := time.Now()
+	ask, err := cm.queryAsk(ctx, miner)
 	if err != nil {
 		var clientErr *filclient.Error
 		if !(xerrors.As(err, &clientErr) && clientErr.Code == filclient.ErrLotusError) {
@@ -2277,25 +3570,66 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content
 			})
 		}
 
-		return 0, xerrors.Errorf("failed to get ask for miner %s: %w", miner, err)
+		return 0, abi.TokenAmount{}, xerrors.Errorf("failed to get ask for miner %s: %w", miner, err)
 	}
+	cm.recordMinerLatency(miner, time.Since(askStart))
 
 	price := ask.Ask.Ask.Price
 	if verified {
 		price = ask.Ask.Ask.VerifiedPrice
 	}
 
-	if cm.priceIsTooHigh(price, verified) {
-		return 0, fmt.Errorf("miners price is too high: %s %s", miner, price)
+	if !rejected.Nil() && !price.GreaterThan(rejected) {
+		return 0, price, fmt.Errorf("miner %s rejected price %s but its ask is %s", miner, types.FIL(rejected), types.FIL(price))
 	}
 
-	prop, err := cm.FilClient.MakeDeal(ctx, miner, content.Cid.CID, price, ask.Ask.Ask.MinPieceSize, dealDuration, verified)
+	if err := cm.checkDealPrice(miner, price, verified, pricing); err != nil {
+		return 0, price, err
+	}
+
+	_, _, contentPiece, err := cm.getPieceCommitment(ctx, content.Cid.CID, cm.Blockstore)
 	if err != nil {
-		return 0, xerrors.Errorf("failed to construct a deal proposal: %w", err)
+		return 0, price, xerrors.Errorf("failed to get piece commitment: %w", err)
 	}
 
-	if err := cm.putProposalRecord(prop.DealProposal); err != nil {
-		return 0, err
+	pieceSize, err = dealPieceSize(contentPiece, pieceSize, ask.Ask.Ask.MinPieceSize, ask.Ask.Ask.MaxPieceSize)
+	if err != nil {
+		return 0, price, xerrors.Errorf("cannot make deal with miner %s: %w", miner, err)
+	}
+
+	dur, err := cm.dealDurationForMiner(miner, pieceSize)
+	if err != nil {
+		return 0, price, xerrors.Errorf("miner %s does not accept our deal duration: %w", miner, err)
+	}
+
+	prop, err := cm.FilClient.MakeDeal(ctx, miner, content.Cid.CID, price, pieceSize, dur, verified)
+	if err != nil {
+		return 0, price, xerrors.Errorf("failed to construct a deal proposal: %w", err)
+	}
+	prop.FastRetrieval = fastRetrieval
+
+	if err := cm.applyRemoteSigner(ctx, prop.DealProposal); err != nil {
+		return 0, price, xerrors.Errorf("failed to sign deal proposal: %w", err)
+	}
+
+	if err := cm.applyDealLabel(ctx, prop.DealProposal, content); err != nil {
+		return 0, price, xerrors.Errorf("failed to label deal proposal: %w", err)
+	}
+
+	if cm.autoStartEpoch {
+		if err := cm.applyAutoStartEpoch(ctx, prop.DealProposal, content.Size); err != nil {
+			return 0, price, xerrors.Errorf("failed to set deal start epoch: %w", err)
+		}
+	}
+
+	if coll != nil {
+		if err := cm.applyDealCollateral(ctx, prop.DealProposal, coll); err != nil {
+			return 0, price, xerrors.Errorf("invalid deal collateral: %w", err)
+		}
+	}
+
+	if err := cm.putProposalRecord(ctx, prop.DealProposal); err != nil {
+		return 0, price, err
 	}
 
 	proto, err := cm.FilClient.DealProtocolForMiner(ctx, miner)
@@ -2306,44 +3640,55 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content
 			Message: err.Error(),
 			Content: content.ID,
 		})
-		return 0, err
+		return 0, price, err
 	}
 
-	propnd, err := cborutil.AsIpld(prop.DealProposal)
+	propCid, err := util.ProposalCid(prop.DealProposal)
 	if err != nil {
-		return 0, xerrors.Errorf("failed to compute deal proposal ipld node: %w", err)
+		return 0, price, err
 	}
 
 	dealUUID := uuid.New()
 	deal := &contentDeal{
-		Content:  content.ID,
-		PropCid:  util.DbCID{propnd.Cid()},
-		DealUUID: dealUUID.String(),
-		Miner:    miner.String(),
-		Verified: verified,
+		Content:       content.ID,
+		PropCid:       util.DbCID{propCid},
+		DealUUID:      dealUUID.String(),
+		Miner:         miner.String(),
+		Verified:      verified,
+		FastRetrieval: fastRetrieval,
+		PieceSize:     prop.DealProposal.Proposal.PieceSize,
 	}
 
 	if err := cm.DB.Create(deal).Error; err != nil {
-		return 0, xerrors.Errorf("failed to create database entry for deal: %w", err)
+		return 0, price, xerrors.Errorf("failed to create database entry for deal: %w", err)
 	}
 
 	// Send the deal proposal to the storage provider
+	proposalDone := cm.trackProposal(deal.ID)
 	var cleanupDealPrep func() error
 	var propPhase bool
 	isPushTransfer := proto == filclient.DealProtocolv110
 	switch proto {
 	case filclient.DealProtocolv110:
-		propPhase, err = cm.FilClient.SendProposalV110(ctx, *prop, propnd.Cid())
+		propPhase, deal.ProposalAttempts, err = cm.sendProposalWithRetries(ctx, miner, func() (bool, error) {
+			propStart := time.Now()
+			propPhase, err := cm.FilClient.SendProposalV110(ctx, *prop, propCid)
+			if err == nil {
+				cm.recordMinerLatency(miner, time.Since(propStart))
+			}
+			return propPhase, err
+		})
 	case filclient.DealProtocolv120:
-		cleanupDealPrep, propPhase, err = cm.sendProposalV120(ctx, content.Location, *prop, propnd.Cid(), dealUUID, deal.ID)
+		cleanupDealPrep, propPhase, deal.ProposalAttempts, err = cm.sendProposalV120(ctx, content.Location, *prop, propCid, dealUUID, deal.ID)
 	default:
 		err = fmt.Errorf("unrecognized deal protocol %s", proto)
 	}
+	proposalDone()
 
 	if err != nil {
 		// Clean up the database entry
 		if err := cm.DB.Delete(&contentDeal{}, deal).Error; err != nil {
-			return 0, fmt.Errorf("failed to delete content deal from db: %w", err)
+			return 0, price, fmt.Errorf("failed to delete content deal from db: %w", err)
 		}
 
 		if cleanupDealPrep != nil {
@@ -2364,22 +3709,26 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content Content
 			Message: err.Error(),
 			Content: content.ID,
 		})
-		return 0, err
+		return 0, price, err
 	}
 
+	cm.minerBreakers.success(miner)
+	cm.saveProposalAttempts(deal)
+	cm.recordOnboardingStage(content.ID, onboardingProposed)
+
 	// If the data transfer is a pull transfer, we don't need to explicitly
 	// start the transfer (the Storage Provider will start pulling data as
 	// soon as it accepts the proposal)
 	if !isPushTransfer {
-		return deal.ID, nil
+		return deal.ID, price, nil
 	}
 
 	// It's a push transfer, so start the data transfer
 	if err := cm.StartDataTransfer(ctx, deal); err != nil {
-		return 0, fmt.Errorf("failed to start data transfer: %w", err)
+		return 0, price, fmt.Errorf("failed to start data transfer: %w", err)
 	}
 
-	return deal.ID, nil
+	return deal.ID, price, nil
 }
 
 func (cm *ContentManager) StartDataTransfer(ctx context.Context, cd *contentDeal) error {
@@ -2424,12 +3773,54 @@ func (cm *ContentManager) StartDataTransfer(ctx context.Context, cd *contentDeal
 	return nil
 }
 
-func (cm *ContentManager) putProposalRecord(dealprop *market.ClientDealProposal) error {
+// most times we bump the start epoch of a duplicate proposal looking for a
+// cid that isn't taken yet
+const maxProposalBumps = 10
+
+// putProposalRecord saves a signed proposal. Making a deal for the same
+// content with the same parameters in the same epoch gives an identical
+// proposal, and so the same cid. By default the saved proposal is kept and
+// the new one is treated as the same proposal. With bumpDuplicateProposals
+// set, the start (and end) epoch are bumped and the proposal re-signed until
+// its cid is distinct, dealprop is updated in place.
+func (cm *ContentManager) putProposalRecord(ctx context.Context, dealprop *market.ClientDealProposal) error {
 	nd, err := cborutil.AsIpld(dealprop)
 	if err != nil {
 		return err
 	}
-	// fmt.Println("proposal cid: ", nd.Cid())
+
+	for i := 0; ; i++ {
+		exists, err := cm.proposalRecordExists(nd.Cid())
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			break
+		}
+
+		if !cm.bumpDuplicateProposals {
+			log.Infow("proposal already saved, reusing it", "propcid", nd.Cid(), "miner", dealprop.Proposal.Provider)
+			return nil
+		}
+
+		if i >= maxProposalBumps {
+			return fmt.Errorf("proposal %s still collides with a saved proposal after %d start epoch bumps", nd.Cid(), maxProposalBumps)
+		}
+
+		log.Infow("proposal already saved, bumping start epoch", "propcid", nd.Cid(), "miner", dealprop.Proposal.Provider, "startEpoch", dealprop.Proposal.StartEpoch)
+		prop := dealprop.Proposal
+		prop.StartEpoch++
+		prop.EndEpoch++
+		if err := cm.resignProposal(ctx, dealprop, prop); err != nil {
+			return err
+		}
+
+		nd, err = cborutil.AsIpld(dealprop)
+		if err != nil {
+			return err
+		}
+	}
 
 	if err := cm.DB.Create(&proposalRecord{
 		PropCid: util.DbCID{nd.Cid()},
@@ -2441,6 +3832,14 @@ func (cm *ContentManager) putProposalRecord(dealprop *market.ClientDealProposal)
 	return nil
 }
 
+func (cm *ContentManager) proposalRecordExists(propCid cid.Cid) (bool, error) {
+	var count int64
+	if err := cm.DB.Model(&proposalRecord{}).Where("prop_cid = ?", propCid.Bytes()).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func (cm *ContentManager) getProposalRecord(propCid cid.Cid) (*market.ClientDealProposal, error) {
 	var proprec proposalRecord
 	if err := cm.DB.First(&proprec, "prop_cid = ?", propCid.Bytes()).Error; err != nil {
@@ -2455,8 +3854,51 @@ func (cm *ContentManager) getProposalRecord(propCid cid.Cid) (*market.ClientDeal
 	return &prop, nil
 }
 
+// proposalRecordBatch is how many proposal records are loaded per query, to
+// stay under the database's limit on query parameters
+const proposalRecordBatch = 500
+
+// proposalsForDeals loads the proposals of the given deals, keyed by
+// proposal cid. Deals whose proposal wasn't recorded are left out.
+func (cm *ContentManager) proposalsForDeals(deals []contentDeal) (map[cid.Cid]*market.ClientDealProposal, error) {
+	out := make(map[cid.Cid]*market.ClientDealProposal, len(deals))
+	for i := 0; i < len(deals); i += proposalRecordBatch {
+		end := i + proposalRecordBatch
+		if end > len(deals) {
+			end = len(deals)
+		}
+
+		keys := make([][]byte, 0, end-i)
+		for _, d := range deals[i:end] {
+			keys = append(keys, d.PropCid.CID.Bytes())
+		}
+
+		var recs []proposalRecord
+		if err := cm.DB.Find(&recs, "prop_cid in ?", keys).Error; err != nil {
+			return nil, err
+		}
+
+		for _, rec := range recs {
+			var prop market.ClientDealProposal
+			if err := prop.UnmarshalCBOR(bytes.NewReader(rec.Data)); err != nil {
+				return nil, err
+			}
+			out[rec.PropCid.CID] = &prop
+		}
+	}
+	return out, nil
+}
+
 func (cm *ContentManager) recordDealFailure(dfe *DealFailureError) error {
 	log.Infow("deal failure error", "miner", dfe.Miner, "phase", dfe.Phase, "msg", dfe.Message, "content", dfe.Content)
+	if dfe.Miner != address.Undef && breakerPhases[dfe.Phase] {
+		cm.minerBreakers.failure(dfe.Miner)
+	}
+
+	if dfe.Miner != address.Undef && notAcceptingDeals(dfe.Message) {
+		cm.recordMinerNotAccepting(dfe.Miner, dfe.Message)
+	}
+
 	rec := dfe.Record()
 	if dfe.Miner != address.Undef {
 		var m storageMiner
@@ -2591,6 +4033,13 @@ func (cm *ContentManager) getPieceCommitment(ctx context.Context, data cid.Cid,
 	if err != nil {
 		return cid.Undef, 0, 0, err
 	}
+	if pcr == nil {
+		// a piece computed elsewhere for this deal, see withSuppliedPiece
+		if sp := suppliedPieceFor(ctx, data); sp != nil {
+			return sp.Piece, sp.CarSize, sp.Size.Unpadded(), nil
+		}
+	}
+
 	if pcr != nil {
 		if pcr.CarSize > 0 {
 			return pcr.Piece.CID, pcr.CarSize, pcr.Size, nil
@@ -2691,7 +4140,12 @@ func (cm *ContentManager) RefreshContentForCid(ctx context.Context, c cid.Cid) (
 	}
 }
 
-func (cm *ContentManager) RefreshContent(ctx context.Context, cont uint) error {
+// RefreshContent retrieves a content back from its deals. Content refreshed
+// locally is checked against its root cid and marked as stored locally again
+// once all of its dag is there, the result says which miner served it. It is
+// nil for content refreshed onto a shuttle. Refreshes of a content that is
+// already being retrieved wait for that retrieval, see retrieveContent.
+func (cm *ContentManager) RefreshContent(ctx context.Context, cont uint) (*rehydrateResult, error) {
 	ctx, span := cm.tracer.Start(ctx, "refreshContent")
 	defer span.End()
 
@@ -2699,33 +4153,21 @@ func (cm *ContentManager) RefreshContent(ctx context.Context, cont uint) error {
 	// until we can update its offloading status in the database
 	var c Content
 	if err := cm.DB.First(&c, "id = ?", cont).Error; err != nil {
-		return err
+		return nil, err
 	}
 
 	loc, err := cm.selectLocationForRetrieval(ctx, c)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	log.Infof("refreshing content %d onto shuttle %s", cont, loc)
 
 	switch loc {
 	case "local":
-		if err := cm.retrieveContent(ctx, cont); err != nil {
-			return err
-		}
-
-		if err := cm.DB.Model(&Content{}).Where("id = ?", cont).Update("offloaded", false).Error; err != nil {
-			return err
-		}
-
-		if err := cm.DB.Model(&ObjRef{}).Where("content = ?", cont).Update("offloaded", 0).Error; err != nil {
-			return err
-		}
+		return cm.rehydrateContent(ctx, c)
 	default:
-		return cm.sendRetrieveContentMessage(ctx, loc, c)
+		return nil, cm.sendRetrieveContentMessage(ctx, loc, c)
 	}
-
-	return nil
 }
 
 func (cm *ContentManager) sendRetrieveContentMessage(ctx context.Context, loc string, cont Content) error {
@@ -2808,10 +4250,6 @@ func (cm *ContentManager) retrieveContent(ctx context.Context, contentToFetch ui
 	return nil
 }
 
-func (cm *ContentManager) indexForAggregate(ctx context.Context, aggregateID, contID uint) (int, error) {
-	return 0, fmt.Errorf("selector based retrieval not yet implemented")
-}
-
 func (cm *ContentManager) runRetrieval(ctx context.Context, contentToFetch uint) error {
 	ctx, span := cm.tracer.Start(ctx, "runRetrieval")
 	defer span.End()
@@ -2821,26 +4259,29 @@ func (cm *ContentManager) runRetrieval(ctx context.Context, contentToFetch uint)
 		return err
 	}
 
-	rootContent := content.ID
+	if err := cm.freeSpace.CheckWrite(content.Size); err != nil {
+		return xerrors.Errorf("refusing to retrieve content %d: %w", content.ID, err)
+	}
 
-	index := -1
+	// a content that was aggregated has no deals of its own, it is retrieved
+	// from the aggregate's deals by selecting just its link
+	var aggr *Content
+	dealsFor := content.ID
 	if content.AggregatedIn > 0 {
-		rootContent = content.AggregatedIn
-		ix, err := cm.indexForAggregate(ctx, rootContent, contentToFetch)
-		if err != nil {
+		aggr = new(Content)
+		if err := cm.DB.First(aggr, content.AggregatedIn).Error; err != nil {
 			return err
 		}
-		index = ix
+		dealsFor = aggr.ID
 	}
-	_ = index
 
 	var deals []contentDeal
-	if err := cm.DB.Find(&deals, "content = ? and not failed", contentToFetch).Error; err != nil {
+	if err := cm.DB.Find(&deals, "content = ? and not failed", dealsFor).Error; err != nil {
 		return err
 	}
 
 	if len(deals) == 0 {
-		return xerrors.Errorf("no active deals for content %d we are trying to retrieve", contentToFetch)
+		return xerrors.Errorf("no active deals for content %d we are trying to retrieve", dealsFor)
 	}
 
 	// TODO: probably need some better way to pick miners to retrieve from...
@@ -2856,7 +4297,14 @@ func (cm *ContentManager) runRetrieval(ctx context.Context, contentToFetch uint)
 
 		log.Infow("attempting retrieval deal", "content", contentToFetch, "miner", maddr)
 
-		ask, err := cm.FilClient.RetrievalQuery(ctx, maddr, content.Cid.CID)
+		cm.connectMinerOverride(ctx, maddr)
+
+		queryCid := content.Cid.CID
+		if aggr != nil {
+			queryCid = aggr.Cid.CID
+		}
+
+		ask, err := cm.retrievalQuery(ctx, maddr, queryCid)
 		if err != nil {
 			span.RecordError(err)
 
@@ -2872,7 +4320,12 @@ func (cm *ContentManager) runRetrieval(ctx context.Context, contentToFetch uint)
 		}
 		log.Infow("got retrieval ask", "content", content, "miner", maddr, "ask", ask)
 
-		if err := cm.tryRetrieve(ctx, maddr, content.Cid.CID, ask); err != nil {
+		if aggr != nil {
+			err = cm.tryRetrieveMember(ctx, maddr, content, *aggr, ask)
+		} else {
+			err = cm.tryRetrieve(ctx, maddr, content.ID, content.Cid.CID, ask)
+		}
+		if err != nil {
 			span.RecordError(err)
 			log.Errorw("failed to retrieve content", "miner", maddr, "content", content.Cid.CID, "err", err)
 			cm.recordRetrievalFailure(&util.RetrievalFailureRecord{
@@ -2937,7 +4390,7 @@ func (s *Server) handleFixupDeals(c echo.Context) error {
 				}
 				dealUUID = &parsed
 			}
-			provds, err := s.CM.FilClient.DealStatus(subctx, miner, d.PropCid.CID, dealUUID)
+			provds, err := s.CM.dealStatus(subctx, miner, d.PropCid.CID, dealUUID)
 			if err != nil {
 				log.Errorf("failed to get deal status: %d %s: %s", d.ID, miner, err)
 				return
@@ -2980,17 +4433,17 @@ func (cm *ContentManager) addObjectsToDatabase(ctx context.Context, content uint
 	ctx, span := cm.tracer.Start(ctx, "addObjectsToDatabase")
 	defer span.End()
 
-	if err := cm.DB.CreateInBatches(objects, 300).Error; err != nil {
+	// objects can be shared with other content, keep garbage collection
+	// from deleting one we are about to add a ref to
+	cm.contentLk.RLock()
+	err := insertObjectsAndRefs(cm.DB, content, objects, cm.objectBatchSize)
+	cm.contentLk.RUnlock()
+	if err != nil {
 		return xerrors.Errorf("failed to create objects in db: %w", err)
 	}
 
-	refs := make([]ObjRef, 0, len(objects))
 	var totalSize int64
 	for _, o := range objects {
-		refs = append(refs, ObjRef{
-			Content: content,
-			Object:  o.ID,
-		})
 		totalSize += int64(o.Size)
 	}
 
@@ -2999,17 +4452,25 @@ func (cm *ContentManager) addObjectsToDatabase(ctx context.Context, content uint
 		attribute.Int("numObjects", len(objects)),
 	)
 
-	if err := cm.DB.Model(Content{}).Where("id = ?", content).UpdateColumns(map[string]interface{}{
+	updates := map[string]interface{}{
 		"active":   true,
 		"size":     totalSize,
 		"pinning":  false,
 		"location": loc,
-	}).Error; err != nil {
-		return xerrors.Errorf("failed to update content in database: %w", err)
 	}
 
-	if err := cm.DB.CreateInBatches(refs, 500).Error; err != nil {
-		return xerrors.Errorf("failed to create refs: %w", err)
+	// content pinned on shuttles is sniffed there and comes without a dserv
+	if dserv != nil {
+		mt, err := util.DetectMimeType(ctx, dserv, root)
+		if err != nil {
+			log.Warnf("failed to detect mime type of content %d: %s", content, err)
+		} else if mt != "" {
+			updates["mime_type"] = mt
+		}
+	}
+
+	if err := cm.DB.Model(Content{}).Where("id = ?", content).UpdateColumns(updates).Error; err != nil {
+		return xerrors.Errorf("failed to update content in database: %w", err)
 	}
 
 	return nil
@@ -3063,18 +4524,7 @@ func (cm *ContentManager) safeFetchData(ctx context.Context, c cid.Cid) (func(),
 	}
 
 	cset := cid.NewSet()
-	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, err
-		}
-
-		if c.Type() == cid.Raw {
-			return nil, nil
-		}
-
-		return node.Links(), nil
-	}, c, cset.Visit, merkledag.Concurrent())
+	err := util.WalkDag(ctx, dserv, c, cset.Visit, cm.dagWalkConcurrency, nil)
 	if err != nil {
 		return deref, err
 	}
@@ -3082,6 +4532,20 @@ func (cm *ContentManager) safeFetchData(ctx context.Context, c cid.Cid) (func(),
 	return deref, nil
 }
 
+// checkDagComplete walks the dag under c using only our blockstore and
+// errors if any of its blocks are missing
+func (cm *ContentManager) checkDagComplete(ctx context.Context, c cid.Cid) error {
+	dserv := merkledag.NewDAGService(blockservice.New(cm.Blockstore, nil))
+
+	cset := cid.NewSet()
+	err := util.WalkDag(ctx, dserv, c, cset.Visit, cm.dagWalkConcurrency, nil)
+	if err != nil {
+		return fmt.Errorf("dag for %s is incomplete locally (%d blocks found): %w", c, cset.Len(), err)
+	}
+
+	return nil
+}
+
 func (cm *ContentManager) addrInfoForShuttle(handle string) (*peer.AddrInfo, error) {
 	if handle == "local" {
 		return &peer.AddrInfo{
@@ -3265,15 +4729,17 @@ func (cm *ContentManager) splitContentLocal(ctx context.Context, cont Content, s
 
 	for i, c := range boxCids {
 		content := &Content{
-			Cid:          util.DbCID{c},
-			Name:         fmt.Sprintf("%s-%d", cont.Name, i),
-			Active:       false,
-			Pinning:      true,
-			UserID:       cont.UserID,
-			Replication:  cont.Replication,
-			Location:     "local",
-			DagSplit:     true,
-			AggregatedIn: cont.ID,
+			Cid:             util.DbCID{c},
+			Name:            fmt.Sprintf("%s-%d", cont.Name, i),
+			Active:          false,
+			Pinning:         true,
+			UserID:          cont.UserID,
+			Replication:     cont.Replication,
+			Location:        "local",
+			DagSplit:        true,
+			AggregatedIn:    cont.ID,
+			MinSuccessRatio: cont.MinSuccessRatio,
+			Access:          cont.Access,
 		}
 
 		if err := cm.DB.Create(content).Error; err != nil {
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithoutDealMiners(t *testing.T) {
+	assert := assert.New(t)
+
+	m1, _ := address.NewIDAddress(1000)
+	m2, _ := address.NewIDAddress(1001)
+	m3, _ := address.NewIDAddress(1002)
+
+	deals := []contentDeal{
+		{Content: 5, Miner: m2.String()},
+	}
+
+	out := withoutDealMiners([]address.Address{m1, m2, m3}, deals)
+	assert.Equal([]address.Address{m1, m3}, out)
+
+	out = withoutDealMiners([]address.Address{m2}, deals)
+	assert.Empty(out)
+
+	out = withoutDealMiners([]address.Address{m1, m3}, nil)
+	assert.Equal([]address.Address{m1, m3}, out)
+}
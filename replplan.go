@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// How many deals are made for content that didn't ask for a replication of
+// its own
+const (
+	// always the node's replication setting
+	replicationModeFixed = "fixed"
+
+	// as many deals as it takes to meet the durability target, given how
+	// reliable the miners the deals go to have been
+	replicationModeAdaptive = "adaptive"
+)
+
+func validReplicationMode(mode string) error {
+	switch mode {
+	case "", replicationModeFixed, replicationModeAdaptive:
+		return nil
+	default:
+		return fmt.Errorf("unknown replication mode %q", mode)
+	}
+}
+
+// durabilityTarget is what the adaptive replication mode aims for: with the
+// given confidence, the content survives losing any Tolerance of its replicas
+type durabilityTarget struct {
+	Tolerance  int     `json:"tolerance"`
+	Confidence float64 `json:"confidence"`
+
+	// most deals the target may take, it's given up on past that
+	MaxDeals int `json:"maxDeals"`
+}
+
+func (dt durabilityTarget) validate() error {
+	if dt.Tolerance < 0 {
+		return fmt.Errorf("durability tolerance must not be negative")
+	}
+
+	if dt.Confidence <= 0 || dt.Confidence >= 1 {
+		return fmt.Errorf("durability confidence must be between 0 and 1 (exclusive), got %g", dt.Confidence)
+	}
+
+	if dt.MaxDeals <= dt.Tolerance {
+		return fmt.Errorf("max replication (%d) must be more than the durability tolerance (%d)", dt.MaxDeals, dt.Tolerance)
+	}
+	return nil
+}
+
+type plannedReplica struct {
+	Miner string `json:"miner"`
+
+	// chance the miner loses its replica, going by its deal history
+	LossProbability float64 `json:"lossProbability"`
+
+	// the content already has a deal with the miner
+	Existing bool `json:"existing"`
+}
+
+// replicationPlan is how many deals a content gets under the adaptive mode,
+// and the miners that number assumes. Those miners are tried first when
+// picking miners for the content, but any that turn out not to take the deal
+// are made up for from the ranking as usual, so the plan is made again every
+// time the content is checked and then counts the miners its deals actually
+// went to.
+type replicationPlan struct {
+	Content uint             `json:"content"`
+	Target  durabilityTarget `json:"target"`
+
+	Replicas []plannedReplica `json:"replicas"`
+	Deals    int              `json:"deals"`
+	NewDeals int              `json:"newDeals"`
+
+	// chance that more than Target.Tolerance replicas survive with these
+	// miners, and whether that meets the target
+	Confidence float64 `json:"confidence"`
+	Met        bool    `json:"met"`
+}
+
+// lossPrior is the chance of losing a deal across all the miners we made
+// deals with, what a miner we know little about is assumed to be like. With
+// no settled deals at all it's a coin flip.
+func lossPrior(stats []*minerDealStats) float64 {
+	var lost, settled int
+	for _, st := range stats {
+		lost += st.FailedDeals + st.DealFaults
+		settled += st.FailedDeals + st.DealFaults + st.ConfirmedDeals
+	}
+	return float64(lost+1) / float64(settled+2)
+}
+
+// minerLossProbability estimates the chance a deal with the miner doesn't
+// end up stored, from its failed and faulted deals against the ones that made
+// it. Deals still in progress don't count either way. The estimate starts out
+// at the prior, worth two deals, and moves away from it as the miner's deals
+// settle.
+func minerLossProbability(st *minerDealStats, prior float64) float64 {
+	if st == nil {
+		return prior
+	}
+
+	lost := st.FailedDeals + st.DealFaults
+	settled := lost + st.ConfirmedDeals
+	return (float64(lost) + 2*prior) / float64(settled+2)
+}
+
+// survivalProbability is the chance that at least need of the replicas, each
+// lost with the given probability independently of the others, survive
+func survivalProbability(losses []float64, need int) float64 {
+	if need <= 0 {
+		return 1
+	}
+
+	// dist[k] is the chance exactly k of the replicas so far survive
+	dist := make([]float64, len(losses)+1)
+	dist[0] = 1
+	for i, p := range losses {
+		for k := i + 1; k > 0; k-- {
+			dist[k] = dist[k]*p + dist[k-1]*(1-p)
+		}
+		dist[0] *= p
+	}
+
+	var out float64
+	for k := need; k < len(dist); k++ {
+		out += dist[k]
+	}
+	return out
+}
+
+// planReplication keeps the existing replicas and adds candidates, most
+// reliable first, until the target is met or the plan reaches MaxDeals
+// replicas. Candidates must not include miners of existing replicas.
+func planReplication(target durabilityTarget, existing, candidates []plannedReplica) *replicationPlan {
+	plan := &replicationPlan{
+		Target:   target,
+		Replicas: append([]plannedReplica(nil), existing...),
+	}
+
+	losses := make([]float64, 0, len(existing)+len(candidates))
+	for _, r := range existing {
+		losses = append(losses, r.LossProbability)
+	}
+
+	// the stable sort keeps the ranking's order among equally reliable miners
+	sorted := append([]plannedReplica(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LossProbability < sorted[j].LossProbability
+	})
+
+	need := target.Tolerance + 1
+	plan.Confidence = survivalProbability(losses, need)
+	for _, c := range sorted {
+		if plan.Confidence >= target.Confidence || len(plan.Replicas) >= target.MaxDeals {
+			break
+		}
+
+		plan.Replicas = append(plan.Replicas, c)
+		plan.NewDeals++
+		losses = append(losses, c.LossProbability)
+		plan.Confidence = survivalProbability(losses, need)
+	}
+
+	plan.Deals = len(plan.Replicas)
+	plan.Met = plan.Confidence >= target.Confidence
+	return plan
+}
+
+// replicationPlanForContent plans the deals for a content from its active
+// deals and the ranked miner list. Miners on cooldown or suspended aren't
+// planned for, as no deal would be made with them right now.
+func (cm *ContentManager) replicationPlanForContent(content Content, target durabilityTarget) (*replicationPlan, error) {
+	sorted, stats, err := cm.sortedMinerList()
+	if err != nil {
+		return nil, err
+	}
+
+	byMiner := make(map[address.Address]*minerDealStats, len(stats))
+	for _, st := range stats {
+		byMiner[st.Miner] = st
+	}
+	prior := lossPrior(stats)
+
+	deals, err := cm.activeDealsForContent(content.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	have := make(map[address.Address]bool)
+	var existing []plannedReplica
+	for _, d := range deals {
+		maddr, err := d.MinerAddr()
+		if err != nil || have[maddr] {
+			continue
+		}
+		have[maddr] = true
+
+		existing = append(existing, plannedReplica{
+			Miner:           maddr.String(),
+			LossProbability: minerLossProbability(byMiner[maddr], prior),
+			Existing:        true,
+		})
+	}
+
+	suspended, err := cm.suspendedMiners()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []plannedReplica
+	for _, m := range sorted {
+		if have[m] || !cm.minerBreakers.available(m) {
+			continue
+		}
+
+		if _, ok := suspended[m]; ok {
+			continue
+		}
+
+		candidates = append(candidates, plannedReplica{
+			Miner:           m.String(),
+			LossProbability: minerLossProbability(byMiner[m], prior),
+		})
+	}
+
+	plan := planReplication(target, existing, candidates)
+	plan.Content = content.ID
+	return plan, nil
+}
+
+// Plans are asked for a few times each time a content is checked, by
+// replicationFor and when picking miners, and reused for that long
+const (
+	replicationPlanTTL       = time.Minute
+	replicationPlanCacheSize = 4096
+)
+
+type cachedReplicationPlan struct {
+	plan *replicationPlan
+	at   time.Time
+}
+
+// adaptivePlan returns the content's plan under the adaptive mode, nil when
+// its replication isn't up to the plan
+func (cm *ContentManager) adaptivePlan(content Content) (*replicationPlan, error) {
+	if content.Replication > 0 || cm.replicationMode != replicationModeAdaptive {
+		return nil, nil
+	}
+
+	if v, ok := cm.replPlans.Get(content.ID); ok && content.ID != 0 {
+		cached := v.(cachedReplicationPlan)
+		if time.Since(cached.at) < replicationPlanTTL {
+			return cached.plan, nil
+		}
+	}
+
+	plan, err := cm.replicationPlanForContent(content, cm.durabilityTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	if content.ID != 0 {
+		cm.replPlans.Add(content.ID, cachedReplicationPlan{plan: plan, at: time.Now()})
+	}
+	return plan, nil
+}
+
+// plannedMiners are the miners the content's plan counts on getting new
+// deals, most reliable first, so they're tried before any other
+func (cm *ContentManager) plannedMiners(content Content) []address.Address {
+	plan, err := cm.adaptivePlan(content)
+	if err != nil {
+		log.Warnw("failed to plan replication, picking miners from the ranking", "content", content.ID, "err", err)
+		return nil
+	}
+
+	if plan == nil {
+		return nil
+	}
+
+	var out []address.Address
+	for _, r := range plan.Replicas {
+		if r.Existing {
+			continue
+		}
+
+		m, err := address.NewFromString(r.Miner)
+		if err != nil {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// replicationFor returns how many deals the content should have
+func (cm *ContentManager) replicationFor(content Content) int {
+	if content.Replication > 0 {
+		return content.Replication
+	}
+
+	if cm.replicationMode != replicationModeAdaptive {
+		return cm.Replication
+	}
+
+	plan, err := cm.adaptivePlan(content)
+	if err != nil {
+		log.Errorw("failed to plan replication, using the fixed replication", "content", content.ID, "err", err)
+		return cm.Replication
+	}
+
+	if !plan.Met {
+		log.Warnw("durability target can't be met with the miners we have", "content", content.ID,
+			"confidence", plan.Confidence, "target", cm.durabilityTarget.Confidence, "deals", plan.Deals)
+	}
+
+	// surviving the loss of Tolerance replicas takes at least one more,
+	// even when there are no miners to plan with
+	if plan.Deals <= cm.durabilityTarget.Tolerance {
+		return cm.durabilityTarget.Tolerance + 1
+	}
+	return plan.Deals
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSurvivalProbability(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(1.0, survivalProbability(nil, 0))
+	assert.Equal(0.0, survivalProbability(nil, 1))
+
+	// any one of two coin flips
+	assert.InDelta(0.75, survivalProbability([]float64{0.5, 0.5}, 1), 1e-9)
+	// both of them
+	assert.InDelta(0.25, survivalProbability([]float64{0.5, 0.5}, 2), 1e-9)
+
+	// at least two of three replicas that are each lost 10% of the time
+	exp := 3*0.9*0.9*0.1 + 0.9*0.9*0.9
+	assert.InDelta(exp, survivalProbability([]float64{0.1, 0.1, 0.1}, 2), 1e-9)
+
+	// a replica that's never lost always survives
+	assert.InDelta(1.0, survivalProbability([]float64{0, 0.9}, 1), 1e-9)
+}
+
+func TestMinerLossProbability(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0.5, minerLossProbability(nil, 0.5))
+	assert.Equal(0.5, minerLossProbability(&minerDealStats{}, 0.5))
+
+	// deals in progress don't count
+	assert.Equal(0.5, minerLossProbability(&minerDealStats{TotalDeals: 10}, 0.5))
+
+	reliable := &minerDealStats{TotalDeals: 100, ConfirmedDeals: 98, FailedDeals: 1, DealFaults: 1}
+	flaky := &minerDealStats{TotalDeals: 100, ConfirmedDeals: 60, FailedDeals: 30, DealFaults: 10}
+	assert.InDelta(3.0/102, minerLossProbability(reliable, 0.5), 1e-9)
+	assert.InDelta(41.0/102, minerLossProbability(flaky, 0.5), 1e-9)
+
+	// new miners are assumed to be like the rest
+	assert.Equal(0.5, lossPrior(nil))
+	prior := lossPrior([]*minerDealStats{reliable, flaky})
+	assert.InDelta(43.0/202, prior, 1e-9)
+	assert.Equal(prior, minerLossProbability(nil, prior))
+	assert.InDelta(prior, minerLossProbability(&minerDealStats{TotalDeals: 3}, prior), 1e-9)
+	assert.InDelta((2+2*prior)/12, minerLossProbability(&minerDealStats{ConfirmedDeals: 8, FailedDeals: 2}, prior), 1e-9)
+}
+
+func TestPlanReplication(t *testing.T) {
+	assert := assert.New(t)
+
+	target := durabilityTarget{Tolerance: 1, Confidence: 0.999, MaxDeals: 10}
+	assert.NoError(target.validate())
+
+	reliable := []plannedReplica{
+		{Miner: "f01", LossProbability: 0.01},
+		{Miner: "f02", LossProbability: 0.01},
+		{Miner: "f03", LossProbability: 0.01},
+		{Miner: "f04", LossProbability: 0.01},
+	}
+	plan := planReplication(target, nil, reliable)
+	assert.True(plan.Met)
+	assert.Equal(3, plan.Deals)
+	assert.Equal(3, plan.NewDeals)
+	assert.GreaterOrEqual(plan.Confidence, 0.999)
+
+	// flaky miners need more deals for the same target
+	var flaky []plannedReplica
+	for i := 0; i < 10; i++ {
+		flaky = append(flaky, plannedReplica{Miner: fmt.Sprintf("f1%d", i), LossProbability: 0.3})
+	}
+	plan = planReplication(target, nil, flaky)
+	assert.True(plan.Met)
+	assert.Greater(plan.Deals, 3)
+
+	// the most reliable candidates are planned for first, and existing deals
+	// are kept whatever their miners are like
+	existing := []plannedReplica{{Miner: "f09", LossProbability: 0.3, Existing: true}}
+	plan = planReplication(target, existing, append(flaky[:2:2], reliable...))
+	assert.True(plan.Met)
+	assert.Equal("f09", plan.Replicas[0].Miner)
+	assert.True(plan.Replicas[0].Existing)
+	for _, r := range plan.Replicas[1:] {
+		assert.Equal(0.01, r.LossProbability)
+	}
+	assert.Equal(plan.Deals-1, plan.NewDeals)
+
+	// the cap wins over the target
+	capped := durabilityTarget{Tolerance: 1, Confidence: 0.999, MaxDeals: 4}
+	plan = planReplication(capped, nil, flaky)
+	assert.False(plan.Met)
+	assert.Equal(4, plan.Deals)
+	assert.False(math.IsNaN(plan.Confidence))
+
+	// already durable enough, nothing new to make
+	plan = planReplication(target, reliable[:3], flaky)
+	assert.True(plan.Met)
+	assert.Zero(plan.NewDeals)
+
+	assert.Error(durabilityTarget{Tolerance: 1, Confidence: 1, MaxDeals: 3}.validate())
+	assert.Error(durabilityTarget{Tolerance: 2, Confidence: 0.9, MaxDeals: 2}.validate())
+	assert.Error(durabilityTarget{Tolerance: -1, Confidence: 0.9, MaxDeals: 2}.validate())
+}
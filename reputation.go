@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+)
+
+const minerReputationVersion = 1
+
+// minerReputationExport is the deal history of the miners a node has made
+// deals with, in a form other nodes can import to seed their own ranking.
+// Only the node's own deals are exported, never stats it imported itself,
+// so passing exports around between nodes doesn't count a deal twice.
+type minerReputationExport struct {
+	Version  int               `json:"version"`
+	Source   string            `json:"source"`
+	Exported time.Time         `json:"exported"`
+	Miners   []minerReputation `json:"miners"`
+}
+
+type minerReputation struct {
+	Miner          string `json:"miner"`
+	TotalDeals     int    `json:"totalDeals"`
+	ConfirmedDeals int    `json:"confirmedDeals"`
+	FailedDeals    int    `json:"failedDeals"`
+	DealFaults     int    `json:"dealFaults"`
+}
+
+func (mr minerReputation) validate() error {
+	if _, err := address.NewFromString(mr.Miner); err != nil {
+		return fmt.Errorf("invalid miner %q: %w", mr.Miner, err)
+	}
+
+	if mr.ConfirmedDeals < 0 || mr.FailedDeals < 0 || mr.DealFaults < 0 ||
+		mr.TotalDeals < mr.ConfirmedDeals+mr.FailedDeals+mr.DealFaults {
+		return fmt.Errorf("inconsistent deal counts for miner %s", mr.Miner)
+	}
+
+	// exports only list miners deals were made with, and a miner without
+	// any has no success ratio
+	if mr.TotalDeals == 0 {
+		return fmt.Errorf("no deals reported for miner %s", mr.Miner)
+	}
+	return nil
+}
+
+// importedMinerStats are the deal counts another node reported for a miner.
+// Importing from the same source again replaces its earlier stats.
+type importedMinerStats struct {
+	gorm.Model
+	Source   string `gorm:"index:idx_imported_miner_stats_source_miner,unique"`
+	Miner    string `gorm:"index:idx_imported_miner_stats_source_miner,unique"`
+	Exported time.Time
+
+	TotalDeals     int
+	ConfirmedDeals int
+	FailedDeals    int
+	DealFaults     int
+}
+
+// localMinerDealStats counts the deals this node made with each miner
+func localMinerDealStats(db *gorm.DB) (map[address.Address]*minerDealStats, error) {
+	var deals []contentDeal
+	if err := db.Find(&deals).Error; err != nil {
+		return nil, err
+	}
+
+	stats := make(map[address.Address]*minerDealStats)
+	for _, d := range deals {
+		maddr, err := d.MinerAddr()
+		if err != nil {
+			return nil, err
+		}
+
+		st, ok := stats[maddr]
+		if !ok {
+			st = &minerDealStats{
+				Miner: maddr,
+			}
+			stats[maddr] = st
+		}
+
+		st.TotalDeals++
+		if d.DealID > 0 {
+			if d.Failed {
+				st.DealFaults++
+				if d.FailedReason == dealFailedSlashed {
+					st.SlashedDeals++
+				}
+			} else {
+				st.ConfirmedDeals++
+			}
+		} else if d.Failed {
+			st.FailedDeals++
+		} else {
+			// in progress
+		}
+	}
+
+	stored, err := minerBytesStored(db, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for m, b := range stored {
+		maddr, err := address.NewFromString(m)
+		if err != nil {
+			return nil, err
+		}
+
+		if st, ok := stats[maddr]; ok {
+			st.TotalBytesStored = b
+		}
+	}
+
+	return stats, nil
+}
+
+// minerBytesStored sums the padded piece sizes of the confirmed deals of each
+// miner, or of just the given one, as the deals were proposed
+func minerBytesStored(db *gorm.DB, miner string) (map[string]uint64, error) {
+	q := db.Model(&contentDeal{}).
+		Select("miner, sum(piece_size) as size").
+		Where("deal_id > 0 and not failed")
+	if miner != "" {
+		q = q.Where("miner = ?", miner)
+	}
+
+	var rows []struct {
+		Miner string
+		Size  uint64
+	}
+	if err := q.Group("miner").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]uint64, len(rows))
+	for _, r := range rows {
+		out[r.Miner] = r.Size
+	}
+	return out, nil
+}
+
+// deals whose piece size is backfilled at once, see backfillDealPieceSizes
+const dealPieceSizeBackfillBatch = 500
+
+// runDealPieceSizeBackfill backfills the piece sizes of old deals once, in
+// the background, see backfillDealPieceSizes
+func (cm *ContentManager) runDealPieceSizeBackfill(ctx context.Context) {
+	n, err := backfillDealPieceSizes(ctx, cm.DB)
+	if err != nil {
+		log.Errorf("failed to backfill deal piece sizes: %s", err)
+		return
+	}
+
+	if n > 0 {
+		log.Infow("backfilled deal piece sizes", "deals", n)
+	}
+}
+
+// backfillDealPieceSizes records the piece size of confirmed deals made
+// before it was recorded, from their proposals. Deals whose proposal we no
+// longer have are marked as such and left at zero, so each deal is only
+// looked at once. It returns how many deals it looked at.
+func backfillDealPieceSizes(ctx context.Context, db *gorm.DB) (int, error) {
+	var total int
+	for {
+		var deals []contentDeal
+		if err := db.WithContext(ctx).Model(&contentDeal{}).
+			Where("deal_id > 0 and not failed and piece_size = 0 and not piece_size_unknown").
+			Select("id, prop_cid").Order("id").Limit(dealPieceSizeBackfillBatch).
+			Find(&deals).Error; err != nil {
+			return total, err
+		}
+
+		if len(deals) == 0 {
+			return total, nil
+		}
+
+		props := make([]util.DbCID, 0, len(deals))
+		for _, d := range deals {
+			props = append(props, d.PropCid)
+		}
+
+		var recs []proposalRecord
+		if err := db.WithContext(ctx).Where("prop_cid in ?", props).Find(&recs).Error; err != nil {
+			return total, err
+		}
+
+		sizes := make(map[cid.Cid]abi.PaddedPieceSize, len(recs))
+		for _, rec := range recs {
+			var prop market.ClientDealProposal
+			if err := prop.UnmarshalCBOR(bytes.NewReader(rec.Data)); err != nil {
+				log.Warnw("failed to decode deal proposal", "propCid", rec.PropCid.CID, "err", err)
+				continue
+			}
+			sizes[rec.PropCid.CID] = prop.Proposal.PieceSize
+		}
+
+		if err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			for _, d := range deals {
+				upd := map[string]interface{}{"piece_size_unknown": true}
+				if size, ok := sizes[d.PropCid.CID]; ok && size > 0 {
+					upd = map[string]interface{}{"piece_size": size}
+				}
+
+				if err := tx.Model(&contentDeal{}).Where("id = ?", d.ID).UpdateColumns(upd).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return total, err
+		}
+
+		total += len(deals)
+	}
+}
+
+// mergeImportedMinerStats adds the deal counts imported from other nodes to
+// stats. Counts are summed rather than ratios averaged, so each source weighs
+// in by how many deals it has seen with the miner.
+func mergeImportedMinerStats(db *gorm.DB, stats map[address.Address]*minerDealStats) error {
+	var imported []importedMinerStats
+	if err := db.Find(&imported).Error; err != nil {
+		return err
+	}
+
+	for _, im := range imported {
+		maddr, err := address.NewFromString(im.Miner)
+		if err != nil {
+			continue
+		}
+
+		st, ok := stats[maddr]
+		if !ok {
+			st = &minerDealStats{
+				Miner: maddr,
+			}
+			stats[maddr] = st
+		}
+
+		st.TotalDeals += im.TotalDeals
+		st.ConfirmedDeals += im.ConfirmedDeals
+		st.FailedDeals += im.FailedDeals
+		st.DealFaults += im.DealFaults
+	}
+	return nil
+}
+
+func exportMinerReputation(db *gorm.DB, source string) (*minerReputationExport, error) {
+	stats, err := localMinerDealStats(db)
+	if err != nil {
+		return nil, err
+	}
+
+	exp := &minerReputationExport{
+		Version:  minerReputationVersion,
+		Source:   source,
+		Exported: time.Now(),
+		Miners:   make([]minerReputation, 0, len(stats)),
+	}
+	for _, st := range stats {
+		exp.Miners = append(exp.Miners, minerReputation{
+			Miner:          st.Miner.String(),
+			TotalDeals:     st.TotalDeals,
+			ConfirmedDeals: st.ConfirmedDeals,
+			FailedDeals:    st.FailedDeals,
+			DealFaults:     st.DealFaults,
+		})
+	}
+	return exp, nil
+}
+
+// importMinerReputation stores the stats of an export from another node,
+// replacing anything imported from that node before. Exports made by this
+// node itself are refused as its deals are already counted.
+func importMinerReputation(db *gorm.DB, self string, exp *minerReputationExport) (int, error) {
+	if exp.Version != minerReputationVersion {
+		return 0, fmt.Errorf("unsupported miner reputation export version %d", exp.Version)
+	}
+
+	if exp.Source == "" {
+		return 0, fmt.Errorf("miner reputation export has no source")
+	}
+
+	if exp.Source == self {
+		return 0, fmt.Errorf("miner reputation export was made by this node, its deals are already counted")
+	}
+
+	recs := make([]importedMinerStats, 0, len(exp.Miners))
+	for _, mr := range exp.Miners {
+		if err := mr.validate(); err != nil {
+			return 0, err
+		}
+
+		recs = append(recs, importedMinerStats{
+			Source:         exp.Source,
+			Miner:          mr.Miner,
+			Exported:       exp.Exported,
+			TotalDeals:     mr.TotalDeals,
+			ConfirmedDeals: mr.ConfirmedDeals,
+			FailedDeals:    mr.FailedDeals,
+			DealFaults:     mr.DealFaults,
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("source = ?", exp.Source).Delete(&importedMinerStats{}).Error; err != nil {
+			return err
+		}
+
+		if len(recs) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(recs, 500).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(recs), nil
+}
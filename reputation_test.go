@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinerReputationImport(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &contentDeal{}, &importedMinerStats{}, &Content{}, &proposalRecord{})
+
+	data, _ := cid.Decode("bafkqaaa")
+	cont := &Content{Cid: util.DbCID{CID: data}}
+	assert.NoError(db.Create(cont).Error)
+
+	assert.NoError(db.Create(&contentDeal{Content: cont.ID, Miner: "f01000", DealID: 1, PieceSize: 2048}).Error)
+	assert.NoError(db.Create(&contentDeal{Content: cont.ID, Miner: "f01000", Failed: true, PieceSize: 2048}).Error)
+
+	m1000, _ := address.NewFromString("f01000")
+	m1001, _ := address.NewFromString("f01001")
+
+	exp, err := exportMinerReputation(db, "self")
+	assert.NoError(err)
+	assert.Equal([]minerReputation{{Miner: m1000.String(), TotalDeals: 2, ConfirmedDeals: 1, FailedDeals: 1}}, exp.Miners)
+
+	// our own export is already counted
+	_, err = importMinerReputation(db, "self", exp)
+	assert.Error(err)
+
+	other := &minerReputationExport{
+		Version: minerReputationVersion,
+		Source:  "other",
+		Miners: []minerReputation{
+			{Miner: "f01000", TotalDeals: 8, ConfirmedDeals: 8},
+			{Miner: "f01001", TotalDeals: 4, ConfirmedDeals: 1, FailedDeals: 3},
+		},
+	}
+
+	// importing the same source twice replaces rather than adds
+	for i := 0; i < 2; i++ {
+		n, err := importMinerReputation(db, "self", other)
+		assert.NoError(err)
+		assert.Equal(2, n)
+	}
+
+	stats, err := localMinerDealStats(db)
+	assert.NoError(err)
+	assert.NoError(mergeImportedMinerStats(db, stats))
+
+	assert.Equal(10, stats[m1000].TotalDeals)
+	assert.Equal(9, stats[m1000].ConfirmedDeals)
+	assert.Equal(4, stats[m1001].TotalDeals)
+
+	// only the confirmed deal counts towards the bytes stored
+	assert.Equal(uint64(2048), stats[m1000].TotalBytesStored)
+
+	// imported stats never make it into our own exports
+	exp, err = exportMinerReputation(db, "self")
+	assert.NoError(err)
+	assert.Len(exp.Miners, 1)
+
+	bad := &minerReputationExport{
+		Version: minerReputationVersion,
+		Source:  "bad",
+		Miners:  []minerReputation{{Miner: "f01002", TotalDeals: 1, ConfirmedDeals: 2}},
+	}
+	_, err = importMinerReputation(db, "self", bad)
+	assert.Error(err)
+
+	// a miner without deals would have no success ratio
+	bad.Miners = []minerReputation{{Miner: "f01002"}}
+	_, err = importMinerReputation(db, "self", bad)
+	assert.Error(err)
+}
+
+func TestBackfillDealPieceSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &contentDeal{}, &proposalRecord{})
+
+	piece, _ := cid.Decode("baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq")
+	client, _ := address.NewIDAddress(100)
+	provider, _ := address.NewIDAddress(2000)
+
+	prop := &market.ClientDealProposal{
+		Proposal: market.DealProposal{
+			PieceCID:             piece,
+			PieceSize:            4096,
+			Client:               client,
+			Provider:             provider,
+			StoragePricePerEpoch: big.Zero(),
+			ProviderCollateral:   big.Zero(),
+			ClientCollateral:     big.Zero(),
+		},
+		ClientSignature: crypto.Signature{Type: crypto.SigTypeBLS, Data: []byte{}},
+	}
+	propCid, err := util.ProposalCid(prop)
+	assert.NoError(err)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(prop.MarshalCBOR(buf))
+	assert.NoError(db.Create(&proposalRecord{PropCid: util.DbCID{CID: propCid}, Data: buf.Bytes()}).Error)
+
+	// made before piece sizes were recorded, one with its proposal and one
+	// without
+	assert.NoError(db.Create(&contentDeal{Miner: "f02000", DealID: 1, PropCid: util.DbCID{CID: propCid}}).Error)
+	assert.NoError(db.Create(&contentDeal{Miner: "f02000", DealID: 2, PropCid: util.DbCID{CID: piece}}).Error)
+	assert.NoError(db.Create(&contentDeal{Miner: "f02000", DealID: 3, PieceSize: 2048}).Error)
+
+	n, err := backfillDealPieceSizes(context.Background(), db)
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	stored, err := minerBytesStored(db, "f02000")
+	assert.NoError(err)
+	assert.Equal(uint64(4096+2048), stored["f02000"])
+
+	var d contentDeal
+	assert.NoError(db.First(&d, "deal_id = ?", 1).Error)
+	assert.Equal(abi.PaddedPieceSize(4096), d.PieceSize)
+	assert.False(d.PieceSizeUnknown)
+
+	// the deal without a proposal isn't looked at again
+	var unknown contentDeal
+	assert.NoError(db.First(&unknown, "deal_id = ?", 2).Error)
+	assert.True(unknown.PieceSizeUnknown)
+
+	n, err = backfillDealPieceSizes(context.Background(), db)
+	assert.NoError(err)
+	assert.Zero(n)
+}
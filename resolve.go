@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipns"
+	ipns_pb "github.com/ipfs/go-ipns/pb"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+// how many names a resolution may go through, e.g. a DNSLink domain pointing
+// at an IPNS key pointing at another
+const maxResolveDepth = 8
+
+// the stdlib resolver doesn't tell us the TTL of DNS records, so DNSLink
+// answers are cached for this long
+const dnslinkTTL = time.Minute
+
+// how long an IPNS answer is cached for when its record doesn't say
+const defaultIpnsTTL = time.Minute
+
+const resolveTimeout = time.Second * 30
+
+// how many answers are cached, the least recently used go first
+const resolveCacheSize = 4096
+
+var (
+	// there is no record for the name, as opposed to a lookup that failed
+	errNameNotResolved = errors.New("name could not be resolved")
+	errInvalidName     = errors.New("invalid name")
+)
+
+type nameResolution struct {
+	Name      string `json:"name"`
+	Cid       string `json:"cid"`
+	Remainder string `json:"remainder"`
+	Path      string `json:"path"`
+	// the names the resolution went through, in order
+	Chain []string `json:"chain"`
+	// in seconds, how long the answer can be relied on for
+	TTL     int64     `json:"ttl"`
+	Expires time.Time `json:"expires"`
+}
+
+// nameResolver resolves IPNS keys through the routing system and DNSLink
+// domains through DNS, answers are cached for as long as their TTL
+type nameResolver struct {
+	routing   routing.ValueStore
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	cache *lru.Cache
+}
+
+func newNameResolver(r routing.ValueStore) *nameResolver {
+	cache, err := lru.New(resolveCacheSize)
+	if err != nil {
+		panic(err) // only errors on a size that isn't positive
+	}
+
+	return &nameResolver{
+		routing:   r,
+		lookupTXT: net.DefaultResolver.LookupTXT,
+		cache:     cache,
+	}
+}
+
+func (nr *nameResolver) cached(name string, now time.Time) (*nameResolution, bool) {
+	v, ok := nr.cache.Get(name)
+	if !ok {
+		return nil, false
+	}
+
+	res := v.(nameResolution)
+	if !now.Before(res.Expires) {
+		nr.cache.Remove(name)
+		return nil, false
+	}
+
+	res.TTL = int64(res.Expires.Sub(now) / time.Second)
+	return &res, true
+}
+
+func (nr *nameResolver) remember(res nameResolution) {
+	nr.cache.Add(res.Name, res)
+}
+
+// resolve follows a name to the cid it points at. Names can be given as
+// /ipns/<key or domain>/path, ipns://..., or just the key or domain. A
+// /ipfs/ path resolves to itself.
+func (nr *nameResolver) resolve(ctx context.Context, name string) (*nameResolution, error) {
+	now := time.Now()
+	if res, ok := nr.cached(name, now); ok {
+		return res, nil
+	}
+
+	p := name
+	var chain []string
+	var ttl time.Duration
+	for depth := 0; ; depth++ {
+		if depth > maxResolveDepth {
+			return nil, fmt.Errorf("%s goes through more than %d names: %w", name, maxResolveDepth, errNameNotResolved)
+		}
+
+		ns, key, rest, err := splitNamePath(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if ns == "ipfs" {
+			c, err := cid.Decode(key)
+			if err != nil {
+				return nil, fmt.Errorf("%s points at an invalid cid %q: %w", name, key, errInvalidName)
+			}
+
+			res := nameResolution{
+				Name:      name,
+				Cid:       c.String(),
+				Remainder: rest,
+				Path:      "/ipfs/" + c.String() + rest,
+				Chain:     chain,
+				TTL:       int64(ttl / time.Second),
+				Expires:   now.Add(ttl),
+			}
+			if ttl > 0 {
+				nr.remember(res)
+			}
+			return &res, nil
+		}
+
+		chain = append(chain, "/ipns/"+key)
+
+		target, kttl, err := nr.resolveKey(ctx, key, now)
+		if err != nil {
+			return nil, err
+		}
+
+		// the answer is only as good as the shortest lived record it used
+		if depth == 0 || kttl < ttl {
+			ttl = kttl
+		}
+
+		p = strings.TrimRight(target, "/") + rest
+	}
+}
+
+// resolveKey resolves one IPNS key or DNSLink domain to the path it points at
+func (nr *nameResolver) resolveKey(ctx context.Context, key string, now time.Time) (string, time.Duration, error) {
+	if pid, err := peer.Decode(key); err == nil {
+		return nr.resolveIpns(ctx, pid, now)
+	}
+
+	if strings.Contains(key, ".") {
+		p, err := nr.resolveDNSLink(ctx, key)
+		return p, dnslinkTTL, err
+	}
+
+	return "", 0, fmt.Errorf("%q is neither an IPNS key nor a domain: %w", key, errInvalidName)
+}
+
+func (nr *nameResolver) resolveIpns(ctx context.Context, pid peer.ID, now time.Time) (string, time.Duration, error) {
+	// the routing system checks the record's signature and validity before
+	// handing it to us
+	val, err := nr.routing.GetValue(ctx, ipns.RecordKey(pid))
+	if err != nil {
+		if errors.Is(err, routing.ErrNotFound) {
+			return "", 0, fmt.Errorf("no IPNS record found for %s: %w", pid, errNameNotResolved)
+		}
+		return "", 0, fmt.Errorf("looking up IPNS record for %s: %w", pid, err)
+	}
+
+	entry := new(ipns_pb.IpnsEntry)
+	if err := entry.Unmarshal(val); err != nil {
+		return "", 0, fmt.Errorf("invalid IPNS record for %s: %w", pid, err)
+	}
+
+	eol, err := ipns.GetEOL(entry)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid IPNS record for %s: %w", pid, err)
+	}
+	if !now.Before(eol) {
+		return "", 0, fmt.Errorf("IPNS record for %s expired at %s: %w", pid, eol, errNameNotResolved)
+	}
+
+	ttl := time.Duration(entry.GetTtl())
+	if ttl <= 0 {
+		ttl = defaultIpnsTTL
+	}
+	if left := eol.Sub(now); left < ttl {
+		ttl = left
+	}
+
+	// old records hold the raw cid rather than a path
+	v := string(entry.GetValue())
+	if c, err := cid.Cast(entry.GetValue()); err == nil {
+		v = "/ipfs/" + c.String()
+	}
+	return v, ttl, nil
+}
+
+func (nr *nameResolver) resolveDNSLink(ctx context.Context, domain string) (string, error) {
+	for _, host := range []string{"_dnslink." + domain, domain} {
+		txts, err := nr.lookupTXT(ctx, host)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				continue
+			}
+			return "", fmt.Errorf("looking up dnslink for %s: %w", domain, err)
+		}
+
+		if p, ok := parseDNSLink(txts); ok {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("no dnslink record found for %s: %w", domain, errNameNotResolved)
+}
+
+// parseDNSLink picks the dnslink path out of a domain's TXT records, with
+// several the lowest sorting one wins so that the answer is stable
+func parseDNSLink(txts []string) (string, bool) {
+	var paths []string
+	for _, txt := range txts {
+		txt = strings.TrimSpace(txt)
+		if !strings.HasPrefix(txt, "dnslink=") {
+			continue
+		}
+
+		p := strings.TrimSpace(strings.TrimPrefix(txt, "dnslink="))
+		if _, _, _, err := splitNamePath(p); err != nil || !strings.HasPrefix(p, "/") {
+			continue
+		}
+		paths = append(paths, p)
+	}
+
+	if len(paths) == 0 {
+		return "", false
+	}
+
+	sort.Strings(paths)
+	return paths[0], true
+}
+
+// splitNamePath splits a name into its namespace, ipfs or ipns, the cid, key
+// or domain, and the rest of the path, which is empty or starts with a slash
+func splitNamePath(p string) (string, string, string, error) {
+	switch {
+	case strings.HasPrefix(p, "ipns://"):
+		p = "/ipns/" + strings.TrimPrefix(p, "ipns://")
+	case strings.HasPrefix(p, "ipfs://"):
+		p = "/ipfs/" + strings.TrimPrefix(p, "ipfs://")
+	case !strings.HasPrefix(p, "/"):
+		p = "/ipns/" + p
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return "", "", "", fmt.Errorf("%q has no name to resolve: %w", p, errInvalidName)
+	}
+
+	ns, key := parts[0], parts[1]
+	if ns != "ipfs" && ns != "ipns" {
+		return "", "", "", fmt.Errorf("%q is not an /ipfs/ or /ipns/ path: %w", p, errInvalidName)
+	}
+
+	var rest string
+	if len(parts) == 3 {
+		rest = "/" + strings.TrimRight(parts[2], "/")
+		if rest == "/" {
+			rest = ""
+		}
+	}
+	return ns, key, rest, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipns"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+type memValueStore map[string][]byte
+
+func (m memValueStore) PutValue(ctx context.Context, k string, v []byte, opts ...routing.Option) error {
+	m[k] = v
+	return nil
+}
+
+func (m memValueStore) GetValue(ctx context.Context, k string, opts ...routing.Option) ([]byte, error) {
+	v, ok := m[k]
+	if !ok {
+		return nil, routing.ErrNotFound
+	}
+	return v, nil
+}
+
+func (m memValueStore) SearchValue(ctx context.Context, k string, opts ...routing.Option) (<-chan []byte, error) {
+	out := make(chan []byte, 1)
+	if v, ok := m[k]; ok {
+		out <- v
+	}
+	close(out)
+	return out, nil
+}
+
+func testCid(t *testing.T, data string) cid.Cid {
+	h, err := mh.Sum([]byte(data), mh.SHA2_256, -1)
+	require.NoError(t, err)
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+// publishIpns puts a record for a new key pointing at val, and returns the key
+func publishIpns(t *testing.T, vs memValueStore, val string, eol time.Time, ttl time.Duration) peer.ID {
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pid, err := peer.IDFromPrivateKey(sk)
+	require.NoError(t, err)
+
+	entry, err := ipns.Create(sk, []byte(val), 1, eol, ttl)
+	require.NoError(t, err)
+	data, err := entry.Marshal()
+	require.NoError(t, err)
+
+	vs[ipns.RecordKey(pid)] = data
+	return pid
+}
+
+func testResolver(vs memValueStore, txts map[string][]string) *nameResolver {
+	nr := newNameResolver(vs)
+	nr.lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if t, ok := txts[name]; ok {
+			return t, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nr
+}
+
+func TestSplitNamePath(t *testing.T) {
+	cases := []struct {
+		in        string
+		ns, key   string
+		remainder string
+	}{
+		{"example.com", "ipns", "example.com", ""},
+		{"/ipns/example.com/a/b/", "ipns", "example.com", "/a/b"},
+		{"ipns://example.com/a", "ipns", "example.com", "/a"},
+		{"/ipfs/bafkqaaa/c", "ipfs", "bafkqaaa", "/c"},
+		{"ipfs://bafkqaaa", "ipfs", "bafkqaaa", ""},
+	}
+	for _, c := range cases {
+		ns, key, rest, err := splitNamePath(c.in)
+		require.NoError(t, err, c.in)
+		require.Equal(t, c.ns, ns, c.in)
+		require.Equal(t, c.key, key, c.in)
+		require.Equal(t, c.remainder, rest, c.in)
+	}
+
+	for _, in := range []string{"/ipns/", "/ipld/foo", "/"} {
+		_, _, _, err := splitNamePath(in)
+		require.ErrorIs(t, err, errInvalidName, in)
+	}
+}
+
+func TestParseDNSLink(t *testing.T) {
+	p, ok := parseDNSLink([]string{"v=spf1 -all", " dnslink=/ipns/example.com ", "dnslink=/ipfs/bafkqaaa/x"})
+	require.True(t, ok)
+	require.Equal(t, "/ipfs/bafkqaaa/x", p)
+
+	_, ok = parseDNSLink([]string{"dnslink=", "dnslink=example.com", "something else"})
+	require.False(t, ok)
+}
+
+func TestResolveName(t *testing.T) {
+	ctx := context.Background()
+	vs := memValueStore{}
+	target := testCid(t, "site")
+
+	pid := publishIpns(t, vs, "/ipfs/"+target.String()+"/docs", time.Now().Add(time.Hour), time.Minute*5)
+	nr := testResolver(vs, map[string][]string{
+		"_dnslink.example.com": {"dnslink=/ipns/" + pid.String() + "/v1"},
+	})
+
+	res, err := nr.resolve(ctx, "example.com/index.html")
+	require.NoError(t, err)
+	require.Equal(t, target.String(), res.Cid)
+	require.Equal(t, "/docs/v1/index.html", res.Remainder)
+	require.Equal(t, "/ipfs/"+target.String()+"/docs/v1/index.html", res.Path)
+	require.Equal(t, []string{"/ipns/example.com", "/ipns/" + pid.String()}, res.Chain)
+	// dnslink answers are kept for less time than the ipns record
+	require.Equal(t, int64(dnslinkTTL/time.Second), res.TTL)
+
+	res, err = nr.resolve(ctx, "/ipns/"+pid.String())
+	require.NoError(t, err)
+	require.Equal(t, target.String(), res.Cid)
+	require.Equal(t, "/docs", res.Remainder)
+	require.Equal(t, int64(300), res.TTL)
+
+	// answers are cached until they expire
+	delete(vs, ipns.RecordKey(pid))
+	_, err = nr.resolve(ctx, "/ipns/"+pid.String())
+	require.NoError(t, err)
+
+	_, err = nr.resolve(ctx, pid.String())
+	require.ErrorIs(t, err, errNameNotResolved)
+
+	_, err = nr.resolve(ctx, "nothing.example.com")
+	require.ErrorIs(t, err, errNameNotResolved)
+
+	_, err = nr.resolve(ctx, "not-a-key")
+	require.ErrorIs(t, err, errInvalidName)
+}
+
+func TestResolveNameLoop(t *testing.T) {
+	nr := testResolver(memValueStore{}, map[string][]string{
+		"_dnslink.a.example.com": {"dnslink=/ipns/b.example.com"},
+		"_dnslink.b.example.com": {"dnslink=/ipns/a.example.com"},
+	})
+
+	_, err := nr.resolve(context.Background(), "a.example.com")
+	require.ErrorIs(t, err, errNameNotResolved)
+}
+
+func TestResolveNameLookupFailure(t *testing.T) {
+	nr := testResolver(memValueStore{}, nil)
+	nr.lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+
+	_, err := nr.resolve(context.Background(), "example.com")
+	require.Error(t, err)
+	require.False(t, errors.Is(err, errNameNotResolved))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/application-research/estuary/util"
@@ -10,6 +11,9 @@ import (
 	"github.com/application-research/filclient/retrievehelper"
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/ipfs/go-cid"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -32,14 +36,30 @@ func (s *Server) retrievalAsksForContent(ctx context.Context, contid uint) (map[
 	}
 
 	fmt.Printf("looking at %d deals for content: %s\n", len(deals), content.Cid.CID)
-	out := make(map[address.Address]*retrievalmarket.QueryResponse)
+	var miners []address.Address
 	for _, d := range deals {
 		maddr, err := d.MinerAddr()
 		if err != nil {
 			return nil, err
 		}
+		miners = append(miners, maddr)
+	}
+
+	// without deals of our own, try whoever the indexer says has it
+	if len(miners) == 0 && s.CM.indexerURL != "" {
+		indexed, err := s.CM.indexedMiners(ctx, content.Cid.CID)
+		if err != nil {
+			log.Errorf("failed to find providers for %s through the indexer: %s", content.Cid.CID, err)
+		}
+		fmt.Printf("found %d miners for content through the indexer: %s\n", len(indexed), content.Cid.CID)
+		miners = indexed
+	}
+
+	out := make(map[address.Address]*retrievalmarket.QueryResponse)
+	for _, maddr := range miners {
+		s.CM.connectMinerOverride(ctx, maddr)
 
-		resp, err := s.FilClient.RetrievalQuery(ctx, maddr, content.Cid.CID)
+		resp, err := s.CM.retrievalQuery(ctx, maddr, content.Cid.CID)
 		if err != nil {
 			s.CM.recordRetrievalFailure(&util.RetrievalFailureRecord{
 				Miner:   maddr.String(),
@@ -58,6 +78,86 @@ func (s *Server) retrievalAsksForContent(ctx context.Context, contid uint) (map[
 	return out, nil
 }
 
+// libp2p protocols a miner may speak that relate to retrievals, keyed by the
+// transport they belong to
+var retrievalProtocols = map[string][]string{
+	"graphsync":  {"/ipfs/graphsync/2.0.0", "/ipfs/graphsync/1.0.0"},
+	"bitswap":    {"/ipfs/bitswap/1.2.0", "/ipfs/bitswap/1.1.0", "/ipfs/bitswap/1.0.0", "/ipfs/bitswap"},
+	"transports": {"/fil/retrieval/transports/1.0.0"},
+}
+
+type minerRetrievalProtocols struct {
+	Miner      string   `json:"miner"`
+	PeerID     string   `json:"peerId"`
+	Query      bool     `json:"query"`
+	Transports []string `json:"transports"`
+	Protocols  []string `json:"protocols"`
+
+	// Usable is false when the miner can't be retrieved from by us, even if
+	// it answers retrieval queries
+	Usable bool `json:"usable"`
+
+	// the protocol versions we'd retrieve with, or why there are none
+	Negotiated       *retrievalNegotiation `json:"negotiated,omitempty"`
+	NegotiationError string                `json:"negotiationError,omitempty"`
+}
+
+// minerRetrievalProtocols connects to a miner and reports which retrieval
+// related protocols it advertises through libp2p identify
+func (cm *ContentManager) minerRetrievalProtocols(ctx context.Context, maddr address.Address) (*minerRetrievalProtocols, error) {
+	ctx, span := cm.tracer.Start(ctx, "minerRetrievalProtocols", trace.WithAttributes(
+		attribute.Stringer("miner", maddr),
+	))
+	defer span.End()
+
+	cm.connectMinerOverride(ctx, maddr)
+
+	pid, protos, err := cm.minerProtocols(ctx, maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &minerRetrievalProtocols{
+		Miner:  maddr.String(),
+		PeerID: pid.String(),
+	}
+
+	query, err := cm.Host.Peerstore().SupportsProtocols(pid, filclient.RetrievalQueryProtocol)
+	if err != nil {
+		return nil, err
+	}
+	out.Query = len(query) > 0
+	out.Protocols = append(out.Protocols, query...)
+
+	for transport, protos := range retrievalProtocols {
+		supported, err := cm.Host.Peerstore().SupportsProtocols(pid, protos...)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(supported) > 0 {
+			out.Transports = append(out.Transports, transport)
+			out.Protocols = append(out.Protocols, supported...)
+		}
+	}
+	sort.Strings(out.Transports)
+
+	// we only know how to retrieve from miners over graphsync
+	for _, t := range out.Transports {
+		if t == "graphsync" {
+			out.Usable = out.Query
+		}
+	}
+
+	out.Negotiated, err = negotiateRetrievalProtocols(protos)
+	if err != nil {
+		out.NegotiationError = err.Error()
+		out.Usable = false
+	}
+
+	return out, nil
+}
+
 func (cm *ContentManager) recordRetrievalFailure(rfr *util.RetrievalFailureRecord) error {
 	return cm.DB.Create(rfr).Error
 }
@@ -83,7 +183,7 @@ func (s *Server) retrieveContent(ctx context.Context, contid uint) error {
 	}
 
 	for m, ask := range asks {
-		if err := s.CM.tryRetrieve(ctx, m, content.Cid.CID, ask); err != nil {
+		if err := s.CM.tryRetrieve(ctx, m, contid, content.Cid.CID, ask); err != nil {
 			log.Errorw("failed to retrieve content", "miner", m, "content", content.Cid.CID, "err", err)
 			s.CM.recordRetrievalFailure(&util.RetrievalFailureRecord{
 				Miner:   m.String(),
@@ -101,28 +201,174 @@ func (s *Server) retrieveContent(ctx context.Context, contid uint) error {
 	return nil
 }
 
-func (cm *ContentManager) tryRetrieve(ctx context.Context, maddr address.Address, c cid.Cid, ask *retrievalmarket.QueryResponse) error {
+func parseRetrievalPriceCap(s string) (abi.TokenAmount, error) {
+	if s == "" {
+		return abi.TokenAmount{}, nil
+	}
+
+	amt, err := types.ParseFIL(s)
+	if err != nil {
+		return abi.TokenAmount{}, err
+	}
+
+	return abi.TokenAmount(amt), nil
+}
+
+// retrievalCost splits what a miner asks for a retrieval into the one-time
+// unseal payment and the per-byte payment for streaming the data. Miners may
+// quote either one as zero.
+type retrievalCost struct {
+	Unseal   abi.TokenAmount
+	Transfer abi.TokenAmount
+}
+
+func costForAsk(ask *retrievalmarket.QueryResponse) retrievalCost {
+	return retrievalCost{
+		Unseal:   ask.UnsealPrice,
+		Transfer: big.Mul(ask.MinPricePerByte, big.NewIntUnsigned(ask.Size)),
+	}
+}
+
+// authorizeRetrieval checks the unseal and transfer costs of a retrieval
+// against their caps independently
+func (cm *ContentManager) authorizeRetrieval(maddr address.Address, cost retrievalCost) error {
+	if !cm.retrievalMaxUnsealPrice.Nil() && cost.Unseal.GreaterThan(cm.retrievalMaxUnsealPrice) {
+		return fmt.Errorf("miner %s unseal price %s exceeds max unseal price %s", maddr, types.FIL(cost.Unseal), types.FIL(cm.retrievalMaxUnsealPrice))
+	}
+
+	if !cm.retrievalMaxTransferPrice.Nil() && cost.Transfer.GreaterThan(cm.retrievalMaxTransferPrice) {
+		return fmt.Errorf("miner %s transfer price %s exceeds max transfer price %s", maddr, types.FIL(cost.Transfer), types.FIL(cm.retrievalMaxTransferPrice))
+	}
+
+	log.Infow("authorized retrieval", "miner", maddr, "unsealPrice", types.FIL(cost.Unseal), "transferPrice", types.FIL(cost.Transfer))
+	return nil
+}
+
+// tryRetrieve pays for the retrieval out of filclient's payment channel to
+// the miner. filclient's paychmgr keeps one channel per client and miner and
+// reuses it for every retrieval from that miner. How much goes into it ahead
+// of the retrieval is up to the funding strategy, see fundRetrievalPaych.
+func (cm *ContentManager) tryRetrieve(ctx context.Context, maddr address.Address, contID uint, c cid.Cid, ask *retrievalmarket.QueryResponse) error {
+	cost := costForAsk(ask)
+	if err := cm.authorizeRetrieval(maddr, cost); err != nil {
+		return err
+	}
 
-	proposal, err := retrievehelper.RetrievalProposalForAsk(ask, c, nil)
+	protos, err := cm.negotiateRetrieval(ctx, maddr)
 	if err != nil {
 		return err
 	}
 
-	stats, err := cm.FilClient.RetrieveContent(ctx, maddr, proposal)
+	cp, err := cm.newRetrievalCheckpointer(contID, c)
 	if err != nil {
 		return err
 	}
 
-	cm.recordRetrievalSuccess(c, maddr, stats)
+	// pick up from the last checkpoint of an earlier attempt, if any
+	sel, done, err := cp.resume(ctx)
+	if err != nil {
+		return err
+	}
+
+	if done {
+		log.Infow("content was fully retrieved before, nothing left to fetch", "content", contID, "cid", c)
+		return cp.finish()
+	}
+
+	proposal, err := retrievehelper.RetrievalProposalForAsk(cm.retrievalAskWithPaymentInterval(maddr, ask), c, sel)
+	if err != nil {
+		return err
+	}
+
+	funding, release, err := cm.fundRetrievalPaych(ctx, maddr, cost)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	stats, err := util.RetrieveContentWithStats(ctx, cm.FilClient, maddr, proposal, cp.progress, cm.retrievalStatsSink(contID))
+	if err != nil {
+		// keep whatever made it in for the next attempt
+		if cerr := cp.checkpoint(context.Background()); cerr != nil {
+			log.Warnw("failed to checkpoint retrieval", "content", contID, "err", cerr)
+		}
+		return err
+	}
+
+	if sel != nil {
+		// a resumed retrieval only fetched part of the dag, make sure the
+		// rest is still there
+		ok, err := cp.dagComplete(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			if err := cp.reset(); err != nil {
+				return err
+			}
+			return fmt.Errorf("content %d is incomplete after resuming its retrieval, it will be retrieved in full next time", contID)
+		}
+	}
+
+	if err := cp.finish(); err != nil {
+		log.Warnw("failed to clear retrieval checkpoint", "content", contID, "err", err)
+	}
+
+	cm.recordRetrievalSuccess(contID, c, maddr, stats, cost, proposal.PaymentInterval, protos, funding, nil)
 	return nil
 }
 
+// retrievalStatsSink returns a channel for util.RetrieveContentWithStats that
+// keeps the latest snapshot of the content's retrieval, for
+// handleGetRetrievalProgress to serve
+func (cm *ContentManager) retrievalStatsSink(contID uint) chan util.RetrievalStatsSnapshot {
+	cm.retrLk.Lock()
+	prog := cm.retrievalsInProgress[contID]
+	cm.retrLk.Unlock()
+
+	updates := make(chan util.RetrievalStatsSnapshot, 1)
+	go func() {
+		for st := range updates {
+			if prog != nil {
+				prog.SetStats(st)
+			}
+		}
+	}()
+	return updates
+}
+
+// retrievalAskWithPaymentInterval returns the ask with our configured payment
+// interval applied. Smaller intervals mean more payments, but less is lost
+// if the transfer dies part way through. The interval is clamped to the
+// miner's maximum, which it would reject the proposal over.
+func (cm *ContentManager) retrievalAskWithPaymentInterval(maddr address.Address, ask *retrievalmarket.QueryResponse) *retrievalmarket.QueryResponse {
+	if cm.retrievalPaymentInterval == 0 {
+		return ask
+	}
+
+	interval := cm.retrievalPaymentInterval
+	if interval > ask.MaxPaymentInterval {
+		log.Infow("configured payment interval is larger than the miner allows, clamping it to the miner's maximum",
+			"miner", maddr, "interval", interval, "max", ask.MaxPaymentInterval)
+		interval = ask.MaxPaymentInterval
+	}
+
+	out := *ask
+	out.MaxPaymentInterval = interval
+	if out.MaxPaymentIntervalIncrease > interval {
+		out.MaxPaymentIntervalIncrease = interval
+	}
+	return &out
+}
+
 type retrievalSuccessRecord struct {
 	ID        uint      `gorm:"primarykey" json:"-"`
 	CreatedAt time.Time `json:"createdAt"`
 
-	Cid   util.DbCID `json:"cid"`
-	Miner string     `json:"miner"`
+	Content uint       `json:"content" gorm:"index"`
+	Cid     util.DbCID `json:"cid"`
+	Miner   string     `json:"miner"`
 
 	Peer         string `json:"peer"`
 	Size         uint64 `json:"size"`
@@ -131,10 +377,41 @@ type retrievalSuccessRecord struct {
 	TotalPayment string `json:"totalPayment"`
 	NumPayments  int    `json:"numPayments"`
 	AskPrice     string `json:"askPrice"`
+
+	UnsealPayment   string `json:"unsealPayment"`
+	TransferPayment string `json:"transferPayment"`
+	PaymentInterval uint64 `json:"paymentInterval"`
+
+	// retrieval protocol versions negotiated with the miner, comma
+	// separated, empty if it didn't advertise any
+	Protocols string `json:"protocols"`
+
+	// how the payment channel was funded for the retrieval and what it had
+	// left after, empty when funding was left to filclient
+	PaychFunding string `json:"paychFunding,omitempty"`
+	Paych        string `json:"paych,omitempty"`
+	PaychFunded  string `json:"paychFunded,omitempty"`
+	PaychBalance string `json:"paychBalance,omitempty"`
+
+	// set when only the content's link of the aggregate it is in was
+	// retrieved, with how much less that fetched than the whole aggregate
+	Aggregate  uint   `json:"aggregate,omitempty"`
+	BytesSaved uint64 `json:"bytesSaved,omitempty"`
 }
 
-func (cm *ContentManager) recordRetrievalSuccess(cc cid.Cid, m address.Address, rstats *filclient.RetrievalStats) {
-	if err := cm.DB.Create(&retrievalSuccessRecord{
+func (cm *ContentManager) recordRetrievalSuccess(contID uint, cc cid.Cid, m address.Address, rstats *filclient.RetrievalStats, cost retrievalCost, paymentInterval uint64, protos *retrievalNegotiation, funding *paychFunding, partial *partialRetrieval) {
+	// the unseal price is paid up front, whatever remains was paid for the transfer
+	transferPayment := big.Sub(rstats.TotalPayment, cost.Unseal)
+	if transferPayment.LessThan(big.Zero()) {
+		transferPayment = big.Zero()
+	}
+
+	log.Infow("retrieval finished", "miner", m, "cid", cc, "size", rstats.Size, "duration", rstats.Duration,
+		"unsealPayment", types.FIL(cost.Unseal), "transferPayment", types.FIL(transferPayment), "totalPayment", types.FIL(rstats.TotalPayment),
+		"paymentInterval", paymentInterval, "numPayments", rstats.NumPayments, "protocols", protos.String())
+
+	rec := &retrievalSuccessRecord{
+		Content:      contID,
 		Cid:          util.DbCID{cc},
 		Miner:        m.String(),
 		Peer:         rstats.Peer.String(),
@@ -144,7 +421,19 @@ func (cm *ContentManager) recordRetrievalSuccess(cc cid.Cid, m address.Address,
 		TotalPayment: rstats.TotalPayment.String(),
 		NumPayments:  rstats.NumPayments,
 		AskPrice:     rstats.AskPrice.String(),
-	}).Error; err != nil {
+
+		UnsealPayment:   cost.Unseal.String(),
+		TransferPayment: transferPayment.String(),
+		PaymentInterval: paymentInterval,
+		Protocols:       protos.String(),
+	}
+	if partial != nil {
+		rec.Aggregate = partial.Aggregate
+		rec.BytesSaved = partial.BytesSaved
+	}
+	cm.finishPaychFunding(context.TODO(), m, funding, rec)
+
+	if err := cm.DB.Create(rec).Error; err != nil {
 		log.Errorf("failed to write retrieval success record: %s", err)
 	}
 }
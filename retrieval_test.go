@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrievalAskWithPaymentInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	maddr, _ := address.NewIDAddress(1000)
+	ask := &retrievalmarket.QueryResponse{
+		MaxPaymentInterval:         2 << 20,
+		MaxPaymentIntervalIncrease: 2 << 20,
+	}
+
+	// nothing configured leaves the miner's terms
+	cm := &ContentManager{}
+	assert.Equal(ask, cm.retrievalAskWithPaymentInterval(maddr, ask))
+
+	cm.retrievalPaymentInterval = 1 << 20
+	out := cm.retrievalAskWithPaymentInterval(maddr, ask)
+	assert.Equal(uint64(1<<20), out.MaxPaymentInterval)
+	assert.Equal(uint64(1<<20), out.MaxPaymentIntervalIncrease)
+
+	// more than the miner allows is clamped to its maximum
+	cm.retrievalPaymentInterval = 4 << 20
+	out = cm.retrievalAskWithPaymentInterval(maddr, ask)
+	assert.Equal(uint64(2<<20), out.MaxPaymentInterval)
+	assert.Equal(uint64(2<<20), out.MaxPaymentIntervalIncrease)
+}
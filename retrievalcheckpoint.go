@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// retrievalCheckpoint is how far a retrieval of a content got when it was
+// last checkpointed, so that a retrieval cut short by a crash or a failed
+// transfer picks up where it left off instead of fetching the whole dag again
+type retrievalCheckpoint struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Content uint `gorm:"unique"`
+	Root    util.DbCID
+
+	// bytes received by the retrieval that made the checkpoint
+	Received uint64
+}
+
+// retrievalSubtree is a subtree under the root of a retrieval that was all
+// in our blockstore, and synced to disk, at a checkpoint
+type retrievalSubtree struct {
+	ID      uint `gorm:"primarykey"`
+	Content uint `gorm:"index"`
+	Link    int
+	Cid     util.DbCID
+}
+
+// retrievalCheckpointer records the progress of one retrieval of a content.
+// Checkpoints are taken every interval bytes, in the background so that the
+// transfer isn't held up by them.
+type retrievalCheckpointer struct {
+	db          *gorm.DB
+	dserv       ipld.DAGService
+	sync        func(context.Context) error
+	concurrency int
+
+	content  uint
+	root     cid.Cid
+	interval uint64
+
+	lk       sync.Mutex
+	next     uint64
+	received uint64
+	running  bool
+
+	// held while taking a checkpoint
+	cpLk     sync.Mutex
+	closed   bool
+	complete map[int]bool
+}
+
+func (cm *ContentManager) newRetrievalCheckpointer(content uint, root cid.Cid) (*retrievalCheckpointer, error) {
+	bs := cm.Node.Blockstore
+	rc := &retrievalCheckpointer{
+		db:          cm.DB,
+		dserv:       merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))),
+		sync:        cm.Node.SyncBlockstore,
+		concurrency: cm.dagWalkConcurrency,
+		content:     content,
+		root:        root,
+		interval:    cm.retrievalCheckpointBytes,
+		next:        cm.retrievalCheckpointBytes,
+		complete:    make(map[int]bool),
+	}
+
+	var cp retrievalCheckpoint
+	if err := cm.DB.First(&cp, "content = ?", content).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return rc, nil
+		}
+		return nil, err
+	}
+
+	// the content was retrieved under another root before, none of what we
+	// have is of use
+	if cp.Root.CID != root {
+		if err := rc.reset(); err != nil {
+			return nil, err
+		}
+		return rc, nil
+	}
+
+	var subtrees []retrievalSubtree
+	if err := cm.DB.Find(&subtrees, "content = ?", content).Error; err != nil {
+		return nil, err
+	}
+
+	for _, st := range subtrees {
+		rc.complete[st.Link] = true
+	}
+	return rc, nil
+}
+
+// progress is the progress callback of the retrieval, it kicks off a
+// checkpoint whenever another interval worth of bytes came in
+func (rc *retrievalCheckpointer) progress(received uint64) {
+	if rc.interval == 0 {
+		return
+	}
+
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+
+	rc.received = received
+	if received < rc.next || rc.running {
+		return
+	}
+
+	rc.next = received + rc.interval
+	rc.running = true
+	go func() {
+		defer func() {
+			rc.lk.Lock()
+			rc.running = false
+			rc.lk.Unlock()
+		}()
+
+		if err := rc.checkpoint(context.Background()); err != nil {
+			log.Warnw("failed to checkpoint retrieval", "content", rc.content, "err", err)
+		}
+	}()
+}
+
+// checkpoint syncs the blockstore and then records which subtrees under the
+// root are complete, only what was synced counts
+func (rc *retrievalCheckpointer) checkpoint(ctx context.Context) error {
+	if rc.interval == 0 {
+		return nil
+	}
+
+	rc.cpLk.Lock()
+	defer rc.cpLk.Unlock()
+
+	if rc.closed {
+		return nil
+	}
+
+	rc.lk.Lock()
+	received := rc.received
+	rc.lk.Unlock()
+
+	if err := rc.sync(ctx); err != nil {
+		return xerrors.Errorf("failed to sync blockstore: %w", err)
+	}
+
+	links, err := rc.rootLinks(ctx)
+	if err != nil {
+		return err
+	}
+
+	var done []retrievalSubtree
+	for i, l := range links {
+		if rc.complete[i] {
+			continue
+		}
+
+		ok, err := rc.dagComplete(ctx, l.Cid)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			done = append(done, retrievalSubtree{
+				Content: rc.content,
+				Link:    i,
+				Cid:     util.DbCID{l.Cid},
+			})
+		}
+	}
+
+	err = rc.db.Transaction(func(tx *gorm.DB) error {
+		var cp retrievalCheckpoint
+		if err := tx.FirstOrCreate(&cp, retrievalCheckpoint{Content: rc.content, Root: util.DbCID{rc.root}}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&cp).Update("received", received).Error; err != nil {
+			return err
+		}
+
+		if len(done) == 0 {
+			return nil
+		}
+		return tx.Create(&done).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, st := range done {
+		rc.complete[st.Link] = true
+	}
+
+	log.Infow("checkpointed retrieval", "content", rc.content, "received", received, "complete", len(rc.complete), "subtrees", len(links))
+	return nil
+}
+
+// rootLinks returns the links of the root, nil if we don't have the root yet
+func (rc *retrievalCheckpointer) rootLinks(ctx context.Context) ([]*ipld.Link, error) {
+	if rc.root.Type() == cid.Raw {
+		return nil, nil
+	}
+
+	nd, err := rc.dserv.Get(ctx, rc.root)
+	if err != nil {
+		if xerrors.Is(err, ipld.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return nd.Links(), nil
+}
+
+// dagComplete checks that every block of the dag under root is in the
+// blockstore
+func (rc *retrievalCheckpointer) dagComplete(ctx context.Context, root cid.Cid) (bool, error) {
+	err := util.WalkDag(ctx, rc.dserv, root, cid.NewSet().Visit, rc.concurrency, nil)
+	if err != nil {
+		if xerrors.Is(err, ipld.ErrNotFound) || xerrors.Is(err, blockstore.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// resume returns the selector for the part of the dag the last checkpoint
+// didn't have yet, nil to retrieve all of it. done is true if the whole dag
+// is in the blockstore already.
+func (rc *retrievalCheckpointer) resume(ctx context.Context) (sel ipldprime.Node, done bool, err error) {
+	if len(rc.complete) == 0 {
+		return nil, false, nil
+	}
+
+	links, err := rc.rootLinks(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if links == nil {
+		// the root went away since the checkpoint
+		return nil, false, rc.reset()
+	}
+
+	sel = resumeSelector(len(links), rc.complete)
+	if sel == nil {
+		ok, err := rc.dagComplete(ctx, rc.root)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !ok {
+			// what was checkpointed went away since, start over
+			return nil, false, rc.reset()
+		}
+		return nil, true, nil
+	}
+
+	log.Infow("resuming retrieval from checkpoint", "content", rc.content, "complete", len(rc.complete), "subtrees", len(links))
+	return sel, false, nil
+}
+
+// reset drops the checkpoints of the content to start over from nothing
+func (rc *retrievalCheckpointer) reset() error {
+	rc.cpLk.Lock()
+	defer rc.cpLk.Unlock()
+
+	return rc.resetLocked()
+}
+
+// finish drops the checkpoints of the content once the retrieval is done,
+// and stops any more from being taken
+func (rc *retrievalCheckpointer) finish() error {
+	rc.cpLk.Lock()
+	defer rc.cpLk.Unlock()
+
+	rc.closed = true
+	return rc.resetLocked()
+}
+
+func (rc *retrievalCheckpointer) resetLocked() error {
+	rc.complete = make(map[int]bool)
+
+	return rc.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("content = ?", rc.content).Delete(&retrievalSubtree{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("content = ?", rc.content).Delete(&retrievalCheckpoint{}).Error
+	})
+}
+
+// resumeSelector selects the root and every subtree under it that isn't
+// complete, for a unixfs (dag-pb) root with the given number of links. It
+// returns nil if every subtree is complete.
+func resumeSelector(links int, complete map[int]bool) ipldprime.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	all := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+
+	// incomplete subtrees usually come in runs, graphsync fetches them in
+	// order, so select each run as one range
+	var ranges []builder.SelectorSpec
+	for i := 0; i < links; i++ {
+		if complete[i] {
+			continue
+		}
+
+		start := i
+		for i < links && !complete[i] {
+			i++
+		}
+
+		ranges = append(ranges, ssb.ExploreRange(int64(start), int64(i), ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Hash", all)
+		})))
+	}
+
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	sel := ranges[0]
+	if len(ranges) > 1 {
+		sel = ssb.ExploreUnion(ranges...)
+	}
+
+	return ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("Links", sel)
+	}).Node()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/stretchr/testify/require"
+)
+
+// selectedBlocks returns every block the selector visits in the dag under root
+func selectedBlocks(t *testing.T, bs blockstore.Blockstore, root cid.Cid, sel ipldprime.Node) *cid.Set {
+	ctx := context.Background()
+
+	parsed, err := selector.ParseSelector(sel)
+	require.NoError(t, err)
+
+	seen := cid.NewSet()
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx ipldprime.LinkContext, l ipldprime.Link) (io.Reader, error) {
+		c := l.(cidlink.Link).Cid
+		seen.Add(c)
+
+		blk, err := bs.Get(lctx.Ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+
+	nd, err := lsys.Load(ipldprime.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+	require.NoError(t, err)
+
+	err = traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:        ctx,
+			LinkSystem: lsys,
+			LinkTargetNodePrototypeChooser: func(ipldprime.Link, ipldprime.LinkContext) (ipldprime.NodePrototype, error) {
+				return basicnode.Prototype.Any, nil
+			},
+		},
+	}.WalkAdv(nd, parsed, func(traversal.Progress, ipldprime.Node, traversal.VisitReason) error { return nil })
+	require.NoError(t, err)
+
+	seen.Add(root)
+	return seen
+}
+
+func TestRetrievalCheckpoint(t *testing.T) {
+	ctx := context.Background()
+
+	db := newTestDB(t, &retrievalCheckpoint{}, &retrievalSubtree{})
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	source := io.LimitReader(rand.New(rand.NewSource(7)), 4*1024*1024)
+	nd, err := util.ImportFile(dserv, source)
+	require.NoError(t, err)
+
+	links := nd.Links()
+	require.Greater(t, len(links), 3)
+
+	var synced int
+	rc := &retrievalCheckpointer{
+		db:    db,
+		dserv: dserv,
+		sync: func(context.Context) error {
+			synced++
+			return nil
+		},
+		content:  1,
+		root:     nd.Cid(),
+		interval: 1 << 20,
+		complete: make(map[int]bool),
+	}
+
+	// drop the blocks of the second subtree on, as if the retrieval got cut
+	// short after the first one
+	dropped := cid.NewSet()
+	for _, l := range links[1:] {
+		require.NoError(t, merkledag.Walk(ctx, merkledag.GetLinksWithDAG(dserv), l.Cid, dropped.Visit))
+	}
+	require.NoError(t, dropped.ForEach(func(c cid.Cid) error {
+		return bs.DeleteBlock(ctx, c)
+	}))
+
+	rc.received = 1 << 20
+	require.NoError(t, rc.checkpoint(ctx))
+	require.Equal(t, 1, synced)
+	require.Equal(t, map[int]bool{0: true}, rc.complete)
+
+	var cp retrievalCheckpoint
+	require.NoError(t, db.First(&cp, "content = ?", 1).Error)
+	require.Equal(t, uint64(1<<20), cp.Received)
+
+	// a new attempt picks up the checkpoint and only asks for the rest
+	rc2 := &retrievalCheckpointer{
+		db:       db,
+		dserv:    dserv,
+		content:  1,
+		root:     nd.Cid(),
+		complete: map[int]bool{0: true},
+	}
+	sel, done, err := rc2.resume(ctx)
+	require.NoError(t, err)
+	require.False(t, done)
+	require.NotNil(t, sel)
+
+	// import the same file again to see what the selector covers of the
+	// whole dag: everything but the first subtree
+	rebuilt := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	rebuiltDserv := merkledag.NewDAGService(blockservice.New(rebuilt, offline.Exchange(rebuilt)))
+	nd2, err := util.ImportFile(rebuiltDserv, io.LimitReader(rand.New(rand.NewSource(7)), 4*1024*1024))
+	require.NoError(t, err)
+	require.Equal(t, nd.Cid(), nd2.Cid())
+
+	visited := selectedBlocks(t, rebuilt, nd.Cid(), sel)
+	first := cid.NewSet()
+	require.NoError(t, merkledag.Walk(ctx, merkledag.GetLinksWithDAG(rebuiltDserv), links[0].Cid, first.Visit))
+	all := cid.NewSet()
+	require.NoError(t, merkledag.Walk(ctx, merkledag.GetLinksWithDAG(rebuiltDserv), nd.Cid(), all.Visit))
+
+	require.NoError(t, first.ForEach(func(c cid.Cid) error {
+		require.False(t, visited.Has(c), "selector visits a block of a complete subtree")
+		return nil
+	}))
+	require.Equal(t, all.Len()-first.Len(), visited.Len())
+
+	// once everything is there, there's nothing left to fetch
+	rc3 := &retrievalCheckpointer{
+		db:       db,
+		dserv:    rebuiltDserv,
+		content:  1,
+		root:     nd.Cid(),
+		complete: make(map[int]bool),
+	}
+	for i := range links {
+		rc3.complete[i] = true
+	}
+	_, done, err = rc3.resume(ctx)
+	require.NoError(t, err)
+	require.True(t, done)
+
+	require.NoError(t, rc3.finish())
+	var count int64
+	require.NoError(t, db.Model(&retrievalSubtree{}).Count(&count).Error)
+	require.Zero(t, count)
+	require.NoError(t, db.Model(&retrievalCheckpoint{}).Count(&count).Error)
+	require.Zero(t, count)
+
+	// a finished checkpointer takes no more checkpoints
+	rc3.interval = 1
+	rc3.sync = func(context.Context) error { return nil }
+	require.NoError(t, rc3.checkpoint(ctx))
+	require.NoError(t, db.Model(&retrievalCheckpoint{}).Count(&count).Error)
+	require.Zero(t, count)
+}
+
+func TestResumeSelector(t *testing.T) {
+	require.Nil(t, resumeSelector(3, map[int]bool{0: true, 1: true, 2: true}))
+
+	for _, complete := range []map[int]bool{
+		{0: true},
+		{1: true},
+		{0: true, 2: true, 3: true},
+	} {
+		sel := resumeSelector(5, complete)
+		require.NotNil(t, sel)
+
+		_, err := selector.ParseSelector(sel)
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/ipfs/go-cid"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	"golang.org/x/xerrors"
+)
+
+// errNoCompatibleRetrievalProtocol is wrapped by the errors of miners we
+// share no version of a retrieval protocol with
+var errNoCompatibleRetrievalProtocol = errors.New("no compatible retrieval protocol")
+
+// the protocols a retrieval goes through, with the versions of each we speak,
+// most preferred first
+var retrievalProtocolSteps = []struct {
+	Step   string
+	Prefix string
+	Ours   []string
+}{
+	// filclient only sends queries over the current version
+	{"query", "/fil/retrieval/qry/", []string{string(retrievalmarket.QueryProtocolID)}},
+	{"data-transfer", "/fil/datatransfer/", []string{string(datatransfer.ProtocolDataTransfer1_2)}},
+	{"graphsync", "/ipfs/graphsync/", []string{string(gsnet.ProtocolGraphsync_2_0_0), string(gsnet.ProtocolGraphsync_1_0_0)}},
+}
+
+// retrievalNegotiation is the version of each retrieval protocol we'd speak
+// with a miner
+type retrievalNegotiation struct {
+	Query        string `json:"query"`
+	DataTransfer string `json:"dataTransfer"`
+	Graphsync    string `json:"graphsync"`
+}
+
+func (rn *retrievalNegotiation) String() string {
+	if rn == nil {
+		return ""
+	}
+	return strings.Join([]string{rn.Query, rn.DataTransfer, rn.Graphsync}, ",")
+}
+
+// negotiateRetrievalProtocols picks the version of each retrieval protocol to
+// use with a miner that advertises theirs. A miner that advertises nothing at
+// all, which is what one we failed to identify looks like, gets a nil
+// negotiation and no error rather than being ruled out.
+func negotiateRetrievalProtocols(theirs []string) (*retrievalNegotiation, error) {
+	if len(theirs) == 0 {
+		return nil, nil
+	}
+
+	supported := make(map[string]bool, len(theirs))
+	for _, p := range theirs {
+		supported[p] = true
+	}
+
+	picked := make([]string, len(retrievalProtocolSteps))
+	for i, step := range retrievalProtocolSteps {
+		for _, p := range step.Ours {
+			if supported[p] {
+				picked[i] = p
+				break
+			}
+		}
+
+		if picked[i] == "" {
+			var versions []string
+			for _, p := range theirs {
+				if strings.HasPrefix(p, step.Prefix) {
+					versions = append(versions, p)
+				}
+			}
+			return nil, xerrors.Errorf("%w for %s: miner speaks %v, we speak %v", errNoCompatibleRetrievalProtocol, step.Step, versions, step.Ours)
+		}
+	}
+
+	return &retrievalNegotiation{
+		Query:        picked[0],
+		DataTransfer: picked[1],
+		Graphsync:    picked[2],
+	}, nil
+}
+
+// identifyTimeout bounds how long we wait for libp2p identify with a miner to
+// tell us the protocols it speaks
+const identifyTimeout = 15 * time.Second
+
+// minerProtocols returns the protocols a miner advertised through libp2p
+// identify, connecting to it first unless we already are. The peerstore only
+// has a peer's protocols once identify on the connection finished, so reading
+// them straight after connecting can find none at all.
+func (cm *ContentManager) minerProtocols(ctx context.Context, maddr address.Address) (peer.ID, []string, error) {
+	pid, err := cm.minerPeer(ctx, maddr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if pid == nil || cm.Host.Network().Connectedness(*pid) != network.Connected {
+		p, err := cm.FilClient.ConnectToMiner(ctx, maddr)
+		if err != nil {
+			return "", nil, err
+		}
+		pid = &p
+	}
+
+	if err := waitForIdentify(ctx, cm.Host, *pid); err != nil {
+		return "", nil, err
+	}
+
+	protos, err := cm.Host.Peerstore().GetProtocols(*pid)
+	if err != nil {
+		return "", nil, err
+	}
+	return *pid, protos, nil
+}
+
+// waitForIdentify waits for identify to finish on a connection to the peer,
+// hosts that don't run identify have nothing to wait for
+func waitForIdentify(ctx context.Context, h host.Host, pid peer.ID) error {
+	ider, ok := h.(interface{ IDService() identify.IDService })
+	if !ok {
+		return nil
+	}
+
+	conns := h.Network().ConnsToPeer(pid)
+	if len(conns) == 0 {
+		return xerrors.Errorf("not connected to %s", pid)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, identifyTimeout)
+	defer cancel()
+
+	select {
+	case <-ider.IDService().IdentifyWait(conns[0]):
+		return nil
+	case <-ctx.Done():
+		return xerrors.Errorf("waiting for identify with %s: %w", pid, ctx.Err())
+	}
+}
+
+// negotiateRetrieval negotiates retrieval protocol versions with a miner from
+// what it advertised, see minerProtocols
+func (cm *ContentManager) negotiateRetrieval(ctx context.Context, maddr address.Address) (*retrievalNegotiation, error) {
+	_, protos, err := cm.minerProtocols(ctx, maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	rn, err := negotiateRetrievalProtocols(protos)
+	if err != nil {
+		return nil, xerrors.Errorf("miner %s: %w", maddr, err)
+	}
+
+	if rn != nil {
+		log.Debugw("negotiated retrieval protocols", "miner", maddr, "protocols", rn.String())
+	}
+	return rn, nil
+}
+
+// retrievalQuery is filclient's RetrievalQuery for miners we can retrieve
+// from, those we share no protocol version with fail up front
+func (cm *ContentManager) retrievalQuery(ctx context.Context, maddr address.Address, c cid.Cid) (*retrievalmarket.QueryResponse, error) {
+	if _, err := cm.negotiateRetrieval(ctx, maddr); err != nil {
+		return nil, err
+	}
+
+	return cm.FilClient.RetrievalQuery(ctx, maddr, c)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestNegotiateRetrievalProtocols(t *testing.T) {
+	assert := assert.New(t)
+
+	// not identified yet, nothing to rule the miner out on
+	rn, err := negotiateRetrievalProtocols(nil)
+	assert.NoError(err)
+	assert.Nil(rn)
+	assert.Equal("", rn.String())
+
+	current := []string{
+		"/fil/retrieval/qry/1.0.0",
+		"/fil/datatransfer/1.2.0",
+		"/ipfs/graphsync/1.0.0",
+		"/ipfs/graphsync/2.0.0",
+		"/ipfs/id/1.0.0",
+	}
+	rn, err = negotiateRetrievalProtocols(current)
+	assert.NoError(err)
+	assert.Equal("/fil/retrieval/qry/1.0.0", rn.Query)
+	assert.Equal("/fil/datatransfer/1.2.0", rn.DataTransfer)
+	assert.Equal("/ipfs/graphsync/2.0.0", rn.Graphsync)
+
+	// older graphsync is still fine
+	rn, err = negotiateRetrievalProtocols([]string{
+		"/fil/retrieval/qry/1.0.0",
+		"/fil/datatransfer/1.2.0",
+		"/ipfs/graphsync/1.0.0",
+	})
+	assert.NoError(err)
+	assert.Equal("/ipfs/graphsync/1.0.0", rn.Graphsync)
+
+	// a miner that only speaks the legacy query protocol
+	_, err = negotiateRetrievalProtocols([]string{
+		"/fil/retrieval/qry/0.0.1",
+		"/fil/datatransfer/1.2.0",
+		"/ipfs/graphsync/2.0.0",
+	})
+	assert.True(xerrors.Is(err, errNoCompatibleRetrievalProtocol))
+	assert.Contains(err.Error(), "/fil/retrieval/qry/0.0.1")
+}
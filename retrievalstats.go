@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-state-types/big"
+	"gorm.io/gorm"
+)
+
+// how content retrieval stats can be ordered
+const (
+	retrievalStatsByCount = "retrievals"
+	retrievalStatsByBytes = "bytes"
+	retrievalStatsByCost  = "cost"
+)
+
+// contentRetrievalStats sums up the successful retrievals of one cid
+type contentRetrievalStats struct {
+	// zero for records written before retrievals were tied to contents
+	Content uint       `json:"content,omitempty"`
+	Cid     util.DbCID `json:"cid"`
+
+	Retrievals  int    `json:"retrievals"`
+	Miners      int    `json:"miners"`
+	BytesServed uint64 `json:"bytesServed"`
+	// bytes per second over all retrievals together
+	AverageSpeed  uint64    `json:"averageSpeed"`
+	TotalPayment  big.Int   `json:"totalPayment"`
+	LastRetrieval time.Time `json:"lastRetrieval"`
+
+	// put into payment channels ahead of the retrievals by the funding
+	// strategy, see fundRetrievalPaych
+	PaychFunded big.Int `json:"paychFunded"`
+}
+
+// retrievalStatsByContent aggregates the retrieval success records per cid.
+// The payments are stored as strings so the sums are done here rather than
+// in the database.
+func retrievalStatsByContent(db *gorm.DB, orderBy string, limit int) ([]*contentRetrievalStats, error) {
+	var less func(a, b *contentRetrievalStats) bool
+	switch orderBy {
+	case "", retrievalStatsByCount:
+		less = func(a, b *contentRetrievalStats) bool { return a.Retrievals > b.Retrievals }
+	case retrievalStatsByBytes:
+		less = func(a, b *contentRetrievalStats) bool { return a.BytesServed > b.BytesServed }
+	case retrievalStatsByCost:
+		less = func(a, b *contentRetrievalStats) bool { return a.TotalPayment.GreaterThan(b.TotalPayment) }
+	default:
+		return nil, fmt.Errorf("unknown retrieval stats ordering %q", orderBy)
+	}
+
+	var records []retrievalSuccessRecord
+	if err := db.Order("id asc").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	byCid := make(map[string]*contentRetrievalStats)
+	miners := make(map[string]map[string]bool)
+	durations := make(map[string]int64)
+	for _, r := range records {
+		k := r.Cid.CID.String()
+		st, ok := byCid[k]
+		if !ok {
+			st = &contentRetrievalStats{
+				Cid:          r.Cid,
+				TotalPayment: big.Zero(),
+				PaychFunded:  big.Zero(),
+			}
+			byCid[k] = st
+			miners[k] = make(map[string]bool)
+		}
+
+		if r.Content != 0 {
+			st.Content = r.Content
+		}
+		st.Retrievals++
+		st.BytesServed += r.Size
+		durations[k] += r.DurationMs
+		miners[k][r.Miner] = true
+		if r.CreatedAt.After(st.LastRetrieval) {
+			st.LastRetrieval = r.CreatedAt
+		}
+
+		if r.TotalPayment != "" {
+			pay, err := big.FromString(r.TotalPayment)
+			if err != nil {
+				log.Warnf("retrieval record %d has an invalid payment %q: %s", r.ID, r.TotalPayment, err)
+			} else {
+				st.TotalPayment = big.Add(st.TotalPayment, pay)
+			}
+		}
+
+		if r.PaychFunded != "" {
+			funded, err := big.FromString(r.PaychFunded)
+			if err != nil {
+				log.Warnf("retrieval record %d has an invalid payment channel funding %q: %s", r.ID, r.PaychFunded, err)
+			} else {
+				st.PaychFunded = big.Add(st.PaychFunded, funded)
+			}
+		}
+	}
+
+	out := make([]*contentRetrievalStats, 0, len(byCid))
+	for k, st := range byCid {
+		st.Miners = len(miners[k])
+		if ms := durations[k]; ms > 0 {
+			st.AverageSpeed = st.BytesServed * 1000 / uint64(ms)
+		}
+		out = append(out, st)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if less(out[i], out[j]) {
+			return true
+		}
+		if less(out[j], out[i]) {
+			return false
+		}
+		return out[i].Cid.CID.String() < out[j].Cid.CID.String()
+	})
+
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+
+	return out, nil
+}
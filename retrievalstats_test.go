@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrievalStatsByContent(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &retrievalSuccessRecord{})
+
+	objects := makeTestObjects(t, 2)
+	hot, cold := objects[0].Cid, objects[1].Cid
+
+	now := time.Now()
+	for _, r := range []retrievalSuccessRecord{
+		// written before records had a content
+		{Cid: hot, Miner: "f01000", Size: 1000, DurationMs: 1000, TotalPayment: "10", CreatedAt: now.Add(-time.Hour)},
+		{Content: 1, Cid: hot, Miner: "f01000", Size: 1000, DurationMs: 500, TotalPayment: "20", PaychFunded: "25", CreatedAt: now},
+		{Content: 1, Cid: hot, Miner: "f01001", Size: 1000, DurationMs: 500, TotalPayment: "0", PaychFunded: "0", CreatedAt: now.Add(-time.Minute)},
+		{Content: 2, Cid: cold, Miner: "f01000", Size: 5000, DurationMs: 1000, TotalPayment: "100", CreatedAt: now},
+	} {
+		r := r
+		assert.NoError(db.Create(&r).Error)
+	}
+
+	stats, err := retrievalStatsByContent(db, retrievalStatsByCount, 0)
+	assert.NoError(err)
+	if assert.Len(stats, 2) {
+		st := stats[0]
+		assert.Equal(uint(1), st.Content)
+		assert.Equal(hot.CID, st.Cid.CID)
+		assert.Equal(3, st.Retrievals)
+		assert.Equal(2, st.Miners)
+		assert.Equal(uint64(3000), st.BytesServed)
+		assert.Equal(uint64(1500), st.AverageSpeed)
+		assert.Equal(big.NewInt(30), st.TotalPayment)
+		assert.Equal(big.NewInt(25), st.PaychFunded)
+		assert.WithinDuration(now, st.LastRetrieval, time.Second)
+	}
+
+	byBytes, err := retrievalStatsByContent(db, retrievalStatsByBytes, 1)
+	assert.NoError(err)
+	if assert.Len(byBytes, 1) {
+		assert.Equal(uint(2), byBytes[0].Content)
+		assert.Equal(uint64(5000), byBytes[0].AverageSpeed)
+	}
+
+	byCost, err := retrievalStatsByContent(db, retrievalStatsByCost, 1)
+	assert.NoError(err)
+	if assert.Len(byCost, 1) {
+		assert.Equal(cold.CID, byCost[0].Cid.CID)
+	}
+
+	_, err = retrievalStatsByContent(db, "bogus", 1)
+	assert.Error(err)
+}
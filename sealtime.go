@@ -0,0 +1,276 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// how far back and how many deals we look at to estimate sealing times
+	sealHistoryWindow = time.Hour * 24 * 90
+	sealHistoryLimit  = 200
+
+	// below this many deals a miner's own history isn't trusted and the
+	// history of all miners is used instead
+	minSealSamples = 5
+)
+
+const (
+	// deals sealed this recently show how the miner's pipeline is doing now
+	sealRecentWindow = time.Hour * 24 * 7
+
+	// deals start within days of being proposed, one whose data has waited
+	// this long without being sealed missed its start and never will be
+	sealStuckAfter = time.Hour * 24 * 14
+)
+
+const (
+	sealBasisMiner = "miner"
+	sealBasisAll   = "all"
+)
+
+// sealEstimate predicts how long after its data is transferred a deal
+// becomes active on chain. Low and High are the 10th and 90th percentiles of
+// past deals, most deals should land in between.
+type sealEstimate struct {
+	Miner string `json:"miner"`
+	// whether the estimate comes from this miner's deals or, if it had too
+	// few, from the deals of all miners
+	Basis   string        `json:"basis"`
+	Samples int           `json:"samples"`
+	Low     time.Duration `json:"low"`
+	Median  time.Duration `json:"median"`
+	High    time.Duration `json:"high"`
+}
+
+// Seal estimates are reused for that long, picking miners for a content with
+// a deadline looks up dozens of them every few minutes
+const (
+	sealEstimateTTL       = time.Minute * 10
+	sealEstimateCacheSize = 4096
+)
+
+type cachedSealEstimate struct {
+	est *sealEstimate
+	at  time.Time
+}
+
+// sealEstimate is estimateSealTime, reused for sealEstimateTTL. Miners
+// without enough history are remembered too.
+func (cm *ContentManager) sealEstimate(miner string) (*sealEstimate, error) {
+	if v, ok := cm.sealEstimates.Get(miner); ok {
+		cached := v.(cachedSealEstimate)
+		if time.Since(cached.at) < sealEstimateTTL {
+			return cached.est, nil
+		}
+	}
+
+	est, err := estimateSealTime(cm.DB, miner)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.sealEstimates.Add(miner, cachedSealEstimate{est: est, at: time.Now()})
+	return est, nil
+}
+
+// sealDurations returns the time from transfer finished to the deal being
+// active for the most recent deals of miner, or of all miners if it is empty
+func sealDurations(db *gorm.DB, miner string) ([]time.Duration, error) {
+	return sealDurationsSince(db, miner, time.Now().Add(-sealHistoryWindow))
+}
+
+func sealDurationsSince(db *gorm.DB, miner string, since time.Time) ([]time.Duration, error) {
+	q := db.Model(contentDeal{}).
+		Select("transfer_finished, sealed_at").
+		Where("not failed and transfer_finished > ? and sealed_at > ?", time.Unix(1, 0), since)
+	if miner != "" {
+		q = q.Where("miner = ?", miner)
+	}
+
+	var rows []struct {
+		TransferFinished time.Time
+		SealedAt         time.Time
+	}
+	if err := q.Order("sealed_at desc").Limit(sealHistoryLimit).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	var out []time.Duration
+	for _, r := range rows {
+		if r.SealedAt.After(r.TransferFinished) {
+			out = append(out, r.SealedAt.Sub(r.TransferFinished))
+		}
+	}
+	return out, nil
+}
+
+// estimateSealTime returns nil if there isn't enough history, even across
+// all miners, to say anything
+func estimateSealTime(db *gorm.DB, miner string) (*sealEstimate, error) {
+	basis := sealBasisMiner
+	durs, err := sealDurations(db, miner)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(durs) < minSealSamples {
+		basis = sealBasisAll
+		durs, err = sealDurations(db, "")
+		if err != nil {
+			return nil, err
+		}
+
+		if len(durs) < minSealSamples {
+			return nil, nil
+		}
+	}
+
+	sort.Slice(durs, func(i, j int) bool {
+		return durs[i] < durs[j]
+	})
+
+	return &sealEstimate{
+		Miner:   miner,
+		Basis:   basis,
+		Samples: len(durs),
+		Low:     durationPercentile(durs, 10),
+		Median:  durationPercentile(durs, 50),
+		High:    durationPercentile(durs, 90),
+	}, nil
+}
+
+// durationPercentile takes the nearest rank percentile of sorted durations
+func durationPercentile(sorted []time.Duration, p int) time.Duration {
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// How backed up a miner's sealing pipeline looks
+const (
+	pipelineUnknown  = "unknown"
+	pipelineOK       = "ok"
+	pipelineSlowing  = "slowing"
+	pipelineBackedUp = "backed-up"
+)
+
+// minerPipeline estimates how backed up a miner's sealing pipeline is. Miners
+// don't show their sealing jobs to clients, so it is worked out from our own
+// deals with the miner: the ones it has the data for but hasn't sealed yet,
+// and how long the ones sealed lately took compared to before.
+type minerPipeline struct {
+	Miner  string `json:"miner"`
+	Status string `json:"status"`
+
+	// our deals waiting to be sealed, and how long the oldest has waited
+	Waiting       int           `json:"waiting"`
+	OldestWaiting time.Duration `json:"oldestWaiting"`
+
+	// deals that waited so long they are stuck rather than queued, see
+	// sealStuckAfter. They aren't counted as waiting.
+	Stuck int `json:"stuck"`
+
+	// median seal time of the deals sealed in the last week
+	RecentMedian  time.Duration `json:"recentMedian"`
+	RecentSamples int           `json:"recentSamples"`
+
+	Estimate *sealEstimate `json:"estimate"`
+
+	// how long a deal made now is expected to take to seal, zero if there
+	// is nothing to go on
+	ExpectedSeal time.Duration `json:"expectedSeal"`
+}
+
+// assess fills in the status and expected seal time. A deal made now
+// waits behind the ones already queued, so it takes at least as long as the
+// oldest of those has waited.
+func (mp *minerPipeline) assess() {
+	if mp.Estimate == nil && mp.RecentSamples == 0 && mp.Waiting == 0 {
+		mp.Status = pipelineUnknown
+		return
+	}
+
+	if mp.Estimate != nil {
+		mp.ExpectedSeal = mp.Estimate.Median
+	}
+	if mp.RecentSamples >= minSealSamples && mp.RecentMedian > mp.ExpectedSeal {
+		mp.ExpectedSeal = mp.RecentMedian
+	}
+	if mp.OldestWaiting > mp.ExpectedSeal {
+		mp.ExpectedSeal = mp.OldestWaiting
+	}
+
+	if mp.Estimate == nil {
+		// deals waiting, but nothing sealed to compare against
+		mp.Status = pipelineUnknown
+		return
+	}
+
+	recentSlow := mp.RecentSamples >= minSealSamples && mp.RecentMedian > mp.Estimate.Median*3/2
+	switch {
+	case mp.OldestWaiting > mp.Estimate.High, mp.RecentSamples >= minSealSamples && mp.RecentMedian > mp.Estimate.High:
+		mp.Status = pipelineBackedUp
+	case mp.OldestWaiting > mp.Estimate.Median, recentSlow:
+		mp.Status = pipelineSlowing
+	default:
+		mp.Status = pipelineOK
+	}
+}
+
+func estimateMinerPipeline(db *gorm.DB, miner string) (*minerPipeline, error) {
+	est, err := estimateSealTime(db, miner)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	recent, err := sealDurationsSince(db, miner, now.Add(-sealRecentWindow))
+	if err != nil {
+		return nil, err
+	}
+
+	unsealed := func() *gorm.DB {
+		return db.Model(contentDeal{}).
+			Where("miner = ? and not failed and not retired and transfer_finished > ? and sealed_at < ?", miner, time.Unix(1, 0), time.Unix(1, 0))
+	}
+
+	stuckBefore := now.Add(-sealStuckAfter)
+
+	var waiting []time.Time
+	if err := unsealed().
+		Where("transfer_finished >= ?", stuckBefore).
+		Order("transfer_finished").
+		Pluck("transfer_finished", &waiting).Error; err != nil {
+		return nil, err
+	}
+
+	var stuck int64
+	if err := unsealed().Where("transfer_finished < ?", stuckBefore).Count(&stuck).Error; err != nil {
+		return nil, err
+	}
+
+	mp := &minerPipeline{
+		Miner:         miner,
+		Waiting:       len(waiting),
+		Stuck:         int(stuck),
+		RecentSamples: len(recent),
+		Estimate:      est,
+	}
+	if len(waiting) > 0 {
+		mp.OldestWaiting = now.Sub(waiting[0])
+	}
+	if len(recent) > 0 {
+		sort.Slice(recent, func(i, j int) bool {
+			return recent[i] < recent[j]
+		})
+		mp.RecentMedian = durationPercentile(recent, 50)
+	}
+
+	mp.assess()
+	return mp, nil
+}
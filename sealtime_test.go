@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateSealTime(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &contentDeal{})
+
+	est, err := estimateSealTime(db, "f01000")
+	assert.NoError(err)
+	assert.Nil(est)
+
+	now := time.Now()
+	addDeal := func(miner string, sealTime time.Duration, failed bool) {
+		d := contentDeal{
+			Miner:            miner,
+			Failed:           failed,
+			TransferFinished: now.Add(-sealTime),
+			SealedAt:         now,
+		}
+		assert.NoError(db.Create(&d).Error)
+	}
+
+	for i := 1; i <= 10; i++ {
+		addDeal("f01000", time.Duration(i)*time.Hour, false)
+	}
+	addDeal("f01000", time.Hour*1000, true)
+	for i := 0; i < 3; i++ {
+		addDeal("f02000", time.Hour*100, false)
+	}
+	// not sealed yet
+	assert.NoError(db.Create(&contentDeal{Miner: "f01000", TransferFinished: now}).Error)
+
+	est, err = estimateSealTime(db, "f01000")
+	assert.NoError(err)
+	assert.Equal(&sealEstimate{
+		Miner:   "f01000",
+		Basis:   sealBasisMiner,
+		Samples: 10,
+		Low:     time.Hour,
+		Median:  time.Hour * 5,
+		High:    time.Hour * 9,
+	}, est)
+
+	// too few deals of its own, fall back to everyone's
+	est, err = estimateSealTime(db, "f02000")
+	assert.NoError(err)
+	assert.Equal(sealBasisAll, est.Basis)
+	assert.Equal(13, est.Samples)
+	assert.Equal(time.Hour*100, est.High)
+}
+
+func TestEstimateMinerPipeline(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &contentDeal{})
+
+	now := time.Now()
+	waiting := func(d contentDeal, since time.Duration) {
+		d.Miner = "f01000"
+		d.TransferFinished = now.Add(-since)
+		assert.NoError(db.Create(&d).Error)
+	}
+
+	waiting(contentDeal{}, time.Hour*2)
+	waiting(contentDeal{}, time.Hour*5)
+
+	// failed, retired and stuck deals aren't queued for sealing
+	waiting(contentDeal{Failed: true}, time.Hour*50)
+	waiting(contentDeal{Retired: true}, time.Hour*60)
+	waiting(contentDeal{}, sealStuckAfter+time.Hour)
+
+	mp, err := estimateMinerPipeline(db, "f01000")
+	assert.NoError(err)
+	assert.Equal(2, mp.Waiting)
+	assert.Equal(1, mp.Stuck)
+	assert.InDelta(float64(time.Hour*5), float64(mp.OldestWaiting), float64(time.Minute))
+}
+
+func TestDurationPercentile(t *testing.T) {
+	durs := []time.Duration{1, 2, 3}
+	assert.Equal(t, time.Duration(1), durationPercentile(durs, 10))
+	assert.Equal(t, time.Duration(2), durationPercentile(durs, 50))
+	assert.Equal(t, time.Duration(3), durationPercentile(durs, 90))
+	assert.Equal(t, time.Duration(7), durationPercentile([]time.Duration{7}, 50))
+}
+
+func TestMinerPipelineAssess(t *testing.T) {
+	assert := assert.New(t)
+
+	est := &sealEstimate{
+		Basis:  sealBasisMiner,
+		Low:    time.Hour,
+		Median: time.Hour * 5,
+		High:   time.Hour * 9,
+	}
+
+	mp := &minerPipeline{}
+	mp.assess()
+	assert.Equal(pipelineUnknown, mp.Status)
+	assert.Equal(time.Duration(0), mp.ExpectedSeal)
+
+	// waiting deals without history still say a new deal takes at least as long
+	mp = &minerPipeline{Waiting: 2, OldestWaiting: time.Hour * 3}
+	mp.assess()
+	assert.Equal(pipelineUnknown, mp.Status)
+	assert.Equal(time.Hour*3, mp.ExpectedSeal)
+
+	mp = &minerPipeline{Estimate: est, Waiting: 1, OldestWaiting: time.Hour, RecentMedian: time.Hour * 6, RecentSamples: 10}
+	mp.assess()
+	assert.Equal(pipelineOK, mp.Status)
+	assert.Equal(time.Hour*6, mp.ExpectedSeal)
+
+	// too few recent deals to count
+	mp = &minerPipeline{Estimate: est, RecentMedian: time.Hour * 20, RecentSamples: 2}
+	mp.assess()
+	assert.Equal(pipelineOK, mp.Status)
+	assert.Equal(time.Hour*5, mp.ExpectedSeal)
+
+	mp = &minerPipeline{Estimate: est, RecentMedian: time.Hour * 8, RecentSamples: 10}
+	mp.assess()
+	assert.Equal(pipelineSlowing, mp.Status)
+
+	mp = &minerPipeline{Estimate: est, Waiting: 3, OldestWaiting: time.Hour * 7}
+	mp.assess()
+	assert.Equal(pipelineSlowing, mp.Status)
+	assert.Equal(time.Hour*7, mp.ExpectedSeal)
+
+	mp = &minerPipeline{Estimate: est, Waiting: 3, OldestWaiting: time.Hour * 12}
+	mp.assess()
+	assert.Equal(pipelineBackedUp, mp.Status)
+	assert.Equal(time.Hour*12, mp.ExpectedSeal)
+
+	mp = &minerPipeline{Estimate: est, RecentMedian: time.Hour * 10, RecentSamples: 10}
+	mp.assess()
+	assert.Equal(pipelineBackedUp, mp.Status)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+	"gorm.io/gorm"
+)
+
+// What happened to a miner that was considered for a deal
+const (
+	// picked for a deal
+	selectionSelected = "selected"
+
+	// passed the checks it got to, but enough miners were found first
+	selectionConsidered = "considered"
+
+	// ruled out, for the reason given
+	selectionFiltered = "filtered"
+)
+
+// Why a miner was ruled out for a deal
+const (
+	selectionExcluded  = "excluded"   // already has or had a deal for the content
+	selectionSuspended = "suspended"  // on the blocklist
+	selectionCooldown  = "cooldown"   // breaker is open after recent failures
+	selectionAskFailed = "ask-failed" // didn't answer our ask query
+	selectionPieceSize = "piece-size" // content is too small for the miner's minimum piece size
+	selectionDiversity = "diversity"  // shares an operator or location with another replica
+	selectionPrice     = "price"      // too expensive on the terms we'd make the deal on
+	selectionDuration  = "duration"   // doesn't take deals as long as ours
+
+	selectionNotAccepting = "not-accepting" // recently turned a proposal down for having no room for deals
+	selectionTooSlow      = "too-slow"      // not expected to seal before the content's deal deadline
+	selectionLowSuccess   = "low-success"   // below the success ratio the content asks for
+)
+
+// Which list a miner came up in, see pickMiners
+const (
+	selectionSourceRanked = "ranked"
+	selectionSourceRandom = "random"
+
+	// ranked miners ordered by seal time, for content with a deal deadline
+	selectionSourceDeadline = "deadline"
+
+	// the miners the content's replication plan counted on, see
+	// adaptivePlan
+	selectionSourcePlanned = "planned"
+)
+
+// selectionAuditRecord is one round of picking miners to make deals for a
+// content with, kept to show later why the content went where it did
+type selectionAuditRecord struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"time"`
+	Content   uint      `gorm:"index" json:"content"`
+	Count     int       `json:"count"`
+	Verified  bool      `json:"verified"`
+
+	Miners []selectionAuditMiner `gorm:"-" json:"miners"`
+}
+
+// selectionAuditMiner is what happened to one miner in a round, in the order
+// the miners were looked at
+type selectionAuditMiner struct {
+	ID      uint   `gorm:"primarykey" json:"-"`
+	Audit   uint   `gorm:"index" json:"-"`
+	Miner   string `json:"miner"`
+	Source  string `json:"source"`
+	Rank    int    `json:"rank,omitempty"`
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+
+	// the deal sizes the miner prefers and how the content compares, only
+	// with deal size targeting on
+	SizeTarget string `json:"sizeTarget,omitempty"`
+}
+
+// selectionAudit collects a round of miner selection as it happens. A nil
+// selectionAudit records nothing, for picking miners outside of deal making.
+type selectionAudit struct {
+	rec     selectionAuditRecord
+	byMiner map[address.Address]int
+
+	// position of each miner in the ranked list, starting at 1
+	ranks map[address.Address]int
+}
+
+func newSelectionAudit(content uint, count int, verified bool) *selectionAudit {
+	return &selectionAudit{
+		rec: selectionAuditRecord{
+			Content:  content,
+			Count:    count,
+			Verified: verified,
+		},
+		byMiner: make(map[address.Address]int),
+		ranks:   make(map[address.Address]int),
+	}
+}
+
+func (sa *selectionAudit) setRanking(sorted []address.Address) {
+	if sa == nil {
+		return
+	}
+
+	for i, m := range sorted {
+		sa.ranks[m] = i + 1
+	}
+}
+
+// consider notes that m came up in the list given by source, the first
+// source a miner comes up in is the one that sticks
+func (sa *selectionAudit) consider(m address.Address, source string) *selectionAuditMiner {
+	if sa == nil {
+		return nil
+	}
+
+	if i, ok := sa.byMiner[m]; ok {
+		return &sa.rec.Miners[i]
+	}
+
+	sa.byMiner[m] = len(sa.rec.Miners)
+	sa.rec.Miners = append(sa.rec.Miners, selectionAuditMiner{
+		Miner:   m.String(),
+		Source:  source,
+		Rank:    sa.ranks[m],
+		Outcome: selectionConsidered,
+	})
+	return &sa.rec.Miners[len(sa.rec.Miners)-1]
+}
+
+func (sa *selectionAudit) filter(m address.Address, reason, detail string) {
+	if sa == nil {
+		return
+	}
+
+	am := sa.consider(m, "")
+	am.Outcome = selectionFiltered
+	am.Reason = reason
+	am.Detail = detail
+}
+
+// filterDropped notes the reason for every miner that is in before but was
+// left out of after
+func (sa *selectionAudit) filterDropped(before, after []address.Address, reason, detail string) {
+	if sa == nil {
+		return
+	}
+
+	kept := make(map[address.Address]bool, len(after))
+	for _, m := range after {
+		kept[m] = true
+	}
+
+	for _, m := range before {
+		if !kept[m] {
+			sa.filter(m, reason, detail)
+		}
+	}
+}
+
+func (sa *selectionAudit) selected(m address.Address, detail string) {
+	if sa == nil {
+		return
+	}
+
+	am := sa.consider(m, "")
+	am.Outcome = selectionSelected
+	am.Reason = ""
+	am.Detail = detail
+}
+
+// sizeTarget notes how the content's piece compares to the deal sizes m
+// prefers, see minerDealSizeRange
+func (sa *selectionAudit) sizeTarget(m address.Address, detail string) {
+	if sa == nil {
+		return
+	}
+
+	sa.consider(m, "").SizeTarget = detail
+}
+
+func (sa *selectionAudit) save(db *gorm.DB) error {
+	if sa == nil {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&sa.rec).Error; err != nil {
+			return err
+		}
+
+		if len(sa.rec.Miners) == 0 {
+			return nil
+		}
+
+		for i := range sa.rec.Miners {
+			sa.rec.Miners[i].Audit = sa.rec.ID
+		}
+		return tx.CreateInBatches(sa.rec.Miners, 500).Error
+	})
+}
+
+func breakerDetail(st *minerBreakerStatus) string {
+	detail := fmt.Sprintf("breaker %s after %d failures", st.State, st.Failures)
+	if st.Until != nil {
+		detail += ", until " + st.Until.Format(time.RFC3339)
+	}
+	return detail
+}
+
+func dealTermsDetail(dt dealTerms) string {
+	terms := "paid"
+	if dt.Verified {
+		terms = "verified"
+	}
+	return fmt.Sprintf("%s at %s: %s", terms, types.FIL(dt.Price), dt.Reason)
+}
+
+// selectionAuditsForContent returns every round of miner selection recorded
+// for a content, oldest first
+func selectionAuditsForContent(db *gorm.DB, content uint) ([]selectionAuditRecord, error) {
+	var recs []selectionAuditRecord
+	if err := db.Order("id asc").Find(&recs, "content = ?", content).Error; err != nil {
+		return nil, err
+	}
+
+	if len(recs) == 0 {
+		return recs, nil
+	}
+
+	ids := make([]uint, 0, len(recs))
+	idx := make(map[uint]int, len(recs))
+	for i, r := range recs {
+		ids = append(ids, r.ID)
+		idx[r.ID] = i
+	}
+
+	var miners []selectionAuditMiner
+	if err := db.Order("id asc").Find(&miners, "audit in ?", ids).Error; err != nil {
+		return nil, err
+	}
+
+	for _, m := range miners {
+		i := idx[m.Audit]
+		recs[i].Miners = append(recs[i].Miners, m)
+	}
+	return recs, nil
+}
+
+const (
+	selectionAuditPruneInterval = time.Hour
+	selectionAuditPruneBatch    = 1000
+)
+
+// runSelectionAuditPruner periodically deletes the selection audits older
+// than the retention period, so they don't grow without bound
+func (cm *ContentManager) runSelectionAuditPruner(ctx context.Context) {
+	ticker := time.NewTicker(selectionAuditPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := pruneSelectionAudits(cm.DB, time.Now().Add(-cm.selectionAuditRetention))
+		if err != nil {
+			log.Errorf("failed to prune selection audits: %s", err)
+		} else if n > 0 {
+			log.Infof("pruned %d selection audits", n)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pruneSelectionAudits deletes the selection audits recorded before the
+// given time along with their miners, a batch at a time so no single
+// transaction holds the tables for long. It returns how many were deleted.
+func pruneSelectionAudits(db *gorm.DB, before time.Time) (int, error) {
+	var total int
+	for {
+		var ids []uint
+		if err := db.Model(selectionAuditRecord{}).Where("created_at < ?", before).Order("id asc").Limit(selectionAuditPruneBatch).Pluck("id", &ids).Error; err != nil {
+			return total, err
+		}
+
+		if len(ids) == 0 {
+			return total, nil
+		}
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("audit in ?", ids).Delete(&selectionAuditMiner{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("id in ?", ids).Delete(&selectionAuditRecord{}).Error
+		}); err != nil {
+			return total, err
+		}
+
+		total += len(ids)
+		if len(ids) < selectionAuditPruneBatch {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+func TestSelectionAudit(t *testing.T) {
+	db := newTestDB(t, &selectionAuditRecord{}, &selectionAuditMiner{})
+
+	m1, _ := address.NewIDAddress(1000)
+	m2, _ := address.NewIDAddress(1001)
+	m3, _ := address.NewIDAddress(1002)
+	m4, _ := address.NewIDAddress(1003)
+
+	audit := newSelectionAudit(7, 2, true)
+	audit.setRanking([]address.Address{m2, m1, m3})
+
+	audit.consider(m4, selectionSourceRandom)
+	audit.filter(m4, selectionSuspended, "bad actor")
+	audit.consider(m1, selectionSourceRanked)
+	audit.consider(m2, selectionSourceRanked)
+	audit.consider(m3, selectionSourceRanked)
+
+	// showing up again doesn't change where a miner came from
+	audit.consider(m1, selectionSourceRandom)
+
+	audit.filterDropped([]address.Address{m1, m2, m3}, []address.Address{m2, m3}, selectionExcluded, "")
+	audit.selected(m2, "verified")
+
+	if err := audit.save(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second round, after the first
+	if err := newSelectionAudit(7, 1, false).save(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// recording nothing is fine
+	var none *selectionAudit
+	none.consider(m1, selectionSourceRanked)
+	none.filter(m1, selectionCooldown, "")
+	if err := none.save(db); err != nil {
+		t.Fatal(err)
+	}
+
+	audits, err := selectionAuditsForContent(db, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audits) != 2 {
+		t.Fatalf("expected 2 rounds, got %d", len(audits))
+	}
+
+	first := audits[0]
+	if first.Count != 2 || !first.Verified {
+		t.Fatalf("unexpected round: %+v", first)
+	}
+
+	expected := []selectionAuditMiner{
+		{Miner: m4.String(), Source: selectionSourceRandom, Outcome: selectionFiltered, Reason: selectionSuspended, Detail: "bad actor"},
+		{Miner: m1.String(), Source: selectionSourceRanked, Rank: 2, Outcome: selectionFiltered, Reason: selectionExcluded},
+		{Miner: m2.String(), Source: selectionSourceRanked, Rank: 1, Outcome: selectionSelected, Detail: "verified"},
+		{Miner: m3.String(), Source: selectionSourceRanked, Rank: 3, Outcome: selectionConsidered},
+	}
+	if len(first.Miners) != len(expected) {
+		t.Fatalf("expected %d miners, got %d", len(expected), len(first.Miners))
+	}
+	for i, exp := range expected {
+		got := first.Miners[i]
+		got.ID, got.Audit = 0, 0
+		if got != exp {
+			t.Errorf("miner %d: expected %+v, got %+v", i, exp, got)
+		}
+	}
+
+	if len(audits[1].Miners) != 0 {
+		t.Fatalf("expected no miners in the second round, got %d", len(audits[1].Miners))
+	}
+
+	other, err := selectionAuditsForContent(db, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other) != 0 {
+		t.Fatalf("expected no rounds for another content, got %d", len(other))
+	}
+}
+
+func TestPruneSelectionAudits(t *testing.T) {
+	db := newTestDB(t, &selectionAuditRecord{}, &selectionAuditMiner{})
+
+	m1, _ := address.NewIDAddress(1000)
+	cutoff := time.Now().Add(-time.Hour)
+
+	for i, age := range []time.Duration{2 * time.Hour, 3 * time.Hour, time.Minute} {
+		audit := newSelectionAudit(uint(i+1), 1, false)
+		audit.rec.CreatedAt = time.Now().Add(-age)
+		audit.consider(m1, selectionSourceRanked)
+		audit.selected(m1, "paid")
+		if err := audit.save(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := pruneSelectionAudits(db, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 audits pruned, got %d", n)
+	}
+
+	var recs []selectionAuditRecord
+	if err := db.Find(&recs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Content != 3 {
+		t.Fatalf("expected only the recent audit to be left, got %+v", recs)
+	}
+
+	var miners []selectionAuditMiner
+	if err := db.Find(&miners).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(miners) != 1 || miners[0].Audit != recs[0].ID {
+		t.Fatalf("expected only the recent audit's miners to be left, got %+v", miners)
+	}
+
+	// nothing left to prune
+	if n, err := pruneSelectionAudits(db, cutoff); err != nil || n != 0 {
+		t.Fatalf("expected nothing pruned, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// how long shutdown waits for proposals that are being sent to finish
+const shutdownProposalWait = time.Second * 30
+
+const (
+	inflightPhaseProposing    = "proposing"
+	inflightPhaseTransferring = "transferring"
+)
+
+// inflightDealRecord is written on shutdown for each deal that was still
+// being proposed or transferring, and reconciled on the next startup
+type inflightDealRecord struct {
+	gorm.Model
+	Deal   uint `gorm:"index"`
+	Phase  string
+	DTChan string
+	Status string
+}
+
+// ShuttingDown reports whether Shutdown has been called, no new deals are
+// started from then on
+func (cm *ContentManager) ShuttingDown() bool {
+	select {
+	case <-cm.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackProposal marks a deal as having its proposal sent to the miner, the
+// returned func must be called once the miner responded or we gave up
+func (cm *ContentManager) trackProposal(deal uint) func() {
+	cm.proposingLk.Lock()
+	defer cm.proposingLk.Unlock()
+	cm.proposing[deal] = struct{}{}
+
+	return func() {
+		cm.proposingLk.Lock()
+		defer cm.proposingLk.Unlock()
+		delete(cm.proposing, deal)
+	}
+}
+
+func (cm *ContentManager) proposalsInFlight() []uint {
+	cm.proposingLk.Lock()
+	defer cm.proposingLk.Unlock()
+
+	out := make([]uint, 0, len(cm.proposing))
+	for d := range cm.proposing {
+		out = append(out, d)
+	}
+	return out
+}
+
+// Shutdown stops the content manager from starting new deals, gives
+// proposals that are being sent a chance to finish and records whatever is
+// still in flight so it can be reconciled on the next startup
+func (cm *ContentManager) Shutdown(ctx context.Context) error {
+	cm.shutdownOnce.Do(func() {
+		close(cm.shutdownCh)
+	})
+
+	wait := time.NewTimer(shutdownProposalWait)
+	defer wait.Stop()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for len(cm.proposalsInFlight()) > 0 {
+		select {
+		case <-tick.C:
+		case <-wait.C:
+			return cm.persistInflightDeals(ctx)
+		case <-ctx.Done():
+			return cm.persistInflightDeals(context.Background())
+		}
+	}
+
+	return cm.persistInflightDeals(ctx)
+}
+
+func (cm *ContentManager) persistInflightDeals(ctx context.Context) error {
+	var recs []inflightDealRecord
+	for _, d := range cm.proposalsInFlight() {
+		recs = append(recs, inflightDealRecord{
+			Deal:  d,
+			Phase: inflightPhaseProposing,
+		})
+	}
+
+	var deals []contentDeal
+	if err := cm.DB.Model(contentDeal{}).
+		Joins("left join contents on contents.id = content_deals.content").
+		Where("not content_deals.failed and content_deals.deal_id = 0 and content_deals.dt_chan != '' and content_deals.transfer_finished < ? and contents.location = ?", time.Unix(1, 0), "local").
+		Select("content_deals.*").
+		Scan(&deals).Error; err != nil {
+		return err
+	}
+
+	for _, d := range deals {
+		rec := inflightDealRecord{
+			Deal:   d.ID,
+			Phase:  inflightPhaseTransferring,
+			DTChan: d.DTChan,
+		}
+
+		if chid, err := d.ChannelID(); err == nil {
+			if st, err := cm.FilClient.TransferStatus(ctx, &chid); err == nil {
+				rec.Status = st.StatusStr
+			}
+		}
+
+		recs = append(recs, rec)
+	}
+
+	if len(recs) == 0 {
+		return nil
+	}
+
+	log.Infow("recording in-flight deals for the next startup", "count", len(recs))
+	return cm.DB.Create(&recs).Error
+}
+
+// reconcileInflightDeals goes over the deals that were in flight when we
+// last shut down. Proposals we never heard back about are marked failed so
+// the content gets new deals, transfers that can't be resumed are failed too
+// and the rest are left to be restarted.
+func (cm *ContentManager) reconcileInflightDeals(ctx context.Context) error {
+	var recs []inflightDealRecord
+	if err := cm.DB.Find(&recs).Error; err != nil {
+		return err
+	}
+
+	for _, rec := range recs {
+		var d contentDeal
+		if err := cm.DB.First(&d, "id = ?", rec.Deal).Error; err != nil {
+			// a deal we cleaned up before exiting
+			continue
+		}
+
+		switch rec.Phase {
+		case inflightPhaseProposing:
+			log.Infow("deal proposal was interrupted by shutdown, marking failed", "deal", d.ID, "content", d.Content, "miner", d.Miner)
+			if err := cm.failInterruptedDeal(d, "proposal interrupted by shutdown"); err != nil {
+				return err
+			}
+		case inflightPhaseTransferring:
+			chid, err := d.ChannelID()
+			if err != nil {
+				continue
+			}
+
+			st, err := cm.FilClient.TransferStatus(ctx, &chid)
+			if err != nil || util.TransferTerminated(st) {
+				log.Infow("transfer interrupted by shutdown can't be resumed, marking failed", "deal", d.ID, "content", d.Content, "chan", rec.DTChan, "lastStatus", rec.Status)
+				if err := cm.failInterruptedDeal(d, fmt.Sprintf("transfer interrupted by shutdown (last status: %s)", rec.Status)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			log.Infow("transfer interrupted by shutdown will be restarted", "deal", d.ID, "content", d.Content, "chan", rec.DTChan)
+		}
+	}
+
+	return cm.DB.Where("1 = 1").Delete(&inflightDealRecord{}).Error
+}
+
+func (cm *ContentManager) failInterruptedDeal(d contentDeal, msg string) error {
+	maddr, err := d.MinerAddr()
+	if err == nil {
+		cm.recordDealFailure(&DealFailureError{
+			Miner:   maddr,
+			Phase:   "shutdown",
+			Message: msg,
+			Content: d.Content,
+		})
+	}
+
+	if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumns(map[string]interface{}{
+		"failed":    true,
+		"failed_at": time.Now(),
+	}).Error; err != nil {
+		return err
+	}
+
+	cm.ToCheck <- d.Content
+	return nil
+}
+
+// rejectWhenShuttingDown refuses new requests once shutdown has started
+func (s *Server) rejectWhenShuttingDown(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.CM.ShuttingDown() {
+			return &util.HttpError{
+				Code:    http.StatusServiceUnavailable,
+				Message: util.ERR_SHUTTING_DOWN,
+			}
+		}
+		return next(c)
+	}
+}
+
+// how long shutdown waits for the background workers to return
+const shutdownWorkerWait = time.Second * 30
+
+// Shutdown stops taking api requests, persists in-flight deal state and stops
+// the data transfers, waits for the background workers, and only then closes
+// the host, the datastore the data-transfer manager keeps its channel state
+// in, the blockstore and the database they were all using
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.echoLk.Lock()
+	e := s.echo
+	s.echoLk.Unlock()
+	if e != nil {
+		if err := e.Shutdown(ctx); err != nil {
+			log.Errorf("failed to shut down api server: %s", err)
+		}
+	}
+
+	if err := s.CM.Shutdown(ctx); err != nil {
+		log.Errorf("failed to persist in-flight deals: %s", err)
+	}
+
+	// filclient doesn't expose its graphsync data-transfer manager, it stops
+	// along with the host below. We stop listening to it, and stop the
+	// libp2p transfer manager, here so no transfer updates race the workers
+	// shutting down.
+	s.CM.unsubscribeTransfers()
+	s.FilClient.Libp2pTransferMgr.Stop()
+
+	if s.stopWorkers != nil {
+		s.stopWorkers()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(shutdownWorkerWait):
+		log.Warnf("background workers didn't stop within %s, closing anyway", shutdownWorkerWait)
+	case <-ctx.Done():
+	}
+
+	s.CM.closeSigner()
+
+	if s.CM.paychMgr != nil {
+		if err := s.CM.paychMgr.Stop(); err != nil {
+			log.Errorf("failed to stop payment channel manager: %s", err)
+		}
+	}
+
+	if s.RetrievalProvider != nil {
+		if err := s.RetrievalProvider.Close(); err != nil {
+			log.Errorf("failed to close retrieval provider: %s", err)
+		}
+	}
+
+	if err := s.Node.Host.Close(); err != nil {
+		log.Errorf("failed to close libp2p host: %s", err)
+	}
+
+	if err := s.Node.Datastore.Close(); err != nil {
+		log.Errorf("failed to close datastore: %s", err)
+	}
+
+	if c, ok := s.Node.Blockstore.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Errorf("failed to close blockstore: %s", err)
+		}
+	}
+
+	sqldb, err := s.DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqldb.Close()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"golang.org/x/xerrors"
+)
+
+// why a deal failed, kept on the deal
+const dealFailedSlashed = "slashed"
+
+// a slashed deal lost our data along with the miner's collateral, so it
+// counts as this many lost deals in the miner's success ratio
+const slashedDealWeight = 5
+
+// slashedDeal is a deal the miner was slashed for
+type slashedDeal struct {
+	Deal       uint           `json:"deal"`
+	DealID     int64          `json:"dealId"`
+	Content    uint           `json:"content"`
+	Miner      string         `json:"miner"`
+	SlashEpoch abi.ChainEpoch `json:"slashEpoch"`
+	FailedAt   time.Time      `json:"failedAt"`
+}
+
+// runSlashMonitor periodically looks up the on-chain state of every active
+// deal, so slashing is caught even for content that isn't being checked
+func (cm *ContentManager) runSlashMonitor(ctx context.Context) {
+	ticker := time.NewTicker(cm.slashCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := cm.checkSlashedDeals(ctx); err != nil {
+			log.Errorf("failed to check deals for slashing: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cm *ContentManager) checkSlashedDeals(ctx context.Context) error {
+	var deals []contentDeal
+	if err := cm.DB.Find(&deals, "deal_id > 0 AND NOT failed AND NOT retired").Error; err != nil {
+		return err
+	}
+
+	var slashed int
+	for i := range deals {
+		d := &deals[i]
+
+		// looks the deal up with StateMarketStorageDeal
+		ok, deal, err := cm.FilClient.CheckChainDeal(ctx, abi.DealID(d.DealID))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Warnw("failed to look up deal on chain", "deal", d.DealID, "miner", d.Miner, "err", err)
+			continue
+		}
+
+		// deals that are gone from the market actor are dealt with when their
+		// content is checked next
+		if !ok || deal.State.SlashEpoch <= 0 {
+			continue
+		}
+
+		if err := cm.handleSlashedDeal(d, deal.State.SlashEpoch); err != nil {
+			log.Errorw("failed to handle slashed deal", "deal", d.DealID, "content", d.Content, "miner", d.Miner, "err", err)
+			continue
+		}
+		slashed++
+	}
+
+	if slashed > 0 {
+		log.Warnw("found slashed deals", "slashed", slashed, "checked", len(deals))
+	}
+	return nil
+}
+
+// handleSlashedDeal fails the deal, counts it against the miner and queues
+// its content to be replicated again
+func (cm *ContentManager) handleSlashedDeal(d *contentDeal, slashEpoch abi.ChainEpoch) error {
+	log.Warnw("deal was slashed", "deal", d.DealID, "content", d.Content, "miner", d.Miner, "slashEpoch", slashEpoch)
+
+	maddr, err := d.MinerAddr()
+	if err != nil {
+		return err
+	}
+
+	res := cm.DB.Model(contentDeal{}).Where("id = ? AND NOT failed", d.ID).UpdateColumns(map[string]interface{}{
+		"failed":        true,
+		"failed_at":     time.Now(),
+		"failed_reason": dealFailedSlashed,
+		"slash_epoch":   slashEpoch,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	// already failed by someone else, e.g. a content check that got there first
+	if res.RowsAffected == 0 {
+		return nil
+	}
+
+	if err := cm.recordDealFailure(&DealFailureError{
+		Miner:   maddr,
+		Phase:   "slashed",
+		Message: fmt.Sprintf("deal %d was slashed at epoch %d", d.DealID, slashEpoch),
+		Content: d.Content,
+	}); err != nil {
+		log.Errorf("failed to record deal failure: %s", err)
+	}
+
+	// if this was an aggregate, every content in it just lost a deal too
+	if err := cm.handleAggregateFault(d); err != nil {
+		return xerrors.Errorf("recording aggregate fault: %w", err)
+	}
+
+	go func() {
+		cm.ToCheck <- d.Content
+	}()
+	return nil
+}
+
+// slashedDeals lists the deals that were slashed, most recent first
+func (cm *ContentManager) slashedDeals(limit int) ([]slashedDeal, error) {
+	q := cm.DB.Where("failed_reason = ?", dealFailedSlashed).Order("failed_at desc")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var deals []contentDeal
+	if err := q.Find(&deals).Error; err != nil {
+		return nil, err
+	}
+
+	out := make([]slashedDeal, 0, len(deals))
+	for _, d := range deals {
+		out = append(out, slashedDeal{
+			Deal:       d.ID,
+			DealID:     d.DealID,
+			Content:    d.Content,
+			Miner:      d.Miner,
+			SlashEpoch: abi.ChainEpoch(d.SlashEpoch),
+			FailedAt:   d.FailedAt,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleSlashedDeal(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &contentDeal{}, &Content{}, &PieceCommRecord{}, &dfeRecord{}, &storageMiner{}, &aggregateFault{})
+
+	cm := &ContentManager{
+		DB:            db,
+		ToCheck:       make(chan uint, 10),
+		minerBreakers: newMinerBreakers(),
+	}
+
+	for i := int64(1); i <= 10; i++ {
+		assert.NoError(db.Create(&contentDeal{Content: 1, Miner: "f01000", DealID: i}).Error)
+	}
+
+	var d contentDeal
+	assert.NoError(db.First(&d, "deal_id = ?", 1).Error)
+	assert.NoError(cm.handleSlashedDeal(&d, 1234))
+	assert.Equal(uint(1), <-cm.ToCheck, "content is queued for new deals")
+
+	// found again by another check, nothing more is done
+	assert.NoError(cm.handleSlashedDeal(&d, 1234))
+	assert.Len(cm.ToCheck, 0)
+
+	var failures int64
+	assert.NoError(db.Model(&dfeRecord{}).Count(&failures).Error)
+	assert.Equal(int64(1), failures)
+
+	slashed, err := cm.slashedDeals(0)
+	assert.NoError(err)
+	if assert.Len(slashed, 1) {
+		assert.Equal(int64(1), slashed[0].DealID)
+		assert.Equal(int64(1234), int64(slashed[0].SlashEpoch))
+	}
+
+	stats, err := localMinerDealStats(db)
+	assert.NoError(err)
+
+	m, _ := address.NewFromString("f01000")
+	assert.Equal(10, stats[m].TotalDeals)
+	assert.Equal(9, stats[m].ConfirmedDeals)
+	assert.Equal(1, stats[m].DealFaults)
+	assert.Equal(1, stats[m].SlashedDeals)
+
+	// one slashed deal weighs as much as slashedDealWeight lost ones
+	assert.InDelta(9.0/(10+slashedDealWeight-1), stats[m].SuccessRatio(), 0.0001)
+}
+
+func TestRepairDealAggregateFaults(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &contentDeal{}, &Content{}, &dfeRecord{}, &storageMiner{}, &aggregateFault{})
+
+	cm := &ContentManager{
+		DB:                     db,
+		minerBreakers:          newMinerBreakers(),
+		aggregateFaultStrategy: aggrFaultReplace,
+	}
+
+	aggr := Content{Aggregate: true, Active: true}
+	assert.NoError(db.Create(&aggr).Error)
+	assert.NoError(db.Create(&Content{Active: true, AggregatedIn: aggr.ID}).Error)
+
+	repair := func(dealID int64, reason string) {
+		d := contentDeal{Content: aggr.ID, Miner: "f01000", DealID: dealID}
+		assert.NoError(db.Create(&d).Error)
+		assert.NoError(cm.repairDeal(&d, reason))
+	}
+
+	faults := func() int64 {
+		var n int64
+		assert.NoError(db.Model(&aggregateFault{}).Count(&n).Error)
+		return n
+	}
+
+	// renewals and failed replica tests aren't faults
+	repair(1, repairExpiring)
+	repair(2, repairReplicaTest)
+	assert.Equal(int64(0), faults())
+
+	// nor is a proposal that never made it on chain
+	repair(0, repairFaulted)
+	assert.Equal(int64(0), faults())
+
+	repair(3, repairFaulted)
+	assert.Equal(int64(1), faults())
+
+	var failed int64
+	assert.NoError(db.Model(&contentDeal{}).Where("failed").Count(&failed).Error)
+	assert.Equal(int64(4), failed)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"gorm.io/gorm"
+)
+
+// newTestDB opens a sqlite database of the test's own, with tables for the
+// given models
+func newTestDB(t testing.TB, models ...interface{}) *gorm.DB {
+	t.Helper()
+
+	db, err := util.SetupDatabase("sqlite=" + filepath.Join(t.TempDir(), "estuary.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
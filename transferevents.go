@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/application-research/filclient"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// longest a status request may wait for the next transfer event
+const maxStatusWait = time.Minute * 5
+
+// transferNotifier lets status requests wait for the next data transfer
+// event on a deal instead of polling for it
+type transferNotifier struct {
+	lk      sync.Mutex
+	waiters map[uint][]chan struct{}
+}
+
+func newTransferNotifier() *transferNotifier {
+	return &transferNotifier{
+		waiters: make(map[uint][]chan struct{}),
+	}
+}
+
+// wait returns a channel that is closed on the next event for the deal, and
+// a func to stop waiting that must be called if the caller gives up first
+func (tn *transferNotifier) wait(deal uint) (<-chan struct{}, func()) {
+	tn.lk.Lock()
+	defer tn.lk.Unlock()
+
+	ch := make(chan struct{})
+	tn.waiters[deal] = append(tn.waiters[deal], ch)
+
+	return ch, func() {
+		tn.lk.Lock()
+		defer tn.lk.Unlock()
+
+		ws := tn.waiters[deal]
+		for i, w := range ws {
+			if w == ch {
+				tn.waiters[deal] = append(ws[:i], ws[i+1:]...)
+				break
+			}
+		}
+		if len(tn.waiters[deal]) == 0 {
+			delete(tn.waiters, deal)
+		}
+	}
+}
+
+func (tn *transferNotifier) notify(deal uint) {
+	tn.lk.Lock()
+	defer tn.lk.Unlock()
+
+	for _, ch := range tn.waiters[deal] {
+		close(ch)
+	}
+	delete(tn.waiters, deal)
+}
+
+// a channel with no deal for it, like a retrieval's, is looked up again after
+// this long, in case its deal just hadn't recorded it yet
+const chanDealMissTTL = time.Second * 30
+
+// chanDeal is the deal a data transfer channel belongs to, zero if none did
+// when it was looked up
+type chanDeal struct {
+	deal uint
+	at   time.Time
+}
+
+// subscribeToTransferEvents wakes up status requests waiting on our own
+// transfers, both legacy push transfers and boost pull transfers, and logs
+// the steps they take. Shuttle transfers are reported through
+// updateTransferStatus.
+func (cm *ContentManager) subscribeToTransferEvents() error {
+	// progress events come in for every block, so remember which deal each
+	// channel belongs to, or that none does, rather than asking the database
+	// every time
+	chanDeals, err := lru.NewARC(10000)
+	if err != nil {
+		return err
+	}
+
+	unsubLegacy := cm.FilClient.SubscribeToDataTransferEvents(func(event datatransfer.Event, st datatransfer.ChannelState) {
+		chid := st.ChannelID()
+
+		v, ok := chanDeals.Get(chid)
+		cd, _ := v.(chanDeal)
+		if !ok || (cd.deal == 0 && time.Since(cd.at) > chanDealMissTTL) {
+			var deals []contentDeal
+			if err := cm.DB.Select("id").Limit(1).Find(&deals, "dt_chan = ?", chid.String()).Error; err != nil {
+				return
+			}
+
+			cd = chanDeal{at: time.Now()}
+			if len(deals) > 0 {
+				cd.deal = deals[0].ID
+			}
+			chanDeals.Add(chid, cd)
+		}
+
+		if cd.deal == 0 {
+			return
+		}
+
+		cm.transferEvents.notify(cd.deal)
+		if name, ok := legacyTransferEvents[event.Code]; ok {
+			cm.transferLog.record(cd.deal, chid.String(), name, filclient.ChannelStateConv(st))
+		}
+	})
+
+	unsub, err := cm.FilClient.Libp2pTransferMgr.Subscribe(func(dbid uint, st filclient.ChannelState) {
+		cm.transferEvents.notify(dbid)
+		cm.transferLog.recordStatus(dbid, st.TransferID, &st)
+	})
+	if err != nil {
+		unsubLegacy()
+		return err
+	}
+
+	cm.unsubscribeTransfers = func() {
+		unsubLegacy()
+		unsub()
+	}
+	return nil
+}
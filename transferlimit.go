@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-metrics-interface"
+)
+
+const transferSlotPollInterval = time.Second * 30
+
+// deals that haven't finished transferring after this long no longer count
+// against the in-flight limit, they are most likely stuck or abandoned
+const transferSlotTimeout = time.Hour * 24
+
+// transferLimiter bounds how many deals can be moving data at once. Deals
+// that would go over the limit wait in line for a slot before their
+// proposal is sent, a freed slot goes to the deals of the highest priority
+// content waiting.
+type transferLimiter struct {
+	lk       sync.Mutex
+	max      int
+	reserved int
+	queued   int
+	inflight int
+
+	// deals waiting for a slot, by the priority of their content
+	waiting map[int]int
+
+	inflightMetr metrics.Gauge
+	queuedMetr   metrics.Gauge
+}
+
+func newTransferLimiter(max int) *transferLimiter {
+	metCtx := metrics.CtxScope(context.Background(), "content_manager")
+	return &transferLimiter{
+		max:          max,
+		waiting:      make(map[int]int),
+		inflightMetr: metrics.NewCtx(metCtx, "transfers_inflight", "number of deals currently transferring data").Gauge(),
+		queuedMetr:   metrics.NewCtx(metCtx, "transfers_queued", "number of deals waiting for a transfer slot").Gauge(),
+	}
+}
+
+type transferSlotStatus struct {
+	Limit    int `json:"limit"`
+	InFlight int `json:"inFlight"`
+	Queued   int `json:"queued"`
+}
+
+func (tl *transferLimiter) status() *transferSlotStatus {
+	tl.lk.Lock()
+	defer tl.lk.Unlock()
+	return &transferSlotStatus{
+		Limit:    tl.max,
+		InFlight: tl.inflight,
+		Queued:   tl.queued,
+	}
+}
+
+func (cm *ContentManager) countInflightTransfers() (int, error) {
+	var n int64
+	if err := cm.DB.Model(&contentDeal{}).
+		Where("not failed and deal_id = 0 and created_at > ? and transfer_finished < ?", time.Now().Add(-transferSlotTimeout), time.Unix(1, 0)).
+		Count(&n).Error; err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// higherWaiting reports whether deals of a higher priority content than
+// priority are waiting for a slot
+func (tl *transferLimiter) higherWaiting(priority int) bool {
+	for p, n := range tl.waiting {
+		if p > priority && n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForTransferSlot blocks until a new deal can be started without going
+// over the in-flight transfer limit, and no deal of a higher priority
+// content is waiting for a slot. The returned func must be called once the
+// deal has been written to the database (or abandoned) to give up the
+// reservation.
+func (cm *ContentManager) waitForTransferSlot(ctx context.Context, priority int) (func(), error) {
+	tl := cm.transferLimiter
+	if tl.max <= 0 {
+		return func() {}, nil
+	}
+
+	tl.lk.Lock()
+	tl.queued++
+	tl.waiting[priority]++
+	tl.queuedMetr.Set(float64(tl.queued))
+	tl.lk.Unlock()
+
+	defer func() {
+		tl.lk.Lock()
+		tl.queued--
+		tl.waiting[priority]--
+		tl.queuedMetr.Set(float64(tl.queued))
+		tl.lk.Unlock()
+	}()
+
+	for {
+		n, err := cm.countInflightTransfers()
+		if err != nil {
+			return nil, err
+		}
+
+		tl.lk.Lock()
+		tl.inflight = n
+		tl.inflightMetr.Set(float64(n))
+		if n+tl.reserved < tl.max && !tl.higherWaiting(priority) {
+			tl.reserved++
+			tl.lk.Unlock()
+
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					tl.lk.Lock()
+					tl.reserved--
+					tl.lk.Unlock()
+				})
+			}, nil
+		}
+		tl.lk.Unlock()
+
+		select {
+		case <-time.After(transferSlotPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"time"
+
+	"github.com/application-research/filclient"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	lru "github.com/hashicorp/golang-lru"
+	"gorm.io/gorm"
+)
+
+// transferEventRecord is one entry in the timeline of a deal's data
+// transfer, kept around after the deal is done to find out why a transfer
+// was slow or flaky
+type transferEventRecord struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"time"`
+	Deal      uint      `gorm:"index" json:"deal"`
+	Chanid    string    `json:"chanid"`
+	Event     string    `json:"event"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	Sent      uint64    `json:"sent"`
+}
+
+// legacyTransferEvents names the go-data-transfer events that make it into
+// the log, progress events come in for every block and are left out
+var legacyTransferEvents = map[datatransfer.EventCode]string{
+	datatransfer.Open:             "requested",
+	datatransfer.Accept:           "started",
+	datatransfer.Restart:          "restarted",
+	datatransfer.PauseInitiator:   "paused",
+	datatransfer.PauseResponder:   "paused",
+	datatransfer.ResumeInitiator:  "resumed",
+	datatransfer.ResumeResponder:  "resumed",
+	datatransfer.Disconnected:     "disconnected",
+	datatransfer.RequestTimedOut:  "timed-out",
+	datatransfer.SendDataError:    "error",
+	datatransfer.Error:            "error",
+	datatransfer.FinishTransfer:   "transferred",
+	datatransfer.Complete:         "completed",
+	datatransfer.Cancel:           "cancelled",
+	datatransfer.RequestCancelled: "cancelled",
+}
+
+// transferStatusEvent names the step a transfer took when its status went
+// from prev to cur, for transfers we only see status updates for (boost
+// transfers and transfers run by shuttles). It's empty if nothing changed.
+func transferStatusEvent(prev, cur datatransfer.Status, seen bool) string {
+	if seen && prev == cur {
+		return ""
+	}
+
+	switch cur {
+	case datatransfer.Requested:
+		return "requested"
+	case datatransfer.Ongoing:
+		if seen && prev == datatransfer.Failing {
+			return "restarted"
+		}
+		if seen && prev == datatransfer.Ongoing {
+			return ""
+		}
+		return "started"
+	case datatransfer.Failing:
+		return "stalled"
+	case datatransfer.TransferFinished:
+		return "transferred"
+	case datatransfer.Completed:
+		return "completed"
+	case datatransfer.Failed:
+		return "failed"
+	case datatransfer.Cancelled:
+		return "cancelled"
+	default:
+		return ""
+	}
+}
+
+type transferLogger struct {
+	db *gorm.DB
+
+	// last status seen for each deal, to only log the changes
+	last *lru.ARCCache
+}
+
+func newTransferLogger(db *gorm.DB) (*transferLogger, error) {
+	last, err := lru.NewARC(10000)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transferLogger{
+		db:   db,
+		last: last,
+	}, nil
+}
+
+func (tl *transferLogger) record(deal uint, chanid, event string, st *filclient.ChannelState) {
+	rec := &transferEventRecord{
+		Deal:   deal,
+		Chanid: chanid,
+		Event:  event,
+	}
+	if st != nil {
+		rec.Status = st.StatusStr
+		if rec.Status == "" {
+			rec.Status = datatransfer.Statuses[st.Status]
+		}
+		rec.Message = st.Message
+		rec.Sent = st.Sent
+	}
+
+	if err := tl.db.Create(rec).Error; err != nil {
+		log.Errorw("failed to record transfer event", "deal", deal, "event", event, "err", err)
+	}
+}
+
+// recordStatus logs the step a transfer took, if any, given its latest status
+func (tl *transferLogger) recordStatus(deal uint, chanid string, st *filclient.ChannelState) {
+	if st == nil {
+		return
+	}
+
+	var prev datatransfer.Status
+	v, seen := tl.last.Get(deal)
+	if seen {
+		prev = v.(datatransfer.Status)
+	}
+	tl.last.Add(deal, st.Status)
+
+	if event := transferStatusEvent(prev, st.Status, seen); event != "" {
+		tl.record(deal, chanid, event, st)
+	}
+}
+
+func transferEventsForDeal(db *gorm.DB, deal uint) ([]transferEventRecord, error) {
+	var events []transferEventRecord
+	if err := db.Order("id asc").Find(&events, "deal = ?", deal).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/filclient"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferStatusEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("requested", transferStatusEvent(0, datatransfer.Requested, false))
+	assert.Equal("started", transferStatusEvent(datatransfer.Requested, datatransfer.Ongoing, true))
+	assert.Equal("", transferStatusEvent(datatransfer.Ongoing, datatransfer.Ongoing, true))
+	assert.Equal("stalled", transferStatusEvent(datatransfer.Ongoing, datatransfer.Failing, true))
+	assert.Equal("restarted", transferStatusEvent(datatransfer.Failing, datatransfer.Ongoing, true))
+	assert.Equal("completed", transferStatusEvent(datatransfer.TransferFinished, datatransfer.Completed, true))
+	assert.Equal("", transferStatusEvent(datatransfer.Ongoing, datatransfer.Finalizing, true))
+}
+
+func TestTransferLoggerRecordStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	db := newTestDB(t, &transferEventRecord{})
+
+	tl, err := newTransferLogger(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, st := range []datatransfer.Status{
+		datatransfer.Requested,
+		datatransfer.Ongoing,
+		datatransfer.Ongoing,
+		datatransfer.Failing,
+		datatransfer.Ongoing,
+		datatransfer.Completed,
+	} {
+		tl.recordStatus(1, "chan", &filclient.ChannelState{Status: st})
+	}
+	tl.recordStatus(2, "other", &filclient.ChannelState{Status: datatransfer.Requested})
+
+	events, err := transferEventsForDeal(db, 1)
+	assert.NoError(err)
+
+	var names []string
+	for _, ev := range events {
+		names = append(names, ev.Event)
+	}
+	assert.Equal([]string{"requested", "started", "stalled", "restarted", "completed"}, names)
+	assert.Equal("Ongoing", events[1].Status)
+}
@@ -1,10 +1,18 @@
 package util
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
+	"fmt"
+	"io"
 
+	"github.com/filecoin-project/go-fil-markets/shared"
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
 )
 
 type Object struct {
@@ -35,3 +43,117 @@ func CalculateCarSize(data cid.Cid, objects []Object) (uint64, error) {
 
 	return size, nil
 }
+
+// most links a piece CAR traversal follows, the same limit filclient uses
+const pieceCarMaxLinks = 32 << 20
+
+// PieceCar prepares the CARv1 stream that the piece commitment of a deal for
+// data is computed over: every block under data once, in the order an
+// all-selector traversal visits them. It must stay in step with how
+// filclient.GeneratePieceCommitmentFFI builds its CAR, or the stream won't
+// reproduce the deal's piece CID.
+func PieceCar(ctx context.Context, bs blockstore.Blockstore, data cid.Cid) (car.SelectiveCarPrepared, error) {
+	sc := car.NewSelectiveCar(ctx, bs,
+		[]car.Dag{{Root: data, Selector: shared.AllSelector()}},
+		car.MaxTraversalLinks(pieceCarMaxLinks),
+		car.TraverseLinksOnlyOnce(),
+	)
+	return sc.Prepare()
+}
+
+// CarBlockMismatchError is returned when a block in a CAR file doesn't hash
+// to the cid it is stored under
+type CarBlockMismatchError struct {
+	Cid    cid.Cid
+	Actual cid.Cid
+}
+
+func (e *CarBlockMismatchError) Error() string {
+	return fmt.Sprintf("car block %s does not match its data (hashes to %s)", e.Cid, e.Actual)
+}
+
+// LoadVerifiedCar loads a CAR file into the blockstore like car.LoadCar,
+// but reports blocks that don't hash to their cid as a CarBlockMismatchError
+// so that callers can tell bad uploads apart from failures on our end
+func LoadVerifiedCar(ctx context.Context, bs blockstore.Blockstore, r io.Reader) (*car.CarHeader, error) {
+	return LoadVerifiedCarWithLimits(ctx, bs, r, DefaultImportLimits)
+}
+
+// LoadVerifiedCarWithLimits is LoadVerifiedCar writing blocks to the
+// blockstore in batches within the limits
+func LoadVerifiedCarWithLimits(ctx context.Context, bs blockstore.Blockstore, r io.Reader, limits ImportLimits) (*car.CarHeader, error) {
+	br := bufio.NewReader(r)
+	header, err := car.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Version != 1 {
+		return nil, fmt.Errorf("invalid car version: %d", header.Version)
+	}
+
+	bb := &blockBuffer{
+		limits: limits,
+		flush: func(blks []blocks.Block) error {
+			return bs.PutMany(ctx, blks)
+		},
+	}
+	for {
+		c, data, err := carutil.ReadNode(br)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		actual, err := c.Prefix().Sum(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if !actual.Equals(c) {
+			return nil, &CarBlockMismatchError{Cid: c, Actual: actual}
+		}
+
+		blk, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := bb.add(blk); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := bb.commit(); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// CarRoot picks the root to track a CAR file by. With no root requested the
+// CAR must declare exactly one, otherwise the requested root must be one of
+// the declared ones.
+func CarRoot(header *car.CarHeader, root string) (cid.Cid, error) {
+	if root == "" {
+		if len(header.Roots) != 1 {
+			return cid.Undef, fmt.Errorf("car file declares %d roots, specify which one to use", len(header.Roots))
+		}
+		return header.Roots[0], nil
+	}
+
+	rc, err := cid.Decode(root)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("invalid root cid: %w", err)
+	}
+
+	for _, r := range header.Roots {
+		if r.Equals(rc) {
+			return r, nil
+		}
+	}
+
+	return cid.Undef, fmt.Errorf("root %s is not one of the roots declared by the car file", rc)
+}
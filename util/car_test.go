@@ -1,18 +1,22 @@
 package util
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"math/rand"
 	"testing"
 
 	"github.com/filecoin-project/go-fil-markets/shared"
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dss "github.com/ipfs/go-datastore/sync"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/ipfs/go-merkledag"
 	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
 	"github.com/stretchr/testify/require"
 )
 
@@ -55,3 +59,91 @@ func TestCalculateCarSize(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int(preparedCar.Size()), int(size))
 }
+
+func TestLoadVerifiedCar(t *testing.T) {
+	ctx := context.Background()
+
+	good := blocks.NewBlock([]byte("good block"))
+	bad, err := blocks.NewBlockWithCid([]byte("tampered"), blocks.NewBlock([]byte("original")).Cid())
+	require.NoError(t, err)
+
+	writeCar := func(roots []cid.Cid, blks ...blocks.Block) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		require.NoError(t, car.WriteHeader(&car.CarHeader{Roots: roots, Version: 1}, buf))
+		for _, b := range blks {
+			require.NoError(t, carutil.LdWrite(buf, b.Cid().Bytes(), b.RawData()))
+		}
+		return buf
+	}
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	header, err := LoadVerifiedCar(ctx, bs, writeCar([]cid.Cid{good.Cid()}, good))
+	require.NoError(t, err)
+	has, err := bs.Has(ctx, good.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	root, err := CarRoot(header, "")
+	require.NoError(t, err)
+	require.Equal(t, good.Cid(), root)
+
+	bs = blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	_, err = LoadVerifiedCar(ctx, bs, writeCar([]cid.Cid{good.Cid()}, good, bad))
+	var mismatch *CarBlockMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, bad.Cid(), mismatch.Cid)
+}
+
+func TestCarRoot(t *testing.T) {
+	a := blocks.NewBlock([]byte("a")).Cid()
+	b := blocks.NewBlock([]byte("b")).Cid()
+	header := &car.CarHeader{Roots: []cid.Cid{a, b}, Version: 1}
+
+	_, err := CarRoot(header, "")
+	require.Error(t, err)
+
+	root, err := CarRoot(header, b.String())
+	require.NoError(t, err)
+	require.Equal(t, b, root)
+
+	_, err = CarRoot(header, blocks.NewBlock([]byte("c")).Cid().String())
+	require.Error(t, err)
+
+	_, err = CarRoot(header, "notacid")
+	require.Error(t, err)
+}
+
+func TestPieceCar(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	nd, err := ImportFile(dserv, io.LimitReader(rand.New(rand.NewSource(9)), 3*1024*1024))
+	require.NoError(t, err)
+
+	dump := func() []byte {
+		prepared, err := PieceCar(ctx, bs, nd.Cid())
+		require.NoError(t, err)
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, prepared.Dump(ctx, buf))
+		require.Equal(t, prepared.Size(), uint64(buf.Len()))
+		return buf.Bytes()
+	}
+
+	// the same dag always makes the same bytes, or the piece CID wouldn't
+	// be reproducible
+	first := dump()
+	require.Equal(t, first, dump())
+
+	out := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	header, err := LoadVerifiedCar(ctx, out, bytes.NewReader(first))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{nd.Cid()}, header.Roots)
+
+	// a dag missing blocks can't be exported
+	require.NoError(t, bs.DeleteBlock(ctx, nd.Links()[1].Cid))
+	_, err = PieceCar(ctx, bs, nd.Cid())
+	require.Error(t, err)
+}
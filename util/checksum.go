@@ -0,0 +1,90 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+// ChecksumSHA256 is the only checksum algorithm for now, checksums are
+// written as <algorithm>:<hex digest> so that others can be added
+const ChecksumSHA256 = "sha256"
+
+// Checksummer hashes the bytes of a file as they are read through it. The
+// checksum is of the file as uploaded, independent of how it is chunked into
+// a dag, so it catches reassembly bugs that keep the dag's cids intact.
+type Checksummer struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func NewChecksummer(r io.Reader) *Checksummer {
+	return &Checksummer{
+		r: r,
+		h: sha256.New(),
+	}
+}
+
+func (c *Checksummer) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+// Sum is the checksum of everything read so far
+func (c *Checksummer) Sum() string {
+	return ChecksumSHA256 + ":" + hex.EncodeToString(c.h.Sum(nil))
+}
+
+// ParseChecksum checks that a checksum is well formed and returns it in its
+// canonical form, lower case hex
+func ParseChecksum(s string) (string, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("checksum %q must be of the form %s:<hex digest>", s, ChecksumSHA256)
+	}
+
+	algo, digest := parts[0], parts[1]
+	if algo != ChecksumSHA256 {
+		return "", fmt.Errorf("unsupported checksum algorithm %q, only %s is supported", algo, ChecksumSHA256)
+	}
+
+	b, err := hex.DecodeString(digest)
+	if err != nil {
+		return "", fmt.Errorf("invalid checksum digest: %w", err)
+	}
+	if len(b) != sha256.Size {
+		return "", fmt.Errorf("%s checksum digest must be %d bytes, not %d", ChecksumSHA256, sha256.Size, len(b))
+	}
+
+	return ChecksumSHA256 + ":" + hex.EncodeToString(b), nil
+}
+
+// ChecksumUnixfsFile reassembles the unixfs file at root from the dag and
+// returns the checksum of its bytes
+func ChecksumUnixfsFile(ctx context.Context, dserv ipld.DAGService, root cid.Cid) (string, error) {
+	nd, err := dserv.Get(ctx, root)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := uio.NewDagReader(ctx, nd, dserv)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a unixfs file: %w", root, err)
+	}
+	defer r.Close()
+
+	ck := NewChecksummer(r)
+	if _, err := io.Copy(io.Discard, ck); err != nil {
+		return "", err
+	}
+	return ck.Sum(), nil
+}
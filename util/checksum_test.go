@@ -0,0 +1,65 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	digest := hex.EncodeToString(sum[:])
+
+	c, err := ParseChecksum("sha256:" + digest)
+	require.NoError(t, err)
+	require.Equal(t, "sha256:"+digest, c)
+
+	c, err = ParseChecksum(" sha256:" + strings.ToUpper(digest) + "\n")
+	require.NoError(t, err)
+	require.Equal(t, "sha256:"+digest, c)
+
+	for _, s := range []string{"", digest, "md5:" + digest, "sha256:xyz", "sha256:" + digest[:32]} {
+		_, err := ParseChecksum(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestChecksumUnixfsFile(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	// big enough to be split into several blocks
+	data := make([]byte, 3*1024*1024+17)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	ck := NewChecksummer(bytes.NewReader(data))
+	nd, err := ImportFile(dserv, ck)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(data)
+	require.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), ck.Sum())
+
+	reassembled, err := ChecksumUnixfsFile(ctx, dserv, nd.Cid())
+	require.NoError(t, err)
+	require.Equal(t, ck.Sum(), reassembled)
+
+	dir := unixfs.EmptyDirNode()
+	require.NoError(t, dserv.Add(ctx, dir))
+	_, err = ChecksumUnixfsFile(ctx, dserv, dir.Cid())
+	require.Error(t, err)
+}
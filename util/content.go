@@ -2,8 +2,10 @@ package util
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	format "github.com/ipfs/go-ipld-format"
@@ -46,37 +48,93 @@ type ContentCreateBody struct {
 	Name     string      `json:"name"`
 	Location string      `json:"location"`
 	Type     ContentType `json:"type"`
+
+	// optional lifetime of the content as a duration, e.g. "720h"
+	TTL string `json:"ttl,omitempty"`
+
+	// pin and serve the content without making deals for it, it can be
+	// promoted to make deals later
+	NoDeal bool `json:"noDeal,omitempty"`
+
+	// how soon deals are made for the content compared to others: low,
+	// normal (the default), high or urgent, which only admins may use
+	Priority string `json:"priority,omitempty"`
+
+	// only make deals with miners that got at least this share of their
+	// deals on chain, between 0 and 1. Zero uses the server's default.
+	MinSuccessRatio float64 `json:"minSuccessRatio,omitempty"`
+
+	// checksum of the file's bytes as uploaded, as <algorithm>:<hex digest>,
+	// see Checksummer
+	Checksum string `json:"checksum,omitempty"`
+}
+
+type ContentPromoteBody struct {
+	// replication factor for the promoted content, zero means the default
+	Replication int `json:"replication,omitempty"`
+}
+
+type ContentDeadlineBody struct {
+	// when the content must be fully replicated by, unset clears the
+	// deadline
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	// make fewer deals if the replication can't be met by the deadline
+	ReduceReplication bool `json:"reduceReplication,omitempty"`
+}
+
+// who, besides admins, may see a content, its deals and its data
+const (
+	// only the content's owner, the default for new content
+	ContentAccessOwner = "owner"
+	// the owner and the users the content is shared with
+	ContentAccessShared = "shared"
+	// anyone, including requests without a token
+	ContentAccessPublic = "public"
+)
+
+type ContentAccessBody struct {
+	// one of ContentAccessOwner, ContentAccessShared or ContentAccessPublic
+	Access string `json:"access"`
+
+	// usernames of the users a shared content is shared with, replacing the
+	// ones it was shared with before. Only used with ContentAccessShared.
+	Users []string `json:"users,omitempty"`
 }
 
 type ContentCreateResponse struct {
 	ID uint `json:"id"`
 }
 
-// FindCIDType checks if a pinned CID (root) is a file, a dir or unknown
-// Returns dbmgr.File or dbmgr.Directory on success
-// Returns dbmgr.Unknown otherwise
-func FindCIDType(ctx context.Context, root cid.Cid, dserv ipld.NodeGetter) (contentType ContentType) {
-	contentType = Unknown
-	nilCID := cid.Cid{}
-	if root == nilCID || dserv == nil {
-		return
+// FindCIDType checks if a pinned CID (root) is a file or a dir
+// Returns dbmgr.Directory for unixfs directories, dbmgr.File for anything else
+// Returns dbmgr.Unknown and an error if the root couldn't be fetched, e.g.
+// from a remote NodeGetter, so that callers can tell a failed fetch apart
+// from the content's type and try again
+func FindCIDType(ctx context.Context, root cid.Cid, dserv ipld.NodeGetter) (ContentType, error) {
+	if !root.Defined() {
+		return Unknown, fmt.Errorf("can't find the type of an undefined cid")
+	}
+
+	if dserv == nil {
+		return Unknown, fmt.Errorf("no node getter to fetch %s with", root)
 	}
 
 	nd, err := dserv.Get(ctx, root)
 	if err != nil {
-		return
+		return Unknown, fmt.Errorf("failed to fetch %s: %w", root, err)
 	}
 
-	contentType = File
 	fsNode, err := TryExtractFSNode(nd)
 	if err != nil {
-		return
+		// not unixfs, or a raw block, which is a file on its own
+		return File, nil
 	}
 
 	if fsNode.IsDir() {
-		contentType = Directory
+		return Directory, nil
 	}
-	return
+	return File, nil
 }
 
 func removeEmptyStrings(strList []string) []string {
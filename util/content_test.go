@@ -0,0 +1,48 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindCIDType(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	file, err := ImportFile(dserv, bytes.NewReader([]byte("hello")))
+	require.NoError(t, err)
+
+	dir := unixfs.EmptyDirNode()
+	require.NoError(t, dserv.Add(ctx, dir))
+
+	ct, err := FindCIDType(ctx, file.Cid(), dserv)
+	require.NoError(t, err)
+	require.Equal(t, File, ct)
+
+	ct, err = FindCIDType(ctx, dir.Cid(), dserv)
+	require.NoError(t, err)
+	require.Equal(t, Directory, ct)
+
+	// a root that can't be fetched is an error, not an unknown type
+	missing := merkledag.NodeWithData([]byte("not in the blockstore"))
+	ct, err = FindCIDType(ctx, missing.Cid(), dserv)
+	require.Error(t, err)
+	require.Equal(t, Unknown, ct)
+
+	_, err = FindCIDType(ctx, cid.Undef, dserv)
+	require.Error(t, err)
+	_, err = FindCIDType(ctx, file.Cid(), nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+// DefaultDagWalkConcurrency is the number of nodes fetched at once when
+// walking a dag, the same as merkledag.Concurrent
+const DefaultDagWalkConcurrency = 32
+
+// WalkDag walks the dag under root, fetching up to concurrency nodes from ng
+// at a time so that walking through a slow or lazy getter isn't serialized.
+// visit works as in merkledag.Walk, it is never called concurrently and
+// returning false skips the cid. cb, if not nil, is called with each node
+// once it's fetched and may run on several goroutines at once. Nodes arrive
+// in no particular order, anything cb collects has to be sorted by the caller
+// if the order matters.
+func WalkDag(ctx context.Context, ng ipld.NodeGetter, root cid.Cid, visit func(cid.Cid) bool, concurrency int, cb func(ipld.Node) error) error {
+	if concurrency <= 0 {
+		concurrency = DefaultDagWalkConcurrency
+	}
+
+	return merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		node, err := ng.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if cb != nil {
+			if err := cb(node); err != nil {
+				return nil, err
+			}
+		}
+
+		if c.Type() == cid.Raw {
+			return nil, nil
+		}
+
+		return node.Links(), nil
+	}, root, visit, merkledag.Concurrency(concurrency))
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkDag(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	source := io.LimitReader(rand.New(rand.NewSource(7)), 4*1024*1024)
+	nd, err := ImportFile(dserv, source)
+	require.NoError(t, err)
+
+	walk := func(concurrency int) ([]string, int) {
+		var lk sync.Mutex
+		var seen []string
+		var size int
+
+		cset := cid.NewSet()
+		err := WalkDag(ctx, dserv, nd.Cid(), cset.Visit, concurrency, func(node ipld.Node) error {
+			lk.Lock()
+			defer lk.Unlock()
+			seen = append(seen, node.Cid().String())
+			size += len(node.RawData())
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, cset.Len(), len(seen))
+
+		sort.Strings(seen)
+		return seen, size
+	}
+
+	seqCids, seqSize := walk(1)
+	require.Greater(t, len(seqCids), 1)
+
+	for _, n := range []int{0, 4, 64} {
+		cids, size := walk(n)
+		require.Equal(t, seqCids, cids)
+		require.Equal(t, seqSize, size)
+	}
+
+	// a missing block fails the walk
+	require.NoError(t, bs.DeleteBlock(ctx, nd.Cid()))
+	err = WalkDag(ctx, dserv, nd.Cid(), cid.NewSet().Visit, 4, nil)
+	require.Error(t, err)
+}
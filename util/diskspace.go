@@ -0,0 +1,113 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// InsufficientSpaceError is returned when there isn't enough free disk space
+// to safely write some data into the blockstore
+type InsufficientSpaceError struct {
+	Need uint64
+	Free uint64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough free disk space for the blockstore: need %s, only %s free", humanize.IBytes(e.Need), humanize.IBytes(e.Free))
+}
+
+// FreeSpaceGuard refuses to start writes into the blockstore that could fill
+// up the disk, which can corrupt the blockstore and the database with it
+type FreeSpaceGuard struct {
+	// a directory on the filesystem holding the blockstore, the guard is
+	// disabled if it is empty
+	Dir string
+
+	// added to the size of the data to account for the DAG and blockstore
+	// overhead on top of the raw bytes
+	OverheadPercent int
+
+	// bytes that must still be free once the data has been written
+	Headroom int64
+}
+
+// NewFreeSpaceGuard guards the filesystem dir is on. With no dir it returns
+// nil, which lets every write through.
+func NewFreeSpaceGuard(dir string, overheadPercent int, headroom int64) *FreeSpaceGuard {
+	if dir == "" {
+		return nil
+	}
+
+	return &FreeSpaceGuard{
+		Dir:             dir,
+		OverheadPercent: overheadPercent,
+		Headroom:        headroom,
+	}
+}
+
+// Check errors with an InsufficientSpaceError if size bytes of content can't
+// be written without going into the headroom. Pass zero when the size isn't
+// known up front to only check that the headroom is still there.
+func (g *FreeSpaceGuard) Check(size int64) error {
+	if g == nil || g.Dir == "" {
+		return nil
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(g.Dir, &st); err != nil {
+		return fmt.Errorf("failed to check free disk space: %w", err)
+	}
+
+	free := st.Bavail * uint64(st.Bsize)
+	need := g.needed(size)
+	if need > free {
+		return &InsufficientSpaceError{Need: need, Free: free}
+	}
+	return nil
+}
+
+// CheckWrite is Check for writes that go ahead when the free space can't be
+// checked at all, which is only logged. It only errors with an
+// InsufficientSpaceError.
+func (g *FreeSpaceGuard) CheckWrite(size int64) error {
+	err := g.Check(size)
+	if err == nil {
+		return nil
+	}
+
+	var ise *InsufficientSpaceError
+	if xerrors.As(err, &ise) {
+		return err
+	}
+
+	log.Warnf("failed to check free space: %s", err)
+	return nil
+}
+
+// CheckImport is CheckWrite for the handlers that import content
+func (g *FreeSpaceGuard) CheckImport(size int64) error {
+	if err := g.CheckWrite(size); err != nil {
+		return &HttpError{
+			Code:    http.StatusInsufficientStorage,
+			Message: ERR_BLOCKSTORE_FULL,
+			Details: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (g *FreeSpaceGuard) needed(size int64) uint64 {
+	if size < 0 {
+		size = 0
+	}
+
+	need := uint64(size) + uint64(size)*uint64(g.OverheadPercent)/100
+	if g.Headroom > 0 {
+		need += uint64(g.Headroom)
+	}
+	return need
+}
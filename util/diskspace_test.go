@@ -0,0 +1,41 @@
+package util
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestFreeSpaceGuard(t *testing.T) {
+	g := &FreeSpaceGuard{
+		Dir:             t.TempDir(),
+		OverheadPercent: 10,
+		Headroom:        1000,
+	}
+
+	require.Equal(t, uint64(1000), g.needed(0))
+	require.Equal(t, uint64(1000), g.needed(-1))
+	require.Equal(t, uint64(2100), g.needed(1000))
+
+	require.NoError(t, g.Check(0))
+
+	g.Headroom = 1 << 62
+	err := g.Check(0)
+	var ise *InsufficientSpaceError
+	require.True(t, xerrors.As(err, &ise))
+	require.Equal(t, uint64(1<<62), ise.Need)
+
+	// no directory, no guard
+	require.NoError(t, (&FreeSpaceGuard{Headroom: 1 << 62}).Check(0))
+	var nilGuard *FreeSpaceGuard
+	require.NoError(t, nilGuard.Check(1<<62))
+	require.Nil(t, NewFreeSpaceGuard("", 10, 1<<62))
+
+	// imports are refused with a 507
+	err = NewFreeSpaceGuard(t.TempDir(), 10, 1<<62).CheckImport(0)
+	var herr *HttpError
+	require.True(t, xerrors.As(err, &herr))
+	require.Equal(t, http.StatusInsufficientStorage, herr.Code)
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// GatewayGrantParam is the query parameter the primary passes a gateway
+// grant to a shuttle in, when redirecting a gateway request to it
+const GatewayGrantParam = "grant"
+
+// GatewayGrant signs a grant for a shuttle's gateway to serve c until expiry,
+// with the shuttle's token as the key. The primary only hands one out after
+// checking the caller may see c, so shuttles don't serve data of contents
+// that aren't public to anyone who asks them directly. A grant looks like
+//
+//	<expiry unix seconds>.<hex hmac-sha256>
+func GatewayGrant(token string, c cid.Cid, expiry time.Time) string {
+	exp := strconv.FormatInt(expiry.Unix(), 10)
+	return exp + "." + gatewayGrantMAC(token, c, exp)
+}
+
+// CheckGatewayGrant checks that grant is one GatewayGrant made for c with
+// token, and hasn't expired
+func CheckGatewayGrant(token string, c cid.Cid, grant string, now time.Time) error {
+	i := strings.Index(grant, ".")
+	if i < 0 {
+		return fmt.Errorf("malformed gateway grant")
+	}
+	exp, mac := grant[:i], grant[i+1:]
+
+	secs, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed gateway grant expiry: %w", err)
+	}
+
+	if !hmac.Equal([]byte(mac), []byte(gatewayGrantMAC(token, c, exp))) {
+		return fmt.Errorf("gateway grant isn't for %s", c)
+	}
+
+	if now.After(time.Unix(secs, 0)) {
+		return fmt.Errorf("gateway grant expired")
+	}
+	return nil
+}
+
+func gatewayGrantMAC(token string, c cid.Cid, exp string) string {
+	h := hmac.New(sha256.New, []byte(token))
+	h.Write([]byte(exp))
+	h.Write([]byte{0})
+	h.Write(c.Hash())
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGatewayGrant(t *testing.T) {
+	c, err := cid.Decode("bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi")
+	require.NoError(t, err)
+	other, err := cid.Decode("QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u")
+	require.NoError(t, err)
+
+	now := time.Unix(1600000000, 0)
+	grant := GatewayGrant("secret", c, now.Add(time.Hour))
+
+	require.NoError(t, CheckGatewayGrant("secret", c, grant, now))
+	require.NoError(t, CheckGatewayGrant("secret", cid.NewCidV0(c.Hash()), grant, now))
+
+	require.Error(t, CheckGatewayGrant("secret", c, grant, now.Add(2*time.Hour)))
+	require.Error(t, CheckGatewayGrant("other", c, grant, now))
+	require.Error(t, CheckGatewayGrant("secret", other, grant, now))
+	require.Error(t, CheckGatewayGrant("secret", c, "", now))
+
+	// the expiry is part of what's signed
+	require.Error(t, CheckGatewayGrant("secret", c, "1700000000"+grant[len("1600003600"):], now))
+}
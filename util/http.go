@@ -31,6 +31,14 @@ const (
 	ERR_INVITE_ALREADY_USED     = "ERR_INVITE_ALREADY_USED"
 	ERR_CONTENT_ADDING_DISABLED = "ERR_CONTENT_ADDING_DISABLED"
 	ERR_INVALID_INPUT           = "ERR_INVALID_INPUT"
+	ERR_BLOCKSTORE_FULL         = "ERR_BLOCKSTORE_FULL"
+	ERR_SHUTTING_DOWN           = "ERR_SHUTTING_DOWN"
+	ERR_RECORD_NOT_FOUND        = "ERR_RECORD_NOT_FOUND"
+	ERR_QUOTA_EXCEEDED          = "ERR_QUOTA_EXCEEDED"
+	ERR_CHECKSUM_MISMATCH       = "ERR_CHECKSUM_MISMATCH"
+	ERR_PIECE_MISMATCH          = "ERR_PIECE_MISMATCH"
+	ERR_PIECE_PENDING           = "ERR_PIECE_PENDING"
+	ERR_MINER_UNREACHABLE       = "ERR_MINER_UNREACHABLE"
 )
 
 type HttpError struct {
@@ -120,6 +128,7 @@ type UserSettings struct {
 
 	ContentAddingDisabled bool `json:"contentAddingDisabled"`
 	DealMakingDisabled    bool `json:"dealMakingDisabled"`
+	DealMakingPaused      bool `json:"dealMakingPaused"`
 
 	UploadEndpoints []string `json:"uploadEndpoints"`
 }
@@ -0,0 +1,145 @@
+package util
+
+import (
+	"context"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ImportLimits bounds how much of an upload is held in memory before it is
+// written out. Blocks are flushed once either limit is reached, with either
+// limit at zero every block is written as soon as it is made, so memory use
+// doesn't grow with the size of the upload.
+type ImportLimits struct {
+	MaxBlocks int
+	MaxBytes  int64
+}
+
+// DefaultImportLimits keep each upload to a few MiB, a few chunks of a file,
+// since there can be many uploads at once
+var DefaultImportLimits = ImportLimits{
+	MaxBlocks: 1000,
+	MaxBytes:  4 << 20,
+}
+
+func (l ImportLimits) full(blocks int, bytes int64) bool {
+	return blocks >= l.MaxBlocks || bytes >= l.MaxBytes
+}
+
+// blockBuffer collects blocks until the limits are reached and then hands
+// them to flush in one go
+type blockBuffer struct {
+	limits ImportLimits
+	flush  func([]blocks.Block) error
+
+	buf  []blocks.Block
+	size int64
+}
+
+func (bb *blockBuffer) add(blk blocks.Block) error {
+	bb.buf = append(bb.buf, blk)
+	bb.size += int64(len(blk.RawData()))
+
+	if bb.limits.full(len(bb.buf), bb.size) {
+		return bb.commit()
+	}
+	return nil
+}
+
+func (bb *blockBuffer) commit() error {
+	if len(bb.buf) == 0 {
+		return nil
+	}
+
+	if err := bb.flush(bb.buf); err != nil {
+		return err
+	}
+
+	// don't hold on to the flushed blocks through the backing array
+	for i := range bb.buf {
+		bb.buf[i] = nil
+	}
+	bb.buf = bb.buf[:0]
+	bb.size = 0
+	return nil
+}
+
+// bufferedDAGService writes the nodes added to it to the underlying
+// DAGService in batches, within the import limits
+type bufferedDAGService struct {
+	ipld.DAGService
+
+	ctx context.Context
+	bb  *blockBuffer
+}
+
+func newBufferedDAGService(ctx context.Context, dserv ipld.DAGService, limits ImportLimits) *bufferedDAGService {
+	bd := &bufferedDAGService{
+		DAGService: dserv,
+		ctx:        ctx,
+	}
+	bd.bb = &blockBuffer{
+		limits: limits,
+		flush:  bd.flush,
+	}
+	return bd
+}
+
+func (bd *bufferedDAGService) flush(blks []blocks.Block) error {
+	nds := make([]ipld.Node, len(blks))
+	for i, b := range blks {
+		nds[i] = b.(ipld.Node)
+	}
+	return bd.DAGService.AddMany(bd.ctx, nds)
+}
+
+func (bd *bufferedDAGService) Add(ctx context.Context, nd ipld.Node) error {
+	return bd.bb.add(nd)
+}
+
+func (bd *bufferedDAGService) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		if err := bd.bb.add(nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get writes out what is buffered first, so that nodes added earlier can be
+// read back
+func (bd *bufferedDAGService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if err := bd.bb.commit(); err != nil {
+		return nil, err
+	}
+	return bd.DAGService.Get(ctx, c)
+}
+
+func (bd *bufferedDAGService) GetMany(ctx context.Context, cs []cid.Cid) <-chan *ipld.NodeOption {
+	if err := bd.bb.commit(); err != nil {
+		out := make(chan *ipld.NodeOption, 1)
+		out <- &ipld.NodeOption{Err: err}
+		close(out)
+		return out
+	}
+	return bd.DAGService.GetMany(ctx, cs)
+}
+
+// ImportFileWithLimits imports a file like ImportFile, writing its blocks
+// out in batches within the limits
+func ImportFileWithLimits(ctx context.Context, dserv ipld.DAGService, fi io.Reader, limits ImportLimits) (ipld.Node, error) {
+	bd := newBufferedDAGService(ctx, dserv, limits)
+
+	nd, err := ImportFile(bd, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bd.bb.commit(); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
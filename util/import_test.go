@@ -0,0 +1,215 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	"github.com/stretchr/testify/require"
+)
+
+// batchRecorder notes the size of every batch written to it
+type batchRecorder struct {
+	ipld.DAGService
+
+	batches []int64
+}
+
+func (br *batchRecorder) Add(ctx context.Context, nd ipld.Node) error {
+	return br.AddMany(ctx, []ipld.Node{nd})
+}
+
+func (br *batchRecorder) AddMany(ctx context.Context, nds []ipld.Node) error {
+	var size int64
+	for _, nd := range nds {
+		size += int64(len(nd.RawData()))
+	}
+	br.batches = append(br.batches, size)
+	return br.DAGService.AddMany(ctx, nds)
+}
+
+func newTestDagService() ipld.DAGService {
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	return merkledag.NewDAGService(blockservice.New(bs, nil))
+}
+
+func TestImportFileWithLimits(t *testing.T) {
+	ctx := context.Background()
+
+	data := make([]byte, 24<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	expected, err := ImportFile(newTestDagService(), bytes.NewReader(data))
+	require.NoError(t, err)
+
+	limits := ImportLimits{MaxBlocks: 1000, MaxBytes: 4 << 20}
+	rec := &batchRecorder{DAGService: newTestDagService()}
+	nd, err := ImportFileWithLimits(ctx, rec, bytes.NewReader(data), limits)
+	require.NoError(t, err)
+	require.Equal(t, expected.Cid(), nd.Cid())
+
+	var total int64
+	for _, b := range rec.batches {
+		// a batch is flushed as soon as it reaches the limit, so it can only
+		// go over by the last block, at most a chunk
+		require.Less(t, b, limits.MaxBytes+(1<<20))
+		total += b
+	}
+	require.Greater(t, len(rec.batches), 1)
+	require.GreaterOrEqual(t, total, int64(len(data)))
+
+	// every block is written as soon as it is made
+	rec = &batchRecorder{DAGService: newTestDagService()}
+	nd, err = ImportFileWithLimits(ctx, rec, bytes.NewReader(data), ImportLimits{})
+	require.NoError(t, err)
+	require.Equal(t, expected.Cid(), nd.Cid())
+	for _, b := range rec.batches {
+		require.LessOrEqual(t, b, int64(1<<20))
+	}
+}
+
+// putRecorder notes the number of blocks in every batch written to it
+type putRecorder struct {
+	blockstore.Blockstore
+
+	batches []int
+}
+
+func (pr *putRecorder) PutMany(ctx context.Context, blks []blocks.Block) error {
+	pr.batches = append(pr.batches, len(blks))
+	return pr.Blockstore.PutMany(ctx, blks)
+}
+
+func TestLoadVerifiedCarWithLimits(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+	nd, err := ImportFile(dserv, io.LimitReader(rand.New(rand.NewSource(4)), 8<<20))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, car.WriteCar(ctx, dserv, []cid.Cid{nd.Cid()}, &buf))
+
+	rec := &putRecorder{Blockstore: blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))}
+	header, err := LoadVerifiedCarWithLimits(ctx, rec, &buf, ImportLimits{MaxBlocks: 3, MaxBytes: 64 << 20})
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{nd.Cid()}, header.Roots)
+
+	var total int
+	for _, n := range rec.batches {
+		require.LessOrEqual(t, n, 3)
+		total += n
+	}
+	// eight 1MiB leaves and their parent
+	require.Equal(t, 9, total)
+
+	has, err := rec.Has(ctx, nd.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+}
+
+// discardDagService drops everything added to it, so that all the memory an
+// import holds on to is its own
+type discardDagService struct {
+	ipld.DAGService
+}
+
+func (discardDagService) Add(context.Context, ipld.Node) error {
+	return nil
+}
+
+func (discardDagService) AddMany(context.Context, []ipld.Node) error {
+	return nil
+}
+
+// heapPeak samples the heap until stopped and returns the most it saw in use
+func heapPeak() func() uint64 {
+	var peak uint64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Millisecond * 5)
+		defer ticker.Stop()
+
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > peak {
+				peak = ms.HeapAlloc
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() uint64 {
+		close(done)
+		wg.Wait()
+		return peak
+	}
+}
+
+func TestImportFileBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("imports a large file")
+	}
+
+	const size = 512 << 20
+	limits := ImportLimits{MaxBlocks: 1000, MaxBytes: 16 << 20}
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	stop := heapPeak()
+	_, err := ImportFileWithLimits(context.Background(), discardDagService{}, io.LimitReader(rand.New(rand.NewSource(5)), size), limits)
+	peak := stop()
+	require.NoError(t, err)
+
+	// the buffer, the chunk being read and the garbage the gc hasn't caught
+	// up with yet, far from the size of the file
+	grew := int64(peak) - int64(before.HeapAlloc)
+	t.Logf("imported %d MiB, heap grew by at most %d MiB", size>>20, grew>>20)
+	require.Less(t, grew, int64(128<<20))
+}
+
+func BenchmarkImportFileWithLimits(b *testing.B) {
+	const size = 256 << 20
+	limits := DefaultImportLimits
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		stop := heapPeak()
+		if _, err := ImportFileWithLimits(context.Background(), discardDagService{}, io.LimitReader(rand.New(rand.NewSource(int64(i))), size), limits); err != nil {
+			b.Fatal(err)
+		}
+		if p := stop(); p > peak {
+			peak = p
+		}
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+}
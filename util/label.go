@@ -0,0 +1,109 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/clientutils"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+)
+
+// Deal label schemes. The cid scheme labels deals with the payload cid only,
+// as filclient does. The estuary scheme also records the content the deal
+// was made for, so deals found on chain can be traced back to it:
+//
+//	estuary:<content id>:v<version>:<payload cid>
+const (
+	DealLabelSchemeCid     = "cid"
+	DealLabelSchemeEstuary = "estuary"
+)
+
+const (
+	estuaryLabelPrefix  = "estuary:"
+	estuaryLabelVersion = 1
+)
+
+// DealLabeler makes the label of the deal proposals for a content
+type DealLabeler interface {
+	Label(content uint, payload cid.Cid) (string, error)
+}
+
+func NewDealLabeler(scheme string) (DealLabeler, error) {
+	switch scheme {
+	case DealLabelSchemeCid:
+		return cidLabeler{}, nil
+	case "", DealLabelSchemeEstuary:
+		return estuaryLabeler{}, nil
+	default:
+		return nil, fmt.Errorf("unknown deal label scheme %q, must be %s or %s", scheme, DealLabelSchemeCid, DealLabelSchemeEstuary)
+	}
+}
+
+type cidLabeler struct{}
+
+func (cidLabeler) Label(content uint, payload cid.Cid) (string, error) {
+	return clientutils.LabelField(payload)
+}
+
+type estuaryLabeler struct{}
+
+// Label falls back to the payload cid alone if the label would go over the
+// size the market actor allows, so the deal can still be made
+func (estuaryLabeler) Label(content uint, payload cid.Cid) (string, error) {
+	label := fmt.Sprintf("%s%d:v%d:%s", estuaryLabelPrefix, content, estuaryLabelVersion, payload)
+	if len(label) > market.DealMaxLabelSize {
+		return clientutils.LabelField(payload)
+	}
+	return label, nil
+}
+
+// DealLabel is what a deal's label says about it. Content is zero for labels
+// that only have the payload cid.
+type DealLabel struct {
+	Content uint    `json:"content,omitempty"`
+	Version int     `json:"version,omitempty"`
+	Payload cid.Cid `json:"payload"`
+}
+
+// DecodeDealLabel reads a label made with either scheme
+func DecodeDealLabel(s string) (*DealLabel, error) {
+	if !strings.HasPrefix(s, estuaryLabelPrefix) {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		return &DealLabel{Payload: c}, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(s, estuaryLabelPrefix), ":", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[1], "v") {
+		return nil, fmt.Errorf("malformed estuary deal label %q", s)
+	}
+
+	content, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content id in deal label %q: %w", s, err)
+	}
+
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid version in deal label %q: %w", s, err)
+	}
+
+	if version != estuaryLabelVersion {
+		return nil, fmt.Errorf("unsupported deal label version %d", version)
+	}
+
+	c, err := cid.Decode(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload cid in deal label %q: %w", s, err)
+	}
+
+	return &DealLabel{
+		Content: uint(content),
+		Version: version,
+		Payload: c,
+	}, nil
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/clientutils"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDealLabelRoundTrip(t *testing.T) {
+	payload, err := cid.Decode("bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi")
+	require.NoError(t, err)
+
+	labeler, err := NewDealLabeler(DealLabelSchemeEstuary)
+	require.NoError(t, err)
+
+	label, err := labeler.Label(42, payload)
+	require.NoError(t, err)
+	require.Equal(t, "estuary:42:v1:bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", label)
+
+	dl, err := DecodeDealLabel(label)
+	require.NoError(t, err)
+	require.Equal(t, &DealLabel{Content: 42, Version: 1, Payload: payload}, dl)
+
+	pc, err := ParseDealLabel(label)
+	require.NoError(t, err)
+	require.Equal(t, payload, pc)
+
+	// labels filclient makes only have the payload cid
+	labeler, err = NewDealLabeler(DealLabelSchemeCid)
+	require.NoError(t, err)
+
+	label, err = labeler.Label(42, payload)
+	require.NoError(t, err)
+
+	dl, err = DecodeDealLabel(label)
+	require.NoError(t, err)
+	require.Equal(t, &DealLabel{Payload: payload}, dl)
+
+	_, err = NewDealLabeler("content-id")
+	require.Error(t, err)
+}
+
+func TestDealLabelOverflow(t *testing.T) {
+	// an identity hash puts the data in the cid, this one is too long for the
+	// estuary label in base32 but fits as a base64 cid label
+	mh, err := multihash.Sum(bytes.Repeat([]byte("a"), 150), multihash.IDENTITY, -1)
+	require.NoError(t, err)
+	payload := cid.NewCidV1(cid.Raw, mh)
+
+	labeler, err := NewDealLabeler(DealLabelSchemeEstuary)
+	require.NoError(t, err)
+
+	label, err := labeler.Label(42, payload)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(label), market.DealMaxLabelSize)
+
+	expected, err := clientutils.LabelField(payload)
+	require.NoError(t, err)
+	require.Equal(t, expected, label)
+}
+
+func TestDecodeDealLabelErrors(t *testing.T) {
+	for _, label := range []string{
+		"",
+		"estuary:",
+		"estuary:42:bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi",
+		"estuary:x:v1:bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi",
+		"estuary:42:v2:bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi",
+		"estuary:42:v1:notacid",
+	} {
+		_, err := DecodeDealLabel(label)
+		require.Error(t, err, label)
+	}
+}
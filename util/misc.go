@@ -19,6 +19,11 @@ func TransferTerminated(st *filclient.ChannelState) bool {
 
 }
 
+// ParseDealLabel returns the payload cid in a deal label, see DecodeDealLabel
 func ParseDealLabel(s string) (cid.Cid, error) {
-	return cid.Decode(s)
+	dl, err := DecodeDealLabel(s)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return dl.Payload, nil
 }
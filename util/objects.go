@@ -0,0 +1,124 @@
+package util
+
+import (
+	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+)
+
+// DefaultObjectBatchSize is the rows per insert statement used when recording
+// objects with no batch size configured. It keeps multi-row inserts well under
+// postgres' limit of 65535 bind parameters per statement.
+const DefaultObjectBatchSize = 1000
+
+// ExistingObjectIDs looks up which of the given cids already have a row in
+// the objects table, and returns the id of the row for each of those. Blocks
+// are content addressed, so an import that shares blocks with content we
+// already have can point its refs at the existing rows instead of recording
+// (and accounting for) the same block again.
+func ExistingObjectIDs(db *gorm.DB, cids []cid.Cid, batchSize int) (map[cid.Cid]uint, error) {
+	if batchSize <= 0 {
+		batchSize = len(cids)
+	}
+
+	out := make(map[cid.Cid]uint)
+	for i := 0; i < len(cids); i += batchSize {
+		end := i + batchSize
+		if end > len(cids) {
+			end = len(cids)
+		}
+
+		keys := make([][]byte, 0, end-i)
+		for _, c := range cids[i:end] {
+			keys = append(keys, c.Bytes())
+		}
+
+		var rows []struct {
+			ID  uint
+			Cid DbCID
+		}
+		if err := db.Table("objects").Select("id, cid").Where("cid in ?", keys).Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+
+		for _, r := range rows {
+			// several rows may exist for a cid from before objects were
+			// shared, any of them will do
+			if _, ok := out[r.Cid.CID]; !ok {
+				out[r.Cid.CID] = r.ID
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// InsertObjectsAndRefs records the objects of a DAG, given by their cids, and
+// refs to them. Blocks that already have an object row, because other content
+// shares them, reuse that row and only get a new ref, so the same bytes
+// aren't accounted for twice, and a block that shows up more than once in the
+// DAG gets a single row and ref. Estuary and the shuttle keep their own
+// object and ref tables, so the rows are created by callbacks:
+// createObjects creates rows for the objects at the given indexes and
+// returns their ids in the same order, createRefs creates a ref to each of
+// the given object ids. It returns the id of the row of every object, in
+// order.
+func InsertObjectsAndRefs(tx *gorm.DB, cids []cid.Cid, batchSize int, createObjects func(idx []int) ([]uint, error), createRefs func(objIDs []uint) error) ([]uint, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultObjectBatchSize
+	}
+
+	existing, err := ExistingObjectIDs(tx, cids, batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// the index of the object each new row is created from
+	first := make(map[cid.Cid]int)
+	var toCreate []int
+	for i, c := range cids {
+		if _, ok := existing[c]; ok {
+			continue
+		}
+		if _, ok := first[c]; ok {
+			continue
+		}
+		first[c] = i
+		toCreate = append(toCreate, i)
+	}
+
+	created := make(map[int]uint, len(toCreate))
+	if len(toCreate) > 0 {
+		newIDs, err := createObjects(toCreate)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range toCreate {
+			created[i] = newIDs[j]
+		}
+	}
+
+	ids := make([]uint, len(cids))
+	refs := make([]uint, 0, len(cids))
+	seen := make(map[uint]bool)
+	for i, c := range cids {
+		if id, ok := existing[c]; ok {
+			ids[i] = id
+		} else {
+			ids[i] = created[first[c]]
+		}
+
+		if seen[ids[i]] {
+			continue
+		}
+		seen[ids[i]] = true
+		refs = append(refs, ids[i])
+	}
+
+	if len(refs) == 0 {
+		return ids, nil
+	}
+	if err := createRefs(refs); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,19 @@
+package util
+
+import (
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// ProposalCid returns the cid of a signed deal proposal, the one miners and
+// the chain know the deal by. Deals are recorded and looked up by it, so it
+// must always be worked out the same way.
+func ProposalCid(prop *market.ClientDealProposal) (cid.Cid, error) {
+	nd, err := cborutil.AsIpld(prop)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("failed to compute deal proposal ipld node: %w", err)
+	}
+	return nd.Cid(), nil
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+func testProposal(t *testing.T) *market.ClientDealProposal {
+	piece, err := cid.Decode("baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq")
+	require.NoError(t, err)
+
+	client, err := address.NewIDAddress(1001)
+	require.NoError(t, err)
+
+	provider, err := address.NewIDAddress(2002)
+	require.NoError(t, err)
+
+	return &market.ClientDealProposal{
+		Proposal: market.DealProposal{
+			PieceCID:             piece,
+			PieceSize:            abi.PaddedPieceSize(2048),
+			VerifiedDeal:         true,
+			Client:               client,
+			Provider:             provider,
+			Label:                "bafkqaaa",
+			StartEpoch:           100000,
+			EndEpoch:             1640000,
+			StoragePricePerEpoch: abi.NewTokenAmount(0),
+			ProviderCollateral:   abi.NewTokenAmount(12345),
+			ClientCollateral:     abi.NewTokenAmount(0),
+		},
+		ClientSignature: crypto.Signature{
+			Type: crypto.SigTypeBLS,
+			Data: []byte("signature"),
+		},
+	}
+}
+
+func TestProposalCid(t *testing.T) {
+	prop := testProposal(t)
+
+	pc, err := ProposalCid(prop)
+	require.NoError(t, err)
+	require.Equal(t, "bafyreih4tpufunnof2x25rxtsxvg6zq6dvmikyhdlgulpoqg5wtf6upzn4", pc.String())
+
+	// any change to the proposal, its signature included, changes the cid
+	prop.ClientSignature.Data = []byte("other signature")
+	other, err := ProposalCid(prop)
+	require.NoError(t, err)
+	require.NotEqual(t, pc, other)
+}
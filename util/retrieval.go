@@ -3,6 +3,7 @@ package util
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -22,6 +23,35 @@ type RetrievalFailureRecord struct {
 type RetrievalProgress struct {
 	Wait   chan struct{}
 	EndErr error
+
+	lk      sync.Mutex
+	stats   *RetrievalStatsSnapshot
+	updated chan struct{}
+}
+
+// SetStats records the latest snapshot of the retrieval and wakes up anyone
+// waiting for it
+func (rp *RetrievalProgress) SetStats(st RetrievalStatsSnapshot) {
+	rp.lk.Lock()
+	defer rp.lk.Unlock()
+
+	rp.stats = &st
+	if rp.updated != nil {
+		close(rp.updated)
+		rp.updated = nil
+	}
+}
+
+// Stats returns the latest snapshot of the retrieval, nil before the first,
+// and a channel that is closed when the next one comes in
+func (rp *RetrievalProgress) Stats() (*RetrievalStatsSnapshot, <-chan struct{}) {
+	rp.lk.Lock()
+	defer rp.lk.Unlock()
+
+	if rp.updated == nil {
+		rp.updated = make(chan struct{})
+	}
+	return rp.stats, rp.updated
 }
 
 type HeartbeatAutoretrieveResponse struct {
@@ -0,0 +1,161 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+// how often RetrieveContentWithStats sends a snapshot
+const RetrievalStatsInterval = time.Second
+
+// RetrievalStatsSnapshot is how a retrieval is going while it runs. The
+// payments are worked out from the proposal's payment schedule, filclient
+// doesn't report them until the retrieval ends.
+type RetrievalStatsSnapshot struct {
+	Miner         string    `json:"miner"`
+	Started       time.Time `json:"started"`
+	BytesReceived uint64    `json:"bytesReceived"`
+	CurrentSpeed  uint64    `json:"currentSpeed"`
+	AverageSpeed  uint64    `json:"averageSpeed"`
+	Payments      int       `json:"payments"`
+	Paid          string    `json:"paid"`
+	Done          bool      `json:"done"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type retrievalStatsTracker struct {
+	miner    address.Address
+	params   retrievalmarket.Params
+	started  time.Time
+	lk       sync.Mutex
+	received uint64
+
+	lastBytes uint64
+	lastTime  time.Time
+}
+
+func (rt *retrievalStatsTracker) progress(received uint64) {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+
+	rt.received = received
+}
+
+func (rt *retrievalStatsTracker) snapshot(now time.Time) RetrievalStatsSnapshot {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+
+	st := RetrievalStatsSnapshot{
+		Miner:         rt.miner.String(),
+		Started:       rt.started,
+		BytesReceived: rt.received,
+	}
+
+	if el := now.Sub(rt.started).Seconds(); el > 0 {
+		st.AverageSpeed = uint64(float64(rt.received) / el)
+	}
+	if el := now.Sub(rt.lastTime).Seconds(); el > 0 && rt.received >= rt.lastBytes {
+		st.CurrentSpeed = uint64(float64(rt.received-rt.lastBytes) / el)
+	}
+	rt.lastBytes = rt.received
+	rt.lastTime = now
+
+	payments, paid := retrievalPaymentsFor(rt.params, rt.received)
+	st.Payments = payments
+	st.Paid = paid.String()
+	return st
+}
+
+// retrievalPaymentsFor works out the payments made by the time received bytes
+// have come in: the unseal price up front, then one payment every payment
+// interval, with the interval growing after each
+func retrievalPaymentsFor(params retrievalmarket.Params, received uint64) (int, abi.TokenAmount) {
+	var payments int
+	paid := big.Zero()
+	if !params.UnsealPrice.Nil() && params.UnsealPrice.GreaterThan(big.Zero()) {
+		payments++
+		paid = params.UnsealPrice
+	}
+
+	if params.PricePerByte.Nil() || params.PricePerByte.IsZero() || params.PaymentInterval == 0 {
+		return payments, paid
+	}
+
+	var paidFor uint64
+	interval := params.PaymentInterval
+	for paidFor+interval <= received {
+		paidFor += interval
+		interval += params.PaymentIntervalIncrease
+		payments++
+	}
+	return payments, big.Add(paid, big.Mul(params.PricePerByte, big.NewIntUnsigned(paidFor)))
+}
+
+// RetrieveContentWithStats runs a retrieval like filclient's
+// RetrieveContentWithProgressCallback, sending a snapshot of how it is going
+// on updates every RetrievalStatsInterval. Snapshots the receiver isn't ready
+// for are dropped, a newer one follows, except the last: it is always sent,
+// marked done, before updates is closed. onProgress may be nil.
+func RetrieveContentWithStats(ctx context.Context, fc *filclient.FilClient, maddr address.Address, proposal *retrievalmarket.DealProposal, onProgress func(uint64), updates chan<- RetrievalStatsSnapshot) (*filclient.RetrievalStats, error) {
+	defer close(updates)
+
+	now := time.Now()
+	rt := &retrievalStatsTracker{
+		miner:    maddr,
+		params:   proposal.Params,
+		started:  now,
+		lastTime: now,
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+
+		ticker := time.NewTicker(RetrievalStatsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				select {
+				case updates <- rt.snapshot(now):
+				default:
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stats, err := fc.RetrieveContentWithProgressCallback(ctx, maddr, proposal, func(received uint64) {
+		rt.progress(received)
+		if onProgress != nil {
+			onProgress(received)
+		}
+	})
+	close(done)
+	<-exited
+
+	last := rt.snapshot(time.Now())
+	last.Done = true
+	if err != nil {
+		last.Error = err.Error()
+	} else {
+		// the final numbers are filclient's own
+		last.BytesReceived = stats.Size
+		last.AverageSpeed = stats.AverageSpeed
+		last.Payments = stats.NumPayments
+		last.Paid = stats.TotalPayment.String()
+	}
+	updates <- last
+
+	return stats, err
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrievalPaymentsFor(t *testing.T) {
+	params := retrievalmarket.Params{
+		PricePerByte:            abi.NewTokenAmount(2),
+		PaymentInterval:         100,
+		PaymentIntervalIncrease: 50,
+		UnsealPrice:             abi.NewTokenAmount(1000),
+	}
+
+	// only the unseal price is paid before any data comes in
+	n, paid := retrievalPaymentsFor(params, 0)
+	require.Equal(t, 1, n)
+	require.Equal(t, abi.NewTokenAmount(1000), paid)
+
+	// intervals of 100, 150, 200: paid for 250 bytes after 300 came in
+	n, paid = retrievalPaymentsFor(params, 300)
+	require.Equal(t, 3, n)
+	require.Equal(t, abi.NewTokenAmount(1000+2*250), paid)
+
+	n, paid = retrievalPaymentsFor(params, 450)
+	require.Equal(t, 4, n)
+	require.Equal(t, abi.NewTokenAmount(1000+2*450), paid)
+
+	// free retrievals make no payments
+	n, paid = retrievalPaymentsFor(retrievalmarket.Params{PricePerByte: big.Zero(), UnsealPrice: big.Zero()}, 1<<20)
+	require.Equal(t, 0, n)
+	require.True(t, paid.IsZero())
+}
+
+func TestRetrievalStatsSnapshot(t *testing.T) {
+	maddr, _ := address.NewIDAddress(1000)
+	start := time.Now()
+	rt := &retrievalStatsTracker{
+		miner:    maddr,
+		params:   retrievalmarket.Params{PricePerByte: big.Zero(), UnsealPrice: big.Zero()},
+		started:  start,
+		lastTime: start,
+	}
+
+	rt.progress(2000)
+	st := rt.snapshot(start.Add(2 * time.Second))
+	require.Equal(t, maddr.String(), st.Miner)
+	require.Equal(t, uint64(2000), st.BytesReceived)
+	require.Equal(t, uint64(1000), st.AverageSpeed)
+	require.Equal(t, uint64(1000), st.CurrentSpeed)
+
+	// current speed is since the last snapshot
+	rt.progress(2500)
+	st = rt.snapshot(start.Add(3 * time.Second))
+	require.Equal(t, uint64(500), st.CurrentSpeed)
+
+	var rp RetrievalProgress
+	cur, updated := rp.Stats()
+	require.Nil(t, cur)
+
+	rp.SetStats(st)
+	select {
+	case <-updated:
+	default:
+		t.Fatal("waiters should be woken by a new snapshot")
+	}
+
+	cur, _ = rp.Stats()
+	require.Equal(t, uint64(2500), cur.BytesReceived)
+}
@@ -0,0 +1,344 @@
+package util
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	"golang.org/x/xerrors"
+)
+
+// how much the files of an archive can add up to past the last size check
+// before the next one, so archives of many small files don't check on every
+// entry
+const tarSizeCheckStep = 64 << 20
+
+// InvalidTarError is returned when an archive can't be read or has entries
+// that can't be represented in unixfs, so that callers can tell bad uploads
+// apart from failures on our end
+type InvalidTarError struct {
+	Err error
+}
+
+func (e *InvalidTarError) Error() string {
+	return fmt.Sprintf("invalid tar archive: %s", e.Err)
+}
+
+func (e *InvalidTarError) Unwrap() error {
+	return e.Err
+}
+
+func invalidTar(format string, args ...interface{}) error {
+	return &InvalidTarError{Err: fmt.Errorf(format, args...)}
+}
+
+// tarDir is a directory of the archive being imported. Files are imported as
+// soon as they are read, only their links are kept until the directories are
+// built at the end.
+type tarDir struct {
+	dirs  map[string]*tarDir
+	links map[string]*ipld.Link
+}
+
+func newTarDir() *tarDir {
+	return &tarDir{
+		dirs:  make(map[string]*tarDir),
+		links: make(map[string]*ipld.Link),
+	}
+}
+
+// mkdirs returns the directory at the path, creating it and its parents
+func (d *tarDir) mkdirs(p string) (*tarDir, error) {
+	if p == "" || p == "." {
+		return d, nil
+	}
+
+	for _, seg := range strings.Split(p, "/") {
+		if _, ok := d.links[seg]; ok {
+			return nil, invalidTar("%s is both a file and a directory", p)
+		}
+
+		sub, ok := d.dirs[seg]
+		if !ok {
+			sub = newTarDir()
+			d.dirs[seg] = sub
+		}
+		d = sub
+	}
+	return d, nil
+}
+
+// add puts a link to an imported file or symlink at the path, replacing any
+// earlier entry for it as tar does
+func (d *tarDir) add(p string, l *ipld.Link) error {
+	parent, err := d.mkdirs(path.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	name := path.Base(p)
+	if _, ok := parent.dirs[name]; ok {
+		return invalidTar("%s is both a file and a directory", p)
+	}
+
+	parent.links[name] = l
+	return nil
+}
+
+func (d *tarDir) find(p string) *ipld.Link {
+	parent := d
+	if dir := path.Dir(p); dir != "." {
+		for _, seg := range strings.Split(dir, "/") {
+			parent = parent.dirs[seg]
+			if parent == nil {
+				return nil
+			}
+		}
+	}
+	return parent.links[path.Base(p)]
+}
+
+// build adds the directory's node and those of its subdirectories to the
+// dag. Directories too large for one block are sharded into a HAMT, like
+// go-unixfs does on its own.
+func (d *tarDir) build(ctx context.Context, dserv ipld.DAGService, prefix cid.Builder) (ipld.Node, error) {
+	dir := uio.NewDirectory(dserv)
+	dir.SetCidBuilder(prefix)
+
+	names := make([]string, 0, len(d.dirs)+len(d.links))
+	for name := range d.dirs {
+		names = append(names, name)
+	}
+	for name := range d.links {
+		names = append(names, name)
+	}
+	// links go in name order, so the same archive always gives the same cid
+	sort.Strings(names)
+
+	for _, name := range names {
+		var child ipld.Node
+		var err error
+		if l, ok := d.links[name]; ok {
+			// only the links of files were kept, the directory wants their
+			// root nodes
+			child, err = dserv.Get(ctx, l.Cid)
+		} else {
+			child, err = d.dirs[name].build(ctx, dserv, prefix)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := dir.AddChild(ctx, name, child); err != nil {
+			return nil, err
+		}
+	}
+
+	nd, err := dir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dserv.Add(ctx, nd); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+// cleanTarPath turns an entry name into a path relative to the archive's
+// root, refusing names that would climb out of it
+func cleanTarPath(name string) (string, error) {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return "", nil
+	}
+
+	// path.Clean of a rooted path never leaves "..", but check the raw name
+	// so that archives that try it are refused rather than quietly fixed
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." {
+			return "", invalidTar("entry %q is outside of the archive", name)
+		}
+	}
+	return p[1:], nil
+}
+
+// ImportTar imports a tar archive, compressed with gzip or not, as a unixfs
+// directory with the archive's paths as its structure. The archive is read
+// as a stream and each file is imported as it is read, blocks are written to
+// dserv within the limits. Symlinks become unixfs symlinks, hard links point
+// at the file they link to.
+//
+// If checkSize isn't nil it is called with the size of the archive's files
+// read so far as they grow, and once more with their total, and the import
+// stops if it fails. Its error is returned as is.
+func ImportTar(ctx context.Context, dserv ipld.DAGService, r io.Reader, limits ImportLimits, checkSize func(size int64) error) (ipld.Node, error) {
+	br := bufio.NewReader(r)
+
+	var tr *tar.Reader
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, &InvalidTarError{Err: err}
+		}
+		defer gz.Close()
+
+		tr = tar.NewReader(gz)
+	} else {
+		tr = tar.NewReader(br)
+	}
+
+	prefix, err := merkledag.PrefixForCidVersion(1)
+	if err != nil {
+		return nil, err
+	}
+	prefix.MhType = DefaultHashFunction
+
+	bd := newBufferedDAGService(ctx, dserv, limits)
+	root := newTarDir()
+
+	var entries int
+	var size, checked int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &InvalidTarError{Err: err}
+		}
+		entries++
+
+		p, err := cleanTarPath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		// only the root directory itself has no name
+		if p == "" && hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeXGlobalHeader {
+			return nil, invalidTar("entry %q has no name", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if _, err := root.mkdirs(p); err != nil {
+				return nil, err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			// the header has the size of the file before it is read, and a
+			// compressed archive can hold far more than its own size
+			size += hdr.Size
+			if checkSize != nil && size-checked >= tarSizeCheckStep {
+				if err := checkSize(size); err != nil {
+					return nil, err
+				}
+				checked = size
+			}
+
+			nd, err := ImportFile(bd, tr)
+			if err != nil {
+				return nil, err
+			}
+
+			fsize, err := nd.Size()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := root.add(p, &ipld.Link{Size: fsize, Cid: nd.Cid()}); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			data, err := unixfs.SymlinkData(hdr.Linkname)
+			if err != nil {
+				return nil, err
+			}
+
+			nd := merkledag.NodeWithData(data)
+			nd.SetCidBuilder(prefix)
+
+			if err := bd.Add(ctx, nd); err != nil {
+				return nil, err
+			}
+
+			fsize, err := nd.Size()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := root.add(p, &ipld.Link{Size: fsize, Cid: nd.Cid()}); err != nil {
+				return nil, err
+			}
+		case tar.TypeLink:
+			target, err := cleanTarPath(hdr.Linkname)
+			if err != nil {
+				return nil, err
+			}
+
+			l := root.find(target)
+			if l == nil {
+				return nil, invalidTar("hard link %q points at %q, which is not an earlier file in the archive", hdr.Name, hdr.Linkname)
+			}
+
+			if err := root.add(p, l); err != nil {
+				return nil, err
+			}
+		case tar.TypeXGlobalHeader:
+			// archive wide metadata, nothing to import
+		default:
+			return nil, invalidTar("entry %q is of a type unixfs can't hold (%q)", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	if entries == 0 {
+		return nil, invalidTar("archive is empty")
+	}
+
+	if checkSize != nil {
+		if err := checkSize(size); err != nil {
+			return nil, err
+		}
+	}
+
+	nd, err := root.build(ctx, bd, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bd.bb.commit(); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+// ImportTarUpload imports a tar archive uploaded to us with ImportTar, for
+// both estuary and shuttles. checkSize is given the size of the files in the
+// archive rather than that of the upload. Archives that can't be imported are
+// reported as bad requests.
+func ImportTarUpload(ctx context.Context, dserv ipld.DAGService, r io.Reader, limits ImportLimits, checkSize func(size int64) error) (ipld.Node, error) {
+	nd, err := ImportTar(ctx, dserv, r, limits, checkSize)
+	if err != nil {
+		var terr *InvalidTarError
+		if xerrors.As(err, &terr) {
+			return nil, &HttpError{
+				Code:    http.StatusBadRequest,
+				Message: ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		return nil, err
+	}
+	return nd, nil
+}
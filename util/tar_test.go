@@ -0,0 +1,214 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	unixfspb "github.com/ipfs/go-unixfs/pb"
+	"github.com/stretchr/testify/require"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	data []byte
+}
+
+func makeTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write(e.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func tarFile(name string, data []byte) tarEntry {
+	return tarEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg}, data: data}
+}
+
+func tarDirEntry(name string) tarEntry {
+	return tarEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}}
+}
+
+func lookupPath(t *testing.T, ctx context.Context, dserv ipld.DAGService, nd ipld.Node, segs ...string) ipld.Node {
+	for _, seg := range segs {
+		dir, err := uio.NewDirectoryFromNode(dserv, nd)
+		require.NoError(t, err)
+		nd, err = dir.Find(ctx, seg)
+		require.NoError(t, err, seg)
+	}
+	return nd
+}
+
+func TestImportTar(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	// big enough to be split into several blocks
+	big := bytes.Repeat([]byte("dataset"), 500000)
+	archive := makeTar(t, []tarEntry{
+		tarDirEntry("./data/"),
+		tarFile("./data/readme.txt", []byte("hello")),
+		tarFile("data/sub/big.bin", big),
+		tarDirEntry("data/empty/"),
+		{hdr: tar.Header{Name: "data/latest", Typeflag: tar.TypeSymlink, Linkname: "sub/big.bin"}},
+		{hdr: tar.Header{Name: "data/copy.txt", Typeflag: tar.TypeLink, Linkname: "./data/readme.txt"}},
+	})
+
+	nd, err := ImportTar(ctx, dserv, bytes.NewReader(archive), ImportLimits{MaxBlocks: 2, MaxBytes: 1 << 20}, nil)
+	require.NoError(t, err)
+
+	readFile := func(segs ...string) []byte {
+		f := lookupPath(t, ctx, dserv, nd, segs...)
+		r, err := uio.NewDagReader(ctx, f, dserv)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return data
+	}
+
+	require.Equal(t, []byte("hello"), readFile("data", "readme.txt"))
+	require.Equal(t, []byte("hello"), readFile("data", "copy.txt"))
+	require.Equal(t, big, readFile("data", "sub", "big.bin"))
+
+	empty := lookupPath(t, ctx, dserv, nd, "data", "empty")
+	dir, err := uio.NewDirectoryFromNode(dserv, empty)
+	require.NoError(t, err)
+	links, err := dir.Links(ctx)
+	require.NoError(t, err)
+	require.Empty(t, links)
+
+	sym := lookupPath(t, ctx, dserv, nd, "data", "latest")
+	fsn, err := unixfs.ExtractFSNode(sym)
+	require.NoError(t, err)
+	require.Equal(t, unixfs.TSymlink, fsn.Type())
+	require.Equal(t, []byte("sub/big.bin"), fsn.Data())
+
+	require.Equal(t, "inode/directory", func() string {
+		mt, err := DetectMimeType(ctx, dserv, nd.Cid())
+		require.NoError(t, err)
+		return mt
+	}())
+
+	// the same archive gzipped imports to the same dag
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err = gw.Write(archive)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	gnd, err := ImportTar(ctx, dserv, &gz, DefaultImportLimits, nil)
+	require.NoError(t, err)
+	require.Equal(t, nd.Cid(), gnd.Cid())
+}
+
+func TestImportTarInvalid(t *testing.T) {
+	ctx := context.Background()
+	dserv := merkledag.NewDAGService(blockservice.New(blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore())), nil))
+
+	bad := map[string][]byte{
+		"escape":    makeTar(t, []tarEntry{tarFile("../etc/passwd", []byte("x"))}),
+		"empty":     makeTar(t, nil),
+		"file dir":  makeTar(t, []tarEntry{tarFile("a", []byte("x")), tarFile("a/b", []byte("y"))}),
+		"dangling":  makeTar(t, []tarEntry{{hdr: tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"}}}),
+		"fifo":      makeTar(t, []tarEntry{{hdr: tar.Header{Name: "p", Typeflag: tar.TypeFifo}}}),
+		"not a tar": bytes.Repeat([]byte("nope"), 200),
+	}
+	for name, archive := range bad {
+		_, err := ImportTar(ctx, dserv, bytes.NewReader(archive), DefaultImportLimits, nil)
+		var terr *InvalidTarError
+		require.ErrorAs(t, err, &terr, name)
+	}
+}
+
+func TestImportTarUpload(t *testing.T) {
+	ctx := context.Background()
+	dserv := merkledag.NewDAGService(blockservice.New(blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore())), nil))
+
+	_, err := ImportTarUpload(ctx, dserv, bytes.NewReader(makeTar(t, nil)), DefaultImportLimits, nil)
+	var herr *HttpError
+	require.ErrorAs(t, err, &herr)
+	require.Equal(t, http.StatusBadRequest, herr.Code)
+
+	// zeros compress to next to nothing, the check gets what the files
+	// really add up to
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err = gw.Write(makeTar(t, []tarEntry{
+		tarFile("a", make([]byte, tarSizeCheckStep)),
+		tarFile("b", make([]byte, 1000)),
+	}))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	require.Less(t, gz.Len(), 1<<20)
+
+	var checked []int64
+	full := &HttpError{Code: http.StatusInsufficientStorage, Message: ERR_BLOCKSTORE_FULL}
+	_, err = ImportTarUpload(ctx, dserv, bytes.NewReader(gz.Bytes()), DefaultImportLimits, func(size int64) error {
+		checked = append(checked, size)
+		if size > tarSizeCheckStep {
+			return full
+		}
+		return nil
+	})
+	require.Equal(t, full, err)
+	require.Equal(t, []int64{tarSizeCheckStep, tarSizeCheckStep + 1000}, checked)
+}
+
+func TestImportTarSharded(t *testing.T) {
+	ctx := context.Background()
+	dserv := merkledag.NewDAGService(blockservice.New(blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore())), nil))
+
+	// shard at a size a test can reach
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 1024
+
+	var entries []tarEntry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, tarFile(fmt.Sprintf("big/file-%03d", i), []byte(fmt.Sprint(i))))
+	}
+	entries = append(entries, tarFile("small/only", []byte("x")))
+
+	nd, err := ImportTar(ctx, dserv, bytes.NewReader(makeTar(t, entries)), DefaultImportLimits, nil)
+	require.NoError(t, err)
+
+	fsType := func(nd ipld.Node) unixfspb.Data_DataType {
+		fsn, err := unixfs.ExtractFSNode(nd)
+		require.NoError(t, err)
+		return fsn.Type()
+	}
+
+	require.Equal(t, unixfs.THAMTShard, fsType(lookupPath(t, ctx, dserv, nd, "big")))
+	require.Equal(t, unixfs.TDirectory, fsType(lookupPath(t, ctx, dserv, nd, "small")))
+
+	f := lookupPath(t, ctx, dserv, nd, "big", "file-042")
+	r, err := uio.NewDagReader(ctx, f, dserv)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("42"), data)
+}
@@ -1,10 +1,13 @@
 package util
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-cidutil"
 	chunker "github.com/ipfs/go-ipfs-chunker"
 	ipld "github.com/ipfs/go-ipld-format"
@@ -12,6 +15,7 @@ import (
 	unixfs "github.com/ipfs/go-unixfs"
 	"github.com/ipfs/go-unixfs/importer/balanced"
 	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
 	mh "github.com/multiformats/go-multihash"
 )
 
@@ -62,3 +66,45 @@ func TryExtractFSNode(nd ipld.Node) (*unixfs.FSNode, error) {
 	}
 	return nil, errors.New("unknown node type")
 }
+
+// DirectoryMimeType is the media type recorded for unixfs directories
+const DirectoryMimeType = "inode/directory"
+
+// how much of a file http.DetectContentType looks at
+const mimeSniffLen = 512
+
+// DetectMimeType sniffs the media type of the unixfs file at root from its
+// first bytes, directories get DirectoryMimeType. Anything that isn't unixfs
+// has no media type and an empty string is returned.
+func DetectMimeType(ctx context.Context, dserv ipld.NodeGetter, root cid.Cid) (string, error) {
+	nd, err := dserv.Get(ctx, root)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := nd.(*merkledag.ProtoNode); ok {
+		fsn, err := TryExtractFSNode(nd)
+		if err != nil {
+			return "", nil
+		}
+
+		if fsn.IsDir() {
+			return DirectoryMimeType, nil
+		}
+	} else if _, ok := nd.(*merkledag.RawNode); !ok {
+		return "", nil
+	}
+
+	dr, err := uio.NewDagReader(ctx, nd, dserv)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, mimeSniffLen)
+	n, err := io.ReadFull(dr, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	return http.DetectContentType(buf[:n]), nil
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectMimeType(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	detect := func(data []byte) string {
+		nd, err := ImportFile(dserv, bytes.NewReader(data))
+		require.NoError(t, err)
+
+		mt, err := DetectMimeType(ctx, dserv, nd.Cid())
+		require.NoError(t, err)
+		return mt
+	}
+
+	require.Equal(t, "image/png", detect([]byte("\x89PNG\x0D\x0A\x1A\x0A and then some pixels")))
+	require.Equal(t, "text/html; charset=utf-8", detect([]byte("<!DOCTYPE html><html></html>")))
+	// big enough to be split into several blocks
+	require.Equal(t, "application/pdf", detect(append([]byte("%PDF-1.4\n"), make([]byte, 3*1024*1024)...)))
+
+	dir := unixfs.EmptyDirNode()
+	require.NoError(t, dserv.Add(ctx, dir))
+	mt, err := DetectMimeType(ctx, dserv, dir.Cid())
+	require.NoError(t, err)
+	require.Equal(t, DirectoryMimeType, mt)
+}